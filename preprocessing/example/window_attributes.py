@@ -8,64 +8,79 @@ import csv
 from scipy import stats
 
 
-def load_video_flow_packets(file_path: str) -> dict:
+def field(obj: dict, name: str, legacy_name: str, default=None):
+    # outputs name fields in lowerCamel case, or with Go names with -legacy-names and before schema version 3
+    return obj.get(name, obj.get(legacy_name, default))
+
+
+def load_video_flow_packets(file_path: str) -> tuple[dict, str]:
     packet_data = json.load(open(file_path, 'r'))
+    # treatment of zero-payload packets (-zero-payload), outputs from before it was configurable kept them
+    zero_payload_mode = 'keep'
+    meta = field(packet_data, 'meta', 'Meta')
+    if meta is not None:
+        zero_payload_mode = field(meta, 'zeroPayload', 'ZeroPayload') or 'keep'
+        # outputs with a meta block keep the flow map under "flows"
+        packet_data = field(packet_data, 'flows', 'Flows')
     dns_name_pattern = re.compile(r'^\d+(?:-\d+)*\.pnt\.geforcenow\.nvidiagrid\.net$')
     for flow in packet_data.values():
-        if flow['Protocol'] == 6:
+        if field(flow, 'protocol', 'Protocol') == 6:
             # ignore TCP flows
             continue
-        if flow['RemotePort'] < 10000 or flow['RemotePort']> 20000:
+        if field(flow, 'remotePort', 'RemotePort') < 10000 or field(flow, 'remotePort', 'RemotePort')> 20000:
             # GFN servers use ports between 10000 and 20000
             continue
-        if flow['LocalPort'] == 49005:
+        if field(flow, 'localPort', 'LocalPort') == 49005:
             # fixed port used for video streams on native GFN apps
-            return flow
-        if re.match(dns_name_pattern, flow['DNSName']):
+            return flow, zero_payload_mode
+        if re.match(dns_name_pattern, field(flow, 'dnsName', 'DNSName', '')):
             # DNS names for video flows typically follow the pattern of "hyphen-separated-ip-address.pnt.geforcenow.nvidiagrid.net"
-            if len(flow['Packets']) > 10000:
+            if len(field(flow, 'packets', 'Packets')) > 10000:
                 # ignore short flows, likely false positives
-                return flow
-    return None
+                return flow, zero_payload_mode
+    return None, zero_payload_mode
 
 
-def get_base_window_stats(file_path: str, window_size: float, first_n_seconds: float) -> dict[str, list[list[int|float]]]:
+def get_base_window_stats(file_path: str, window_size: float, first_n_seconds: float) -> dict[str, list[list[int|float]] | str]:
     if os.path.isdir(file_path):
         file_path = os.path.join(file_path, os.path.dirname(file_path).split('/')[-1] + '_packetStats.json')
-    flow = load_video_flow_packets(file_path)
+    flow, zero_payload_mode = load_video_flow_packets(file_path)
     if flow is None:
         raise ValueError("No video flow found in file")
     
-    base_window_stats = {'PayloadSizes': [], 'InterArrivalTimes': []}
+    base_window_stats = {'PayloadSizes': [], 'InterArrivalTimes': [], 'ZeroPayloadMode': zero_payload_mode}
     num_windows = int(first_n_seconds / window_size)
     while len(base_window_stats['PayloadSizes']) <= num_windows:
         base_window_stats['PayloadSizes'].append([])
         base_window_stats['InterArrivalTimes'].append([])
     
-    base_timestamp = flow['Packets'][0]['Timestamp']    # UNIX microsecond timestamp
+    packets = field(flow, 'packets', 'Packets')
+    base_timestamp = field(packets[0], 'timestamp', 'Timestamp')    # UNIX microsecond timestamp
     prev_timestamp = None
     
-    for packet in flow['Packets']:
-        if packet['Upstream']:
+    for packet in packets:
+        if field(packet, 'upstream', 'Upstream'):
             # skip upstream packets in video flows
             continue
-        packet['Timestamp'] -= base_timestamp
-        packet['Timestamp'] /= 1e6    # convert to seconds
+        if zero_payload_mode != 'keep' and field(packet, 'payloadSize', 'PayloadSize') == 0:
+            # left out of size and inter-arrival statistics with -zero-payload exclude-stats or aggregate
+            continue
+        timestamp = (field(packet, 'timestamp', 'Timestamp') - base_timestamp) / 1e6    # convert to seconds
         # only consider packets within the first n seconds
-        if packet['Timestamp'] > first_n_seconds:
+        if timestamp > first_n_seconds:
             break
         
         # determine which window this packet belongs to
-        window_idx = int(packet['Timestamp'] / window_size)    
+        window_idx = int(timestamp / window_size)    
         # calculate inter-arrival time, skip for first packet in each window
         if len(base_window_stats['PayloadSizes'][window_idx]) > 0:
-            inter_arrival = packet['Timestamp'] - prev_timestamp
+            inter_arrival = timestamp - prev_timestamp
             base_window_stats['InterArrivalTimes'][window_idx].append(inter_arrival)
         # add payload size to current window
-        base_window_stats['PayloadSizes'][window_idx].append(packet['PayloadSize'])
+        base_window_stats['PayloadSizes'][window_idx].append(field(packet, 'payloadSize', 'PayloadSize'))
         
         # update previous timestamp for next iteration
-        prev_timestamp = packet['Timestamp']
+        prev_timestamp = timestamp
     
     return base_window_stats
 
@@ -76,6 +91,7 @@ def generate_window_attributes(file_path: str, window_size: float = 1.0, first_n
     For each window, 17 attributes are generated based on the packet count, payload sizes, and inter-arrival times,
     using statistical functions including sum, mean, med, min, max, std, kurtosis, skew,
     and are named as ct_sum_<window_idx>, sz_sum_<window_idx>, sz_mean_<window_idx>..., it_kurtosis_<window_idx>, it_skew_<window_idx>.
+    They follow zero_payload_mode, the treatment of zero-payload packets the json file was extracted with, added as the last column.
     """
     if first_n_seconds % window_size != 0:
         raise ValueError("First n seconds must be a multiple of window size")
@@ -131,6 +147,8 @@ def generate_window_attributes(file_path: str, window_size: float = 1.0, first_n
             window_attributes[f'it_kurtosis_{window_idx}'] = 0
             window_attributes[f'it_skew_{window_idx}'] = 0
     
+    # recorded after the features so attributes extracted with different -zero-payload modes are not mixed unnoticed
+    window_attributes['zero_payload_mode'] = base_window_stats['ZeroPayloadMode']
     return window_attributes
 
 
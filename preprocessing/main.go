@@ -1,62 +1,125 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"io/fs"
 	"os"
-	"path/filepath"
-	"strings"
-	"sync"
+
+	"preprocessing/pktstats"
 )
 
-func dataMain(basePath string) {
-	var filePath, outPath string
-
-	// Create a semaphore with a capacity of 24 to limit the number of concurrent goroutines
-	semaphore := make(chan struct{}, 24)
-	var wg sync.WaitGroup
-
-	err := filepath.WalkDir(basePath, func(path string, d fs.DirEntry, err error) error {
-		// check for pcapng files
-		if filepath.Ext(path) == ".pcapng" {
-			if err != nil {
-				fmt.Println("Error walking the path:", err)
-				return err
-			}
-
-			filePath = path
-			outPath = strings.Replace(path, ".pcapng", "_packetStats.json", 1)
-			// Check if the output file already exists
-			if _, err := os.Stat(outPath); err == nil {
-				fmt.Printf("Output file %s already exists, skipping...\n", outPath)
-				return nil
-			}
-
-			// Acquire a token from the semaphore before starting a new goroutine
-			semaphore <- struct{}{}
-			wg.Add(1)
-			go func(filePath, outPath string) {
-				defer wg.Done()
-				defer func() { <-semaphore }() // Release the token back to the semaphore when done
-				ExtractPacketStats(filePath, outPath, 0)
-			}(filePath, outPath)
-		}
-		return nil
-	})
-	if err != nil {
-		fmt.Println("Error walking the path:", err)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "summarize" {
+		pktstats.SummarizeMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dedupe" {
+		pktstats.DedupeMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		pktstats.ReportMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "index" {
+		pktstats.IndexMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		pktstats.VerifyMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "init-db" {
+		pktstats.InitDBMain(os.Args[2:])
 		return
 	}
 
-	// Wait for all goroutines to complete
-	wg.Wait()
-}
+	// serve takes the flags of a run, the defaults of the options of its requests
+	serve := len(os.Args) > 1 && os.Args[1] == "serve"
+	if serve {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	// so does correlate, the options of the captures it extracts
+	correlate := len(os.Args) > 1 && os.Args[1] == "correlate"
+	if correlate {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 
-func main() {
 	var basePath string
+	var opts pktstats.Options
+	var correlation pktstats.CorrelateSettings
+	var printVersion, printConfig, checkOnly bool
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "JSON file of the base path and options of a run, as printed by -print-config; flags passed as well override it")
+	flag.BoolVar(&printConfig, "print-config", false, "Print the resolved configuration of the run in the -config format and exit")
+	flag.BoolVar(&checkOnly, "check-inputs", false, "Validate the sidecar inputs (telemetry list, remote prefixes, CGNAT log, reverse DNS cache, geo databases, override files), report all problems and exit; runs always refuse to start with invalid ones")
 	flag.StringVar(&basePath, "p", "../data/", "Base path to the data directory")
+	flag.BoolVar(&printVersion, "version", false, "Print version information and exit")
+	opts.RegisterFlags(flag.CommandLine)
+	correlation.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	dataMain(basePath)
+	if printVersion {
+		fmt.Println(pktstats.BuildVersion())
+		return
+	}
+	if configPath != "" {
+		if err := pktstats.LoadConfig(configPath, flag.CommandLine, &basePath, &opts); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	// the flags hold the values of the config file too
+	opts.HashFlags(flag.CommandLine)
+
+	// before the options parsing them, so that all their problems are reported at once
+	if problems := pktstats.CheckInputs(basePath, opts); len(problems) > 0 && !printConfig {
+		fmt.Printf("%d problems in sidecar inputs:\n", len(problems))
+		for _, problem := range problems {
+			fmt.Println(" ", problem)
+		}
+		os.Exit(1)
+	} else if checkOnly {
+		fmt.Println("Sidecar inputs are valid")
+		return
+	}
+	if err := opts.ValidateExtraction(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if correlate && !printConfig {
+		pktstats.CorrelateMain(flag.Args(), opts, correlation)
+		return
+	}
+	if err := opts.ValidateRun(serve); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if printConfig {
+		fmt.Println(pktstats.ResolvedConfig(basePath, opts, true))
+		return
+	}
+	fmt.Println("Configuration:", pktstats.ResolvedConfig(basePath, opts, false))
+
+	if opts.InputList != "" || opts.File != "" {
+		// aggregate stats, caches and the manifest of the run
+		basePath = opts.OutputDir
+	}
+	if opts.DryRun {
+		if pktstats.DryRun(basePath, opts) == 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if serve {
+		pktstats.ServeMain(basePath, opts)
+		return
+	}
+	if err := pktstats.Run(basePath, opts); errors.Is(err, pktstats.ErrOutputLimit) {
+		os.Exit(pktstats.ExitOutputLimit)
+	} else if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,153 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// unlabeledService is the rollup key for flows without a DNS name.
+const unlabeledService = "unlabeled"
+
+// ServiceStats is the traffic rolled up for one service, keyed by registered domain.
+type ServiceStats struct {
+	Flows          int   `json:"flows"`
+	Packets        int   `json:"packets"`
+	Bytes          int64 `json:"bytes"`
+	StreamingBytes int64 `json:"streamingBytes"` // bytes of flows not classified as bulk downloads or voice
+	BulkBytes      int64 `json:"bulkBytes"`      // bytes of bulk download flows
+	VoiceBytes     int64 `json:"voiceBytes"`     // bytes of upstream voice chat flows, see classifyVoice
+	// idle connections, see classifyIdleConnections, counted apart from the other flows and their bytes
+	IdleConnections     int   `json:"idleConnections,omitempty"`
+	IdleConnectionBytes int64 `json:"idleConnectionBytes,omitempty"`
+	// abandoned flows of connection races, see assignRacePairs, counted in bytes but not as flows
+	RacedLosers int `json:"racedLosers,omitempty"`
+	// flows per connection Outcome, for TCP and QUIC flows
+	Outcomes map[string]int `json:"outcomes,omitempty"`
+}
+
+// AggregateStats collects the per-service rollups of all files processed in a run.
+type AggregateStats struct {
+	mu       sync.Mutex
+	Files    int                                 `json:"files"`
+	Services map[string]*ServiceStats            `json:"services"`
+	Clients  map[string]map[string]*ServiceStats `json:"clients,omitempty"`
+}
+
+// serviceRollup sums the flows of a file per registered domain.
+func serviceRollup(flowMap map[string]*Flow) map[string]*ServiceStats {
+	services := make(map[string]*ServiceStats)
+	for _, flow := range flowMap {
+		if flow.ServiceFlowType == telemetryRole || flow.ServiceFlowType == managementRole {
+			continue
+		}
+		key := flow.RegisteredDomain
+		if key == "" {
+			key = unlabeledService
+		}
+		stats, ok := services[key]
+		if !ok {
+			stats = &ServiceStats{}
+			services[key] = stats
+		}
+		packets, bytes := flow.totals()
+		if flow.TrafficClass == idleConnectionClass {
+			stats.IdleConnections++
+			stats.IdleConnectionBytes += bytes
+			continue
+		}
+		if flow.TrafficClass == racedLoserClass {
+			stats.RacedLosers++
+		} else {
+			stats.Flows++
+		}
+		if flow.Outcome != "" && flow.TrafficClass != racedLoserClass {
+			if stats.Outcomes == nil {
+				stats.Outcomes = make(map[string]int)
+			}
+			stats.Outcomes[flow.Outcome]++
+		}
+		stats.Packets += packets
+		stats.Bytes += bytes
+		switch {
+		case flow.TrafficClass == bulkDownloadClass:
+			stats.BulkBytes += bytes
+		case flow.ServiceFlowType == voiceRole:
+			stats.VoiceBytes += bytes
+		default:
+			stats.StreamingBytes += bytes
+		}
+	}
+	return services
+}
+
+// add merges the rollup of one file into the aggregate; safe for concurrent use.
+func (agg *AggregateStats) add(meta *Meta) {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	if agg.Services == nil {
+		agg.Services = make(map[string]*ServiceStats)
+	}
+	agg.Files++
+	mergeServiceStats(agg.Services, meta.Services)
+	for client, services := range meta.Clients {
+		if agg.Clients == nil {
+			agg.Clients = make(map[string]map[string]*ServiceStats)
+		}
+		if agg.Clients[client] == nil {
+			agg.Clients[client] = make(map[string]*ServiceStats)
+		}
+		mergeServiceStats(agg.Clients[client], services)
+	}
+}
+
+func mergeServiceStats(totals, services map[string]*ServiceStats) {
+	for key, stats := range services {
+		total, ok := totals[key]
+		if !ok {
+			total = &ServiceStats{}
+			totals[key] = total
+		}
+		total.Flows += stats.Flows
+		total.Packets += stats.Packets
+		total.Bytes += stats.Bytes
+		total.StreamingBytes += stats.StreamingBytes
+		total.BulkBytes += stats.BulkBytes
+		total.VoiceBytes += stats.VoiceBytes
+		total.IdleConnections += stats.IdleConnections
+		total.IdleConnectionBytes += stats.IdleConnectionBytes
+		total.RacedLosers += stats.RacedLosers
+		for outcome, flows := range stats.Outcomes {
+			if total.Outcomes == nil {
+				total.Outcomes = make(map[string]int)
+			}
+			total.Outcomes[outcome] += flows
+		}
+	}
+}
+
+// telemetryTotals sums the packets and bytes of telemetry flows.
+func telemetryTotals(flowMap map[string]*Flow) (packets, bytes int64) {
+	for _, flow := range flowMap {
+		if flow.ServiceFlowType != telemetryRole {
+			continue
+		}
+		flowPackets, flowBytes := flow.totals()
+		packets += int64(flowPackets)
+		bytes += flowBytes
+	}
+	return packets, bytes
+}
+
+func (agg *AggregateStats) write(path string, legacyNames bool) error {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	jsonString, err := json.MarshalIndent(agg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if legacyNames {
+		jsonString = withLegacyNames(jsonString)
+	}
+	return os.WriteFile(path, jsonString, 0644)
+}
@@ -0,0 +1,174 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// answerSetWindow is how long after a response its answer set labels the flows of its client
+	answerSetWindow = 5 * time.Minute
+	// maxAnswerSets caps the answer sets recorded in a DNS map
+	maxAnswerSets = 50000
+	// maxAnswerSetRefs caps the answer sets indexed per address, the oldest are dropped
+	maxAnswerSetRefs = 64
+)
+
+// DNSAnswerSet is the set of addresses one DNS response answered to a local
+// client for a query name. Round-robin and CDN names answer several
+// addresses at once, and the same address under several names: the set a
+// client resolved last says which name it connected to.
+type DNSAnswerSet struct {
+	Client string   `json:"client"` // destination of the response
+	Time   int64    `json:"time"`   // Unix time of the response in µs
+	IPs    []string `json:"ips"`    // addresses of the A and AAAA answers
+}
+
+// dnsAnswerSets are the answer sets of the responses of a capture, by
+// normalized query name, in order of arrival.
+type dnsAnswerSets map[string][]DNSAnswerSet
+
+// dnsMapFile is the content of dns_map.json. Files written before answer
+// sets were recorded hold only the names, as a flat object.
+type dnsMapFile struct {
+	Names      map[string]string `json:"names"`
+	AnswerSets dnsAnswerSets     `json:"answerSets"`
+}
+
+// readDNSMapFile reads a dns_map.json, in either format.
+func readDNSMapFile(path string) (map[string]string, dnsAnswerSets, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, nil, err
+	}
+	if names, ok := fields["names"]; ok && len(names) > 0 && names[0] == '{' {
+		var file dnsMapFile
+		if err := json.Unmarshal(content, &file); err != nil {
+			return nil, nil, err
+		}
+		if file.Names == nil {
+			file.Names = make(map[string]string)
+		}
+		return file.Names, file.AnswerSets, nil
+	}
+	dnsMap := make(map[string]string)
+	if err := json.Unmarshal(content, &dnsMap); err != nil {
+		return nil, nil, err
+	}
+	return dnsMap, nil, nil
+}
+
+// responseAnswerSets returns the answer sets of a DNS response by name. The
+// addresses of the name queried, directly or through its CNAME chain, are
+// the set of that name; other addresses in the response form sets of their
+// own names. Names that are invalid are left out.
+func responseAnswerSets(client string, dns *layers.DNS, timestamp time.Time) map[string]DNSAnswerSet {
+	if !dns.QR {
+		return nil
+	}
+	// the names of the chain of the query, to the name it resolves from
+	chain := make(map[string]string)
+	if len(dns.Questions) > 0 {
+		if query, ok := normalizeDNSName(string(dns.Questions[0].Name)); ok {
+			chain[query] = query
+			for extended := true; extended; {
+				extended = false
+				for _, answer := range dns.Answers {
+					name, _ := normalizeDNSName(string(answer.Name))
+					target, ok := normalizeDNSName(string(answer.CNAME))
+					if _, seen := chain[target]; answer.Type == layers.DNSTypeCNAME && ok && !seen && chain[name] != "" {
+						chain[target], extended = chain[name], true
+					}
+				}
+			}
+		}
+	}
+	var sets map[string]DNSAnswerSet
+	for _, answer := range dns.Answers {
+		if answer.Type != layers.DNSTypeA && answer.Type != layers.DNSTypeAAAA {
+			continue
+		}
+		name, ok := normalizeDNSName(string(answer.Name))
+		if !ok {
+			continue
+		}
+		if query, ok := chain[name]; ok {
+			name = query
+		}
+		if sets == nil {
+			sets = make(map[string]DNSAnswerSet)
+		}
+		set, ok := sets[name]
+		if !ok {
+			set = DNSAnswerSet{Client: client, Time: timestamp.UnixMicro()}
+		}
+		set.IPs = append(set.IPs, answer.IP.String())
+		sets[name] = set
+	}
+	return sets
+}
+
+// answerSetRef is an answer set an address belongs to.
+type answerSetRef struct {
+	name, client string
+	time         int64 // in the output precision
+}
+
+// answerSetIndex finds the answer sets of an address, to label a flow with
+// the name its client resolved the remote address from last.
+type answerSetIndex map[string][]answerSetRef
+
+// newAnswerSetIndex indexes the answer sets of a DNS map, oldest first.
+func newAnswerSetIndex(sets dnsAnswerSets, opts Options) answerSetIndex {
+	type entry struct {
+		name string
+		set  *DNSAnswerSet
+	}
+	var entries []entry
+	for name := range sets {
+		for i := range sets[name] {
+			entries = append(entries, entry{name, &sets[name][i]})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].set.Time < entries[j].set.Time })
+	index := make(answerSetIndex)
+	for _, entry := range entries {
+		index.add(entry.name, entry.set, opts.duration(time.Duration(entry.set.Time)*time.Microsecond))
+	}
+	return index
+}
+
+// add indexes an answer set resolved at timestamp, in the output precision.
+func (index answerSetIndex) add(name string, set *DNSAnswerSet, timestamp int64) {
+	for _, ip := range set.IPs {
+		refs := index[ip]
+		if len(refs) >= maxAnswerSetRefs {
+			refs = refs[1:]
+		}
+		index[ip] = append(refs, answerSetRef{name: name, client: set.Client, time: timestamp})
+	}
+}
+
+// lookup returns the name of the latest answer set holding ip that client
+// resolved up to window before timestamp.
+func (index answerSetIndex) lookup(ip, client string, timestamp, window int64) (string, bool) {
+	var best *answerSetRef
+	for i := range index[ip] {
+		ref := &index[ip][i]
+		if ref.client == client && ref.time <= timestamp && timestamp-ref.time <= window && (best == nil || ref.time >= best.time) {
+			best = ref
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.name, true
+}
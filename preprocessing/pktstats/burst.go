@@ -0,0 +1,94 @@
+package pktstats
+
+import (
+	"sort"
+	"time"
+)
+
+// BottleneckRates summarizes the bottleneck rates implied by the dispersion of
+// a flow's downstream packet trains.
+type BottleneckRates struct {
+	Bursts  int     `json:"bursts"` // bursts the percentiles are computed over
+	P10Mbps float64 `json:"p10Mbps"`
+	P50Mbps float64 `json:"p50Mbps"`
+	P90Mbps float64 `json:"p90Mbps"`
+}
+
+// burstState detects downstream bursts, trains of packets spaced at most
+// maxGap apart, and records the dispersion of each.
+type burstState struct {
+	maxGap     int64 // in timestamp units of the output precision, 0 disables detection
+	minPackets int
+	skipEmpty  bool  // leave out zero-payload packets, unless Options.ZeroPayload is keep
+	first      int64 // arrival of the first packet of the current train
+	last       int64
+	packets    int
+	bytes      int64 // bytes of the current train after its first packet
+	maxPayload int   // largest payload of the current train
+	trains     []burstTrain
+}
+
+// burstTrain is the dispersion of one burst: the bytes that arrived after its
+// first packet and the time they took.
+type burstTrain struct {
+	start      int64
+	bytes      int64
+	dispersion int64
+	maxPayload int
+}
+
+func (state *burstState) observe(packet *Packet) {
+	if packet.Direction != DirectionDownstream || (state.skipEmpty && packet.PayloadSize == 0) {
+		return
+	}
+	if state.packets > 0 && packet.Timestamp-state.last <= state.maxGap {
+		state.last = packet.Timestamp
+		state.packets++
+		state.bytes += int64(packet.PktLength)
+		state.maxPayload = max(state.maxPayload, packet.PayloadSize)
+		return
+	}
+	state.end()
+	state.first, state.last = packet.Timestamp, packet.Timestamp
+	state.packets = 1
+	state.bytes = 0
+	state.maxPayload = packet.PayloadSize
+}
+
+// end closes the current train, keeping it if it is long enough to be a burst.
+func (state *burstState) end() {
+	if state.packets > 0 && state.packets >= state.minPackets && state.last > state.first {
+		state.trains = append(state.trains, burstTrain{state.first, state.bytes, state.last - state.first, state.maxPayload})
+	}
+	state.packets = 0
+}
+
+// estimateBottleneck stores the percentiles of the bottleneck rates implied by
+// the flow's downstream bursts (bytes over dispersion). Flows with fewer than
+// Options.BurstMinCount bursts are left without an estimate.
+func (flow *Flow) estimateBottleneck(opts Options) {
+	state := &flow.bursts
+	if state.maxGap <= 0 {
+		return
+	}
+	state.end()
+	if len(state.trains) == 0 || len(state.trains) < opts.BurstMinCount {
+		return
+	}
+	rates := make([]float64, len(state.trains))
+	for i, train := range state.trains {
+		seconds := float64(opts.microseconds(train.dispersion)) / float64(time.Second/time.Microsecond)
+		rates[i] = float64(train.bytes) * 8 / seconds / 1e6
+	}
+	sort.Float64s(rates)
+	percentile := func(p float64) float64 {
+		return rates[int(p*float64(len(rates)-1))]
+	}
+	flow.BottleneckMbps = &BottleneckRates{
+		Bursts:  len(rates),
+		P10Mbps: percentile(0.1),
+		P50Mbps: percentile(0.5),
+		P90Mbps: percentile(0.9),
+	}
+	state.trains = nil
+}
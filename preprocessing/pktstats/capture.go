@@ -0,0 +1,358 @@
+package pktstats
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// stdinInput is the -f value reading the capture from standard input.
+const stdinInput = "-"
+
+var errMmapUnsupported = errors.New("memory-mapped reads are not supported for this file")
+
+// openSource opens the captures read by extractions and DNS passes; tests
+// replace it with fake packet sources.
+var openSource = openCapture
+
+// captureReader is a source of packets read from a capture file or stream.
+type captureReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// captureStream reads packets from a captureReader, ending the capture at
+// the first read error. Errors other than the end of the file are kept in
+// err, so the packets read before a truncation or decompression error are
+// still extracted. A panic of the reader ends the capture too, see rethrow.
+type captureStream struct {
+	captureReader
+	err      error
+	panicked *filePanic // recovered from a read
+	progress progressSource
+	stopped  atomic.Bool // set by stop, ends the capture at the next read
+	// the input as it is hashed, with Options.captureHash, see finishHash
+	hashed io.Reader
+	hasher *captureHasher
+}
+
+func (stream *captureStream) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if stream.stopped.Load() {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	defer func() {
+		if value := recover(); value != nil {
+			stream.panicked = &filePanic{value: value, stack: debug.Stack()}
+			data, ci, err = nil, gopacket.CaptureInfo{}, io.EOF
+		}
+	}()
+	data, ci, err = stream.captureReader.ReadPacketData()
+	if err != nil && err != io.EOF {
+		stream.err = err
+		err = io.EOF
+	}
+	return data, ci, err
+}
+
+// rethrow raises the panic of a read again in the calling goroutine: a
+// PacketSource reads on a goroutine of its own, where a panic would end the
+// run rather than fail the file in recoverFile.
+func (stream *captureStream) rethrow() {
+	if stream.panicked != nil {
+		panic(stream.panicked)
+	}
+}
+
+// stop ends a capture read by a PacketSource, whose goroutine delivers the
+// packets on packets, and calls release once that goroutine has returned: a
+// handle must not be closed under a read in progress. With wait unset, the
+// release is left to a background goroutine, for reads that may never
+// return, e.g. on a damaged network file system block.
+func (stream *captureStream) stop(packets chan gopacket.Packet, release func(), wait bool) {
+	stream.stopped.Store(true)
+	drain := func() {
+		for range packets {
+		}
+		release()
+	}
+	if !wait {
+		go drain()
+		return
+	}
+	drain()
+}
+
+// finishHash reads what the readers left of a hashed input, e.g. pcapng
+// blocks after the last packet or the rest of a damaged file, into its hash,
+// which then covers the whole file.
+func (stream *captureStream) finishHash() {
+	if stream.hashed == nil {
+		return
+	}
+	if _, err := io.Copy(io.Discard, stream.hashed); err != nil && stream.hasher.err == nil {
+		stream.hasher.err = err
+	}
+}
+
+// receivePacket returns the next packet delivered by a PacketSource, nil at
+// the end of the capture or once ctx is done. Waiting on ctx rather than
+// checking it between packets also ends a read blocked in libpcap.
+func receivePacket(ctx context.Context, packets chan gopacket.Packet) gopacket.Packet {
+	select {
+	case packet := <-packets:
+		return packet
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// compression is a compressed capture format, recognized by its magic bytes.
+type compression struct {
+	suffix string
+	magic  []byte
+	open   func(io.Reader) (io.Reader, func(), error)
+}
+
+var compressions = []compression{
+	{".gz", []byte{0x1f, 0x8b}, func(r io.Reader) (io.Reader, func(), error) {
+		reader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { reader.Close() }, nil
+	}},
+	{".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.Reader, func(), error) {
+		reader, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, reader.Close, nil
+	}},
+	{".lz4", []byte{0x04, 0x22, 0x4d, 0x18}, func(r io.Reader) (io.Reader, func(), error) {
+		return lz4.NewReader(r), func() {}, nil
+	}},
+}
+
+// isCompressionSuffix reports whether ext is the suffix of a compressed capture.
+func isCompressionSuffix(ext string) bool {
+	for _, c := range compressions {
+		if c.suffix == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// captureExt returns the extension of a capture file name, including the
+// capture format of compressed captures, e.g. ".pcap.zst".
+func captureExt(path string) string {
+	ext := filepath.Ext(path)
+	if isCompressionSuffix(ext) {
+		ext = filepath.Ext(strings.TrimSuffix(path, ext)) + ext
+	}
+	return ext
+}
+
+// isCaptureFile reports whether a file found under the base path is a capture
+// to process: pcapng files, and compressed pcap and pcapng files.
+func isCaptureFile(path string) bool {
+	ext := filepath.Ext(path)
+	if isCompressionSuffix(ext) {
+		inner := filepath.Ext(strings.TrimSuffix(path, ext))
+		return inner == ".pcap" || inner == ".pcapng"
+	}
+	return ext == ".pcapng"
+}
+
+// remoteFailure returns the error that ended the stream of a remote input,
+// nil if the capture was read to its end or was truncated.
+func (stream *captureStream) remoteFailure() error {
+	var failure *remoteError
+	if errors.As(stream.err, &failure) {
+		return failure
+	}
+	return nil
+}
+
+// openCapture opens a capture file with libpcap or, for stdinInput, remote
+// inputs, compressed files and with Options.InterfaceRoles, with the pure-Go stream
+// readers, which never seek: libpcap does not report the pcapng interface of
+// offline packets. With Options.Mmap, uncompressed files are mapped instead.
+// With Options.captureHash, the bytes of the file are hashed as they are
+// read, so files are read with the pure-Go readers too.
+// Compression is detected from the magic bytes rather than the file name, so
+// mislabeled files are read as what they are. The returned function releases
+// the capture.
+func openCapture(filePath string, opts Options) (*captureStream, func(), error) {
+	if filePath == stdinInput {
+		input, hashed := opts.captureHash.tee(os.Stdin)
+		reader, release, err := openCaptureStream(input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read capture from stdin: %w", err)
+		}
+		return &captureStream{captureReader: reader, progress: streamProgress{}, hashed: hashed, hasher: opts.captureHash}, release, nil
+	}
+	if isRemoteInput(filePath) {
+		remote := newRemoteReader(context.Background(), filePath)
+		input, hashed := opts.captureHash.tee(remote)
+		reader, release, err := openCaptureStream(input)
+		if err != nil {
+			remote.Close()
+			return nil, nil, fmt.Errorf("unable to read capture from %s: %w", filePath, err)
+		}
+		return &captureStream{captureReader: reader, progress: streamProgress{}, hashed: hashed, hasher: opts.captureHash}, func() {
+			release()
+			remote.Close()
+		}, nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(file, magic)
+	if compressionOf(magic[:n]) == nil {
+		if opts.Mmap && info.Mode().IsRegular() {
+			stream, release, err := openMappedCapture(file, info.Size(), opts.captureHash)
+			if err == nil {
+				return stream, release, nil
+			}
+			// read without a map instead
+		}
+		if opts.InterfaceRoles == "" && opts.captureHash == nil {
+			file.Close()
+			handle, err := pcap.OpenOffline(filePath)
+			if err != nil {
+				return nil, nil, err
+			}
+			progress := &estimatedProgress{size: info.Size(), pcapng: n == 4 && binary.LittleEndian.Uint32(magic) == pcapngSectionHeader}
+			return &captureStream{captureReader: handle, progress: progress}, handle.Close, nil
+		}
+		// read with the stream readers, which report the interface of packets
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	progress := &offsetProgress{size: info.Size()}
+	input, hashed := opts.captureHash.tee(file)
+	reader, release, err := openCaptureStream(countingReader{input, progress})
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("unable to read capture stream: %w", err)
+	}
+	return &captureStream{captureReader: reader, progress: progress, hashed: hashed, hasher: opts.captureHash}, func() {
+		release()
+		file.Close()
+	}, nil
+}
+
+// openMappedCapture reads an uncompressed capture file from memory, with the
+// pure-Go readers of streams but without a read syscall per buffer.
+func openMappedCapture(file *os.File, size int64, hasher *captureHasher) (*captureStream, func(), error) {
+	data, unmap, err := mapFile(file, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	progress := &offsetProgress{size: size}
+	input, hashed := hasher.tee(bytes.NewReader(data))
+	reader, release, err := openCaptureStream(countingReader{input, progress})
+	if err != nil {
+		unmap()
+		return nil, nil, err
+	}
+	return &captureStream{captureReader: reader, progress: progress, hashed: hashed, hasher: hasher}, func() {
+		release()
+		unmap()
+		file.Close()
+	}, nil
+}
+
+// compressionOf returns the compression whose magic bytes start data, nil for
+// uncompressed data.
+func compressionOf(data []byte) *compression {
+	for i, c := range compressions {
+		if bytes.HasPrefix(data, c.magic) {
+			return &compressions[i]
+		}
+	}
+	return nil
+}
+
+// openCaptureStream reads a pcap or pcapng stream, decompressing it first if
+// it starts with the magic bytes of a compression.
+func openCaptureStream(r io.Reader) (captureReader, func(), error) {
+	reader := bufio.NewReaderSize(r, 1<<20)
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {}
+	if c := compressionOf(magic); c != nil {
+		decompressed, closeDecompressor, err := c.open(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader, release = bufio.NewReaderSize(decompressed, 1<<20), closeDecompressor
+		if magic, err = reader.Peek(4); err != nil {
+			release()
+			return nil, nil, err
+		}
+	}
+	// the section header block type reads the same in both byte orders
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		ngReader, err := pcapgo.NewNgReader(reader, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("unable to read pcapng stream: %w", err)
+		}
+		return ngReader, release, nil
+	}
+	pcapReader, err := pcapgo.NewReader(reader)
+	if err != nil {
+		release()
+		return nil, nil, fmt.Errorf("unable to read pcap stream: %w", err)
+	}
+	return pcapReader, release, nil
+}
+
+// learnDNSResponse maps the addresses in the A and AAAA answers of a DNS
+// response to their names, for Options.DNSSinglePass. Unlike constructDNSMap,
+// DNS64-synthesized addresses are mapped to the name they were answered for.
+// @return the number of answers with invalid names, left out
+func learnDNSResponse(dnsMap map[string]string, dns *layers.DNS) int {
+	if !dns.QR {
+		return 0
+	}
+	invalid := 0
+	for _, answer := range dns.Answers {
+		if answer.Type == layers.DNSTypeA || answer.Type == layers.DNSTypeAAAA {
+			if !mapDNSName(dnsMap, answer.IP.String(), string(answer.Name)) {
+				invalid++
+			}
+		}
+	}
+	return invalid
+}
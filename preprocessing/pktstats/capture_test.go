@@ -0,0 +1,233 @@
+package pktstats
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var benchCaptureMB = flag.Int64("bench-capture-mb", 256, "size of the captures read by BenchmarkCaptureRead, in MiB")
+
+// blockingSource delivers the first packets of a capture, then blocks in
+// its next read until unblocked, as a read of a hung network file system does.
+type blockingSource struct {
+	captureReader
+	packets int // delivered before blocking
+	blocked chan struct{}
+	unblock chan struct{}
+}
+
+func (source *blockingSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if source.packets == 0 {
+		close(source.blocked)
+		<-source.unblock
+		return nil, gopacket.CaptureInfo{}, os.ErrClosed
+	}
+	source.packets--
+	return source.captureReader.ReadPacketData()
+}
+
+func TestReceivePacketTimeout(t *testing.T) {
+	packets := make(chan gopacket.Packet)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan gopacket.Packet)
+	go func() { done <- receivePacket(ctx, packets) }()
+	select {
+	case packet := <-done:
+		if packet != nil {
+			t.Errorf("receivePacket returned %v from a source that delivered nothing", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receivePacket still waiting on a blocked source after its context ended")
+	}
+}
+
+// TestFileTimeout extracts a capture whose read blocks with -file-timeout:
+// the file fails with reason timeout instead of holding its worker, and the
+// capture is released once the read returns.
+func TestFileTimeout(t *testing.T) {
+	capture := fixture(t, "flows.pcap", flowsCapture)
+	source := &blockingSource{packets: 10, blocked: make(chan struct{}), unblock: make(chan struct{})}
+	released := make(chan struct{})
+	defer func(open func(string, Options) (*captureStream, func(), error)) { openSource = open }(openSource)
+	openSource = func(filePath string, opts Options) (*captureStream, func(), error) {
+		stream, release, err := openCapture(filePath, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		source.captureReader = stream
+		return &captureStream{captureReader: source, progress: stream.progress}, func() {
+			release()
+			close(released)
+		}, nil
+	}
+
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.File, opts.OutputDir = capture, dir
+	opts.FileTimeout = 100 * time.Millisecond
+	finished := make(chan error)
+	go func() { finished <- Run(dir, opts) }()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run still blocked on the read past -file-timeout")
+	}
+	select {
+	case <-source.blocked:
+	default:
+		t.Fatal("the read never blocked")
+	}
+
+	manifestFile, err := os.ReadFile(filepath.Join(dir, "run_manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(manifestFile, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Status != "failed" || manifest.Files[0].Reason != "timeout" {
+		t.Errorf("manifest files %+v, want the capture failed with reason timeout", manifest.Files)
+	}
+
+	// a capture must not be released under the read in progress
+	select {
+	case <-released:
+		t.Fatal("capture released while its read was blocked")
+	default:
+	}
+	close(source.unblock)
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Error("capture not released once the read returned")
+	}
+}
+
+// writeBenchCapture writes a capture of at least size bytes, in pcapng or
+// pcap format, repeating the packets of flowsCapture with increasing
+// timestamps.
+func writeBenchCapture(b *testing.B, path string, pcapng bool, size int64) {
+	b.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	buffered := bufio.NewWriterSize(file, 1<<20)
+	var write func(gopacket.CaptureInfo, []byte) error
+	flush := buffered.Flush
+	if pcapng {
+		writer, err := pcapgo.NewNgWriter(buffered, layers.LinkTypeEthernet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		write = writer.WritePacket
+		flush = func() error {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			return buffered.Flush()
+		}
+	} else {
+		writer := pcapgo.NewWriterNanos(buffered)
+		if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+			b.Fatal(err)
+		}
+		write = writer.WritePacket
+	}
+	packets := flowsCapture(b)
+	var written int64
+	for round := time.Duration(0); written < size; round++ {
+		for _, packet := range packets {
+			ci := gopacket.CaptureInfo{Timestamp: fixtureStart.Add(round*time.Second + packet.at), CaptureLength: len(packet.data), Length: max(packet.length, len(packet.data))}
+			if err := write(ci, packet.data); err != nil {
+				b.Fatal(err)
+			}
+			written += int64(len(packet.data))
+		}
+	}
+	if err := flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// readAll reads every packet of a capture, returning their count.
+func readAll(b *testing.B, reader captureReader) int {
+	b.Helper()
+	packets := 0
+	for {
+		_, _, err := reader.ReadPacketData()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		packets++
+	}
+}
+
+// BenchmarkCaptureRead compares the memory-mapped read path of -mmap with
+// the buffered reads of the stream readers on the same local files, sized
+// with -bench-capture-mb, e.g. -bench CaptureRead -bench-capture-mb 4096
+// for multi-GB captures.
+func BenchmarkCaptureRead(b *testing.B) {
+	dir := b.TempDir()
+	for _, format := range []string{"pcap", "pcapng"} {
+		path := filepath.Join(dir, "bench."+format)
+		writeBenchCapture(b, path, format == "pcapng", *benchCaptureMB<<20)
+		info, err := os.Stat(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(format+"/mmap", func(b *testing.B) {
+			b.SetBytes(info.Size())
+			for i := 0; i < b.N; i++ {
+				file, err := os.Open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				stream, release, err := openMappedCapture(file, info.Size(), nil)
+				if err != nil {
+					file.Close()
+					b.Skip(err)
+				}
+				readAll(b, stream)
+				release()
+			}
+		})
+		b.Run(format+"/buffered", func(b *testing.B) {
+			b.SetBytes(info.Size())
+			for i := 0; i < b.N; i++ {
+				file, err := os.Open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				reader, release, err := openCaptureStream(countingReader{file, &offsetProgress{size: info.Size()}})
+				if err != nil {
+					b.Fatal(err)
+				}
+				readAll(b, reader)
+				release()
+				file.Close()
+			}
+		})
+	}
+}
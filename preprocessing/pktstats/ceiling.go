@@ -0,0 +1,241 @@
+package pktstats
+
+import "github.com/google/gopacket/layers"
+
+// throughput ceiling attributions of TCP downloads, TCPCeiling.Attribution
+const (
+	ceilingRwnd    = "rwnd-limited"   // the data in flight sat at the local receive window
+	ceilingLoss    = "loss-limited"   // loss events throttled the sender, below the window
+	ceilingSender  = "sender-limited" // neither: the sender sent less than it could
+	ceilingUnknown = "unknown"        // the window or RTT are unknown, or the flow is too short
+)
+
+const (
+	// ceilingMinBytes is the downstream payload of a TCP flow from which its
+	// ceiling is attributed.
+	ceilingMinBytes = 1 << 20
+	// ceilingMinBins is the number of round trips with downstream data below
+	// which a flow's ceiling is unknown.
+	ceilingMinBins = 20
+	// ceilingRwndShare is the share of round trips pinned at the receive
+	// window from which a flow is rwnd-limited.
+	ceilingRwndShare = 0.5
+	// ceilingLossShare is the share of round trips with loss events from which
+	// a flow not rwnd-limited is loss-limited.
+	ceilingLossShare = 0.05
+)
+
+// TCPCeiling attributes the throughput ceiling of a TCP download to the
+// receive window of the local host, to loss on the path or to the sender,
+// per round trip of the handshake RTT, see attributeCeiling.
+type TCPCeiling struct {
+	Attribution string  `json:"attribution"`
+	Reason      string  `json:"reason,omitempty"` // why the attribution is unknown
+	RTTMicros   int64   `json:"rttMicros,omitempty"`
+	Bins        int     `json:"bins"`       // round trips with downstream data
+	RwndPinned  float64 `json:"rwndPinned"` // share of them with the data in flight at the advertised window
+	LossShare   float64 `json:"lossShare"`  // share of them with retransmissions or duplicate ACKs
+	// downstream segments ending at or before the highest sequence number
+	// seen, and upstream duplicate pure ACKs
+	Retransmissions int   `json:"retransmissions"`
+	DuplicateAcks   int   `json:"duplicateAcks"`
+	MaxWindow       int64 `json:"maxWindow,omitempty"` // largest receive window advertised by the local host, scaled, in bytes
+}
+
+// ceilingCounts are the round trips of a flow, the input of attributeCeiling.
+type ceilingCounts struct {
+	windowKnown bool // the handshake was seen, with the window scale and RTT
+	bins        int  // round trips with downstream data
+	pinned      int  // of which the data in flight reached the receive window
+	lossy       int  // of which had loss events
+}
+
+// attributeCeiling attributes the ceiling of a flow from its round trips: to
+// the receive window if the data in flight reached it in at least
+// ceilingRwndShare of them, whatever the losses, as a sender at the window
+// cannot send more; otherwise to loss if at least ceilingLossShare of them
+// had loss events, and to the sender if not. Flows without the handshake or
+// with fewer than ceilingMinBins round trips are unknown.
+func attributeCeiling(counts ceilingCounts) (attribution, reason string) {
+	switch {
+	case !counts.windowKnown:
+		return ceilingUnknown, "handshake not captured"
+	case counts.bins < ceilingMinBins:
+		return ceilingUnknown, "too few round trips"
+	case float64(counts.pinned) >= ceilingRwndShare*float64(counts.bins):
+		return ceilingRwnd, ""
+	case float64(counts.lossy) >= ceilingLossShare*float64(counts.bins):
+		return ceilingLoss, ""
+	}
+	return ceilingSender, ""
+}
+
+// ceilingState follows the downstream data of a TCP flow against the
+// receive window advertised by the local host, per round trip.
+type ceilingState struct {
+	// handshake: the scale of the local host's windows and the RTT from the
+	// handshake packet of one side to the answer of the other
+	synTime     int64
+	synUpstream bool
+	synScale    int
+	synAckTime  int64
+	scale       int
+	scaleKnown  bool
+	rtt         int64
+
+	window     int64 // last receive window advertised upstream, scaled
+	maxWindow  int64
+	acked      uint32 // last upstream ACK
+	ackStarted bool
+	highSeq    uint32 // end of the highest downstream segment
+	seqStarted bool
+	maxSegment int64
+	downBytes  int64
+
+	bin                   int64 // start of the current round trip
+	binData, binPinned    bool
+	binLossy              bool
+	counts                ceilingCounts
+	retransmissions, dups int
+}
+
+// scaleOption returns the window scale option of a SYN, -1 without one.
+func scaleOption(tcp *layers.TCP) int {
+	for _, option := range tcp.Options {
+		if option.OptionType == layers.TCPOptionKindWindowScale && len(option.OptionData) == 1 {
+			return int(min(option.OptionData[0], 14))
+		}
+	}
+	return -1
+}
+
+// observe follows a packet of a TCP flow.
+func (state *ceilingState) observe(packet *Packet, tcp *layers.TCP, payloadLen int) {
+	upstream := packet.Direction == DirectionUpstream
+	if tcp.SYN {
+		state.observeHandshake(packet, tcp, upstream)
+		return
+	}
+	if state.rtt == 0 && state.synAckTime > 0 && !state.synUpstream && !upstream && tcp.ACK {
+		// the local host is the server: the RTT ends with the client's ACK
+		state.rtt = max(packet.Timestamp-state.synAckTime, 1)
+	}
+	if state.rtt > 0 {
+		state.advance(packet.Timestamp)
+	}
+	if upstream {
+		if tcp.ACK {
+			pureAck := payloadLen == 0 && !tcp.FIN && !tcp.RST
+			if pureAck && state.ackStarted && tcp.Ack == state.acked && state.seqStarted && state.highSeq != state.acked {
+				state.dups++
+				state.binLossy = true
+			}
+			state.acked, state.ackStarted = tcp.Ack, true
+		}
+		if state.scaleKnown {
+			state.window = int64(tcp.Window) << state.scale
+			state.maxWindow = max(state.maxWindow, state.window)
+		}
+		state.checkPinned()
+		return
+	}
+	if packet.Direction != DirectionDownstream || payloadLen == 0 {
+		return
+	}
+	state.downBytes += int64(payloadLen)
+	state.maxSegment = max(state.maxSegment, int64(payloadLen))
+	state.binData = true
+	end := tcp.Seq + uint32(payloadLen)
+	if state.seqStarted && int32(end-state.highSeq) <= 0 {
+		state.retransmissions++
+		state.binLossy = true
+		return
+	}
+	state.highSeq, state.seqStarted = end, true
+	state.checkPinned()
+}
+
+// observeHandshake takes the window scale of the local host from the SYN and
+// SYN-ACK and, if the local host is the client, the RTT.
+func (state *ceilingState) observeHandshake(packet *Packet, tcp *layers.TCP, upstream bool) {
+	if !tcp.ACK {
+		// the last SYN, if it was retransmitted
+		state.synTime, state.synUpstream, state.synScale = packet.Timestamp, upstream, scaleOption(tcp)
+		return
+	}
+	if state.synTime == 0 || upstream == state.synUpstream {
+		return
+	}
+	state.synAckTime = packet.Timestamp
+	scale := scaleOption(tcp)
+	state.scale, state.scaleKnown = scale, true
+	if !upstream {
+		state.scale = state.synScale
+		state.rtt = max(packet.Timestamp-state.synTime, 1)
+	}
+	if scale < 0 || state.synScale < 0 {
+		// without the option on both SYNs, windows are not scaled
+		state.scale = 0
+	}
+}
+
+// advance closes the round trips before timestamp.
+func (state *ceilingState) advance(timestamp int64) {
+	if state.bin == 0 {
+		state.bin = timestamp
+		return
+	}
+	if timestamp-state.bin < state.rtt {
+		return
+	}
+	if state.binData {
+		state.counts.bins++
+		if state.binPinned {
+			state.counts.pinned++
+		}
+		if state.binLossy {
+			state.counts.lossy++
+		}
+	}
+	state.bin += (timestamp - state.bin) / state.rtt * state.rtt
+	state.binData, state.binPinned, state.binLossy = false, false, false
+}
+
+// checkPinned marks the round trip if the data in flight is within a
+// segment of the advertised window.
+func (state *ceilingState) checkPinned() {
+	if state.window <= 0 || !state.seqStarted || !state.ackStarted {
+		return
+	}
+	if inFlight := int64(int32(state.highSeq - state.acked)); inFlight > 0 && inFlight+state.maxSegment >= state.window {
+		state.binPinned = true
+	}
+}
+
+// attributeCeiling stores the ceiling attribution of TCP flows that
+// downloaded at least ceilingMinBytes.
+func (flow *Flow) attributeCeiling(opts Options) {
+	state := &flow.ceiling
+	if flow.Protocol != 6 || state.downBytes < ceilingMinBytes {
+		return
+	}
+	if state.rtt > 0 {
+		// the round trip in progress
+		state.advance(state.bin + state.rtt)
+	}
+	counts := state.counts
+	counts.windowKnown = state.rtt > 0 && state.scaleKnown
+	ceiling := &TCPCeiling{
+		Bins:            counts.bins,
+		RTTMicros:       opts.microseconds(state.rtt),
+		Retransmissions: state.retransmissions,
+		DuplicateAcks:   state.dups,
+		MaxWindow:       state.maxWindow,
+	}
+	ceiling.Attribution, ceiling.Reason = attributeCeiling(counts)
+	if counts.bins > 0 {
+		ceiling.RwndPinned = float64(counts.pinned) / float64(counts.bins)
+		ceiling.LossShare = float64(counts.lossy) / float64(counts.bins)
+	}
+	flow.TCPCeiling = ceiling
+}
@@ -0,0 +1,209 @@
+package pktstats
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestAttributeCeilingCounts(t *testing.T) {
+	tests := []struct {
+		counts      ceilingCounts
+		attribution string
+		reason      string
+	}{
+		{ceilingCounts{windowKnown: false, bins: 100, pinned: 100}, ceilingUnknown, "handshake not captured"},
+		{ceilingCounts{windowKnown: true, bins: ceilingMinBins - 1, pinned: ceilingMinBins - 1}, ceilingUnknown, "too few round trips"},
+		{ceilingCounts{windowKnown: true, bins: 100, pinned: 50}, ceilingRwnd, ""},
+		{ceilingCounts{windowKnown: true, bins: 100, pinned: 50, lossy: 100}, ceilingRwnd, ""}, // a sender at the window cannot send more
+		{ceilingCounts{windowKnown: true, bins: 100, pinned: 49, lossy: 5}, ceilingLoss, ""},
+		{ceilingCounts{windowKnown: true, bins: 100, pinned: 49, lossy: 4}, ceilingSender, ""},
+		{ceilingCounts{windowKnown: true, bins: ceilingMinBins}, ceilingSender, ""},
+	}
+	for _, test := range tests {
+		attribution, reason := attributeCeiling(test.counts)
+		if attribution != test.attribution || reason != test.reason {
+			t.Errorf("%+v: attributed %s (%s), want %s (%s)", test.counts, attribution, reason, test.attribution, test.reason)
+		}
+	}
+}
+
+// ceilingFlow scripts a TCP download of a local client from a server with a
+// round trip time of ceilingRTT microseconds, feeding its packets to the
+// ceiling state of a flow.
+type ceilingFlow struct {
+	flow   *Flow
+	now    int64
+	seq    uint32 // next downstream sequence number
+	window uint16 // advertised by the client, unscaled
+}
+
+const (
+	ceilingRTT     = 10000
+	ceilingSegment = 1000
+)
+
+func (c *ceilingFlow) packet(upstream bool, tcp *layers.TCP, payloadLen int) {
+	direction := DirectionDownstream
+	if upstream {
+		direction = DirectionUpstream
+	}
+	c.flow.ceiling.observe(&Packet{Direction: direction, Upstream: upstream, Timestamp: c.now, PayloadSize: payloadLen}, tcp, payloadLen)
+}
+
+// handshake opens the connection, the SYNs carrying the window scales of
+// the client and the server, -1 for none.
+func (c *ceilingFlow) handshake(clientScale, serverScale int) {
+	option := func(scale int) []layers.TCPOption {
+		if scale < 0 {
+			return nil
+		}
+		return []layers.TCPOption{{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{byte(scale)}}}
+	}
+	c.packet(true, &layers.TCP{SYN: true, Window: c.window, Options: option(clientScale)}, 0)
+	c.now += ceilingRTT
+	c.packet(false, &layers.TCP{SYN: true, ACK: true, Ack: 1, Options: option(serverScale)}, 0)
+	c.now += 100
+	c.packet(true, &layers.TCP{ACK: true, Seq: 1, Ack: 1, Window: c.window}, 0)
+	c.seq = 1
+}
+
+// roundTrip sends segments downstream, retransmits the last retransmitted of
+// them, and has the client acknowledge them all, dups times a duplicate ACK
+// of the first one first.
+func (c *ceilingFlow) roundTrip(segments, retransmitted, dups int) {
+	start := c.now
+	first := c.seq
+	for i := 0; i < segments; i++ {
+		c.now += 10
+		c.packet(false, &layers.TCP{ACK: true, PSH: true, Seq: c.seq, Ack: 1}, ceilingSegment)
+		c.seq += ceilingSegment
+	}
+	for i := 0; i < retransmitted; i++ {
+		c.now += 10
+		c.packet(false, &layers.TCP{ACK: true, PSH: true, Seq: c.seq - uint32(i+1)*ceilingSegment, Ack: 1}, ceilingSegment)
+	}
+	c.now = start + ceilingRTT/2
+	for i := 0; i < dups+1 && dups > 0; i++ {
+		c.now += 10
+		c.packet(true, &layers.TCP{ACK: true, Seq: 1, Ack: first + ceilingSegment, Window: c.window}, 0)
+	}
+	c.now += 10
+	c.packet(true, &layers.TCP{ACK: true, Seq: 1, Ack: c.seq, Window: c.window}, 0)
+	c.now = start + ceilingRTT
+}
+
+// every returns 1 for every nth round trip i, 0 for the others.
+func every(i, n int) int {
+	if i%n == 0 {
+		return 1
+	}
+	return 0
+}
+
+// TestAttributeCeiling scripts a download hitting each attribution.
+func TestAttributeCeiling(t *testing.T) {
+	const rounds = 30
+	tests := []struct {
+		name   string
+		window uint16
+		script func(c *ceilingFlow)
+		want   *TCPCeiling // nil when the flow gets no attribution
+	}{
+		{
+			name:   "rwnd-limited",
+			window: 512, // 64 KiB scaled
+			script: func(c *ceilingFlow) {
+				c.handshake(7, 8)
+				for i := 0; i < rounds; i++ {
+					c.roundTrip(66, 0, 0)
+				}
+			},
+			want: &TCPCeiling{Attribution: ceilingRwnd, RTTMicros: ceilingRTT, Bins: rounds, RwndPinned: 1, MaxWindow: 512 << 7},
+		},
+		{
+			name:   "loss-limited by retransmissions",
+			window: 65535,
+			script: func(c *ceilingFlow) {
+				c.handshake(-1, -1)
+				for i := 0; i < rounds; i++ {
+					c.roundTrip(40, every(i, 5), 0)
+				}
+			},
+			want: &TCPCeiling{Attribution: ceilingLoss, RTTMicros: ceilingRTT, Bins: rounds, LossShare: 0.2, Retransmissions: rounds / 5, MaxWindow: 65535},
+		},
+		{
+			name:   "loss-limited by duplicate ACKs",
+			window: 65535,
+			script: func(c *ceilingFlow) {
+				c.handshake(-1, -1)
+				for i := 0; i < rounds; i++ {
+					c.roundTrip(40, 0, 3*every(i, 10))
+				}
+			},
+			want: &TCPCeiling{Attribution: ceilingLoss, RTTMicros: ceilingRTT, Bins: rounds, LossShare: 0.1, DuplicateAcks: 3 * rounds / 10, MaxWindow: 65535},
+		},
+		{
+			name:   "sender-limited",
+			window: 65535,
+			script: func(c *ceilingFlow) {
+				c.handshake(-1, -1)
+				for i := 0; i < rounds; i++ {
+					c.roundTrip(40, 0, 0)
+				}
+			},
+			want: &TCPCeiling{Attribution: ceilingSender, RTTMicros: ceilingRTT, Bins: rounds, MaxWindow: 65535},
+		},
+		{
+			name:   "handshake not captured",
+			window: 65535,
+			script: func(c *ceilingFlow) {
+				c.seq = 1
+				for i := 0; i < rounds; i++ {
+					c.roundTrip(40, 0, 0)
+				}
+			},
+			want: &TCPCeiling{Attribution: ceilingUnknown, Reason: "handshake not captured"},
+		},
+		{
+			name:   "too few round trips",
+			window: 65535,
+			script: func(c *ceilingFlow) {
+				c.handshake(7, 7)
+				for i := 0; i < 5; i++ {
+					c.roundTrip(220, 0, 0)
+				}
+			},
+			want: &TCPCeiling{Attribution: ceilingUnknown, Reason: "too few round trips", RTTMicros: ceilingRTT, Bins: 5, MaxWindow: 65535 << 7},
+		},
+		{
+			name:   "too small",
+			window: 65535,
+			script: func(c *ceilingFlow) {
+				c.handshake(-1, -1)
+				for i := 0; i < rounds; i++ {
+					c.roundTrip(10, 0, 0)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		c := &ceilingFlow{flow: &Flow{Protocol: 6}, now: 1_000_000, window: test.window}
+		test.script(c)
+		c.flow.attributeCeiling(DefaultOptions())
+		got := c.flow.TCPCeiling
+		if test.want == nil {
+			if got != nil {
+				t.Errorf("%s: ceiling %+v of a flow below %d bytes", test.name, got, ceilingMinBytes)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: no ceiling attributed", test.name)
+			continue
+		}
+		if *got != *test.want {
+			t.Errorf("%s: ceiling %+v, want %+v", test.name, *got, *test.want)
+		}
+	}
+}
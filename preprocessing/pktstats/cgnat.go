@@ -0,0 +1,111 @@
+package pktstats
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unknownSubscriber is the subscriber of flows no translation entry matches.
+const unknownSubscriber = "unknown"
+
+// translation is an entry of a CGNAT translation log: the subscriber's
+// internal IP held the external port range during the interval.
+type translation struct {
+	subscriber          string
+	firstPort, lastPort int
+	start, end          time.Time
+}
+
+// translationLog maps external IPs to their translations.
+type translationLog map[string][]translation
+
+// loadTranslationLog reads a CSV translation log with the columns internal IP,
+// external IP, port range ("1024-2047" or a single port), start and end time
+// (RFC 3339 or Unix seconds). A header row is skipped.
+func loadTranslationLog(path string) (translationLog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 5
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	translations := make(translationLog)
+	for i, record := range records {
+		if i == 0 && net.ParseIP(record[0]) == nil {
+			continue
+		}
+		entry, err := parseTranslation(record)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, i+1, err)
+		}
+		external := net.ParseIP(record[1]).String()
+		translations[external] = append(translations[external], entry)
+	}
+	return translations, nil
+}
+
+func parseTranslation(record []string) (translation, error) {
+	var entry translation
+	if net.ParseIP(record[0]) == nil || net.ParseIP(record[1]) == nil {
+		return entry, fmt.Errorf("invalid IP address")
+	}
+	entry.subscriber = net.ParseIP(record[0]).String()
+	first, last, found := strings.Cut(record[2], "-")
+	if !found {
+		last = first
+	}
+	var err error
+	entry.firstPort, err = strconv.Atoi(first)
+	if err == nil {
+		entry.lastPort, err = strconv.Atoi(last)
+	}
+	if err != nil || entry.firstPort < 0 || entry.firstPort > entry.lastPort || entry.lastPort > 65535 {
+		return entry, fmt.Errorf("invalid port range %q", record[2])
+	}
+	if entry.start, err = parseLogTime(record[3]); err != nil {
+		return entry, fmt.Errorf("invalid start time %q", record[3])
+	}
+	if entry.end, err = parseLogTime(record[4]); err != nil {
+		return entry, fmt.Errorf("invalid end time %q", record[4])
+	}
+	if entry.end.Before(entry.start) {
+		return entry, fmt.Errorf("end time %s before start time %s", record[4], record[3])
+	}
+	return entry, nil
+}
+
+func parseLogTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*1e9)), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// isExternal reports whether ip is a CGNAT external address of the log, which
+// takes the place of the local address in captures at the aggregation point.
+func (translations translationLog) isExternal(ip net.IP) bool {
+	_, ok := translations[ip.String()]
+	return ok
+}
+
+// subscriber returns the subscriber that held the external IP and port at the
+// given time, or unknownSubscriber.
+func (translations translationLog) subscriber(ip string, port int, at time.Time) string {
+	for _, entry := range translations[ip] {
+		if entry.firstPort <= port && port <= entry.lastPort && !at.Before(entry.start) && !at.After(entry.end) {
+			return entry.subscriber
+		}
+	}
+	return unknownSubscriber
+}
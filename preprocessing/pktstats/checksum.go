@@ -0,0 +1,93 @@
+package pktstats
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket/layers"
+)
+
+// minimum number of upstream packets checked before warning about checksum offload
+const checksumOffloadMinPackets = 100
+
+// checksumResult is the outcome of validating the checksums of a packet.
+type checksumResult int
+
+const (
+	checksumUnverified checksumResult = iota // truncated or not IPv4
+	checksumGood
+	checksumBad  // IPv4 header or TCP/UDP checksum mismatch
+	checksumZero // transport checksum left at zero: unused (UDP) or not yet filled in (offload)
+)
+
+// ChecksumCounts counts the checksum validation results of packets, with Options.VerifyChecksums.
+type ChecksumCounts struct {
+	Good int `json:"good"`
+	Bad  int `json:"bad"`
+	Zero int `json:"zero"`
+}
+
+func (counts *ChecksumCounts) add(result checksumResult) {
+	switch result {
+	case checksumGood:
+		counts.Good++
+	case checksumBad:
+		counts.Bad++
+	case checksumZero:
+		counts.Zero++
+	}
+}
+
+// verifyChecksums validates the IPv4 header checksum and the checksum of the
+// TCP or UDP segment made of header and payload.
+func verifyChecksums(ip *layers.IPv4, header, payload []byte) checksumResult {
+	if onesComplementSum(ip.Contents, 0) != 0xffff {
+		return checksumBad
+	}
+	var stored uint16
+	switch ip.Protocol {
+	case layers.IPProtocolTCP:
+		if len(header) < 20 {
+			return checksumUnverified
+		}
+		stored = binary.BigEndian.Uint16(header[16:18])
+	case layers.IPProtocolUDP:
+		if len(header) < 8 {
+			return checksumUnverified
+		}
+		stored = binary.BigEndian.Uint16(header[6:8])
+	default:
+		return checksumUnverified
+	}
+	if stored == 0 {
+		return checksumZero
+	}
+	length := len(header) + len(payload)
+	src, dst := ip.SrcIP.To4(), ip.DstIP.To4()
+	if src == nil || dst == nil {
+		return checksumUnverified
+	}
+	pseudo := []byte{src[0], src[1], src[2], src[3], dst[0], dst[1], dst[2], dst[3], 0, byte(ip.Protocol), byte(length >> 8), byte(length)}
+	// TCP and UDP headers have an even length, the payload is summed on its own
+	sum := onesComplementSum(pseudo, 0)
+	sum = onesComplementSum(header, sum)
+	sum = onesComplementSum(payload, sum)
+	if sum != 0xffff {
+		return checksumBad
+	}
+	return checksumGood
+}
+
+// onesComplementSum adds data to sum as 16-bit big-endian words, folding the
+// carries, as in the Internet checksum.
+func onesComplementSum(data []byte, sum uint32) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return sum
+}
@@ -0,0 +1,82 @@
+package pktstats
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// clientToken in the output template splits the output into one file per local IP.
+const clientToken = "{client}"
+
+// thirdPartyClient is the {client} value of the file holding third-party flows.
+const thirdPartyClient = "third-party"
+
+// clientRollup sums the flows of a file per local client and registered domain.
+func clientRollup(flowMap map[string]*Flow) map[string]map[string]*ServiceStats {
+	clients := make(map[string]map[string]*ServiceStats)
+	for client, flows := range splitByClient(flowMap) {
+		clients[client] = serviceRollup(flows)
+	}
+	return clients
+}
+
+// splitByClient groups flows by their local client.
+func splitByClient(flowMap map[string]*Flow) map[string]map[string]*Flow {
+	clients := make(map[string]map[string]*Flow)
+	for flowID, flow := range flowMap {
+		if clients[flow.LocalClient] == nil {
+			clients[flow.LocalClient] = make(map[string]*Flow)
+		}
+		clients[flow.LocalClient][flowID] = flow
+	}
+	return clients
+}
+
+// clientOutputPath fills in the {client} token of an output path, with IPv6
+// colons replaced so the address is usable in file names.
+func clientOutputPath(outPath, client string) string {
+	return strings.ReplaceAll(outPath, clientToken, strings.ReplaceAll(client, ":", "-"))
+}
+
+// outputExists reports whether the output of an input file already exists. For
+// outputs split per client, any client's file counts; for outputs split into
+// parts, only a complete set of parts.
+func outputExists(outPath string) bool {
+	matches, err := filepath.Glob(clientOutputPath(outPath, "*"))
+	return err == nil && len(matches) > 0 || partsExist(clientOutputPath(outPath, "*"))
+}
+
+// writeClientOutputs writes one output per local client, each with its own meta
+// block and its mirror flows, and the third-party flows, if kept, in a
+// separate file.
+func writeClientOutputs(outPath string, output *Output, opts Options) error {
+	clients := splitByClient(output.Flows)
+	mirrors := splitByClient(output.MirrorFlows)
+	for client := range mirrors {
+		if clients[client] == nil {
+			// a client with mirror flows only
+			clients[client] = make(map[string]*Flow)
+		}
+	}
+	for client, flows := range clients {
+		meta := *output.Meta
+		meta.Services = serviceRollup(flows)
+		if services, ok := output.Meta.Clients[client]; ok {
+			// also counts the idle connections left out with Options.ExcludeIdleConnections
+			meta.Services = services
+		}
+		meta.Clients = nil
+		if err := writeSizedOutput(clientOutputPath(outPath, client), &Output{Meta: &meta, Flows: flows, MirrorFlows: mirrors[client]}, opts); err != nil {
+			return fmt.Errorf("unable to write output of client %s: %w", client, err)
+		}
+	}
+	if len(output.ThirdPartyFlows) > 0 {
+		meta := *output.Meta
+		meta.Services = nil
+		meta.Clients = nil
+		thirdPartyOutput := &Output{Meta: &meta, Flows: map[string]*Flow{}, ThirdPartyFlows: output.ThirdPartyFlows}
+		return writeSizedOutput(clientOutputPath(outPath, thirdPartyClient), thirdPartyOutput, opts)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package pktstats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// ClockCheck is the estimated offset of the capture host's clock, from
+// timestamps carried by the captured traffic itself.
+type ClockCheck struct {
+	OffsetSeconds  float64 `json:"offsetSeconds"` // to add to capture timestamps to get the true time
+	Source         string  `json:"source"`        // ntp (server transmit timestamps) or http-date (Date headers, 1s resolution)
+	Samples        int     `json:"samples"`
+	Corrected      bool    `json:"corrected"`                // whether output timestamps were corrected, with Options.FixClock
+	RawStart       int64   `json:"rawStart"`                 // timestamp of the first packet as captured
+	CorrectedStart int64   `json:"correctedStart,omitempty"` // timestamp of the first packet after correction
+}
+
+// clockCheck collects clock offset samples, in seconds, from NTP server
+// responses and HTTP Date headers.
+type clockCheck struct {
+	ntp, httpDate []float64
+	first         time.Time
+}
+
+func (clock *clockCheck) observe(captured time.Time, srcPort int, udp bool, payload []byte) {
+	if clock.first.IsZero() {
+		clock.first = captured
+	}
+	if udp && srcPort == 123 && len(payload) >= 48 {
+		// server (4) or broadcast (5) mode; the transmit timestamp is at offset 40
+		if mode := payload[0] & 0x07; mode == 4 || mode == 5 {
+			seconds := binary.BigEndian.Uint32(payload[40:44])
+			fraction := binary.BigEndian.Uint32(payload[44:48])
+			if seconds != 0 {
+				ntpTime := float64(int64(seconds)-ntpEpochOffset) + float64(fraction)/(1<<32)
+				clock.ntp = append(clock.ntp, ntpTime-unixSeconds(captured))
+			}
+		}
+	}
+	if !udp && srcPort == 80 && bytes.HasPrefix(payload, []byte("HTTP/1.")) {
+		headerEnd := bytes.Index(payload, []byte("\r\n\r\n"))
+		if headerEnd < 0 {
+			headerEnd = len(payload)
+		}
+		if i := bytes.Index(payload[:headerEnd], []byte("\r\nDate: ")); i >= 0 {
+			value := payload[i+len("\r\nDate: ") : headerEnd]
+			if end := bytes.Index(value, []byte("\r\n")); end >= 0 {
+				value = value[:end]
+			}
+			if date, err := http.ParseTime(string(value)); err == nil {
+				// the header has whole seconds, compare with the middle of the second
+				clock.httpDate = append(clock.httpDate, unixSeconds(date)+0.5-unixSeconds(captured))
+			}
+		}
+	}
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// estimate returns the median offset of the NTP samples, or of the HTTP Date
+// samples if the capture has no NTP responses, nil without samples.
+func (clock *clockCheck) estimate(opts Options) *ClockCheck {
+	samples, source := clock.ntp, "ntp"
+	if len(samples) == 0 {
+		samples, source = clock.httpDate, "http-date"
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+	sort.Float64s(samples)
+	median := samples[len(samples)/2]
+	if len(samples)%2 == 0 {
+		median = (samples[len(samples)/2-1] + median) / 2
+	}
+	return &ClockCheck{
+		OffsetSeconds: median,
+		Source:        source,
+		Samples:       len(samples),
+		RawStart:      opts.timestamp(clock.first),
+	}
+}
+
+// clockWarning returns a quality warning if the offset exceeds the threshold.
+func clockWarning(check *ClockCheck, opts Options) string {
+	if check == nil || opts.ClockWarnSeconds <= 0 || math.Abs(check.OffsetSeconds) <= opts.ClockWarnSeconds {
+		return ""
+	}
+	return fmt.Sprintf("capture clock is off by %.1fs according to %d %s samples", check.OffsetSeconds, check.Samples, check.Source)
+}
+
+// correctClock shifts the packet timestamps of flows by the estimated offset.
+func correctClock(check *ClockCheck, opts Options, flowMaps ...map[string]*Flow) {
+	offset := opts.duration(time.Duration(check.OffsetSeconds * float64(time.Second)))
+	for _, flowMap := range flowMaps {
+		for _, flow := range flowMap {
+			for i := range flow.Packets {
+				flow.Packets[i].Timestamp += offset
+			}
+			if flow.FirstMediaTimestamp != 0 {
+				flow.FirstMediaTimestamp += offset
+			}
+			if flow.Keepalive != nil {
+				flow.Keepalive.LastActiveTimestamp += offset
+			}
+			for i := range flow.PathEvents {
+				flow.PathEvents[i].Timestamp += offset
+			}
+		}
+	}
+	check.Corrected = true
+	check.CorrectedStart = check.RawStart + offset
+}
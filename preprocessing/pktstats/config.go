@@ -0,0 +1,102 @@
+package pktstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runConfig is the content of a -config file: the base path and the options
+// of a run, keyed as the options are in the manifest and the meta block.
+type runConfig struct {
+	BasePath string `json:"basePath"`
+	Options
+}
+
+// LoadConfig reads a -config file into basePath and opts, which hold the flag
+// values, then sets the flags passed on the command line again so they
+// override the file, and records the file in the options. Keys the options
+// do not have are an error, so a typo does not silently leave an option at
+// its default.
+func LoadConfig(path string, flags *flag.FlagSet, basePath *string, opts *Options) error {
+	explicit := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config: %w", err)
+	}
+	if content, err = parseDurations(content); err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	config := runConfig{BasePath: *basePath, Options: *opts}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config %s: data after the options", path)
+	}
+	*basePath, *opts = config.BasePath, config.Options
+	opts.configFile = path
+	for name, value := range explicit {
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// parseDurations replaces the durations of a config written as strings, e.g.
+// "10s", with the nanoseconds the options are encoded with.
+func parseDurations(content []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	if err := decoder.Decode(&fields); err != nil {
+		// reported when decoding the options
+		return content, nil
+	}
+	options := reflect.TypeOf(Options{})
+	changed := false
+	for i := 0; i < options.NumField(); i++ {
+		field := options.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		var text string
+		if field.Type != reflect.TypeOf(time.Duration(0)) || json.Unmarshal(fields[name], &text) != nil {
+			continue
+		}
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		fields[name], changed = json.RawMessage(strconv.FormatInt(int64(duration), 10)), true
+	}
+	if !changed {
+		return content, nil
+	}
+	parsed, err := json.Marshal(fields)
+	// keep any data after the options for LoadConfig to reject
+	return append(parsed, content[decoder.InputOffset():]...), err
+}
+
+// ResolvedConfig returns the configuration of a run in the -config format,
+// indented or on one line.
+func ResolvedConfig(basePath string, opts Options, indent bool) string {
+	var content []byte
+	if indent {
+		content, _ = json.MarshalIndent(runConfig{BasePath: basePath, Options: opts}, "", "  ")
+	} else {
+		content, _ = json.Marshal(runConfig{BasePath: basePath, Options: opts})
+	}
+	return string(content)
+}
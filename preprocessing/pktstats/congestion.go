@@ -0,0 +1,207 @@
+package pktstats
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// congestion signals, the names of Options.CongestionWeights
+const (
+	signalLoss    = "loss"    // loss signals per downstream packet of the bin, see limitState
+	signalDrop    = "drop"    // rate drop from the recent p95 rate, as in classifyLimitation
+	signalCadence = "cadence" // frame rate drop from the highest of the flow, see FrameRates.Timeline
+)
+
+var congestionSignals = []string{signalLoss, signalDrop, signalCadence}
+
+const (
+	// congestionLossSaturation is the share of lost packets of a bin at which
+	// its loss signal is 1
+	congestionLossSaturation = 0.05
+	// congestionMergeGap is the longest run of bins below the threshold
+	// within an episode
+	congestionMergeGap = time.Second
+)
+
+// Congestion is an episode of congestion of a downstream media flow: a
+// period whose bins scored at least Options.CongestionThreshold, see
+// detectCongestion.
+type Congestion struct {
+	Start    int64           `json:"start"`    // start of its first bin
+	End      int64           `json:"end"`      // end of its last bin
+	Signals  []string        `json:"signals"`  // signals contributing to the score of a bin over the threshold
+	Severity float64         `json:"severity"` // highest score of its bins
+	Bins     []CongestionBin `json:"bins"`     // values behind the scores, the bins from Start to End
+}
+
+// CongestionBin holds the measurements and signals of one bin of an episode.
+type CongestionBin struct {
+	Timestamp   int64   `json:"timestamp"`
+	Packets     int     `json:"packets"` // downstream packets
+	LossSignals int     `json:"lossSignals"`
+	Mbps        float64 `json:"mbps"`
+	RecentMbps  float64 `json:"recentMbps"`    // p95 rate of the last Options.LimitWindow bins
+	FPS         float64 `json:"fps,omitempty"` // frame rate of the timeline segment of the bin
+	Loss        float64 `json:"loss"`
+	Drop        float64 `json:"drop"`
+	Cadence     float64 `json:"cadence"`
+	Score       float64 `json:"score"`
+}
+
+// congestionWeights are the weights of the signals, by name.
+type congestionWeights map[string]float64
+
+// parseCongestionWeights parses weights of signals such as "loss=0.5,drop=0.3".
+// Signals left out weigh 0.
+func parseCongestionWeights(weights string) (congestionWeights, error) {
+	parsed := make(congestionWeights)
+	for _, weight := range strings.Split(weights, ",") {
+		if strings.TrimSpace(weight) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(weight, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !containsString(congestionSignals, name) {
+			return nil, fmt.Errorf("invalid congestion weight %q: expected <signal>=<weight> with a signal among %s", weight, strings.Join(congestionSignals, ", "))
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid congestion weight %q: the weight must be a non-negative number", weight)
+		}
+		parsed[name] = w
+	}
+	return parsed, nil
+}
+
+// congestionScorer scores the signals of a bin, each from 0 to 1.
+type congestionScorer func(signals map[string]float64) float64
+
+// congestionScorers build the scoring functions of Options.CongestionScore
+// from the weights of the signals.
+var congestionScorers = map[string]func(congestionWeights) congestionScorer{
+	// weighted sum of the signals, so that weaker signals add up
+	"weighted": func(weights congestionWeights) congestionScorer {
+		return func(signals map[string]float64) float64 {
+			var score float64
+			for name, value := range signals {
+				score += weights[name] * value
+			}
+			return score
+		}
+	},
+	// strongest weighted signal, so that a single one is enough
+	"max": func(weights congestionWeights) congestionScorer {
+		return func(signals map[string]float64) float64 {
+			var score float64
+			for name, value := range signals {
+				score = max(score, weights[name]*value)
+			}
+			return score
+		}
+	},
+}
+
+func isCongestionScore(score string) bool {
+	_, ok := congestionScorers[score]
+	return ok
+}
+
+// detectCongestion stores the congestion episodes of a downstream media flow
+// from the bins of its limitation classification: bins whose signals score at
+// least Options.CongestionThreshold, merged across runs of other bins shorter
+// than congestionMergeGap.
+// @param rates: downstream bytes of each bin
+func (flow *Flow) detectCongestion(bins []limitBin, rates []float64, opts Options) {
+	if opts.CongestionThreshold <= 0 {
+		return
+	}
+	state := &flow.limitation
+	// validated with the options
+	weights, _ := parseCongestionWeights(opts.CongestionWeights)
+	score := congestionScorers[opts.CongestionScore](weights)
+	window := max(opts.LimitWindow, 1)
+	mbpsPerByte := 8 / (float64(opts.LimitBinMillis) * 1000)
+	var maxFPS float64
+	if flow.FrameRate != nil {
+		for _, segment := range flow.FrameRate.Timeline {
+			maxFPS = max(maxFPS, segment.FPS)
+		}
+	}
+	measured := make([]CongestionBin, len(bins))
+	congested := make([]bool, len(bins))
+	for i, bin := range bins {
+		measure := CongestionBin{
+			Timestamp:   state.start + int64(i)*state.binWidth,
+			Packets:     bin.packets,
+			LossSignals: bin.lossSignals,
+			Mbps:        math.Round(rates[i]*mbpsPerByte*1000) / 1000,
+		}
+		p95 := recentP95(rates, i, window)
+		measure.RecentMbps = math.Round(p95*mbpsPerByte*1000) / 1000
+		if bin.lossSignals > 0 {
+			measure.Loss = min(float64(bin.lossSignals)/float64(bin.packets+bin.lossSignals)/congestionLossSaturation, 1)
+		}
+		if p95 > 0 {
+			measure.Drop = max(1-rates[i]/p95, 0)
+		}
+		if maxFPS > 0 {
+			measure.FPS = flow.FrameRate.fpsAt(measure.Timestamp)
+			if measure.FPS > 0 {
+				measure.Cadence = 1 - measure.FPS/maxFPS
+			}
+		}
+		measure.Score = score(map[string]float64{signalLoss: measure.Loss, signalDrop: measure.Drop, signalCadence: measure.Cadence})
+		measure.Loss = math.Round(measure.Loss*1000) / 1000
+		measure.Drop = math.Round(measure.Drop*1000) / 1000
+		measure.Cadence = math.Round(measure.Cadence*1000) / 1000
+		measure.Score = math.Round(measure.Score*1000) / 1000
+		measured[i] = measure
+		congested[i] = measure.Score >= opts.CongestionThreshold
+	}
+	mergeBins := int(opts.duration(congestionMergeGap) / max(state.binWidth, 1))
+	for i := 0; i < len(bins); i++ {
+		if !congested[i] {
+			continue
+		}
+		last := i
+		for j := i + 1; j < len(bins) && j-last <= mergeBins; j++ {
+			if congested[j] {
+				last = j
+			}
+		}
+		episode := Congestion{Start: measured[i].Timestamp, End: measured[last].Timestamp + state.binWidth, Bins: measured[i : last+1]}
+		triggered := make(map[string]bool)
+		for j := i; j <= last; j++ {
+			if !congested[j] {
+				continue
+			}
+			episode.Severity = max(episode.Severity, measured[j].Score)
+			for name, value := range map[string]float64{signalLoss: measured[j].Loss, signalDrop: measured[j].Drop, signalCadence: measured[j].Cadence} {
+				if value > 0 && weights[name] > 0 {
+					triggered[name] = true
+				}
+			}
+		}
+		for _, name := range congestionSignals {
+			if triggered[name] {
+				episode.Signals = append(episode.Signals, name)
+			}
+		}
+		flow.CongestionEpisodes = append(flow.CongestionEpisodes, episode)
+		i = last
+	}
+}
+
+// fpsAt returns the frame rate of the timeline segment covering a timestamp,
+// 0 if none does.
+func (rates *FrameRates) fpsAt(timestamp int64) float64 {
+	i := sort.Search(len(rates.Timeline), func(i int) bool { return rates.Timeline[i].End > timestamp })
+	if i < len(rates.Timeline) && rates.Timeline[i].Start <= timestamp {
+		return rates.Timeline[i].FPS
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package pktstats
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCongestionWeights(t *testing.T) {
+	tests := []struct {
+		weights string
+		want    congestionWeights
+		err     string // start of the error wanted, empty for none
+	}{
+		{"loss=0.5,drop=0.3,cadence=0.2", congestionWeights{signalLoss: 0.5, signalDrop: 0.3, signalCadence: 0.2}, ""},
+		{" loss = 1 , ,drop=0", congestionWeights{signalLoss: 1, signalDrop: 0}, ""},
+		{"", congestionWeights{}, ""},
+		{"rtt=0.5", nil, "invalid congestion weight"},
+		{"loss", nil, "invalid congestion weight"},
+		{"loss=-1", nil, "invalid congestion weight"},
+		{"loss=high", nil, "invalid congestion weight"},
+	}
+	for _, test := range tests {
+		got, err := parseCongestionWeights(test.weights)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%q: error %v, want %s", test.weights, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: weights %v (%v), want %v", test.weights, got, err, test.want)
+		}
+	}
+}
+
+// TestDetectCongestion scores synthetic series of 40 bins of 100 ms at 10
+// Mbit/s with 100 packets each, in which the tests place losses, rate drops
+// and frame rate drops.
+func TestDetectCongestion(t *testing.T) {
+	const (
+		start    = 1_000_000
+		binWidth = 100_000
+		rate     = 125_000 // bytes per bin
+	)
+	type series struct {
+		losses map[int]int     // loss signals by bin
+		rates  map[int]float64 // share of the rate by bin
+		fps    [2]int          // bins at 30 rather than 60 fps
+	}
+	type episode struct {
+		first, last int // bins
+		signals     []string
+		severity    float64
+	}
+	lossy := func(loss int, bins ...int) map[int]int {
+		losses := make(map[int]int)
+		for _, bin := range bins {
+			losses[bin] = loss
+		}
+		return losses
+	}
+	tests := []struct {
+		name     string
+		opts     func(opts *Options)
+		series   series
+		episodes []episode
+	}{
+		{"steady", nil, series{}, nil},
+		// 10 losses for 100 packets saturate the loss signal, weighted 0.5
+		{"loss burst", nil, series{losses: lossy(10, 10, 11, 12)}, []episode{{10, 12, []string{signalLoss}, 0.5}}},
+		{"loss below the threshold", nil, series{losses: lossy(3, 10, 11, 12)}, nil},
+		// 4/104/0.05*0.5 + 0.5*0.3
+		{"loss and rate drop", nil, series{losses: lossy(4, 20, 21, 22), rates: map[int]float64{20: 0.5, 21: 0.5, 22: 0.5}}, []episode{{20, 22, []string{signalLoss, signalDrop}, 0.535}}},
+		{"rate drop alone", nil, series{rates: map[int]float64{20: 0, 21: 0, 22: 0}}, nil},
+		{"merged across a short gap", nil, series{losses: lossy(10, 10, 11, 15, 16)}, []episode{{10, 16, []string{signalLoss}, 0.5}}},
+		{"apart", nil, series{losses: lossy(10, 5, 25)}, []episode{{5, 5, []string{signalLoss}, 0.5}, {25, 25, []string{signalLoss}, 0.5}}},
+		{"max score", func(opts *Options) { opts.CongestionScore, opts.CongestionWeights = "max", "loss=1,drop=1" },
+			series{losses: lossy(3, 10), rates: map[int]float64{10: 0.6}}, []episode{{10, 10, []string{signalLoss, signalDrop}, 0.583}}},
+		{"cadence", func(opts *Options) { opts.CongestionWeights = "cadence=1" }, series{fps: [2]int{30, 35}}, []episode{{30, 34, []string{signalCadence}, 0.5}}},
+		{"signals without weight", func(opts *Options) { opts.CongestionWeights = "drop=1" }, series{losses: lossy(10, 10), rates: map[int]float64{10: 0.2}}, []episode{{10, 10, []string{signalDrop}, 0.8}}},
+		{"disabled", func(opts *Options) { opts.CongestionThreshold = 0 }, series{losses: lossy(10, 10, 11, 12)}, nil},
+	}
+	for _, test := range tests {
+		opts := DefaultOptions()
+		opts.LimitWindow = 10
+		if test.opts != nil {
+			test.opts(&opts)
+		}
+		flow := &Flow{}
+		flow.limitation.start, flow.limitation.binWidth = start, binWidth
+		bins := make([]limitBin, 40)
+		rates := make([]float64, len(bins))
+		for i := range bins {
+			share, ok := test.series.rates[i]
+			if !ok {
+				share = 1
+			}
+			rates[i] = rate * share
+			bins[i] = limitBin{bytes: int64(rates[i]), packets: 100, lossSignals: test.series.losses[i]}
+		}
+		if test.series.fps != [2]int{} {
+			at := func(bin int) int64 { return start + int64(bin)*binWidth }
+			flow.FrameRate = &FrameRates{Timeline: []FrameRateSegment{
+				{Start: at(0), End: at(test.series.fps[0]), FPS: 60},
+				{Start: at(test.series.fps[0]), End: at(test.series.fps[1]), FPS: 30},
+				{Start: at(test.series.fps[1]), End: at(len(bins)), FPS: 60},
+			}}
+		}
+		flow.detectCongestion(bins, rates, opts)
+
+		if len(flow.CongestionEpisodes) != len(test.episodes) {
+			t.Errorf("%s: episodes %+v, want %+v", test.name, flow.CongestionEpisodes, test.episodes)
+			continue
+		}
+		for i, want := range test.episodes {
+			got := flow.CongestionEpisodes[i]
+			if got.Start != start+int64(want.first)*binWidth || got.End != start+int64(want.last+1)*binWidth || len(got.Bins) != want.last-want.first+1 ||
+				!reflect.DeepEqual(got.Signals, want.signals) || got.Severity != want.severity {
+				t.Errorf("%s: episode %d %+v, want %+v", test.name, i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// correlateWindow is the capture time over which the clock offset between
+// two vantage points is taken, see estimateClock.
+const correlateWindow = 10 * time.Second
+
+// CorrelateSettings are the settings of the correlate subcommand.
+type CorrelateSettings struct {
+	minConfidence float64
+	maxOffset     time.Duration // largest clock offset plus one-way delay between the captures
+	out           string
+}
+
+// Correlation compares two captures of the same traffic from two vantage
+// points, e.g. the client's Wi-Fi and the router's WAN port: the flows seen
+// at both, the packets seen at only one of them and the one-way delays
+// between them.
+type Correlation struct {
+	SourceA string `json:"sourceA"`
+	SourceB string `json:"sourceB"`
+	// clock of B minus clock of A at the start of A, and its drift, from the
+	// flows matched with at least MinConfidence; nil without packets in both
+	// directions
+	Clock         *ClockComparison  `json:"clock,omitempty"`
+	MinConfidence float64           `json:"minConfidence"`
+	Flows         []CorrelatedFlow  `json:"flows"`                // in order of confidence
+	UnmatchedA    []string          `json:"unmatchedA,omitempty"` // keys of the flows of A without a match in B
+	UnmatchedB    []string          `json:"unmatchedB,omitempty"`
+	Notes         []string          `json:"notes,omitempty"`
+	matches       []*flowComparison // of Flows
+}
+
+// ClockComparison is the clock offset between the captures. One-way delays
+// cannot tell an offset from an asymmetry of the paths: the smallest delays
+// of both directions are taken to be equal, as NTP does.
+type ClockComparison struct {
+	OffsetMicros int64   `json:"offsetMicros"`
+	SkewPPM      float64 `json:"skewPPM"` // drift of the offset, from its change across the windows
+	Windows      int     `json:"windows"` // windows of correlateWindow with packets in both directions
+	// the direction of the packets seen first in A, e.g. "to 80.84.170.5:12000"
+	// for captures at the client and at the WAN port
+	AToB string `json:"aToB"`
+}
+
+// CorrelatedFlow is a flow matched across the two captures.
+type CorrelatedFlow struct {
+	KeyA           string  `json:"keyA"`
+	KeyB           string  `json:"keyB"`
+	SharedEndpoint string  `json:"sharedEndpoint"` // endpoint both captures see, the other may be translated
+	Confidence     float64 `json:"confidence"`     // from 0 to 1, see compareFlows
+	MatchedPackets int     `json:"matchedPackets"`
+	IPIDConfirmed  int     `json:"ipidConfirmed"` // matches with the same non-zero IP ID, see compareFlows
+	// packets seen in one capture only, while the other was capturing
+	OnlyInA   int         `json:"onlyInA"`
+	OnlyInB   int         `json:"onlyInB"`
+	DelayAToB *DelayStats `json:"delayAToB,omitempty"` // one-way delays, with at least Correlation.MinConfidence
+	DelayBToA *DelayStats `json:"delayBToA,omitempty"`
+}
+
+// DelayStats is the distribution of the one-way delays of the matched
+// packets of one direction, net of the clock offset.
+type DelayStats struct {
+	Packets   int     `json:"packets"`
+	MinMillis float64 `json:"minMillis"`
+	P50Millis float64 `json:"p50Millis"`
+	P90Millis float64 `json:"p90Millis"`
+	P99Millis float64 `json:"p99Millis"`
+	MaxMillis float64 `json:"maxMillis"`
+}
+
+// vantage is the capture of one vantage point, timestamps in microseconds.
+type vantage struct {
+	source     string
+	start, end int64
+	flows      []*vantageFlow
+}
+
+type vantageFlow struct {
+	key         string
+	protocol    int
+	endpoints   [2]string // ip:port of each endpoint
+	first, last int64
+	packets     []vantagePacket
+}
+
+type vantagePacket struct {
+	timestamp int64
+	src       string // ip:port of the sender
+	size      int    // transport payload, the same at both vantage points
+	ipid      int
+}
+
+// loadVantage reads an output, or extracts a capture with opts.
+func loadVantage(path string, opts Options) (*vantage, error) {
+	var output *Output
+	switch filepath.Ext(path) {
+	case ".json", ".ndjson", ".csv":
+		var err error
+		if output, err = LoadFlows(path); err != nil {
+			return nil, err
+		}
+		if output.Meta == nil {
+			return nil, fmt.Errorf("%s is an output without a meta block", path)
+		}
+	default:
+		output = &Output{Flows: make(map[string]*Flow)}
+		extractor := NewExtractor(opts)
+		extractor.RegisterFlowHandler(output.collect)
+		meta, err := extractor.Extract(path)
+		if err != nil {
+			return nil, err
+		}
+		output.Meta = meta
+	}
+	meta := output.Meta
+	v := &vantage{source: meta.Source, start: meta.Options.microseconds(meta.CaptureStart), end: meta.Options.microseconds(meta.CaptureEnd)}
+	for _, flows := range []map[string]*Flow{output.Flows, output.ThirdPartyFlows} {
+		for _, key := range sortedFlowKeys(flows) {
+			flow := flows[key]
+			if len(flow.Packets) == 0 {
+				continue
+			}
+			vf := &vantageFlow{
+				key:      key,
+				protocol: flow.Protocol,
+				endpoints: [2]string{
+					net.JoinHostPort(flow.LocalIP, strconv.Itoa(flow.LocalPort)),
+					net.JoinHostPort(flow.RemoteIP, strconv.Itoa(flow.RemotePort)),
+				},
+			}
+			for _, packet := range flow.Packets {
+				vf.packets = append(vf.packets, vantagePacket{
+					timestamp: meta.Options.microseconds(packet.Timestamp),
+					src:       net.JoinHostPort(packet.SrcIP, strconv.Itoa(packet.SrcPort)),
+					size:      packet.PayloadSize,
+					ipid:      packet.IPID,
+				})
+			}
+			sort.SliceStable(vf.packets, func(i, j int) bool { return vf.packets[i].timestamp < vf.packets[j].timestamp })
+			vf.first, vf.last = vf.packets[0].timestamp, vf.packets[len(vf.packets)-1].timestamp
+			v.flows = append(v.flows, vf)
+		}
+	}
+	if v.start == 0 || v.end == 0 {
+		// outputs from before the capture span was recorded
+		for _, flow := range v.flows {
+			if v.start == 0 || flow.first < v.start {
+				v.start = flow.first
+			}
+			v.end = max(v.end, flow.last)
+		}
+	}
+	return v, nil
+}
+
+// packetDelta is the timestamp in B minus that in A of a matched packet.
+type packetDelta struct {
+	timestamp int64 // in A
+	toShared  bool  // sent to the shared endpoint
+	delta     int64
+}
+
+// flowComparison is the packet alignment of a candidate pair of flows.
+type flowComparison struct {
+	a, b       *vantageFlow
+	shared     string
+	confidence float64
+	matched    int
+	confirmed  int
+	onlyInA    int
+	onlyInB    int
+	deltas     []packetDelta
+}
+
+// compareFlows aligns the packets of a flow of A and a flow of B sharing an
+// endpoint, per direction and in order: a packet of A matches the first
+// packet of B not yet passed with the same payload size, the same IP ID when
+// both have one, and a timestamp within maxOffset. The packets of B passed
+// over and those of A without a match count as seen in one capture only, if
+// the other capture was running then.
+//
+// The confidence is the share of the packets of both flows that matched,
+// weighted by the evidence of the matches: full for a match confirmed by
+// its IP ID, if it differs from that of the previous packet of the
+// direction, as some stacks send a constant one, three quarters for a payload size differing from the previous
+// packet of the direction, half for a size repeating it, as the packets of
+// media flows often share their size.
+func compareFlows(a, b *vantageFlow, shared string, spanA, spanB [2]int64, maxOffset int64) *flowComparison {
+	comparison := &flowComparison{a: a, b: b, shared: shared}
+	inSpan := func(timestamp int64, span [2]int64) bool {
+		return timestamp >= span[0]-maxOffset && timestamp <= span[1]+maxOffset
+	}
+	var evidence float64
+	for _, toShared := range []bool{false, true} {
+		var packetsA, packetsB []vantagePacket
+		for _, packet := range a.packets {
+			if (packet.src != shared) == toShared {
+				packetsA = append(packetsA, packet)
+			}
+		}
+		for _, packet := range b.packets {
+			if (packet.src != shared) == toShared {
+				packetsB = append(packetsB, packet)
+			}
+		}
+		passOver := func(packet vantagePacket) {
+			if inSpan(packet.timestamp, spanA) {
+				comparison.onlyInB++
+			}
+		}
+		j := 0
+		previousSize, previousIPID := -1, -1
+		for _, packetA := range packetsA {
+			for j < len(packetsB) && packetsB[j].timestamp < packetA.timestamp-maxOffset {
+				passOver(packetsB[j])
+				j++
+			}
+			match := -1
+			for k := j; k < len(packetsB) && packetsB[k].timestamp <= packetA.timestamp+maxOffset; k++ {
+				packetB := packetsB[k]
+				if packetB.size == packetA.size && (packetA.ipid == 0 || packetB.ipid == 0 || packetA.ipid == packetB.ipid) {
+					match = k
+					break
+				}
+			}
+			if match < 0 {
+				if inSpan(packetA.timestamp, spanB) {
+					comparison.onlyInA++
+				}
+				continue
+			}
+			for ; j < match; j++ {
+				passOver(packetsB[j])
+			}
+			packetB := packetsB[match]
+			j = match + 1
+			comparison.matched++
+			switch {
+			case packetA.ipid != 0 && packetA.ipid == packetB.ipid && packetA.ipid != previousIPID:
+				comparison.confirmed++
+				evidence += 1
+			case packetA.size != previousSize:
+				evidence += 0.75
+			default:
+				evidence += 0.5
+			}
+			previousSize, previousIPID = packetA.size, packetA.ipid
+			comparison.deltas = append(comparison.deltas, packetDelta{packetA.timestamp, toShared, packetB.timestamp - packetA.timestamp})
+		}
+		for ; j < len(packetsB); j++ {
+			passOver(packetsB[j])
+		}
+	}
+	if counted := 2*comparison.matched + comparison.onlyInA + comparison.onlyInB; counted > 0 {
+		comparison.confidence = evidence * 2 / float64(counted)
+	}
+	return comparison
+}
+
+// correlate matches the flows of two captures: each flow of A with the flow
+// of B of the same protocol sharing an endpoint that it aligns best with,
+// pairs of higher confidence first.
+func correlate(a, b *vantage, settings CorrelateSettings) *Correlation {
+	maxOffset := settings.maxOffset.Microseconds()
+	byEndpoint := make(map[string][]*vantageFlow)
+	for _, flow := range b.flows {
+		for _, endpoint := range flow.endpoints {
+			key := strconv.Itoa(flow.protocol) + "/" + endpoint
+			byEndpoint[key] = append(byEndpoint[key], flow)
+		}
+	}
+	var comparisons []*flowComparison
+	for _, flowA := range a.flows {
+		seen := make(map[*vantageFlow]bool)
+		// remote endpoint first: when both are shared, packets are oriented
+		// upstream or downstream alike in all flows
+		for _, endpoint := range []string{flowA.endpoints[1], flowA.endpoints[0]} {
+			for _, flowB := range byEndpoint[strconv.Itoa(flowA.protocol)+"/"+endpoint] {
+				if seen[flowB] || flowB.first > flowA.last+maxOffset || flowB.last < flowA.first-maxOffset {
+					continue
+				}
+				seen[flowB] = true
+				shared := endpoint
+				if comparison := compareFlows(flowA, flowB, shared, [2]int64{a.start, a.end}, [2]int64{b.start, b.end}, maxOffset); comparison.matched > 0 {
+					comparisons = append(comparisons, comparison)
+				}
+			}
+		}
+	}
+	sort.SliceStable(comparisons, func(i, j int) bool { return comparisons[i].confidence > comparisons[j].confidence })
+
+	correlation := &Correlation{SourceA: a.source, SourceB: b.source, MinConfidence: settings.minConfidence, Flows: []CorrelatedFlow{}}
+	matchedA, matchedB := make(map[*vantageFlow]bool), make(map[*vantageFlow]bool)
+	for _, comparison := range comparisons {
+		if matchedA[comparison.a] || matchedB[comparison.b] {
+			continue
+		}
+		matchedA[comparison.a], matchedB[comparison.b] = true, true
+		correlation.matches = append(correlation.matches, comparison)
+	}
+	for _, flow := range a.flows {
+		if !matchedA[flow] {
+			correlation.UnmatchedA = append(correlation.UnmatchedA, flow.key)
+		}
+	}
+	for _, flow := range b.flows {
+		if !matchedB[flow] {
+			correlation.UnmatchedB = append(correlation.UnmatchedB, flow.key)
+		}
+	}
+
+	clock, aToB, offsetAt := estimateClock(correlation.matches, settings.minConfidence, a.start)
+	if clock == nil {
+		correlation.Notes = append(correlation.Notes, fmt.Sprintf("no flow matched with a confidence of at least %.2f has packets in both directions: the clock offset and one-way delays are not estimated", settings.minConfidence))
+	}
+	correlation.Clock = clock
+	for _, comparison := range correlation.matches {
+		flow := CorrelatedFlow{
+			KeyA:           comparison.a.key,
+			KeyB:           comparison.b.key,
+			SharedEndpoint: comparison.shared,
+			Confidence:     math.Round(comparison.confidence*1000) / 1000,
+			MatchedPackets: comparison.matched,
+			IPIDConfirmed:  comparison.confirmed,
+			OnlyInA:        comparison.onlyInA,
+			OnlyInB:        comparison.onlyInB,
+		}
+		if clock != nil && comparison.confidence >= settings.minConfidence {
+			var forward, backward []float64
+			for _, delta := range comparison.deltas {
+				offset := offsetAt(delta.timestamp)
+				if delta.toShared == aToB {
+					forward = append(forward, float64(delta.delta-offset)/1000)
+				} else {
+					backward = append(backward, float64(offset-delta.delta)/1000)
+				}
+			}
+			flow.DelayAToB, flow.DelayBToA = delayStats(forward), delayStats(backward)
+		}
+		correlation.Flows = append(correlation.Flows, flow)
+	}
+	return correlation
+}
+
+// estimateClock estimates the clock offset of B from the matched packets of
+// the comparisons with at least minConfidence, per correlateWindow of A's
+// time: packets travelling from A to B arrive at least the smallest delay
+// after the offset, those travelling back at least the smallest delay
+// before, so the offset is halfway between the smallest delta of the one and
+// the largest of the other. A line fitted through the offsets of the
+// windows gives the drift. The direction from A to B is the one of the
+// larger deltas.
+// @return the comparison, whether packets sent to the shared endpoints
+// travel from A to B, and the offset at a timestamp of A
+func estimateClock(comparisons []*flowComparison, minConfidence float64, start int64) (*ClockComparison, bool, func(int64) int64) {
+	var toShared, fromShared []int64
+	for _, comparison := range comparisons {
+		if comparison.confidence < minConfidence {
+			continue
+		}
+		for _, delta := range comparison.deltas {
+			if delta.toShared {
+				toShared = append(toShared, delta.delta)
+			} else {
+				fromShared = append(fromShared, delta.delta)
+			}
+		}
+	}
+	if len(toShared) == 0 || len(fromShared) == 0 {
+		return nil, false, nil
+	}
+	median := func(values []int64) int64 {
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		return values[len(values)/2]
+	}
+	aToB := median(toShared) > median(fromShared)
+
+	window := correlateWindow.Microseconds()
+	type bounds struct {
+		minForward, maxBackward int64
+		forward, backward       bool
+	}
+	windows := make(map[int64]*bounds)
+	for _, comparison := range comparisons {
+		if comparison.confidence < minConfidence {
+			continue
+		}
+		for _, delta := range comparison.deltas {
+			w := (delta.timestamp - start) / window
+			b, ok := windows[w]
+			if !ok {
+				b = &bounds{minForward: math.MaxInt64, maxBackward: math.MinInt64}
+				windows[w] = b
+			}
+			if delta.toShared == aToB {
+				b.minForward, b.forward = min(b.minForward, delta.delta), true
+			} else {
+				b.maxBackward, b.backward = max(b.maxBackward, delta.delta), true
+			}
+		}
+	}
+	// least squares fit of the offsets of the windows over their middle
+	var n, sumX, sumY, sumXX, sumXY float64
+	for w, b := range windows {
+		if !b.forward || !b.backward {
+			continue
+		}
+		x := float64(w*window + window/2)
+		y := float64(b.minForward+b.maxBackward) / 2
+		n++
+		sumX, sumY, sumXX, sumXY = sumX+x, sumY+y, sumXX+x*x, sumXY+x*y
+	}
+	if n == 0 {
+		return nil, false, nil
+	}
+	var slope float64
+	if denominator := n*sumXX - sumX*sumX; n > 1 && denominator != 0 {
+		slope = (n*sumXY - sumX*sumY) / denominator
+	}
+	intercept := (sumY - slope*sumX) / n
+	offsetAt := func(timestamp int64) int64 {
+		return int64(math.Round(intercept + slope*float64(timestamp-start)))
+	}
+	direction := "from the shared endpoint"
+	if aToB {
+		direction = "to the shared endpoint"
+	}
+	return &ClockComparison{
+		OffsetMicros: offsetAt(start),
+		SkewPPM:      math.Round(slope*1e6*1000) / 1000,
+		Windows:      int(n),
+		AToB:         direction,
+	}, aToB, offsetAt
+}
+
+func delayStats(delays []float64) *DelayStats {
+	if len(delays) == 0 {
+		return nil
+	}
+	sort.Float64s(delays)
+	percentile := func(p float64) float64 {
+		return delays[int(p*float64(len(delays)-1))]
+	}
+	return &DelayStats{
+		Packets:   len(delays),
+		MinMillis: delays[0],
+		P50Millis: percentile(0.5),
+		P90Millis: percentile(0.9),
+		P99Millis: percentile(0.99),
+		MaxMillis: delays[len(delays)-1],
+	}
+}
+
+// CorrelateMain implements the correlate subcommand, comparing two captures
+// of the same traffic from two vantage points, outputs or captures extracted
+// with the flags of the run.
+func CorrelateMain(paths []string, opts Options, settings CorrelateSettings) {
+	if len(paths) != 2 {
+		fmt.Println("Usage: correlate [flags] a b, with a and b outputs or captures of two vantage points")
+		os.Exit(1)
+	}
+	if settings.minConfidence < 0 || settings.minConfidence > 1 || settings.maxOffset <= 0 {
+		fmt.Println("-correlate-min-confidence must be between 0 and 1 and -correlate-max-offset positive")
+		os.Exit(1)
+	}
+	if opts.CGNATLog != "" {
+		translations, err := loadTranslationLog(opts.CGNATLog)
+		if err != nil {
+			fmt.Println("Error reading CGNAT translation log:", err)
+			os.Exit(1)
+		}
+		opts.translations = translations
+	}
+	var vantages [2]*vantage
+	for i, path := range paths {
+		v, err := loadVantage(path, opts)
+		if err != nil {
+			fmt.Println("unable to read vantage point:", err)
+			os.Exit(1)
+		}
+		vantages[i] = v
+	}
+	correlation := correlate(vantages[0], vantages[1], settings)
+
+	fmt.Printf("%d flows matched, %d of A and %d of B unmatched\n", len(correlation.Flows), len(correlation.UnmatchedA), len(correlation.UnmatchedB))
+	if clock := correlation.Clock; clock != nil {
+		fmt.Printf("clock of B: %+.3f ms, drift %+.3f ppm over %d windows; A to B is %s\n", float64(clock.OffsetMicros)/1000, clock.SkewPPM, clock.Windows, clock.AToB)
+	}
+	fmt.Printf("%-50s %-50s %6s %8s %7s %7s %10s %10s\n", "Flow in A", "Flow in B", "Conf.", "Matched", "Only A", "Only B", "A>B p50ms", "B>A p50ms")
+	for _, flow := range correlation.Flows {
+		p50 := func(stats *DelayStats) string {
+			if stats == nil {
+				return "-"
+			}
+			return strconv.FormatFloat(stats.P50Millis, 'f', 2, 64)
+		}
+		fmt.Printf("%-50s %-50s %6.3f %8d %7d %7d %10s %10s\n", flow.KeyA, flow.KeyB, flow.Confidence, flow.MatchedPackets, flow.OnlyInA, flow.OnlyInB, p50(flow.DelayAToB), p50(flow.DelayBToA))
+	}
+	for _, note := range correlation.Notes {
+		fmt.Println("Note:", note)
+	}
+	content, err := json.MarshalIndent(correlation, "", "  ")
+	if err == nil {
+		err = os.WriteFile(settings.out, content, 0644)
+	}
+	if err != nil {
+		fmt.Println("unable to write correlation:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("========== Writing correlation to: %s ==========\n", settings.out)
+}
+
+// RegisterFlags defines the flags of the correlate subcommand on flags.
+func (settings *CorrelateSettings) RegisterFlags(flags *flag.FlagSet) {
+	flags.Float64Var(&settings.minConfidence, "correlate-min-confidence", 0.7, "Smallest confidence of a flow matched by the correlate subcommand to estimate the clock offset and report one-way delays from")
+	flags.DurationVar(&settings.maxOffset, "correlate-max-offset", 2*time.Second, "Largest clock offset plus one-way delay between the two captures of the correlate subcommand")
+	flags.StringVar(&settings.out, "correlate-out", "correlation.json", "Output path of the correlate subcommand's report")
+}
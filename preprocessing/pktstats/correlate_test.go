@@ -0,0 +1,290 @@
+package pktstats
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// endpoints of the synthetic vantage points: the client at A is translated
+// at B, the server is seen at both
+const (
+	clientAtA   = "192.168.1.10:50000"
+	clientAtB   = "198.51.100.2:61000"
+	mediaServer = "203.0.113.10:3478"
+)
+
+const correlateStart = 1_700_000_000_000_000 // µs
+
+func newVantageFlow(key string, protocol int, endpoints [2]string, packets []vantagePacket) *vantageFlow {
+	flow := &vantageFlow{key: key, protocol: protocol, endpoints: endpoints, packets: packets}
+	if len(packets) > 0 {
+		flow.first, flow.last = packets[0].timestamp, packets[len(packets)-1].timestamp
+	}
+	return flow
+}
+
+// clockOfB returns the timestamp of B for a time of A, for a clock of B
+// offset by offset µs at correlateStart and drifting by skewPPM.
+func clockOfB(offset int64, skewPPM float64) func(int64) int64 {
+	return func(timestamp int64) int64 {
+		return timestamp + offset + int64(math.Round(skewPPM*float64(timestamp-correlateStart)/1e6))
+	}
+}
+
+// jitter returns the queueing delay of the i-th packet, none for every tenth.
+func jitter(random *rand.Rand, i int) int64 {
+	if i%10 == 0 {
+		return 0
+	}
+	return random.Int63n(1000)
+}
+
+// mediaFlows returns a media flow of seconds seen at the client (A) and at
+// the WAN port (B): each 100 ms, a packet up with an IP ID and a packet down
+// without one, of alternating sizes, each delay µs plus jitter apart.
+func mediaFlows(random *rand.Rand, offset int64, skewPPM float64, delay int64, seconds int) (a, b *vantageFlow) {
+	toB := clockOfB(offset, skewPPM)
+	var packetsA, packetsB []vantagePacket
+	for i := 0; i < seconds*10; i++ {
+		up := correlateStart + int64(i)*100_000
+		packetsA = append(packetsA, vantagePacket{timestamp: up, src: clientAtA, size: 120, ipid: i + 1})
+		packetsB = append(packetsB, vantagePacket{timestamp: toB(up + delay + jitter(random, i)), src: clientAtB, size: 120, ipid: i + 1})
+		down, size := up+50_000, 1200-i%2*100
+		packetsB = append(packetsB, vantagePacket{timestamp: toB(down - delay - jitter(random, i)), src: mediaServer, size: size})
+		packetsA = append(packetsA, vantagePacket{timestamp: down, src: mediaServer, size: size})
+	}
+	a = newVantageFlow(clientAtA+"-"+mediaServer+"@17", 17, [2]string{clientAtA, mediaServer}, packetsA)
+	b = newVantageFlow(clientAtB+"-"+mediaServer+"@17", 17, [2]string{clientAtB, mediaServer}, packetsB)
+	return a, b
+}
+
+func TestCompareFlows(t *testing.T) {
+	// two packets up and two down, 10 ms apart
+	packets := []vantagePacket{
+		{timestamp: 10_000, src: clientAtA, size: 100, ipid: 1},
+		{timestamp: 20_000, src: mediaServer, size: 1200, ipid: 7},
+		{timestamp: 30_000, src: clientAtA, size: 100, ipid: 2},
+		{timestamp: 40_000, src: mediaServer, size: 1200, ipid: 8},
+	}
+	// seen at B delta µs later, with the client translated
+	atB := func(packets []vantagePacket, delta int64) []vantagePacket {
+		var seen []vantagePacket
+		for _, packet := range packets {
+			packet.timestamp += delta
+			if packet.src == clientAtA {
+				packet.src = clientAtB
+			}
+			seen = append(seen, packet)
+		}
+		return seen
+	}
+	withIPID := func(packets []vantagePacket, ipid func(int) int) []vantagePacket {
+		var changed []vantagePacket
+		for i, packet := range packets {
+			packet.ipid = ipid(i)
+			changed = append(changed, packet)
+		}
+		return changed
+	}
+	noIPID := withIPID(packets, func(int) int { return 0 })
+	constantIPID := withIPID(packets, func(int) int { return 5 })
+	extra := append(atB(packets[:2], 500), vantagePacket{timestamp: 25_500, src: clientAtB, size: 300, ipid: 9})
+	extra = append(extra, atB(packets[2:], 500)...)
+
+	span := [2]int64{0, 50_000}
+	tests := []struct {
+		name       string
+		a, b       []vantagePacket
+		spanB      [2]int64
+		confidence float64
+		matched    int
+		confirmed  int
+		onlyInA    int
+		onlyInB    int
+	}{
+		{"confirmed by IP IDs", packets, atB(packets, 500), span, 1, 4, 4, 0, 0},
+		{"clock of B behind", packets, atB(packets, -800), span, 1, 4, 4, 0, 0},
+		// a size repeating the previous of its direction weighs half
+		{"without IP IDs", noIPID, atB(noIPID, 500), span, 0.625, 4, 0, 0, 0},
+		{"constant IP ID", constantIPID, atB(constantIPID, 500), span, 0.75, 4, 2, 0, 0},
+		{"lost before B", packets, atB([]vantagePacket{packets[0], packets[1], packets[3]}, 500), span, 6.0 / 7, 3, 3, 1, 0},
+		{"B stopped capturing", packets, atB(packets[:2], 500), [2]int64{0, 25_000}, 1, 2, 2, 0, 0},
+		{"extra packet in B", packets, extra, span, 8.0 / 9, 4, 4, 0, 1},
+		{"beyond the max offset", packets, atB(packets, 1500), span, 0, 0, 0, 4, 4},
+		{"other IP IDs", packets, withIPID(atB(packets, 500), func(i int) int { return 100 + i }), span, 0, 0, 0, 4, 4},
+	}
+	for _, test := range tests {
+		a := newVantageFlow("a", 17, [2]string{clientAtA, mediaServer}, test.a)
+		b := newVantageFlow("b", 17, [2]string{clientAtB, mediaServer}, test.b)
+		got := compareFlows(a, b, mediaServer, span, test.spanB, 1000)
+		if math.Abs(got.confidence-test.confidence) > 1e-9 || got.matched != test.matched || got.confirmed != test.confirmed || got.onlyInA != test.onlyInA || got.onlyInB != test.onlyInB {
+			t.Errorf("%s: confidence %.3f, %d matched, %d confirmed, %d only in A, %d only in B; want %.3f, %d, %d, %d, %d", test.name,
+				got.confidence, got.matched, got.confirmed, got.onlyInA, got.onlyInB, test.confidence, test.matched, test.confirmed, test.onlyInA, test.onlyInB)
+		}
+	}
+}
+
+// clockDeltas returns the deltas of the packets of a flow of seconds, one
+// each 100 ms in each direction, for a clock of B offset by offset and
+// drifting by skewPPM, delay µs plus jitter apart; the packets sent to the
+// shared endpoint travel from A to B if aToB.
+func clockDeltas(random *rand.Rand, offset int64, skewPPM float64, delay int64, seconds int, aToB bool) []packetDelta {
+	toB := clockOfB(offset, skewPPM)
+	var deltas []packetDelta
+	for i := 0; i < seconds*10; i++ {
+		forward := correlateStart + int64(i)*100_000
+		backward := forward + 50_000
+		deltas = append(deltas,
+			packetDelta{timestamp: forward, toShared: aToB, delta: toB(forward+delay+jitter(random, i)) - forward},
+			packetDelta{timestamp: backward, toShared: !aToB, delta: toB(backward-delay-jitter(random, i)) - backward})
+	}
+	return deltas
+}
+
+func TestEstimateClock(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	confident := func(deltas []packetDelta) []*flowComparison {
+		return []*flowComparison{{confidence: 0.9, deltas: deltas}}
+	}
+	oneWay := func(deltas []packetDelta) []packetDelta {
+		var kept []packetDelta
+		for _, delta := range deltas {
+			if delta.toShared {
+				kept = append(kept, delta)
+			}
+		}
+		return kept
+	}
+	tests := []struct {
+		name        string
+		comparisons []*flowComparison
+		offset      int64 // µs, at correlateStart
+		skewPPM     float64
+		windows     int
+		aToB        bool
+	}{
+		{"B ahead and drifting", confident(clockDeltas(random, 150_000, 50, 2000, 60, true)), 150_000, 50, 6, true},
+		{"B behind and drifting back", confident(clockDeltas(random, -2_000_000, -20, 15_000, 60, true)), -2_000_000, -20, 6, true},
+		{"B at the client", confident(clockDeltas(random, 150_000, 50, 2000, 60, false)), 150_000, 50, 6, false},
+		{"one window", confident(clockDeltas(random, 3000, 0, 2000, 10, true)), 3000, 0, 1, true},
+		{"below the confidence", []*flowComparison{{confidence: 0.5, deltas: clockDeltas(random, 150_000, 50, 2000, 60, true)}}, 0, 0, 0, false},
+		{"one direction", confident(oneWay(clockDeltas(random, 150_000, 50, 2000, 60, true))), 0, 0, 0, false},
+		{"none", nil, 0, 0, 0, false},
+	}
+	for _, test := range tests {
+		clock, aToB, offsetAt := estimateClock(test.comparisons, 0.7, correlateStart)
+		if test.windows == 0 {
+			if clock != nil {
+				t.Errorf("%s: clock %+v", test.name, clock)
+			}
+			continue
+		}
+		if clock == nil {
+			t.Errorf("%s: no clock estimated", test.name)
+			continue
+		}
+		// the bounds of a window are the packets of least jitter, anywhere in
+		// it, which leaves its offset tens of µs off that at its middle
+		if abs(clock.OffsetMicros-test.offset) > 50 || math.Abs(clock.SkewPPM-test.skewPPM) > 0.5 || clock.Windows != test.windows || aToB != test.aToB {
+			t.Errorf("%s: clock %+v, A to B %v; want offset %d µs, skew %v ppm over %d windows, A to B %v", test.name, clock, aToB, test.offset, test.skewPPM, test.windows, test.aToB)
+		}
+		later := correlateStart + int64(60e6)
+		if want := clockOfB(test.offset, test.skewPPM)(later) - later; abs(offsetAt(later)-want) > 50 {
+			t.Errorf("%s: offset %d µs a minute later, want %d", test.name, offsetAt(later), want)
+		}
+	}
+}
+
+func abs(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+// TestCorrelate matches the flows of a client and its WAN port, with the
+// clock of the WAN port 150 ms ahead and drifting by 50 ppm.
+func TestCorrelate(t *testing.T) {
+	const (
+		offset  = 150_000
+		skewPPM = 50
+		delay   = 2000
+	)
+	random := rand.New(rand.NewSource(1))
+	mediaA, mediaB := mediaFlows(random, offset, skewPPM, delay, 60)
+	toB := clockOfB(offset, skewPPM)
+
+	// a flow of packets of one size, with two candidates at B alike
+	var ambiguous []vantagePacket
+	for i := int64(0); i < 20; i++ {
+		ambiguous = append(ambiguous, vantagePacket{timestamp: correlateStart + i*50_000, src: "203.0.113.20:9000", size: 1000})
+	}
+	candidate := func(port string) *vantageFlow {
+		var packets []vantagePacket
+		for _, packet := range ambiguous {
+			packet.timestamp = toB(packet.timestamp - delay)
+			packets = append(packets, packet)
+		}
+		return newVantageFlow("198.51.100.2:"+port+"-203.0.113.20:9000@17", 17, [2]string{"198.51.100.2:" + port, "203.0.113.20:9000"}, packets)
+	}
+	ambiguousA := newVantageFlow("192.168.1.10:50002-203.0.113.20:9000@17", 17, [2]string{"192.168.1.10:50002", "203.0.113.20:9000"}, ambiguous)
+	// flows seen at one vantage point only
+	local := newVantageFlow("192.168.1.10:50001-192.168.1.1:53@17", 17, [2]string{"192.168.1.10:50001", "192.168.1.1:53"},
+		[]vantagePacket{{timestamp: correlateStart, src: "192.168.1.10:50001", size: 40}})
+	router := newVantageFlow("198.51.100.2:123-192.0.2.123:123@17", 17, [2]string{"198.51.100.2:123", "192.0.2.123:123"},
+		[]vantagePacket{{timestamp: toB(correlateStart), src: "198.51.100.2:123", size: 48}})
+
+	a := &vantage{source: "client.pcapng", start: correlateStart, end: mediaA.last, flows: []*vantageFlow{mediaA, ambiguousA, local}}
+	b := &vantage{source: "wan.pcapng", start: toB(correlateStart), end: toB(mediaA.last), flows: []*vantageFlow{router, mediaB, candidate("61002"), candidate("61003")}}
+
+	tests := []struct {
+		name          string
+		minConfidence float64
+		clock         bool
+	}{
+		{"media flow confident", 0.7, true},
+		// confirmed by IP IDs upstream only, the media flow is not
+		{"no flow confident enough", 0.9, false},
+	}
+	for _, test := range tests {
+		correlation := correlate(a, b, CorrelateSettings{minConfidence: test.minConfidence, maxOffset: 1e9})
+		// the media flow aligns best, the ambiguous one with the first of its candidates
+		if len(correlation.Flows) != 2 {
+			t.Fatalf("%s: flows %+v", test.name, correlation.Flows)
+		}
+		media, other := correlation.Flows[0], correlation.Flows[1]
+		// IP IDs confirm the packets up, the sizes alternate down
+		if media.KeyA != mediaA.key || media.KeyB != mediaB.key || media.SharedEndpoint != mediaServer || media.Confidence != 0.875 || media.MatchedPackets != 1200 || media.IPIDConfirmed != 600 || media.OnlyInA != 0 || media.OnlyInB != 0 {
+			t.Errorf("%s: media flow %+v", test.name, media)
+		}
+		if other.KeyA != ambiguousA.key || other.KeyB != "198.51.100.2:61002-203.0.113.20:9000@17" || other.Confidence != 0.513 || other.DelayAToB != nil || other.DelayBToA != nil {
+			t.Errorf("%s: ambiguous flow %+v, want the first candidate without delays", test.name, other)
+		}
+		if want := []string{local.key}; !reflect.DeepEqual(correlation.UnmatchedA, want) {
+			t.Errorf("%s: unmatched in A %v, want %v", test.name, correlation.UnmatchedA, want)
+		}
+		if want := []string{router.key, "198.51.100.2:61003-203.0.113.20:9000@17"}; !reflect.DeepEqual(correlation.UnmatchedB, want) {
+			t.Errorf("%s: unmatched in B %v, want %v", test.name, correlation.UnmatchedB, want)
+		}
+
+		if !test.clock {
+			if correlation.Clock != nil || len(correlation.Notes) != 1 || media.DelayAToB != nil || media.DelayBToA != nil {
+				t.Errorf("%s: clock %+v, notes %q and delays of the media flow", test.name, correlation.Clock, correlation.Notes)
+			}
+			continue
+		}
+		clock := correlation.Clock
+		if clock == nil || abs(clock.OffsetMicros-offset) > 50 || math.Abs(clock.SkewPPM-skewPPM) > 0.5 || clock.Windows != 6 || clock.AToB != "to the shared endpoint" {
+			t.Fatalf("%s: clock %+v, want %d µs and %d ppm over 6 windows", test.name, clock, offset, skewPPM)
+		}
+		// the one-way delays are recovered net of the drifting offset, within
+		// the jitter of 1 ms
+		for _, stats := range []*DelayStats{media.DelayAToB, media.DelayBToA} {
+			if stats == nil || stats.Packets != 600 || math.Abs(stats.MinMillis-delay/1000.0) > 0.1 || stats.MaxMillis > delay/1000.0+1.1 {
+				t.Errorf("%s: delays %+v, want 600 packets from %v ms", test.name, stats, delay/1000.0)
+			}
+		}
+	}
+}
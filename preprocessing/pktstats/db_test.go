@@ -0,0 +1,269 @@
+package pktstats
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingDB keeps the rows exported to it.
+type recordingDB struct {
+	rows []*dbRows
+}
+
+func (db *recordingDB) createSchema(ctx context.Context) error { return nil }
+
+func (db *recordingDB) export(ctx context.Context, rows *dbRows) error {
+	db.rows = append(db.rows, rows)
+	return nil
+}
+
+func (db *recordingDB) close() {}
+
+// TestCaptureHash exports captures read in each way and checks that their
+// rows are keyed by the SHA-256 of the whole file.
+func TestCaptureHash(t *testing.T) {
+	capture := fixture(t, "flows.pcap", flowsCapture)
+	content, err := os.ReadFile(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(content)
+	writer.Close()
+
+	tests := []struct {
+		name    string
+		content []byte
+		ext     string
+		mmap    bool
+	}{
+		{"pcap", content, ".pcap", false},
+		{"mapped", content, ".pcap", true},
+		{"compressed", compressed.Bytes(), ".pcap.gz", false},
+		// a truncated record header after the last packet
+		{"trailing bytes", append(append([]byte{}, content...), 1, 2, 3), ".pcap", false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "capture"+test.ext)
+		if err := os.WriteFile(path, test.content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		db := &recordingDB{}
+		opts := testOptions()
+		opts.Mmap, opts.db = test.mmap, db
+		if ExtractPacketStats(context.Background(), path, filepath.Join(t.TempDir(), "capture_packetStats.json"), opts) == nil {
+			t.Fatalf("%s: unable to extract %s", test.name, path)
+		}
+		sum := sha256.Sum256(test.content)
+		if len(db.rows) != 1 || db.rows[0].file.FileHash != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: rows %+v, want one file keyed by %x", test.name, db.rows, sum)
+		}
+	}
+}
+
+func TestNewDBRows(t *testing.T) {
+	hasher := &captureHasher{hash: sha256.New()}
+	io.WriteString(hasher.hash, "capture")
+	sum := sha256.Sum256([]byte("capture"))
+	hash := hex.EncodeToString(sum[:])
+
+	game := &Flow{LocalIP: "192.168.1.10", RemoteIP: "203.0.113.10", LocalPort: 50000, RemotePort: 49005, Protocol: 17,
+		ServiceFlowType: "video", DNSName: "eu1.game.example.com", RegisteredDomain: "example.com", LabelSource: "dns",
+		TransportProfile: "rtp", LocalClient: "192.168.1.10", SessionID: 1,
+		Packets: []Packet{{Timestamp: 1000, Upstream: true, PktLength: 142, PayloadSize: 100}, {Timestamp: 1500, PktLength: 1242, PayloadSize: 1200}}}
+	game.download = downloadState{upBytes: 142, downBytes: 1242, packets: 2, first: 1000, last: 1500}
+	update := &Flow{LocalIP: "192.168.1.10", RemoteIP: "198.51.100.7", LocalPort: 50001, RemotePort: 443, Protocol: 6,
+		RegisteredDomain: "cdn.example.net", TrafficClass: "bulk-download", Outcome: "completed",
+		Packets: []Packet{{Timestamp: 2000, PktLength: 1500, PayloadSize: 1448}}}
+	update.download = downloadState{downBytes: 1500, packets: 1, first: 2000, last: 2000}
+	output := &Output{
+		Meta: &Meta{
+			SchemaVersion: schemaVersion, OptionsHash: "options", Source: "capture.pcapng",
+			TotalPackets: 4, TotalBytes: 3000, AccountedPackets: 3, AccountedBytes: 2884,
+			Services: map[string]*ServiceStats{
+				"example.com":     {Flows: 1, Packets: 2, Bytes: 1384, StreamingBytes: 1384},
+				"cdn.example.net": {Flows: 1, Packets: 1, Bytes: 1500, BulkBytes: 1500},
+			},
+			captureHash: hasher,
+		},
+		Flows: map[string]*Flow{"b": update, "a": game},
+	}
+	opts := DefaultOptions()
+	opts.DBPacketServices = " example.com ,"
+	rows, err := newDBRows(output, "out.json", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportedAt := rows.file.ExportedAt
+	want := &dbRows{
+		file: dbFileRow{FileHash: hash, Source: "capture.pcapng", Output: "out.json", OptionsHash: "options", SchemaVersion: schemaVersion,
+			TotalPackets: 4, TotalBytes: 3000, AccountedPackets: 3, AccountedBytes: 2884, Flows: 2, ExportedAt: exportedAt},
+		services: []dbServiceRow{
+			{FileHash: hash, Service: "cdn.example.net", Flows: 1, Packets: 1, Bytes: 1500, BulkBytes: 1500, ExportedAt: exportedAt},
+			{FileHash: hash, Service: "example.com", Flows: 1, Packets: 2, Bytes: 1384, StreamingBytes: 1384, ExportedAt: exportedAt},
+		},
+		flows: []dbFlowRow{
+			{FileHash: hash, FlowKey: "a", LocalIP: "192.168.1.10", RemoteIP: "203.0.113.10", LocalPort: 50000, RemotePort: 49005, Protocol: 17,
+				ServiceFlowType: "video", DNSName: "eu1.game.example.com", RegisteredDomain: "example.com", LabelSource: "dns", TransportProfile: "rtp",
+				LocalClient: "192.168.1.10", SessionID: 1, Packets: 2, UpBytes: 142, DownBytes: 1242, FirstTimestamp: 1000, LastTimestamp: 1500, ExportedAt: exportedAt},
+			{FileHash: hash, FlowKey: "b", LocalIP: "192.168.1.10", RemoteIP: "198.51.100.7", LocalPort: 50001, RemotePort: 443, Protocol: 6,
+				RegisteredDomain: "cdn.example.net", TrafficClass: "bulk-download", Outcome: "completed", Packets: 1, DownBytes: 1500,
+				FirstTimestamp: 2000, LastTimestamp: 2000, ExportedAt: exportedAt},
+		},
+		// the packets of the flows of the packet services only
+		packets: []dbPacketRow{
+			{FileHash: hash, FlowKey: "a", Seq: 0, Timestamp: 1000, Upstream: true, PktLength: 142, PayloadSize: 100, ExportedAt: exportedAt},
+			{FileHash: hash, FlowKey: "a", Seq: 1, Timestamp: 1500, PktLength: 1242, PayloadSize: 1200, ExportedAt: exportedAt},
+		},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows\n%+v\nwant\n%+v", rows, want)
+	}
+	if time.Since(exportedAt) > time.Minute || exportedAt.Location() != time.UTC {
+		t.Errorf("exported at %v", exportedAt)
+	}
+
+	// an output whose capture was not hashed, e.g. after a failed read of its rest
+	output.Meta.captureHash = &captureHasher{hash: sha256.New(), err: io.ErrUnexpectedEOF}
+	if _, err := newDBRows(output, "out.json", opts); err == nil {
+		t.Error("rows of a capture not hashed whole")
+	}
+}
+
+// schemaColumns returns the columns of each table of a schema, in order,
+// and the columns of its key: the primary key or the ORDER BY.
+func schemaColumns(t *testing.T, schema []string) (map[string][]string, map[string]string) {
+	t.Helper()
+	create := regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \(`)
+	key := regexp.MustCompile(`(?:PRIMARY KEY|ORDER BY) \(?([\w, ]+?)\)?$`)
+	columns, keys := make(map[string][]string), make(map[string]string)
+	for _, statement := range schema {
+		scanner := bufio.NewScanner(strings.NewReader(statement))
+		scanner.Scan()
+		match := create.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			t.Fatalf("statement %q creates no table", statement)
+		}
+		table := match[1]
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if match := key.FindStringSubmatch(line); match != nil {
+				keys[table] = match[1]
+			}
+			if strings.HasPrefix(line, ")") || strings.HasPrefix(line, "PRIMARY KEY") {
+				continue
+			}
+			columns[table] = append(columns[table], strings.Fields(line)[0])
+		}
+		if _, ok := keys[table]; !ok {
+			keys[table] = strings.TrimSuffix(columns[table][0], ",")
+		}
+	}
+	return columns, keys
+}
+
+// TestDBSchema checks that the tables of both databases have the columns of
+// the row types, in order, and the same keys.
+func TestDBSchema(t *testing.T) {
+	tables := map[string]any{
+		"pktstats_files":    dbFileRow{},
+		"pktstats_services": dbServiceRow{},
+		"pktstats_flows":    dbFlowRow{},
+		"pktstats_packets":  dbPacketRow{},
+	}
+	wantKeys := map[string]string{
+		"pktstats_files":    "file_hash",
+		"pktstats_services": "file_hash, service",
+		"pktstats_flows":    "file_hash, flow_key",
+		"pktstats_packets":  "file_hash, flow_key, seq",
+	}
+	for name, schema := range map[string][]string{"postgres": postgresSchema, "clickhouse": clickHouseSchema} {
+		columns, keys := schemaColumns(t, schema)
+		if len(columns) != len(tables) {
+			t.Errorf("%s: tables %v", name, keys)
+		}
+		for table, row := range tables {
+			if !reflect.DeepEqual(columns[table], dbColumns(row)) {
+				t.Errorf("%s: %s columns %v, want %v", name, table, columns[table], dbColumns(row))
+			}
+			if keys[table] != wantKeys[table] {
+				t.Errorf("%s: %s keyed by %q, want %q", name, table, keys[table], wantKeys[table])
+			}
+		}
+	}
+}
+
+// TestClickHouseExport exports the rows of a file to a fake ClickHouse HTTP
+// interface, checking that the rows of the capture hash are deleted first.
+func TestClickHouseExport(t *testing.T) {
+	type request struct {
+		query, hash string
+		rows        []map[string]any
+	}
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received := request{query: r.URL.Query().Get("query"), hash: r.URL.Query().Get("param_hash")}
+		decoder := json.NewDecoder(r.Body)
+		for {
+			var row map[string]any
+			if err := decoder.Decode(&row); err != nil {
+				break
+			}
+			received.rows = append(received.rows, row)
+		}
+		requests = append(requests, received)
+	}))
+	defer server.Close()
+
+	db := &clickHouseExporter{endpoint: server.URL + "/", client: server.Client()}
+	exportedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	rows := &dbRows{
+		file:     dbFileRow{FileHash: "hash", Source: "capture.pcapng", Flows: 1, ExportedAt: exportedAt},
+		services: []dbServiceRow{{FileHash: "hash", Service: "example.com", ExportedAt: exportedAt}},
+		flows:    []dbFlowRow{{FileHash: "hash", FlowKey: "a", RemotePort: 49005, ExportedAt: exportedAt}},
+	}
+	if err := db.export(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+	var queries []string
+	for _, received := range requests {
+		queries = append(queries, received.query)
+	}
+	want := []string{
+		"DELETE FROM pktstats_files WHERE file_hash = {hash:String}",
+		"DELETE FROM pktstats_packets WHERE file_hash = {hash:String}",
+		"DELETE FROM pktstats_flows WHERE file_hash = {hash:String}",
+		"DELETE FROM pktstats_services WHERE file_hash = {hash:String}",
+		"INSERT INTO pktstats_services FORMAT JSONEachRow",
+		"INSERT INTO pktstats_flows FORMAT JSONEachRow",
+		"INSERT INTO pktstats_files FORMAT JSONEachRow",
+	}
+	if !reflect.DeepEqual(queries, want) {
+		t.Fatalf("queries %q, want %q", queries, want)
+	}
+	for _, received := range requests[:4] {
+		if received.hash != "hash" {
+			t.Errorf("%s: hash %q", received.query, received.hash)
+		}
+	}
+	flow := requests[5].rows
+	if len(flow) != 1 || len(flow[0]) != len(dbColumns(dbFlowRow{})) || flow[0]["flow_key"] != "a" || flow[0]["remote_port"] != 49005.0 || flow[0]["exported_at"] != "2026-01-02T03:04:05Z" {
+		t.Errorf("flow rows %v", flow)
+	}
+}
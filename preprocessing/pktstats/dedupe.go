@@ -0,0 +1,138 @@
+package pktstats
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// DedupeMain implements the dedupe subcommand, merging the outputs of
+// overlapping capture files (e.g. tcpdump -G rotations) into one output where
+// packets present in several inputs are kept once.
+func DedupeMain(args []string) {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	outPath := fs.String("o", "merged_packetStats.json", "Path of the merged output")
+	tolerance := fs.Duration("tolerance", time.Microsecond, "Largest timestamp difference between copies of the same packet")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: dedupe [-o merged.json] [-tolerance 1us] output.json...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	outputs := make([]*Output, fs.NArg())
+	for i, path := range fs.Args() {
+		output, err := LoadFlows(path)
+		if err != nil {
+			fmt.Println("unable to read output:", err)
+			os.Exit(1)
+		}
+		if output.Meta == nil {
+			fmt.Printf("%s is an output without a meta block\n", path)
+			os.Exit(1)
+		}
+		if mode := output.Meta.zeroPayloadMode(); i > 0 && mode != outputs[0].Meta.zeroPayloadMode() {
+			fmt.Printf("%s was extracted with -zero-payload %s, %s with %s\n", path, mode, outputs[0].Meta.Source, outputs[0].Meta.zeroPayloadMode())
+			os.Exit(1)
+		}
+		outputs[i] = output
+	}
+	merged, removed := dedupeOutputs(outputs, *tolerance)
+	fmt.Printf("Removed %d duplicate packets\n", removed)
+	if err := writeOutput(*outPath, merged, merged.Meta.Options); err != nil {
+		fmt.Println(err)
+		panic("unable to write to file")
+	}
+}
+
+// sourcedPacket is a packet of a merged flow with the input it comes from.
+type sourcedPacket struct {
+	Packet
+	input int
+}
+
+// dedupeOutputs merges outputs, dropping packets of a flow that another input
+// already holds with the same direction, length and IP ID and a timestamp
+// within tolerance. Repeated packets within one input, such as retransmissions,
+// are kept. The meta block is the first input's, with totals adjusted.
+func dedupeOutputs(outputs []*Output, tolerance time.Duration) (*Output, int64) {
+	meta := *outputs[0].Meta
+	meta.Format = "json"
+	meta.Options.Format = "json"
+	meta.Flows, meta.ThirdPartyFlows = nil, nil
+	meta.Sources = nil
+	meta.TotalPackets, meta.TotalBytes, meta.AccountedPackets, meta.AccountedBytes = 0, 0, 0, 0
+	for _, output := range outputs {
+		meta.Sources = append(meta.Sources, output.Meta.Source)
+		meta.TotalPackets += output.Meta.TotalPackets
+		meta.TotalBytes += output.Meta.TotalBytes
+		meta.AccountedPackets += output.Meta.AccountedPackets
+		meta.AccountedBytes += output.Meta.AccountedBytes
+	}
+	// outputs from before timestamps had a configurable precision are in microseconds
+	window := meta.Options.duration(tolerance)
+
+	merged := &Output{Meta: &meta}
+	var removed, removedBytes int64
+	merged.Flows = dedupeFlows(outputs, func(output *Output) map[string]*Flow { return output.Flows }, window, &removed, &removedBytes)
+	thirdPartyFlows := dedupeFlows(outputs, func(output *Output) map[string]*Flow { return output.ThirdPartyFlows }, window, &removed, &removedBytes)
+	if len(thirdPartyFlows) > 0 {
+		merged.ThirdPartyFlows = thirdPartyFlows
+	}
+	meta.Services = serviceRollup(merged.Flows)
+	meta.TotalPackets -= removed
+	meta.TotalBytes -= removedBytes
+	meta.AccountedPackets -= removed
+	meta.AccountedBytes -= removedBytes
+	return merged, removed
+}
+
+func dedupeFlows(outputs []*Output, flowsOf func(*Output) map[string]*Flow, window int64, removed, removedBytes *int64) map[string]*Flow {
+	flows := make(map[string]*Flow)
+	packets := make(map[string][]sourcedPacket)
+	for i, output := range outputs {
+		for key, flow := range flowsOf(output) {
+			if _, ok := flows[key]; !ok {
+				flows[key] = flow
+			}
+			for _, packet := range flow.Packets {
+				packets[key] = append(packets[key], sourcedPacket{packet, i})
+			}
+		}
+	}
+	for key, flow := range flows {
+		candidates := packets[key]
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Timestamp < candidates[j].Timestamp })
+		flow.Packets = flow.Packets[:0:0]
+		var kept []sourcedPacket
+		for _, packet := range candidates {
+			if isDuplicate(kept, packet, window) {
+				flow.DuplicatesRemoved++
+				*removed++
+				*removedBytes += int64(packet.PktLength)
+				continue
+			}
+			kept = append(kept, packet)
+			flow.Packets = append(flow.Packets, packet.Packet)
+		}
+	}
+	return flows
+}
+
+// isDuplicate reports whether a packet kept from another input within the
+// timestamp window is an exact copy of packet.
+func isDuplicate(kept []sourcedPacket, packet sourcedPacket, window int64) bool {
+	for i := len(kept) - 1; i >= 0 && packet.Timestamp-kept[i].Timestamp <= window; i-- {
+		other := kept[i]
+		if other.input != packet.input && other.Upstream == packet.Upstream &&
+			other.PktLength == packet.PktLength && other.IPID == packet.IPID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+)
+
+// devicesMu serializes updates of the per-directory devices.json files, which
+// are shared by all captures of a directory.
+var devicesMu sync.Mutex
+
+// Device is a local household device observed through ARP and DHCP.
+type Device struct {
+	ID               string // MAC address without separators
+	MAC              string
+	OUI              string // vendor prefix of the MAC address
+	Hostname         string `json:",omitempty"` // from DHCP option 12
+	ParamRequestList []int  `json:",omitempty"` // from DHCP option 55, useful for fingerprinting
+	IPs              []DeviceIP
+}
+
+// DeviceIP is an IPv4 address held by a device, with the UNIX microsecond
+// timestamps of its first and last observation.
+type DeviceIP struct {
+	IP                  string
+	FirstSeen, LastSeen int64
+}
+
+// deviceTable maps MAC addresses to devices.
+type deviceTable map[string]*Device
+
+func (devices deviceTable) device(mac net.HardwareAddr) *Device {
+	key := mac.String()
+	device, ok := devices[key]
+	if !ok {
+		device = &Device{
+			ID:  strings.ReplaceAll(key, ":", ""),
+			MAC: key,
+		}
+		if len(key) >= 8 {
+			device.OUI = key[:8]
+		}
+		devices[key] = device
+	}
+	return device
+}
+
+// holds records that the device held ip at timestamp.
+func (device *Device) holds(ip string, firstSeen, lastSeen int64) {
+	for i := range device.IPs {
+		if device.IPs[i].IP == ip {
+			device.IPs[i].FirstSeen = min(device.IPs[i].FirstSeen, firstSeen)
+			device.IPs[i].LastSeen = max(device.IPs[i].LastSeen, lastSeen)
+			return
+		}
+	}
+	device.IPs = append(device.IPs, DeviceIP{IP: ip, FirstSeen: firstSeen, LastSeen: lastSeen})
+}
+
+// observeARP records the sender of ARP requests and replies.
+func (devices deviceTable) observeARP(arp *layers.ARP, timestamp int64) {
+	if arp.Operation != layers.ARPRequest && arp.Operation != layers.ARPReply {
+		return
+	}
+	ip := net.IP(arp.SourceProtAddress)
+	if ip.IsUnspecified() {
+		// ARP probe, the sender does not hold the address yet
+		return
+	}
+	devices.device(arp.SourceHwAddress).holds(ip.String(), timestamp, timestamp)
+}
+
+// observeDHCP records client hostnames and parameter request lists from DHCP
+// requests, and assigned addresses from DHCP ACKs.
+func (devices deviceTable) observeDHCP(dhcp *layers.DHCPv4, timestamp int64) {
+	device := devices.device(dhcp.ClientHWAddr)
+	var msgType layers.DHCPMsgType
+	for _, opt := range dhcp.Options {
+		switch opt.Type {
+		case layers.DHCPOptMessageType:
+			if len(opt.Data) == 1 {
+				msgType = layers.DHCPMsgType(opt.Data[0])
+			}
+		case layers.DHCPOptHostname:
+			device.Hostname = string(opt.Data)
+		case layers.DHCPOptParamsRequest:
+			device.ParamRequestList = device.ParamRequestList[:0]
+			for _, param := range opt.Data {
+				device.ParamRequestList = append(device.ParamRequestList, int(param))
+			}
+		}
+	}
+	if msgType == layers.DHCPMsgTypeAck && !dhcp.YourClientIP.IsUnspecified() {
+		device.holds(dhcp.YourClientIP.String(), timestamp, timestamp)
+	}
+}
+
+// lookup returns the ID of the device that held ip at timestamp, or of the
+// last device known to hold it, or "" if no device held the address.
+func (devices deviceTable) lookup(ip string, timestamp int64) string {
+	var id string
+	var best int64
+	for _, device := range devices {
+		for _, held := range device.IPs {
+			if held.IP != ip {
+				continue
+			}
+			if held.FirstSeen <= timestamp && timestamp <= held.LastSeen {
+				return device.ID
+			}
+			if id == "" || held.LastSeen > best {
+				id, best = device.ID, held.LastSeen
+			}
+		}
+	}
+	return id
+}
+
+// saveDevices merges the devices observed in a capture into devices.json in
+// dir, the localDir of the capture, next to dns_map.json.
+func saveDevices(dir string, devices deviceTable) error {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	devicesPath := filepath.Join(dir, "devices.json")
+	stored := make(deviceTable)
+	if devicesFile, err := os.ReadFile(devicesPath); err == nil {
+		if err := json.Unmarshal(devicesFile, &stored); err != nil {
+			return fmt.Errorf("unable to unmarshal %s: %w", devicesPath, err)
+		}
+	}
+	for key, device := range devices {
+		known, ok := stored[key]
+		if !ok {
+			stored[key] = device
+			continue
+		}
+		if device.Hostname != "" {
+			known.Hostname = device.Hostname
+		}
+		if len(device.ParamRequestList) > 0 {
+			known.ParamRequestList = device.ParamRequestList
+		}
+		for _, held := range device.IPs {
+			known.holds(held.IP, held.FirstSeen, held.LastSeen)
+		}
+	}
+	jsonString, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(devicesPath, jsonString, 0644)
+}
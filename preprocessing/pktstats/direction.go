@@ -0,0 +1,17 @@
+package pktstats
+
+// Direction is the direction of a packet relative to the local network.
+type Direction string
+
+const (
+	DirectionUpstream   Direction = "upstream"   // from a local to a remote endpoint
+	DirectionDownstream Direction = "downstream" // from a remote to a local endpoint
+	DirectionLocal      Direction = "local"      // between two local endpoints
+	DirectionUnknown    Direction = "unknown"    // between two remote endpoints (third-party traffic)
+)
+
+// canonicalUpstream reports whether a packet without a single local endpoint
+// counts as upstream: sent by the endpoint ordered first in canonical keys.
+func (packet *Packet) canonicalUpstream() bool {
+	return endpointLess(packet.SrcIP, packet.SrcPort, packet.DstIP, packet.DstPort)
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package pktstats
+
+// freeSpace is not supported on this platform, files are started without a
+// space check.
+func freeSpace(path string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
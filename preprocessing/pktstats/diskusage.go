@@ -0,0 +1,113 @@
+package pktstats
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// errFreeSpaceUnsupported is returned by freeSpace on platforms without
+// statfs; files are then started without a space check.
+var errFreeSpaceUnsupported = errors.New("free space unknown on this platform")
+
+// outputBytes counts the bytes of all output files written by the process,
+// see hashedFile.
+var outputBytes atomic.Int64
+
+// DiskUsage is the disk usage accounting of a run in its manifest.
+type DiskUsage struct {
+	OutputBytes    int64 `json:"outputBytes"`              // written to output files by the run
+	MaxTotalOutput int64 `json:"maxTotalOutput,omitempty"` // Options.MaxTotalOutput
+	LimitReached   bool  `json:"limitReached,omitempty"`   // files were left pending once OutputBytes reached MaxTotalOutput
+	Pending        int   `json:"pending,omitempty"`        // files not started because of the limit
+	RefusedSpace   int   `json:"refusedSpace,omitempty"`   // files failed for lack of free space, see Options.OutputSpaceFactor
+	// free space on the filesystem of the base path at the end of the run, if
+	// known
+	FreeBytes *int64 `json:"freeBytes,omitempty"`
+}
+
+// diskLimits enforces Options.MaxTotalOutput and Options.OutputSpaceFactor
+// across the workers of a run. Files in progress reserve the space their
+// outputs are expected to take, so that files started at once do not all
+// count on the same free space.
+type diskLimits struct {
+	limit   int64
+	factor  float64
+	start   int64 // outputBytes when the run started
+	pending atomic.Int64
+	refused atomic.Int64
+
+	mu       sync.Mutex
+	reserved int64
+}
+
+func newDiskLimits(opts Options) *diskLimits {
+	return &diskLimits{limit: opts.MaxTotalOutput, factor: opts.OutputSpaceFactor, start: outputBytes.Load()}
+}
+
+// limitReached reports whether the outputs of the run reached the limit, in
+// which case no new file is to be started.
+func (limits *diskLimits) limitReached() bool {
+	return limits.limit > 0 && outputBytes.Load()-limits.start >= limits.limit
+}
+
+// deferFile counts a file left pending at the limit.
+func (limits *diskLimits) deferFile() {
+	limits.pending.Add(1)
+}
+
+// reserve checks that the outputs of inputs of size bytes fit into the free
+// space of the filesystem of outDir, net of the reservations of the files in
+// progress, and reserves their expected size until release is called.
+func (limits *diskLimits) reserve(outDir string, size int64) (release func(), err error) {
+	if limits.factor <= 0 {
+		return func() {}, nil
+	}
+	free, err := freeSpace(outDir)
+	if errors.Is(err, errFreeSpaceUnsupported) {
+		return func() {}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	expected := int64(float64(size) * limits.factor)
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	if available := free - limits.reserved; expected > available {
+		limits.refused.Add(1)
+		return nil, fmt.Errorf("%d bytes free on the output filesystem (%d reserved by files in progress), %d expected for the output of %d input bytes", free, limits.reserved, expected, size)
+	}
+	limits.reserved += expected
+	return func() {
+		limits.mu.Lock()
+		limits.reserved -= expected
+		limits.mu.Unlock()
+	}, nil
+}
+
+// report returns the accounting of the run for its manifest.
+func (limits *diskLimits) report(basePath string) *DiskUsage {
+	usage := &DiskUsage{
+		OutputBytes:    outputBytes.Load() - limits.start,
+		MaxTotalOutput: limits.limit,
+		Pending:        int(limits.pending.Load()),
+		RefusedSpace:   int(limits.refused.Load()),
+	}
+	usage.LimitReached = usage.Pending > 0
+	if free, err := freeSpace(basePath); err == nil {
+		usage.FreeBytes = &free
+	}
+	return usage
+}
+
+// inputSize is the total size of the local files of a run input.
+func inputSize(paths ...string) int64 {
+	var size int64
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
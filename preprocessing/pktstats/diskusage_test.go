@@ -0,0 +1,109 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDiskLimitsReserve reserves the outputs of inputs sized relative to the
+// free space of the temporary directory, so that it holds on any filesystem.
+func TestDiskLimitsReserve(t *testing.T) {
+	dir := t.TempDir()
+	free, err := freeSpace(dir)
+	if errors.Is(err, errFreeSpaceUnsupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		factor float64
+		sizes  []int64 // reserved in turn, all held until the end
+		admit  []bool
+	}{
+		{"no check", 0, []int64{2 * free}, []bool{true}},
+		{"fits", 2, []int64{free / 4}, []bool{true}},
+		{"factor", 4, []int64{free / 2}, []bool{false}},
+		{"files in progress", 1, []int64{free * 6 / 10, free * 6 / 10, free / 10}, []bool{true, false, true}},
+	}
+	for _, test := range tests {
+		limits := newDiskLimits(Options{OutputSpaceFactor: test.factor})
+		refused := 0
+		for i, size := range test.sizes {
+			release, err := limits.reserve(dir, size)
+			if (err == nil) != test.admit[i] {
+				t.Errorf("%s: file %d of %d bytes admitted %v (%v), want %v", test.name, i, size, err == nil, err, test.admit[i])
+			}
+			if err != nil {
+				refused++
+				continue
+			}
+			defer release()
+		}
+		if usage := limits.report(dir); usage.RefusedSpace != refused {
+			t.Errorf("%s: %d files refused in the report, want %d", test.name, usage.RefusedSpace, refused)
+		}
+	}
+
+	// released reservations free their space for the next files
+	limits := newDiskLimits(Options{OutputSpaceFactor: 1})
+	release, err := limits.reserve(dir, free*6/10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, err := limits.reserve(dir, free*6/10); err != nil {
+		t.Errorf("space still reserved after release: %v", err)
+	}
+}
+
+// TestMaxTotalOutput runs over three captures with a limit the first output
+// exceeds: the first is processed, the other two left pending.
+func TestMaxTotalOutput(t *testing.T) {
+	content, err := os.ReadFile(fixture(t, "flows.pcap", flowsCapture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var inputs []string
+	for _, name := range []string{"a.pcap", "b.pcap", "c.pcap"} {
+		inputs = append(inputs, filepath.Join(dir, name))
+		if err := os.WriteFile(inputs[len(inputs)-1], content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := testOptions()
+	opts.Jobs = 1
+	opts.MaxTotalOutput = 1
+	opts.OutputDir = dir
+	opts.InputList = filepath.Join(dir, "inputs.txt")
+	if err := os.WriteFile(opts.InputList, []byte(strings.Join(inputs, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(dir, opts); !errors.Is(err, ErrOutputLimit) {
+		t.Fatalf("run ended with %v, want %v", err, ErrOutputLimit)
+	}
+
+	manifestFile, err := os.ReadFile(filepath.Join(dir, "run_manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(manifestFile, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a.pcap": "processed", "b.pcap": "pending", "c.pcap": "pending"}
+	for _, entry := range manifest.Files {
+		if status := want[filepath.Base(entry.Input)]; entry.Status != status {
+			t.Errorf("%s recorded as %+v, want %s", filepath.Base(entry.Input), entry, status)
+		}
+	}
+	usage := manifest.DiskUsage
+	if usage == nil || usage.OutputBytes <= 0 || usage.MaxTotalOutput != 1 || !usage.LimitReached || usage.Pending != 2 {
+		t.Errorf("disk usage %+v, want the output bytes of the first file and 2 pending", usage)
+	}
+}
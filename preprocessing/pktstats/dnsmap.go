@@ -0,0 +1,111 @@
+package pktstats
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// dnsMapCache builds the DNS map of each directory once per run and shares it
+// with the workers processing the directory's files, which only read it.
+type dnsMapCache struct {
+	mu   sync.Mutex
+	dirs map[string]*directoryDNSMap
+}
+
+type directoryDNSMap struct {
+	mu         sync.Mutex
+	built      bool
+	dnsMap     map[string]string
+	answerSets dnsAnswerSets
+}
+
+// get returns the DNS map of the localDir of filePath, building it from
+// filePath (or the directory's dns_map.json) if no other file of the
+// directory did yet. Concurrent callers for a directory wait for the first;
+// if its ctx ends the build, the next caller builds the map from its own file.
+func (cache *dnsMapCache) get(ctx context.Context, filePath string, opts Options) (map[string]string, dnsAnswerSets, error) {
+	dir := localDir(filePath, opts)
+	cache.mu.Lock()
+	if cache.dirs == nil {
+		cache.dirs = make(map[string]*directoryDNSMap)
+	}
+	entry, ok := cache.dirs[dir]
+	if !ok {
+		entry = &directoryDNSMap{}
+		cache.dirs[dir] = entry
+	}
+	cache.mu.Unlock()
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if !entry.built {
+		dnsMap, answerSets, err := constructDNSMap(ctx, filePath, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.dnsMap, entry.answerSets, entry.built = dnsMap, answerSets, true
+	}
+	return entry.dnsMap, entry.answerSets, nil
+}
+
+// limits of RFC 1035 on DNS names in text form
+const (
+	maxDNSNameLength  = 253
+	maxDNSLabelLength = 63
+)
+
+// canonicalDNSName returns name lowercase and without the trailing dot of
+// fully qualified names, the form in which names are mapped, matched and
+// written.
+func canonicalDNSName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// normalizeDNSName returns the canonical form of a DNS name, or false for
+// names no well-formed response carries: empty or too long names, empty or
+// too long labels, and characters other than printable ASCII, e.g. control
+// characters that would break csv rows.
+func normalizeDNSName(name string) (string, bool) {
+	name = canonicalDNSName(name)
+	if name == "" || len(name) > maxDNSNameLength {
+		return "", false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return "", false
+		}
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > maxDNSLabelLength {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// mapDNSName maps ip to the normalized name, reporting false if the name is
+// invalid and left out.
+func mapDNSName(dnsMap map[string]string, ip, name string) bool {
+	name, ok := normalizeDNSName(name)
+	if ok {
+		dnsMap[ip] = name
+	}
+	return ok
+}
+
+// normalizeDNSMap normalizes the names of a DNS map read from a file, e.g. a
+// dns_map.json written before names were normalized, and removes the invalid
+// ones.
+// @return the number of names removed
+func normalizeDNSMap(dnsMap map[string]string) int {
+	invalid := 0
+	for ip, name := range dnsMap {
+		if normalized, ok := normalizeDNSName(name); ok {
+			dnsMap[ip] = normalized
+		} else {
+			delete(dnsMap, ip)
+			invalid++
+		}
+	}
+	return invalid
+}
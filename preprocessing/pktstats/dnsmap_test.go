@@ -0,0 +1,275 @@
+package pktstats
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// routerAdvertisement crafts a Router Advertisement of the local router
+// announcing prefix as the NAT64 prefix in a PREF64 option.
+func routerAdvertisement(t testing.TB, prefix string) []byte {
+	t.Helper()
+	_, announced, err := net.ParseCIDR(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, _ := announced.Mask.Size()
+	code := 0
+	for code < len(pref64Lengths) && pref64Lengths[code] != length {
+		code++
+	}
+	// scaled lifetime of 600s in the upper 13 bits, prefix length code in the lower 3
+	data := []byte{0x0a, 0x8 | byte(code)}
+	data = append(data, announced.IP.To16()[:12]...)
+	network := ipLayer("fe80::1", "ff02::1", layers.IPProtocolICMPv6)
+	network.(*layers.IPv6).HopLimit = 255
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeRouterAdvertisement, 0)}
+	icmp.SetNetworkLayerForChecksum(network)
+	ra := &layers.ICMPv6RouterAdvertisement{
+		HopLimit:       64,
+		RouterLifetime: 1800,
+		Options:        layers.ICMPv6Options{{Type: icmpv6OptPREF64, Data: data}},
+	}
+	return frame(t, network, icmp, ra)
+}
+
+// dnsPortsCapture has the answers of a home router's resolver on ports 5353
+// and 5053 only, and flows to the addresses they resolved.
+func dnsPortsCapture(t testing.TB) []fixturePacket {
+	const client, router = "192.168.1.10", "192.168.1.1"
+	return []fixturePacket{
+		{at: 0, data: dnsResponse(t, router, 5353, client, "eu1.game.example.com", "203.0.113.10")},
+		{at: time.Millisecond, data: dnsResponse(t, router, 5053, client, "cdn.example.net", "198.51.100.7")},
+		{at: 10 * time.Millisecond, data: udpPacket(t, client, 50000, "203.0.113.10", 3478, make([]byte, 80))},
+		{at: 11 * time.Millisecond, data: udpPacket(t, "203.0.113.10", 3478, client, 50000, make([]byte, 1200))},
+		{at: 12 * time.Millisecond, data: tcpPacket(t, client, 50100, "198.51.100.7", 443, "S", 1, 0, nil)},
+		{at: 13 * time.Millisecond, data: tcpPacket(t, "198.51.100.7", 443, client, 50100, "SA", 1, 2, nil)},
+	}
+}
+
+// nat64Capture is an IPv6-only client behind DNS64/NAT64 with its resolver on
+// port 5053: the AAAA answers synthesize addresses in the well-known prefix
+// and in the prefix announced by the router, from the A records of other names.
+// The flows start from cached answers, past answerSetWindow, so that they are
+// labeled from the DNS map rather than the answer sets of the client.
+func nat64Capture(t testing.TB) []fixturePacket {
+	const client, resolver = "2001:db8:1::10", "2001:db8:1::1"
+	cached := answerSetWindow + time.Minute
+	return []fixturePacket{
+		{at: 0, data: dnsResponse(t, resolver, 5053, client, "eu1.game.example.com", "203.0.113.10")},
+		{at: time.Millisecond, data: dnsResponse(t, resolver, 5053, client, "nat64.game.example.com", "64:ff9b::cb00:710a")},
+		{at: 2 * time.Millisecond, data: dnsResponse(t, resolver, 5053, client, "eu2.game.example.com", "198.51.100.7")},
+		{at: 3 * time.Millisecond, data: dnsResponse(t, resolver, 5053, client, "relay.example.org", "2001:db8:64::c633:6407")},
+		{at: 4 * time.Millisecond, data: dnsResponse(t, resolver, 5053, client, "v6only.example.org", "64:ff9b::c000:201")},
+		{at: cached, data: udpPacket(t, client, 50000, "64:ff9b::cb00:710a", 3478, make([]byte, 80))},
+		{at: cached + time.Millisecond, data: udpPacket(t, client, 50001, "2001:db8:64::c633:6407", 3478, make([]byte, 80))},
+		{at: cached + 2*time.Millisecond, data: udpPacket(t, client, 50002, "64:ff9b::c000:201", 3478, make([]byte, 80))},
+		// the prefix is announced after the answers it synthesized
+		{at: cached + time.Second, data: routerAdvertisement(t, "2001:db8:64::/96")},
+	}
+}
+
+// copyFixture copies a crafted capture into a temporary directory, where the
+// dns_map.json of the two-pass DNS mapping is written.
+func copyFixture(t *testing.T, capture string) string {
+	t.Helper()
+	content, err := os.ReadFile(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), filepath.Base(capture))
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// dnsNames returns the DNS names of the flows of an output by remote address;
+// flows left unlabeled are not part of outputs.
+func dnsNames(output *Output) map[string]string {
+	names := make(map[string]string)
+	for _, flow := range output.Flows {
+		names[flow.RemoteIP] = flow.DNSName
+	}
+	return names
+}
+
+func TestDNSPorts(t *testing.T) {
+	capture := fixture(t, "dnsports.pcap", dnsPortsCapture)
+	tests := []struct {
+		dnsPorts string
+		want     map[string]string
+	}{
+		{"53", map[string]string{"203.0.113.10": "", "198.51.100.7": ""}},
+		{"5353", map[string]string{"203.0.113.10": "eu1.game.example.com", "198.51.100.7": ""}},
+		{"53,5353,5053", map[string]string{"203.0.113.10": "eu1.game.example.com", "198.51.100.7": "cdn.example.net"}},
+	}
+	for _, test := range tests {
+		for _, singlePass := range []bool{true, false} {
+			opts := testOptions()
+			opts.DNSPorts, opts.DNSSinglePass = test.dnsPorts, singlePass
+			output, _ := extractFixture(t, copyFixture(t, capture), opts)
+			names := dnsNames(output)
+			for remoteIP, want := range test.want {
+				if got := names[remoteIP]; got != want {
+					t.Errorf("dns ports %s, single pass %v: flow to %s named %q, want %q", test.dnsPorts, singlePass, remoteIP, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestDNS64 maps the addresses DNS64 synthesized to the names of the A
+// records they embed, in the well-known prefix and the prefix of the router.
+func TestDNS64(t *testing.T) {
+	capture := fixture(t, "nat64.pcap", nat64Capture)
+	opts := DefaultOptions()
+	opts.DNSPorts = "53,5053"
+	opts.LocalSubnets = "192.168.0.0/16,2001:db8:1::/48"
+	output, _ := extractFixture(t, copyFixture(t, capture), opts)
+	want := map[string]string{
+		"64:ff9b::cb00:710a":     "eu1.game.example.com",
+		"2001:db8:64::c633:6407": "eu2.game.example.com",
+		"64:ff9b::c000:201":      "v6only.example.org", // no A record for the embedded address
+	}
+	names := dnsNames(output)
+	for remoteIP, name := range want {
+		if got := names[remoteIP]; got != name {
+			t.Errorf("flow to %s named %q, want %q", remoteIP, got, name)
+		}
+	}
+
+	// on the default port, none of the answers is read
+	opts.DNSPorts = "53"
+	output, _ = extractFixture(t, copyFixture(t, capture), opts)
+	names = dnsNames(output)
+	for remoteIP := range want {
+		if got := names[remoteIP]; got != "" {
+			t.Errorf("dns ports 53: flow to %s named %q from an answer on port 5053", remoteIP, got)
+		}
+	}
+}
+
+func TestNormalizeDNSName(t *testing.T) {
+	long := strings.Repeat("a", maxDNSLabelLength)
+	tests := []struct {
+		name string
+		want string // empty for names left out
+	}{
+		{"eu1.game.example.com", "eu1.game.example.com"},
+		{"eu1.game.example.com.", "eu1.game.example.com"},
+		{"EU1.Game.Example.COM.", "eu1.game.example.com"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"XN--BCHER-KVA.example.", "xn--bcher-kva.example"},
+		{"_sip._udp.example.com", "_sip._udp.example.com"},
+		{long + ".example", long + ".example"},
+		{strings.Repeat(long+".", 3) + strings.Repeat("a", 61), strings.Repeat(long+".", 3) + strings.Repeat("a", 61)},
+		// the name before punycode encoding is not on the wire
+		{"bücher.example", ""},
+		{"", ""},
+		{".", ""},
+		{" ", ""},
+		{"\t", ""},
+		{" example.com", ""},
+		{"game .example.com", ""},
+		{"game\r\n.example.com", ""},
+		{"game..example.com", ""},
+		{".example.com", ""},
+		{"example.com..", ""},
+		{long + "a.example", ""},
+		{strings.Repeat(long+".", 3) + strings.Repeat("a", 62), ""},
+	}
+	for _, test := range tests {
+		got, ok := normalizeDNSName(test.name)
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("normalizeDNSName(%q) = %q, %v, want %q", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestNormalizeDNSMap(t *testing.T) {
+	dnsMap := map[string]string{
+		"203.0.113.10":  "EU1.Game.Example.COM.",
+		"203.0.113.11":  "eu1.game.example.com",
+		"198.51.100.7":  "xn--bcher-kva.example.",
+		"198.51.100.8":  "bücher.example",
+		"192.0.2.1":     "",
+		"192.0.2.2":     "  ",
+		"2001:db8::1":   "cdn.example.net\n",
+		"2001:db8::2":   "cdn..example.net",
+		"64:ff9b::c000": "v6only.example.org",
+	}
+	want := map[string]string{
+		"203.0.113.10":  "eu1.game.example.com",
+		"203.0.113.11":  "eu1.game.example.com",
+		"198.51.100.7":  "xn--bcher-kva.example",
+		"64:ff9b::c000": "v6only.example.org",
+	}
+	if invalid := normalizeDNSMap(dnsMap); invalid != 5 {
+		t.Errorf("%d names removed, want 5", invalid)
+	}
+	if !reflect.DeepEqual(dnsMap, want) {
+		t.Errorf("DNS map %v, want %v", dnsMap, want)
+	}
+
+	// of conflicting answers for an address, the last one read is kept;
+	// an invalid one leaves the earlier name
+	dnsMap = make(map[string]string)
+	for _, answer := range []struct {
+		name string
+		ok   bool
+	}{{"eu1.game.example.com.", true}, {"EU2.game.example.com", true}, {"eu3 .game.example.com", false}} {
+		if ok := mapDNSName(dnsMap, "203.0.113.10", answer.name); ok != answer.ok {
+			t.Errorf("mapDNSName(%q) = %v, want %v", answer.name, ok, answer.ok)
+		}
+	}
+	if name := dnsMap["203.0.113.10"]; name != "eu2.game.example.com" {
+		t.Errorf("address named %q, want eu2.game.example.com", name)
+	}
+}
+
+// TestResponseAnswerSetsCNAME follows the CNAME chain of the query whatever
+// the case and trailing dots of its names.
+func TestResponseAnswerSetsCNAME(t *testing.T) {
+	cname := func(name, target string) layers.DNSResourceRecord {
+		return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeCNAME, Class: layers.DNSClassIN, CNAME: []byte(target)}
+	}
+	a := func(name, ip string) layers.DNSResourceRecord {
+		return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: net.ParseIP(ip)}
+	}
+	dns := &layers.DNS{
+		QR:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte("Play.Example.com."), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		// out of order, as some resolvers send them
+		Answers: []layers.DNSResourceRecord{
+			cname("edge.CDN.example.net.", "EU1.edge.cdn.example.net"),
+			cname("play.example.com", "edge.cdn.example.net"),
+			a("eu1.edge.cdn.example.net.", "203.0.113.10"),
+			a("EU1.EDGE.CDN.EXAMPLE.NET", "203.0.113.11"),
+			// a name outside the chain, and one no response carries
+			a("ntp.example.org", "198.51.100.7"),
+			a("bad name.example.org", "198.51.100.8"),
+			// a loop back to the query is not followed again
+			cname("eu1.edge.cdn.example.net", "play.example.com."),
+		},
+	}
+	timestamp := time.Unix(1700000000, 0)
+	sets := responseAnswerSets("192.168.1.10", dns, timestamp)
+	want := map[string]DNSAnswerSet{
+		"play.example.com": {Client: "192.168.1.10", Time: timestamp.UnixMicro(), IPs: []string{"203.0.113.10", "203.0.113.11"}},
+		"ntp.example.org":  {Client: "192.168.1.10", Time: timestamp.UnixMicro(), IPs: []string{"198.51.100.7"}},
+	}
+	if !reflect.DeepEqual(sets, want) {
+		t.Errorf("answer sets %+v, want %+v", sets, want)
+	}
+	if sets := responseAnswerSets("192.168.1.10", &layers.DNS{Questions: dns.Questions, Answers: dns.Answers}, timestamp); sets != nil {
+		t.Errorf("answer sets %+v of a query", sets)
+	}
+}
@@ -0,0 +1,61 @@
+package pktstats
+
+import "time"
+
+// bulkDownloadClass is the TrafficClass of flows classified as game downloads or updates.
+const bulkDownloadClass = "bulk-download"
+
+// DownloadEvidence holds the values the bulk download classifier decided on.
+type DownloadEvidence struct {
+	DownstreamRatio    float64 `json:"downstreamRatio"`    // downstream bytes per upstream byte
+	ThroughputMbps     float64 `json:"throughputMbps"`     // downstream throughput over the flow duration
+	UpstreamPayloadPPS float64 `json:"upstreamPayloadPPS"` // upstream packets carrying payload per second
+}
+
+// downloadState accumulates the per-flow values behind DownloadEvidence.
+type downloadState struct {
+	upBytes, downBytes int64
+	packets            int
+	upPayloadPackets   int
+	first, last        int64 // packet timestamps in the output precision
+}
+
+func (state *downloadState) observe(packet *Packet) {
+	if state.upBytes == 0 && state.downBytes == 0 {
+		state.first = packet.Timestamp
+	}
+	state.last = packet.Timestamp
+	state.packets++
+	if packet.Upstream {
+		state.upBytes += int64(packet.PktLength)
+		if packet.PayloadSize > 0 {
+			state.upPayloadPackets++
+		}
+	} else {
+		state.downBytes += int64(packet.PktLength)
+	}
+}
+
+// classifyDownload tags TCP flows to HTTP(S) ports as bulk downloads when they
+// are strongly downstream-asymmetric, high-throughput and lack the frequent
+// upstream payloads (inputs, feedback) of streaming. Downloads share provider
+// domains with streaming, so the rollups report their bytes separately.
+func (flow *Flow) classifyDownload(opts Options) {
+	if flow.Protocol != 6 || (flow.RemotePort != 443 && flow.RemotePort != 80) {
+		return
+	}
+	state := flow.download
+	seconds := float64(time.Duration(opts.microseconds(state.last-state.first))*time.Microsecond) / float64(time.Second)
+	if seconds <= 0 {
+		return
+	}
+	evidence := &DownloadEvidence{
+		DownstreamRatio:    float64(state.downBytes) / float64(max(state.upBytes, 1)),
+		ThroughputMbps:     float64(state.downBytes) * 8 / seconds / 1e6,
+		UpstreamPayloadPPS: float64(state.upPayloadPackets) / seconds,
+	}
+	flow.DownloadEvidence = evidence
+	if evidence.DownstreamRatio >= opts.BulkMinRatio && evidence.ThroughputMbps >= opts.BulkMinMbps && evidence.UpstreamPayloadPPS <= opts.BulkMaxUpPPS {
+		flow.TrafficClass = bulkDownloadClass
+	}
+}
@@ -0,0 +1,144 @@
+package pktstats
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dryRunEntry is what a run would do with one input.
+type dryRunEntry struct {
+	input  string
+	action string // process, check (with Options.PreflightOnly), skip or fail
+	output string
+	reason string
+	size   int64 // -1 when unknown, for remote inputs and stdin
+}
+
+// DryRun prints the inputs a run would process, check, skip or fail on, with
+// the reason, their outputs and the total size of the inputs to process. It
+// touches nothing on disk: no capture is extracted and no output, DNS map,
+// cache or manifest is written. With Options.Stitch, the first packet of each
+// file is read to order the files of a directory. It returns the number of
+// inputs that would be processed or checked.
+func DryRun(basePath string, opts Options) int {
+	inputs, err := collectInputs(basePath, opts)
+	if err != nil {
+		fmt.Println(err)
+		return 0
+	}
+	inputs, _ = sampleInputs(inputs, opts)
+	var entries []dryRunEntry
+	if opts.Stitch && !opts.PreflightOnly {
+		for _, files := range groupByDirectory(inputs) {
+			entries = append(entries, dryRunStitched(files, opts)...)
+		}
+	} else {
+		for _, input := range inputs {
+			entries = append(entries, dryRunInput(input, opts))
+		}
+	}
+
+	fmt.Printf("%-8s %14s  %-60s %-60s %s\n", "Action", "Bytes", "Input", "Output", "Reason")
+	var processed, skipped, failed, unknownSizes int
+	var totalBytes int64
+	for _, entry := range entries {
+		size := "?"
+		if entry.size >= 0 {
+			size = fmt.Sprint(entry.size)
+		}
+		fmt.Printf("%-8s %14s  %-60s %-60s %s\n", entry.action, size, entry.input, entry.output, entry.reason)
+		switch entry.action {
+		case "process", "check":
+			processed++
+			if entry.size >= 0 {
+				totalBytes += entry.size
+			} else {
+				unknownSizes++
+			}
+		case "skip":
+			skipped++
+		default:
+			failed++
+		}
+	}
+	fmt.Printf("%d inputs would be processed (%d bytes, %.2f GiB", processed, totalBytes, float64(totalBytes)/(1<<30))
+	if unknownSizes > 0 {
+		fmt.Printf(", plus %d inputs of unknown size", unknownSizes)
+	}
+	fmt.Printf("), %d skipped, %d would fail\n", skipped, failed)
+	return processed
+}
+
+// dryRunInput plans one input as Run would process it.
+func dryRunInput(input string, opts Options) dryRunEntry {
+	entry := dryRunEntry{input: input, action: "process", size: -1}
+	filePath := input
+	if isRemoteInput(input) {
+		var err error
+		if filePath, err = remoteLocalPath(opts.OutputDir, input); err != nil {
+			entry.action, entry.reason = "fail", err.Error()
+			return entry
+		}
+		entry.reason = "streamed, outputs in " + filepath.Dir(filePath)
+	} else if input != stdinInput {
+		info, err := os.Stat(input)
+		if err != nil {
+			entry.action, entry.reason = "fail", err.Error()
+			return entry
+		}
+		entry.size = info.Size()
+	}
+	if opts.PreflightOnly {
+		entry.action = "check"
+		return entry
+	}
+	entry.output = outputPath(opts.OutTemplate, filePath, opts.Format)
+	if opts.Out != "" {
+		entry.output = opts.Out
+	}
+	if outputExists(entry.output) {
+		if opts.Force {
+			entry.reason = "output exists, overwritten with -force"
+		} else if skip, reason := skipExisting(entry.output, opts); skip {
+			entry.action, entry.reason = "skip", reason
+		} else {
+			entry.reason = reason + ", overwritten"
+		}
+	}
+	return entry
+}
+
+// dryRunStitched plans the files of a directory as processStitched would: in
+// capture time order, skipped together when the output of the first exists.
+// Sessions are only known while reading, every file is listed with the output
+// of the first.
+func dryRunStitched(files []string, opts Options) []dryRunEntry {
+	var entries []dryRunEntry
+	stitched, failed := newStitchedCapture(files, opts)
+	for _, input := range failed {
+		entries = append(entries, dryRunEntry{input: input, action: "fail", reason: "unable to read the first packet", size: -1})
+	}
+	if len(stitched.files) == 0 {
+		return entries
+	}
+	outPath := outputPath(opts.OutTemplate, stitched.files[0], opts.Format)
+	action, reason := "process", "stitched in "+filepath.Dir(outPath)+", sessions split by -stitch-gap"
+	if outputExists(outPath) {
+		if opts.Force {
+			reason += ", outputs overwritten with -force"
+		} else if skip, skipReason := skipExisting(outPath, opts); skip {
+			action, reason = "skip", "directory's first "+skipReason
+		} else {
+			reason += ", " + skipReason + ", overwritten"
+		}
+	}
+	for _, input := range stitched.files {
+		size, ok := stitched.sizes[input]
+		if !ok {
+			size = -1
+		}
+		entries = append(entries, dryRunEntry{input: input, action: action, output: outPath, reason: reason, size: size})
+	}
+	return entries
+}
@@ -0,0 +1,290 @@
+package pktstats
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// dtlsMaxPackets bounds the payload-bearing packets of a UDP flow inspected for
+// a DTLS handshake; retransmitted flights stay well within it.
+const dtlsMaxPackets = 50
+
+// dtlsMaxMessage bounds the size of a reassembled ClientHello or ServerHello.
+const dtlsMaxMessage = 16 << 10
+
+// DTLS record content type and handshake message types
+const (
+	dtlsHandshake   = 22
+	dtlsClientHello = 1
+	dtlsServerHello = 2
+)
+
+// TLS extension types read from the hellos
+const (
+	extensionUseSRTP           = 14
+	extensionSupportedVersions = 43
+)
+
+// dtlsVersions names the DTLS protocol versions.
+var dtlsVersions = map[uint16]string{
+	0xfeff: "1.0",
+	0xfefd: "1.2",
+	0xfefc: "1.3",
+}
+
+// srtpProfiles names the SRTP protection profiles of RFC 5764 and RFC 7714.
+var srtpProfiles = map[uint16]string{
+	0x0001: "SRTP_AES128_CM_HMAC_SHA1_80",
+	0x0002: "SRTP_AES128_CM_HMAC_SHA1_32",
+	0x0005: "SRTP_NULL_HMAC_SHA1_80",
+	0x0006: "SRTP_NULL_HMAC_SHA1_32",
+	0x0007: "SRTP_AEAD_AES_128_GCM",
+	0x0008: "SRTP_AEAD_AES_256_GCM",
+}
+
+// dtlsState follows the DTLS handshake of a UDP flow: the hellos, reassembled
+// from their fragments, and the first protected (epoch > 0) record of each side.
+type dtlsState struct {
+	inspected   int
+	client      string // endpoint that sent the ClientHello
+	clientHello dtlsMessage
+	serverHello dtlsMessage
+	helloTime   int64 // first ClientHello, retransmitted flights keep it
+	protected   map[string]int64
+}
+
+// dtlsMessage reassembles one handshake message from fragments, which may
+// arrive out of order, repeated or overlapping.
+type dtlsMessage struct {
+	body     []byte
+	received []bool
+	missing  int
+}
+
+func (message *dtlsMessage) complete() bool {
+	return message.body != nil && message.missing == 0
+}
+
+// add copies a fragment into the message, returning false for a fragment
+// inconsistent with the earlier ones.
+func (message *dtlsMessage) add(length, offset int, fragment []byte) bool {
+	if length > dtlsMaxMessage || offset+len(fragment) > length {
+		return false
+	}
+	if message.body == nil {
+		message.body = make([]byte, length)
+		message.received = make([]bool, length)
+		message.missing = length
+	} else if len(message.body) != length {
+		return false
+	}
+	for i, b := range fragment {
+		if !message.received[offset+i] {
+			message.received[offset+i] = true
+			message.body[offset+i] = b
+			message.missing--
+		}
+	}
+	return true
+}
+
+func (state *dtlsState) observe(packet *Packet, payload []byte) {
+	if len(payload) == 0 || state.inspected >= dtlsMaxPackets {
+		return
+	}
+	state.inspected++
+	sender := packet.SrcIP + ":" + strconv.Itoa(packet.SrcPort)
+	// a datagram may carry several records
+	for len(payload) > 0 {
+		if payload[0]&0xe0 == 0x20 {
+			// DTLS 1.3 unified header, only used for protected records
+			state.protect(sender, packet.Timestamp)
+			return
+		}
+		if !isDTLSRecord(payload) {
+			return
+		}
+		contentType := payload[0]
+		epoch := binary.BigEndian.Uint16(payload[3:5])
+		length := int(binary.BigEndian.Uint16(payload[11:13]))
+		if 13+length > len(payload) {
+			return
+		}
+		record := payload[13 : 13+length]
+		payload = payload[13+length:]
+		if epoch > 0 {
+			state.protect(sender, packet.Timestamp)
+		} else if contentType == dtlsHandshake {
+			state.handshake(sender, packet.Timestamp, record)
+		}
+	}
+}
+
+// handshake reads the handshake messages of an unprotected record, keeping
+// fragments of the hellos.
+func (state *dtlsState) handshake(sender string, timestamp int64, record []byte) {
+	for len(record) >= 12 {
+		messageType := record[0]
+		length := int(record[1])<<16 | int(record[2])<<8 | int(record[3])
+		offset := int(record[6])<<16 | int(record[7])<<8 | int(record[8])
+		fragmentLength := int(record[9])<<16 | int(record[10])<<8 | int(record[11])
+		if 12+fragmentLength > len(record) {
+			return
+		}
+		fragment := record[12 : 12+fragmentLength]
+		record = record[12+fragmentLength:]
+		switch messageType {
+		case dtlsClientHello:
+			if state.client == "" {
+				state.client = sender
+				state.helloTime = timestamp
+			}
+			if sender == state.client {
+				state.clientHello.add(length, offset, fragment)
+			}
+		case dtlsServerHello:
+			if state.client != "" && sender != state.client {
+				state.serverHello.add(length, offset, fragment)
+			}
+		}
+	}
+}
+
+// protect records the first protected record of a side, once the handshake started.
+func (state *dtlsState) protect(sender string, timestamp int64) {
+	if state.client == "" {
+		return
+	}
+	if state.protected == nil {
+		state.protected = make(map[string]int64)
+	}
+	if _, ok := state.protected[sender]; !ok {
+		state.protected[sender] = timestamp
+	}
+}
+
+// classifyDTLS stores the DTLS details of a UDP flow from its handshake:
+// version and cipher suite from the ServerHello, the SRTP profiles offered and
+// selected in use_srtp, and the time from the first ClientHello until both
+// sides sent protected records. Fields stay empty when a hello is missing or
+// cannot be parsed.
+func (flow *Flow) classifyDTLS(opts Options) {
+	state := &flow.dtls
+	if state.clientHello.complete() {
+		if _, extensions, ok := parseHello(state.clientHello.body, false); ok {
+			flow.SRTPProfiles = parseSRTPProfiles(extensions[extensionUseSRTP])
+		}
+	}
+	if state.serverHello.complete() {
+		if hello, extensions, ok := parseHello(state.serverHello.body, true); ok {
+			version := hello.version
+			if selected := extensions[extensionSupportedVersions]; len(selected) == 2 {
+				version = binary.BigEndian.Uint16(selected)
+			}
+			flow.DTLSVersion = dtlsVersions[version]
+			if flow.DTLSVersion == "" {
+				flow.DTLSVersion = fmt.Sprintf("0x%04x", version)
+			}
+			flow.Cipher = tls.CipherSuiteName(hello.cipher)
+			if profiles := parseSRTPProfiles(extensions[extensionUseSRTP]); len(profiles) > 0 {
+				flow.SRTPProfile = profiles[0]
+			}
+		}
+	}
+	if len(state.protected) == 2 {
+		var complete int64
+		for _, timestamp := range state.protected {
+			complete = max(complete, timestamp)
+		}
+		flow.HandshakeDurationMicros = opts.microseconds(complete - state.helloTime)
+	}
+}
+
+// dtlsHello holds the fields of a hello that precede its extensions.
+type dtlsHello struct {
+	version uint16
+	cipher  uint16 // selected cipher suite, ServerHello only
+}
+
+// parseHello parses a ClientHello or ServerHello body into its fixed fields
+// and its extensions by type.
+func parseHello(body []byte, server bool) (dtlsHello, map[uint16][]byte, bool) {
+	var hello dtlsHello
+	r := byteReader{data: body}
+	hello.version = r.uint16()
+	r.skip(32) // random
+	r.skip(int(r.uint8()))
+	if server {
+		hello.cipher = r.uint16()
+		r.skip(1) // compression method
+	} else {
+		r.skip(int(r.uint8())) // cookie
+		r.skip(int(r.uint16()))
+		r.skip(int(r.uint8())) // compression methods
+	}
+	if r.failed {
+		return hello, nil, false
+	}
+	extensions := make(map[uint16][]byte)
+	if r.remaining() == 0 {
+		return hello, extensions, true
+	}
+	block := byteReader{data: r.bytes(int(r.uint16()))}
+	for !r.failed && !block.failed && block.remaining() > 0 {
+		extensionType := block.uint16()
+		extensions[extensionType] = block.bytes(int(block.uint16()))
+	}
+	return hello, extensions, !r.failed && !block.failed
+}
+
+// parseSRTPProfiles parses the profile list of a use_srtp extension.
+func parseSRTPProfiles(extension []byte) []string {
+	r := byteReader{data: extension}
+	list := byteReader{data: r.bytes(int(r.uint16()))}
+	var profiles []string
+	for !r.failed && list.remaining() >= 2 {
+		profile := list.uint16()
+		name, ok := srtpProfiles[profile]
+		if !ok {
+			name = fmt.Sprintf("0x%04x", profile)
+		}
+		profiles = append(profiles, name)
+	}
+	return profiles
+}
+
+// byteReader reads big-endian fields, recording reads past the end in failed.
+type byteReader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if r.failed || n > len(r.data) {
+		r.failed = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *byteReader) skip(n int) { r.bytes(n) }
+
+func (r *byteReader) remaining() int { return len(r.data) }
+
+func (r *byteReader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *byteReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
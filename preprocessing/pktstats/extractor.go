@@ -0,0 +1,50 @@
+package pktstats
+
+// FlowHandler receives a flow once it is complete. Ownership of the flow
+// transfers to the handler: the Extractor does not read or modify it afterwards.
+type FlowHandler func(flow *Flow)
+
+// PacketHandler receives each packet stored in a flow, together with the key of
+// the flow. The packet is only valid for the duration of the call.
+type PacketHandler func(packet *Packet, flowKey string)
+
+// Extractor extracts flows from captures and hands them to the registered
+// handlers. Handlers run synchronously on the goroutine calling Extract, so
+// a slow handler slows down extraction. By default flows do not time out, they are handed
+// over at the end of the file (or of the session, see ExtractStitched) in order of first packet arrival, third-party
+// flows last; only flows evicted under Options.MaxFlows are handed over early. With Options.Finalize flush,
+// closed TCP and idle UDP flows are handed over as the capture is read, see flowFlusher. An Extractor must not be used for several files concurrently.
+type Extractor struct {
+	opts           Options
+	flowHandlers   []FlowHandler
+	packetHandlers []PacketHandler
+}
+
+// NewExtractor creates an Extractor with the given options.
+func NewExtractor(opts Options) *Extractor {
+	return &Extractor{opts: opts}
+}
+
+// RegisterFlowHandler adds a handler called for every flow once it is complete.
+func (e *Extractor) RegisterFlowHandler(handler FlowHandler) {
+	e.flowHandlers = append(e.flowHandlers, handler)
+}
+
+// RegisterPacketHandler adds a handler called for every packet as it is added to a flow.
+func (e *Extractor) RegisterPacketHandler(handler PacketHandler) {
+	e.packetHandlers = append(e.packetHandlers, handler)
+}
+
+func (e *Extractor) handlePacket(packet *Packet, flowKey string) {
+	for _, handler := range e.packetHandlers {
+		handler(packet, flowKey)
+	}
+}
+
+func (e *Extractor) handleFlows(flowMap map[string]*Flow) {
+	for _, key := range sortedFlowKeys(flowMap) {
+		for _, handler := range e.flowHandlers {
+			handler(flowMap[key])
+		}
+	}
+}
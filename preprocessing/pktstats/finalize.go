@@ -0,0 +1,134 @@
+package pktstats
+
+import "time"
+
+// finalization policies, Options.Finalize
+const (
+	finalizeEndOfFile = "end-of-file" // all flows are complete at the end of the file
+	finalizeFlush     = "flush"       // closed TCP and idle UDP flows are complete once they end
+)
+
+// flushSweepMin is the shortest capture time between two sweeps for
+// complete flows.
+const flushSweepMin = time.Second
+
+var finalizePolicies = []string{finalizeEndOfFile, finalizeFlush}
+
+func isFinalizePolicy(policy string) bool {
+	return containsString(finalizePolicies, policy)
+}
+
+// policies for packets of flows already flushed, Options.LateArrivals
+const (
+	lateReopen = "reopen" // start a continuation of the flow
+	lateCount  = "count"  // count the packets in the meta block only
+)
+
+var latePolicies = []string{lateReopen, lateCount}
+
+func isLatePolicy(policy string) bool {
+	return containsString(latePolicies, policy)
+}
+
+// flowFlusher hands flows over before the end of the file under the flush
+// policy: TCP flows Options.FlushLinger after they were closed, by a FIN in
+// both directions or a RST, and UDP flows idle for Options.FlushUDPIdle.
+// Flushed flows are complete: they are not part of the analyses across
+// flows at the end of the file, only of the service rollups and telemetry
+// totals, which are taken as they are flushed.
+type flowFlusher struct {
+	linger, udpIdle int64 // in the output precision
+	interval        int64 // capture time between sweeps
+	next            int64 // capture time of the next sweep
+	late            string
+	parts           map[string]int // flushed parts of each flow key
+
+	flushed, reopened      int
+	latePackets, lateBytes int64
+	services               map[string]*ServiceStats // rollups of the flushed flows
+	telemetryPackets       int64
+	telemetryBytes         int64
+}
+
+func newFlowFlusher(opts Options) *flowFlusher {
+	if opts.Finalize != finalizeFlush {
+		return nil
+	}
+	linger, udpIdle := opts.duration(opts.FlushLinger), opts.duration(opts.FlushUDPIdle)
+	return &flowFlusher{
+		linger:   linger,
+		udpIdle:  udpIdle,
+		interval: max(min(linger, udpIdle)/2, opts.duration(flushSweepMin)),
+		late:     opts.LateArrivals,
+		parts:    make(map[string]int),
+		services: make(map[string]*ServiceStats),
+	}
+}
+
+// due reports whether a flow is complete at capture time now.
+func (flusher *flowFlusher) due(flow *Flow, now int64) bool {
+	switch flow.Protocol {
+	case 6:
+		return flow.outcome.closedAt > 0 && now-flow.outcome.closedAt >= flusher.linger
+	case 17:
+		return now-flow.download.last >= flusher.udpIdle
+	}
+	return false
+}
+
+// sweep removes the flows complete at capture time now from the flow maps,
+// at most once per interval, and returns them.
+func (flusher *flowFlusher) sweep(now int64, flowMaps ...map[string]*Flow) map[string]*Flow {
+	if now < flusher.next {
+		return nil
+	}
+	flusher.next = now + flusher.interval
+	var flushed map[string]*Flow
+	for _, flows := range flowMaps {
+		for key, flow := range flows {
+			if !flusher.due(flow, now) {
+				continue
+			}
+			if flushed == nil {
+				flushed = make(map[string]*Flow)
+			}
+			flushed[key] = flow
+			delete(flows, key)
+			flusher.parts[key]++
+		}
+	}
+	flusher.flushed += len(flushed)
+	return flushed
+}
+
+// account takes the rollups of flushed flows, once they are finished and
+// before they are handed over.
+func (flusher *flowFlusher) account(flushed map[string]*Flow) {
+	local := make(map[string]*Flow)
+	for key, flow := range flushed {
+		if flow.Direction != DirectionUnknown {
+			local[key] = flow
+		}
+	}
+	mergeServiceStats(flusher.services, serviceRollup(local))
+	packets, bytes := telemetryTotals(local)
+	flusher.telemetryPackets += packets
+	flusher.telemetryBytes += bytes
+}
+
+// lateArrival handles the first packet of a flow key: for a key already
+// flushed, it returns the continuation number of the flow to start or, with
+// the count policy, counts the packet and reports it is to be dropped.
+func (flusher *flowFlusher) lateArrival(flowKey string, packet *Packet) (continuation int, drop bool) {
+	part := flusher.parts[flowKey]
+	if part == 0 {
+		return 0, false
+	}
+	if flusher.late == lateReopen {
+		flusher.reopened++
+		return part, false
+	}
+	flusher.latePackets++
+	flusher.lateBytes += int64(packet.PktLength)
+	return 0, true
+}
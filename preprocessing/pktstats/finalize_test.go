@@ -0,0 +1,85 @@
+package pktstats
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// flushCapture holds a TCP flow closed after 81 ms, a game flow lasting 5 s
+// and a UDP flow idle from 0.5 s, then late packets of the closed and idle
+// flows at 3 and 4 s.
+func flushCapture(t testing.TB) []fixturePacket {
+	const client, resolver, game, store = "192.168.1.10", "192.168.1.1", "203.0.113.10", "198.51.100.7"
+	payload := func(size int) []byte { return make([]byte, size) }
+	packets := []fixturePacket{
+		{at: 0, data: dnsResponse(t, resolver, 53, client, "eu1.game.example.com", game)},
+		{at: time.Millisecond, data: dnsResponse(t, resolver, 53, client, "store.example.net", store)},
+		{at: 10 * time.Millisecond, data: tcpPacket(t, client, 50100, store, 443, "S", 1000, 0, nil)},
+		{at: 30 * time.Millisecond, data: tcpPacket(t, store, 443, client, 50100, "SA", 5000, 1001, nil)},
+		{at: 32 * time.Millisecond, data: tcpPacket(t, client, 50100, store, 443, "PA", 1001, 5001, payload(300))},
+		{at: 52 * time.Millisecond, data: tcpPacket(t, store, 443, client, 50100, "PA", 5001, 1301, payload(1200))},
+		{at: 60 * time.Millisecond, data: tcpPacket(t, client, 50100, store, 443, "FA", 1301, 6201, nil)},
+		{at: 80 * time.Millisecond, data: tcpPacket(t, store, 443, client, 50100, "FA", 6201, 1302, nil)},
+		{at: 81 * time.Millisecond, data: tcpPacket(t, client, 50100, store, 443, "A", 1302, 6202, nil)},
+		{at: 3 * time.Second, data: tcpPacket(t, store, 443, client, 50100, "A", 6202, 1302, nil)},
+		{at: 4 * time.Second, data: udpPacket(t, game, 3479, client, 50001, payload(500))},
+	}
+	for at := 100 * time.Millisecond; at <= 5*time.Second; at += 100 * time.Millisecond {
+		packets = append(packets, fixturePacket{at: at, data: udpPacket(t, game, 3478, client, 50000, payload(1100))})
+		if at <= 500*time.Millisecond {
+			packets = append(packets, fixturePacket{at: at + time.Millisecond, data: udpPacket(t, game, 3479, client, 50001, payload(500))})
+		}
+	}
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].at < packets[j].at })
+	return packets
+}
+
+// TestFlush extracts a capture with the end-of-file and flush policies and
+// compares the flows handed over, in order, and the counts of the meta block.
+func TestFlush(t *testing.T) {
+	const (
+		store = "192.168.1.10:50100-198.51.100.7:443@6"
+		game  = "192.168.1.10:50000-203.0.113.10:3478@17"
+		idle  = "192.168.1.10:50001-203.0.113.10:3479@17"
+	)
+	capture := fixture(t, "flush.pcap", flushCapture)
+	tests := []struct {
+		name                   string
+		finalize, late         string
+		flows                  []string // handed over, in order
+		flushed, reopened      int
+		latePackets, lateBytes int64
+	}{
+		{"end of file", finalizeEndOfFile, lateReopen, []string{store, game, idle}, 0, 0, 0, 0},
+		// the store flow is flushed a second after its FINs, the idle flow and
+		// the flow of the resolver, left out, two seconds after their last
+		// packets; the rest at the end of the file
+		{"flush and reopen", finalizeFlush, lateReopen, []string{store, idle, game, store + "#1", idle + "#1"}, 3, 2, 0, 0},
+		// the ACK padded to the Ethernet minimum and the UDP packet
+		{"flush and count", finalizeFlush, lateCount, []string{store, idle, game}, 3, 0, 2, 60 + 542},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.Finalize, opts.LateArrivals = test.finalize, test.late
+		opts.FlushLinger, opts.FlushUDPIdle = time.Second, 2*time.Second
+		extractor := NewExtractor(opts)
+		var flows []string
+		extractor.RegisterFlowHandler(func(flow *Flow) { flows = append(flows, flow.getFlowID()) })
+		meta, err := extractor.Extract(capture)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(flows, test.flows) {
+			t.Errorf("%s: flows handed over %v, want %v", test.name, flows, test.flows)
+		}
+		if meta.FlushedFlows != test.flushed || meta.ReopenedFlows != test.reopened || meta.LatePackets != test.latePackets || meta.LateBytes != test.lateBytes {
+			t.Errorf("%s: %d flushed, %d reopened, %d late packets of %d bytes, want %d, %d, %d of %d", test.name,
+				meta.FlushedFlows, meta.ReopenedFlows, meta.LatePackets, meta.LateBytes, test.flushed, test.reopened, test.latePackets, test.lateBytes)
+		}
+		if services := meta.Services["example.net"]; services == nil || services.Flows == 0 {
+			t.Errorf("%s: store flow missing from the service rollups: %+v", test.name, services)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package pktstats
+
+import (
+	_ "embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// osFingerprintTable maps SYN fingerprints to OS labels, see os_fingerprints.txt.
+//
+//go:embed os_fingerprints.txt
+var osFingerprintTable string
+
+// osFingerprint is a line of the fingerprint table.
+type osFingerprint struct {
+	initialTTL int
+	options    string
+	label      string
+}
+
+var osFingerprints = parseOSFingerprints(osFingerprintTable)
+
+func parseOSFingerprints(table string) []osFingerprint {
+	var fingerprints []osFingerprint
+	for _, line := range strings.Split(table, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		ttl, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		fingerprints = append(fingerprints, osFingerprint{ttl, fields[1], fields[2]})
+	}
+	return fingerprints
+}
+
+// LocalEndpoint holds the passive fingerprint of a local IP: the most common
+// header fields of the TCP SYNs it sent, and how often it sets the DF bit.
+type LocalEndpoint struct {
+	IP         string  `json:"ip"`
+	SYNs       int     `json:"syns"`                 // SYNs sent, over all fingerprints
+	InitialTTL int     `json:"initialTTL,omitempty"` // TTL of the SYNs rounded up to 32, 64, 128 or 255
+	TCPOptions string  `json:"tcpOptions,omitempty"` // option kinds in order, e.g. M,S,T,N,W, see os_fingerprints.txt
+	WindowSize int     `json:"windowSize,omitempty"`
+	MSS        int     `json:"mss,omitempty"`
+	DFShare    float64 `json:"dfShare"`           // share of the IPv4 packets sent with the DF bit set
+	OSGuess    string  `json:"osGuess,omitempty"` // label of the matching os_fingerprints.txt entry
+}
+
+// synFingerprint is the tuple of SYN header fields an endpoint is grouped by.
+type synFingerprint struct {
+	initialTTL, window, mss int
+	options                 string
+}
+
+// endpointFingerprints aggregates the fingerprints of the local IPs of a file,
+// without storing anything per packet.
+type endpointFingerprints map[string]*endpointState
+
+type endpointState struct {
+	packets, dontFragment int
+	syns                  map[synFingerprint]int
+}
+
+// observe records an IPv4 packet sent by a local IP, tcp being its TCP layer or nil.
+func (fingerprints endpointFingerprints) observe(ip *layers.IPv4, tcp *layers.TCP) {
+	src := ip.SrcIP.String()
+	state, ok := fingerprints[src]
+	if !ok {
+		state = &endpointState{syns: make(map[synFingerprint]int)}
+		fingerprints[src] = state
+	}
+	state.packets++
+	if ip.Flags&layers.IPv4DontFragment != 0 {
+		state.dontFragment++
+	}
+	if tcp == nil || !tcp.SYN || tcp.ACK {
+		return
+	}
+	fingerprint := synFingerprint{initialTTL: initialTTL(ip.TTL), window: int(tcp.Window)}
+	kinds := make([]string, 0, len(tcp.Options))
+	for _, option := range tcp.Options {
+		switch option.OptionType {
+		case layers.TCPOptionKindMSS:
+			kinds = append(kinds, "M")
+			if len(option.OptionData) == 2 {
+				fingerprint.mss = int(option.OptionData[0])<<8 | int(option.OptionData[1])
+			}
+		case layers.TCPOptionKindNop:
+			kinds = append(kinds, "N")
+		case layers.TCPOptionKindWindowScale:
+			kinds = append(kinds, "W")
+		case layers.TCPOptionKindSACKPermitted:
+			kinds = append(kinds, "S")
+		case layers.TCPOptionKindTimestamps:
+			kinds = append(kinds, "T")
+		case layers.TCPOptionKindEndList:
+			kinds = append(kinds, "E")
+		default:
+			kinds = append(kinds, fmt.Sprintf("?%d", option.OptionType))
+		}
+	}
+	fingerprint.options = strings.Join(kinds, ",")
+	state.syns[fingerprint]++
+}
+
+// initialTTL rounds a TTL up to the nearest common initial TTL.
+func initialTTL(ttl uint8) int {
+	for _, initial := range []int{32, 64, 128} {
+		if int(ttl) <= initial {
+			return initial
+		}
+	}
+	return 255
+}
+
+// endpoints returns the fingerprint of each local IP, sorted by IP, with the
+// most common SYN fingerprint and its OS guess.
+func (fingerprints endpointFingerprints) endpoints() []LocalEndpoint {
+	endpoints := make([]LocalEndpoint, 0, len(fingerprints))
+	for ip, state := range fingerprints {
+		endpoint := LocalEndpoint{IP: ip, DFShare: float64(state.dontFragment) / float64(state.packets)}
+		var best synFingerprint
+		for fingerprint, count := range state.syns {
+			endpoint.SYNs += count
+			if count > state.syns[best] || count == state.syns[best] && fingerprint.options < best.options {
+				best = fingerprint
+			}
+		}
+		if endpoint.SYNs > 0 {
+			endpoint.InitialTTL, endpoint.TCPOptions = best.initialTTL, best.options
+			endpoint.WindowSize, endpoint.MSS = best.window, best.mss
+			for _, known := range osFingerprints {
+				if known.initialTTL == best.initialTTL && known.options == best.options {
+					endpoint.OSGuess = known.label
+					break
+				}
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].IP < endpoints[j].IP })
+	return endpoints
+}
@@ -0,0 +1,213 @@
+package pktstats
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var update = flag.Bool("update", false, "rewrite the crafted captures and golden files under "+testdata)
+
+// testdata holds the crafted captures of the tests and their golden outputs.
+const testdata = "../testdata"
+
+// fixtureStart is the capture time of the first packet of crafted captures.
+var fixtureStart = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+var (
+	localMAC  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	routerMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+)
+
+// fixturePacket is a packet of a crafted capture.
+type fixturePacket struct {
+	at     time.Duration // after fixtureStart
+	data   []byte
+	length int // on the wire, 0 for len(data); larger for packets cut at the snap length
+}
+
+// frame serializes an Ethernet frame around the layers of a packet, with the
+// lengths and checksums computed.
+func frame(t testing.TB, network gopacket.NetworkLayer, upper ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	ethernet := &layers.Ethernet{SrcMAC: localMAC, DstMAC: routerMAC, EthernetType: layers.EthernetTypeIPv4}
+	if _, ok := network.(*layers.IPv6); ok {
+		ethernet.EthernetType = layers.EthernetTypeIPv6
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	all := append([]gopacket.SerializableLayer{ethernet, network.(gopacket.SerializableLayer)}, upper...)
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, all...); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buffer.Bytes()...)
+}
+
+// ipLayer returns the IPv4 or IPv6 header of a packet from src to dst.
+func ipLayer(src, dst string, protocol layers.IPProtocol) gopacket.NetworkLayer {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if srcIP.To4() == nil {
+		return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: protocol, SrcIP: srcIP, DstIP: dstIP}
+	}
+	return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: protocol, SrcIP: srcIP.To4(), DstIP: dstIP.To4()}
+}
+
+// udpPacket crafts a UDP packet from src:srcPort to dst:dstPort.
+func udpPacket(t testing.TB, src string, srcPort int, dst string, dstPort int, payload []byte) []byte {
+	t.Helper()
+	network := ipLayer(src, dst, layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(network)
+	return frame(t, network, udp, gopacket.Payload(payload))
+}
+
+// tcpPacket crafts a TCP segment from src:srcPort to dst:dstPort with the
+// flags of a string of S, A, P, F and R.
+func tcpPacket(t testing.TB, src string, srcPort int, dst string, dstPort int, flags string, seq, ack uint32, payload []byte) []byte {
+	t.Helper()
+	network := ipLayer(src, dst, layers.IPProtocolTCP)
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		Ack:     ack,
+		Window:  65535,
+		SYN:     strings.Contains(flags, "S"),
+		ACK:     strings.Contains(flags, "A"),
+		PSH:     strings.Contains(flags, "P"),
+		FIN:     strings.Contains(flags, "F"),
+		RST:     strings.Contains(flags, "R"),
+	}
+	tcp.SetNetworkLayerForChecksum(network)
+	return frame(t, network, tcp, gopacket.Payload(payload))
+}
+
+// dnsResponse crafts the response of a resolver at server:port to client
+// answering name with addrs, A or AAAA records by their family.
+func dnsResponse(t testing.TB, server string, port int, client string, name string, addrs ...string) []byte {
+	t.Helper()
+	dns := &layers.DNS{ID: 1, QR: true, RD: true, RA: true}
+	question := layers.DNSQuestion{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}
+	for _, addr := range addrs {
+		record := layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.ParseIP(addr)}
+		if record.IP.To4() == nil {
+			record.Type, question.Type = layers.DNSTypeAAAA, layers.DNSTypeAAAA
+		} else {
+			record.IP = record.IP.To4()
+		}
+		dns.Answers = append(dns.Answers, record)
+	}
+	dns.Questions = []layers.DNSQuestion{question}
+	network := ipLayer(server, client, layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: layers.UDPPort(port), DstPort: 40000}
+	udp.SetNetworkLayerForChecksum(network)
+	return frame(t, network, udp, dns)
+}
+
+// fixture returns the path of a crafted capture under testdata, written from
+// the packets of build with -update.
+func fixture(t testing.TB, name string, build func(t testing.TB) []fixturePacket) string {
+	t.Helper()
+	return rawFixture(t, name, func(t testing.TB) []byte {
+		var buffer bytes.Buffer
+		writer := pcapgo.NewWriterNanos(&buffer)
+		if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+			t.Fatal(err)
+		}
+		for _, packet := range build(t) {
+			ci := gopacket.CaptureInfo{Timestamp: fixtureStart.Add(packet.at), CaptureLength: len(packet.data), Length: max(packet.length, len(packet.data))}
+			if err := writer.WritePacket(ci, packet.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buffer.Bytes()
+	})
+}
+
+// rawFixture returns the path of a crafted capture under testdata, written
+// from the bytes of build with -update, for captures pcapgo cannot write.
+func rawFixture(t testing.TB, name string, build func(t testing.TB) []byte) string {
+	t.Helper()
+	path := filepath.Join(testdata, name)
+	if *update {
+		if err := os.WriteFile(path, build(t), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("%v: run go test -update to write the crafted captures", err)
+	}
+	return path
+}
+
+// golden compares got with the golden file name under testdata, rewritten
+// with -update.
+func golden(t testing.TB, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join(testdata, name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v: run go test -update to write the golden files", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s, run go test -update if the change is intended:\n%s", path, got)
+	}
+}
+
+// testOptions returns the options of the command without flags, reading the
+// DNS names as packets are read so that no dns_map.json is written.
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.DNSSinglePass = true
+	return opts
+}
+
+// extractFixture extracts a capture into an output in a temporary directory
+// and loads it back.
+func extractFixture(t testing.TB, capture string, opts Options) (*Output, string) {
+	t.Helper()
+	outPath := filepath.Join(t.TempDir(), strings.TrimSuffix(filepath.Base(capture), filepath.Ext(capture))+"_packetStats."+opts.Format)
+	if ExtractPacketStats(context.Background(), capture, outPath, opts) == nil {
+		t.Fatalf("unable to extract %s", capture)
+	}
+	output, err := LoadFlows(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output, outPath
+}
+
+// syntheticFlow returns a flow from localIP:localPort, downloading from
+// first to last seconds into the capture, with the state the analyses across
+// flows read, in microseconds.
+func syntheticFlow(localIP string, localPort int, remoteIP string, remotePort, protocol int, first, last float64) *Flow {
+	flow := &Flow{
+		LocalIP: localIP, LocalPort: localPort, RemoteIP: remoteIP, RemotePort: remotePort, Protocol: protocol,
+		LocalFirst: true, Packets: []Packet{{Timestamp: int64(first * 1e6)}},
+	}
+	flow.download.first, flow.download.last = int64(first*1e6), int64(last*1e6)
+	return flow
+}
+
+// keyedFlows returns the flow map of flows, by their flow IDs.
+func keyedFlows(flows []*Flow) map[string]*Flow {
+	flowMap := make(map[string]*Flow, len(flows))
+	for _, flow := range flows {
+		flowMap[flow.getFlowID()] = flow
+	}
+	return flowMap
+}
@@ -0,0 +1,77 @@
+package pktstats
+
+import "sort"
+
+// flowLimits bounds the number of flows tracked while reading a capture, see
+// Options.MaxFlows. Beyond the soft limit, the longest idle unlabeled flows
+// are evicted and only labeled flows are created; beyond the hard limit, no
+// flow is created. Packets of flows that are not stored are counted only.
+type flowLimits struct {
+	soft, hard int
+	dropped    map[string]bool // keys of flows not stored or already evicted
+	notStored  int
+	evicted    int
+	packets    int64 // packets of dropped flow keys
+	bytes      int64
+}
+
+func newFlowLimits(opts Options) *flowLimits {
+	if opts.MaxFlows <= 0 {
+		return nil
+	}
+	hard := opts.MaxFlowsHard
+	if hard <= 0 {
+		hard = 2 * opts.MaxFlows
+	}
+	return &flowLimits{soft: opts.MaxFlows, hard: max(hard, opts.MaxFlows), dropped: make(map[string]bool)}
+}
+
+// evict removes the longest idle unlabeled flows once the soft limit is
+// reached, a tenth of the limit at a time, and returns them.
+func (limits *flowLimits) evict(flowMaps ...map[string]*Flow) map[string]*Flow {
+	tracked := 0
+	for _, flows := range flowMaps {
+		tracked += len(flows)
+	}
+	if tracked < limits.soft {
+		return nil
+	}
+	type candidate struct {
+		key   string
+		flows map[string]*Flow
+		last  int64
+	}
+	var candidates []candidate
+	for _, flows := range flowMaps {
+		for key, flow := range flows {
+			if flow.DNSName == "" {
+				candidates = append(candidates, candidate{key, flows, flow.download.last})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].last < candidates[j].last })
+	evicted := make(map[string]*Flow)
+	for _, c := range candidates[:min(len(candidates), max(limits.soft/10, 1))] {
+		evicted[c.key] = c.flows[c.key]
+		delete(c.flows, c.key)
+		// later packets of the flow would start a flow with the same key
+		limits.dropped[c.key] = true
+	}
+	limits.evicted += len(evicted)
+	return evicted
+}
+
+// admit reports whether a new flow may be created with tracked flows in the maps.
+func (limits *flowLimits) admit(tracked int, labeled bool) bool {
+	return tracked < limits.soft || tracked < limits.hard && labeled
+}
+
+// drop counts a packet of a flow that is not stored.
+func (limits *flowLimits) drop(flowKey string, packet *Packet) {
+	if !limits.dropped[flowKey] {
+		limits.dropped[flowKey] = true
+		limits.notStored++
+	}
+	limits.packets++
+	limits.bytes += int64(packet.PktLength)
+}
@@ -0,0 +1,68 @@
+package pktstats
+
+// observe updates the per-flow state derived from the packets of a flow. It is
+// called for every packet, including those beyond Options.NumPackets that are
+// not stored.
+func (flow *Flow) observe(packet *Packet, payload []byte) {
+	if flow.captureBytes > 0 {
+		flow.capturePayload(packet.Upstream, payload)
+	}
+	flow.download.observe(packet)
+	if packet.Upstream {
+		flow.sizesUp.observe(packet.PayloadSize)
+	} else {
+		flow.sizesDown.observe(packet.PayloadSize)
+	}
+	flow.firstMedia.observe(packet)
+	if flow.rampUp.window > 0 {
+		flow.rampUp.observe(packet, &flow.firstMedia)
+	}
+	if flow.response.eventGap > 0 {
+		flow.response.observe(packet)
+	}
+	if flow.keepalive.maxPayload > 0 {
+		flow.keepalive.observe(packet)
+	}
+	if flow.bursts.maxGap > 0 {
+		flow.bursts.observe(packet)
+	}
+	if flow.limitation.binWidth > 0 && flow.firstMedia.found {
+		flow.limitation.observe(packet, payload, flow.TransportProfile == profileRTP)
+	}
+	if flow.TransportProfile == profileRTP {
+		flow.rtpTiming.observe(packet, payload)
+	}
+	if flow.periodicity.maxSize > 0 {
+		flow.periodicity.observe(packet)
+	}
+	if flow.voice.pacing.maxSize > 0 {
+		flow.voice.observe(packet, payload)
+	}
+	if flow.signature.remaining > 0 {
+		flow.extendSignature(packet)
+	}
+	if flow.Protocol == 17 {
+		flow.dtls.observe(packet, payload)
+	}
+	if flow.TransportProfile == "" {
+		flow.transport.observe(flow.Protocol, payload)
+		if flow.transport.inspected >= transportProfilePackets {
+			flow.TransportProfile = classifyTransport(flow.Protocol, flow.transport)
+		}
+	}
+}
+
+// finalize completes the per-flow state once all packets have been observed.
+func (flow *Flow) finalize() {
+	flow.TLSRecordsUp = flow.tlsUp.tlsRecordStats()
+	flow.TLSRecordsDown = flow.tlsDown.tlsRecordStats()
+	if flow.decrypt != nil {
+		flow.NegotiationEvents, flow.decrypt = flow.decrypt.events, nil
+	}
+	flow.PayloadSizesUp = flow.sizesUp.payloadSizes()
+	flow.PayloadSizesDown = flow.sizesDown.payloadSizes()
+	if flow.TransportProfile == "" {
+		// fewer payload-bearing packets than needed, decide on what was seen
+		flow.TransportProfile = classifyTransport(flow.Protocol, flow.transport)
+	}
+}
@@ -0,0 +1,218 @@
+package pktstats
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// standardFrameRates are the frame rates a burst cadence is mapped to.
+var standardFrameRates = []float64{24, 30, 50, 60, 90, 120, 144, 240}
+
+const (
+	// frameRateWindow is the sliding window of the frame rate timeline, moved
+	// by frameRateStep
+	frameRateWindow = 2 * time.Second
+	frameRateStep   = time.Second
+	// frameRateMinFrames is the number of frames a flow or window needs for an estimate
+	frameRateMinFrames = 20
+	// frameRateTolerance is the largest relative difference between a frame
+	// interval and the frame period for the interval to be on cadence
+	frameRateTolerance = 0.2
+	// frameRateMinConfidence is the least confidence of a window to move the timeline
+	frameRateMinConfidence = 0.5
+	// frameRateHold is the number of consecutive windows a new frame rate
+	// must hold for, so that a window of jitter is not taken for a change
+	frameRateHold = 2
+)
+
+// FrameRates is the video frame rate of a downstream media flow,
+// estimated from the cadence of its bursts.
+type FrameRates struct {
+	FPS        float64 `json:"fps"`        // standard frame rate nearest the cadence
+	CadenceFPS float64 `json:"cadenceFPS"` // inverse of the median interval between frames
+	// share of the intervals between frames within frameRateTolerance of the
+	// period of FPS: lower with jitter, dropped frames and rate changes
+	Confidence float64            `json:"confidence"`
+	Frames     int                `json:"frames"`
+	Timeline   []FrameRateSegment `json:"timeline,omitempty"` // frame rate over sliding windows, one segment per rate held
+}
+
+// FrameRateSegment is a period of a flow at one frame rate.
+type FrameRateSegment struct {
+	Start      int64   `json:"start"` // start of its first window
+	End        int64   `json:"end"`   // end of its last window, at most the last frame
+	FPS        float64 `json:"fps"`
+	Confidence float64 `json:"confidence"` // mean confidence of its windows
+}
+
+// FrameRateChange is a change of the frame rate of a flow, e.g. from 60 to
+// 30 fps under congestion.
+type FrameRateChange struct {
+	Flow      string  `json:"flow"`
+	Timestamp int64   `json:"timestamp"` // start of the segment at the new rate
+	FromFPS   float64 `json:"fromFPS"`
+	ToFPS     float64 `json:"toFPS"`
+}
+
+// videoFrames returns the arrival of the video frames among the downstream
+// bursts: the bursts with a packet of at least minPayload bytes, leaving out
+// the trains of audio substreams, whose packets are smaller. Bursts starting
+// within frameGap of the end of the previous one are the same frame, split
+// by the pacing of the sender.
+func (state *burstState) videoFrames(minPayload int, frameGap int64) []int64 {
+	var frames []int64
+	var end int64
+	for _, train := range state.trains {
+		if train.maxPayload < minPayload {
+			continue
+		}
+		if len(frames) == 0 || train.start-end > frameGap {
+			frames = append(frames, train.start)
+		}
+		end = train.start + train.dispersion
+	}
+	return frames
+}
+
+// estimateCadence estimates the frame rate of frame arrivals in timestamp
+// units, perSecond of them per second.
+// @return the nearest standard frame rate, the cadence and the share of intervals on cadence
+func estimateCadence(frames []int64, perSecond float64) (fps, cadence, confidence float64) {
+	intervals := make([]int64, 0, len(frames)-1)
+	for i := 1; i < len(frames); i++ {
+		intervals = append(intervals, frames[i]-frames[i-1])
+	}
+	sorted := append([]int64(nil), intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	if median <= 0 {
+		return 0, 0, 0
+	}
+	cadence = perSecond / float64(median)
+	fps = standardFrameRates[0]
+	for _, rate := range standardFrameRates[1:] {
+		// nearest in ratio, as the rates are multiples of each other
+		if math.Abs(math.Log(cadence/rate)) < math.Abs(math.Log(cadence/fps)) {
+			fps = rate
+		}
+	}
+	period := perSecond / fps
+	onCadence := 0
+	for _, interval := range intervals {
+		if math.Abs(float64(interval)-period) <= frameRateTolerance*period {
+			onCadence++
+		}
+	}
+	return fps, cadence, float64(onCadence) / float64(len(intervals))
+}
+
+// estimateFrameRate stores the frame rate of a downstream UDP media flow,
+// overall and over sliding windows, from the cadence of its video frames.
+// Flows with fewer than frameRateMinFrames frames are left without one.
+func (flow *Flow) estimateFrameRate(opts Options) {
+	state := &flow.bursts
+	if state.maxGap <= 0 || flow.Protocol != 17 || flow.TrafficClass == bulkDownloadClass {
+		return
+	}
+	state.end()
+	frames := state.videoFrames(flow.firstMedia.minPayload, opts.duration(frameGap))
+	if len(frames) < frameRateMinFrames {
+		return
+	}
+	perSecond := float64(opts.duration(time.Second))
+	fps, cadence, confidence := estimateCadence(frames, perSecond)
+	if fps == 0 {
+		return
+	}
+	estimate := &FrameRates{FPS: fps, CadenceFPS: math.Round(cadence*100) / 100, Confidence: math.Round(confidence*1000) / 1000, Frames: len(frames)}
+	estimate.Timeline = frameRateTimeline(frameRateWindows(frames, perSecond, opts.duration(frameRateWindow), opts.duration(frameRateStep)))
+	flow.FrameRate = estimate
+}
+
+// frameRateWindowEstimate is the estimate of one sliding window.
+type frameRateWindowEstimate struct {
+	start, end int64
+	fps        float64
+	confidence float64
+}
+
+// frameRateWindows estimates the frame rate of the windows of frames with
+// enough of them and a confidence of at least frameRateMinConfidence.
+func frameRateWindows(frames []int64, perSecond float64, window, step int64) []frameRateWindowEstimate {
+	var windows []frameRateWindowEstimate
+	last := frames[len(frames)-1]
+	first, end := 0, 0
+	for start := frames[0]; ; start += step {
+		for first < len(frames) && frames[first] < start {
+			first++
+		}
+		for end < len(frames) && frames[end] < start+window {
+			end++
+		}
+		if end-first >= frameRateMinFrames {
+			fps, _, confidence := estimateCadence(frames[first:end], perSecond)
+			if fps > 0 && confidence >= frameRateMinConfidence {
+				windows = append(windows, frameRateWindowEstimate{start, min(start+window, last), fps, confidence})
+			}
+		}
+		if start+window > last {
+			return windows
+		}
+	}
+}
+
+// frameRateTimeline merges consecutive windows into segments of one frame
+// rate. A segment starts once its rate held for frameRateHold windows, the
+// first segment at the first window.
+func frameRateTimeline(windows []frameRateWindowEstimate) []FrameRateSegment {
+	var segments []FrameRateSegment
+	var counts []int // windows of each segment
+	var pending []frameRateWindowEstimate
+	for _, window := range windows {
+		current := len(segments) - 1
+		if current >= 0 && window.fps == segments[current].FPS {
+			segments[current].End = window.end
+			segments[current].Confidence += window.confidence
+			counts[current]++
+			pending = nil
+			continue
+		}
+		if len(pending) > 0 && pending[0].fps != window.fps {
+			pending = nil
+		}
+		pending = append(pending, window)
+		if current >= 0 && len(pending) < frameRateHold {
+			continue
+		}
+		segment := FrameRateSegment{Start: pending[0].start, End: window.end, FPS: window.fps}
+		for _, held := range pending {
+			segment.Confidence += held.confidence
+		}
+		segments = append(segments, segment)
+		counts = append(counts, len(pending))
+		pending = nil
+	}
+	for i := range segments {
+		segments[i].Confidence = math.Round(segments[i].Confidence/float64(counts[i])*1000) / 1000
+	}
+	return segments
+}
+
+// collectFrameRateChanges lists the frame rate changes of the flows, in
+// order of time.
+func collectFrameRateChanges(flowMap map[string]*Flow) []FrameRateChange {
+	var changes []FrameRateChange
+	for _, key := range sortedFlowKeys(flowMap) {
+		flow := flowMap[key]
+		if flow.FrameRate == nil {
+			continue
+		}
+		timeline := flow.FrameRate.Timeline
+		for i := 1; i < len(timeline); i++ {
+			changes = append(changes, FrameRateChange{Flow: flow.getFlowID(), Timestamp: timeline[i].Start, FromFPS: timeline[i-1].FPS, ToFPS: timeline[i].FPS})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Timestamp < changes[j].Timestamp })
+	return changes
+}
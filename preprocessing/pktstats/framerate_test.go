@@ -0,0 +1,181 @@
+package pktstats
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// frameTrain returns the arrivals in µs of seconds of frames at fps from
+// start, each moved by up to jitter either way, deterministically.
+func frameTrain(random *rand.Rand, start int64, fps, seconds float64, jitter time.Duration) []int64 {
+	period := 1e6 / fps
+	frames := make([]int64, int(fps*seconds))
+	for i := range frames {
+		offset := (random.Float64()*2 - 1) * float64(jitter.Microseconds())
+		frames[i] = start + int64(float64(i)*period+offset)
+	}
+	return frames
+}
+
+func TestEstimateCadence(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	dropped := func(frames []int64) []int64 { // every fifth frame lost
+		var kept []int64
+		for i, frame := range frames {
+			if i%5 != 4 {
+				kept = append(kept, frame)
+			}
+		}
+		return kept
+	}
+	tests := []struct {
+		name          string
+		frames        []int64
+		fps           float64
+		minConfidence float64
+		maxConfidence float64
+	}{
+		{"30 fps", frameTrain(random, 0, 30, 5, 0), 30, 1, 1},
+		{"60 fps", frameTrain(random, 0, 60, 5, 0), 60, 1, 1},
+		{"120 fps", frameTrain(random, 0, 120, 5, 0), 120, 1, 1},
+		{"30 fps with jitter", frameTrain(random, 0, 30, 5, 3*time.Millisecond), 30, 1, 1},
+		{"60 fps with jitter", frameTrain(random, 0, 60, 5, time.Millisecond), 60, 1, 1},
+		{"120 fps with jitter", frameTrain(random, 0, 120, 5, 500*time.Microsecond), 120, 1, 1},
+		// beyond the tolerance, fewer intervals are on cadence
+		{"60 fps with heavy jitter", frameTrain(random, 0, 60, 5, 4*time.Millisecond), 60, 0.3, 0.8},
+		{"NTSC rate", frameTrain(random, 0, 59.94, 5, 0), 60, 1, 1},
+		{"nearest in ratio", frameTrain(random, 0, 135, 5, 0), 144, 1, 1},
+		{"dropped frames", dropped(frameTrain(random, 0, 60, 5, 0)), 60, 0.7, 0.8},
+	}
+	for _, test := range tests {
+		fps, cadence, confidence := estimateCadence(test.frames, 1e6)
+		if fps != test.fps || confidence < test.minConfidence || confidence > test.maxConfidence {
+			t.Errorf("%s: %v fps (cadence %.2f) with confidence %.3f, want %v fps with confidence in [%v, %v]", test.name, fps, cadence, confidence, test.fps, test.minConfidence, test.maxConfidence)
+		}
+	}
+	if fps, _, _ := estimateCadence([]int64{5, 5, 5}, 1e6); fps != 0 {
+		t.Errorf("%v fps of frames at the same time", fps)
+	}
+}
+
+// mediaBursts returns the downstream packets of a media flow with video
+// frames at the arrivals of frames, each sent in two bursts paced apart, and
+// an audio substream of small packets at 50 Hz in the gaps between frames.
+func mediaBursts(frames []int64) []Packet {
+	const (
+		videoPayload = 1200
+		audioPayload = 160
+		spacing      = 20  // µs between the packets of a burst
+		pacing       = 500 // µs between the two bursts of a frame
+	)
+	var packets []Packet
+	burst := func(start int64, payload int) {
+		for i := 0; i < 5; i++ {
+			packets = append(packets, Packet{Direction: DirectionDownstream, Timestamp: start + int64(i)*spacing, PayloadSize: payload, PktLength: payload + 42})
+		}
+	}
+	for _, frame := range frames {
+		burst(frame, videoPayload)
+		burst(frame+pacing, videoPayload)
+	}
+	for audio := frames[0] + 10000; audio < frames[len(frames)-1]; audio += 20000 {
+		// clear of the frames, or the detector takes it for part of one
+		next := sort.Search(len(frames), func(i int) bool { return frames[i] > audio })
+		if audio-frames[next-1] > 2000 && (next == len(frames) || frames[next]-audio > 2000) {
+			burst(audio, audioPayload)
+		}
+	}
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].Timestamp < packets[j].Timestamp })
+	return packets
+}
+
+// TestEstimateFrameRate runs a flow dropping from 60 to 30 fps under jitter
+// through the burst detector.
+func TestEstimateFrameRate(t *testing.T) {
+	const start = 1_000_000
+	random := rand.New(rand.NewSource(1))
+	frames := append(frameTrain(random, start, 60, 10, time.Millisecond), frameTrain(random, start+10_000_000, 30, 10, time.Millisecond)...)
+	frames[0] = start
+
+	opts := DefaultOptions()
+	flow := &Flow{Protocol: 17, LocalIP: "192.168.1.10", LocalPort: 50000, RemoteIP: "203.0.113.10", RemotePort: 3478}
+	flow.bursts = burstState{maxGap: opts.duration(time.Duration(opts.BurstGapMicros) * time.Microsecond), minPackets: opts.BurstMinPackets, skipEmpty: true}
+	flow.firstMedia.minPayload = opts.MediaMinPayload
+	for _, packet := range mediaBursts(frames) {
+		flow.bursts.observe(&packet)
+	}
+	flow.estimateFrameRate(opts)
+
+	estimate := flow.FrameRate
+	if estimate == nil {
+		t.Fatal("no frame rate estimated")
+	}
+	// the audio trains and the second burst of each frame are not frames
+	if estimate.Frames != len(frames) {
+		t.Errorf("%d frames, want %d", estimate.Frames, len(frames))
+	}
+	// two intervals at 60 fps for each at 30 fps: their median is among the
+	// longer of the jittered intervals at 60 fps
+	if estimate.FPS != 60 || math.Abs(estimate.CadenceFPS-60) > 60*frameRateTolerance || math.Abs(estimate.Confidence-2.0/3) > 0.01 {
+		t.Errorf("frame rate %v fps (cadence %v) with confidence %v, want 60 fps with confidence 0.667", estimate.FPS, estimate.CadenceFPS, estimate.Confidence)
+	}
+	// the window straddling the change is still mostly at 60 fps, the
+	// segment at 30 fps starts with the first window past it
+	timeline := estimate.Timeline
+	if len(timeline) != 2 || timeline[0].FPS != 60 || timeline[1].FPS != 30 {
+		t.Fatalf("timeline %+v, want 60 then 30 fps", timeline)
+	}
+	if timeline[0].Start != start || timeline[1].Start != start+10_000_000 || timeline[1].End != frames[len(frames)-1] {
+		t.Errorf("timeline %+v, want 60 fps from %d and 30 fps from %d to %d", timeline, start, start+10_000_000, frames[len(frames)-1])
+	}
+	if timeline[1].Confidence != 1 {
+		t.Errorf("confidence %v at 30 fps, want 1 within the tolerance of the jitter", timeline[1].Confidence)
+	}
+
+	changes := collectFrameRateChanges(map[string]*Flow{flow.getFlowID(): flow})
+	want := FrameRateChange{Flow: flow.getFlowID(), Timestamp: start + 10_000_000, FromFPS: 60, ToFPS: 30}
+	if len(changes) != 1 || changes[0] != want {
+		t.Errorf("frame rate changes %+v, want %+v", changes, want)
+	}
+}
+
+// TestEstimateFrameRateWithoutVideo leaves a flow of audio trains alone, and a
+// flow with too few frames.
+func TestEstimateFrameRateWithoutVideo(t *testing.T) {
+	opts := DefaultOptions()
+	random := rand.New(rand.NewSource(1))
+	audio := func(packets []Packet) []Packet {
+		var kept []Packet
+		for _, packet := range packets {
+			if packet.PayloadSize < opts.MediaMinPayload {
+				kept = append(kept, packet)
+			}
+		}
+		return kept
+	}
+	tests := []struct {
+		name    string
+		packets []Packet
+	}{
+		{"audio only", audio(mediaBursts(frameTrain(random, 0, 60, 10, 0)))},
+		{"too few frames", mediaBursts(frameTrain(random, 0, 60, 1, 0)[:frameRateMinFrames-1])},
+	}
+	for _, test := range tests {
+		flow := &Flow{Protocol: 17}
+		flow.bursts = burstState{maxGap: opts.duration(time.Duration(opts.BurstGapMicros) * time.Microsecond), minPackets: opts.BurstMinPackets, skipEmpty: true}
+		flow.firstMedia.minPayload = opts.MediaMinPayload
+		for _, packet := range test.packets {
+			flow.bursts.observe(&packet)
+		}
+		if len(flow.bursts.trains) < frameRateMinFrames/2 {
+			t.Fatalf("%s: %d bursts detected", test.name, len(flow.bursts.trains))
+		}
+		flow.estimateFrameRate(opts)
+		if flow.FrameRate != nil {
+			t.Errorf("%s: frame rate %+v", test.name, flow.FrameRate)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package pktstats
+
+import (
+	"fmt"
+	"time"
+)
+
+// GapInterval is a time interval, in packet timestamps, without any captured packet.
+type GapInterval struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// gapDetector finds quiet periods, intervals without any packet at all longer
+// than a threshold. In a busy capture these point to the capture dropping
+// packets rather than to network loss.
+type gapDetector struct {
+	quiet int64 // shortest quiet period, in timestamp units; 0 disables detection
+	first int64
+	last  int64
+	seen  bool
+	gaps  []GapInterval
+}
+
+func newGapDetector(opts Options) *gapDetector {
+	return &gapDetector{quiet: opts.duration(time.Duration(opts.GapQuietMs) * time.Millisecond)}
+}
+
+// observe records the timestamp of a packet, including packets that belong to no flow.
+func (detector *gapDetector) observe(timestamp int64) {
+	if detector.quiet == 0 {
+		return
+	}
+	if !detector.seen {
+		detector.first, detector.seen = timestamp, true
+	} else if timestamp-detector.last > detector.quiet {
+		detector.gaps = append(detector.gaps, GapInterval{detector.last, timestamp})
+	}
+	detector.last = max(detector.last, timestamp)
+}
+
+// spanned returns the quiet periods between two consecutive packets of a flow,
+// for which the flow's inter-arrival time spike is suspected to be a capture gap.
+func (detector *gapDetector) spanned(from, to int64) []GapInterval {
+	var spanned []GapInterval
+	for i := len(detector.gaps) - 1; i >= 0 && detector.gaps[i].Start >= from; i-- {
+		if detector.gaps[i].End <= to {
+			spanned = append([]GapInterval{detector.gaps[i]}, spanned...)
+		}
+	}
+	return spanned
+}
+
+// suspected reports whether the quiet periods are suspected capture gaps: the
+// capture reports kernel drops, or is otherwise busy, with an average rate of
+// at least minPPS packets per second.
+func (detector *gapDetector) suspected(packets int64, kernelDrops *int64, opts Options) bool {
+	if len(detector.gaps) == 0 {
+		return false
+	}
+	if kernelDrops != nil && *kernelDrops > 0 {
+		return true
+	}
+	seconds := float64(opts.microseconds(detector.last-detector.first)) / 1e6
+	return seconds > 0 && float64(packets)/seconds >= opts.GapMinPPS
+}
+
+// printGaps logs the suspected capture gaps of a file.
+func printGaps(filePath string, gaps []GapInterval, opts Options) {
+	var total int64
+	for _, gap := range gaps {
+		total += opts.microseconds(gap.End - gap.Start)
+	}
+	fmt.Printf("%s: %d suspected capture gaps, %s in total\n", filePath, len(gaps), time.Duration(total)*time.Microsecond)
+}
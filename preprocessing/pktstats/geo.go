@@ -0,0 +1,155 @@
+package pktstats
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// RemotePoP is the point of presence of a remote endpoint: its autonomous
+// system and the city it is located in, from the geo databases.
+type RemotePoP struct {
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"asOrg,omitempty"`
+	City    string `json:"city,omitempty"`
+	Country string `json:"country,omitempty"` // ISO 3166-1 code
+}
+
+// key identifies the PoP by ASN and city, the organization and country
+// follow from them.
+func (pop *RemotePoP) key() string {
+	return fmt.Sprintf("%d/%s", pop.ASN, pop.City)
+}
+
+// PoPChange is a change of the remote PoP between the consecutive media
+// flows of a local client and service, within a session or from one session
+// to the next, e.g. as a mobile client moves between serving edges.
+type PoPChange struct {
+	Timestamp     int64     `json:"timestamp"` // first packet of the flow to the new PoP
+	LocalClient   string    `json:"localClient"`
+	Service       string    `json:"service"`
+	FromSessionID int       `json:"fromSessionID"`
+	ToSessionID   int       `json:"toSessionID"`
+	From          RemotePoP `json:"from"`
+	To            RemotePoP `json:"to"`
+	// from the last packet of the earlier flows to Timestamp, negative when
+	// the new flow started before they ended
+	GapMicros int64 `json:"gapMicros"`
+}
+
+// geoDatabases are the MaxMind-format ASN and city databases of
+// Options.GeoASNDB and Options.GeoCityDB, either of which may be missing.
+type geoDatabases struct {
+	asn, city *maxminddb.Reader
+}
+
+func openGeoDatabases(asnPath, cityPath string) (*geoDatabases, error) {
+	geo := &geoDatabases{}
+	var err error
+	if asnPath != "" {
+		if geo.asn, err = maxminddb.Open(asnPath); err != nil {
+			return nil, fmt.Errorf("unable to open ASN database: %w", err)
+		}
+	}
+	if cityPath != "" {
+		if geo.city, err = maxminddb.Open(cityPath); err != nil {
+			geo.close()
+			return nil, fmt.Errorf("unable to open city database: %w", err)
+		}
+	}
+	return geo, nil
+}
+
+func (geo *geoDatabases) close() {
+	if geo.asn != nil {
+		geo.asn.Close()
+	}
+	if geo.city != nil {
+		geo.city.Close()
+	}
+}
+
+// lookup returns the PoP of an address, nil if neither database knows it.
+func (geo *geoDatabases) lookup(address string) *RemotePoP {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil
+	}
+	var pop RemotePoP
+	if geo.asn != nil {
+		var record struct {
+			Number uint   `maxminddb:"autonomous_system_number"`
+			Org    string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := geo.asn.Lookup(ip, &record); err == nil {
+			pop.ASN, pop.ASOrg = record.Number, record.Org
+		}
+	}
+	if geo.city != nil {
+		var record struct {
+			City struct {
+				Names map[string]string `maxminddb:"names"`
+			} `maxminddb:"city"`
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := geo.city.Lookup(ip, &record); err == nil {
+			pop.City, pop.Country = record.City.Names["en"], record.Country.ISOCode
+		}
+	}
+	if pop == (RemotePoP{}) {
+		return nil
+	}
+	return &pop
+}
+
+// trackPoPChanges sets the RemotePoP of the flows of media sessions, after
+// linkSessions, and returns the changes of PoP between the consecutive
+// session flows of each local client and service, in order of time. Flows
+// whose remote address neither database knows neither start nor end a
+// change.
+func trackPoPChanges(flowMap map[string]*Flow, geo *geoDatabases, opts Options) []PoPChange {
+	type previous struct {
+		flow *Flow
+		last int64 // last packet of the flows so far
+	}
+	latest := make(map[string]*previous)
+	var changes []PoPChange
+	for _, key := range sortedFlowKeys(flowMap) {
+		flow := flowMap[key]
+		if flow.SessionID == 0 {
+			continue
+		}
+		if flow.RemotePoP = geo.lookup(flow.RemoteIP); flow.RemotePoP == nil {
+			continue
+		}
+		group := flow.LocalIP + "/" + flow.Subscriber + "#" + flow.RegisteredDomain
+		prev, ok := latest[group]
+		if !ok {
+			latest[group] = &previous{flow: flow, last: flow.download.last}
+			continue
+		}
+		if prev.flow.RemotePoP.key() != flow.RemotePoP.key() {
+			client := flow.LocalIP
+			if flow.Subscriber != "" {
+				client = flow.Subscriber
+			}
+			changes = append(changes, PoPChange{
+				Timestamp:     flow.download.first,
+				LocalClient:   client,
+				Service:       flow.RegisteredDomain,
+				FromSessionID: prev.flow.SessionID,
+				ToSessionID:   flow.SessionID,
+				From:          *prev.flow.RemotePoP,
+				To:            *flow.RemotePoP,
+				GapMicros:     opts.microseconds(flow.download.first - prev.last),
+			})
+		}
+		prev.flow, prev.last = flow, max(prev.last, flow.download.last)
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Timestamp < changes[j].Timestamp })
+	return changes
+}
@@ -0,0 +1,77 @@
+package pktstats
+
+import (
+	"fmt"
+	"sort"
+)
+
+// heavyHitterCount is the number of flows listed in Meta.TopFlows.
+const heavyHitterCount = 10
+
+// HeavyHitter is one of the flows carrying the most bytes in a file.
+type HeavyHitter struct {
+	Key              string  `json:"key"`
+	ServiceFlowType  string  `json:"serviceFlowType"`
+	RegisteredDomain string  `json:"registeredDomain"`
+	Bytes            int64   `json:"bytes"`
+	DownUpRatio      float64 `json:"downUpRatio"`          // downstream bytes per upstream byte
+	TCPCeiling       string  `json:"tcpCeiling,omitempty"` // attribution of Flow.TCPCeiling, for TCP downloads
+}
+
+// heavyHitters ranks flows by bytes and returns the top flows with the Gini
+// coefficient of bytes across all flows: 0 when all flows carry the same
+// bytes, close to 1 when a single flow carries nearly all of them. Bytes
+// count every packet of a flow, including those not stored.
+func heavyHitters(flowMap map[string]*Flow) ([]HeavyHitter, float64) {
+	hitters := make([]HeavyHitter, 0, len(flowMap))
+	for key, flow := range flowMap {
+		up, down := flow.download.upBytes, flow.download.downBytes
+		hitter := HeavyHitter{
+			Key:              key,
+			ServiceFlowType:  flow.ServiceFlowType,
+			RegisteredDomain: flow.RegisteredDomain,
+			Bytes:            up + down,
+			DownUpRatio:      float64(down) / float64(max(up, 1)),
+		}
+		if flow.TCPCeiling != nil {
+			hitter.TCPCeiling = flow.TCPCeiling.Attribution
+		}
+		hitters = append(hitters, hitter)
+	}
+	sort.Slice(hitters, func(i, j int) bool {
+		if hitters[i].Bytes != hitters[j].Bytes {
+			return hitters[i].Bytes > hitters[j].Bytes
+		}
+		return hitters[i].Key < hitters[j].Key
+	})
+
+	// Gini coefficient over bytes sorted in ascending order
+	var total, weighted float64
+	n := float64(len(hitters))
+	for i := range hitters {
+		bytes := float64(hitters[len(hitters)-1-i].Bytes)
+		total += bytes
+		weighted += float64(i+1) * bytes
+	}
+	var gini float64
+	if total > 0 {
+		gini = 2*weighted/(n*total) - (n+1)/n
+	}
+	return hitters[:min(len(hitters), heavyHitterCount)], gini
+}
+
+// printHeavyHitters logs the top flows of a file.
+func printHeavyHitters(filePath string, hitters []HeavyHitter, gini float64) {
+	fmt.Printf("%s: top flows by bytes (concentration %.2f)\n", filePath, gini)
+	for _, hitter := range hitters {
+		label := hitter.ServiceFlowType
+		if label == "" {
+			label = unlabeledService
+		}
+		ceiling := ""
+		if hitter.TCPCeiling != "" {
+			ceiling = "  " + hitter.TCPCeiling
+		}
+		fmt.Printf("  %-50s %-40s %12d bytes  down/up %.1f%s\n", hitter.Key, label, hitter.Bytes, hitter.DownUpRatio, ceiling)
+	}
+}
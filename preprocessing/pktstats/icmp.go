@@ -0,0 +1,120 @@
+package pktstats
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// maximum number of ICMP errors about untracked flows listed per file
+const maxStrayICMPErrors = 100
+
+// PathEvent is an ICMP error about a packet of a flow, e.g. a router asking
+// for fragmentation during path MTU discovery or a host whose port is
+// unreachable.
+type PathEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Reporter  string `json:"reporter"` // sender of the error, a router on the path or the destination host
+	Type      int    `json:"type"`
+	Code      int    `json:"code"`
+	MTU       int    `json:"mtu,omitempty"` // next-hop MTU of fragmentation needed errors
+}
+
+// StrayICMPError is an ICMP error quoting a packet of no tracked flow.
+type StrayICMPError struct {
+	PathEvent
+	Flow string `json:"flow"` // key of the flow of the quoted packet
+}
+
+// pathEventStats counts the ICMP errors of a file matched to flows and lists
+// the stray ones.
+type pathEventStats struct {
+	matched int
+	stray   []StrayICMPError
+	count   int // stray errors, including those beyond the list
+}
+
+func (stats *pathEventStats) recordStray(event PathEvent, flowID string) {
+	stats.count++
+	if len(stats.stray) < maxStrayICMPErrors {
+		stats.stray = append(stats.stray, StrayICMPError{PathEvent: event, Flow: flowID})
+	}
+}
+
+// isICMPError reports whether an ICMPv4 type is an error quoting the packet
+// that caused it: destination unreachable, time exceeded or parameter problem.
+func isICMPError(icmpType uint8) bool {
+	return icmpType == layers.ICMPv4TypeDestinationUnreachable || icmpType == layers.ICMPv4TypeTimeExceeded || icmpType == layers.ICMPv4TypeParameterProblem
+}
+
+// icmpPathEvent returns the event of an ICMPv4 error and the quoted packet
+// that caused it, from the quoted IPv4 header and the first bytes of its TCP
+// or UDP header. The quoted packet only carries addresses, ports and protocol.
+func icmpPathEvent(icmp *layers.ICMPv4, reporter string, timestamp int64) (PathEvent, Packet, bool) {
+	icmpType := icmp.TypeCode.Type()
+	if !isICMPError(icmpType) {
+		return PathEvent{}, Packet{}, false
+	}
+	quoted := icmp.Payload
+	if len(quoted) < 20 || quoted[0]>>4 != 4 {
+		return PathEvent{}, Packet{}, false
+	}
+	headerLength := int(quoted[0]&0x0f) * 4
+	protocol := quoted[9]
+	if headerLength < 20 || len(quoted) < headerLength+4 || (protocol != 6 && protocol != 17) {
+		return PathEvent{}, Packet{}, false
+	}
+	event := PathEvent{
+		Timestamp: timestamp,
+		Reporter:  reporter,
+		Type:      int(icmpType),
+		Code:      int(icmp.TypeCode.Code()),
+	}
+	if icmpType == layers.ICMPv4TypeDestinationUnreachable && icmp.TypeCode.Code() == layers.ICMPv4CodeFragmentationNeeded {
+		// RFC 1191: the next-hop MTU is in the low half of the unused header field
+		event.MTU = int(icmp.Seq)
+	}
+	packet := Packet{
+		SrcIP:    net.IP(quoted[12:16]).String(),
+		DstIP:    net.IP(quoted[16:20]).String(),
+		SrcPort:  int(binary.BigEndian.Uint16(quoted[headerLength:])),
+		DstPort:  int(binary.BigEndian.Uint16(quoted[headerLength+2:])),
+		Protocol: int(protocol),
+	}
+	return event, packet, true
+}
+
+// match appends an ICMP error to the flow of the packet it quotes, keyed as
+// the packets of the flow are, or lists it as stray.
+func (stats *pathEventStats) match(event PathEvent, quoted *Packet, flowMap, thirdPartyFlowMap map[string]*Flow, opts Options, timestamp time.Time) {
+	srcIP, dstIP := net.ParseIP(quoted.SrcIP), net.ParseIP(quoted.DstIP)
+	srcLocal := opts.localNets.contains(srcIP) || opts.translations.isExternal(srcIP)
+	dstLocal := opts.localNets.contains(dstIP) || opts.translations.isExternal(dstIP)
+	flows := flowMap
+	canonical := opts.CanonicalKeys
+	if srcLocal != dstLocal {
+		quoted.Upstream = srcLocal
+	} else {
+		canonical = true
+		quoted.Upstream = quoted.canonicalUpstream()
+		if !srcLocal {
+			flows = thirdPartyFlowMap
+		}
+	}
+	flowID := quoted.getFlowID(canonical)
+	if opts.translations != nil && (srcLocal || dstLocal) {
+		if quoted.Upstream {
+			flowID += "/" + opts.translations.subscriber(quoted.SrcIP, quoted.SrcPort, timestamp)
+		} else {
+			flowID += "/" + opts.translations.subscriber(quoted.DstIP, quoted.DstPort, timestamp)
+		}
+	}
+	if flow, ok := flows[flowID]; ok {
+		flow.PathEvents = append(flow.PathEvents, event)
+		stats.matched++
+		return
+	}
+	stats.recordStray(event, flowID)
+}
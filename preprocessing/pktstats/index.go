@@ -0,0 +1,288 @@
+package pktstats
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultIndexTemplate names the outputs of Options.IndexOnly when
+// Options.OutTemplate is left at its default, next to the full outputs.
+const defaultIndexTemplate = "{dir}/{base}_index.json"
+
+// CaptureIndex is the output of Options.IndexOnly: the flows of a capture
+// without their packets, to browse a dataset before extracting it.
+type CaptureIndex struct {
+	Meta  *Meta         `json:"meta"`
+	Flows []IndexedFlow `json:"flows"` // in order of first packet arrival, third-party flows included
+}
+
+// IndexedFlow is the entry of a flow in a CaptureIndex. Its counts cover all
+// packets of the flow, not only the stored ones.
+type IndexedFlow struct {
+	Key              string        `json:"key"`
+	LocalIP          string        `json:"localIP"`
+	RemoteIP         string        `json:"remoteIP"`
+	LocalPort        int           `json:"localPort"`
+	RemotePort       int           `json:"remotePort"`
+	Protocol         int           `json:"protocol"`
+	Direction        Direction     `json:"direction,omitempty"`
+	ServiceFlowType  string        `json:"serviceFlowType,omitempty"`
+	DNSName          string        `json:"dnsName,omitempty"`
+	RegisteredDomain string        `json:"registeredDomain,omitempty"`
+	TransportProfile string        `json:"transportProfile"`
+	PayloadSizesUp   *PayloadSizes `json:"payloadSizesUp,omitempty"`
+	PayloadSizesDown *PayloadSizes `json:"payloadSizesDown,omitempty"`
+	Packets          int           `json:"packets"`
+	UpBytes          int64         `json:"upBytes"`
+	DownBytes        int64         `json:"downBytes"`
+	FirstTimestamp   int64         `json:"firstTimestamp"`
+	LastTimestamp    int64         `json:"lastTimestamp"`
+	DurationMicros   int64         `json:"durationMicros"`
+}
+
+// writeIndex stores the flows of an output as a CaptureIndex. The service
+// rollups of the meta block count stored packets, at most one per flow with
+// Options.IndexOnly, and are left out; they are also left out of the
+// aggregate stats of the run.
+func writeIndex(outPath string, output *Output, opts Options) error {
+	output.Meta.Services, output.Meta.Clients = nil, nil
+	index := CaptureIndex{Meta: output.Meta, Flows: []IndexedFlow{}}
+	for _, flows := range []map[string]*Flow{output.Flows, output.ThirdPartyFlows} {
+		for key, flow := range flows {
+			index.Flows = append(index.Flows, IndexedFlow{
+				Key:              key,
+				LocalIP:          flow.LocalIP,
+				RemoteIP:         flow.RemoteIP,
+				LocalPort:        flow.LocalPort,
+				RemotePort:       flow.RemotePort,
+				Protocol:         flow.Protocol,
+				Direction:        flow.Direction,
+				ServiceFlowType:  flow.ServiceFlowType,
+				DNSName:          flow.DNSName,
+				RegisteredDomain: flow.RegisteredDomain,
+				TransportProfile: flow.TransportProfile,
+				PayloadSizesUp:   flow.PayloadSizesUp,
+				PayloadSizesDown: flow.PayloadSizesDown,
+				Packets:          flow.download.packets,
+				UpBytes:          flow.download.upBytes,
+				DownBytes:        flow.download.downBytes,
+				FirstTimestamp:   flow.download.first,
+				LastTimestamp:    flow.download.last,
+				DurationMicros:   opts.microseconds(flow.download.last - flow.download.first),
+			})
+		}
+	}
+	sort.Slice(index.Flows, func(i, j int) bool {
+		a, b := index.Flows[i], index.Flows[j]
+		if a.FirstTimestamp != b.FirstTimestamp {
+			return a.FirstTimestamp < b.FirstTimestamp
+		}
+		return a.Key < b.Key
+	})
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+	content, err := marshalOutput(&index, opts.LegacyNames)
+	if err != nil {
+		return fmt.Errorf("unable to marshal index: %w", err)
+	}
+	return writeOutputFile(outPath, content, output.Meta.hashes)
+}
+
+// readIndex reads a CaptureIndex written with Options.IndexOnly.
+func readIndex(path string) (*CaptureIndex, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := &CaptureIndex{}
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return index, nil
+}
+
+// indexQuery selects the flows of an index.
+type indexQuery struct {
+	service     string // case-insensitive substring of the registered domain, label or DNS name
+	minDuration time.Duration
+	minBytes    int64
+}
+
+func (query *indexQuery) matches(flow *IndexedFlow) bool {
+	if query.service != "" {
+		service := strings.ToLower(query.service)
+		if !strings.Contains(strings.ToLower(flow.RegisteredDomain), service) &&
+			!strings.Contains(strings.ToLower(flow.ServiceFlowType), service) &&
+			!strings.Contains(strings.ToLower(flow.DNSName), service) {
+			return false
+		}
+	}
+	return flow.DurationMicros >= query.minDuration.Microseconds() && flow.UpBytes+flow.DownBytes >= query.minBytes
+}
+
+// matchesSketch selects the entries of a sketch for a query: by DNS name
+// with a service, by remote IP otherwise, with at least the minimum bytes.
+// Sketches have no durations and match no query with one.
+func (query *indexQuery) matchesSketch(sketch *EndpointSketch) []SketchEntry {
+	if query.minDuration > 0 {
+		return nil
+	}
+	entries := sketch.RemoteIPs
+	if query.service != "" {
+		entries = sketch.DNSNames
+	}
+	var matched []SketchEntry
+	for _, entry := range entries {
+		if query.service != "" && !strings.Contains(entry.Key, strings.ToLower(query.service)) {
+			continue
+		}
+		if entry.Bytes-entry.ErrorBytes >= query.minBytes {
+			matched = append(matched, entry)
+		}
+	}
+	return matched
+}
+
+// absolutePath returns path as an absolute path, or unchanged if it cannot.
+func absolutePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// printSketch lists a capture with the sketch entries matching a query,
+// reporting whether there are any.
+func printSketch(sketch *EndpointSketch, query *indexQuery, listFlows bool) bool {
+	matched := query.matchesSketch(sketch)
+	if len(matched) == 0 {
+		return false
+	}
+	var bytes int64
+	for _, entry := range matched {
+		bytes += entry.Bytes
+	}
+	fmt.Printf("%-60s %8s %12s %14s\n", sketch.Meta.Source+" (sketch)", "-", "-", fmt.Sprintf("~%d", bytes))
+	if listFlows {
+		for _, entry := range matched {
+			// the actual bytes, or their bounds
+			bytes := fmt.Sprint(entry.Bytes)
+			if entry.ErrorBytes > 0 {
+				bytes = fmt.Sprintf("%d-%d", entry.Bytes-entry.ErrorBytes, entry.Bytes)
+			}
+			fmt.Printf("    %-56s %-24s %12s %14s\n", entry.Key, entry.DNSName, "-", bytes)
+		}
+	}
+	return true
+}
+
+// IndexMain implements the index subcommand, listing the captures whose index
+// holds flows matching a query, e.g. the captures with flows of a service
+// longer than 10 minutes. Captures with a sketch instead, or sketched on the
+// fly with -sketch-over, list their top remote endpoints matching the query.
+func IndexMain(args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	basePath := fs.String("p", "../data/", "Base path to the index files written with -index-only")
+	var query indexQuery
+	fs.StringVar(&query.service, "service", "", "Only flows whose registered domain, label or DNS name contains this text, case-insensitive")
+	fs.DurationVar(&query.minDuration, "min-duration", 0, "Only flows lasting at least this long")
+	fs.Int64Var(&query.minBytes, "min-bytes", 0, "Only flows with at least this many bytes in both directions")
+	listFlows := fs.Bool("flows", false, "List the matching flows of each capture")
+	sketchOver := fs.Int64("sketch-over", 0, "Sketch the captures under -p without an index or sketch of at least this many bytes, 0 to disable")
+	var sketchOpts Options
+	fs.StringVar(&sketchOpts.LocalSubnets, "local-subnets", defaultLocalSubnets, "Comma-separated CIDR prefixes of local endpoints, for -sketch-over")
+	fs.StringVar(&sketchOpts.DNSPorts, "dns-ports", "53", "Comma-separated source ports of DNS responses, for -sketch-over")
+	fs.IntVar(&sketchOpts.SketchTop, "sketch-top", 20, "Number of remote endpoints of each capture sketched with -sketch-over")
+	fs.Parse(args)
+	if _, err := parseLocalSubnets(sketchOpts.LocalSubnets); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if _, err := parsePorts(sketchOpts.DNSPorts); err != nil {
+		fmt.Println("Invalid DNS ports:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%-60s %8s %12s %14s\n", "Capture", "Flows", "Longest", "Bytes")
+	captures := 0
+	// captures with an index or a sketch, by absolute path
+	covered := make(map[string]bool)
+	err := findOutputs(*basePath, func(path string, meta *Meta) {
+		if meta.Options.Sketch {
+			covered[absolutePath(meta.Source)] = true
+			sketch, err := readSketch(path)
+			if err != nil {
+				fmt.Println("unable to read sketch:", err)
+			} else if printSketch(sketch, &query, *listFlows) {
+				captures++
+			}
+			return
+		}
+		if !meta.Options.IndexOnly {
+			return
+		}
+		covered[absolutePath(meta.Source)] = true
+		index, err := readIndex(path)
+		if err != nil {
+			fmt.Println("unable to read index:", err)
+			return
+		}
+		var matched []*IndexedFlow
+		var longest, bytes int64
+		for i := range index.Flows {
+			flow := &index.Flows[i]
+			if !query.matches(flow) {
+				continue
+			}
+			matched = append(matched, flow)
+			longest = max(longest, flow.DurationMicros)
+			bytes += flow.UpBytes + flow.DownBytes
+		}
+		if len(matched) == 0 {
+			return
+		}
+		captures++
+		longestDuration := (time.Duration(longest) * time.Microsecond).Round(time.Second)
+		fmt.Printf("%-60s %8d %12s %14d\n", index.Meta.Source, len(matched), longestDuration, bytes)
+		if *listFlows {
+			for _, flow := range matched {
+				duration := (time.Duration(flow.DurationMicros) * time.Microsecond).Round(time.Millisecond)
+				fmt.Printf("    %-56s %-24s %12s %14d\n", flow.Key, flow.RegisteredDomain, duration, flow.UpBytes+flow.DownBytes)
+			}
+		}
+	})
+	if err != nil {
+		fmt.Println("Error walking the path:", err)
+		os.Exit(1)
+	}
+	if *sketchOver > 0 {
+		err = filepath.WalkDir(*basePath, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !isCaptureFile(path) || covered[absolutePath(path)] {
+				return err
+			}
+			if info, err := d.Info(); err != nil || info.Size() < *sketchOver {
+				return nil
+			}
+			sketch, err := sketchCapture(context.Background(), path, sketchOpts)
+			if err != nil {
+				fmt.Println(err)
+			} else if printSketch(sketch, &query, *listFlows) {
+				captures++
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println("Error walking the path:", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("%d captures matched\n", captures)
+}
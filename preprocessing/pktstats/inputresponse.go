@@ -0,0 +1,161 @@
+package pktstats
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// inputEventGap is the least time without input packets before the one starting an input event
+	inputEventGap = 50 * time.Millisecond
+	// frameGap is the largest gap between the downstream packets of one frame
+	frameGap = 2 * time.Millisecond
+	// keyframeFactor is the least size of an enlarged frame, in mean frame sizes of the flow so far
+	keyframeFactor = 2
+	// keyframeWarmup is the number of frames a flow needs before enlarged ones are detected
+	keyframeWarmup = 10
+	// inputResponseWindow is the longest delay from an input event to the enlarged frame answering it
+	inputResponseWindow = 500 * time.Millisecond
+	// inputResponseMinEvents is the number of answered input events needed to report a session's delays
+	inputResponseMinEvents = 10
+	// maxResponseEvents caps the input events and enlarged frames kept per flow
+	maxResponseEvents = 10000
+)
+
+// InputResponse is the delay from the input events of a session to the next
+// enlarged downstream frame, a proxy of its input-to-frame latency. An input
+// event is a burst of upstream input packets after at least inputEventGap
+// without any, an enlarged frame one of at least keyframeFactor times the
+// mean frame size of its flow.
+type InputResponse struct {
+	SessionID int     `json:"sessionID"`
+	Events    int     `json:"events"` // input events answered within inputResponseWindow
+	P50Millis float64 `json:"p50Millis"`
+	P95Millis float64 `json:"p95Millis"`
+}
+
+// responseState records the timestamps of the input events and enlarged
+// frames of a UDP flow, with Options.InputBand.
+type responseState struct {
+	eventGap  int64 // inputEventGap in the output precision, 0 if disabled
+	frameGap  int64
+	maxSize   int // largest input payload, Options.InputMaxSize
+	lastInput int64
+	hasInput  bool
+	events    []int64
+	// the current frame and the mean size of the frames so far
+	frameFirst, frameLast int64
+	frameBytes            int64
+	frames                int
+	meanBytes             float64
+	keyframes             []int64
+}
+
+func (state *responseState) observe(packet *Packet) {
+	if packet.PayloadSize == 0 {
+		return
+	}
+	if packet.Upstream {
+		if packet.PayloadSize > state.maxSize {
+			return
+		}
+		if (!state.hasInput || packet.Timestamp-state.lastInput >= state.eventGap) && len(state.events) < maxResponseEvents {
+			state.events = append(state.events, packet.Timestamp)
+		}
+		state.lastInput, state.hasInput = packet.Timestamp, true
+		return
+	}
+	if state.frameBytes > 0 && packet.Timestamp-state.frameLast <= state.frameGap {
+		state.frameLast = packet.Timestamp
+		state.frameBytes += int64(packet.PayloadSize)
+		return
+	}
+	state.endFrame()
+	state.frameFirst, state.frameLast = packet.Timestamp, packet.Timestamp
+	state.frameBytes = int64(packet.PayloadSize)
+}
+
+// endFrame closes the current frame, recording it if it is enlarged.
+func (state *responseState) endFrame() {
+	if state.frameBytes == 0 {
+		return
+	}
+	if state.frames >= keyframeWarmup && float64(state.frameBytes) >= keyframeFactor*state.meanBytes && len(state.keyframes) < maxResponseEvents {
+		state.keyframes = append(state.keyframes, state.frameFirst)
+	}
+	state.frames++
+	state.meanBytes += (float64(state.frameBytes) - state.meanBytes) / float64(state.frames)
+	state.frameBytes = 0
+}
+
+// measureInputResponses returns the InputResponse of each session, after
+// linkSessions: the enlarged frames of its media flows answering the events of
+// its input flows, the flows tagged as input of the same local client and
+// service that overlap the session, media flows tagged as input included.
+// Sessions without input flows, or with fewer than inputResponseMinEvents
+// answered events, are left out rather than reported from noise.
+func measureInputResponses(flowMap map[string]*Flow, opts Options) []InputResponse {
+	minDuration := opts.duration(opts.SessionMinDuration)
+	type session struct {
+		client, service string
+		first, last     int64
+		keyframes       []int64
+		events          []int64
+	}
+	sessions := make(map[int]*session)
+	var ids []int
+	for _, flow := range flowMap {
+		if flow.SessionID == 0 || flow.response.eventGap == 0 {
+			continue
+		}
+		s, ok := sessions[flow.SessionID]
+		if !ok {
+			s = &session{client: flow.LocalIP + "/" + flow.Subscriber, service: flow.sessionService(minDuration), first: flow.download.first}
+			sessions[flow.SessionID] = s
+			ids = append(ids, flow.SessionID)
+		}
+		flow.response.endFrame()
+		s.first, s.last = min(s.first, flow.download.first), max(s.last, flow.download.last)
+		s.keyframes = append(s.keyframes, flow.response.keyframes...)
+	}
+	for _, flow := range flowMap {
+		if flow.ServiceFlowType != inputRole || flow.response.eventGap == 0 {
+			continue
+		}
+		for _, s := range sessions {
+			if flow.LocalIP+"/"+flow.Subscriber == s.client && flow.RegisteredDomain == s.service &&
+				flow.download.first <= s.last && flow.download.last >= s.first {
+				s.events = append(s.events, flow.response.events...)
+			}
+		}
+	}
+
+	sort.Ints(ids)
+	window := opts.duration(inputResponseWindow)
+	var responses []InputResponse
+	for _, id := range ids {
+		s := sessions[id]
+		sort.Slice(s.keyframes, func(i, j int) bool { return s.keyframes[i] < s.keyframes[j] })
+		var delays []float64
+		for _, event := range s.events {
+			next := sort.Search(len(s.keyframes), func(i int) bool { return s.keyframes[i] > event })
+			if next < len(s.keyframes) && s.keyframes[next]-event <= window {
+				delays = append(delays, float64(opts.microseconds(s.keyframes[next]-event))/1000)
+			}
+		}
+		if len(delays) < inputResponseMinEvents {
+			continue
+		}
+		sort.Float64s(delays)
+		percentile := func(p float64) float64 {
+			return delays[int(p*float64(len(delays)-1))]
+		}
+		responses = append(responses, InputResponse{
+			SessionID: id,
+			Events:    len(delays),
+			P50Millis: percentile(0.5),
+			P95Millis: percentile(0.95),
+		})
+	}
+	return responses
+}
@@ -0,0 +1,315 @@
+package pktstats
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+	"gopkg.in/yaml.v3"
+)
+
+// InputProblem is a problem of a sidecar input: the files read alongside the
+// captures, such as the telemetry list, remote prefixes, CGNAT translation
+// log, reverse DNS cache, geo databases and per-directory override files.
+type InputProblem struct {
+	Path    string
+	Line    int // 0 for problems of the whole file
+	Message string
+}
+
+func (problem InputProblem) String() string {
+	if problem.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", problem.Path, problem.Line, problem.Message)
+	}
+	return fmt.Sprintf("%s: %s", problem.Path, problem.Message)
+}
+
+// checkLines applies check to each entry of a line-based sidecar, skipping
+// blank lines and # comments.
+func checkLines(path, kind string, check func(entry string) error) []InputProblem {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return []InputProblem{{Path: path, Message: err.Error()}}
+	}
+	var problems []InputProblem
+	entries := 0
+	for i, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries++
+		if err := check(line); err != nil {
+			problems = append(problems, InputProblem{Path: path, Line: i + 1, Message: err.Error()})
+		}
+	}
+	if entries == 0 {
+		problems = append(problems, InputProblem{Path: path, Message: "no " + kind})
+	}
+	return problems
+}
+
+// ValidateTelemetryList checks a telemetry blocklist, Options.TelemetryList:
+// one well-formed domain suffix per line.
+func ValidateTelemetryList(path string) []InputProblem {
+	return checkLines(path, "domain suffixes", func(entry string) error {
+		if _, ok := normalizeDNSName(entry); !ok {
+			return fmt.Errorf("invalid domain suffix %q", entry)
+		}
+		return nil
+	})
+}
+
+// ValidateRulesFile checks a rules file, Options.Rules: a JSON array of
+// classifier rules, each valid and with a name of its own.
+func ValidateRulesFile(path string) []InputProblem {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return []InputProblem{{Path: path, Message: err.Error()}}
+	}
+	var rules []ClassifierRule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return []InputProblem{jsonProblem(path, content, err)}
+	}
+	var problems []InputProblem
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		if _, err := compileRule(rule); err != nil {
+			problems = append(problems, InputProblem{Path: path, Message: fmt.Sprintf("rule %d: %v", i+1, err)})
+		} else if names[rule.Name] || rule.Name == keepPortsRule {
+			problems = append(problems, InputProblem{Path: path, Message: fmt.Sprintf("rule %d: name %s is already taken", i+1, rule.Name)})
+		}
+		names[rule.Name] = true
+	}
+	return problems
+}
+
+// ValidateRemotePrefixes checks a file of remote prefixes, the @file of
+// Options.RemotePrefixes: one CIDR prefix or address per line.
+func ValidateRemotePrefixes(path string) []InputProblem {
+	return checkLines(path, "remote prefixes", func(entry string) error {
+		_, err := parseRemotePrefix(entry)
+		return err
+	})
+}
+
+// ValidateTranslationLog checks a CGNAT translation log, Options.CGNATLog,
+// in the format of loadTranslationLog.
+func ValidateTranslationLog(path string) []InputProblem {
+	file, err := os.Open(path)
+	if err != nil {
+		return []InputProblem{{Path: path, Message: err.Error()}}
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var problems []InputProblem
+	for i := 0; ; i++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// the reader cannot resynchronize after a quoting error
+			return append(problems, InputProblem{Path: path, Line: parseErr.Line, Message: parseErr.Err.Error()})
+		} else if err != nil {
+			return append(problems, InputProblem{Path: path, Message: err.Error()})
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != 5 {
+			problems = append(problems, InputProblem{Path: path, Line: line, Message: fmt.Sprintf("%d fields, expected internal IP, external IP, port range, start and end", len(record))})
+			continue
+		}
+		if i == 0 && net.ParseIP(record[0]) == nil {
+			// header row
+			continue
+		}
+		if _, err := parseTranslation(record); err != nil {
+			problems = append(problems, InputProblem{Path: path, Line: line, Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+// ValidateRDNSCache checks a reverse DNS cache, the rdns_cache.json of a
+// base path or Options.RDNSOffline: an object of IP addresses and their PTR
+// names, empty for addresses without one.
+func ValidateRDNSCache(path string) []InputProblem {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return []InputProblem{{Path: path, Message: err.Error()}}
+	}
+	var cache map[string]string
+	if err := json.Unmarshal(content, &cache); err != nil {
+		return []InputProblem{jsonProblem(path, content, err)}
+	}
+	var problems []InputProblem
+	for _, ip := range sortedKeys(cache) {
+		if net.ParseIP(ip) == nil {
+			problems = append(problems, InputProblem{Path: path, Message: fmt.Sprintf("invalid IP address %q", ip)})
+		} else if name := cache[ip]; name != "" {
+			if _, ok := normalizeDNSName(name); !ok {
+				problems = append(problems, InputProblem{Path: path, Message: fmt.Sprintf("invalid PTR name %q of %s", name, ip)})
+			}
+		}
+	}
+	return problems
+}
+
+// ValidateGeoDatabase checks a MaxMind-format database of Options.GeoASNDB
+// (kind "ASN") or Options.GeoCityDB (kind "City") by its database type, so
+// that databases passed in place of each other are not silently useless.
+func ValidateGeoDatabase(path, kind string) []InputProblem {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return []InputProblem{{Path: path, Message: err.Error()}}
+	}
+	defer reader.Close()
+	databaseType := reader.Metadata.DatabaseType
+	if !strings.Contains(databaseType, kind) && !(kind == "ASN" && strings.Contains(databaseType, "ISP")) {
+		return []InputProblem{{Path: path, Message: fmt.Sprintf("database type %q has no %s records", databaseType, kind)}}
+	}
+	return nil
+}
+
+// ValidateOverrideFile checks a per-directory override file, see
+// overrideFileName: a mapping of the options of overrideKeys, each valid,
+// and the telemetry list it names.
+func ValidateOverrideFile(path string) []InputProblem {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return []InputProblem{{Path: path, Message: err.Error()}}
+	}
+	var settings map[string]string
+	if err := yaml.Unmarshal(content, &settings); err != nil {
+		return yamlProblems(path, err)
+	}
+	var problems []InputProblem
+	for _, key := range sortedKeys(settings) {
+		value := settings[key]
+		switch key {
+		case "localSubnets":
+			_, err = parseLocalSubnets(value)
+		case "keepPorts":
+			_, err = parsePortRanges(value)
+		case "telemetryList":
+			err = nil
+			if value != "" {
+				if !filepath.IsAbs(value) {
+					value = filepath.Join(filepath.Dir(path), value)
+				}
+				problems = append(problems, ValidateTelemetryList(value)...)
+			}
+		default:
+			err = fmt.Errorf("%q cannot be set per directory, only %s", key, strings.Join(sortedKeys(overrideKeys), ", "))
+		}
+		if err != nil {
+			problems = append(problems, InputProblem{Path: path, Message: fmt.Sprintf("%s: %v", key, err)})
+		}
+	}
+	return problems
+}
+
+// jsonProblem locates a decoding error of a JSON sidecar.
+func jsonProblem(path string, content []byte, err error) InputProblem {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		offset = syntaxErr.Offset
+	} else if errors.As(err, &typeErr) {
+		offset = typeErr.Offset
+	} else {
+		return InputProblem{Path: path, Message: err.Error()}
+	}
+	line := bytes.Count(content[:min(offset, int64(len(content)))], []byte("\n")) + 1
+	return InputProblem{Path: path, Line: line, Message: err.Error()}
+}
+
+// yamlLine matches a decoding error of yaml.v3 located on a line.
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlProblems locates the decoding errors of a YAML sidecar: the syntax
+// error, or each value that does not decode.
+func yamlProblems(path string, err error) []InputProblem {
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+	var problems []InputProblem
+	for _, message := range messages {
+		problem := InputProblem{Path: path, Message: message}
+		if match := yamlLine.FindStringSubmatch(message); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Message = match[2]
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// CheckInputs validates all sidecar inputs of a run at once, before any
+// capture is read: those of the options and the override files of the
+// directories under basePath, or of the -f capture's directory.
+func CheckInputs(basePath string, opts Options) []InputProblem {
+	var problems []InputProblem
+	if opts.TelemetryList != "" {
+		problems = append(problems, ValidateTelemetryList(opts.TelemetryList)...)
+	}
+	if opts.Rules != "" {
+		problems = append(problems, ValidateRulesFile(opts.Rules)...)
+	}
+	if path, ok := strings.CutPrefix(opts.RemotePrefixes, "@"); ok {
+		problems = append(problems, ValidateRemotePrefixes(path)...)
+	}
+	if opts.CGNATLog != "" {
+		problems = append(problems, ValidateTranslationLog(opts.CGNATLog)...)
+	}
+	if opts.RDNSOffline != "" {
+		problems = append(problems, ValidateRDNSCache(opts.RDNSOffline)...)
+	} else if cachePath := filepath.Join(basePath, "rdns_cache.json"); opts.RDNS && fileExists(cachePath) {
+		problems = append(problems, ValidateRDNSCache(cachePath)...)
+	}
+	if opts.GeoASNDB != "" {
+		problems = append(problems, ValidateGeoDatabase(opts.GeoASNDB, "ASN")...)
+	}
+	if opts.GeoCityDB != "" {
+		problems = append(problems, ValidateGeoDatabase(opts.GeoCityDB, "City")...)
+	}
+
+	var overrideFiles []string
+	if opts.File != "" && opts.File != "-" {
+		if path := filepath.Join(filepath.Dir(opts.File), overrideFileName); fileExists(path) {
+			overrideFiles = append(overrideFiles, path)
+		}
+	} else if opts.InputList == "" {
+		filepath.WalkDir(basePath, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() && entry.Name() == overrideFileName {
+				overrideFiles = append(overrideFiles, path)
+			}
+			return nil
+		})
+	}
+	for _, path := range overrideFiles {
+		problems = append(problems, ValidateOverrideFile(path)...)
+	}
+	return problems
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,196 @@
+package pktstats
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sidecarCase is the content of a sidecar input and its expected problems,
+// each "<line>: <start of the message>", line 0 for the whole file.
+type sidecarCase struct {
+	name    string
+	content string
+	want    []string
+}
+
+// testSidecar runs validate on each case written to a file named file.
+func testSidecar(t *testing.T, file string, validate func(path string) []InputProblem, tests []sidecarCase) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), file)
+			if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, problem := range validate(path) {
+				got = append(got, fmt.Sprintf("%d: %s", problem.Line, problem.Message))
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got problems %q, want %q", got, test.want)
+			}
+			for i := range got {
+				if !strings.HasPrefix(got[i], test.want[i]) {
+					t.Errorf("got problem %q, want %q", got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateTelemetryList(t *testing.T) {
+	testSidecar(t, "telemetry.txt", ValidateTelemetryList, []sidecarCase{
+		{"valid", "# ads\ndoubleclick.net\n\nTelemetry.Example.com.\n", nil},
+		{"invalid suffixes", "ads.example.com\nads..example.com\nbad name.com\n", []string{`2: invalid domain suffix "ads..example.com"`, `3: invalid domain suffix "bad name.com"`}},
+		{"only comments", "# nothing yet\n\n", []string{"0: no domain suffixes"}},
+	})
+}
+
+func TestValidateRulesFile(t *testing.T) {
+	testSidecar(t, "rules.json", ValidateRulesFile, []sidecarCase{
+		{"valid", `[{"name": "stun", "protocol": "udp", "remotePorts": "3478-3481", "keep": true},
+			{"name": "xbox", "dns": ["*.xboxlive.com"], "label": "xboxlive.com", "priority": 2}]`, nil},
+		{"empty", `[]`, nil},
+		{"syntax error", "[\n{\"name\": \"stun\",\n}]", []string{"3: invalid character '}'"}},
+		{"wrong type", "[\n{\"name\": \"stun\", \"keep\": \"yes\"}]", []string{"2: json: cannot unmarshal string"}},
+		{"invalid rules", `[{"name": "a", "keep": true, "protocol": "icmp"},
+			{"name": "b", "label": "x", "localPorts": "70000"},
+			{"name": "c", "keep": true, "direction": "inbound"},
+			{"name": "d", "keep": true, "transportProfile": "sctp"},
+			{"name": "e", "keep": true, "dns": ["[a-"]},
+			{"name": "f"},
+			{"keep": true}]`, []string{
+			`0: rule 1: rule a: unknown protocol "icmp"`,
+			"0: rule 2: rule b: local ports:",
+			`0: rule 3: rule c: unknown direction "inbound"`,
+			`0: rule 4: rule d: unknown transport profile "sctp"`,
+			`0: rule 5: rule e: invalid DNS pattern "[a-"`,
+			"0: rule 6: rule f neither keeps nor labels flows",
+			"0: rule 7: rule without a name",
+		}},
+		{"taken names", `[{"name": "a", "keep": true}, {"name": "a", "label": "x"}, {"name": "` + keepPortsRule + `", "keep": true}]`, []string{
+			"0: rule 2: name a is already taken",
+			"0: rule 3: name " + keepPortsRule + " is already taken",
+		}},
+	})
+}
+
+func TestValidateRemotePrefixes(t *testing.T) {
+	testSidecar(t, "prefixes.txt", ValidateRemotePrefixes, []sidecarCase{
+		{"valid", "# game servers\n203.0.113.0/24\n198.51.100.7\n2001:db8::/32\n", nil},
+		{"invalid prefixes", "203.0.113.0/24\n203.0.113.0/33\nexample.com\n", []string{`2: invalid remote prefix "203.0.113.0/33"`, `3: invalid remote prefix "example.com"`}},
+		{"empty", "", []string{"0: no remote prefixes"}},
+	})
+}
+
+func TestValidateTranslationLog(t *testing.T) {
+	testSidecar(t, "cgnat.csv", ValidateTranslationLog, []sidecarCase{
+		{"valid with header", "internal,external,ports,start,end\n100.64.0.2,198.51.100.1,1024-2047,2024-03-01T12:00:00Z,2024-03-01T13:00:00Z\n100.64.0.3, 198.51.100.1, 2048, 1709294400, 1709298000.5\n", nil},
+		{"invalid records", strings.Join([]string{
+			"100.64.0.2,198.51.100.1,1024-2047,1709294400,1709298000",
+			"100.64.0.2,host,1024-2047,1709294400,1709298000",
+			"100.64.0.2,198.51.100.1,2047-1024,1709294400,1709298000",
+			"100.64.0.2,198.51.100.1,1024-70000,1709294400,1709298000",
+			"100.64.0.2,198.51.100.1,1024,yesterday,1709298000",
+			"100.64.0.2,198.51.100.1,1024,1709294400,2024-03-01",
+			"100.64.0.2,198.51.100.1,1024,1709298000,1709294400",
+			"100.64.0.2,198.51.100.1,1024",
+		}, "\n"), []string{
+			"2: invalid IP address",
+			`3: invalid port range "2047-1024"`,
+			`4: invalid port range "1024-70000"`,
+			`5: invalid start time "yesterday"`,
+			`6: invalid end time "2024-03-01"`,
+			"7: end time 1709294400 before start time 1709298000",
+			"8: 3 fields, expected internal IP, external IP, port range, start and end",
+		}},
+		{"quoting error", "100.64.0.2,198.51.100.1,1024,1709294400,1709298000\n100.64.0.2,\"198.51.100.1,1024\n", []string{"2: extraneous or missing \" in quoted-field"}},
+	})
+}
+
+func TestValidateRDNSCache(t *testing.T) {
+	testSidecar(t, "rdns_cache.json", ValidateRDNSCache, []sidecarCase{
+		{"valid", `{"203.0.113.10": "edge1.example.com.", "2001:db8::1": "", "198.51.100.7": "host.example.net"}`, nil},
+		{"invalid entries", `{"203.0.113.10": "bad..example.com", "example.com": "x.example.com"}`, []string{
+			`0: invalid PTR name "bad..example.com" of 203.0.113.10`,
+			`0: invalid IP address "example.com"`,
+		}},
+		{"not an object", "{\n\"203.0.113.10\": [\"a\"]}", []string{"2: json: cannot unmarshal array"}},
+	})
+}
+
+func TestValidateGeoDatabase(t *testing.T) {
+	for _, kind := range []string{"ASN", "City"} {
+		testSidecar(t, "geo.mmdb", func(path string) []InputProblem { return ValidateGeoDatabase(path, kind) }, []sidecarCase{
+			{"not a database " + kind, "ASN,City\n", []string{"0: error opening database: invalid MaxMind DB file"}},
+		})
+	}
+}
+
+func TestValidateOverrideFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "telemetry.txt"), []byte("bad..example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testSidecar(t, overrideFileName, ValidateOverrideFile, []sidecarCase{
+		{"valid", "# site B\nlocalSubnets: 10.20.0.0/16\nkeepPorts: 3074,49000-49100\n", nil},
+		{"single port", "keepPorts: 3074\n", nil},
+		{"empty", "# nothing overridden yet\n", nil},
+		{"invalid values", "localSubnets: 10.20.0.0/33\nkeepPorts: 3074-\nformat: csv\n", []string{
+			`0: format: "format" cannot be set per directory, only keepPorts, localSubnets, telemetryList`,
+			"0: keepPorts:",
+			"0: localSubnets:",
+		}},
+		// reported in the telemetry list
+		{"telemetry list", "telemetryList: " + filepath.Join(dir, "telemetry.txt") + "\n", []string{`1: invalid domain suffix "bad..example.com"`}},
+		{"syntax error", "keepPorts: 3074\nlocalSubnets: 10.20.0.0/16: x\n", []string{"2: mapping values are not allowed in this context"}},
+		{"wrong types", "keepPorts: 3074\nlocalSubnets:\n  - 10.20.0.0/16\ntelemetryList: {a: b}\n", []string{
+			"3: cannot unmarshal !!seq into string",
+			"4: cannot unmarshal !!map into string",
+		}},
+		{"not a mapping", "- keepPorts: 3074\n", []string{"1: cannot unmarshal !!seq into map[string]string"}},
+	})
+}
+
+// TestCheckInputs reports the problems of all sidecar inputs of a run at once.
+func TestCheckInputs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	opts := testOptions()
+	opts.TelemetryList = write("telemetry.txt", "ads..example.com\n")
+	opts.RemotePrefixes = "@" + write("prefixes.txt", "203.0.113.0/24\n")
+	opts.RDNS = true
+	write("rdns_cache.json", `{"host": "x.example.com"}`)
+	write("site/"+overrideFileName, "keepPorts: x\n")
+	write("site/other/"+overrideFileName, "")
+
+	var got []string
+	for _, problem := range CheckInputs(dir, opts) {
+		got = append(got, strings.TrimPrefix(problem.String(), dir+string(filepath.Separator)))
+	}
+	want := []string{
+		`telemetry.txt:1: invalid domain suffix "ads..example.com"`,
+		`rdns_cache.json: invalid IP address "host"`,
+		filepath.Join("site", overrideFileName) + ": keepPorts:",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got problems %q, want %q", got, want)
+	}
+	for i := range got {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("got problem %q, want %q", got[i], want[i])
+		}
+	}
+}
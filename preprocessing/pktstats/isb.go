@@ -0,0 +1,117 @@
+package pktstats
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// pcapng block types, name resolution record types and interface statistics option codes
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterfaceStats = 0x00000005
+	pcapngNameResolution = 0x00000004
+	pcapngPacket         = 0x00000002 // obsolete packet block
+	pcapngSimplePacket   = 0x00000003
+	pcapngEnhancedPacket = 0x00000006
+	pcapngNRBIPv4        = 1
+	pcapngNRBIPv6        = 2
+	pcapngIfDropOption   = 5
+	pcapngMaxTrailBlocks = 256
+)
+
+// readKernelDrops returns the packets dropped by the capture interfaces, as
+// recorded in the isb_ifdrop option of the pcapng interface statistics blocks
+// that capture tools write after the last packet. Blocks are walked backwards
+// from the end of the file using their trailing length fields, so the packet
+// data is not read again. ok is false when the file has no such statistics.
+func readKernelDrops(filePath string) (drops int64, ok bool, err error) {
+	if filePath == stdinInput || isRemoteInput(filePath) {
+		return 0, false, nil // a stream cannot be read backwards
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	// the section header tells the byte order of the file
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return 0, false, err
+	}
+	order, ok := pcapngByteOrder(header)
+	if !ok {
+		return 0, false, nil // not a pcapng file
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	end := info.Size()
+	perInterface := make(map[uint32]int64)
+	trailer := make([]byte, 4)
+	for i := 0; i < pcapngMaxTrailBlocks && end > 12; i++ {
+		if _, err := file.ReadAt(trailer, end-4); err != nil {
+			return 0, false, err
+		}
+		length := int64(order.Uint32(trailer))
+		if length < 12 || length > end {
+			return 0, false, errors.New("corrupt pcapng block length")
+		}
+		start := end - length
+		block := make([]byte, length)
+		if _, err := file.ReadAt(block, start); err != nil {
+			return 0, false, err
+		}
+		blockType := order.Uint32(block[0:4])
+		if blockType == pcapngNameResolution {
+			end = start
+			continue
+		}
+		if blockType != pcapngInterfaceStats {
+			break
+		}
+		// walking backwards, the first statistics seen per interface are the latest
+		ifaceID := order.Uint32(block[8:12])
+		if _, seen := perInterface[ifaceID]; !seen {
+			if ifDrop, found := isbIfDrop(block[20:length-4], order); found {
+				perInterface[ifaceID] = ifDrop
+			}
+		}
+		end = start
+	}
+	for _, ifDrop := range perInterface {
+		drops += ifDrop
+	}
+	return drops, len(perInterface) > 0, nil
+}
+
+// pcapngByteOrder returns the byte order of a pcapng file from the first 12
+// bytes of its section header, ok is false if the file is not pcapng.
+func pcapngByteOrder(header []byte) (order binary.ByteOrder, ok bool) {
+	order = binary.LittleEndian
+	if binary.BigEndian.Uint32(header[8:12]) == 0x1a2b3c4d {
+		order = binary.BigEndian
+	}
+	return order, order.Uint32(header[0:4]) == pcapngSectionHeader
+}
+
+// isbIfDrop looks up the isb_ifdrop option in the options of a statistics block.
+func isbIfDrop(options []byte, order binary.ByteOrder) (int64, bool) {
+	for len(options) >= 4 {
+		code := order.Uint16(options[0:2])
+		length := int(order.Uint16(options[2:4]))
+		if code == 0 || 4+length > len(options) {
+			break
+		}
+		if code == pcapngIfDropOption && length == 8 {
+			return int64(order.Uint64(options[4:12])), true
+		}
+		// option values are padded to 32 bits
+		options = options[4+(length+3)/4*4:]
+	}
+	return 0, false
+}
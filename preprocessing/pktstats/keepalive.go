@@ -0,0 +1,141 @@
+package pktstats
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// keepaliveMinIntervals is the number of intervals between keepalives needed to detect the regime
+	keepaliveMinIntervals = 3
+	// keepaliveMaxVariation is the largest coefficient of variation of the intervals of a keepalive regime
+	keepaliveMaxVariation = 0.2
+)
+
+// Keepalive describes the end of a flow where only small packets are sent at
+// a near-constant period, e.g. the keepalives of a game client long after the
+// session ended.
+type Keepalive struct {
+	PeriodMillis        float64 `json:"periodMillis"`        // mean interval between keepalives
+	Packets             int     `json:"packets"`             // packets of the regime, in both directions
+	OnlyDurationMicros  int64   `json:"onlyDurationMicros"`  // from the last non-keepalive packet to the end of the flow
+	LastActiveTimestamp int64   `json:"lastActiveTimestamp"` // last non-keepalive packet, the flow's first if none; its end with Options.TrimKeepalive
+}
+
+// intervalStats tracks the mean and variance of the intervals between the
+// packets of one direction (Welford's algorithm).
+type intervalStats struct {
+	last     int64
+	hasLast  bool
+	count    int
+	mean, m2 float64
+}
+
+func (stats *intervalStats) add(timestamp int64) {
+	if stats.hasLast {
+		interval := float64(timestamp - stats.last)
+		stats.count++
+		delta := interval - stats.mean
+		stats.mean += delta / float64(stats.count)
+		stats.m2 += delta * (interval - stats.mean)
+	}
+	stats.hasLast = true
+	stats.last = timestamp
+}
+
+// regular reports whether the intervals are numerous and regular enough for a
+// keepalive regime, with a mean of at least minPeriod.
+func (stats *intervalStats) regular(minPeriod int64) bool {
+	if stats.count < keepaliveMinIntervals || stats.mean < float64(minPeriod) || stats.mean <= 0 {
+		return false
+	}
+	return math.Sqrt(stats.m2/float64(stats.count))/stats.mean <= keepaliveMaxVariation
+}
+
+// keepaliveState follows the packets of a flow since its last packet with a
+// payload above maxPayload, in constant memory.
+type keepaliveState struct {
+	maxPayload int   // largest keepalive payload, 0 if disabled
+	minPeriod  int64 // shortest keepalive period in the output precision
+	lastActive int64
+	active     bool // whether a packet above maxPayload was seen
+	packets    int
+	up, down   intervalStats
+}
+
+func (state *keepaliveState) observe(packet *Packet) {
+	if packet.PayloadSize > state.maxPayload {
+		state.lastActive, state.active = packet.Timestamp, true
+		state.packets = 0
+		state.up, state.down = intervalStats{}, intervalStats{}
+		return
+	}
+	state.packets++
+	if packet.Upstream {
+		state.up.add(packet.Timestamp)
+	} else {
+		state.down.add(packet.Timestamp)
+	}
+}
+
+// measureKeepalive stores the Keepalive of flows ending in a keepalive
+// regime: the small packets since the last larger one are regular in one
+// direction at least, at a period of at least Options.KeepaliveMinPeriod.
+// The period bound keeps low-bitrate audio, whose small packets are tens of
+// milliseconds apart, from being taken for keepalives. With
+// Options.TrimKeepalive, the flow then ends at its last non-keepalive packet
+// for everything derived from its end, e.g. media sessions and its outcome.
+func (flow *Flow) measureKeepalive(opts Options) {
+	state := &flow.keepalive
+	if state.maxPayload == 0 {
+		return
+	}
+	// keepalives may be sent by either side, answered or not
+	var stats *intervalStats
+	for _, candidate := range []*intervalStats{&state.up, &state.down} {
+		if candidate.regular(state.minPeriod) && (stats == nil || candidate.count > stats.count) {
+			stats = candidate
+		}
+	}
+	if stats == nil {
+		return
+	}
+	lastActive := state.lastActive
+	if !state.active {
+		lastActive = flow.download.first
+	}
+	flow.Keepalive = &Keepalive{
+		PeriodMillis:        stats.mean * float64(opts.timestampUnit()) / float64(time.Millisecond),
+		Packets:             state.packets,
+		OnlyDurationMicros:  opts.microseconds(flow.download.last - lastActive),
+		LastActiveTimestamp: lastActive,
+	}
+	if opts.TrimKeepalive {
+		flow.download.last = lastActive
+	}
+}
+
+// idleConnectionClass is the TrafficClass of TCP flows to a known service
+// that only carried keepalives, e.g. the push connections of a platform.
+const idleConnectionClass = "idle-connection"
+
+// classifyIdleConnections gives the TCP flows of flowMap to a known service
+// whose whole lifetime is a keepalive regime, without any packet above
+// Options.KeepaliveMaxPayload, idleConnectionClass, once their labels are
+// final. Flows are only classified after their last packet, with their
+// Keepalive, so a flow that starts idle and later carries data is not.
+// @return the keys of the idle connections
+func classifyIdleConnections(flowMap map[string]*Flow) []string {
+	var idle []string
+	for key, flow := range flowMap {
+		if flow.Protocol != 6 || flow.Keepalive == nil || flow.keepalive.active || flow.RegisteredDomain == "" || flow.TrafficClass == racedLoserClass ||
+			flow.ServiceFlowType == telemetryRole || flow.ServiceFlowType == managementRole {
+			continue
+		}
+		flow.TrafficClass = idleConnectionClass
+		idle = append(idle, key)
+	}
+	sort.Strings(idle)
+	return idle
+}
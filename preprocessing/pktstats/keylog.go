@@ -0,0 +1,280 @@
+package pktstats
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// negotiationMaxEvents bounds the NegotiationEvents of a flow; decryption
+// stops once they are reached.
+const negotiationMaxEvents = 1000
+
+// negotiationMaxScans bounds the JSON values tried per decrypted message
+// for Options.NegotiationPaths.
+const negotiationMaxScans = 16
+
+// keyLogSecrets are the secrets of a TLS connection in a key log, by the
+// client random of its ClientHello.
+type keyLogSecrets struct {
+	masterSecret  []byte // TLS 1.2, CLIENT_RANDOM
+	clientTraffic []byte // TLS 1.3 and QUIC, CLIENT_TRAFFIC_SECRET_0
+	serverTraffic []byte // TLS 1.3 and QUIC, SERVER_TRAFFIC_SECRET_0
+}
+
+// keyLog is an SSLKEYLOGFILE, Options.KeyLog, by client random.
+type keyLog map[[32]byte]*keyLogSecrets
+
+// readKeyLog reads a key log in the NSS format written by browsers and TLS
+// libraries with SSLKEYLOGFILE: one "<label> <client random> <secret>" line
+// per secret, in hex. Handshake secrets and other labels are not needed.
+func readKeyLog(path string) (keyLog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys := make(keyLog)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected <label> <client random> <secret>", line)
+		}
+		random, err := hex.DecodeString(fields[1])
+		if err != nil || len(random) != 32 {
+			return nil, fmt.Errorf("line %d: invalid client random", line)
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid secret", line)
+		}
+		entry := keys[[32]byte(random)]
+		if entry == nil {
+			entry = &keyLogSecrets{}
+		}
+		switch fields[0] {
+		case "CLIENT_RANDOM":
+			entry.masterSecret = secret
+		case "CLIENT_TRAFFIC_SECRET_0":
+			entry.clientTraffic = secret
+		case "SERVER_TRAFFIC_SECRET_0":
+			entry.serverTraffic = secret
+		default:
+			continue
+		}
+		keys[[32]byte(random)] = entry
+	}
+	return keys, scanner.Err()
+}
+
+// lookup returns the secrets of a client random, nil if the key log has none.
+func (keys keyLog) lookup(random []byte) *keyLogSecrets {
+	if len(random) != 32 {
+		return nil
+	}
+	return keys[[32]byte(random)]
+}
+
+// Negotiation is a message decrypted from a flow with the keys of
+// Options.KeyLog: a TLS record of a TCP flow or a STREAM or DATAGRAM frame
+// of a QUIC flow.
+type Negotiation struct {
+	Timestamp   int64  `json:"timestamp"` // of the packet completing the message
+	FromClient  bool   `json:"fromClient"`
+	ContentType string `json:"contentType"`      // TLS: application_data, handshake or alert; QUIC: stream or datagram
+	Stream      *int64 `json:"stream,omitempty"` // QUIC stream ID
+	Size        int    `json:"size"`             // plaintext bytes
+	// values of the JSON fields matched by Options.NegotiationPaths, by path,
+	// with Options.ExtractPayloads
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+// parseNegotiationPaths parses comma-separated dot-separated paths of JSON
+// fields, e.g. "video.resolution,codec".
+func parseNegotiationPaths(text string) ([]string, error) {
+	var paths []string
+	for _, path := range strings.Split(text, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		for _, key := range strings.Split(path, ".") {
+			if key == "" {
+				return nil, fmt.Errorf("empty key in path %q", path)
+			}
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// decryptState decrypts the messages of a TCP or UDP flow whose client
+// random is in the key log. Flows without a ClientHello, or whose keys are
+// not in the log, are left alone.
+type decryptState struct {
+	keys  keyLog
+	paths []string // JSON fields extracted from the messages, nil without Options.ExtractPayloads
+	done  bool
+	tls   *tlsSession
+	quic  *quicSession
+	// events are the flow's NegotiationEvents
+	events []Negotiation
+}
+
+// newDecryptState returns the decryption state of a flow, nil without a
+// key log.
+func newDecryptState(keys keyLog, paths []string) *decryptState {
+	if keys == nil {
+		return nil
+	}
+	return &decryptState{keys: keys, paths: paths}
+}
+
+// observeTCP decrypts the TLS records completed by a TCP segment.
+func (state *decryptState) observeTCP(packet *Packet, seq uint32, payload []byte) {
+	if state.done || len(payload) == 0 {
+		return
+	}
+	if state.tls == nil {
+		state.tls = newTLSSession()
+	}
+	if !state.tls.observe(state, packet, seq, payload) {
+		state.stop()
+	}
+}
+
+// observeUDP decrypts the QUIC packets of a UDP datagram.
+func (state *decryptState) observeUDP(packet *Packet, payload []byte) {
+	if state.done || len(payload) == 0 {
+		return
+	}
+	if state.quic == nil {
+		if !isQUICInitial(payload) {
+			// not QUIC, or captured after its handshake
+			state.stop()
+			return
+		}
+		state.quic = newQUICSession()
+	}
+	if !state.quic.observe(state, packet, payload) {
+		state.stop()
+	}
+}
+
+// stop ends the decryption of a flow, releasing its buffers.
+func (state *decryptState) stop() {
+	state.done, state.tls, state.quic = true, nil, nil
+}
+
+// record adds a decrypted message to the flow's events, with the fields of
+// state.paths found in its JSON values.
+func (state *decryptState) record(packet *Packet, fromClient bool, contentType string, stream *int64, plaintext []byte) {
+	if len(state.events) >= negotiationMaxEvents {
+		state.done = true
+		return
+	}
+	event := Negotiation{Timestamp: packet.Timestamp, FromClient: fromClient, ContentType: contentType, Stream: stream, Size: len(plaintext)}
+	if len(state.paths) > 0 {
+		event.Fields = extractJSONFields(plaintext, state.paths)
+	}
+	state.events = append(state.events, event)
+}
+
+// extractJSONFields looks for JSON objects in a message, e.g. the body of an
+// HTTP request or a WebSocket frame, and returns the first value found for
+// each path, nil if none was.
+func extractJSONFields(message []byte, paths []string) map[string]any {
+	var fields map[string]any
+	for scans := 0; scans < negotiationMaxScans && len(fields) < len(paths); scans++ {
+		start := bytes.IndexByte(message, '{')
+		if start < 0 {
+			break
+		}
+		decoder := json.NewDecoder(bytes.NewReader(message[start:]))
+		decoder.UseNumber()
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			message = message[start+1:]
+			continue
+		}
+		message = message[start+int(decoder.InputOffset()):]
+		for _, path := range paths {
+			if _, found := fields[path]; found {
+				continue
+			}
+			if field, ok := lookupJSONPath(value, strings.Split(path, ".")); ok {
+				if fields == nil {
+					fields = make(map[string]any)
+				}
+				fields[path] = field
+			}
+		}
+	}
+	return fields
+}
+
+// lookupJSONPath returns the value at a path of object keys, applying the
+// rest of the path to each element of the arrays on the way.
+func lookupJSONPath(value any, path []string) (any, bool) {
+	if len(path) == 0 {
+		return value, true
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		if child, ok := value[path[0]]; ok {
+			return lookupJSONPath(child, path[1:])
+		}
+	case []any:
+		for _, element := range value {
+			if field, ok := lookupJSONPath(element, path); ok {
+				return field, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3, also used by QUIC.
+func hkdfExpandLabel(newHash func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0) // empty context
+	out := make([]byte, length)
+	if _, err := hkdf.Expand(newHash, secret, info).Read(out); err != nil {
+		return nil
+	}
+	return out
+}
+
+// tls12PRF is the P_hash pseudorandom function of TLS 1.2.
+func tls12PRF(newHash func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	out := make([]byte, 0, length)
+	mac := hmac.New(newHash, secret)
+	a := seed
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
@@ -0,0 +1,89 @@
+package pktstats
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadKeyLog(t *testing.T) {
+	random := strings.Repeat("ab", 32)
+	other := strings.Repeat("cd", 32)
+	tests := []struct {
+		name    string
+		content string
+		err     string // error wanted, empty for none
+	}{
+		{"valid", "# comment\n\nCLIENT_RANDOM " + random + " 0102\n" +
+			"CLIENT_HANDSHAKE_TRAFFIC_SECRET " + other + " 0304\n" +
+			"CLIENT_TRAFFIC_SECRET_0 " + other + " 0506\n  SERVER_TRAFFIC_SECRET_0 " + other + " 0708  \n", ""},
+		{"missing secret", "CLIENT_RANDOM " + random + "\n", "line 1: expected <label> <client random> <secret>"},
+		{"extra field", "# comment\nCLIENT_RANDOM " + random + " 0102 0304\n", "line 2: expected <label> <client random> <secret>"},
+		{"client random not hex", "CLIENT_RANDOM " + strings.Repeat("zz", 32) + " 0102\n", "line 1: invalid client random"},
+		{"short client random", "CLIENT_RANDOM " + random[2:] + " 0102\n", "line 1: invalid client random"},
+		{"secret not hex", "CLIENT_RANDOM " + random + " 0g\n", "line 1: invalid secret"},
+		{"odd secret", "CLIENT_RANDOM " + random + " 012\n", "line 1: invalid secret"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "keys.log")
+		if err := os.WriteFile(path, []byte(test.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := readKeyLog(path)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(keys) != 2 {
+			t.Errorf("%s: %d client randoms, want 2", test.name, len(keys))
+		}
+		tls12 := keys.lookup(unhex(t, random))
+		if tls12 == nil || !bytes.Equal(tls12.masterSecret, []byte{1, 2}) || tls12.clientTraffic != nil {
+			t.Errorf("%s: TLS 1.2 secrets %+v", test.name, tls12)
+		}
+		// the handshake secret is not kept
+		tls13 := keys.lookup(unhex(t, other))
+		if tls13 == nil || tls13.masterSecret != nil || !bytes.Equal(tls13.clientTraffic, []byte{5, 6}) || !bytes.Equal(tls13.serverTraffic, []byte{7, 8}) {
+			t.Errorf("%s: TLS 1.3 secrets %+v", test.name, tls13)
+		}
+	}
+	if _, err := readKeyLog(filepath.Join(t.TempDir(), "missing.log")); err == nil {
+		t.Error("missing key log read")
+	}
+	if secrets := keyLog(nil).lookup([]byte{1, 2, 3}); secrets != nil {
+		t.Errorf("secrets %+v of a short client random", secrets)
+	}
+}
+
+// TestTLS12PRF checks the P_SHA256 of TLS 1.2 against the published test
+// vector of the IETF TLS working group.
+func TestTLS12PRF(t *testing.T) {
+	out := tls12PRF(sha256.New, unhex(t, "9bbe436ba940f017b17652849a71db35"), "test label", unhex(t, "a0ba9f936cda311827a6f796ffd5198c"), 100)
+	want := unhex(t, `
+		e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a
+		6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab
+		4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701
+		87347b66
+	`)
+	if !bytes.Equal(out, want) {
+		t.Errorf("PRF %x, want %x", out, want)
+	}
+}
+
+func TestExtractJSONFields(t *testing.T) {
+	message := []byte(`POST /session HTTP/1.1\r\n\r\n{"video": {"codec": "h265", "streams": [{"fps": 60}]}} {"bitrate": 20000} {broken`)
+	fields := extractJSONFields(message, []string{"video.codec", "video.streams.fps", "bitrate", "audio"})
+	if len(fields) != 3 || fields["video.codec"] != "h265" || fmt.Sprint(fields["video.streams.fps"]) != "60" || fmt.Sprint(fields["bitrate"]) != "20000" {
+		t.Errorf("fields %v", fields)
+	}
+}
@@ -0,0 +1,62 @@
+package pktstats
+
+// schemaVersion is the version of the output schema, recorded in the meta
+// block. Version 2 separates ServiceFlowType from DNSName, version 3 names
+// fields in lowerCamel case (see names.go); outputs without a version predate
+// both.
+const schemaVersion = 3
+
+// Label sources, from most to least reliable.
+const (
+	labelDNS       = "dns"            // captured DNS answer for RemoteIP
+	labelTelemetry = "telemetry-list" // DNS name on the telemetry list
+	labelNRB       = "nrb"            // pcapng name resolution block, see readNameResolution
+	labelInputBand = "input-band"     // upstream periodicity in Options.InputBand
+	labelVoice     = "voice-pacing"   // upstream pacing in Options.VoiceBands, see classifyVoice
+	labelRDNS      = "rdns"           // live PTR lookup, names only
+	labelRDNSCache = "rdns-cache"     // cached PTR lookup, names only
+	labelMgmt      = "mgmt-endpoints" // capture host management traffic, see tagManagement
+	labelRule      = "rule"           // classifier rule of Options.Rules, see ClassifierRule
+	labelSNI       = "sni"            // TLS server name disagreeing with the DNS name, with Options.LabelPrecedence sni
+)
+
+// labelFlow sets the labels of a new flow from its resolved name: DNSName is
+// the hostname, ServiceFlowType the service it belongs to (its registered
+// domain) or the role of telemetry flows.
+func labelFlow(flow *Flow, dnsName string, telemetry domainSuffixes) {
+	flow.DNSName = dnsName
+	flow.RegisteredDomain = registeredDomain(dnsName)
+	switch {
+	case dnsName == "":
+		return
+	case telemetry.matches(dnsName):
+		flow.ServiceFlowType = telemetryRole
+		flow.LabelSource = labelTelemetry
+	default:
+		flow.ServiceFlowType = flow.RegisteredDomain
+		flow.LabelSource = labelDNS
+	}
+	flow.LabelConfidence = 1
+}
+
+// upgradeLabels maps the labels of flows read from outputs older than schema
+// version 2, where ServiceFlowType repeated DNSName, to the current semantics.
+// Roles such as telemetry and input are kept.
+func upgradeLabels(flows map[string]*Flow, version int) {
+	if version >= 2 {
+		return
+	}
+	for _, flow := range flows {
+		if flow.DNSName == "" || flow.ServiceFlowType != flow.DNSName {
+			continue
+		}
+		if flow.RegisteredDomain == "" {
+			flow.RegisteredDomain = registeredDomain(flow.DNSName)
+		}
+		flow.ServiceFlowType = flow.RegisteredDomain
+		if flow.LabelSource == "" {
+			flow.LabelSource = labelDNS
+		}
+		flow.LabelConfidence = 1
+	}
+}
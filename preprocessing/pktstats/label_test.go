@@ -0,0 +1,92 @@
+package pktstats
+
+import "testing"
+
+func TestLabelFlow(t *testing.T) {
+	var telemetry domainSuffixes
+	telemetry.add("metrics.example.net")
+	tests := []struct {
+		name             string
+		dnsName          string
+		registeredDomain string
+		serviceFlowType  string
+		labelSource      string
+		labelConfidence  float64
+	}{
+		{"unresolved", "", "", "", "", 0},
+		{"service", "eu1.game.example.com", "example.com", "example.com", labelDNS, 1},
+		{"multi-label public suffix", "cdn.example.co.uk", "example.co.uk", "example.co.uk", labelDNS, 1},
+		{"telemetry", "ingest.metrics.example.net", "example.net", telemetryRole, labelTelemetry, 1},
+		{"telemetry suffix", "metrics.example.net", "example.net", telemetryRole, labelTelemetry, 1},
+		{"not a telemetry label", "xmetrics.example.net", "example.net", "example.net", labelDNS, 1},
+		{"address", "203.0.113.10", "203.0.113.10", "203.0.113.10", labelDNS, 1},
+	}
+	for _, test := range tests {
+		flow := &Flow{}
+		labelFlow(flow, test.dnsName, telemetry)
+		if flow.DNSName != test.dnsName {
+			t.Errorf("%s: DNSName %q, want the resolved name %q", test.name, flow.DNSName, test.dnsName)
+		}
+		if flow.RegisteredDomain != test.registeredDomain {
+			t.Errorf("%s: RegisteredDomain %q, want %q", test.name, flow.RegisteredDomain, test.registeredDomain)
+		}
+		if flow.ServiceFlowType != test.serviceFlowType {
+			t.Errorf("%s: ServiceFlowType %q, want %q", test.name, flow.ServiceFlowType, test.serviceFlowType)
+		}
+		if flow.LabelSource != test.labelSource || flow.LabelConfidence != test.labelConfidence {
+			t.Errorf("%s: label source %q confidence %v, want %q %v", test.name, flow.LabelSource, flow.LabelConfidence, test.labelSource, test.labelConfidence)
+		}
+	}
+}
+
+// TestUpgradeLabels reads the labels of flows of outputs before schema
+// version 2, where ServiceFlowType repeated DNSName.
+func TestUpgradeLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		flow    Flow
+		want    Flow
+	}{
+		{
+			"hostname", 1,
+			Flow{DNSName: "eu1.game.example.com", ServiceFlowType: "eu1.game.example.com"},
+			Flow{DNSName: "eu1.game.example.com", RegisteredDomain: "example.com", ServiceFlowType: "example.com", LabelSource: labelDNS, LabelConfidence: 1},
+		},
+		{
+			"unversioned", 0,
+			Flow{DNSName: "cdn.example.co.uk", ServiceFlowType: "cdn.example.co.uk"},
+			Flow{DNSName: "cdn.example.co.uk", RegisteredDomain: "example.co.uk", ServiceFlowType: "example.co.uk", LabelSource: labelDNS, LabelConfidence: 1},
+		},
+		{
+			"registered domain kept", 1,
+			Flow{DNSName: "eu1.game.example.com", RegisteredDomain: "game.example.com", ServiceFlowType: "eu1.game.example.com", LabelSource: labelNRB},
+			Flow{DNSName: "eu1.game.example.com", RegisteredDomain: "game.example.com", ServiceFlowType: "game.example.com", LabelSource: labelNRB, LabelConfidence: 1},
+		},
+		{
+			"role kept", 1,
+			Flow{DNSName: "ingest.metrics.example.net", ServiceFlowType: telemetryRole},
+			Flow{DNSName: "ingest.metrics.example.net", ServiceFlowType: telemetryRole},
+		},
+		{
+			"unresolved", 1,
+			Flow{},
+			Flow{},
+		},
+		{
+			"current version", 2,
+			Flow{DNSName: "eu1.game.example.com", ServiceFlowType: "eu1.game.example.com"},
+			Flow{DNSName: "eu1.game.example.com", ServiceFlowType: "eu1.game.example.com"},
+		},
+	}
+	for _, test := range tests {
+		flow := test.flow
+		upgradeLabels(map[string]*Flow{"flow": &flow}, test.version)
+		if flow.DNSName != test.want.DNSName || flow.RegisteredDomain != test.want.RegisteredDomain || flow.ServiceFlowType != test.want.ServiceFlowType ||
+			flow.LabelSource != test.want.LabelSource || flow.LabelConfidence != test.want.LabelConfidence {
+			t.Errorf("%s: labels %q %q %q %q %v, want %q %q %q %q %v", test.name,
+				flow.DNSName, flow.RegisteredDomain, flow.ServiceFlowType, flow.LabelSource, flow.LabelConfidence,
+				test.want.DNSName, test.want.RegisteredDomain, test.want.ServiceFlowType, test.want.LabelSource, test.want.LabelConfidence)
+		}
+	}
+}
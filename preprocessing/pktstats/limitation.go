@@ -0,0 +1,243 @@
+package pktstats
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// LimitationShares summarizes how a downstream media flow's time divides into
+// application-limited and network-limited periods, see classifyLimitation.
+type LimitationShares struct {
+	Bins           int     `json:"bins"`           // bins of Options.LimitBinMillis spanned by the flow from its first media packet
+	AppLimited     float64 `json:"appLimited"`     // share of bins idling by choice
+	NetworkLimited float64 `json:"networkLimited"` // share of bins throttled by the network
+	LossSignals    int     `json:"lossSignals"`    // retransmissions, duplicate ACKs and missing RTP packets
+	// CongestionTruncated is set when the flow spanned more than
+	// limitMaxBins bins, its congestion episodes covering only the first ones
+	CongestionTruncated bool `json:"congestionTruncated,omitempty"`
+}
+
+// limitMaxBins bounds the bins of a flow kept for its congestion episodes,
+// 4 hours of bins of the default width; the classification itself only
+// keeps the bins of its window.
+const limitMaxBins = 144000
+
+// limitClass is the state of a flow during one bin.
+type limitClass int
+
+const (
+	limitUnclassified limitClass = iota
+	limitApp
+	limitNetwork
+)
+
+// limitThresholds are the parameters of classifyLimitation.
+type limitThresholds struct {
+	window       int     // bins the recent p95 rate is taken over, the current one included
+	appRatio     float64 // rate below this fraction of the recent p95 is app-limited, without loss signals
+	networkRatio float64 // rate at or above this fraction of the recent p95 is network-limited, with loss signals
+}
+
+// limitState bins the downstream bytes of a flow over time from its first
+// media packet, counts the loss signals seen in each bin and classifies each
+// bin once the next one starts.
+type limitState struct {
+	binWidth   int64 // in timestamp units of the output precision, 0 disables binning
+	thresholds limitThresholds
+	started    bool
+	start      int64 // arrival of the first packet binned
+	current    int   // index of the bin being filled
+	filling    limitBin
+	recent     []float64 // rates of the last thresholds.window bins, by index modulo the window
+	shares     LimitationShares
+	bins       []limitBin // the first limitMaxBins bins, for detectCongestion
+	upBytes    int64
+	downBytes  int64
+	// TCP: end of the highest downstream segment, and the last upstream pure ACK
+	seqStarted bool
+	highSeq    uint32
+	ackStarted bool
+	lastAck    uint32
+	// RTP: last downstream sequence number per SSRC
+	rtpSeqs map[uint32]uint16
+}
+
+type limitBin struct {
+	bytes       int64
+	packets     int // downstream
+	lossSignals int
+}
+
+// bin returns the bin of a timestamp, closing the bins before it. Packets
+// arriving late for a closed bin count in the current one.
+func (state *limitState) bin(timestamp int64) *limitBin {
+	if !state.started {
+		state.started, state.start = true, timestamp
+		state.recent = make([]float64, 0, state.thresholds.window)
+	}
+	for i := int(max(timestamp-state.start, 0) / state.binWidth); state.current < i; state.current++ {
+		state.close()
+	}
+	return &state.filling
+}
+
+// close classifies the current bin against the recent ones, see
+// classifyLimitation, and keeps it for detectCongestion.
+func (state *limitState) close() {
+	bin := state.filling
+	state.filling = limitBin{}
+	rate := float64(bin.bytes)
+	if len(state.recent) < cap(state.recent) {
+		state.recent = append(state.recent, rate)
+	} else {
+		state.recent[state.current%cap(state.recent)] = rate
+	}
+	switch classifyBin(rate, bin.lossSignals, percentile95(state.recent), state.thresholds) {
+	case limitApp:
+		state.shares.AppLimited++
+	case limitNetwork:
+		state.shares.NetworkLimited++
+	}
+	state.shares.Bins++
+	state.shares.LossSignals += bin.lossSignals
+	if len(state.bins) < limitMaxBins {
+		state.bins = append(state.bins, bin)
+	} else {
+		state.shares.CongestionTruncated = true
+	}
+}
+
+// observe adds a packet to its bin and, for RTP flows, counts the downstream
+// packets missing from the sequence of each SSRC.
+func (state *limitState) observe(packet *Packet, payload []byte, rtp bool) {
+	bin := state.bin(packet.Timestamp)
+	switch packet.Direction {
+	case DirectionUpstream:
+		state.upBytes += int64(packet.PktLength)
+		return
+	case DirectionDownstream:
+		state.downBytes += int64(packet.PktLength)
+		bin.bytes += int64(packet.PktLength)
+		bin.packets++
+	default:
+		return
+	}
+	if !rtp || len(payload) < 12 || payload[0]>>6 != 2 {
+		return
+	}
+	seq := binary.BigEndian.Uint16(payload[2:4])
+	ssrc := binary.BigEndian.Uint32(payload[8:12])
+	if state.rtpSeqs == nil {
+		state.rtpSeqs = make(map[uint32]uint16)
+	}
+	if last, ok := state.rtpSeqs[ssrc]; ok {
+		// serial number arithmetic, reordered packets count as neither loss nor progress
+		delta := seq - last
+		if delta >= 0x8000 {
+			return
+		}
+		if delta > 1 {
+			bin.lossSignals += int(delta - 1)
+		}
+	}
+	state.rtpSeqs[ssrc] = seq
+}
+
+// observeTCP counts downstream retransmissions, segments ending at or before
+// the highest sequence number seen, and upstream duplicate pure ACKs.
+func (state *limitState) observeTCP(packet *Packet, seq, ack uint32, pureAck bool, payloadLen int) {
+	switch {
+	case packet.Direction == DirectionDownstream && payloadLen > 0:
+		end := seq + uint32(payloadLen)
+		if state.seqStarted && int32(end-state.highSeq) <= 0 {
+			state.bin(packet.Timestamp).lossSignals++
+			return
+		}
+		state.seqStarted = true
+		state.highSeq = end
+	case packet.Direction == DirectionUpstream && pureAck:
+		if state.ackStarted && ack == state.lastAck {
+			state.bin(packet.Timestamp).lossSignals++
+		}
+		state.ackStarted = true
+		state.lastAck = ack
+	}
+}
+
+// classifyLimitation classifies each bin of a rate series, given the loss
+// signals of each bin. A bin is app-limited if its rate is below
+// appRatio times the p95 rate of the recent window and it has no loss
+// signals, and network-limited if its rate is at least networkRatio times
+// that p95 (near the flow's plateau) and it has loss signals. Other bins are
+// left unclassified. Rates may be in any unit.
+func classifyLimitation(rates []float64, lossSignals []int, thresholds limitThresholds) []limitClass {
+	classes := make([]limitClass, len(rates))
+	for i, rate := range rates {
+		classes[i] = classifyBin(rate, lossSignals[i], recentP95(rates, i, thresholds.window), thresholds)
+	}
+	return classes
+}
+
+// classifyBin classifies one bin given the p95 rate of the recent window.
+func classifyBin(rate float64, lossSignals int, p95 float64, thresholds limitThresholds) limitClass {
+	switch {
+	case lossSignals == 0 && rate < thresholds.appRatio*p95:
+		return limitApp
+	case lossSignals > 0 && rate >= thresholds.networkRatio*p95:
+		return limitNetwork
+	}
+	return limitUnclassified
+}
+
+// recentP95 returns the p95 of the window of rates ending at the i-th one.
+func recentP95(rates []float64, i, window int) float64 {
+	return percentile95(rates[max(i-window+1, 0) : i+1])
+}
+
+// percentile95 returns the p95 of rates, which it leaves unsorted.
+func percentile95(rates []float64) float64 {
+	sorted := append([]float64(nil), rates...)
+	sort.Float64s(sorted)
+	return sorted[int(0.95*float64(len(sorted)-1))]
+}
+
+// estimateLimitation stores the shares of app-limited and network-limited
+// bins of downstream media flows: flows binned from their first media packet
+// on, spanning at least two bins, that received more than they sent from
+// then on, other than bulk downloads. Their congestion episodes are detected
+// from the same bins.
+func (flow *Flow) estimateLimitation(opts Options) {
+	state := &flow.limitation
+	if !state.started {
+		return
+	}
+	state.close()
+	bins := state.bins
+	state.bins, state.recent, state.rtpSeqs = nil, nil, nil
+	if state.shares.Bins < 2 || state.downBytes <= state.upBytes || flow.TrafficClass == bulkDownloadClass {
+		return
+	}
+	shares := state.shares
+	shares.AppLimited /= float64(shares.Bins)
+	shares.NetworkLimited /= float64(shares.Bins)
+	flow.Limitation = &shares
+	rates := make([]float64, len(bins))
+	for i, bin := range bins {
+		rates[i] = float64(bin.bytes)
+	}
+	flow.detectCongestion(bins, rates, opts)
+}
+
+// limitBinWidth returns the bin width of Options.LimitBinMillis in timestamp units.
+func (opts Options) limitBinWidth() int64 {
+	return opts.duration(time.Duration(opts.LimitBinMillis) * time.Millisecond)
+}
+
+func (opts Options) limitThresholds() limitThresholds {
+	return limitThresholds{
+		window:       max(opts.LimitWindow, 1),
+		appRatio:     opts.AppLimitedRatio,
+		networkRatio: opts.NetworkLimitedRatio,
+	}
+}
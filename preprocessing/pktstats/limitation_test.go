@@ -0,0 +1,155 @@
+package pktstats
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestClassifyLimitation(t *testing.T) {
+	thresholds := limitThresholds{window: 4, appRatio: 0.3, networkRatio: 0.8}
+	const (
+		u = limitUnclassified
+		a = limitApp
+		n = limitNetwork
+	)
+	tests := []struct {
+		name        string
+		rates       []float64
+		lossSignals []int
+		want        []limitClass
+	}{
+		{"plateau", []float64{100, 100, 100}, []int{0, 0, 0}, []limitClass{u, u, u}},
+		{"idle without loss", []float64{100, 100, 10}, []int{0, 0, 0}, []limitClass{u, u, a}},
+		{"idle with loss", []float64{100, 100, 10}, []int{0, 0, 1}, []limitClass{u, u, u}},
+		{"app-limited edge", []float64{100, 100, 29.9, 30}, []int{0, 0, 0, 0}, []limitClass{u, u, a, u}},
+		{"loss at the plateau", []float64{100, 100, 100}, []int{0, 2, 0}, []limitClass{u, n, u}},
+		{"network-limited edge", []float64{100, 100, 80, 79.9}, []int{0, 0, 1, 1}, []limitClass{u, u, n, u}},
+		// the p95 is the rate ranked int(0.95*(n-1)) of the n bins of the
+		// window: the bin itself for the first bin, the lower of two
+		{"first bin", []float64{50}, []int{1}, []limitClass{n}},
+		{"silent first bin", []float64{0}, []int{0}, []limitClass{u}},
+		{"two bins", []float64{100, 10}, []int{0, 0}, []limitClass{u, u}},
+		// the high rates leave the window of 4 bins
+		{"window", []float64{1000, 1000, 100, 100, 100, 100}, []int{0, 0, 0, 0, 0, 0}, []limitClass{u, u, a, a, u, u}},
+		{"none", nil, nil, []limitClass{}},
+	}
+	for _, test := range tests {
+		if got := classifyLimitation(test.rates, test.lossSignals, thresholds); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: classes %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestLimitStateClassification bins a series packet by packet and checks
+// that classifying each bin as the next one starts, over the bins of the
+// window only, agrees with classifying the whole series.
+func TestLimitStateClassification(t *testing.T) {
+	thresholds := limitThresholds{window: 5, appRatio: 0.3, networkRatio: 0.8}
+	random := rand.New(rand.NewSource(1))
+	state := limitState{binWidth: 100, thresholds: thresholds}
+	const bins = 200
+	rates := make([]float64, bins)
+	lossSignals := make([]int, bins)
+	for i := 0; i < bins; i++ {
+		timestamp := int64(1000 + i*100)
+		for packets := random.Intn(4); packets > 0; packets-- {
+			state.observe(&Packet{Direction: DirectionDownstream, Timestamp: timestamp, PktLength: 1000}, nil, false)
+			rates[i] += 1000
+		}
+		if random.Intn(5) == 0 {
+			state.bin(timestamp).lossSignals++
+			lossSignals[i]++
+		}
+	}
+	// a late packet counts in the last bin
+	state.observe(&Packet{Direction: DirectionDownstream, Timestamp: 1000, PktLength: 1000}, nil, false)
+	rates[bins-1] += 1000
+	flow := &Flow{limitation: state}
+	flow.limitation.upBytes = 0
+	flow.estimateLimitation(DefaultOptions())
+
+	want := LimitationShares{Bins: bins}
+	for i, class := range classifyLimitation(rates, lossSignals, thresholds) {
+		switch class {
+		case limitApp:
+			want.AppLimited++
+		case limitNetwork:
+			want.NetworkLimited++
+		}
+		want.LossSignals += lossSignals[i]
+	}
+	want.AppLimited /= bins
+	want.NetworkLimited /= bins
+	if flow.Limitation == nil || *flow.Limitation != want {
+		t.Errorf("limitation %+v, want %+v", flow.Limitation, want)
+	}
+	if len(flow.limitation.recent) != 0 || flow.limitation.bins != nil {
+		t.Error("bins kept after the estimate")
+	}
+}
+
+// TestLimitStateMediaFlows bins flows from their first media packet only.
+func TestLimitStateMediaFlows(t *testing.T) {
+	opts := DefaultOptions()
+	newFlow := func() *Flow {
+		flow := &Flow{Protocol: 17}
+		flow.limitation.binWidth, flow.limitation.thresholds = opts.limitBinWidth(), opts.limitThresholds()
+		flow.firstMedia.minPayload = opts.MediaMinPayload
+		return flow
+	}
+	up := func(timestamp int64) *Packet {
+		return &Packet{Direction: DirectionUpstream, Upstream: true, Timestamp: timestamp, PayloadSize: 100, PktLength: 142}
+	}
+	down := func(timestamp int64, payload int) *Packet {
+		return &Packet{Direction: DirectionDownstream, Timestamp: timestamp, PayloadSize: payload, PktLength: payload + 42}
+	}
+
+	// small packets for a minute: no media
+	control := newFlow()
+	for i := int64(0); i < 600; i++ {
+		control.observe(up(i*opts.limitBinWidth()), nil)
+		control.observe(down(i*opts.limitBinWidth()+10, 500), nil)
+	}
+	control.estimateLimitation(opts)
+	if control.limitation.started || control.Limitation != nil {
+		t.Errorf("flow without media binned: %+v", control.Limitation)
+	}
+
+	// the bins start with the first media packet, after 10 bins of signaling
+	media := newFlow()
+	for i := int64(0); i < 30; i++ {
+		payload := 1200
+		if i < 10 {
+			payload = 500
+		}
+		media.observe(up(i*opts.limitBinWidth()), nil)
+		media.observe(down(i*opts.limitBinWidth()+10, payload), nil)
+		media.observe(down(i*opts.limitBinWidth()+20, payload), nil)
+	}
+	media.estimateLimitation(opts)
+	if media.Limitation == nil || media.Limitation.Bins != 20 {
+		t.Errorf("media flow limitation %+v, want 20 bins", media.Limitation)
+	}
+}
+
+// TestLimitStateCap keeps the first limitMaxBins bins for the congestion
+// episodes while classifying them all.
+func TestLimitStateCap(t *testing.T) {
+	opts := DefaultOptions()
+	flow := &Flow{}
+	flow.limitation = limitState{binWidth: 1, thresholds: opts.limitThresholds()}
+	for i := int64(0); i < limitMaxBins+10; i++ {
+		flow.limitation.observe(&Packet{Direction: DirectionDownstream, Timestamp: i, PktLength: 1000}, nil, false)
+	}
+	if len(flow.limitation.bins) != limitMaxBins {
+		t.Errorf("%d bins kept, want %d", len(flow.limitation.bins), limitMaxBins)
+	}
+	if cap(flow.limitation.recent) != opts.LimitWindow {
+		t.Errorf("%d recent rates kept, want %d", cap(flow.limitation.recent), opts.LimitWindow)
+	}
+	flow.estimateLimitation(opts)
+	if flow.Limitation == nil || flow.Limitation.Bins != limitMaxBins+10 || !flow.Limitation.CongestionTruncated {
+		t.Errorf("limitation %+v, want %d bins with truncated congestion episodes", flow.Limitation, limitMaxBins+10)
+	}
+}
@@ -0,0 +1,331 @@
+package pktstats
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errNoMeta is returned by readMeta for JSON files that are not outputs with a meta block.
+var errNoMeta = errors.New("no meta block")
+
+// readMeta reads only the meta block of an output: the leading "Meta" member of
+// json and ndjson outputs, or the .meta.json sidecar of csv outputs.
+func readMeta(path string) (*Meta, error) {
+	if filepath.Ext(path) == ".csv" {
+		path += ".meta.json"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	meta := &Meta{}
+	if strings.HasSuffix(path, ".meta.json") {
+		return meta, decoder.Decode(meta)
+	}
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errNoMeta
+	}
+	if token, err := decoder.Token(); err != nil {
+		return nil, errNoMeta
+	} else if key, ok := token.(string); !ok || !strings.EqualFold(key, "meta") {
+		return nil, errNoMeta
+	}
+	return meta, decoder.Decode(meta)
+}
+
+// LoadFlows loads an output of any format: json outputs with a meta block,
+// legacy json outputs holding only the flow map (returned with a nil Meta),
+// and ndjson and csv outputs, whose flows are rebuilt from the meta block.
+// Labels of outputs older than schemaVersion are upgraded, see upgradeLabels.
+func LoadFlows(path string) (*Output, error) {
+	switch filepath.Ext(path) {
+	case ".ndjson", ".csv":
+		meta, err := readMeta(path)
+		if err != nil {
+			return nil, err
+		}
+		output := &Output{Meta: meta, Flows: make(map[string]*Flow)}
+		for _, ref := range meta.Flows {
+			output.Flows[ref.Key] = ref.flow()
+		}
+		for _, ref := range meta.ThirdPartyFlows {
+			if output.ThirdPartyFlows == nil {
+				output.ThirdPartyFlows = make(map[string]*Flow)
+			}
+			output.ThirdPartyFlows[ref.Key] = ref.flow()
+		}
+		for _, ref := range meta.MirrorFlows {
+			if output.MirrorFlows == nil {
+				output.MirrorFlows = make(map[string]*Flow)
+			}
+			output.MirrorFlows[ref.Key] = ref.flow()
+		}
+		_, err = Iterate(path, func(flowKey string, packet *Packet) error {
+			flow, ok := output.Flows[flowKey]
+			if !ok {
+				flow, ok = output.ThirdPartyFlows[flowKey]
+			}
+			if !ok {
+				flow, ok = output.MirrorFlows[flowKey]
+			}
+			if !ok {
+				return fmt.Errorf("packet of unknown flow %s", flowKey)
+			}
+			flow.Packets = append(flow.Packets, *packet)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		upgradeLabels(output.Flows, meta.SchemaVersion)
+		upgradeLabels(output.ThirdPartyFlows, meta.SchemaVersion)
+		upgradeLabels(output.MirrorFlows, meta.SchemaVersion)
+		return output, nil
+	default:
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var envelope map[string]json.RawMessage
+		if err := json.Unmarshal(content, &envelope); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		output := &Output{}
+		_, hasMeta := envelope["meta"]
+		if _, ok := envelope["Meta"]; ok || hasMeta {
+			err = json.Unmarshal(content, output)
+		} else {
+			err = json.Unmarshal(content, &output.Flows)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		version := 0
+		if output.Meta != nil {
+			version = output.Meta.SchemaVersion
+		}
+		upgradeLabels(output.Flows, version)
+		upgradeLabels(output.ThirdPartyFlows, version)
+		upgradeLabels(output.MirrorFlows, version)
+		return output, nil
+	}
+}
+
+// flow returns the flow described by a flow reference, without packets.
+func (ref FlowRef) flow() *Flow {
+	return &Flow{
+		LocalIP:          ref.LocalIP,
+		RemoteIP:         ref.RemoteIP,
+		LocalPort:        ref.LocalPort,
+		RemotePort:       ref.RemotePort,
+		Protocol:         ref.Protocol,
+		ServiceFlowType:  ref.ServiceFlowType,
+		LabelSource:      ref.LabelSource,
+		LabelConfidence:  ref.LabelConfidence,
+		DNSName:          ref.DNSName,
+		RegisteredDomain: ref.RegisteredDomain,
+		TransportProfile: ref.TransportProfile,
+		PeerGroupID:      ref.PeerGroupID,
+		Outcome:          ref.Outcome,
+		ZeroPayload:      ref.ZeroPayload,
+		Mirror:           ref.Mirror,
+		Packets:          make([]Packet, 0, ref.NumPackets),
+	}
+}
+
+// Iterate streams the packets of an ndjson or csv output to fn, one at a time,
+// without holding the output in memory, and returns the meta block.
+func Iterate(path string, fn func(flowKey string, packet *Packet) error) (*Meta, error) {
+	meta, err := readMeta(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[int]string)
+	for _, refs := range [][]FlowRef{meta.Flows, meta.ThirdPartyFlows, meta.MirrorFlows} {
+		for _, ref := range refs {
+			keys[ref.ID] = ref.Key
+		}
+	}
+	flowKey := func(ref string) (string, error) {
+		if meta.Options.StringKeys {
+			return ref, nil
+		}
+		id, err := strconv.Atoi(ref)
+		if err != nil {
+			return "", fmt.Errorf("invalid flow ID %q", ref)
+		}
+		key, ok := keys[id]
+		if !ok {
+			return "", fmt.Errorf("unknown flow ID %d", id)
+		}
+		return key, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if filepath.Ext(path) == ".csv" {
+		return meta, iterateCSV(file, flowKey, fn)
+	}
+	reader := bufio.NewReader(file)
+	// skip the meta block on the first line
+	if _, err := reader.ReadBytes('\n'); err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(reader)
+	for {
+		var record struct {
+			Flow json.RawMessage
+			Packet
+		}
+		if err := decoder.Decode(&record); err == io.EOF {
+			return meta, nil
+		} else if err != nil {
+			return nil, err
+		}
+		ref := string(record.Flow)
+		if unquoted, err := strconv.Unquote(ref); err == nil {
+			ref = unquoted
+		}
+		key, err := flowKey(ref)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(key, &record.Packet); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// iterateCSV streams the rows of a csv output, locating columns by header so
+// outputs written before columns were added still load.
+func iterateCSV(file io.Reader, flowKey func(string) (string, error), fn func(string, *Packet) error) error {
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	// by lowercased name, to read outputs written with either naming, see names.go
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(name)] = i
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[strings.ToLower(name)]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+	number := func(row []string, name string) int {
+		value, _ := strconv.Atoi(field(row, name))
+		return value
+	}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		key, err := flowKey(field(row, "Flow"))
+		if err != nil {
+			return err
+		}
+		timestamp, _ := strconv.ParseInt(field(row, "Timestamp"), 10, 64)
+		upstream, _ := strconv.ParseBool(field(row, "Upstream"))
+		df, _ := strconv.ParseBool(field(row, "DF"))
+		badChecksum, _ := strconv.ParseBool(field(row, "BadChecksum"))
+		packet := Packet{
+			SrcIP:       field(row, "SrcIP"),
+			DstIP:       field(row, "DstIP"),
+			SrcPort:     number(row, "SrcPort"),
+			DstPort:     number(row, "DstPort"),
+			Protocol:    number(row, "Protocol"),
+			Upstream:    upstream,
+			Direction:   Direction(field(row, "Direction")),
+			Timestamp:   timestamp,
+			PktLength:   number(row, "PktLength"),
+			PayloadSize: number(row, "PayloadSize"),
+			IPID:        number(row, "IPID"),
+			DF:          df,
+			FlowLabel:   number(row, "FlowLabel"),
+			BadChecksum: badChecksum,
+		}
+		if err := fn(key, &packet); err != nil {
+			return err
+		}
+	}
+}
+
+// FlowsByService returns the flows of a service, keyed by registered domain
+// as in the service rollups, "unlabeled" for flows without a DNS name.
+func (output *Output) FlowsByService(service string) map[string]*Flow {
+	flows := make(map[string]*Flow)
+	for key, flow := range output.Flows {
+		domain := flow.RegisteredDomain
+		if domain == "" {
+			domain = unlabeledService
+		}
+		if domain == service {
+			flows[key] = flow
+		}
+	}
+	return flows
+}
+
+// TotalBytes sums the length of the stored packets sent in direction, or of
+// all stored packets for an empty direction. Packets of outputs written
+// before packets had a Direction are matched by their Upstream flag.
+func (output *Output) TotalBytes(direction Direction) int64 {
+	var total int64
+	for _, flow := range output.Flows {
+		for _, packet := range flow.Packets {
+			if direction == "" || packet.direction() == direction {
+				total += int64(packet.PktLength)
+			}
+		}
+	}
+	return total
+}
+
+func (packet *Packet) direction() Direction {
+	if packet.Direction != "" {
+		return packet.Direction
+	}
+	if packet.Upstream {
+		return DirectionUpstream
+	}
+	return DirectionDownstream
+}
+
+// TimeRange returns the timestamps of the first and last stored packet, zero
+// for an output without packets.
+func (output *Output) TimeRange() (first, last int64) {
+	seen := false
+	for _, flows := range []map[string]*Flow{output.Flows, output.ThirdPartyFlows, output.MirrorFlows} {
+		for _, flow := range flows {
+			for _, packet := range flow.Packets {
+				if !seen || packet.Timestamp < first {
+					first = packet.Timestamp
+				}
+				if !seen || packet.Timestamp > last {
+					last = packet.Timestamp
+				}
+				seen = true
+			}
+		}
+	}
+	return first, last
+}
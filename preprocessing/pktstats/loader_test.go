@@ -0,0 +1,179 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// flowsCapture is a short session of a client with a game server over UDP
+// and a store over TCP, both resolved by DNS.
+func flowsCapture(t testing.TB) []fixturePacket {
+	const client, resolver, game, store = "192.168.1.10", "192.168.1.1", "203.0.113.10", "198.51.100.7"
+	payload := func(size int) []byte { return make([]byte, size) }
+	packets := []fixturePacket{
+		{at: 0, data: dnsResponse(t, resolver, 53, client, "eu1.game.example.com", game)},
+		{at: time.Millisecond, data: dnsResponse(t, resolver, 53, client, "store.example.net", store)},
+		{at: 10 * time.Millisecond, data: tcpPacket(t, client, 50100, store, 443, "S", 1000, 0, nil)},
+		{at: 30 * time.Millisecond, data: tcpPacket(t, store, 443, client, 50100, "SA", 5000, 1001, nil)},
+		{at: 31 * time.Millisecond, data: tcpPacket(t, client, 50100, store, 443, "A", 1001, 5001, nil)},
+		{at: 32 * time.Millisecond, data: tcpPacket(t, client, 50100, store, 443, "PA", 1001, 5001, payload(300))},
+		{at: 52 * time.Millisecond, data: tcpPacket(t, store, 443, client, 50100, "PA", 5001, 1301, payload(1200))},
+		{at: 60 * time.Millisecond, data: tcpPacket(t, client, 50100, store, 443, "FA", 1301, 6201, nil)},
+		{at: 80 * time.Millisecond, data: tcpPacket(t, store, 443, client, 50100, "FA", 6201, 1302, nil)},
+		{at: 81 * time.Millisecond, data: tcpPacket(t, client, 50100, store, 443, "A", 1302, 6202, nil)},
+	}
+	for i := 0; i < 20; i++ {
+		at := 100*time.Millisecond + time.Duration(i)*16*time.Millisecond
+		packets = append(packets,
+			fixturePacket{at: at, data: udpPacket(t, client, 50000, game, 3478, payload(80))},
+			fixturePacket{at: at + 5*time.Millisecond, data: udpPacket(t, game, 3478, client, 50000, payload(1100+i))},
+		)
+	}
+	return packets
+}
+
+// TestLoadFlowsRoundTrip extracts the same capture in each output format and
+// loads them back against the golden flows of the json output.
+func TestLoadFlowsRoundTrip(t *testing.T) {
+	capture := fixture(t, "flows.pcap", flowsCapture)
+	output, _ := extractFixture(t, capture, testOptions())
+	content, err := json.MarshalIndent(output.Flows, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "flows_packetStats.golden.json", append(content, '\n'))
+	var want map[string]*Flow
+	if err := json.Unmarshal(content, &want); err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 2 {
+		t.Fatalf("got %d flows, want the game and store flows", len(want))
+	}
+	if !reflect.DeepEqual(output.Flows, want) {
+		t.Error("json output does not load back into its flows")
+	}
+
+	// per-packet outputs hold the flow-level fields of the meta block
+	var index flowIndex
+	refs := index.add(want, "")
+	for _, format := range []string{"ndjson", "csv"} {
+		for _, stringKeys := range []bool{false, true} {
+			opts := testOptions()
+			opts.Format, opts.StringKeys = format, stringKeys
+			loaded, _ := extractFixture(t, capture, opts)
+			if loaded.Meta == nil || len(loaded.Flows) != len(want) {
+				t.Fatalf("%s: got %d flows, want %d", format, len(loaded.Flows), len(want))
+			}
+			for _, ref := range refs {
+				expected := ref.flow()
+				expected.Packets = want[ref.Key].Packets
+				if got := loaded.Flows[ref.Key]; !reflect.DeepEqual(got, expected) {
+					t.Errorf("%s (string keys %v): flow %s loads as %+v, want %+v", format, stringKeys, ref.Key, got, expected)
+				}
+			}
+		}
+	}
+}
+
+// TestLoadFlowsLegacy loads an output holding only the flow map, as written
+// before outputs had a meta block.
+func TestLoadFlowsLegacy(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join(testdata, "flows_packetStats.golden.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "legacy_packetStats.json")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := LoadFlows(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want map[string]*Flow
+	if err := json.Unmarshal(content, &want); err != nil {
+		t.Fatal(err)
+	}
+	if output.Meta != nil {
+		t.Error("legacy output loaded with a meta block")
+	}
+	if !reflect.DeepEqual(output.Flows, want) {
+		t.Error("legacy output does not load into its flows")
+	}
+}
+
+func TestOutputQueries(t *testing.T) {
+	capture := fixture(t, "flows.pcap", flowsCapture)
+	output, _ := extractFixture(t, capture, testOptions())
+
+	tests := []struct {
+		service string
+		flows   int
+	}{
+		{"example.com", 1},
+		{"example.net", 1},
+		{"example.org", 0},
+	}
+	for _, test := range tests {
+		if got := len(output.FlowsByService(test.service)); got != test.flows {
+			t.Errorf("FlowsByService(%q) = %d flows, want %d", test.service, got, test.flows)
+		}
+	}
+
+	var up, down int64
+	for _, flow := range output.Flows {
+		for _, packet := range flow.Packets {
+			if packet.Direction == DirectionUpstream {
+				up += int64(packet.PktLength)
+			} else {
+				down += int64(packet.PktLength)
+			}
+		}
+	}
+	if got := output.TotalBytes(DirectionUpstream); got != up || up == 0 {
+		t.Errorf("TotalBytes(upstream) = %d, want %d", got, up)
+	}
+	if got := output.TotalBytes(DirectionDownstream); got != down || down == 0 {
+		t.Errorf("TotalBytes(downstream) = %d, want %d", got, down)
+	}
+	if got := output.TotalBytes(""); got != up+down {
+		t.Errorf("TotalBytes() = %d, want %d", got, up+down)
+	}
+
+	// from the SYN of the store flow to the last packet of the game flow
+	first, last := output.TimeRange()
+	start := fixtureStart.UnixMicro()
+	if wantFirst, wantLast := start+10_000, start+(100+19*16+5)*1000; first != wantFirst || last != wantLast {
+		t.Errorf("TimeRange() = %d, %d, want %d, %d", first, last, wantFirst, wantLast)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	capture := fixture(t, "flows.pcap", flowsCapture)
+	want, _ := extractFixture(t, capture, testOptions())
+	for _, format := range []string{"ndjson", "csv"} {
+		opts := testOptions()
+		opts.Format = format
+		_, outPath := extractFixture(t, capture, opts)
+		packets := make(map[string][]Packet)
+		meta, err := Iterate(outPath, func(flowKey string, packet *Packet) error {
+			packets[flowKey] = append(packets[flowKey], *packet)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta == nil || len(meta.Flows) != len(want.Flows) {
+			t.Fatalf("%s: meta block lists the wrong flows", format)
+		}
+		for key, flow := range want.Flows {
+			if !reflect.DeepEqual(packets[key], flow.Packets) {
+				t.Errorf("%s: packets of %s iterate as %v, want %v", format, key, packets[key], flow.Packets)
+			}
+		}
+	}
+}
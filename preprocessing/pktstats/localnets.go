@@ -0,0 +1,40 @@
+package pktstats
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// defaultLocalSubnets are the private ranges and the UNSW network the
+// captures were first collected in.
+const defaultLocalSubnets = "192.168.0.0/16,172.16.0.0/12,10.0.0.0/8,149.171.0.0/16"
+
+// localSubnets are the networks of local endpoints, Options.LocalSubnets.
+type localSubnets []*net.IPNet
+
+// parseLocalSubnets parses a comma-separated list of CIDR prefixes.
+func parseLocalSubnets(list string) (localSubnets, error) {
+	var subnets localSubnets
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local subnet %q", item)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+func (subnets localSubnets) contains(ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
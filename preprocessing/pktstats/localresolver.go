@@ -0,0 +1,45 @@
+package pktstats
+
+import (
+	"sort"
+
+	"github.com/google/gopacket/layers"
+)
+
+// localResolvers are the local IPs answering DNS queries, such as a Pi-hole or
+// the caching resolver of a home router. Clients only learn names from them,
+// the resolution upstream of them is not what the client saw.
+type localResolvers map[string]bool
+
+// observe records the source of a DNS response sent from a local IP.
+func (resolvers localResolvers) observe(packet *Packet, dns *layers.DNS) {
+	if dns.QR && (packet.Direction == DirectionLocal || packet.Direction == DirectionUpstream) {
+		resolvers[packet.SrcIP] = true
+	}
+}
+
+// exclude removes the LAN flows between clients and a local resolver on a
+// DNS port, which are infrastructure rather than traffic of a service, and
+// returns them.
+func (resolvers localResolvers) exclude(flowMap map[string]*Flow, dnsPorts map[int]bool) []*Flow {
+	var excluded []*Flow
+	for key, flow := range flowMap {
+		if flow.Direction != DirectionLocal {
+			continue
+		}
+		if resolvers[flow.LocalIP] && dnsPorts[flow.LocalPort] || resolvers[flow.RemoteIP] && dnsPorts[flow.RemotePort] {
+			excluded = append(excluded, flow)
+			delete(flowMap, key)
+		}
+	}
+	return excluded
+}
+
+func (resolvers localResolvers) ips() []string {
+	ips := make([]string, 0, len(resolvers))
+	for ip := range resolvers {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
@@ -0,0 +1,161 @@
+package pktstats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Manifest records what a run did: the binary and options used and the outcome for each input file.
+type Manifest struct {
+	mu       sync.Mutex
+	Version  VersionInfo     `json:"version"`
+	Options  Options         `json:"options"`
+	BasePath string          `json:"basePath"`
+	Config   string          `json:"config,omitempty"` // -config file of the run, merged into Options
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Order    []string        `json:"order"` // inputs in the order they were dispatched, see Options.Order
+	Files    []ManifestEntry `json:"files"`
+	// how the inputs of a sampled run were selected, see Options.Sample
+	Sampling *Sampling `json:"sampling,omitempty"`
+	// bytes written and the files pending or refused under the disk limits
+	DiskUsage *DiskUsage `json:"diskUsage,omitempty"`
+	// flows matched by each classifier rule over the files processed, and
+	// the rules that matched none, see ClassifierRule
+	RuleMatches    map[string]int `json:"ruleMatches,omitempty"`
+	UnmatchedRules []string       `json:"unmatchedRules,omitempty"`
+
+	overrides map[string]*appliedOverrides // by input, see noteOverrides
+}
+
+// ManifestEntry is the outcome of one input file: processed, skipped, failed,
+// checked (with -preflight-only) or pending (not started at
+// Options.MaxTotalOutput, processed when the run is resumed).
+type ManifestEntry struct {
+	Input    string   `json:"input"`
+	Output   string   `json:"output,omitempty"`
+	Status   string   `json:"status"`
+	Reason   string   `json:"reason,omitempty"` // why a file failed, "timeout" after Options.FileTimeout, "disk space" or "panic", or is pending
+	Warnings []string `json:"warnings,omitempty"`
+	// value and stack of the panic that failed the input, see recoverFile
+	Panic string `json:"panic,omitempty"`
+	// SHA-256 of each file written for the input, by path, with Options.HashOutputs
+	Hashes map[string]string `json:"hashes,omitempty"`
+	// per-directory override files applied to the input, farthest first, see overrideFileName
+	Overrides []string `json:"overrides,omitempty"`
+	// options set differently by several override files, the nearest one applies
+	OverrideConflicts []string `json:"overrideConflicts,omitempty"`
+}
+
+func newManifest(basePath string, opts Options) *Manifest {
+	return &Manifest{
+		Version:  BuildVersion(),
+		Options:  opts,
+		BasePath: basePath,
+		Config:   opts.configFile,
+		Started:  time.Now(),
+	}
+}
+
+// record adds the outcome of an input file; safe for concurrent use.
+func (manifest *Manifest) record(input, output, status string) {
+	manifest.add(ManifestEntry{Input: input, Output: output, Status: status})
+}
+
+// recordProcessed adds an input file extracted into the output described by
+// meta, with the hashes of the files written.
+func (manifest *Manifest) recordProcessed(input, output string, meta *Meta) {
+	entry := ManifestEntry{Input: input, Output: output, Status: "processed"}
+	if meta.hashes != nil {
+		entry.Hashes = meta.hashes.files
+	}
+	if meta.exportErr != nil {
+		entry.Status, entry.Reason = "failed", "database export"
+	}
+	manifest.addRuleMatches(meta.RuleMatches)
+	manifest.add(entry)
+}
+
+// recordFailure adds a failed input file, as timed out if ctx, the context
+// of its extraction, ended with its deadline.
+func (manifest *Manifest) recordFailure(ctx context.Context, input, output string) {
+	entry := ManifestEntry{Input: input, Output: output, Status: "failed"}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		entry.Reason = "timeout"
+	}
+	manifest.add(entry)
+}
+
+// recordPanic adds an input file failed by a panic recovered in its processing.
+func (manifest *Manifest) recordPanic(input, output string, recovered *filePanic) {
+	manifest.add(ManifestEntry{Input: input, Output: output, Status: "failed", Reason: "panic", Panic: recovered.String()})
+}
+
+// noteOverrides attaches the override files applied to an input to its
+// entries.
+func (manifest *Manifest) noteOverrides(input string, applied *appliedOverrides) {
+	if len(applied.files) == 0 {
+		return
+	}
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	if manifest.overrides == nil {
+		manifest.overrides = make(map[string]*appliedOverrides)
+	}
+	manifest.overrides[input] = applied
+}
+
+// noteDiskUsage sets the disk usage accounting of the run.
+func (manifest *Manifest) noteDiskUsage(usage *DiskUsage) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	manifest.DiskUsage = usage
+}
+
+// addRuleMatches adds the classifier rule matches of a file.
+func (manifest *Manifest) addRuleMatches(matches map[string]int) {
+	if len(matches) == 0 {
+		return
+	}
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	if manifest.RuleMatches == nil {
+		manifest.RuleMatches = make(map[string]int)
+	}
+	for name, count := range matches {
+		manifest.RuleMatches[name] += count
+	}
+}
+
+func (manifest *Manifest) add(entry ManifestEntry) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	if applied, ok := manifest.overrides[entry.Input]; ok {
+		entry.Overrides, entry.OverrideConflicts = applied.files, applied.conflicts
+	}
+	manifest.Files = append(manifest.Files, entry)
+}
+
+func (manifest *Manifest) write(path string) error {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	manifest.Finished = time.Now()
+	manifest.UnmatchedRules = nil
+	for _, name := range sortedKeys(manifest.RuleMatches) {
+		if manifest.RuleMatches[name] == 0 {
+			manifest.UnmatchedRules = append(manifest.UnmatchedRules, name)
+		}
+	}
+	jsonString, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if manifest.Options.LegacyNames {
+		jsonString = withLegacyNames(jsonString)
+	}
+	return os.WriteFile(path, jsonString, 0644)
+}
@@ -0,0 +1,44 @@
+package pktstats
+
+// firstMediaState finds the first downstream packet carrying at least
+// minPayload bytes after the first upstream packet of a flow, approximating
+// the start-up delay of a stream (click play to first video packet).
+type firstMediaState struct {
+	minPayload int
+	firstUp    int64 // first upstream packet, valid once upSeen
+	upSeen     bool
+	found      bool
+	timestamp  int64 // first qualifying downstream packet, valid once found
+}
+
+// observe uses the Upstream flag, so local and third-party flows measure from
+// the first packet of the endpoint ordered first in their key.
+func (state *firstMediaState) observe(packet *Packet) {
+	if state.found {
+		return
+	}
+	if packet.Upstream {
+		if !state.upSeen {
+			state.upSeen = true
+			state.firstUp = packet.Timestamp
+		}
+		return
+	}
+	if state.upSeen && packet.PayloadSize >= state.minPayload {
+		state.found = true
+		state.timestamp = packet.Timestamp
+	}
+}
+
+// measureFirstMedia stores the delay from the first upstream packet to the
+// first large downstream packet and the timestamp of that packet, or a delay
+// of -1 if the flow has no such packet.
+func (flow *Flow) measureFirstMedia(opts Options) {
+	state := &flow.firstMedia
+	if !state.found {
+		flow.FirstMediaDelayMicros = -1
+		return
+	}
+	flow.FirstMediaDelayMicros = opts.microseconds(state.timestamp - state.firstUp)
+	flow.FirstMediaTimestamp = state.timestamp
+}
@@ -0,0 +1,143 @@
+package pktstats
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricsWindow is the window, in seconds of capture time, of the bitrate and active flow gauges.
+const metricsWindow = 10
+
+// otherService is the service label of flows outside the configured services.
+const otherService = "other"
+
+// serviceMetrics holds per-service counters served in the Prometheus text
+// format. Services are labeled by registered domain, only for the configured
+// ones, to keep the label cardinality bounded.
+type serviceMetrics struct {
+	mu       sync.Mutex
+	services map[string]bool
+	counters map[serviceDirection]*serviceCounters
+	lastSeen map[string]map[string]int64 // service -> flow key -> last packet timestamp
+	latest   int64                       // latest packet timestamp, in seconds
+}
+
+type serviceDirection struct {
+	service   string
+	direction string // see Direction
+}
+
+type serviceCounters struct {
+	bytes, packets int64
+	// bytes per second of capture time, indexed by timestamp modulo metricsWindow
+	buckets [metricsWindow]struct {
+		second int64
+		bytes  int64
+	}
+}
+
+func newServiceMetrics(services string) *serviceMetrics {
+	metrics := &serviceMetrics{
+		services: make(map[string]bool),
+		counters: make(map[serviceDirection]*serviceCounters),
+		lastSeen: make(map[string]map[string]int64),
+	}
+	for _, service := range strings.Split(services, ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			metrics.services[service] = true
+		}
+	}
+	return metrics
+}
+
+// observe counts a packet of a flow, including packets beyond Options.NumPackets.
+func (metrics *serviceMetrics) observe(flow *Flow, flowKey string, packet *Packet, second int64) {
+	service := otherService
+	if metrics.services[flow.RegisteredDomain] {
+		service = flow.RegisteredDomain
+	}
+	direction := string(packet.Direction)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	key := serviceDirection{service, direction}
+	counters, ok := metrics.counters[key]
+	if !ok {
+		counters = &serviceCounters{}
+		metrics.counters[key] = counters
+	}
+	counters.bytes += int64(packet.PktLength)
+	counters.packets++
+	bucket := &counters.buckets[second%metricsWindow]
+	if bucket.second != second {
+		bucket.second = second
+		bucket.bytes = 0
+	}
+	bucket.bytes += int64(packet.PktLength)
+	if metrics.lastSeen[service] == nil {
+		metrics.lastSeen[service] = make(map[string]int64)
+	}
+	metrics.lastSeen[service][flowKey] = second
+	if second > metrics.latest {
+		metrics.latest = second
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (metrics *serviceMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	keys := make([]serviceDirection, 0, len(metrics.counters))
+	for key := range metrics.counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].direction < keys[j].direction
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# TYPE cloudgaming_service_bytes_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "cloudgaming_service_bytes_total{service=%q,direction=%q} %d\n", key.service, key.direction, metrics.counters[key].bytes)
+	}
+	fmt.Fprintln(w, "# TYPE cloudgaming_service_packets_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "cloudgaming_service_packets_total{service=%q,direction=%q} %d\n", key.service, key.direction, metrics.counters[key].packets)
+	}
+	fmt.Fprintf(w, "# HELP cloudgaming_service_bitrate_bps bitrate over the last %d seconds\n", metricsWindow)
+	fmt.Fprintln(w, "# TYPE cloudgaming_service_bitrate_bps gauge")
+	for _, key := range keys {
+		var bytes int64
+		for _, bucket := range metrics.counters[key].buckets {
+			if metrics.latest-bucket.second < metricsWindow {
+				bytes += bucket.bytes
+			}
+		}
+		fmt.Fprintf(w, "cloudgaming_service_bitrate_bps{service=%q,direction=%q} %d\n", key.service, key.direction, bytes*8/metricsWindow)
+	}
+	fmt.Fprintf(w, "# HELP cloudgaming_service_active_flows flows with a packet in the last %d seconds\n", metricsWindow)
+	fmt.Fprintln(w, "# TYPE cloudgaming_service_active_flows gauge")
+	services := make([]string, 0, len(metrics.lastSeen))
+	for service := range metrics.lastSeen {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		active := 0
+		for flowKey, second := range metrics.lastSeen[service] {
+			if metrics.latest-second < metricsWindow {
+				active++
+			} else {
+				// idle flows are forgotten, they count again once a packet arrives
+				delete(metrics.lastSeen[service], flowKey)
+			}
+		}
+		fmt.Fprintf(w, "cloudgaming_service_active_flows{service=%q} %d\n", service, active)
+	}
+}
@@ -0,0 +1,139 @@
+package pktstats
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// managementRole is the ServiceFlowType of the capture host's own management
+// traffic, e.g. SSH sessions and the rsync of the captures off the box, with
+// Options.ExcludeMgmt.
+const managementRole = "management"
+
+// mgmtEndpoint is an entry of Options.MgmtEndpoints: a port of the capture
+// host ("22"), any port of a host ("10.0.0.5") or a port of a host
+// ("10.0.0.5:873").
+type mgmtEndpoint struct {
+	ip   string // empty for the capture host
+	port int    // 0 for any port
+}
+
+func parseMgmtEndpoints(list string) ([]mgmtEndpoint, error) {
+	var endpoints []mgmtEndpoint
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var endpoint mgmtEndpoint
+		host, port := item, ""
+		if h, p, err := net.SplitHostPort(item); err == nil {
+			host, port = h, p
+		} else if !strings.Contains(item, ".") && !strings.Contains(item, ":") {
+			host, port = "", item
+		}
+		if host != "" {
+			if net.ParseIP(host) == nil {
+				return nil, fmt.Errorf("invalid management endpoint %q", item)
+			}
+			endpoint.ip = host
+		}
+		if port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil || p <= 0 || p > 65535 {
+				return nil, fmt.Errorf("invalid management endpoint %q", item)
+			}
+			endpoint.port = p
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// captureHosts returns the IPs of the capture host: Options.CaptureHost if
+// set, otherwise the local IPs serving one of the capture host's management
+// ports in flowMap, as the capture box is the one managed over them.
+func captureHosts(flowMap map[string]*Flow, endpoints []mgmtEndpoint, captureHost string) map[string]bool {
+	hosts := make(map[string]bool)
+	if captureHost != "" {
+		for _, ip := range strings.Split(captureHost, ",") {
+			hosts[strings.TrimSpace(ip)] = true
+		}
+		return hosts
+	}
+	ports := make(map[int]bool)
+	for _, endpoint := range endpoints {
+		if endpoint.ip == "" {
+			ports[endpoint.port] = true
+		}
+	}
+	for _, flow := range flowMap {
+		if ports[flow.LocalPort] && flow.RemotePort != flow.LocalPort {
+			hosts[flow.LocalIP] = true
+		}
+		// in LAN flows, the remote endpoint is local too
+		if flow.Direction == DirectionLocal && ports[flow.RemotePort] && flow.LocalPort != flow.RemotePort {
+			hosts[flow.RemoteIP] = true
+		}
+	}
+	return hosts
+}
+
+// isManagement reports whether a flow matches one of the management endpoints.
+func (flow *Flow) isManagement(endpoints []mgmtEndpoint, hosts map[string]bool) bool {
+	for _, endpoint := range endpoints {
+		switch {
+		case endpoint.ip == "":
+			if (hosts[flow.LocalIP] || hosts[flow.RemoteIP]) && (flow.LocalPort == endpoint.port || flow.RemotePort == endpoint.port) {
+				return true
+			}
+		case endpoint.port == 0:
+			if flow.LocalIP == endpoint.ip || flow.RemoteIP == endpoint.ip {
+				return true
+			}
+		default:
+			if flow.LocalIP == endpoint.ip && flow.LocalPort == endpoint.port || flow.RemoteIP == endpoint.ip && flow.RemotePort == endpoint.port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// managementStats sums the management flows of a file.
+type managementStats struct {
+	hosts   []string // capture host IPs, sorted
+	flows   []*Flow
+	packets int64
+	bytes   int64
+}
+
+// tagManagement gives the management flows of flowMap managementRole, which
+// leaves them out of the service rollups, and removes them from flowMap with
+// Options.MgmtDrop. Totals count all packets of the flows, stored or not.
+func tagManagement(flowMap map[string]*Flow, opts Options) managementStats {
+	var stats managementStats
+	endpoints, _ := parseMgmtEndpoints(opts.MgmtEndpoints)
+	hosts := captureHosts(flowMap, endpoints, opts.CaptureHost)
+	for ip := range hosts {
+		stats.hosts = append(stats.hosts, ip)
+	}
+	sort.Strings(stats.hosts)
+	for key, flow := range flowMap {
+		if !flow.isManagement(endpoints, hosts) {
+			continue
+		}
+		flow.ServiceFlowType = managementRole
+		flow.LabelSource, flow.LabelConfidence = labelMgmt, 1
+		stats.flows = append(stats.flows, flow)
+		stats.packets += int64(flow.download.packets)
+		stats.bytes += flow.download.upBytes + flow.download.downBytes
+		if opts.MgmtDrop {
+			delete(flowMap, key)
+		}
+	}
+	return stats
+}
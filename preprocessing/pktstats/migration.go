@@ -0,0 +1,109 @@
+package pktstats
+
+import "sort"
+
+// Migration is the move of a session's media from one remote server to
+// another, e.g. a cloud gaming session migrated mid-play: the media flow to
+// the old server dies and a new one to a server of the same service starts.
+type Migration struct {
+	SessionID int    `json:"sessionID"`
+	Timestamp int64  `json:"timestamp"` // first packet of the first media flow to NewRemote
+	Service   string `json:"service"`
+	OldRemote string `json:"oldRemote"`
+	NewRemote string `json:"newRemote"`
+	// from the last packet of the media flows to OldRemote to Timestamp,
+	// negative when the new flow started before the old one ended
+	GapMicros int64 `json:"gapMicros"`
+}
+
+// sessionService returns the service a flow's media session is linked under,
+// or "" if the flow is no media flow: UDP flows with a large downstream packet
+// (see Flow.FirstMediaDelayMicros) lasting at least minDuration, in the output
+// precision. Media flows also tagged as input flows keep their service.
+func (flow *Flow) sessionService(minDuration int64) string {
+	if flow.Protocol != 17 || flow.Direction == DirectionUnknown || !flow.firstMedia.found || flow.download.last-flow.download.first < minDuration {
+		return ""
+	}
+	switch flow.ServiceFlowType {
+	case inputRole:
+		return flow.RegisteredDomain
+	case telemetryRole, voiceRole, managementRole:
+		return ""
+	}
+	return flow.ServiceFlowType
+}
+
+// linkSessions groups the media flows of each service and local client into
+// sessions: a flow starting at most Options.SessionGap after the last packet
+// of the session's flows so far continues it. Each flow of a session gets its
+// SessionID, counting from 1 in order of the sessions' first packets. Within a
+// session, a flow to another remote IP than the last one is a migration, short
+// flows such as the probes sent to candidate servers before one is chosen are
+// left out by Options.SessionMinDuration.
+func linkSessions(flowMap map[string]*Flow, opts Options) []Migration {
+	gap, minDuration := opts.duration(opts.SessionGap), opts.duration(opts.SessionMinDuration)
+	groups := make(map[string][]*Flow)
+	var groupKeys []string
+	// in order of first packet arrival, ties broken by flow key
+	for _, key := range sortedFlowKeys(flowMap) {
+		flow := flowMap[key]
+		service := flow.sessionService(minDuration)
+		if service == "" {
+			continue
+		}
+		groupKey := flow.LocalIP + "/" + flow.Subscriber + "#" + service
+		if _, ok := groups[groupKey]; !ok {
+			groupKeys = append(groupKeys, groupKey)
+		}
+		groups[groupKey] = append(groups[groupKey], flow)
+	}
+
+	type session struct {
+		flows      []*Flow
+		migrations []Migration
+	}
+	var sessions []*session
+	for _, groupKey := range groupKeys {
+		var current *session
+		var end, remoteEnd int64 // last packet of the session, and of its flows to the current remote
+		remote := ""
+		for _, flow := range groups[groupKey] {
+			if current == nil || flow.download.first-end > gap {
+				current = &session{}
+				sessions = append(sessions, current)
+				end, remote = flow.download.last, flow.RemoteIP
+				remoteEnd = end
+			} else if flow.RemoteIP != remote {
+				current.migrations = append(current.migrations, Migration{
+					Timestamp: flow.download.first,
+					Service:   flow.sessionService(minDuration),
+					OldRemote: remote,
+					NewRemote: flow.RemoteIP,
+					GapMicros: opts.microseconds(flow.download.first - remoteEnd),
+				})
+				remote, remoteEnd = flow.RemoteIP, flow.download.last
+			}
+			current.flows = append(current.flows, flow)
+			end = max(end, flow.download.last)
+			if flow.RemoteIP == remote {
+				remoteEnd = max(remoteEnd, flow.download.last)
+			}
+		}
+	}
+
+	// sessions of different groups interleave, number them by first packet
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].flows[0].download.first < sessions[j].flows[0].download.first
+	})
+	var migrations []Migration
+	for i, s := range sessions {
+		for _, flow := range s.flows {
+			flow.SessionID = i + 1
+		}
+		for _, migration := range s.migrations {
+			migration.SessionID = i + 1
+			migrations = append(migrations, migration)
+		}
+	}
+	return migrations
+}
@@ -0,0 +1,148 @@
+package pktstats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// timelineFlow is a flow of a synthetic session timeline, downloading from
+// first to last seconds into the capture.
+type timelineFlow struct {
+	localIP     string
+	remoteIP    string
+	remotePort  int
+	protocol    int
+	service     string
+	first, last float64
+	session     int // SessionID wanted
+}
+
+// flow returns the flow from localPort with the state linkSessions reads.
+func (spec timelineFlow) flow(localPort int) *Flow {
+	flow := syntheticFlow(spec.localIP, localPort, spec.remoteIP, spec.remotePort, spec.protocol, spec.first, spec.last)
+	flow.ServiceFlowType, flow.RegisteredDomain = spec.service, spec.service
+	if spec.service == inputRole {
+		flow.RegisteredDomain = "example.com"
+	}
+	flow.Direction = DirectionUpstream
+	flow.firstMedia.found = true
+	return flow
+}
+
+func TestLinkSessions(t *testing.T) {
+	const client, other = "192.168.1.10", "192.168.1.11"
+	const old, moved, probe = "203.0.113.10", "203.0.113.20", "203.0.113.30"
+	media := func(localIP, remoteIP string, remotePort int, first, last float64, session int) timelineFlow {
+		return timelineFlow{localIP, remoteIP, remotePort, 17, "example.com", first, last, session}
+	}
+	migration := func(session int, at float64, oldRemote, newRemote string, gap float64) Migration {
+		return Migration{SessionID: session, Timestamp: int64(at * 1e6), Service: "example.com", OldRemote: oldRemote, NewRemote: newRemote, GapMicros: int64(gap * 1e6)}
+	}
+	tests := []struct {
+		name       string
+		gap        time.Duration // Options.SessionGap, the default when 0
+		minimum    time.Duration // Options.SessionMinDuration, the default when 0
+		flows      []timelineFlow
+		migrations []Migration
+	}{
+		{
+			name:       "migration",
+			flows:      []timelineFlow{media(client, old, 3478, 0, 60, 1), media(client, moved, 3478, 62, 120, 1)},
+			migrations: []Migration{migration(1, 62, old, moved, 2)},
+		},
+		{
+			name:  "beyond the session gap",
+			flows: []timelineFlow{media(client, old, 3478, 0, 60, 1), media(client, moved, 3478, 75, 120, 2)},
+		},
+		{
+			name:       "session gap flag",
+			gap:        20 * time.Second,
+			flows:      []timelineFlow{media(client, old, 3478, 0, 60, 1), media(client, moved, 3478, 75, 120, 1)},
+			migrations: []Migration{migration(1, 75, old, moved, 15)},
+		},
+		{
+			name:       "overlap",
+			flows:      []timelineFlow{media(client, old, 3478, 0, 60, 1), media(client, moved, 3478, 55, 120, 1)},
+			migrations: []Migration{migration(1, 55, old, moved, -5)},
+		},
+		{
+			name:  "new port of the same server",
+			flows: []timelineFlow{media(client, old, 3478, 0, 60, 1), media(client, old, 3479, 61, 120, 1)},
+		},
+		{
+			name: "probe left out",
+			flows: []timelineFlow{
+				media(client, old, 3478, 0, 60, 1),
+				media(client, probe, 3478, 59, 60, 0),
+				media(client, moved, 3478, 62, 120, 1),
+			},
+			migrations: []Migration{migration(1, 62, old, moved, 2)},
+		},
+		{
+			name:    "session min duration flag",
+			minimum: 500 * time.Millisecond,
+			flows: []timelineFlow{
+				media(client, old, 3478, 0, 60, 1),
+				media(client, probe, 3478, 59, 60, 1),
+				media(client, moved, 3478, 62, 120, 1),
+			},
+			migrations: []Migration{migration(1, 59, old, probe, -1), migration(1, 62, probe, moved, 2)},
+		},
+		{
+			name: "migration back",
+			flows: []timelineFlow{
+				media(client, old, 3478, 0, 30, 1),
+				media(client, moved, 3478, 31, 60, 1),
+				media(client, old, 3478, 61, 90, 1),
+			},
+			migrations: []Migration{migration(1, 31, old, moved, 1), migration(1, 61, moved, old, 1)},
+		},
+		{
+			name: "clients and services apart",
+			flows: []timelineFlow{
+				media(client, old, 3478, 0, 60, 1),
+				media(other, moved, 3478, 1, 60, 2),
+				{client, moved, 3478, 17, "example.net", 2, 60, 3},
+			},
+		},
+		{
+			name: "no media flows",
+			flows: []timelineFlow{
+				{client, old, 443, 6, "example.com", 0, 60, 0},
+				{client, old, 4000, 17, telemetryRole, 0, 60, 0},
+				{client, old, 3478, 17, "", 0, 60, 0},
+			},
+		},
+		{
+			name: "input flows keep their service",
+			flows: []timelineFlow{
+				{client, old, 3478, 17, inputRole, 0, 60, 1},
+				media(client, moved, 3478, 62, 120, 1),
+			},
+			migrations: []Migration{migration(1, 62, old, moved, 2)},
+		},
+	}
+	for _, test := range tests {
+		opts := DefaultOptions()
+		if test.gap > 0 {
+			opts.SessionGap = test.gap
+		}
+		if test.minimum > 0 {
+			opts.SessionMinDuration = test.minimum
+		}
+		flows := make([]*Flow, len(test.flows))
+		for i, spec := range test.flows {
+			flows[i] = spec.flow(50000 + i)
+		}
+		migrations := linkSessions(keyedFlows(flows), opts)
+		for i, spec := range test.flows {
+			if got := flows[i].SessionID; got != spec.session {
+				t.Errorf("%s: flow %s in session %d, want %d", test.name, flows[i].getFlowID(), got, spec.session)
+			}
+		}
+		if !reflect.DeepEqual(migrations, test.migrations) {
+			t.Errorf("%s: migrations %+v, want %+v", test.name, migrations, test.migrations)
+		}
+	}
+}
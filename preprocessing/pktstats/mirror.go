@@ -0,0 +1,128 @@
+package pktstats
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interface roles of Options.InterfaceRoles, by pcapng interface ID.
+const (
+	interfaceWire   = "wire"             // packets as sent on the network, the role of unlisted interfaces
+	interfaceMirror = "decrypted-mirror" // decrypted copies of wire packets, e.g. re-injected by a TLS-terminating proxy
+)
+
+var interfaceRoleNames = []string{interfaceWire, interfaceMirror}
+
+// mirrorKeySuffix ends the keys of mirror flows, which usually have the
+// tuple of the wire flow they copy.
+const mirrorKeySuffix = "~mirror"
+
+// mirrorLinkWindow is the largest difference between the first packets of a
+// mirror flow and of a wire flow of the same remote endpoint for them to be
+// linked, when no wire flow has the tuple of the mirror flow.
+const mirrorLinkWindow = time.Second
+
+// Matches of MirrorLink.
+const (
+	mirrorMatchTuple    = "tuple"    // the wire flow has the same tuple
+	mirrorMatchEndpoint = "endpoint" // the wire flow has the same remote endpoint and protocol, and the nearest first packet
+)
+
+// MirrorLink marks a flow read on a decrypted-mirror interface and links it
+// to the wire flow it copies. Mirror flows are stored apart from the wire
+// flows and left out of the rollups, so their bytes are not counted twice.
+type MirrorLink struct {
+	Interface int    `json:"interface"`          // pcapng interface ID the flow was read on
+	WireFlow  string `json:"wireFlow,omitempty"` // key of the wire flow, empty if none matched
+	Match     string `json:"match,omitempty"`    // how the wire flow matched: tuple or endpoint
+	// first packet of the mirror flow minus that of the wire flow, in output
+	// timestamp units
+	StartOffset int64 `json:"startOffset"`
+}
+
+// interfaceRoles maps pcapng interface IDs to their role, see
+// Options.InterfaceRoles.
+type interfaceRoles map[int]string
+
+// parseInterfaceRoles parses comma-separated <interface ID>=<role> pairs,
+// e.g. "0=wire,1=decrypted-mirror".
+func parseInterfaceRoles(text string) (interfaceRoles, error) {
+	roles := make(interfaceRoles)
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, role, found := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(id))
+		if !found || err != nil || n < 0 {
+			return nil, fmt.Errorf("expected <interface ID>=<role>, got %q", entry)
+		}
+		role = strings.TrimSpace(role)
+		if !containsString(interfaceRoleNames, role) {
+			return nil, fmt.Errorf("unknown role %q of interface %d, expected one of %s", role, n, strings.Join(interfaceRoleNames, ", "))
+		}
+		roles[n] = role
+	}
+	return roles, nil
+}
+
+// mirrored reports whether the packets of a pcapng interface are decrypted
+// copies of wire packets.
+func (roles interfaceRoles) mirrored(id int) bool {
+	return roles[id] == interfaceMirror
+}
+
+// linkMirrors links each mirror flow to the wire flow of flowMap it copies:
+// the one with its tuple or else, within mirrorLinkWindow, the one of the
+// same remote endpoint and protocol whose first packet is nearest.
+// @return the number of mirror flows left unlinked
+func linkMirrors(mirrorFlowMap, flowMap map[string]*Flow, opts Options) int {
+	window := opts.duration(mirrorLinkWindow)
+	byEndpoint := make(map[string][]*Flow)
+	for _, key := range sortedFlowKeys(flowMap) {
+		flow := flowMap[key]
+		endpoint := flow.RemoteIP + ":" + strconv.Itoa(flow.RemotePort) + "@" + strconv.Itoa(flow.Protocol)
+		byEndpoint[endpoint] = append(byEndpoint[endpoint], flow)
+	}
+	unlinked := 0
+	for key, mirror := range mirrorFlowMap {
+		first := mirror.Packets[0].Timestamp
+		if wire, ok := flowMap[strings.TrimSuffix(key, mirrorKeySuffix)]; ok {
+			mirror.Mirror.WireFlow, mirror.Mirror.Match = wire.getFlowID(), mirrorMatchTuple
+			mirror.Mirror.StartOffset = first - wire.Packets[0].Timestamp
+			continue
+		}
+		candidates := byEndpoint[mirror.RemoteIP+":"+strconv.Itoa(mirror.RemotePort)+"@"+strconv.Itoa(mirror.Protocol)]
+		// candidates are in order of first packet, the nearest one is next to
+		// the first one starting after the mirror flow
+		i := sort.Search(len(candidates), func(i int) bool { return candidates[i].Packets[0].Timestamp >= first })
+		var nearest *Flow
+		for _, j := range []int{i - 1, i} {
+			if j < 0 || j >= len(candidates) {
+				continue
+			}
+			if distance := startDistance(mirror, candidates[j]); distance <= window && (nearest == nil || distance < startDistance(mirror, nearest)) {
+				nearest = candidates[j]
+			}
+		}
+		if nearest == nil {
+			unlinked++
+			continue
+		}
+		mirror.Mirror.WireFlow, mirror.Mirror.Match = nearest.getFlowID(), mirrorMatchEndpoint
+		mirror.Mirror.StartOffset = first - nearest.Packets[0].Timestamp
+	}
+	return unlinked
+}
+
+// startDistance is the time between the first packets of two flows.
+func startDistance(a, b *Flow) int64 {
+	if distance := a.Packets[0].Timestamp - b.Packets[0].Timestamp; distance > 0 {
+		return distance
+	}
+	return b.Packets[0].Timestamp - a.Packets[0].Timestamp
+}
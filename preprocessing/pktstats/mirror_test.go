@@ -0,0 +1,129 @@
+package pktstats
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// mirrorCapture is the flows capture in pcapng, with the packets of the game
+// flow copied 2 ms later on a second interface.
+func mirrorCapture(t testing.TB) []byte {
+	var buffer bytes.Buffer
+	writer, err := pcapgo.NewNgWriter(&buffer, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := writer.AddInterface(pcapgo.NgInterface{Name: "mirror", LinkType: layers.LinkTypeEthernet, SnapLength: 65535})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the game flow follows the DNS responses and the store flow
+	for i, packet := range flowsCapture(t) {
+		ci := gopacket.CaptureInfo{Timestamp: fixtureStart.Add(packet.at), CaptureLength: len(packet.data), Length: len(packet.data)}
+		if err := writer.WritePacket(ci, packet.data); err != nil {
+			t.Fatal(err)
+		}
+		if i >= 10 {
+			ci.Timestamp, ci.InterfaceIndex = ci.Timestamp.Add(2*time.Millisecond), mirror
+			if err := writer.WritePacket(ci, packet.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestParseInterfaceRoles(t *testing.T) {
+	tests := []struct {
+		roles string
+		want  interfaceRoles
+		err   bool
+	}{
+		{"0=wire,1=decrypted-mirror", interfaceRoles{0: interfaceWire, 1: interfaceMirror}, false},
+		{" 2 = decrypted-mirror , ", interfaceRoles{2: interfaceMirror}, false},
+		{"", interfaceRoles{}, false},
+		{"1=mirror", nil, true},
+		{"eth1=decrypted-mirror", nil, true},
+		{"-1=wire", nil, true},
+		{"1", nil, true},
+	}
+	for _, test := range tests {
+		roles, err := parseInterfaceRoles(test.roles)
+		if (err != nil) != test.err || !test.err && !reflect.DeepEqual(roles, test.want) {
+			t.Errorf("%q: roles %v (%v), want %v", test.roles, roles, err, test.want)
+		}
+	}
+}
+
+// TestLinkMirrors links a mirror flow at a time to the wire flows of two
+// game flows to the same server, 2 s apart, and a store flow.
+func TestLinkMirrors(t *testing.T) {
+	const client, game, store = "192.168.1.10", "203.0.113.10", "198.51.100.7"
+	wire := []*Flow{
+		syntheticFlow(client, 50000, game, 3478, 17, 1, 60),
+		syntheticFlow(client, 50002, game, 3478, 17, 3, 60),
+		syntheticFlow(client, 50100, store, 443, 6, 0.5, 1),
+	}
+	tests := []struct {
+		name        string
+		mirror      *Flow
+		wireFlow    string // empty for none
+		match       string
+		startOffset int64
+	}{
+		{"same tuple", syntheticFlow(client, 50000, game, 3478, 17, 1.2, 60), wire[0].getFlowID(), mirrorMatchTuple, 200000},
+		{"same tuple long after", syntheticFlow(client, 50100, store, 443, 6, 30, 31), wire[2].getFlowID(), mirrorMatchTuple, 29500000},
+		{"nearest start after", syntheticFlow(client, 51000, game, 3478, 17, 2.9, 60), wire[1].getFlowID(), mirrorMatchEndpoint, -100000},
+		{"nearest start before", syntheticFlow(client, 51000, game, 3478, 17, 1.4, 60), wire[0].getFlowID(), mirrorMatchEndpoint, 400000},
+		{"outside the window", syntheticFlow(client, 51000, game, 3478, 17, 5, 60), "", "", 0},
+		{"other protocol", syntheticFlow(client, 51000, game, 3478, 6, 1, 60), "", "", 0},
+		{"other port", syntheticFlow(client, 51000, game, 3479, 17, 1, 60), "", "", 0},
+	}
+	for _, test := range tests {
+		test.mirror.Mirror = &MirrorLink{Interface: 1}
+		unlinked := linkMirrors(keyedFlows([]*Flow{test.mirror}), keyedFlows(wire), DefaultOptions())
+		want := MirrorLink{Interface: 1, WireFlow: test.wireFlow, Match: test.match, StartOffset: test.startOffset}
+		if *test.mirror.Mirror != want {
+			t.Errorf("%s: link %+v, want %+v", test.name, *test.mirror.Mirror, want)
+		}
+		if linked := unlinked == 0; linked != (test.wireFlow != "") {
+			t.Errorf("%s: %d mirror flows unlinked", test.name, unlinked)
+		}
+	}
+}
+
+// TestMirrorExtraction extracts the capture with a mirror interface: the game
+// flow read on it is stored apart and linked to its wire flow, and the totals
+// of the wire flows are those of the capture without it.
+func TestMirrorExtraction(t *testing.T) {
+	const game = "192.168.1.10:50000-203.0.113.10:3478@17"
+	wire, _ := extractFixture(t, fixture(t, "flows.pcap", flowsCapture), testOptions())
+	opts := testOptions()
+	opts.InterfaceRoles = "1=decrypted-mirror"
+	output, _ := extractFixture(t, rawFixture(t, "mirror.pcapng", mirrorCapture), opts)
+
+	if len(output.Flows) != len(wire.Flows) || len(output.MirrorFlows) != 1 {
+		t.Fatalf("%d flows and %d mirror flows, want %d and 1", len(output.Flows), len(output.MirrorFlows), len(wire.Flows))
+	}
+	mirror := output.MirrorFlows[game+mirrorKeySuffix]
+	if mirror == nil || *mirror.Mirror != (MirrorLink{Interface: 1, WireFlow: game, Match: mirrorMatchTuple, StartOffset: 2000}) {
+		t.Errorf("mirror flows %v, want the game flow linked by tuple", output.MirrorFlows)
+	}
+	meta := output.Meta
+	if meta.AccountedPackets != wire.Meta.AccountedPackets || meta.AccountedBytes != wire.Meta.AccountedBytes || meta.MirrorPackets != 40 || meta.MirrorBytes != 25470 {
+		t.Errorf("%d packets of %d bytes accounted and %d of %d mirrored, want %d of %d and the 40 packets of 25470 bytes of the game flow",
+			meta.AccountedPackets, meta.AccountedBytes, meta.MirrorPackets, meta.MirrorBytes, wire.Meta.AccountedPackets, wire.Meta.AccountedBytes)
+	}
+	if services := meta.Services["example.com"]; services == nil || services.Flows != 1 {
+		t.Errorf("game service rollup %+v, want the wire flow only", services)
+	}
+}
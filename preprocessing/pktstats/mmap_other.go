@@ -0,0 +1,10 @@
+//go:build !unix
+
+package pktstats
+
+import "os"
+
+// mapFile is not supported on this platform, captures are read from the file.
+func mapFile(file *os.File, size int64) ([]byte, func(), error) {
+	return nil, nil, errMmapUnsupported
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package pktstats
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile maps a file read-only, advising the kernel that it is read
+// sequentially so that it reads ahead and drops the pages behind.
+func mapFile(file *os.File, size int64) ([]byte, func(), error) {
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil, errMmapUnsupported
+	}
+	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	// only a hint, the mapping is read the same without it
+	_ = unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	return data, func() { unix.Munmap(data) }, nil
+}
@@ -0,0 +1,92 @@
+package pktstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Output fields are named in lowerCamel case by their json struct tags. With
+// Options.LegacyNames, outputs keep the Go field names used before schema
+// version 3 (e.g. SrcIP instead of srcIP). As both spellings only differ in
+// case, which encoding/json ignores when decoding, outputs of either naming
+// load into the same structs.
+
+// legacyFieldNames maps the json names of the fields of the output, ndjson record,
+// aggregate and manifest structs to their Go names.
+var legacyFieldNames = legacyNames(reflect.TypeOf(Output{}), reflect.TypeOf(packetRecord{}), reflect.TypeOf(AggregateStats{}), reflect.TypeOf(Manifest{}), reflect.TypeOf(CaptureIndex{}))
+
+func legacyNames(types ...reflect.Type) map[string]string {
+	names := make(map[string]string)
+	seen := make(map[reflect.Type]bool)
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+			walk(t.Elem())
+			return
+		case reflect.Struct:
+		default:
+			return
+		}
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name != "" && name != "-" && !field.Anonymous {
+				names[name] = field.Name
+			}
+			walk(field.Type)
+		}
+	}
+	for _, t := range types {
+		walk(t)
+	}
+	return names
+}
+
+// jsonObjectKey matches an object key in encoded JSON. A key always follows
+// the opening brace or a comma, while a quote inside a string is escaped.
+var jsonObjectKey = regexp.MustCompile(`([{,]\s*)"([A-Za-z0-9]+)"(\s*:)`)
+
+// withLegacyNames renames the object keys of encoded JSON that are json names
+// of output fields to their legacy Go names. Map keys such as flow keys and
+// registered domains contain separators and never match a field name.
+func withLegacyNames(data []byte) []byte {
+	return jsonObjectKey.ReplaceAllFunc(data, func(match []byte) []byte {
+		parts := jsonObjectKey.FindSubmatch(match)
+		legacy, ok := legacyFieldNames[string(parts[2])]
+		if !ok {
+			return match
+		}
+		return bytes.Join([][]byte{parts[1], []byte(`"` + legacy + `"`), parts[3]}, nil)
+	})
+}
+
+// marshalOutput encodes v as JSON, with legacy field names if requested.
+func marshalOutput(v interface{}, legacy bool) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || !legacy {
+		return data, err
+	}
+	return withLegacyNames(data), nil
+}
+
+// outputFieldName returns the name of an output field as written: its json
+// name, or its Go name with Options.LegacyNames.
+func outputFieldName(name string, legacy bool) string {
+	if legacy {
+		if goName, ok := legacyFieldNames[name]; ok {
+			return goName
+		}
+	}
+	return name
+}
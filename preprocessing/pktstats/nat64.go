@@ -0,0 +1,78 @@
+package pktstats
+
+import (
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// icmpv6OptPREF64 is the Router Advertisement option announcing the NAT64 prefix (RFC 8781).
+const icmpv6OptPREF64 layers.ICMPv6Opt = 38
+
+// nat64Prefixes are the prefixes DNS64 uses to synthesize AAAA records from A
+// records: the well-known 64:ff9b::/96 and any prefix announced in Router
+// Advertisements seen in the capture.
+type nat64Prefixes []*net.IPNet
+
+func newNAT64Prefixes() nat64Prefixes {
+	_, wellKnown, _ := net.ParseCIDR("64:ff9b::/96")
+	return nat64Prefixes{wellKnown}
+}
+
+// pref64Lengths maps the prefix length code of the PREF64 option to the prefix length.
+var pref64Lengths = [...]int{96, 64, 56, 48, 40, 32}
+
+// learnFromRA adds the NAT64 prefix announced by a Router Advertisement, if any.
+func (prefixes *nat64Prefixes) learnFromRA(ra *layers.ICMPv6RouterAdvertisement) {
+	for _, opt := range ra.Options {
+		if opt.Type != icmpv6OptPREF64 || len(opt.Data) != 14 {
+			continue
+		}
+		code := int(opt.Data[1] & 0x07)
+		if code >= len(pref64Lengths) {
+			continue
+		}
+		prefix := make(net.IP, net.IPv6len)
+		copy(prefix, opt.Data[2:14])
+		mask := net.CIDRMask(pref64Lengths[code], 128)
+		announced := &net.IPNet{IP: prefix.Mask(mask), Mask: mask}
+		known := false
+		for _, p := range *prefixes {
+			known = known || p.String() == announced.String()
+		}
+		if !known {
+			*prefixes = append(*prefixes, announced)
+		}
+	}
+}
+
+// embeddedIPv4 returns the IPv4 address embedded in a NAT64-synthesized IPv6
+// address following RFC 6052, or nil if the address is in none of the prefixes.
+func (prefixes nat64Prefixes) embeddedIPv4(ip net.IP) net.IP {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	for _, prefix := range prefixes {
+		if !prefix.Contains(ip) {
+			continue
+		}
+		// bits 64-71 are the reserved "u" octet and never carry address bits
+		length, _ := prefix.Mask.Size()
+		switch length {
+		case 32:
+			return net.IPv4(ip[4], ip[5], ip[6], ip[7])
+		case 40:
+			return net.IPv4(ip[5], ip[6], ip[7], ip[9])
+		case 48:
+			return net.IPv4(ip[6], ip[7], ip[9], ip[10])
+		case 56:
+			return net.IPv4(ip[7], ip[9], ip[10], ip[11])
+		case 64:
+			return net.IPv4(ip[9], ip[10], ip[11], ip[12])
+		case 96:
+			return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package pktstats
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TestEmbeddedIPv4 extracts 192.0.2.33 from the synthesized addresses of
+// each prefix length of RFC 6052, section 2.4.
+func TestEmbeddedIPv4(t *testing.T) {
+	tests := []struct {
+		prefix string
+		ip     string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::", "192.0.2.33"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::", "192.0.2.33"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::", "192.0.2.33"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::", "192.0.2.33"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0", "192.0.2.33"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33", "192.0.2.33"},
+		{"", "64:ff9b::192.0.2.33", "192.0.2.33"},
+		{"", "2001:db8:122:344::192.0.2.33", ""}, // not in a known prefix
+		{"", "192.0.2.33", ""},
+	}
+	for _, test := range tests {
+		prefixes := newNAT64Prefixes()
+		if test.prefix != "" {
+			_, prefix, err := net.ParseCIDR(test.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		got := prefixes.embeddedIPv4(net.ParseIP(test.ip))
+		if (got == nil) != (test.want == "") || (got != nil && got.String() != test.want) {
+			t.Errorf("%s in %s: embedded address %v, want %q", test.ip, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestLearnFromRA(t *testing.T) {
+	pref64 := func(code byte, prefix string) layers.ICMPv6Option {
+		return layers.ICMPv6Option{Type: icmpv6OptPREF64, Data: append([]byte{0x0a, 0x08 | code}, net.ParseIP(prefix)[:12]...)}
+	}
+	tests := []struct {
+		name    string
+		options layers.ICMPv6Options
+		want    []string
+	}{
+		{"no option", nil, []string{"64:ff9b::/96"}},
+		{"96", layers.ICMPv6Options{pref64(0, "2001:db8:64::")}, []string{"64:ff9b::/96", "2001:db8:64::/96"}},
+		{"32", layers.ICMPv6Options{pref64(5, "2001:db8::")}, []string{"64:ff9b::/96", "2001:db8::/32"}},
+		{"well-known", layers.ICMPv6Options{pref64(0, "64:ff9b::")}, []string{"64:ff9b::/96"}},
+		{"announced twice", layers.ICMPv6Options{pref64(1, "2001:db8:1:2::"), pref64(1, "2001:db8:1:2::")}, []string{"64:ff9b::/96", "2001:db8:1:2::/64"}},
+		{"invalid length code", layers.ICMPv6Options{pref64(6, "2001:db8:64::")}, []string{"64:ff9b::/96"}},
+		{"short option", layers.ICMPv6Options{{Type: icmpv6OptPREF64, Data: []byte{0x0a, 0x08, 0x20, 0x01}}}, []string{"64:ff9b::/96"}},
+	}
+	for _, test := range tests {
+		prefixes := newNAT64Prefixes()
+		prefixes.learnFromRA(&layers.ICMPv6RouterAdvertisement{Options: test.options})
+		var got []string
+		for _, prefix := range prefixes {
+			got = append(got, prefix.String())
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: prefixes %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: prefixes %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
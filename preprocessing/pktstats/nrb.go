@@ -0,0 +1,130 @@
+package pktstats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+)
+
+// nrbConfidence is the confidence in labels from name resolution blocks:
+// Wireshark saves the names it resolved, which may come from PTR lookups on
+// the analyst's machine rather than from the capture.
+const nrbConfidence = 0.8
+
+// readNameResolution returns the IPv4 and IPv6 records of the pcapng name
+// resolution blocks of a capture, first name per address. Blocks are read
+// before the first packet and, walking backwards as in readKernelDrops, after
+// the last one, where Wireshark writes resolved names when saving a file;
+// packet data is skipped. Blocks interleaved with packets are not read.
+// Files that are not pcapng (including compressed captures) and streams have
+// no records.
+func readNameResolution(filePath string) (map[string]string, error) {
+	if filePath == stdinInput || isRemoteInput(filePath) {
+		return nil, nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, err
+	}
+	order, ok := pcapngByteOrder(header)
+	if !ok {
+		return nil, nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	// readBlock reads the block at start, returning false for packet blocks
+	readBlock := func(start, length int64) (bool, error) {
+		if length < 12 || start+length > info.Size() {
+			return false, errors.New("corrupt pcapng block length")
+		}
+		blockType := make([]byte, 4)
+		if _, err := file.ReadAt(blockType, start); err != nil {
+			return false, err
+		}
+		switch order.Uint32(blockType) {
+		case pcapngPacket, pcapngSimplePacket, pcapngEnhancedPacket:
+			return false, nil
+		case pcapngNameResolution:
+			block := make([]byte, length)
+			if _, err := file.ReadAt(block, start); err != nil {
+				return false, err
+			}
+			parseNameRecords(block[8:length-4], order, names)
+		}
+		return true, nil
+	}
+
+	// leading blocks, up to the first packet
+	start := int64(0)
+	lengthField := make([]byte, 4)
+	for start+12 <= info.Size() {
+		if _, err := file.ReadAt(lengthField, start+4); err != nil {
+			return nil, err
+		}
+		length := int64(order.Uint32(lengthField))
+		if more, err := readBlock(start, length); err != nil || !more {
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		start += length
+	}
+	// trailing blocks, back to the last packet
+	end := info.Size()
+	for i := 0; i < pcapngMaxTrailBlocks && end-12 >= start; i++ {
+		if _, err := file.ReadAt(lengthField, end-4); err != nil {
+			return nil, err
+		}
+		length := int64(order.Uint32(lengthField))
+		if more, err := readBlock(end-length, length); err != nil || !more {
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		end -= length
+	}
+	return names, nil
+}
+
+// parseNameRecords adds the IPv4 and IPv6 records of a name resolution block
+// body to names. A record holds an address followed by one or more
+// zero-terminated names; values are padded to 32 bits.
+func parseNameRecords(body []byte, order binary.ByteOrder, names map[string]string) {
+	for len(body) >= 4 {
+		recordType := order.Uint16(body[0:2])
+		length := int(order.Uint16(body[2:4]))
+		if recordType == 0 || 4+length > len(body) {
+			return
+		}
+		value := body[4 : 4+length]
+		addrLen := 0
+		switch recordType {
+		case pcapngNRBIPv4:
+			addrLen = net.IPv4len
+		case pcapngNRBIPv6:
+			addrLen = net.IPv6len
+		}
+		if addrLen > 0 && len(value) > addrLen {
+			name, _, _ := bytes.Cut(value[addrLen:], []byte{0})
+			ip := net.IP(value[:addrLen]).String()
+			if _, ok := names[ip]; !ok {
+				mapDNSName(names, ip, string(name))
+			}
+		}
+		body = body[4+(length+3)/4*4:]
+	}
+}
@@ -0,0 +1,520 @@
+package pktstats
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Options holds the settings that control how packet statistics are extracted.
+type Options struct {
+	// NumPackets is the number of packets to extract per flow, 0 for all packets
+	NumPackets int `json:"numPackets"`
+	// CanonicalKeys orders the endpoints in flow keys by IP:port rather than local-remote
+	CanonicalKeys bool `json:"canonicalKeys"`
+	// Format is the output format: json (flow map), ndjson or csv (one record per packet)
+	Format string `json:"format"`
+	// IndexOnly writes a CaptureIndex of each capture, its flows without packets, instead of the output
+	IndexOnly bool `json:"indexOnly"`
+	// Sketch writes an EndpointSketch of each capture, its top remote endpoints by bytes, instead of the output
+	Sketch bool `json:"sketch"`
+	// SketchTop is the number of remote endpoints listed in each sketch
+	SketchTop int `json:"sketchTop"`
+	// StringKeys makes per-packet records reference flows by full key instead of integer ID
+	StringKeys bool `json:"stringKeys"`
+	// ThirdParty is the policy for packets with no local endpoint: drop or keep
+	ThirdParty string `json:"thirdParty"`
+	// ZeroPayload is the treatment of zero-payload packets: keep, exclude-stats or aggregate, see zeroPayloadModes
+	ZeroPayload string `json:"zeroPayload"`
+	// Devices enables the ARP/DHCP device inventory written to devices.json
+	Devices bool `json:"devices"`
+	// OutTemplate is the output filename template, see defaultOutTemplate
+	OutTemplate string `json:"outTemplate"`
+	// PerClient tags flows with their local client and rolls up traffic per client
+	PerClient bool `json:"perClient"`
+	// PreflightOnly only runs the capture quality checks, without extraction
+	PreflightOnly bool `json:"preflightOnly"`
+	// DNSWarnMinutes is the capture duration after which missing DNS responses are a quality warning
+	DNSWarnMinutes int `json:"dnsWarnMinutes"`
+	// CaptureBytes is the number of initial payload bytes stored per direction per flow, 0 for none
+	CaptureBytes int `json:"captureBytes"`
+	// CaptureFilter selects the flows whose payload is captured, see parsePayloadFilter
+	CaptureFilter string `json:"captureFilter"`
+	// RDNS resolves PTR records for remote IPs without a captured DNS name
+	RDNS bool `json:"rdns"`
+	// RDNSOffline is a pre-built PTR cache consulted instead of live lookups
+	RDNSOffline string `json:"rdnsOffline"`
+	// RDNSTimeout bounds each PTR lookup
+	RDNSTimeout time.Duration `json:"rdnsTimeout"`
+	// LocalSubnets lists the CIDR prefixes of local endpoints, which set the direction of packets
+	LocalSubnets string `json:"localSubnets"`
+	// KeepPorts lists the local ports and port ranges of flows kept without a DNS name, e.g. "49000-49100"
+	KeepPorts string `json:"keepPorts"`
+	// Rules is a JSON file of classifier rules keeping and labeling flows by provider, see ClassifierRule;
+	// KeepPorts is their default rule
+	Rules string `json:"rules"`
+	// LabelPrecedence is the name labeling flows whose SNI and DNS name disagree: dns or sni, see resolveSNI
+	LabelPrecedence string `json:"labelPrecedence"`
+	// InterfaceRoles maps pcapng interface IDs to their role, e.g. "1=decrypted-mirror", see MirrorLink
+	InterfaceRoles string `json:"interfaceRoles"`
+	// TraceFilter selects packets, by a flow tuple or a BPF expression, whose filtering decisions are traced, see filterTracer
+	TraceFilter string `json:"traceFilter"`
+	// TracePackets is the number of packets traced per output with TraceFilter
+	TracePackets int `json:"tracePackets"`
+	// KeyLog is an SSLKEYLOGFILE whose secrets decrypt the TLS and QUIC flows of their connections, see Negotiation
+	KeyLog string `json:"keyLog"`
+	// ExtractPayloads records the JSON fields of NegotiationPaths found in decrypted messages; nothing decrypted is written without it
+	ExtractPayloads bool `json:"extractPayloads"`
+	// NegotiationPaths lists the dot-separated paths of the JSON fields recorded with ExtractPayloads, e.g. "video.codec,bitrate"
+	NegotiationPaths string `json:"negotiationPaths"`
+	// RemotePrefixes lists the CIDR prefixes of the remote endpoints whose flows are extracted, or @file; empty for all
+	RemotePrefixes string `json:"remotePrefixes"`
+	// DNSPorts lists the ports DNS responses are sent from, e.g. "53,5353"
+	DNSPorts string `json:"dnsPorts"`
+	// SignaturePackets is the number of packets in each flow's signature, 0 for no signature
+	SignaturePackets int `json:"signaturePackets"`
+	// SignatureZeroPayload includes packets without payload in signatures
+	SignatureZeroPayload bool `json:"signatureZeroPayload"`
+	// BulkMinRatio is the minimum downstream/upstream byte ratio of bulk downloads
+	BulkMinRatio float64 `json:"bulkMinRatio"`
+	// BulkMinMbps is the minimum downstream throughput of bulk downloads
+	BulkMinMbps float64 `json:"bulkMinMbps"`
+	// BulkMaxUpPPS is the maximum rate of upstream payload-bearing packets of bulk downloads
+	BulkMaxUpPPS float64 `json:"bulkMaxUpPPS"`
+	// InputMaxSize is the largest upstream payload counted in the input periodicity of UDP flows, 0 to disable it
+	InputMaxSize int `json:"inputMaxSize"`
+	// InputBand is the frequency band, e.g. "60-125", of flows tagged as input flows; empty to disable tagging
+	InputBand string `json:"inputBand"`
+	// VoiceMinSize and VoiceMaxSize bound the upstream UDP payloads counted in the voice pacing
+	VoiceMinSize int `json:"voiceMinSize"`
+	VoiceMaxSize int `json:"voiceMaxSize"`
+	// VoiceBands are the frequency bands, e.g. "45-55", of the pacing of flows tagged as voice flows; empty to disable detection
+	VoiceBands string `json:"voiceBands"`
+	// InputList is a file listing the inputs, local paths or s3:// and http(s):// URLs, instead of walking the base path
+	InputList string `json:"inputList"`
+	// Watch keeps the run going, processing capture files under the base path as they are completed
+	Watch bool `json:"watch"`
+	// WatchInterval is the interval between scans of the base path with Watch
+	WatchInterval time.Duration `json:"watchInterval"`
+	// WatchGrace is how long a file's size must be stable before it is processed with Watch
+	WatchGrace time.Duration `json:"watchGrace"`
+	// SkipAnyExisting skips inputs whose output exists even if it was extracted with other options, see skipExisting
+	SkipAnyExisting bool `json:"skipAnyExisting"`
+	// Force processes inputs whose output already exists
+	Force bool `json:"force"`
+	// Order is the order in which inputs are dispatched, see inputOrders; empty for walk or list order
+	Order string `json:"order"`
+	// PriorityGlob matches inputs dispatched before all others, by file name or path
+	PriorityGlob string `json:"priorityGlob"`
+	// Sample is the fraction of the inputs processed, selected by the hash of their path and Seed, 0 for all, see sampleInputs
+	Sample float64 `json:"sample"`
+	// SampleCount is the number of inputs processed, selected like with Sample, 0 for all
+	SampleCount int `json:"sampleCount"`
+	// Seed is the seed of the selection of Sample and SampleCount
+	Seed int64 `json:"seed"`
+	// LegacyNames writes output fields with the Go field names of schema versions before 3, e.g. SrcIP instead of srcIP
+	LegacyNames bool `json:"legacyNames,omitempty"`
+	// NoFingerprints leaves out the per local IP fingerprints (Meta.LocalEndpoints), e.g. for privacy-sensitive exports
+	NoFingerprints bool `json:"noFingerprints"`
+	// VerifyChecksums validates IPv4 and TCP/UDP checksums, counting the results and marking packets with BadChecksum
+	VerifyChecksums bool `json:"verifyChecksums"`
+	// IPHeaderFields adds the IPv4 identification and don't fragment flag of each packet (IPID, DF), or its IPv6 flow label (FlowLabel)
+	IPHeaderFields bool `json:"ipHeaderFields"`
+	// MaxFlows is the soft limit on tracked flows: beyond it, idle unlabeled flows are evicted and only labeled flows are created; 0 for no limit
+	MaxFlows int `json:"maxFlows"`
+	// MaxFlowsHard is the limit beyond which no flow is created, 0 for twice MaxFlows
+	MaxFlowsHard int `json:"maxFlowsHard"`
+	// BurstGapMicros is the largest gap in µs between downstream packets of one burst, 0 disables burst detection
+	BurstGapMicros int `json:"burstGapMicros"`
+	// BurstMinPackets is the minimum number of packets in a burst
+	BurstMinPackets int `json:"burstMinPackets"`
+	// BurstMinCount is the minimum number of bursts of a flow with a bottleneck rate estimate
+	BurstMinCount int `json:"burstMinCount"`
+	// MediaMinPayload is the smallest downstream payload counted as the first media packet of a flow, see Flow.FirstMediaDelayMicros
+	MediaMinPayload int `json:"mediaMinPayload"`
+	// RampUpSeconds is the window after the first media packet of a flow described in its RampUp, 0 to disable it
+	RampUpSeconds int `json:"rampUpSeconds"`
+	// KeepaliveMaxPayload is the largest payload of a keepalive packet, see measureKeepalive, 0 to disable the detection
+	KeepaliveMaxPayload int `json:"keepaliveMaxPayload"`
+	// KeepaliveMinPeriod is the shortest period of a keepalive regime
+	KeepaliveMinPeriod time.Duration `json:"keepaliveMinPeriod"`
+	// ExcludeIdleConnections leaves idle connections, see classifyIdleConnections, out of the output, counted only in the rollups
+	ExcludeIdleConnections bool `json:"excludeIdleConnections"`
+	// TrimKeepalive ends flows with a keepalive regime at their last non-keepalive packet
+	TrimKeepalive bool `json:"trimKeepalive"`
+	// OngoingIdle is the silence before the end of the capture after which a flow is no longer ongoing, see classifyOutcome
+	OngoingIdle time.Duration `json:"ongoingIdle"`
+	// RatioBin is the bin width of the per-client byte ratio timelines, see RatioTimeline, 0 to disable them
+	RatioBin time.Duration `json:"ratioBin"`
+	// StreamingMinRatio is the minimum downstream/upstream byte ratio of the bins of a likely cloud streaming interval
+	StreamingMinRatio float64 `json:"streamingMinRatio"`
+	// StreamingMinMbps is the minimum rate of the bins of a likely cloud streaming interval
+	StreamingMinMbps float64 `json:"streamingMinMbps"`
+	// StreamingMinDuration is the shortest likely cloud streaming interval
+	StreamingMinDuration time.Duration `json:"streamingMinDuration"`
+	// Finalize is when flows are complete and handed over, see finalizePolicies
+	Finalize string `json:"finalize"`
+	// FlushLinger is how long a closed TCP flow is kept after its FINs or RST before it is flushed
+	FlushLinger time.Duration `json:"flushLinger"`
+	// FlushUDPIdle is how long a UDP flow is idle before it is flushed
+	FlushUDPIdle time.Duration `json:"flushUDPIdle"`
+	// LateArrivals is what becomes of the packets of flows already flushed, see latePolicies
+	LateArrivals string `json:"lateArrivals"`
+	// SessionGap is the largest gap between the media flows of one session, see linkSessions
+	SessionGap time.Duration `json:"sessionGap"`
+	// SessionMinDuration is the shortest media flow linked into sessions
+	SessionMinDuration time.Duration `json:"sessionMinDuration"`
+	// RaceWindow is the largest gap between the starts of the QUIC and TCP flows of a connection race, see assignRacePairs, 0 to disable it
+	RaceWindow time.Duration `json:"raceWindow"`
+	// RaceLoserMaxBytes is the most bytes of the abandoned flow of a race
+	RaceLoserMaxBytes int `json:"raceLoserMaxBytes"`
+	// RaceLoserMaxDuration is the longest duration of the abandoned flow of a race
+	RaceLoserMaxDuration time.Duration `json:"raceLoserMaxDuration"`
+	// LimitBinMillis is the bin width in ms of the app-limited/network-limited classification, 0 to disable it
+	LimitBinMillis int `json:"limitBinMillis"`
+	// LimitWindow is the number of recent bins the p95 rate of the classification is taken over
+	LimitWindow int `json:"limitWindow"`
+	// AppLimitedRatio is the fraction of the recent p95 rate below which a bin without loss signals is app-limited
+	AppLimitedRatio float64 `json:"appLimitedRatio"`
+	// NetworkLimitedRatio is the fraction of the recent p95 rate from which a bin with loss signals is network-limited
+	NetworkLimitedRatio float64 `json:"networkLimitedRatio"`
+	// LearnPrefixes adds the IPv6 prefixes of the router advertisements of a capture to its local subnets, see learnedPrefixes
+	LearnPrefixes bool `json:"learnPrefixes"`
+	// RTPClockRates are the clock rates of RTP payload types, e.g. "96=90000,111=48000", for dynamic ones; see RTPTiming
+	RTPClockRates string `json:"rtpClockRates"`
+	// CongestionScore is the scoring function of the congestion signals of a bin, see congestionScorers
+	CongestionScore string `json:"congestionScore"`
+	// CongestionWeights are the weights of the congestion signals, e.g. "loss=0.5,drop=0.3,cadence=0.2"
+	CongestionWeights string `json:"congestionWeights"`
+	// CongestionThreshold is the score from which a bin is congested, 0 to disable episode detection
+	CongestionThreshold float64 `json:"congestionThreshold"`
+	// File is the only input to process instead of walking the base path, stdinInput to read a stream from stdin
+	File string `json:"file"`
+	// Out is the output path of File, instead of OutTemplate
+	Out string `json:"out"`
+	// DNSSinglePass maps DNS names from the responses as packets are read instead of in a first pass, see learnDNSResponse
+	DNSSinglePass bool `json:"dnsSinglePass"`
+	// Stitch processes the captures of each directory in capture time order on one worker, continuing flows across files
+	Stitch bool `json:"stitch"`
+	// StitchGap is the largest gap in capture time between consecutive files of one stitched session
+	StitchGap time.Duration `json:"stitchGap"`
+	// DryRun only reports the inputs a run would process or skip and their outputs, see DryRun
+	DryRun bool `json:"dryRun"`
+	// ProgressInterval is the interval at which the reading progress of each file is printed, 0 to disable it
+	ProgressInterval time.Duration `json:"progressInterval"`
+	// Jobs is the number of captures processed at once, by batch runs and serve requests together
+	Jobs int `json:"jobs"`
+	// FileTimeout is how long the extraction of a file (or a stitched session) may take before it is abandoned, 0 for no limit
+	FileTimeout time.Duration `json:"fileTimeout"`
+	// ServeAddr is the listen address of the serve subcommand's HTTP API
+	ServeAddr string `json:"serveAddr"`
+	// ServeMaxUploadMB is the largest capture in MiB accepted as an upload by the serve subcommand
+	ServeMaxUploadMB int64 `json:"serveMaxUploadMB"`
+	// ServeTimeout is how long a serve request waits for its output before it is turned into a job
+	ServeTimeout time.Duration `json:"serveTimeout"`
+	// OutputDir holds the local copies of remote inputs, their outputs and, with InputList or File, the run files
+	OutputDir string `json:"outputDir"`
+	// MaxOutputSize is the size in bytes above which OverflowPolicy applies to json outputs, 0 for no limit
+	MaxOutputSize int `json:"maxOutputSize"`
+	// OverflowPolicy handles outputs larger than MaxOutputSize: split, summarize or error
+	OverflowPolicy string `json:"overflowPolicy"`
+	// MaxTotalOutput is the size in bytes of the outputs of a run after which no new file is started, 0 for no limit
+	MaxTotalOutput int64 `json:"maxTotalOutput"`
+	// OutputSpaceFactor is the free space a file needs on the output filesystem to be started, as a multiple of its input size, 0 to skip the check
+	OutputSpaceFactor float64 `json:"outputSpaceFactor"`
+	// GapQuietMs is the shortest period without any packet that is a suspected capture gap, 0 to disable detection
+	GapQuietMs int `json:"gapQuietMs"`
+	// GapMinPPS is the average packet rate above which a capture counts as busy enough for gap detection
+	GapMinPPS float64 `json:"gapMinPPS"`
+	// ClockWarnSeconds is the estimated clock offset above which a quality warning is raised, 0 to disable
+	ClockWarnSeconds float64 `json:"clockWarnSeconds"`
+	// FixClock corrects output timestamps by the estimated clock offset
+	FixClock bool `json:"fixClock"`
+	// TelemetryList replaces the embedded telemetry/ad domain blocklist, see telemetry_domains.txt
+	TelemetryList string `json:"telemetryList"`
+	// ExcludeMgmt tags the capture host's management flows, see tagManagement, and leaves them out of the rollups
+	ExcludeMgmt bool `json:"excludeMgmt"`
+	// MgmtEndpoints lists the management ports of the capture host and management hosts, e.g. "22,10.0.0.5:873"
+	MgmtEndpoints string `json:"mgmtEndpoints"`
+	// MgmtDrop leaves management flows out of the output entirely, with ExcludeMgmt
+	MgmtDrop bool `json:"mgmtDrop"`
+	// CaptureHost lists the capture host's IPs, inferred from the management ports if empty
+	CaptureHost string `json:"captureHost"`
+	// GeoASNDB is a MaxMind-format ASN database locating the remote PoPs of media sessions, see trackPoPChanges
+	GeoASNDB string `json:"geoASNDB"`
+	// GeoCityDB is a MaxMind-format city database locating the remote PoPs of media sessions
+	GeoCityDB string `json:"geoCityDB"`
+	// CGNATLog is a CSV translation log attributing flows of CGNAT external addresses to subscribers
+	CGNATLog string `json:"cgnatLog"`
+	// TimestampPrecision is the unit of packet timestamps: us or ns
+	TimestampPrecision string `json:"timestampPrecision"`
+	// Timezone is the IANA time zone of the capture host's clock, recorded as Meta.CaptureTimezone
+	Timezone string `json:"timezone"`
+	// MetricsAddr is the listen address of the Prometheus metrics endpoint, empty to disable it
+	MetricsAddr string `json:"metricsAddr"`
+	// MetricsServices lists the registered domains labeled in metrics, other services are "other"
+	MetricsServices string `json:"metricsServices"`
+	// Mmap reads uncompressed local capture files from memory maps rather than with libpcap
+	Mmap bool `json:"mmap"`
+	// HashOutputs records the SHA-256 of each output file in a .sha256 sidecar and the run manifest
+	HashOutputs bool `json:"hashOutputs"`
+	// NoFlowIndex leaves out the <output>.idx.json index locating the record of each flow of json and ndjson outputs, see OutputIndex
+	NoFlowIndex bool `json:"noFlowIndex"`
+	// DB is the DSN of the database the results of each file are exported to, see dbExporter; left out
+	// of the outputs, it may hold a password
+	DB string `json:"-"`
+	// DBPacketServices lists the registered domains whose packets are exported to DB too
+	DBPacketServices string `json:"dbPacketServices"`
+	// DNSMap maps IPs to DNS names; when set, it is used instead of building the map from the capture or dns_map.json
+	DNSMap map[string]string `json:"-"`
+	// DNSAnswerSets are the answer sets of the responses DNSMap was built from, see DNSAnswerSet
+	DNSAnswerSets map[string][]DNSAnswerSet `json:"-"`
+
+	optionsHash  string // see optionsHash, set from the flags
+	configFile   string // -config file the options were read from
+	rdns         *rdnsResolver
+	geo          *geoDatabases
+	metrics      *serviceMetrics
+	db           dbExporter
+	translations translationLog
+	captureHash  *captureHasher // with db, set per extraction
+	keyLog       keyLog         // read from KeyLog
+	localNets    localSubnets   // parsed LocalSubnets, set per extraction
+	tracePath    string         // trace file of TraceFilter, set per output
+	// limits the captures processed at once to Jobs, shared by a run and the
+	// requests of ServeMain
+	workers chan struct{}
+}
+
+// fileContext returns the context of the extraction of one file, cancelled
+// after FileTimeout.
+func (opts Options) fileContext() (context.Context, context.CancelFunc) {
+	if opts.FileTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), opts.FileTimeout)
+}
+
+// ValidateExtraction checks the options that control the extraction of a
+// capture, as set by flags or by the options of a serve request.
+func (opts Options) ValidateExtraction() error {
+	if !isOutputFormat(opts.Format) {
+		return fmt.Errorf("unknown output format: %s", opts.Format)
+	}
+	if !isThirdPartyPolicy(opts.ThirdParty) {
+		return fmt.Errorf("unknown third-party policy: %s", opts.ThirdParty)
+	}
+	if !isZeroPayloadMode(opts.ZeroPayload) {
+		return fmt.Errorf("unknown zero-payload mode: %s", opts.ZeroPayload)
+	}
+	if _, err := parseFrequencyBand(opts.InputBand); err != nil {
+		return err
+	}
+	if _, err := parseFrequencyBands(opts.VoiceBands); err != nil {
+		return err
+	}
+	if opts.VoiceMinSize > opts.VoiceMaxSize {
+		return fmt.Errorf("-voice-min-size must not exceed -voice-max-size")
+	}
+	if opts.KeepaliveMaxPayload < 0 || opts.KeepaliveMinPeriod <= 0 {
+		return fmt.Errorf("-keepalive-max-payload must not be negative and -keepalive-min-period must be positive")
+	}
+	if opts.RaceWindow < 0 || opts.RaceLoserMaxBytes < 0 || opts.RaceLoserMaxDuration < 0 {
+		return fmt.Errorf("-race-window, -race-loser-max-bytes and -race-loser-max-duration must not be negative")
+	}
+	if opts.RatioBin < 0 || opts.StreamingMinRatio < 0 || opts.StreamingMinMbps < 0 || opts.StreamingMinDuration < 0 {
+		return fmt.Errorf("-ratio-bin, -streaming-min-ratio, -streaming-min-mbps and -streaming-min-duration must not be negative")
+	}
+	if _, err := parseClockRates(opts.RTPClockRates); err != nil {
+		return err
+	}
+	if !isCongestionScore(opts.CongestionScore) {
+		return fmt.Errorf("unknown congestion score: %s", opts.CongestionScore)
+	}
+	if _, err := parseCongestionWeights(opts.CongestionWeights); err != nil {
+		return err
+	}
+	if opts.CongestionThreshold < 0 {
+		return fmt.Errorf("-congestion-threshold must not be negative")
+	}
+	if !isFinalizePolicy(opts.Finalize) {
+		return fmt.Errorf("unknown finalization policy: %s", opts.Finalize)
+	}
+	if !isLatePolicy(opts.LateArrivals) {
+		return fmt.Errorf("unknown late arrival policy: %s", opts.LateArrivals)
+	}
+	if opts.FlushLinger < 0 || opts.FlushUDPIdle <= 0 {
+		return fmt.Errorf("-flush-linger must not be negative and -flush-udp-idle must be positive")
+	}
+	if !isTimestampPrecision(opts.TimestampPrecision) {
+		return fmt.Errorf("unknown timestamp precision: %s", opts.TimestampPrecision)
+	}
+	if _, err := time.LoadLocation(opts.Timezone); err != nil {
+		return fmt.Errorf("unknown time zone: %s", opts.Timezone)
+	}
+	if _, err := parseLocalSubnets(opts.LocalSubnets); err != nil {
+		return err
+	}
+	if _, err := parsePortRanges(opts.KeepPorts); err != nil {
+		return fmt.Errorf("invalid keep ports: %w", err)
+	}
+	if _, err := newClassifierRules(opts.Rules, opts.KeepPorts); err != nil {
+		return err
+	}
+	if !containsString(labelPrecedences, opts.LabelPrecedence) {
+		return fmt.Errorf("unknown label precedence: %s", opts.LabelPrecedence)
+	}
+	if _, err := parseInterfaceRoles(opts.InterfaceRoles); err != nil {
+		return fmt.Errorf("invalid interface roles: %w", err)
+	}
+	if opts.TraceFilter != "" {
+		if _, _, err := parseTraceFilter(opts.TraceFilter, layers.LinkTypeEthernet); err != nil {
+			return fmt.Errorf("invalid trace filter: %w", err)
+		}
+		if opts.TracePackets < 1 {
+			return fmt.Errorf("-trace-packets must be positive")
+		}
+	}
+	paths, err := parseNegotiationPaths(opts.NegotiationPaths)
+	if err != nil {
+		return fmt.Errorf("invalid negotiation paths: %w", err)
+	}
+	if opts.ExtractPayloads && (opts.KeyLog == "" || len(paths) == 0) {
+		return fmt.Errorf("-extract-payloads needs -keylog and -negotiation-paths")
+	}
+	if len(paths) > 0 && !opts.ExtractPayloads {
+		return fmt.Errorf("-negotiation-paths needs -extract-payloads")
+	}
+	if _, err := parsePorts(opts.DNSPorts); err != nil {
+		return fmt.Errorf("invalid DNS ports: %w", err)
+	}
+	if _, err := parseRemotePrefixes(opts.RemotePrefixes); err != nil {
+		return err
+	}
+	if _, err := parsePayloadFilter(opts.CaptureFilter); err != nil {
+		return err
+	}
+	if _, err := parseMgmtEndpoints(opts.MgmtEndpoints); err != nil {
+		return err
+	}
+	for _, ip := range strings.Split(opts.CaptureHost, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" && net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid capture host IP %q", ip)
+		}
+	}
+	return nil
+}
+
+// ValidateRun checks the options that select the inputs and outputs of a run
+// and how it is carried out, and sets the default output template of
+// IndexOnly and Sketch.
+// @param serve: whether the options are those of ServeMain
+func (opts *Options) ValidateRun(serve bool) error {
+	if opts.Watch && opts.InputList != "" {
+		return fmt.Errorf("-watch cannot be combined with -list")
+	}
+	if opts.File != "" && (opts.Watch || opts.InputList != "") {
+		return fmt.Errorf("-f cannot be combined with -watch or -list")
+	}
+	if opts.Stitch && (opts.Watch || opts.InputList != "" || opts.File != "") {
+		return fmt.Errorf("-stitch only applies to the directories walked under -p, it cannot be combined with -watch, -list or -f")
+	}
+	if opts.Jobs <= 0 {
+		return fmt.Errorf("-j must be positive")
+	}
+	if opts.FileTimeout < 0 {
+		return fmt.Errorf("-file-timeout must not be negative")
+	}
+	if serve && (opts.File != "" || opts.InputList != "" || opts.Stitch || opts.PreflightOnly || opts.DryRun) {
+		return fmt.Errorf("serve cannot be combined with -f, -list, -stitch, -preflight-only or -dry-run, only with -watch")
+	}
+	if serve && (opts.ServeMaxUploadMB <= 0 || opts.ServeTimeout <= 0) {
+		return fmt.Errorf("-serve-max-upload-mb and -serve-timeout must be positive")
+	}
+	if opts.DB != "" && (serve || opts.File == stdinInput) {
+		return fmt.Errorf("-db cannot be combined with serve or -f -: exported rows are keyed by the hash of the capture file")
+	}
+	if opts.DBPacketServices != "" && opts.DB == "" {
+		return fmt.Errorf("-db-packet-services requires -db")
+	}
+	if opts.Sample < 0 || opts.Sample > 1 || opts.SampleCount < 0 {
+		return fmt.Errorf("-sample must be between 0 and 1 and -sample-count must not be negative")
+	}
+	if (opts.Sample > 0 || opts.SampleCount > 0) && (opts.Sample > 0 && opts.SampleCount > 0 || opts.Watch || opts.File != "") {
+		return fmt.Errorf("-sample and -sample-count exclude each other and cannot be combined with -watch or -f")
+	}
+	if opts.DryRun && opts.Watch {
+		return fmt.Errorf("-dry-run cannot be combined with -watch")
+	}
+	if opts.Out != "" && opts.File == "" {
+		return fmt.Errorf("-out requires -f")
+	}
+	if opts.File == stdinInput {
+		// a stream can only be read once, from start to end
+		if opts.Out == "" {
+			return fmt.Errorf("-f - requires -out: there is no input path to derive the output path from")
+		}
+		if !opts.DNSSinglePass {
+			return fmt.Errorf("-f - requires -dns-single-pass: the DNS pass reads the capture a second time with a BPF filter")
+		}
+		if opts.Devices {
+			return fmt.Errorf("-f - cannot be combined with -devices: the device inventory is stored next to the input")
+		}
+		if !opts.Force && outputExists(opts.Out) {
+			return fmt.Errorf("output file %s already exists: inputs from stdin are not skipped, remove it or use -force", opts.Out)
+		}
+	}
+	if opts.Watch && opts.WatchInterval <= 0 {
+		return fmt.Errorf("-watch-interval must be positive")
+	}
+	if opts.MaxTotalOutput < 0 || opts.OutputSpaceFactor < 0 {
+		return fmt.Errorf("-max-total-output and -output-space-factor cannot be negative")
+	}
+	if opts.Order != "" && !isInputOrder(opts.Order) {
+		return fmt.Errorf("unknown input order: %s", opts.Order)
+	}
+	if _, err := filepath.Match(opts.PriorityGlob, ""); err != nil {
+		return fmt.Errorf("invalid priority glob: %w", err)
+	}
+	if !isOverflowPolicy(opts.OverflowPolicy) {
+		return fmt.Errorf("unknown overflow policy: %s", opts.OverflowPolicy)
+	}
+	if opts.MaxOutputSize > 0 && opts.Format != "json" {
+		return fmt.Errorf("-max-output-size requires -format json")
+	}
+	if opts.IndexOnly {
+		if opts.Format != "json" || opts.MaxOutputSize > 0 || opts.PreflightOnly || serve {
+			return fmt.Errorf("-index-only requires -format json and cannot be combined with -max-output-size, -preflight-only or serve")
+		}
+		if opts.OutTemplate == defaultOutTemplate {
+			// next to the full outputs, not in their place
+			opts.OutTemplate = defaultIndexTemplate
+		}
+	}
+	if opts.Sketch {
+		if opts.Format != "json" || opts.IndexOnly || opts.MaxOutputSize > 0 || opts.PreflightOnly || opts.Stitch || serve {
+			return fmt.Errorf("-sketch requires -format json and cannot be combined with -index-only, -max-output-size, -preflight-only, -stitch or serve")
+		}
+		if opts.SketchTop < 1 {
+			return fmt.Errorf("-sketch-top must be at least 1")
+		}
+		if opts.OutTemplate == defaultOutTemplate {
+			opts.OutTemplate = defaultSketchTemplate
+		}
+	}
+	if err := validateOutTemplate(opts.OutTemplate); err != nil {
+		return err
+	}
+	if strings.Contains(opts.OutTemplate, clientToken) && !opts.PerClient {
+		return fmt.Errorf("the {client} output template token requires -per-client")
+	}
+	if strings.Contains(opts.OutTemplate, clientToken) && (opts.IndexOnly || opts.Sketch) {
+		return fmt.Errorf("the {client} output template token cannot be combined with -index-only or -sketch")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package pktstats
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// runFlags select inputs, outputs and how a run is carried out, leaving the
+// content of each output unchanged. They are not part of the options hash.
+var runFlags = map[string]bool{
+	"config": true, "print-config": true, "check-inputs": true, "p": true, "list": true, "f": true, "out": true, "o": true, "out-template": true,
+	"watch": true, "watch-interval": true, "watch-grace": true, "force": true, "skip-any-existing": true,
+	"order": true, "priority-glob": true, "sample": true, "sample-count": true, "seed": true, "dry-run": true, "preflight-only": true, "progress": true, "version": true,
+	"j": true, "file-timeout": true, "serve-addr": true, "serve-max-upload-mb": true, "serve-timeout": true,
+	"metrics-addr": true, "metrics-services": true, "hash-outputs": true,
+	"db": true, "mmap": true, "max-total-output": true, "output-space-factor": true, "correlate-min-confidence": true, "correlate-max-offset": true, "correlate-out": true,
+	"trace-filter": true, "trace-packets": true,
+}
+
+// optionsHash hashes the flags set to other values than their defaults,
+// except runFlags. Options added later therefore do not change the hash of
+// earlier outputs as long as they keep their default, but neither does a
+// change of a default.
+func optionsHash(flags *flag.FlagSet) string {
+	var settings []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if value := f.Value.String(); !runFlags[f.Name] && value != f.DefValue {
+			settings = append(settings, f.Name+"="+value)
+		}
+	})
+	sort.Strings(settings)
+	hash := sha256.New()
+	for _, setting := range settings {
+		fmt.Fprintln(hash, setting)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// HashFlags sets the options hash recorded in the meta block of outputs, see
+// optionsHash, from the parsed flags, which hold the values of a -config
+// file too.
+func (opts *Options) HashFlags(flags *flag.FlagSet) {
+	opts.optionsHash = optionsHash(flags)
+}
+
+// skipExisting decides whether an input whose output exists is skipped, with
+// the reason. Outputs extracted with other options, by their OptionsHash, are
+// reprocessed unless Options.SkipAnyExisting is set. Outputs without a hash,
+// such as legacy outputs without a meta block, have unknown options and are
+// left alone.
+func skipExisting(outPath string, opts Options) (bool, string) {
+	if opts.SkipAnyExisting {
+		return true, "output exists"
+	}
+	meta, err := readExistingMeta(outPath)
+	switch {
+	case errors.Is(err, errNoMeta) || err == nil && meta.OptionsHash == "":
+		return true, "output exists, extracted with unknown options"
+	case err != nil:
+		return true, fmt.Sprintf("output exists, unable to read its options: %v", err)
+	case meta.OptionsHash != opts.optionsHash:
+		return false, "output extracted with other options"
+	}
+	return true, "output exists"
+}
+
+// readExistingMeta reads the meta block of an existing output: of any
+// client's output with the {client} template token, and of the first part of
+// split outputs.
+func readExistingMeta(outPath string) (*Meta, error) {
+	outPath = clientOutputPath(outPath, "*")
+	matches, _ := filepath.Glob(outPath)
+	parts, _ := filepath.Glob(partOutputPath(outPath, 1))
+	err := fmt.Errorf("no output at %s", outPath)
+	for _, path := range append(matches, parts...) {
+		var meta *Meta
+		if meta, err = readMeta(path); err == nil {
+			return meta, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,85 @@
+package pktstats
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// inputOrders are the valid values of Options.Order.
+var inputOrders = []string{"lexical", "newest", "oldest", "largest", "smallest"}
+
+func isInputOrder(order string) bool {
+	for _, o := range inputOrders {
+		if order == o {
+			return true
+		}
+	}
+	return false
+}
+
+// orderInputs sorts the inputs of a run in the order they are dispatched to
+// workers: inputs matching priorityGlob first, then by order. Modification
+// times and sizes come from the local files; remote inputs, which are only
+// downloaded at dispatch, keep their relative order after the local ones.
+func orderInputs(inputs []string, order, priorityGlob string) []string {
+	type candidate struct {
+		input    string
+		priority bool
+		local    bool
+		modTime  int64
+		size     int64
+	}
+	candidates := make([]candidate, len(inputs))
+	for i, input := range inputs {
+		c := candidate{input: input, priority: matchesPriority(input, priorityGlob)}
+		if !isRemoteInput(input) && order != "lexical" {
+			if info, err := os.Stat(input); err == nil {
+				c.local, c.modTime, c.size = true, info.ModTime().UnixNano(), info.Size()
+			}
+		}
+		candidates[i] = c
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.priority != b.priority {
+			return a.priority
+		}
+		if order == "lexical" {
+			return a.input < b.input
+		}
+		if a.local != b.local {
+			return a.local
+		}
+		switch order {
+		case "newest":
+			return a.modTime > b.modTime
+		case "oldest":
+			return a.modTime < b.modTime
+		case "largest":
+			return a.size > b.size
+		case "smallest":
+			return a.size < b.size
+		}
+		return false
+	})
+	ordered := make([]string, len(candidates))
+	for i, c := range candidates {
+		ordered[i] = c.input
+	}
+	return ordered
+}
+
+// matchesPriority reports whether an input matches the priority glob, by its
+// file name or its full path.
+func matchesPriority(input, glob string) bool {
+	if glob == "" {
+		return false
+	}
+	if ok, _ := filepath.Match(glob, filepath.Base(input)); ok {
+		return true
+	}
+	ok, _ := filepath.Match(glob, strings.TrimPrefix(input, "./"))
+	return ok
+}
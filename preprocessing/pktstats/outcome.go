@@ -0,0 +1,91 @@
+package pktstats
+
+import "github.com/google/gopacket/layers"
+
+// flow outcomes, from the handshake and teardown packets observed
+const (
+	outcomeNoResponse    = "no-response"                // only SYNs or QUIC Initials, never answered
+	outcomeEstablished   = "established"                // answered, then silent before the end of the capture without teardown
+	outcomeResetByRemote = "reset-by-remote"            // the remote endpoint sent the first RST, including refused connections
+	outcomeResetByLocal  = "reset-by-local"             // the local endpoint sent the first RST
+	outcomeFinClosed     = "fin-closed"                 // a FIN was sent and no RST
+	outcomeOngoing       = "ongoing-at-capture-end"     // answered and active until the end of the capture
+	outcomeBeforeCapture = "established-before-capture" // the first packet opens no connection, captured mid-life
+)
+
+// outcomeState follows the handshake and teardown of a TCP flow, or the
+// QUIC Initials of a UDP flow. Upstream is the local endpoint, or for
+// third-party flows the endpoint ordered first in the key.
+type outcomeState struct {
+	seen        bool
+	handshake   bool // the first packet was a SYN without ACK, or a QUIC Initial
+	initiatorUp bool // direction of that packet
+	answered    bool // a packet from the other endpoint
+	fin         bool
+	finUp       bool // FINs by direction, for Options.Finalize
+	finDown     bool
+	reset       bool
+	resetUp     bool  // direction of the first RST
+	closedAt    int64 // packet closing a TCP flow, by a RST or the FIN of the second direction
+}
+
+// observe takes the TCP header of TCP packets, nil for UDP.
+func (state *outcomeState) observe(packet *Packet, payload []byte, tcp *layers.TCP) {
+	if !state.seen {
+		state.seen = true
+		if tcp != nil {
+			state.handshake = tcp.SYN && !tcp.ACK
+		} else {
+			state.handshake = isQUICInitial(payload)
+		}
+		state.initiatorUp = packet.Upstream
+	} else if packet.Upstream != state.initiatorUp {
+		state.answered = true
+	}
+	if tcp == nil {
+		return
+	}
+	if tcp.RST && !state.reset {
+		state.reset = true
+		state.resetUp = packet.Upstream
+	}
+	if tcp.FIN {
+		state.fin = true
+		if packet.Upstream {
+			state.finUp = true
+		} else {
+			state.finDown = true
+		}
+	}
+	if state.closedAt == 0 && (state.reset || state.finUp && state.finDown) {
+		state.closedAt = packet.Timestamp
+	}
+}
+
+// classifyOutcome sets the Outcome of TCP flows and of UDP flows opened by a
+// QUIC Initial. Flows answered, not torn down and active after activeSince
+// (the end of the capture minus Options.OngoingIdle, in the output precision)
+// are ongoing. QUIC teardown is encrypted, so QUIC flows are never closed.
+func (flow *Flow) classifyOutcome(activeSince int64) {
+	state := &flow.outcome
+	if flow.Protocol != 6 && !state.handshake {
+		// connectionless UDP, or QUIC captured mid-life, which looks the same
+		return
+	}
+	switch {
+	case !state.handshake:
+		flow.Outcome = outcomeBeforeCapture
+	case !state.answered:
+		flow.Outcome = outcomeNoResponse
+	case state.reset && state.resetUp:
+		flow.Outcome = outcomeResetByLocal
+	case state.reset:
+		flow.Outcome = outcomeResetByRemote
+	case state.fin:
+		flow.Outcome = outcomeFinClosed
+	case flow.download.last >= activeSince:
+		flow.Outcome = outcomeOngoing
+	default:
+		flow.Outcome = outcomeEstablished
+	}
+}
@@ -0,0 +1,457 @@
+package pktstats
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// output formats supported by writeOutput
+var outputFormats = []string{"json", "ndjson", "csv"}
+
+// Output is the content of an output file. The json format writes it as is,
+// per-packet formats write the meta block followed by the packets of each flow.
+type Output struct {
+	Meta            *Meta            `json:"meta"`
+	Flows           map[string]*Flow `json:"flows"`
+	ThirdPartyFlows map[string]*Flow `json:"thirdPartyFlows,omitempty"`
+	MirrorFlows     map[string]*Flow `json:"mirrorFlows,omitempty"` // flows of decrypted-mirror interfaces, see MirrorLink
+}
+
+// Meta describes an output file and the flows it contains.
+type Meta struct {
+	SchemaVersion     int                                 `json:"schemaVersion,omitempty"` // see schemaVersion, absent in outputs from before version 2
+	Version           VersionInfo                         `json:"version"`
+	Options           Options                             `json:"options"`               // effective options after defaults
+	OptionsHash       string                              `json:"optionsHash,omitempty"` // hash of the flags changed from their defaults, see optionsHash
+	Source            string                              `json:"source"`
+	Sources           []string                            `json:"sources,omitempty"` // inputs of outputs merged by the dedupe subcommand, or stitched with Options.Stitch
+	Format            string                              `json:"format"`
+	Services          map[string]*ServiceStats            `json:"services"`
+	Clients           map[string]map[string]*ServiceStats `json:"clients,omitempty"`         // per local client, with Options.PerClient
+	Notes             []string                            `json:"notes,omitempty"`           // caveats about the extraction
+	QualityWarnings   []string                            `json:"qualityWarnings,omitempty"` // signs of a misconfigured capture
+	PayloadCapture    bool                                `json:"payloadCapture,omitempty"`  // whether flows carry initial payload bytes
+	ZeroPayload       string                              `json:"zeroPayload"`               // treatment of zero-payload packets, see Options.ZeroPayload
+	TotalPackets      int64                               `json:"totalPackets"`              // all packets in the capture, including filtered ones
+	TotalBytes        int64                               `json:"totalBytes"`
+	AccountedPackets  int64                               `json:"accountedPackets"` // packets belonging to extracted flows
+	AccountedBytes    int64                               `json:"accountedBytes"`
+	LocalEndpoints    []LocalEndpoint                     `json:"localEndpoints,omitempty"`   // passive fingerprint of each local IP, unless Options.NoFingerprints
+	Checksums         *ChecksumCounts                     `json:"checksums,omitempty"`        // checksum validation results of all IPv4 TCP/UDP packets, with Options.VerifyChecksums
+	EvictedFlows      int                                 `json:"evictedFlows,omitempty"`     // flows handed over before the end of the file, with Options.MaxFlows
+	FlowsNotStored    int                                 `json:"flowsNotStored,omitempty"`   // new flows beyond Options.MaxFlows, counted but not stored
+	PacketsNotStored  int64                               `json:"packetsNotStored,omitempty"` // packets of flows not stored, and of evicted flows after their eviction
+	BytesNotStored    int64                               `json:"bytesNotStored,omitempty"`
+	FlushedFlows      int                                 `json:"flushedFlows,omitempty"`  // flows handed over once closed or idle, with Options.Finalize flush
+	ReopenedFlows     int                                 `json:"reopenedFlows,omitempty"` // continuations of flushed flows, with Options.LateArrivals reopen
+	LatePackets       int64                               `json:"latePackets,omitempty"`   // packets of flushed flows, with Options.LateArrivals count
+	LateBytes         int64                               `json:"lateBytes,omitempty"`
+	Clock             *ClockCheck                         `json:"clock,omitempty"`            // estimated capture clock offset, when the capture has NTP or HTTP evidence
+	CaptureStart      int64                               `json:"captureStart,omitempty"`     // timestamp of the first packet of the capture
+	CaptureEnd        int64                               `json:"captureEnd,omitempty"`       // timestamp of the last packet
+	CaptureTimezone   string                              `json:"captureTimezone,omitempty"`  // time zone of the capture host, Options.Timezone
+	NRBMappings       int                                 `json:"nrbMappings,omitempty"`      // DNS map entries from pcapng name resolution blocks, for addresses without a DNS answer
+	AnswerSetLabels   int                                 `json:"answerSetLabels,omitempty"`  // flows labeled with the name their client resolved the remote address from, see DNSAnswerSet, rather than that of the DNS map
+	SNIDisagreements  int                                 `json:"sniDisagreements,omitempty"` // flows whose SNI and DNS name belong to different registered domains, see SNIDisagreement
+	KernelDrops       *int64                              `json:"kernelDrops,omitempty"`      // from pcapng interface statistics, when present
+	TelemetryPackets  int64                               `json:"telemetryPackets,omitempty"` // packets of telemetry flows, not part of Services
+	TelemetryBytes    int64                               `json:"telemetryBytes,omitempty"`
+	RuleMatches       map[string]int                      `json:"ruleMatches,omitempty"`       // flows matched by each classifier rule, see ClassifierRule
+	IdleConnections   int                                 `json:"idleConnections,omitempty"`   // TCP flows to known services carrying only keepalives, see classifyIdleConnections
+	RacePairs         int                                 `json:"racePairs,omitempty"`         // QUIC/TCP connection races, see assignRacePairs
+	CaptureHosts      []string                            `json:"captureHosts,omitempty"`      // capture host IPs, with Options.ExcludeMgmt
+	ManagementFlows   int                                 `json:"managementFlows,omitempty"`   // flows tagged as management, not part of Services
+	ManagementPackets int64                               `json:"managementPackets,omitempty"` // all their packets, stored or not
+	ManagementBytes   int64                               `json:"managementBytes,omitempty"`
+	CaptureGaps       []GapInterval                       `json:"captureGaps,omitempty"`      // quiet periods suspected to be capture gaps
+	TopFlows          []HeavyHitter                       `json:"topFlows,omitempty"`         // flows with the most bytes
+	PeerGroups        []PeerGroup                         `json:"peerGroups,omitempty"`       // groups of more than one flow between the same IPs, see assignPeerGroups
+	Migrations        []Migration                         `json:"migrations,omitempty"`       // remote server changes within media sessions, see linkSessions
+	PoPChanges        []PoPChange                         `json:"popChanges,omitempty"`       // remote PoP changes of media sessions, with geo databases, see trackPoPChanges
+	InputResponses    []InputResponse                     `json:"inputResponses,omitempty"`   // input-to-frame delays of media sessions, with Options.InputBand
+	FrameRateChanges  []FrameRateChange                   `json:"frameRateChanges,omitempty"` // frame rate changes of media flows, see FrameRates
+	RatioTimelines    []RatioTimeline                     `json:"ratioTimelines,omitempty"`   // byte ratio and rate of each local client over time, see RatioTimeline
+	ByteConcentration float64                             `json:"byteConcentration"`          // Gini coefficient of bytes across flows
+	OverflowPolicy    string                              `json:"overflowPolicy,omitempty"`   // policy applied when the output exceeded Options.MaxOutputSize
+	Part              int                                 `json:"part,omitempty"`             // part number and part count of a split output
+	Parts             int                                 `json:"parts,omitempty"`
+	SummarizedFlows   int                                 `json:"summarizedFlows,omitempty"`   // flows stored without packets by the summarize overflow policy
+	ThirdPartyPackets int                                 `json:"thirdPartyPackets,omitempty"` // packets with no local endpoint, dropped unless kept
+	ThirdPartySamples []AddrPair                          `json:"thirdPartySamples,omitempty"`
+	SkippedPackets    int64                               `json:"skippedPackets,omitempty"` // packets of flows outside Options.RemotePrefixes, skipped
+	SkippedBytes      int64                               `json:"skippedBytes,omitempty"`
+	MirrorPackets     int64                               `json:"mirrorPackets,omitempty"` // packets of mirror flows, not part of AccountedPackets, see MirrorLink
+	MirrorBytes       int64                               `json:"mirrorBytes,omitempty"`
+	UnlinkedMirrors   int                                 `json:"unlinkedMirrors,omitempty"`   // mirror flows without a wire flow
+	DecryptedFlows    int                                 `json:"decryptedFlows,omitempty"`    // flows with NegotiationEvents, with Options.KeyLog
+	StrayICMPErrors   []StrayICMPError                    `json:"strayICMPErrors,omitempty"`   // ICMP errors quoting packets of no tracked flow, the first maxStrayICMPErrors
+	StrayICMPCount    int                                 `json:"strayICMPCount,omitempty"`    // all of them
+	ResolvedButUnused []UnusedResolution                  `json:"resolvedButUnused,omitempty"` // addresses answered in DNS responses of the file but used by no flow, the first maxResolvedButUnused
+	UnusedResolved    int                                 `json:"unusedResolved,omitempty"`    // all of them
+	LocalResolvers    []string                            `json:"localResolvers,omitempty"`    // local IPs answering DNS queries, e.g. a Pi-hole
+	ResolverFlows     int                                 `json:"resolverFlows,omitempty"`     // LAN flows between clients and a local resolver, left out as infrastructure
+	LearnedPrefixes   []LearnedPrefix                     `json:"learnedPrefixes,omitempty"`   // IPv6 prefixes of router advertisements, local from their first one, see Options.LearnPrefixes
+	Flows             []FlowRef                           `json:"flows,omitempty"`
+	ThirdPartyFlows   []FlowRef                           `json:"thirdPartyFlows,omitempty"`
+	MirrorFlows       []FlowRef                           `json:"mirrorFlows,omitempty"`
+
+	hashes      *outputHashes  // with Options.HashOutputs
+	captureHash *captureHasher // with Options.DB, the key of the rows of the file
+	// exportErr is the error exporting the file to Options.DB, it is recorded as failed
+	exportErr error
+}
+
+// FlowRef maps the compact integer ID used by per-packet records to the full flow key.
+type FlowRef struct {
+	ID               int     `json:"id"`
+	Key              string  `json:"key"`
+	LocalIP          string  `json:"localIP"`
+	RemoteIP         string  `json:"remoteIP"`
+	LocalPort        int     `json:"localPort"`
+	RemotePort       int     `json:"remotePort"`
+	Protocol         int     `json:"protocol"`
+	ServiceFlowType  string  `json:"serviceFlowType,omitempty"`
+	LabelSource      string  `json:"labelSource,omitempty"`
+	LabelConfidence  float64 `json:"labelConfidence,omitempty"`
+	DNSName          string  `json:"dnsName,omitempty"`
+	RegisteredDomain string  `json:"registeredDomain,omitempty"`
+	TransportProfile string  `json:"transportProfile"`
+	Outcome          string  `json:"outcome,omitempty"`
+	PeerGroupID      int     `json:"peerGroupID,omitempty"`
+	NumPackets       int     `json:"numPackets"`
+	// zero-payload packets not written as records, with Options.ZeroPayload aggregate
+	ZeroPayload *EmptyPackets `json:"zeroPayload,omitempty"`
+	Mirror      *MirrorLink   `json:"mirror,omitempty"`
+}
+
+// packetRecord is a per-packet row of the ndjson output, referencing its flow
+// by integer ID or, with Options.StringKeys, by the full flow key.
+type packetRecord struct {
+	Flow interface{} `json:"flow"`
+	Packet
+}
+
+func isOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// writeOutput stores the output in outPath using the format selected in opts.
+func writeOutput(outPath string, output *Output, opts Options) error {
+	// the output template may point to a directory that does not exist yet
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+	switch opts.Format {
+	case "ndjson":
+		return writeNDJSON(outPath, output, opts)
+	case "csv":
+		return writeCSV(outPath, output, opts)
+	default:
+		return writeEnvelope(outPath, output, opts)
+	}
+}
+
+// writeEnvelope writes the output as one object, the bytes json.Marshal would
+// produce, flow by flow to index the offset of each.
+func writeEnvelope(outPath string, output *Output, opts Options) error {
+	index := newOutputIndex(opts.Format, output.Meta.SchemaVersion)
+	file, err := createOutputFile(outPath, output.Meta.hashes)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	var offset int64
+	write := func(data ...[]byte) error {
+		for _, d := range data {
+			n, err := writer.Write(d)
+			offset += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	objectKey := func(name string) []byte {
+		return []byte(`"` + outputFieldName(name, opts.LegacyNames) + `":`)
+	}
+	metaString, err := marshalOutput(output.Meta, opts.LegacyNames)
+	if err != nil {
+		return fmt.Errorf("unable to marshal meta data: %w", err)
+	}
+	if err := write([]byte("{"), objectKey("meta"), metaString); err != nil {
+		return err
+	}
+	for _, group := range []struct {
+		name, group string
+		flowMap     map[string]*Flow
+	}{{"flows", "", output.Flows}, {groupThirdParty, groupThirdParty, output.ThirdPartyFlows}, {groupMirror, groupMirror, output.MirrorFlows}} {
+		// thirdPartyFlows and mirrorFlows are omitempty
+		if group.group != "" && len(group.flowMap) == 0 {
+			continue
+		}
+		if err := write([]byte(","), objectKey(group.name)); err != nil {
+			return err
+		}
+		if group.flowMap == nil {
+			if err := write([]byte("null")); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := write([]byte("{")); err != nil {
+			return err
+		}
+		for i, key := range sortedKeys(group.flowMap) {
+			keyString, _ := json.Marshal(key)
+			flowString, err := marshalOutput(group.flowMap[key], opts.LegacyNames)
+			if err != nil {
+				return fmt.Errorf("unable to marshal flow data: %w", err)
+			}
+			separator := []byte(",")
+			if i == 0 {
+				separator = nil
+			}
+			if err := write(separator, keyString, []byte(":")); err != nil {
+				return err
+			}
+			index.add(key, group.group, group.flowMap[key], offset, int64(len(flowString)))
+			if err := write(flowString); err != nil {
+				return err
+			}
+		}
+		if err := write([]byte("}")); err != nil {
+			return err
+		}
+	}
+	if err := write([]byte("}")); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := file.finish(); err != nil {
+		return err
+	}
+	return index.write(outPath, offset, opts, output.Meta.hashes)
+}
+
+// collect is a flow handler adding the flows handed over by an Extractor to the output.
+func (output *Output) collect(flow *Flow) {
+	if flow.Mirror != nil {
+		if output.MirrorFlows == nil {
+			output.MirrorFlows = make(map[string]*Flow)
+		}
+		output.MirrorFlows[flow.getFlowID()] = flow
+		return
+	}
+	if flow.Direction == DirectionUnknown {
+		if output.ThirdPartyFlows == nil {
+			output.ThirdPartyFlows = make(map[string]*Flow)
+		}
+		output.ThirdPartyFlows[flow.getFlowID()] = flow
+		return
+	}
+	output.Flows[flow.getFlowID()] = flow
+}
+
+// sortedFlowKeys returns the keys of flowMap in order of first packet arrival.
+func sortedFlowKeys(flowMap map[string]*Flow) []string {
+	keys := make([]string, 0, len(flowMap))
+	for key := range flowMap {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ti, tj := flowMap[keys[i]].Packets[0].Timestamp, flowMap[keys[j]].Packets[0].Timestamp
+		if ti != tj {
+			return ti < tj
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// writeSizedOutput writes the output, applying Options.MaxOutputSize if set.
+func writeSizedOutput(outPath string, output *Output, opts Options) error {
+	if opts.MaxOutputSize > 0 {
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return err
+		}
+		return writeLimitedJSON(outPath, output, opts)
+	}
+	return writeOutput(outPath, output, opts)
+}
+
+// flowIndex lists the flows of an output in the order of their integer IDs.
+type flowIndex struct {
+	keys   []string
+	flows  []*Flow
+	groups []string // see FlowRecord.Group
+}
+
+// indexOutput assigns each flow a small integer ID, in order of first packet
+// arrival with third-party then mirror flows last, and records the mapping in
+// the meta block.
+func indexOutput(output *Output) flowIndex {
+	var index flowIndex
+	output.Meta.Flows = index.add(output.Flows, "")
+	output.Meta.ThirdPartyFlows = index.add(output.ThirdPartyFlows, groupThirdParty)
+	output.Meta.MirrorFlows = index.add(output.MirrorFlows, groupMirror)
+	return index
+}
+
+func (index *flowIndex) add(flowMap map[string]*Flow, group string) []FlowRef {
+	keys := sortedFlowKeys(flowMap)
+	refs := make([]FlowRef, len(keys))
+	for i, key := range keys {
+		flow := flowMap[key]
+		refs[i] = FlowRef{
+			ID:               len(index.keys),
+			Key:              key,
+			LocalIP:          flow.LocalIP,
+			RemoteIP:         flow.RemoteIP,
+			LocalPort:        flow.LocalPort,
+			RemotePort:       flow.RemotePort,
+			Protocol:         flow.Protocol,
+			ServiceFlowType:  flow.ServiceFlowType,
+			LabelSource:      flow.LabelSource,
+			LabelConfidence:  flow.LabelConfidence,
+			DNSName:          flow.DNSName,
+			RegisteredDomain: flow.RegisteredDomain,
+			TransportProfile: flow.TransportProfile,
+			Outcome:          flow.Outcome,
+			PeerGroupID:      flow.PeerGroupID,
+			NumPackets:       len(flow.Packets),
+			ZeroPayload:      flow.ZeroPayload,
+			Mirror:           flow.Mirror,
+		}
+		index.keys = append(index.keys, key)
+		index.flows = append(index.flows, flow)
+		index.groups = append(index.groups, group)
+	}
+	return refs
+}
+
+// writeNDJSON writes the meta block as the first line followed by one line per packet.
+func writeNDJSON(outPath string, output *Output, opts Options) error {
+	index := indexOutput(output)
+	records := newOutputIndex(opts.Format, output.Meta.SchemaVersion)
+	file, err := createOutputFile(outPath, output.Meta.hashes)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	var offset int64
+	writeLine := func(v interface{}) error {
+		line, err := marshalOutput(v, opts.LegacyNames)
+		if err != nil {
+			return err
+		}
+		n, err := writer.Write(append(line, '\n'))
+		offset += int64(n)
+		return err
+	}
+	if err := writeLine(map[string]*Meta{"meta": output.Meta}); err != nil {
+		return err
+	}
+	for id, key := range index.keys {
+		record := packetRecord{Flow: id}
+		if opts.StringKeys {
+			record.Flow = key
+		}
+		start := offset
+		for _, packet := range index.flows[id].Packets {
+			record.Packet = packet
+			if err := writeLine(&record); err != nil {
+				return err
+			}
+		}
+		records.add(key, index.groups[id], index.flows[id], start, offset-start)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := file.finish(); err != nil {
+		return err
+	}
+	return records.write(outPath, offset, opts, output.Meta.hashes)
+}
+
+// writeCSV writes one row per packet, with the meta block in a <outPath>.meta.json sidecar.
+func writeCSV(outPath string, output *Output, opts Options) error {
+	index := indexOutput(output)
+	metaString, err := marshalOutput(output.Meta, opts.LegacyNames)
+	if err != nil {
+		return fmt.Errorf("unable to marshal meta data: %w", err)
+	}
+	if err := writeOutputFile(outPath+".meta.json", metaString, output.Meta.hashes); err != nil {
+		return err
+	}
+
+	file, err := createOutputFile(outPath, output.Meta.hashes)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	header := []string{"flow", "srcIP", "dstIP", "srcPort", "dstPort", "protocol", "upstream", "timestamp", "pktLength", "payloadSize", "direction"}
+	if opts.IPHeaderFields {
+		header = append(header, "ipid", "df", "flowLabel")
+	}
+	if opts.VerifyChecksums {
+		header = append(header, "badChecksum")
+	}
+	for i, name := range header {
+		header[i] = outputFieldName(name, opts.LegacyNames)
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for id, key := range index.keys {
+		flowRef := strconv.Itoa(id)
+		if opts.StringKeys {
+			flowRef = key
+		}
+		for _, packet := range index.flows[id].Packets {
+			row := []string{
+				flowRef,
+				packet.SrcIP,
+				packet.DstIP,
+				strconv.Itoa(packet.SrcPort),
+				strconv.Itoa(packet.DstPort),
+				strconv.Itoa(packet.Protocol),
+				strconv.FormatBool(packet.Upstream),
+				strconv.FormatInt(packet.Timestamp, 10),
+				strconv.Itoa(packet.PktLength),
+				strconv.Itoa(packet.PayloadSize),
+				string(packet.Direction),
+			}
+			if opts.IPHeaderFields {
+				row = append(row, strconv.Itoa(packet.IPID), strconv.FormatBool(packet.DF), strconv.Itoa(packet.FlowLabel))
+			}
+			if opts.VerifyChecksums {
+				row = append(row, strconv.FormatBool(packet.BadChecksum))
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.finish()
+}
@@ -0,0 +1,55 @@
+package pktstats
+
+import (
+	"encoding/csv"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// checksumCapture is a UDP exchange with a game server whose second response
+// was received with a corrupted UDP checksum.
+func checksumCapture(t testing.TB) []fixturePacket {
+	const client, game = "192.168.1.10", "203.0.113.10"
+	corrupted := udpPacket(t, game, 3478, client, 50000, make([]byte, 200))
+	corrupted[14+20+6] ^= 0xff // the UDP checksum, after the Ethernet and IPv4 headers
+	return []fixturePacket{
+		{at: 0, data: dnsResponse(t, "192.168.1.1", 53, client, "eu1.game.example.com", game)},
+		{at: 10 * time.Millisecond, data: udpPacket(t, client, 50000, game, 3478, make([]byte, 80))},
+		{at: 11 * time.Millisecond, data: udpPacket(t, game, 3478, client, 50000, make([]byte, 200))},
+		{at: 12 * time.Millisecond, data: corrupted},
+	}
+}
+
+func TestCSVBadChecksum(t *testing.T) {
+	capture := fixture(t, "checksums.pcap", checksumCapture)
+	for _, verify := range []bool{false, true} {
+		opts := testOptions()
+		opts.Format, opts.VerifyChecksums = "csv", verify
+		output, outPath := extractFixture(t, capture, opts)
+
+		file, err := os.Open(outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := csv.NewReader(file).Read()
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.Contains(header, "badChecksum") != verify {
+			t.Errorf("verify checksums %v: header %q", verify, header)
+		}
+
+		flow := output.Flows["192.168.1.10:50000-203.0.113.10:3478@17"]
+		if flow == nil || len(flow.Packets) != 3 {
+			t.Fatalf("verify checksums %v: game flow not loaded with its 3 packets", verify)
+		}
+		for i, packet := range flow.Packets {
+			if want := verify && i == 2; packet.BadChecksum != want {
+				t.Errorf("verify checksums %v: packet %d loads with bad checksum %v, want %v", verify, i, packet.BadChecksum, want)
+			}
+		}
+	}
+}
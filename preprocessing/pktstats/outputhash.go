@@ -0,0 +1,158 @@
+package pktstats
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// outputHashes collects the SHA-256 of the files written for an output, with
+// Options.HashOutputs, by path. It is shared by the copies of the meta block
+// made for per-client outputs and parts.
+type outputHashes struct {
+	files map[string]string
+}
+
+// hashedFile is an output file whose bytes are hashed as they are written,
+// so the hash also covers a write cut short, unlike a re-read of the file.
+type hashedFile struct {
+	file   *os.File
+	writer io.Writer
+	hash   hash.Hash
+	hashes *outputHashes // nil if outputs are not hashed
+	closed bool
+}
+
+// createOutputFile creates an output file, hashed if hashes is set.
+func createOutputFile(path string, hashes *outputHashes) (*hashedFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	out := &hashedFile{file: file, writer: file, hashes: hashes}
+	if hashes != nil {
+		out.hash = sha256.New()
+		out.writer = io.MultiWriter(file, out.hash)
+	}
+	return out, nil
+}
+
+func (out *hashedFile) Write(p []byte) (int, error) {
+	n, err := out.writer.Write(p)
+	outputBytes.Add(int64(n))
+	return n, err
+}
+
+// Close closes a file abandoned after an error, without recording its hash.
+func (out *hashedFile) Close() error {
+	if out.closed {
+		return nil
+	}
+	out.closed = true
+	return out.file.Close()
+}
+
+// finish closes a completely written file and, if it is hashed, records its
+// hash and writes it to a <path>.sha256 sidecar in the format of sha256sum.
+func (out *hashedFile) finish() error {
+	if err := out.Close(); err != nil || out.hash == nil {
+		return err
+	}
+	path := out.file.Name()
+	sum := hex.EncodeToString(out.hash.Sum(nil))
+	if out.hashes.files == nil {
+		out.hashes.files = make(map[string]string)
+	}
+	out.hashes.files[path] = sum
+	return os.WriteFile(path+".sha256", []byte(sum+"  "+filepath.Base(path)+"\n"), 0644)
+}
+
+// writeOutputFile writes an output file at once, hashed if hashes is set.
+func writeOutputFile(path string, data []byte, hashes *outputHashes) error {
+	out, err := createOutputFile(path, hashes)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := out.Write(data); err != nil {
+		return err
+	}
+	return out.finish()
+}
+
+// fileSHA256 hashes a file as written, for the verify subcommand.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifyMain implements the verify subcommand, hashing the outputs listed in
+// a run manifest again and reporting those that are missing or changed since
+// they were written with -hash-outputs.
+func VerifyMain(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	basePath := fs.String("p", "../data/", "Base path of the run, holding its run_manifest.json")
+	manifestPath := fs.String("manifest", "", "Path of the run manifest (default: run_manifest.json in -p)")
+	fs.Parse(args)
+	if *manifestPath == "" {
+		*manifestPath = filepath.Join(*basePath, "run_manifest.json")
+	}
+
+	content, err := os.ReadFile(*manifestPath)
+	if err != nil {
+		fmt.Println("unable to read manifest:", err)
+		os.Exit(1)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		fmt.Println("unable to read manifest:", err)
+		os.Exit(1)
+	}
+	checked, failed := 0, 0
+	// the inputs of a stitched session share their output
+	seen := make(map[string]bool)
+	for _, entry := range manifest.Files {
+		paths := make([]string, 0, len(entry.Hashes))
+		for path := range entry.Hashes {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			checked++
+			sum, err := fileSHA256(path)
+			switch {
+			case err != nil:
+				fmt.Printf("MISSING   %s: %v\n", path, err)
+				failed++
+			case sum != entry.Hashes[path]:
+				fmt.Printf("MISMATCH  %s: sha256 %s, %s in the manifest\n", path, sum, entry.Hashes[path])
+				failed++
+			}
+		}
+	}
+	fmt.Printf("%d outputs verified, %d missing or changed\n", checked, failed)
+	if checked == 0 {
+		fmt.Println("The manifest lists no output hashes, run with -hash-outputs to record them")
+	}
+	if failed > 0 || checked == 0 {
+		os.Exit(1)
+	}
+}
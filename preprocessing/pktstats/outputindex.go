@@ -0,0 +1,182 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// outputIndexSuffix is appended to the path of a json or ndjson output to
+// name its flow index, see Options.NoFlowIndex.
+const outputIndexSuffix = ".idx.json"
+
+// flow groups of FlowRecord.Group, the keys of their flow maps in json outputs
+const (
+	groupThirdParty = "thirdPartyFlows"
+	groupMirror     = "mirrorFlows"
+)
+
+var errStaleIndex = errors.New("stale flow index")
+
+// OutputIndex locates the record of each flow of a json or ndjson output, so
+// that a flow is read without scanning the output, see GetFlow.
+type OutputIndex struct {
+	Format        string                `json:"format"`
+	Size          int64                 `json:"size"` // of the output; an index of an output of another size is stale
+	SchemaVersion int                   `json:"schemaVersion"`
+	Flows         map[string]FlowRecord `json:"flows"` // by flow key
+}
+
+// FlowRecord is the entry of a flow in an OutputIndex: the bytes of its
+// record, its value in the flow map of a json output or its run of packet
+// lines in an ndjson output, and the flow-level metadata to select it by.
+type FlowRecord struct {
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	Group     string `json:"group,omitempty"`   // thirdPartyFlows or mirrorFlows, empty for flows
+	Service   string `json:"service,omitempty"` // registered domain
+	SessionID int    `json:"sessionID,omitempty"`
+	Packets   int    `json:"packets"` // stored packets
+	Bytes     int64  `json:"bytes"`   // of all its packets, zero-payload ones left out of the packets included
+	Start     int64  `json:"start"`   // timestamp of the first stored packet
+	End       int64  `json:"end"`     // timestamp of the last stored packet
+}
+
+func newOutputIndex(format string, schemaVersion int) *OutputIndex {
+	return &OutputIndex{Format: format, SchemaVersion: schemaVersion, Flows: make(map[string]FlowRecord)}
+}
+
+// newFlowRecord returns the metadata of a flow, without the location of its record.
+func newFlowRecord(flow *Flow, group string) FlowRecord {
+	record := FlowRecord{Group: group, Service: flow.RegisteredDomain, SessionID: flow.SessionID, Packets: len(flow.Packets)}
+	_, record.Bytes = flow.totals()
+	for i, packet := range flow.Packets {
+		if i == 0 || packet.Timestamp < record.Start {
+			record.Start = packet.Timestamp
+		}
+		record.End = max(record.End, packet.Timestamp)
+	}
+	return record
+}
+
+// add records the bytes of the record of a flow.
+func (index *OutputIndex) add(key, group string, flow *Flow, offset, length int64) {
+	record := newFlowRecord(flow, group)
+	record.Offset, record.Length = offset, length
+	index.Flows[key] = record
+}
+
+// write stores the index of an output of size bytes in <outPath>.idx.json,
+// after the output so that it is not older. With Options.NoFlowIndex, none is
+// written, and the index of an earlier output at outPath is left in place:
+// readOutputIndex finds it stale.
+func (index *OutputIndex) write(outPath string, size int64, opts Options, hashes *outputHashes) error {
+	if opts.NoFlowIndex {
+		return nil
+	}
+	index.Size = size
+	jsonString, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("unable to marshal flow index: %w", err)
+	}
+	return writeOutputFile(outPath+outputIndexSuffix, jsonString, hashes)
+}
+
+// readOutputIndex reads the index of an output, failing with errStaleIndex if
+// the output was written again after it.
+func readOutputIndex(outPath string) (*OutputIndex, error) {
+	indexInfo, err := os.Stat(outPath + outputIndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	outputInfo, err := os.Stat(outPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(outPath + outputIndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	index := &OutputIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("%s: %w", outPath+outputIndexSuffix, err)
+	}
+	if index.Size != outputInfo.Size() || outputInfo.ModTime().After(indexInfo.ModTime()) {
+		return nil, fmt.Errorf("%s: %w", outPath+outputIndexSuffix, errStaleIndex)
+	}
+	return index, nil
+}
+
+// GetFlow reads one flow of a json or ndjson output, by its key, from the
+// record located by the index of the output, see Options.NoFlowIndex.
+func GetFlow(outputPath, flowID string) (*Flow, error) {
+	index, err := readOutputIndex(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	var meta *Meta
+	if index.Format == "ndjson" {
+		// the flow-level fields of ndjson outputs are in the meta block
+		if meta, err = readMeta(outputPath); err != nil {
+			return nil, err
+		}
+	}
+	return index.readFlow(outputPath, flowID, meta)
+}
+
+// readFlow reads the record of a flow of an indexed output.
+// @param meta: the meta block of ndjson outputs, nil for json outputs
+func (index *OutputIndex) readFlow(outputPath, flowID string, meta *Meta) (*Flow, error) {
+	record, ok := index.Flows[flowID]
+	if !ok {
+		return nil, fmt.Errorf("%s: no flow %s in the flow index", outputPath, flowID)
+	}
+	file, err := os.Open(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	section := io.NewSectionReader(file, record.Offset, record.Length)
+
+	var flow *Flow
+	if index.Format == "ndjson" {
+		for _, refs := range [][]FlowRef{meta.Flows, meta.ThirdPartyFlows, meta.MirrorFlows} {
+			for _, ref := range refs {
+				if ref.Key == flowID {
+					flow = ref.flow()
+				}
+			}
+		}
+		if flow == nil {
+			return nil, fmt.Errorf("%s: no flow %s in the meta block", outputPath, flowID)
+		}
+		decoder := json.NewDecoder(section)
+		for {
+			var line struct {
+				Flow json.RawMessage
+				Packet
+			}
+			if err := decoder.Decode(&line); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %w", outputPath, err)
+			}
+			flow.Packets = append(flow.Packets, line.Packet)
+		}
+	} else {
+		data, err := io.ReadAll(section)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &flow); err != nil {
+			return nil, fmt.Errorf("%s: %w", outputPath, err)
+		}
+		if flow == nil {
+			return nil, fmt.Errorf("%s: flow %s is null", outputPath, flowID)
+		}
+	}
+	upgradeLabels(map[string]*Flow{flowID: flow}, index.SchemaVersion)
+	return flow, nil
+}
@@ -0,0 +1,61 @@
+package pktstats
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetFlow(t *testing.T) {
+	capture := fixture(t, "flows.pcap", flowsCapture)
+	for _, format := range []string{"json", "ndjson"} {
+		opts := testOptions()
+		opts.Format = format
+		output, outPath := extractFixture(t, capture, opts)
+		for key, want := range output.Flows {
+			flow, err := GetFlow(outPath, key)
+			if err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+			if !reflect.DeepEqual(flow, want) {
+				t.Errorf("%s: GetFlow(%s) = %+v, want %+v", format, key, flow, want)
+			}
+		}
+		if _, err := GetFlow(outPath, "192.168.1.10:1-192.0.2.1:2@17"); err == nil {
+			t.Errorf("%s: GetFlow of a flow not in the output succeeded", format)
+		}
+
+		// an output written again after its index
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(outPath, later, later); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetFlow(outPath, sortedFlowKeys(output.Flows)[0]); !errors.Is(err, errStaleIndex) {
+			t.Errorf("%s: GetFlow through a stale index returned %v, want %v", format, err, errStaleIndex)
+		}
+	}
+}
+
+// TestNoFlowIndex writes an output again without its index, which leaves the
+// index of the first output in place, found stale.
+func TestNoFlowIndex(t *testing.T) {
+	capture := fixture(t, "flows.pcap", flowsCapture)
+	output, outPath := extractFixture(t, capture, testOptions())
+	if _, err := os.Stat(outPath + outputIndexSuffix); err != nil {
+		t.Fatalf("no flow index by default: %v", err)
+	}
+	opts := testOptions()
+	opts.NoFlowIndex, opts.NumPackets = true, 1
+	if ExtractPacketStats(context.Background(), capture, outPath, opts) == nil {
+		t.Fatalf("unable to extract %s", capture)
+	}
+	if _, err := os.Stat(outPath + outputIndexSuffix); err != nil {
+		t.Errorf("flow index removed with -no-flow-index: %v", err)
+	}
+	if _, err := GetFlow(outPath, sortedFlowKeys(output.Flows)[0]); !errors.Is(err, errStaleIndex) {
+		t.Errorf("GetFlow through the index of the first output returned %v, want %v", err, errStaleIndex)
+	}
+}
@@ -0,0 +1,145 @@
+package pktstats
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errOutputTooLarge fails a file under the error overflow policy.
+var errOutputTooLarge = errors.New("output exceeds the maximum output size")
+
+// policies for outputs exceeding Options.MaxOutputSize
+var overflowPolicies = []string{"split", "summarize", "error"}
+
+func isOverflowPolicy(policy string) bool {
+	return containsString(overflowPolicies, policy)
+}
+
+// partOutputPath returns the path of a part of a split output, e.g.
+// x_packetStats.part1.json for x_packetStats.json.
+func partOutputPath(outPath string, part int) string {
+	ext := filepath.Ext(outPath)
+	return strings.TrimSuffix(outPath, ext) + ".part" + strconv.Itoa(part) + ext
+}
+
+// partsExist reports whether a complete set of parts of a split output exists,
+// as listed by the part count in the meta block of the first part.
+func partsExist(outPath string) bool {
+	firstParts, err := filepath.Glob(partOutputPath(outPath, 1))
+	if err != nil {
+		return false
+	}
+	for _, firstPart := range firstParts {
+		meta, err := readMeta(firstPart)
+		if err != nil || meta.Parts == 0 {
+			continue
+		}
+		base := strings.TrimSuffix(firstPart, ".part1"+filepath.Ext(firstPart)) + filepath.Ext(firstPart)
+		complete := true
+		for part := 2; part <= meta.Parts && complete; part++ {
+			_, err := os.Stat(partOutputPath(base, part))
+			complete = err == nil
+		}
+		if complete {
+			return true
+		}
+	}
+	return false
+}
+
+// sizedFlow is a flow with the size of its JSON encoding in the output.
+type sizedFlow struct {
+	key        string
+	flow       *Flow
+	size       int
+	thirdParty bool
+	mirror     bool
+}
+
+// writeLimitedJSON writes a json output that may exceed Options.MaxOutputSize,
+// applying Options.OverflowPolicy once the flows written so far cross it:
+// split starts a new part at the next flow boundary, summarize drops the
+// packets of the remaining flows, error fails without writing.
+func writeLimitedJSON(outPath string, output *Output, opts Options) error {
+	metaString, err := marshalOutput(output.Meta, opts.LegacyNames)
+	if err != nil {
+		return fmt.Errorf("unable to marshal meta data: %w", err)
+	}
+	total := len(metaString)
+	var flows []sizedFlow
+	for _, group := range []struct {
+		flowMap            map[string]*Flow
+		thirdParty, mirror bool
+	}{{output.Flows, false, false}, {output.ThirdPartyFlows, true, false}, {output.MirrorFlows, false, true}} {
+		for _, key := range sortedFlowKeys(group.flowMap) {
+			flowString, err := marshalOutput(group.flowMap[key], opts.LegacyNames)
+			if err != nil {
+				return fmt.Errorf("unable to marshal flow data: %w", err)
+			}
+			// the key, quotes, colon and comma
+			size := len(key) + len(flowString) + 4
+			flows = append(flows, sizedFlow{key, group.flowMap[key], size, group.thirdParty, group.mirror})
+			total += size
+		}
+	}
+	if total <= opts.MaxOutputSize {
+		return writeOutput(outPath, output, opts)
+	}
+
+	output.Meta.OverflowPolicy = opts.OverflowPolicy
+	switch opts.OverflowPolicy {
+	case "error":
+		return fmt.Errorf("%w: %d bytes, maximum %d bytes", errOutputTooLarge, total, opts.MaxOutputSize)
+	case "summarize":
+		size := len(metaString)
+		for _, sized := range flows {
+			if size+sized.size > opts.MaxOutputSize {
+				sized.flow.SummarizedPackets = len(sized.flow.Packets)
+				sized.flow.Packets = []Packet{}
+				output.Meta.SummarizedFlows++
+				flowString, _ := marshalOutput(sized.flow, opts.LegacyNames)
+				sized.size = len(sized.key) + len(flowString) + 4
+			}
+			size += sized.size
+		}
+		return writeOutput(outPath, output, opts)
+	default:
+		var parts []*Output
+		size := 0
+		for _, sized := range flows {
+			if len(parts) == 0 || size > 0 && size+sized.size > opts.MaxOutputSize {
+				parts = append(parts, &Output{Flows: make(map[string]*Flow)})
+				size = len(metaString)
+			}
+			part := parts[len(parts)-1]
+			if sized.thirdParty {
+				if part.ThirdPartyFlows == nil {
+					part.ThirdPartyFlows = make(map[string]*Flow)
+				}
+				part.ThirdPartyFlows[sized.key] = sized.flow
+			} else if sized.mirror {
+				if part.MirrorFlows == nil {
+					part.MirrorFlows = make(map[string]*Flow)
+				}
+				part.MirrorFlows[sized.key] = sized.flow
+			} else {
+				part.Flows[sized.key] = sized.flow
+			}
+			size += sized.size
+		}
+		for i, part := range parts {
+			meta := *output.Meta
+			meta.Part, meta.Parts = i+1, len(parts)
+			part.Meta = &meta
+			if err := writeOutput(partOutputPath(outPath, i+1), part, opts); err != nil {
+				return err
+			}
+		}
+		output.Meta.Parts = len(parts)
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+package pktstats
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// overrideFileName is the per-directory options file, a YAML mapping: the
+// options it sets apply to the captures of its directory and below, over
+// those of the run.
+const overrideFileName = ".pktstats.yaml"
+
+// overrideKeys are the options an override file may set, by their json
+// names: those describing the network a capture was collected in rather than
+// how it is measured, which differ between the collection sites of a dataset.
+var overrideKeys = map[string]bool{"localSubnets": true, "keepPorts": true, "telemetryList": true}
+
+// appliedOverrides are the override files applying to a capture.
+type appliedOverrides struct {
+	files     []string          // override files, farthest first
+	settings  map[string]string // options set, the value of the nearest file
+	conflicts []string          // options set differently by several files
+}
+
+// directoryOverrides reads the override files of the data tree under
+// basePath once per run.
+type directoryOverrides struct {
+	basePath string
+	mu       sync.Mutex
+	dirs     map[string]map[string]string // options of the override file of each directory, nil without one
+}
+
+func newDirectoryOverrides(basePath string) *directoryOverrides {
+	return &directoryOverrides{basePath: basePath, dirs: make(map[string]map[string]string)}
+}
+
+// read returns the options of the override file of dir, nil without one.
+// Relative telemetry lists are relative to dir.
+func (overrides *directoryOverrides) read(dir string) (map[string]string, error) {
+	overrides.mu.Lock()
+	defer overrides.mu.Unlock()
+	if settings, ok := overrides.dirs[dir]; ok {
+		return settings, nil
+	}
+	path := filepath.Join(dir, overrideFileName)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		overrides.dirs[dir] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var settings map[string]string
+	if err := yaml.Unmarshal(content, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key, value := range settings {
+		if !overrideKeys[key] {
+			return nil, fmt.Errorf("%s: %q cannot be set per directory, only %s", path, key, strings.Join(sortedKeys(overrideKeys), ", "))
+		}
+		if key == "telemetryList" && value != "" && !filepath.IsAbs(value) {
+			settings[key] = filepath.Join(dir, value)
+		}
+	}
+	if settings == nil {
+		settings = make(map[string]string)
+	}
+	overrides.dirs[dir] = settings
+	return settings, nil
+}
+
+// find returns the override files applying to filePath: those of its
+// directory and of the directories above it up to the base path, or only
+// that of its directory for a capture outside the base path. The nearest file
+// sets an option that several files set.
+func (overrides *directoryOverrides) find(filePath string) (*appliedOverrides, error) {
+	dir, err := filepath.Abs(filepath.Dir(filePath))
+	if err != nil {
+		return nil, err
+	}
+	base, err := filepath.Abs(overrides.basePath)
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{dir}
+	if rel, err := filepath.Rel(base, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		for dir != base {
+			dir = filepath.Dir(dir)
+			dirs = append(dirs, dir)
+		}
+	}
+	applied := &appliedOverrides{settings: make(map[string]string)}
+	setBy := make(map[string]string)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		settings, err := overrides.read(dirs[i])
+		if err != nil {
+			return nil, err
+		}
+		if settings == nil {
+			continue
+		}
+		path := filepath.Join(dirs[i], overrideFileName)
+		applied.files = append(applied.files, path)
+		for _, key := range sortedKeys(settings) {
+			if previous, ok := applied.settings[key]; ok && previous != settings[key] {
+				applied.conflicts = append(applied.conflicts, fmt.Sprintf("%s: %q in %s, %q in %s", key, previous, setBy[key], settings[key], path))
+			}
+			applied.settings[key], setBy[key] = settings[key], path
+		}
+	}
+	return applied, nil
+}
+
+// apply returns opts with the options of the override files, validated, and
+// the options hash covering them.
+func (applied *appliedOverrides) apply(opts Options) (Options, error) {
+	if len(applied.settings) == 0 {
+		return opts, nil
+	}
+	content, _ := json.Marshal(applied.settings)
+	if err := json.Unmarshal(content, &opts); err != nil {
+		return opts, err
+	}
+	if err := opts.ValidateExtraction(); err != nil {
+		return opts, err
+	}
+	if _, err := loadTelemetryList(opts.TelemetryList); err != nil {
+		return opts, err
+	}
+	hash := sha256.New()
+	fmt.Fprintln(hash, opts.optionsHash)
+	for _, key := range sortedKeys(applied.settings) {
+		fmt.Fprintln(hash, key+"="+applied.settings[key])
+	}
+	opts.optionsHash = fmt.Sprintf("%x", hash.Sum(nil))[:16]
+	return opts, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
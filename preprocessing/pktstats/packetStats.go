@@ -0,0 +1,1408 @@
+package pktstats
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+type Packet struct {
+	SrcIP       string    `json:"srcIP"`
+	DstIP       string    `json:"dstIP"`
+	SrcPort     int       `json:"srcPort"`
+	DstPort     int       `json:"dstPort"`
+	Protocol    int       `json:"protocol"`
+	Upstream    bool      `json:"upstream"`  // deprecated, see Direction; canonical for local and unknown packets
+	Direction   Direction `json:"direction"` // upstream, downstream, local or unknown
+	Timestamp   int64     `json:"timestamp"`
+	PktLength   int       `json:"pktLength"`
+	PayloadSize int       `json:"payloadSize"`           // transport payload bytes, from the IPv4 header lengths: including bytes beyond the snap length
+	IPID        int       `json:"ipid,omitempty"`        // IPv4 identification, tells copies of a packet from retransmissions, with Options.IPHeaderFields
+	DF          bool      `json:"df,omitempty"`          // IPv4 don't fragment flag, with Options.IPHeaderFields
+	FlowLabel   int       `json:"flowLabel,omitempty"`   // IPv6 flow label, the IPID of IPv6, with Options.IPHeaderFields
+	BadChecksum bool      `json:"badChecksum,omitempty"` // IPv4 or TCP/UDP checksum mismatch, with Options.VerifyChecksums
+}
+
+type Flow struct {
+	LocalIP                 string            `json:"localIP"`
+	RemoteIP                string            `json:"remoteIP"`
+	LocalPort               int               `json:"localPort"`
+	RemotePort              int               `json:"remotePort"`
+	Protocol                int               `json:"protocol"`
+	ServiceFlowType         string            `json:"serviceFlowType,omitempty"`         // service (registered domain) or role (telemetry, input) of the flow, empty if unlabeled
+	DNSName                 string            `json:"dnsName,omitempty"`                 // hostname RemoteIP was resolved from, empty if none was captured
+	RegisteredDomain        string            `json:"registeredDomain,omitempty"`        // registered domain (eTLD+1) of DNSName
+	RDNSName                string            `json:"rdnsName,omitempty"`                // PTR name of RemoteIP for flows without DNSName, with Options.RDNS
+	LabelSource             string            `json:"labelSource,omitempty"`             // where the flow's label comes from, see label.go
+	LabelConfidence         float64           `json:"labelConfidence,omitempty"`         // confidence in the label, from 0 to 1
+	SNI                     string            `json:"sni,omitempty"`                     // server name of the TLS ClientHello, TCP only
+	LabelDisagreement       *SNIDisagreement  `json:"labelDisagreement,omitempty"`       // SNI and DNS name of different registered domains, see resolveSNI
+	Direction               Direction         `json:"direction,omitempty"`               // "local" for LAN flows, "unknown" for third-party flows with no local endpoint
+	DeviceID                string            `json:"deviceID,omitempty"`                // local device holding LocalIP, with Options.Devices
+	LocalClient             string            `json:"localClient,omitempty"`             // local client the flow belongs to, with Options.PerClient
+	Subscriber              string            `json:"subscriber,omitempty"`              // internal IP of the CGNAT subscriber, with Options.CGNATLog
+	LocalFirst              bool              `json:"localFirst"`                        // whether the local endpoint comes first in the flow key
+	TransportProfile        string            `json:"transportProfile"`                  // tcp-tls, tcp-plain, quic, rtp-over-udp, dtls-srtp or udp-unknown
+	Outcome                 string            `json:"outcome,omitempty"`                 // how the connection was opened and ended, TCP and QUIC only, see classifyOutcome
+	InitialPayloadUp        []byte            `json:"initialPayloadUp,omitempty"`        // first payload bytes sent upstream, with Options.CaptureBytes
+	InitialPayloadDown      []byte            `json:"initialPayloadDown,omitempty"`      // first payload bytes sent downstream, with Options.CaptureBytes
+	DuplicatesRemoved       int               `json:"duplicatesRemoved,omitempty"`       // packets also present in an overlapping input, see dedupeOutputs
+	GapSuspected            []GapInterval     `json:"gapSuspected,omitempty"`            // suspected capture gaps the flow was active across
+	SummarizedPackets       int               `json:"summarizedPackets,omitempty"`       // packets dropped by the summarize overflow policy
+	Signature               string            `json:"signature,omitempty"`               // signed payload sizes of the first packets, e.g. "+1350 -60", with Options.SignaturePackets
+	InputFrequencyHz        float64           `json:"inputFrequencyHz,omitempty"`        // dominant frequency of small upstream packets, UDP only
+	InputRegularity         float64           `json:"inputRegularity,omitempty"`         // share of small upstream packets spaced at InputFrequencyHz
+	DTLSVersion             string            `json:"dtlsVersion,omitempty"`             // negotiated DTLS version, e.g. 1.2, from the ServerHello
+	Cipher                  string            `json:"cipher,omitempty"`                  // cipher suite selected in the DTLS ServerHello
+	SRTPProfiles            []string          `json:"srtpProfiles,omitempty"`            // SRTP protection profiles offered in the ClientHello use_srtp extension
+	SRTPProfile             string            `json:"srtpProfile,omitempty"`             // SRTP protection profile selected by the server
+	HandshakeDurationMicros int64             `json:"handshakeDurationMicros,omitempty"` // from the first ClientHello until both sides sent protected records
+	TLSRecordsUp            *TLSRecordStats   `json:"tlsRecordsUp,omitempty"`            // TLS records sent upstream, TCP only
+	TLSRecordsDown          *TLSRecordStats   `json:"tlsRecordsDown,omitempty"`          // TLS records sent downstream, TCP only
+	RecordsTruncated        bool              `json:"recordsTruncated,omitempty"`        // TLS record framing was lost to missed bytes, record counts stop there
+	NegotiationEvents       []Negotiation     `json:"negotiationEvents,omitempty"`       // messages decrypted with the keys of Options.KeyLog, see Negotiation
+	Checksums               *ChecksumCounts   `json:"checksums,omitempty"`               // checksum validation results, with Options.VerifyChecksums
+	BottleneckMbps          *BottleneckRates  `json:"bottleneckMbps,omitempty"`          // bottleneck rates implied by downstream burst dispersion
+	FrameRate               *FrameRates       `json:"frameRate,omitempty"`               // video frame rate implied by the cadence of downstream bursts, UDP only
+	RTPTiming               []RTPTiming       `json:"rtpTiming,omitempty"`               // arrival times against RTP timestamps per SSRC, rtp-over-udp only
+	TrafficClass            string            `json:"trafficClass,omitempty"`            // bulk-download for game downloads and updates, see classifyDownload, idle-connection, see classifyIdleConnections, or raced-loser, see assignRacePairs
+	DownloadEvidence        *DownloadEvidence `json:"downloadEvidence,omitempty"`        // values behind TrafficClass, for TCP flows to HTTP(S) ports
+	Limitation              *LimitationShares `json:"limitation,omitempty"`              // app-limited and network-limited shares of downstream media flows
+	CongestionEpisodes      []Congestion      `json:"congestionEpisodes,omitempty"`      // periods of downstream media flows scoring as congested, see detectCongestion
+	TCPCeiling              *TCPCeiling       `json:"tcpCeiling,omitempty"`              // what bounded the throughput of TCP downloads
+	FirstMediaDelayMicros   int64             `json:"firstMediaDelayMicros"`             // from the first upstream packet to the first downstream packet of at least Options.MediaMinPayload bytes, -1 if none
+	FirstMediaTimestamp     int64             `json:"firstMediaTimestamp,omitempty"`     // timestamp of that downstream packet
+	RampUp                  *RampUp           `json:"rampUp,omitempty"`                  // downstream rates of the first seconds after FirstMediaTimestamp, with Options.RampUpSeconds
+	Keepalive               *Keepalive        `json:"keepalive,omitempty"`               // periodic small packets the flow ends with, see measureKeepalive
+	PayloadSizesUp          *PayloadSizes     `json:"payloadSizesUp,omitempty"`          // distinct and modal payload sizes sent upstream
+	PayloadSizesDown        *PayloadSizes     `json:"payloadSizesDown,omitempty"`        // distinct and modal payload sizes sent downstream
+	PeerGroupID             int               `json:"peerGroupID,omitempty"`             // flows with the same local IP, remote IP, protocol and service share it, see assignPeerGroups
+	PeerFlowCount           int               `json:"peerFlowCount,omitempty"`           // flows in the peer group, this one included
+	RacePairID              int               `json:"racePairID,omitempty"`              // the QUIC and TCP flows of a connection race share it, see assignRacePairs
+	SessionID               int               `json:"sessionID,omitempty"`               // media flows of one session, across server migrations, share it, see linkSessions
+	Continuation            int               `json:"continuation,omitempty"`            // number of the continuation of a flushed flow, see flowFlusher
+	Mirror                  *MirrorLink       `json:"mirror,omitempty"`                  // flows read on a decrypted-mirror interface, with Options.InterfaceRoles
+	RemotePoP               *RemotePoP        `json:"remotePoP,omitempty"`               // ASN and city of the remote endpoint of session flows, with geo databases
+	PathEvents              []PathEvent       `json:"pathEvents,omitempty"`              // ICMP errors about packets of the flow, see icmpPathEvent
+	ZeroPayload             *EmptyPackets     `json:"zeroPayload,omitempty"`             // zero-payload packets not stored, with Options.ZeroPayload aggregate
+	Packets                 []Packet          `json:"packets"`
+
+	transport    transportEvidence
+	captureBytes int // payload bytes to capture per direction
+	signature    signatureState
+	download     downloadState
+	periodicity  periodicityState
+	voice        voiceState
+	dtls         dtlsState
+	bursts       burstState
+	limitation   limitState
+	rtpTiming    rtpTimingState
+	ceiling      ceilingState
+	firstMedia   firstMediaState
+	rampUp       rampUpState
+	keepalive    keepaliveState
+	response     responseState
+	sizesUp      sizeState
+	sizesDown    sizeState
+	outcome      outcomeState
+	tlsUp        tlsRecordState
+	tlsDown      tlsRecordState
+	sni          sniState
+	decrypt      *decryptState // with Options.KeyLog
+}
+
+// ExtractPacketStats extracts packet statistics from a pcap file.
+// @param ctx: cancels the extraction, nothing is written then
+// @param opts: extraction options, see Options
+// @return the meta block of the written output, nil if the file could not be processed
+func ExtractPacketStats(ctx context.Context, filePath string, outPath string, opts Options) *Meta {
+	// Extract packet statistics from the pcap file and store them in the output file
+	fmt.Println("========== Processing file: " + filePath + " ==========")
+	return writePacketStats(outPath, opts, func(extractor *Extractor) (*Meta, error) {
+		return extractor.ExtractContext(ctx, filePath)
+	})
+}
+
+// ExtractStitchedPacketStats extracts packet statistics from the next session
+// of a directory's rotated captures into one output, see stitchedCapture.
+// @return the meta block of the written output, nil if the session could not be processed
+func ExtractStitchedPacketStats(ctx context.Context, stitched *stitchedCapture, outPath string, opts Options) *Meta {
+	fmt.Println("========== Processing files from: " + stitched.files[0] + " ==========")
+	return writePacketStats(outPath, opts, func(extractor *Extractor) (*Meta, error) {
+		return extractor.ExtractStitchedContext(ctx, stitched)
+	})
+}
+
+// writePacketStats runs an extraction and stores its flows in outPath.
+func writePacketStats(outPath string, opts Options, extract func(*Extractor) (*Meta, error)) *Meta {
+	output := &Output{Flows: make(map[string]*Flow)}
+	if opts.TraceFilter != "" {
+		opts.tracePath = strings.ReplaceAll(outPath, clientToken, "all") + traceSuffix
+	}
+	extractor := NewExtractor(opts)
+	extractor.RegisterFlowHandler(output.collect)
+	meta, err := extract(extractor)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	output.Meta = meta
+	if opts.HashOutputs {
+		meta.hashes = &outputHashes{}
+	}
+	if opts.db != nil {
+		// the outputs are written all the same, for the export to be retried from them or the capture
+		if meta.exportErr = exportToDB(output, outPath, opts); meta.exportErr != nil {
+			fmt.Printf("%s: unable to export to the database: %v\n", meta.Source, meta.exportErr)
+		}
+	}
+
+	// store flow data in the selected output format
+	fmt.Printf("========== Writing to file: %s ==========\n", outPath)
+	if opts.IndexOnly {
+		err = writeIndex(outPath, output, opts)
+	} else if strings.Contains(outPath, clientToken) {
+		err = writeClientOutputs(outPath, output, opts)
+	} else {
+		err = writeSizedOutput(outPath, output, opts)
+	}
+	if errors.Is(err, errOutputTooLarge) {
+		fmt.Println(err)
+		return nil
+	}
+	if err != nil {
+		fmt.Println(err)
+		panic("unable to write to file")
+	}
+	return meta
+}
+
+// Extract reads a capture, invoking the packet handlers for every packet added
+// to a flow and the flow handlers for every flow once it is complete.
+// @return the meta block describing the capture and its flows
+func (e *Extractor) Extract(filePath string) (*Meta, error) {
+	return e.ExtractContext(context.Background(), filePath)
+}
+
+// ExtractContext is Extract, ended early with the error of ctx once ctx is
+// done. The flows of the file are not handed over then, except those already
+// evicted under Options.MaxFlows or flushed under Options.Finalize.
+func (e *Extractor) ExtractContext(ctx context.Context, filePath string) (*Meta, error) {
+	return e.extract(ctx, filePath, nil)
+}
+
+// ExtractStitched reads the next session of a directory's rotated captures as
+// a single capture, see stitchedCapture. Flows spanning a rotation are handed
+// over once, at the end of the session.
+func (e *Extractor) ExtractStitched(stitched *stitchedCapture) (*Meta, error) {
+	return e.ExtractStitchedContext(context.Background(), stitched)
+}
+
+// ExtractStitchedContext is ExtractStitched, ended early as ExtractContext.
+// A cancelled session leaves stitched to the release of its capture: it must
+// not be read any further.
+func (e *Extractor) ExtractStitchedContext(ctx context.Context, stitched *stitchedCapture) (*Meta, error) {
+	return e.extract(ctx, stitched.files[0], stitched)
+}
+
+// extract reads the capture filePath or, if stitched is set, the session of
+// rotated captures starting with filePath.
+func (e *Extractor) extract(ctx context.Context, filePath string, stitched *stitchedCapture) (*Meta, error) {
+	opts := e.opts
+	if opts.IndexOnly {
+		// the index holds no packets, store only the first of each flow
+		opts.NumPackets = 1
+	}
+	// get IP addr -- domain name mapping
+	dnsMap, answerSets := opts.DNSMap, dnsAnswerSets(opts.DNSAnswerSets)
+	if opts.DNSSinglePass {
+		// filled from the DNS responses as they are read
+		dnsMap = make(map[string]string)
+	} else if dnsMap == nil {
+		var err error
+		if dnsMap, answerSets, err = constructDNSMap(ctx, filePath, opts); err != nil {
+			return nil, err
+		}
+	}
+	// the answer sets of the DNS map and, as they are read, those of the file
+	answers := newAnswerSetIndex(answerSets, opts)
+	answerWindow := opts.duration(answerSetWindow)
+	// addresses missing from the DNS map kept for the answer set of their client
+	answeredIPs := make(map[string]bool)
+	resolved := func(remoteIP, client string, timestamp int64) bool {
+		if _, ok := dnsMap[remoteIP]; ok || answeredIPs[remoteIP] {
+			return true
+		}
+		if _, ok := answers.lookup(remoteIP, client, timestamp, answerWindow); ok {
+			answeredIPs[remoteIP] = true
+			return true
+		}
+		return false
+	}
+	dnsPorts, _ := parsePorts(opts.DNSPorts)
+	rules, err := newClassifierRules(opts.Rules, opts.KeepPorts)
+	if err != nil {
+		return nil, err
+	}
+	prefixes, _ := parseRemotePrefixes(opts.RemotePrefixes)
+	opts.localNets, _ = parseLocalSubnets(opts.LocalSubnets)
+	// the files read, all remaining files of the directory until a session ends
+	files := []string{filePath}
+	if stitched != nil {
+		files = stitched.files
+	}
+	// names saved in the capture's name resolution blocks, below captured DNS answers
+	nrbNames := make(map[string]string)
+	for _, file := range files {
+		names, err := readNameResolution(file)
+		if err != nil {
+			fmt.Println("unable to read name resolution blocks:", err)
+		}
+		for ip, name := range names {
+			if _, ok := nrbNames[ip]; !ok {
+				nrbNames[ip] = name
+			}
+		}
+	}
+	if len(nrbNames) > 0 {
+		merged := make(map[string]string, len(dnsMap)+len(nrbNames))
+		for ip, name := range dnsMap {
+			merged[ip] = name
+		}
+		for ip, name := range nrbNames {
+			if _, ok := merged[ip]; ok {
+				delete(nrbNames, ip)
+				continue
+			}
+			merged[ip] = name
+		}
+		// the DNS map may be shared by the files of a directory, the merge is per file
+		dnsMap = merged
+	}
+	// store packets for each flow
+	flowMap := make(map[string]*Flow)
+	// flows with no local endpoint, only kept with Options.ThirdParty "keep"
+	thirdPartyFlowMap := make(map[string]*Flow)
+	// flows of decrypted-mirror interfaces, only with Options.InterfaceRoles
+	mirrorFlowMap := make(map[string]*Flow)
+	roles, _ := parseInterfaceRoles(opts.InterfaceRoles)
+	// JSON fields recorded from decrypted messages, with Options.ExtractPayloads
+	var negotiationPaths []string
+	if opts.ExtractPayloads {
+		negotiationPaths, _ = parseNegotiationPaths(opts.NegotiationPaths)
+	}
+	var mirrorPackets, mirrorBytes int64
+	var thirdParty thirdPartyStats
+	// ICMP errors about packets of no tracked flow
+	var pathEvents pathEventStats
+	// addresses answered in the DNS responses of the file, and those used by flows
+	resolutions := newResolutionLog()
+	resolvers := make(localResolvers)
+	// local devices seen in ARP and DHCP, only tracked with Options.Devices
+	devices := make(deviceTable)
+	captureFilter, err := parsePayloadFilter(opts.CaptureFilter)
+	if err != nil {
+		return nil, err
+	}
+	inputBand, err := parseFrequencyBand(opts.InputBand)
+	if err != nil {
+		return nil, err
+	}
+	voiceBands, err := parseFrequencyBands(opts.VoiceBands)
+	if err != nil {
+		return nil, err
+	}
+	clockRates, err := parseClockRates(opts.RTPClockRates)
+	if err != nil {
+		return nil, err
+	}
+	telemetry, err := loadTelemetryList(opts.TelemetryList)
+	if err != nil {
+		return nil, err
+	}
+	// flows labeled from the answer set of their client rather than the DNS map
+	answerSetLabels := 0
+	label := func(flow *Flow, timestamp int64) {
+		dnsName := dnsMap[flow.RemoteIP]
+		if name, ok := answers.lookup(flow.RemoteIP, flow.LocalIP, timestamp, answerWindow); ok && name != dnsName {
+			// the name the client resolved the address from, not the last one answered with it
+			dnsName = name
+			answerSetLabels++
+		}
+		labelFlow(flow, dnsName, telemetry)
+		// with Options.DNSSinglePass, a later DNS answer replaces the name
+		if name, ok := nrbNames[flow.RemoteIP]; ok && flow.LabelSource == labelDNS && flow.DNSName == name {
+			flow.LabelSource, flow.LabelConfidence = labelNRB, nrbConfidence
+		}
+	}
+
+	// create parser to decode layer data
+	var (
+		// Will reuse these for each packet
+		ethLayer   layers.Ethernet
+		ip4Layer   layers.IPv4
+		ip6Layer   layers.IPv6
+		tcpLayer   layers.TCP
+		udpLayer   layers.UDP
+		icmpLayer  layers.ICMPv4
+		icmp6Layer layers.ICMPv6
+		raLayer    layers.ICMPv6RouterAdvertisement
+		arpLayer   layers.ARP
+		dhcpLayer  layers.DHCPv4
+		// decoded explicitly from the UDP payloads of DNS ports
+		dnsLayer layers.DNS
+	)
+	parser := gopacket.NewDecodingLayerParser(
+		layers.LayerTypeEthernet,
+		&ethLayer,
+		&ip4Layer,
+		&ip6Layer,
+		&tcpLayer,
+		&udpLayer,
+		&icmpLayer,
+		&icmp6Layer,
+		&raLayer,
+	)
+	if opts.Devices {
+		parser.AddDecodingLayer(&arpLayer)
+		parser.AddDecodingLayer(&dhcpLayer)
+	}
+
+	if opts.db != nil {
+		// the rows of the file are keyed by the hash of the bytes read,
+		// rather than by reading or downloading the capture again
+		opts.captureHash = &captureHasher{hash: sha256.New()}
+		if stitched != nil {
+			stitched.opts.captureHash = opts.captureHash
+		}
+	}
+	var handle *captureStream
+	var release func()
+	if stitched != nil {
+		// files are released by the stitched capture as they end
+		handle, err = stitched.startSession()
+		release = stitched.close
+	} else {
+		handle, release, err = openSource(filePath, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open pcap %w", err)
+	}
+	// with remote prefixes, the kernel leaves out the packets of other flows
+	// of single uncompressed captures, the others are skipped in the loop
+	var kernelFiltered bool
+	if pcapHandle, ok := handle.captureReader.(*pcap.Handle); ok && len(prefixes) > 0 {
+		if err := pcapHandle.SetBPFFilter(prefixes.bpfFilter(dnsPorts, opts.Devices)); err != nil {
+			release()
+			return nil, fmt.Errorf("unable to set remote prefix filter: %w", err)
+		}
+		kernelFiltered = true
+	}
+	tracer, err := newFilterTracer(opts, handle.LinkType(), opts.tracePath)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("unable to trace filter decisions: %w", err)
+	}
+	defer tracer.close(filePath)
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource.DecodeOptions.Lazy = true
+	packetSource.DecodeOptions.NoCopy = true
+	//packetSource.DecodeStreamsAsDatagrams = true
+	packets := packetSource.Packets()
+	// once cancelled, the read in progress may never return
+	var cancelled bool
+	defer func() {
+		handle.stop(packets, release, !cancelled)
+	}()
+
+	fmt.Println("========== Processing packets ==========")
+	var check preflight
+	progress := progressReporter{source: handle.progress, interval: opts.ProgressInterval}
+	gaps := newGapDetector(opts)
+	limits := newFlowLimits(opts)
+	flusher := newFlowFlusher(opts)
+	ratios := newRatioBins(opts)
+	// flows to local resolvers, left out of the output
+	var resolverFlows []*Flow
+	// last packet of a flow so far, the end of the capture once all are read
+	var captureEnd int64
+	// flows whose SNI and DNS name disagree
+	var sniDisagreements int
+	// flows with messages decrypted with Options.KeyLog
+	var decryptedFlows int
+	// finish completes a flow once all its packets have been observed
+	finish := func(flow *Flow) {
+		if flow.DNSName == "" && dnsMap[flow.RemoteIP] != "" {
+			// with Options.DNSSinglePass, the response may come after the first packet
+			label(flow, flow.download.first)
+		}
+		if flow.resolveSNI(opts.LabelPrecedence, telemetry) {
+			sniDisagreements++
+		}
+		flow.finalize()
+		if len(flow.NegotiationEvents) > 0 {
+			decryptedFlows++
+		}
+		// before the measures taken up to the end of the flow
+		flow.measureKeepalive(opts)
+		flow.measureFirstMedia(opts)
+		flow.measureRampUp()
+		flow.classifyOutcome(captureEnd - opts.duration(opts.OngoingIdle))
+		if flow.Direction == DirectionUnknown {
+			return
+		}
+		flow.classifyDownload(opts)
+		flow.classifyDTLS(opts)
+		// before the bursts are released
+		flow.estimateFrameRate(opts)
+		flow.estimateBottleneck(opts)
+		flow.estimateLimitation(opts)
+		flow.measureRTPTiming(clockRates, opts)
+		flow.attributeCeiling(opts)
+		flow.classifyInput(inputBand)
+		flow.classifyVoice(voiceBands)
+		rules.apply(flow)
+	}
+	var clock clockCheck
+	var checksums ChecksumCounts
+	// DNS answers with invalid names, with Options.DNSSinglePass
+	var invalidNames int
+	var fingerprints endpointFingerprints
+	if !opts.NoFingerprints {
+		fingerprints = make(endpointFingerprints)
+	}
+	// totals over all packets, and over those accounted for by flows
+	var totalPackets, totalBytes, accountedPackets, accountedBytes int64
+	// packets outside the remote prefixes
+	var skippedPackets, skippedBytes int64
+	var captureStart, captureLast int64
+	// IPv6 prefixes of router advertisements, and the packets held for the first one
+	var learned learnedPrefixes
+	held := newHeldPackets(opts, handle.LinkType())
+	// nextPacket returns the packets released by held before reading on,
+	// and whether the packet is replayed
+	nextPacket := func() (gopacket.Packet, bool) {
+		if packet := held.next(); packet != nil {
+			return packet, true
+		}
+		packet := receivePacket(ctx, packets)
+		if packet == nil && ctx.Err() == nil {
+			// the end of the capture ends the hold
+			held.end()
+			if packet := held.next(); packet != nil {
+				return packet, true
+			}
+		}
+		return packet, false
+	}
+packetLoop:
+	for packet, replayed := nextPacket(); packet != nil; packet, replayed = nextPacket() {
+		// layer processing
+		var foundLayerTypes []gopacket.LayerType
+		// the layers are reused across packets: clear the payloads read from
+		// them, so a layer not decoded for this packet cannot leak the last one's
+		tcpLayer.Payload, udpLayer.Payload = nil, nil
+		_ = parser.DecodeLayers(packet.Data(), &foundLayerTypes)
+		// the filtering decisions about the packet, with Options.TraceFilter
+		var trace *TraceRecord
+		if tracer != nil {
+			trace = tracer.start(packet.Metadata().CaptureInfo, packet.Data(), foundLayerTypes, &ip4Layer, &tcpLayer, &udpLayer, opts.timestamp(packet.Metadata().Timestamp))
+		}
+		if !replayed {
+			// replayed packets were counted when they were read
+			check.observe(packet.Metadata().CaptureInfo, len(foundLayerTypes) > 1)
+			totalPackets++
+			totalBytes += int64(len(packet.Data()))
+			if totalPackets == 1 {
+				captureStart = opts.timestamp(packet.Metadata().Timestamp)
+			}
+			captureLast = opts.timestamp(packet.Metadata().Timestamp)
+			progress.observe(filePath, packet.Metadata().CaptureLength, totalPackets)
+			gaps.observe(opts.timestamp(packet.Metadata().Timestamp))
+			if held.expire(packet, opts.timestamp(packet.Metadata().Timestamp)) {
+				if trace != nil {
+					trace.dispose("held: replayed after the IPv6 packets held for a router advertisement")
+				}
+				continue
+			}
+		}
+		var pktData Packet
+		var flowID string
+		var isThirdParty bool
+		var ipv4 bool
+		mirrored := roles.mirrored(packet.Metadata().InterfaceIndex)
+		if opts.Devices {
+			// ARP and DHCP carry no flow data, observe them before any filtering
+			for _, layerType := range foundLayerTypes {
+				switch layerType {
+				case layers.LayerTypeARP:
+					devices.observeARP(&arpLayer, packet.Metadata().Timestamp.UnixMicro())
+				case layers.LayerTypeDHCPv4:
+					devices.observeDHCP(&dhcpLayer, packet.Metadata().Timestamp.UnixMicro())
+				}
+			}
+		}
+		for _, layerType := range foundLayerTypes {
+			switch layerType {
+			case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+				var srcLocal, dstLocal bool
+				if layerType == layers.LayerTypeIPv4 {
+					ipv4 = true
+					pktData.SrcIP = ip4Layer.SrcIP.String()
+					pktData.DstIP = ip4Layer.DstIP.String()
+					srcLocal = opts.localNets.contains(ip4Layer.SrcIP) || opts.translations.isExternal(ip4Layer.SrcIP)
+					dstLocal = opts.localNets.contains(ip4Layer.DstIP) || opts.translations.isExternal(ip4Layer.DstIP)
+				} else {
+					ipv4 = false
+					pktData.SrcIP = ip6Layer.SrcIP.String()
+					pktData.DstIP = ip6Layer.DstIP.String()
+					srcLocal = learned.isLocal(ip6Layer.SrcIP, opts.localNets)
+					dstLocal = learned.isLocal(ip6Layer.DstIP, opts.localNets)
+					// delegated prefixes rotate: wait for the first router advertisement
+					if !srcLocal && !dstLocal && !replayed && held.hold(packet, opts.timestamp(packet.Metadata().Timestamp)) {
+						if trace != nil {
+							trace.dispose("held: IPv6 packet without a local endpoint before the first router advertisement, replayed after it")
+						}
+						continue packetLoop
+					}
+				}
+				// determine packet direction
+				if srcLocal && dstLocal {
+					pktData.Direction = DirectionLocal
+				} else if srcLocal {
+					pktData.Direction = DirectionUpstream
+					pktData.Upstream = true
+				} else if dstLocal {
+					pktData.Direction = DirectionDownstream
+					pktData.Upstream = false
+				} else {
+					pktData.Direction = DirectionUnknown
+					thirdParty.record(pktData.SrcIP, pktData.DstIP)
+					if opts.ThirdParty != "keep" {
+						if trace != nil {
+							trace.decide("direction", "unknown: no endpoint in the local subnets")
+							trace.dispose("dropped: third-party packet, with -third-party %s", opts.ThirdParty)
+						}
+						continue packetLoop
+					}
+					isThirdParty = true
+				}
+				if trace != nil {
+					trace.decide("direction", "%s", pktData.Direction)
+				}
+				if !ipv4 {
+					pktData.Protocol = int(ip6Layer.NextHeader)
+					if opts.IPHeaderFields {
+						pktData.FlowLabel = int(ip6Layer.FlowLabel)
+					}
+					continue
+				}
+				pktData.Protocol = int(ip4Layer.Protocol)
+				if opts.IPHeaderFields {
+					pktData.IPID = int(ip4Layer.Id)
+					pktData.DF = ip4Layer.Flags&layers.IPv4DontFragment != 0
+				}
+			case layers.LayerTypeICMPv6RouterAdvertisement:
+				if opts.LearnPrefixes && learned.learn(&raLayer, ip6Layer.SrcIP, opts.timestamp(packet.Metadata().Timestamp)) {
+					// the held packets are replayed with the prefix
+					held.end()
+				}
+			case layers.LayerTypeICMPv4:
+				// errors about packets of flows, e.g. fragmentation needed or port unreachable
+				if event, quoted, ok := icmpPathEvent(&icmpLayer, pktData.SrcIP, opts.timestamp(packet.Metadata().Timestamp)); ok {
+					pathEvents.match(event, &quoted, flowMap, thirdPartyFlowMap, opts, packet.Metadata().Timestamp)
+				}
+			case layers.LayerTypeTCP, layers.LayerTypeUDP:
+				// fill in packet data
+				pktData.Timestamp = opts.timestamp(packet.Metadata().Timestamp)
+				pktData.PktLength = len(packet.Data())
+				var payload, transportHeader []byte
+				if layerType == layers.LayerTypeTCP {
+					pktData.SrcPort = int(tcpLayer.SrcPort)
+					pktData.DstPort = int(tcpLayer.DstPort)
+					payload, transportHeader = tcpLayer.Payload, tcpLayer.Contents
+				} else {
+					pktData.SrcPort = int(udpLayer.SrcPort)
+					pktData.DstPort = int(udpLayer.DstPort)
+					payload, transportHeader = udpLayer.Payload, udpLayer.Contents
+				}
+				pktData.PayloadSize = len(payload)
+				if ipv4 {
+					// the IPv4 layer is only current when decoded for this packet
+					pktData.PayloadSize = l4PayloadSize(&ip4Layer, len(transportHeader), len(payload))
+				}
+				checksum := checksumUnverified
+				if opts.VerifyChecksums && ipv4 && packet.Metadata().CaptureLength == packet.Metadata().Length {
+					checksum = verifyChecksums(&ip4Layer, transportHeader, payload)
+					checksums.add(checksum)
+					check.observeChecksum(pktData.Direction, checksum)
+					pktData.BadChecksum = checksum == checksumBad
+					if pktData.BadChecksum && pktData.Direction != DirectionUpstream {
+						// received corrupted, keep it out of payload-based features; bad
+						// checksums of sent packets are usually offloaded checksums
+						payload = nil
+					}
+				}
+				if fingerprints != nil && ipv4 && (pktData.Direction == DirectionUpstream || pktData.Direction == DirectionLocal) {
+					// fingerprints cover all flows of a local IP, observe them before filtering
+					if layerType == layers.LayerTypeTCP {
+						fingerprints.observe(&ip4Layer, &tcpLayer)
+					} else {
+						fingerprints.observe(&ip4Layer, nil)
+					}
+				}
+				if layerType == layers.LayerTypeUDP && dnsPorts[pktData.SrcPort] &&
+					dnsLayer.DecodeFromBytes(payload, gopacket.NilDecodeFeedback) == nil {
+					resolutions.observe(&dnsLayer, pktData.Timestamp)
+					sets := responseAnswerSets(pktData.DstIP, &dnsLayer, packet.Metadata().Timestamp)
+					for _, name := range sortedKeys(sets) {
+						set := sets[name]
+						answers.add(name, &set, pktData.Timestamp)
+					}
+					resolvers.observe(&pktData, &dnsLayer)
+					if opts.DNSSinglePass {
+						invalidNames += learnDNSResponse(dnsMap, &dnsLayer)
+					}
+				}
+				// clock evidence may come from any flow, observe it before filtering
+				clock.observe(packet.Metadata().Timestamp, pktData.SrcPort, layerType == layers.LayerTypeUDP, payload)
+				if len(prefixes) > 0 && !prefixes.allows(&pktData) {
+					skippedPackets++
+					skippedBytes += int64(pktData.PktLength)
+					if trace != nil {
+						trace.dispose("skipped: remote endpoint outside the remote prefixes")
+					}
+					continue packetLoop
+				}
+				if trace != nil && len(prefixes) > 0 {
+					trace.decide("remote-prefixes", "within the remote prefixes")
+				}
+				flows := flowMap
+				switch pktData.Direction {
+				case DirectionUnknown:
+					// no local endpoint: order endpoints canonically and treat packets
+					// sent by the first endpoint as upstream
+					pktData.Upstream = pktData.canonicalUpstream()
+					flows = thirdPartyFlowMap
+				case DirectionLocal:
+					// LAN flows (e.g. in-home streaming) have no DNS names, keep all of them
+					pktData.Upstream = pktData.canonicalUpstream()
+				case DirectionUpstream, DirectionDownstream:
+					remoteIP, client := pktData.DstIP, pktData.SrcIP
+					if !pktData.Upstream {
+						remoteIP, client = pktData.SrcIP, pktData.DstIP
+					}
+					// filter out unknown DNS names unless kept by a rule, e.g. within a known port range
+					if resolved(remoteIP, client, pktData.Timestamp) {
+						if trace != nil {
+							trace.decide("dns", "%s resolved in the DNS map or the answers to %s", remoteIP, client)
+						}
+					} else if rule := rules.keeper(&pktData); rule != "" {
+						if trace != nil {
+							trace.decide("dns", "%s not in the DNS map nor the answers to %s", remoteIP, client)
+							trace.decide("rules", "kept by rule %s", rule)
+						}
+					} else {
+						if trace != nil {
+							trace.decide("dns", "%s not in the DNS map nor the answers to %s", remoteIP, client)
+							trace.decide("rules", "no rule keeps it")
+							trace.dispose("dropped: no DNS name and no keeping rule")
+						}
+						continue packetLoop
+					}
+				}
+				// check if flow exists
+				canonical := opts.CanonicalKeys || pktData.Direction == DirectionUnknown || pktData.Direction == DirectionLocal
+				flowID = pktData.getFlowID(canonical)
+				var subscriber string
+				if opts.translations != nil && !isThirdParty {
+					// the external tuple may be reassigned to another subscriber mid-capture,
+					// keying flows by subscriber splits them at the reassignment
+					if pktData.Upstream {
+						subscriber = opts.translations.subscriber(pktData.SrcIP, pktData.SrcPort, packet.Metadata().Timestamp)
+					} else {
+						subscriber = opts.translations.subscriber(pktData.DstIP, pktData.DstPort, packet.Metadata().Timestamp)
+					}
+					flowID += "/" + subscriber
+				}
+				if mirrored {
+					// decrypted copies of wire packets, kept apart from the wire flows
+					flowID += mirrorKeySuffix
+					flows = mirrorFlowMap
+				}
+				if limits != nil {
+					if limits.dropped[flowID] {
+						limits.drop(flowID, &pktData)
+						if trace != nil {
+							trace.dispose("not stored: flow %s was refused under -max-flows", flowID)
+						}
+						continue packetLoop
+					}
+					if _, ok := flows[flowID]; !ok {
+						if evicted := limits.evict(flowMap, thirdPartyFlowMap); len(evicted) > 0 {
+							for _, flow := range evicted {
+								finish(flow)
+							}
+							e.handleFlows(evicted)
+						}
+						remoteIP := pktData.SrcIP
+						if pktData.Upstream {
+							remoteIP = pktData.DstIP
+						}
+						if !limits.admit(len(flowMap)+len(thirdPartyFlowMap), dnsMap[remoteIP] != "") {
+							limits.drop(flowID, &pktData)
+							if trace != nil {
+								trace.dispose("not stored: new flow %s refused under -max-flows", flowID)
+							}
+							continue packetLoop
+						}
+					}
+				}
+				var continuation int
+				if _, ok := flows[flowID]; !ok && flusher != nil {
+					var late bool
+					if continuation, late = flusher.lateArrival(flowID, &pktData); late {
+						if trace != nil {
+							trace.dispose("not stored: late packet of flushed flow %s, with -late-arrivals %s", flowID, opts.LateArrivals)
+						}
+						continue packetLoop
+					}
+				}
+				flow, ok := flows[flowID]
+				if !ok {
+					if pktData.Upstream {
+						flows[flowID] = &Flow{
+							LocalIP:    pktData.SrcIP,
+							RemoteIP:   pktData.DstIP,
+							LocalPort:  pktData.SrcPort,
+							RemotePort: pktData.DstPort,
+							Protocol:   pktData.Protocol,
+							Packets:    []Packet{pktData},
+						}
+					} else {
+						flows[flowID] = &Flow{
+							LocalIP:    pktData.DstIP,
+							RemoteIP:   pktData.SrcIP,
+							LocalPort:  pktData.DstPort,
+							RemotePort: pktData.SrcPort,
+							Protocol:   pktData.Protocol,
+							Packets:    []Packet{pktData},
+						}
+					}
+					flow = flows[flowID]
+					flow.Subscriber = subscriber
+					flow.Continuation = continuation
+					if mirrored {
+						flow.Mirror = &MirrorLink{Interface: packet.Metadata().InterfaceIndex}
+					}
+					if !isThirdParty {
+						resolutions.use(flow.RemoteIP)
+					}
+					label(flow, pktData.Timestamp)
+					flow.LocalFirst = !opts.CanonicalKeys || endpointLess(flow.LocalIP, flow.LocalPort, flow.RemoteIP, flow.RemotePort)
+					if pktData.Direction == DirectionUnknown || pktData.Direction == DirectionLocal {
+						flow.Direction = pktData.Direction
+					}
+					if flow.Protocol == 17 {
+						flow.periodicity.maxSize = opts.InputMaxSize
+						flow.periodicity.tsPerMs = opts.timestampsPerMs()
+						if len(voiceBands) > 0 {
+							flow.voice.pacing = periodicityState{minSize: opts.VoiceMinSize, maxSize: opts.VoiceMaxSize, tsPerMs: opts.timestampsPerMs()}
+						}
+						if inputBand != nil {
+							flow.response = responseState{eventGap: opts.duration(inputEventGap), frameGap: opts.duration(frameGap), maxSize: opts.InputMaxSize}
+						}
+					}
+					if opts.VerifyChecksums {
+						flow.Checksums = &ChecksumCounts{}
+					}
+					flow.signature.remaining = opts.SignaturePackets
+					flow.signature.zeroPayload = opts.SignatureZeroPayload
+					flow.bursts.maxGap = opts.duration(time.Duration(opts.BurstGapMicros) * time.Microsecond)
+					flow.bursts.minPackets = opts.BurstMinPackets
+					flow.bursts.skipEmpty = opts.ZeroPayload != zeroPayloadKeep
+					if !opts.IndexOnly && !opts.Sketch {
+						// neither holds the classification
+						flow.limitation.binWidth, flow.limitation.thresholds = opts.limitBinWidth(), opts.limitThresholds()
+					}
+					flow.firstMedia.minPayload = max(opts.MediaMinPayload, 1)
+					flow.rampUp.window, flow.rampUp.bin = opts.RampUpSeconds, max(opts.duration(rampUpBin), 1)
+					flow.keepalive.maxPayload, flow.keepalive.minPeriod = opts.KeepaliveMaxPayload, opts.duration(opts.KeepaliveMinPeriod)
+					if opts.CaptureBytes > 0 && captureFilter.matches(flow) {
+						flow.captureBytes = opts.CaptureBytes
+					}
+					flow.decrypt = newDecryptState(opts.keyLog, negotiationPaths)
+					e.handlePacket(&pktData, flowID)
+					if trace != nil {
+						trace.dispose("stored: first packet of flow %s", flowID)
+					}
+				} else if opts.ZeroPayload == zeroPayloadAggregate && pktData.PayloadSize == 0 {
+					if flow.ZeroPayload == nil {
+						flow.ZeroPayload = &EmptyPackets{}
+					}
+					flow.ZeroPayload.add(&pktData)
+					if trace != nil {
+						trace.dispose("counted in flow %s, not stored: zero payload, with -zero-payload %s", flowID, opts.ZeroPayload)
+					}
+				} else if opts.NumPackets == 0 || len(flow.Packets) < opts.NumPackets {
+					// only store packets until the max number of packets per flow is reached
+					flow.Packets = append(flow.Packets, pktData)
+					e.handlePacket(&pktData, flowID)
+					if trace != nil {
+						trace.dispose("stored in flow %s", flowID)
+					}
+				} else if trace != nil {
+					trace.dispose("counted in flow %s, not stored: flow already holds %d packets", flowID, opts.NumPackets)
+				}
+				if ok {
+					flow.GapSuspected = append(flow.GapSuspected, gaps.spanned(flow.download.last, pktData.Timestamp)...)
+				}
+				flow.observe(&pktData, payload)
+				if layerType == layers.LayerTypeTCP {
+					flow.outcome.observe(&pktData, payload, &tcpLayer)
+				} else {
+					flow.outcome.observe(&pktData, payload, nil)
+				}
+				captureEnd = max(captureEnd, pktData.Timestamp)
+				if layerType == layers.LayerTypeTCP {
+					flow.observeTLSRecords(pktData.Upstream, tcpLayer.Seq, payload)
+					if pktData.Upstream {
+						flow.sni.observe(payload)
+					}
+					if flow.decrypt != nil {
+						flow.decrypt.observeTCP(&pktData, tcpLayer.Seq, payload)
+					}
+					flow.ceiling.observe(&pktData, &tcpLayer, len(payload))
+					if flow.limitation.binWidth > 0 && flow.firstMedia.found {
+						pureAck := tcpLayer.ACK && !tcpLayer.SYN && !tcpLayer.FIN && !tcpLayer.RST
+						flow.limitation.observeTCP(&pktData, tcpLayer.Seq, tcpLayer.Ack, pureAck, len(payload))
+					}
+				} else if flow.decrypt != nil {
+					flow.decrypt.observeUDP(&pktData, payload)
+				}
+				if flow.Checksums != nil {
+					flow.Checksums.add(checksum)
+				}
+				if mirrored {
+					mirrorPackets++
+					mirrorBytes += int64(pktData.PktLength)
+					break
+				}
+				if opts.metrics != nil && !isThirdParty {
+					opts.metrics.observe(flow, flowID, &pktData, packet.Metadata().Timestamp.Unix())
+				}
+				accountedPackets++
+				accountedBytes += int64(pktData.PktLength)
+				if ratios != nil && (pktData.Direction == DirectionUpstream || pktData.Direction == DirectionDownstream) {
+					client := flow.LocalIP
+					if flow.Subscriber != "" {
+						client = flow.Subscriber
+					}
+					ratios.observe(client, &pktData)
+				}
+				if flusher == nil {
+					break
+				}
+				if flushed := flusher.sweep(captureEnd, flowMap, thirdPartyFlowMap); len(flushed) > 0 {
+					if len(resolvers) > 0 {
+						// the resolvers answering them are known by now
+						excluded := resolvers.exclude(flushed, dnsPorts)
+						for _, flow := range excluded {
+							accountedPackets -= int64(flow.download.packets)
+							accountedBytes -= flow.download.upBytes + flow.download.downBytes
+						}
+						resolverFlows = append(resolverFlows, excluded...)
+					}
+					for _, flow := range flushed {
+						finish(flow)
+					}
+					flusher.account(flushed)
+					e.handleFlows(flushed)
+				}
+			}
+		}
+	}
+	handle.rethrow()
+	if err := ctx.Err(); err != nil {
+		cancelled = true
+		return nil, fmt.Errorf("extraction of %s stopped after %d packets: %w", filePath, totalPackets, err)
+	}
+	if err := handle.remoteFailure(); err != nil {
+		return nil, fmt.Errorf("extraction of %s stopped after %d packets: %w", filePath, totalPackets, err)
+	}
+	handle.finishHash()
+	// flows to a local resolver may start before its first response, drop them once all are known
+	if len(resolvers) > 0 {
+		excluded := resolvers.exclude(flowMap, dnsPorts)
+		for _, flow := range excluded {
+			accountedPackets -= int64(flow.download.packets)
+			accountedBytes -= flow.download.upBytes + flow.download.downBytes
+		}
+		resolverFlows = append(resolverFlows, excluded...)
+	}
+	for _, flows := range []map[string]*Flow{flowMap, thirdPartyFlowMap, mirrorFlowMap} {
+		for _, flow := range flows {
+			finish(flow)
+		}
+	}
+	var unlinkedMirrors int
+	if len(mirrorFlowMap) > 0 {
+		unlinkedMirrors = linkMirrors(mirrorFlowMap, flowMap, opts)
+		fmt.Printf("%s: %d decrypted-mirror flows (%d packets) stored apart, %d without a wire flow\n", filePath, len(mirrorFlowMap), mirrorPackets, unlinkedMirrors)
+	}
+	// once labels are final, as management overrides them
+	var management managementStats
+	if opts.ExcludeMgmt {
+		management = tagManagement(flowMap, opts)
+		if opts.MgmtDrop {
+			accountedPackets -= management.packets
+			accountedBytes -= management.bytes
+		}
+	}
+	thirdParty.report(opts.ThirdParty)
+	if opts.rdns != nil {
+		labelByRDNS(opts.rdns, flowMap)
+	}
+	// once labels are final, as pairs are per host
+	racePairs := assignRacePairs(flowMap, opts)
+	// once labels are final, only flows of known services count
+	idleConnections := classifyIdleConnections(flowMap)
+	// after all labels are final, as groups are per service
+	peerGroups := assignPeerGroups(flowMap)
+	migrations := linkSessions(flowMap, opts)
+	var popChanges []PoPChange
+	if opts.geo != nil {
+		popChanges = trackPoPChanges(flowMap, opts.geo, opts)
+	}
+	inputResponses := measureInputResponses(flowMap, opts)
+	frameRateChanges := collectFrameRateChanges(flowMap)
+	var ratioTimelines []RatioTimeline
+	if ratios != nil {
+		ratioTimelines = ratios.timelines(opts)
+	}
+	qualityWarnings := check.warnings(len(dnsMap), opts)
+	if handle.err != nil {
+		// flows keep the packets read until then, as for a truncated file
+		qualityWarnings = append(qualityWarnings, fmt.Sprintf("capture ends early after %d packets: %v", totalPackets, handle.err))
+	}
+	clockOffset := clock.estimate(opts)
+	if warning := clockWarning(clockOffset, opts); warning != "" {
+		qualityWarnings = append(qualityWarnings, warning)
+	}
+	printWarnings(filePath, qualityWarnings)
+	if opts.Devices {
+		for _, flow := range flowMap {
+			flow.DeviceID = devices.lookup(flow.LocalIP, opts.microseconds(flow.Packets[0].Timestamp))
+		}
+		if err := saveDevices(localDir(filePath, opts), devices); err != nil {
+			fmt.Println("unable to write devices:", err)
+		}
+	}
+	resolvedButUnused, unusedResolved := resolutions.unused()
+	if clockOffset != nil && opts.FixClock {
+		// after device lookups, which use the capture clock
+		correctClock(clockOffset, opts, flowMap, thirdPartyFlowMap, mirrorFlowMap)
+		offset := clockOffset.CorrectedStart - clockOffset.RawStart
+		captureStart += offset
+		captureLast += offset
+		for i := range pathEvents.stray {
+			pathEvents.stray[i].Timestamp += offset
+		}
+		for i := range resolvedButUnused {
+			resolvedButUnused[i].FirstResolved += offset
+		}
+		for i := range migrations {
+			migrations[i].Timestamp += offset
+		}
+		for i := range popChanges {
+			popChanges[i].Timestamp += offset
+		}
+		for i := range ratioTimelines {
+			ratioTimelines[i].Start += offset
+			for j := range ratioTimelines[i].StreamingLikely {
+				ratioTimelines[i].StreamingLikely[j].Start += offset
+				ratioTimelines[i].StreamingLikely[j].End += offset
+			}
+		}
+	}
+	if invalidNames > 0 {
+		fmt.Printf("%s: %d DNS answers with invalid names ignored\n", filePath, invalidNames)
+	}
+	if pathEvents.matched > 0 || pathEvents.count > 0 {
+		fmt.Printf("%s: %d ICMP errors about tracked flows, %d about other packets\n", filePath, pathEvents.matched, pathEvents.count)
+	}
+	meta := &Meta{
+		SchemaVersion:     schemaVersion,
+		Clock:             clockOffset,
+		Version:           BuildVersion(),
+		Options:           opts,
+		OptionsHash:       opts.optionsHash,
+		Source:            filePath,
+		captureHash:       opts.captureHash,
+		Format:            opts.Format,
+		Services:          serviceRollup(flowMap),
+		NRBMappings:       len(nrbNames),
+		AnswerSetLabels:   answerSetLabels,
+		SNIDisagreements:  sniDisagreements,
+		ResolvedButUnused: resolvedButUnused,
+		UnusedResolved:    unusedResolved,
+		LocalResolvers:    resolvers.ips(),
+		ResolverFlows:     len(resolverFlows),
+		LearnedPrefixes:   learned.prefixes,
+		PeerGroups:        peerGroups,
+		Migrations:        migrations,
+		PoPChanges:        popChanges,
+		InputResponses:    inputResponses,
+		FrameRateChanges:  frameRateChanges,
+		RatioTimelines:    ratioTimelines,
+		StrayICMPErrors:   pathEvents.stray,
+		StrayICMPCount:    pathEvents.count,
+		ThirdPartyPackets: thirdParty.packets,
+		ThirdPartySamples: thirdParty.samples,
+		QualityWarnings:   qualityWarnings,
+		PayloadCapture:    opts.CaptureBytes > 0,
+		ZeroPayload:       opts.ZeroPayload,
+		TotalPackets:      totalPackets,
+		TotalBytes:        totalBytes,
+		AccountedPackets:  accountedPackets,
+		AccountedBytes:    accountedBytes,
+		IdleConnections:   len(idleConnections),
+		RacePairs:         racePairs,
+		SkippedPackets:    skippedPackets,
+		SkippedBytes:      skippedBytes,
+		MirrorPackets:     mirrorPackets,
+		MirrorBytes:       mirrorBytes,
+		UnlinkedMirrors:   unlinkedMirrors,
+		DecryptedFlows:    decryptedFlows,
+		CaptureStart:      captureStart,
+		CaptureEnd:        captureLast,
+		CaptureTimezone:   opts.Timezone,
+		RuleMatches:       rules.matches,
+	}
+	if kernelFiltered {
+		meta.Notes = append(meta.Notes, "packets outside the remote prefixes were left out by the kernel filter: they are not part of TotalPackets and TotalBytes, nor of the fingerprints and clock checks")
+	}
+	if opts.VerifyChecksums {
+		meta.Checksums = &checksums
+	}
+	if len(resolvers) > 0 {
+		meta.Notes = append(meta.Notes, fmt.Sprintf("local DNS resolver detected at %s: DNS names are those it answered to clients, its own upstream resolution is not visible", strings.Join(meta.LocalResolvers, ", ")))
+	}
+	if fingerprints != nil {
+		meta.LocalEndpoints = fingerprints.endpoints()
+	}
+	if limits != nil {
+		meta.EvictedFlows = limits.evicted
+		meta.FlowsNotStored, meta.PacketsNotStored, meta.BytesNotStored = limits.notStored, limits.packets, limits.bytes
+		if limits.evicted > 0 || limits.notStored > 0 {
+			fmt.Printf("%s: flow limit reached, %d flows evicted early, %d flows (%d packets) not stored\n", filePath, limits.evicted, limits.notStored, limits.packets)
+		}
+	}
+	meta.TopFlows, meta.ByteConcentration = heavyHitters(flowMap)
+	printHeavyHitters(filePath, meta.TopFlows, meta.ByteConcentration)
+	meta.TelemetryPackets, meta.TelemetryBytes = telemetryTotals(flowMap)
+	if flusher != nil {
+		mergeServiceStats(meta.Services, flusher.services)
+		meta.TelemetryPackets += flusher.telemetryPackets
+		meta.TelemetryBytes += flusher.telemetryBytes
+		meta.FlushedFlows, meta.ReopenedFlows = flusher.flushed, flusher.reopened
+		meta.LatePackets, meta.LateBytes = flusher.latePackets, flusher.lateBytes
+		if flusher.flushed > 0 {
+			meta.Notes = append(meta.Notes, fmt.Sprintf("%d flows were flushed as they ended: they count in the service rollups and telemetry totals, not in the analyses across flows (peer groups, sessions, races, idle connections, heavy hitters) nor in management tagging and clock correction", flusher.flushed))
+		}
+	}
+	if meta.TelemetryPackets > 0 {
+		fmt.Printf("%s: %d telemetry/ad packets (%.1f%% of bytes) left out of service rollups\n", filePath, meta.TelemetryPackets, percentage(meta.TelemetryBytes, meta.AccountedBytes))
+	}
+	if opts.ExcludeMgmt {
+		meta.CaptureHosts = management.hosts
+		meta.ManagementFlows, meta.ManagementPackets, meta.ManagementBytes = len(management.flows), management.packets, management.bytes
+		if len(management.flows) > 0 {
+			fmt.Printf("%s: %d management flows (%.1f%% of bytes) left out of service rollups\n", filePath, len(management.flows), percentage(management.bytes, totalBytes))
+		}
+	}
+	if stitched != nil {
+		files = stitched.read
+		meta.Sources = files
+	}
+	var kernelDrops int64
+	for _, file := range files {
+		if drops, ok, err := readKernelDrops(file); err != nil {
+			fmt.Println("unable to read interface statistics:", err)
+		} else if ok {
+			kernelDrops += drops
+			meta.KernelDrops = &kernelDrops
+		}
+	}
+	if gaps.suspected(totalPackets, meta.KernelDrops, opts) {
+		meta.CaptureGaps = gaps.gaps
+		printGaps(filePath, meta.CaptureGaps, opts)
+	} else {
+		// quiet periods of a sparse capture are no sign of drops
+		for _, flows := range []map[string]*Flow{flowMap, thirdPartyFlowMap, mirrorFlowMap} {
+			for _, flow := range flows {
+				flow.GapSuspected = nil
+			}
+		}
+	}
+	if opts.PerClient {
+		for _, flow := range flowMap {
+			flow.LocalClient = flow.LocalIP
+			if flow.Subscriber != "" {
+				flow.LocalClient = flow.Subscriber
+			}
+		}
+		for _, flow := range mirrorFlowMap {
+			flow.LocalClient = flow.LocalIP
+		}
+		meta.Clients = clientRollup(flowMap)
+		if len(meta.Clients) == 1 {
+			meta.Notes = append(meta.Notes, "only one local IP seen: devices behind the same IP (NAT inside the LAN) are not separated into clients")
+		}
+	}
+	if opts.ExcludeIdleConnections {
+		// after the rollups, which count them apart
+		for _, key := range idleConnections {
+			flow := flowMap[key]
+			meta.AccountedPackets -= int64(flow.download.packets)
+			meta.AccountedBytes -= flow.download.upBytes + flow.download.downBytes
+			delete(flowMap, key)
+		}
+	}
+	if len(idleConnections) > 0 {
+		fmt.Printf("%s: %d idle connections to known services counted apart in service rollups\n", filePath, len(idleConnections))
+	}
+	// the flows not flushed are complete at the end of the file
+	e.handleFlows(flowMap)
+	e.handleFlows(thirdPartyFlowMap)
+	e.handleFlows(mirrorFlowMap)
+	return meta, nil
+}
+
+func (flow *Flow) getFlowID() string {
+	var flowID string
+	if !flow.LocalFirst {
+		flowID = flow.RemoteIP + ":" + strconv.Itoa(flow.RemotePort) + "-" + flow.LocalIP + ":" + strconv.Itoa(flow.LocalPort) + "@" + strconv.Itoa(flow.Protocol)
+	} else {
+		flowID = flow.LocalIP + ":" + strconv.Itoa(flow.LocalPort) + "-" + flow.RemoteIP + ":" + strconv.Itoa(flow.RemotePort) + "@" + strconv.Itoa(flow.Protocol)
+	}
+	if flow.Subscriber != "" {
+		flowID += "/" + flow.Subscriber
+	}
+	if flow.Continuation > 0 {
+		flowID += "#" + strconv.Itoa(flow.Continuation)
+	}
+	if flow.Mirror != nil {
+		flowID += mirrorKeySuffix
+	}
+	return flowID
+}
+
+// getFlowID returns the local-remote flow key of the packet, or with canonical set,
+// a key with the lower IP:port endpoint first so it is independent of the vantage point.
+func (packet *Packet) getFlowID(canonical bool) string {
+	srcFirst := packet.Upstream
+	if canonical {
+		srcFirst = endpointLess(packet.SrcIP, packet.SrcPort, packet.DstIP, packet.DstPort)
+	}
+	if srcFirst {
+		return packet.SrcIP + ":" + strconv.Itoa(packet.SrcPort) + "-" + packet.DstIP + ":" + strconv.Itoa(packet.DstPort) + "@" + strconv.Itoa(packet.Protocol)
+	} else {
+		return packet.DstIP + ":" + strconv.Itoa(packet.DstPort) + "-" + packet.SrcIP + ":" + strconv.Itoa(packet.SrcPort) + "@" + strconv.Itoa(packet.Protocol)
+	}
+}
+
+// l4PayloadSize returns the transport payload length implied by the header
+// lengths of an IPv4 packet: its total length minus the IP header and the
+// transport header, both with options. Unlike the captured payload, it
+// includes bytes cut by the snap length. Inconsistent header lengths fall
+// back to the captured payload length.
+func l4PayloadSize(ip *layers.IPv4, transportHeaderLength, captured int) int {
+	size := int(ip.Length) - int(ip.IHL)*4 - transportHeaderLength
+	if size < captured {
+		return captured
+	}
+	return size
+}
+
+// endpointLess reports whether endpoint a sorts before endpoint b, comparing
+// addresses numerically and then ports.
+func endpointLess(ipA string, portA int, ipB string, portB int) bool {
+	if c := bytes.Compare(net.ParseIP(ipA).To16(), net.ParseIP(ipB).To16()); c != 0 {
+		return c < 0
+	}
+	return portA < portB
+}
+
+// constructDNSMap maps the addresses answered in the DNS responses of a
+// capture to their names, and records the answer set of each response, or
+// reads the directory's dns_map.json. It fails with the error of ctx once ctx
+// is done.
+func constructDNSMap(ctx context.Context, filePath string, opts Options) (map[string]string, dnsAnswerSets, error) {
+	// Construct a map of DNS queries and responses
+	fmt.Println("========== Mapping DNS names for " + filePath + " ==========")
+	dnsMap := make(map[string]string)
+	answerSets := make(dnsAnswerSets)
+	// check if dns map file already exists
+	dnsMapPath := filepath.Join(localDir(filePath, opts), "dns_map.json")
+	if _, err := os.Stat(dnsMapPath); err == nil {
+		fmt.Println("DNS map already exists, reading from file")
+		dnsMap, answerSets, err := readDNSMapFile(dnsMapPath)
+		if err != nil {
+			fmt.Println(err)
+			panic("unable to read DNS map file")
+		}
+		if invalid := normalizeDNSMap(dnsMap); invalid > 0 {
+			fmt.Printf("%s: %d invalid DNS names ignored\n", dnsMapPath, invalid)
+		}
+		return dnsMap, answerSets, nil
+	}
+
+	// create parser to decode layer data
+	var (
+		// Will reuse these for each packet
+		ethLayer   layers.Ethernet
+		ip4Layer   layers.IPv4
+		ip6Layer   layers.IPv6
+		tcpLayer   layers.TCP
+		udpLayer   layers.UDP
+		icmp6Layer layers.ICMPv6
+		raLayer    layers.ICMPv6RouterAdvertisement
+		// decoded explicitly, the parser only recognizes DNS on port 53
+		dnsLayer layers.DNS
+	)
+	parser := gopacket.NewDecodingLayerParser(
+		layers.LayerTypeEthernet,
+		&ethLayer,
+		&ip4Layer,
+		&ip6Layer,
+		&tcpLayer,
+		&udpLayer,
+		&icmp6Layer,
+		&raLayer,
+	)
+	dnsPorts, _ := parsePorts(opts.DNSPorts)
+	// synthesized AAAA records are mapped once all A records and NAT64 prefixes are known
+	nat64 := newNAT64Prefixes()
+	var aaaaRecords []layers.DNSResourceRecord
+	// answers with malformed names, left out of the map
+	invalidNames := 0
+	// answer sets recorded and those beyond maxAnswerSets
+	recordedSets, droppedSets := 0, 0
+
+	handle, release, err := openSource(filePath, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open pcap %w", err)
+	}
+	// only check DNS responses and router advertisements; compressed captures
+	// have no BPF support and are filtered by the port check below
+	if pcapHandle, ok := handle.captureReader.(*pcap.Handle); ok {
+		if err := pcapHandle.SetBPFFilter(dnsBPFFilter(dnsPorts)); err != nil {
+			panic("unable to set BPF filter")
+		}
+	}
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource.DecodeOptions.Lazy = true
+	packetSource.DecodeOptions.NoCopy = true
+	packets := packetSource.Packets()
+	var cancelled bool
+	defer func() {
+		handle.stop(packets, release, !cancelled)
+	}()
+
+	for packet := receivePacket(ctx, packets); packet != nil; packet = receivePacket(ctx, packets) {
+		var foundLayerTypes []gopacket.LayerType
+		_ = parser.DecodeLayers(packet.Data(), &foundLayerTypes)
+		var client string
+		for _, layerType := range foundLayerTypes {
+			switch layerType {
+			case layers.LayerTypeIPv4:
+				client = ip4Layer.DstIP.String()
+			case layers.LayerTypeIPv6:
+				client = ip6Layer.DstIP.String()
+			case layers.LayerTypeUDP:
+				if !dnsPorts[int(udpLayer.SrcPort)] || dnsLayer.DecodeFromBytes(udpLayer.Payload, gopacket.NilDecodeFeedback) != nil {
+					continue
+				}
+				sets := responseAnswerSets(client, &dnsLayer, packet.Metadata().Timestamp)
+				for _, name := range sortedKeys(sets) {
+					if recordedSets < maxAnswerSets {
+						answerSets[name] = append(answerSets[name], sets[name])
+						recordedSets++
+					} else {
+						droppedSets++
+					}
+				}
+				if dnsLayer.QR {
+					for _, answer := range dnsLayer.Answers {
+						dnsRecord := answer
+						if dnsRecord.Type == layers.DNSTypeA {
+							if !mapDNSName(dnsMap, dnsRecord.IP.String(), string(dnsRecord.Name)) {
+								invalidNames++
+							}
+						} else if dnsRecord.Type == layers.DNSTypeAAAA {
+							dnsRecord.Name = append([]byte(nil), dnsRecord.Name...)
+							dnsRecord.IP = append(net.IP(nil), dnsRecord.IP...)
+							aaaaRecords = append(aaaaRecords, dnsRecord)
+						}
+					}
+				}
+			case layers.LayerTypeICMPv6RouterAdvertisement:
+				nat64.learnFromRA(&raLayer)
+			}
+		}
+	}
+	handle.rethrow()
+	if err := ctx.Err(); err != nil {
+		// a partial map must not be written as the directory's
+		cancelled = true
+		return nil, nil, fmt.Errorf("DNS mapping of %s stopped: %w", filePath, err)
+	}
+	if err := handle.remoteFailure(); err != nil {
+		return nil, nil, fmt.Errorf("DNS mapping of %s stopped: %w", filePath, err)
+	}
+	for _, dnsRecord := range aaaaRecords {
+		// map DNS64-synthesized addresses back to the name of the A record they embed
+		dnsName := string(dnsRecord.Name)
+		if ipv4 := nat64.embeddedIPv4(dnsRecord.IP); ipv4 != nil {
+			if name, ok := dnsMap[ipv4.String()]; ok {
+				dnsName = name
+			}
+		}
+		if !mapDNSName(dnsMap, dnsRecord.IP.String(), dnsName) {
+			invalidNames++
+		}
+	}
+	if invalidNames > 0 {
+		fmt.Printf("%s: %d DNS answers with invalid names ignored\n", filePath, invalidNames)
+	}
+	if droppedSets > 0 {
+		fmt.Printf("%s: %d DNS answer sets beyond the first %d not recorded\n", filePath, droppedSets, maxAnswerSets)
+	}
+	// write map to a file in the same directory as the pcap file
+	fmt.Println("========== Writing DNS map to file ==========")
+	jsonString, err := json.Marshal(dnsMapFile{Names: dnsMap, AnswerSets: answerSets})
+	if err != nil {
+		fmt.Println(err)
+		panic("unable to marshal DNS map")
+	}
+	err = os.WriteFile(dnsMapPath, jsonString, 0644)
+	if err != nil {
+		fmt.Println(err)
+		panic("unable to write to file")
+	}
+	return dnsMap, answerSets, nil
+}
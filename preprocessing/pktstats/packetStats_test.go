@@ -0,0 +1,171 @@
+package pktstats
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ipHeaderCapture is a UDP exchange with a game server over IPv4 and one over
+// IPv6, whose IP headers carry an identification, the DF flag and a flow label.
+func ipHeaderCapture(t testing.TB) []fixturePacket {
+	const client4, server4 = "192.168.1.10", "203.0.113.10"
+	const client6, server6 = "2001:db8:1::10", "2001:db8:2::10"
+	udp := func(network gopacket.NetworkLayer, srcPort, dstPort int) []byte {
+		udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+		udp.SetNetworkLayerForChecksum(network)
+		return frame(t, network, udp, gopacket.Payload(make([]byte, 100)))
+	}
+	ipv4 := func(src, dst string, id uint16, flags layers.IPv4Flag) gopacket.NetworkLayer {
+		ip := ipLayer(src, dst, layers.IPProtocolUDP).(*layers.IPv4)
+		ip.Id, ip.Flags = id, flags
+		return ip
+	}
+	ipv6 := func(src, dst string, flowLabel uint32) gopacket.NetworkLayer {
+		ip := ipLayer(src, dst, layers.IPProtocolUDP).(*layers.IPv6)
+		ip.FlowLabel = flowLabel
+		return ip
+	}
+	return []fixturePacket{
+		{at: 0, data: dnsResponse(t, "192.168.1.1", 53, client4, "v4.game.example.com", server4)},
+		{at: time.Millisecond, data: dnsResponse(t, "192.168.1.1", 53, client4, "v6.game.example.com", server6)},
+		{at: 10 * time.Millisecond, data: udp(ipv4(client4, server4, 0x1234, layers.IPv4DontFragment), 50000, 3478)},
+		{at: 11 * time.Millisecond, data: udp(ipv4(server4, client4, 0xbeef, 0), 3478, 50000)},
+		{at: 12 * time.Millisecond, data: udp(ipv6(client6, server6, 0xabcde), 50002, 3478)},
+		{at: 13 * time.Millisecond, data: udp(ipv6(server6, client6, 0), 3478, 50002)},
+	}
+}
+
+func TestIPHeaderFields(t *testing.T) {
+	capture := fixture(t, "ipheader.pcap", ipHeaderCapture)
+	type fields struct {
+		ipid      int
+		df        bool
+		flowLabel int
+	}
+	tests := []struct {
+		format         string
+		ipHeaderFields bool
+		want           []fields // of the packets, in the order of the capture
+	}{
+		{"json", false, []fields{{}, {}, {}, {}}},
+		{"json", true, []fields{{0x1234, true, 0}, {0xbeef, false, 0}, {0, false, 0xabcde}, {}}},
+		{"csv", false, []fields{{}, {}, {}, {}}},
+		{"csv", true, []fields{{0x1234, true, 0}, {0xbeef, false, 0}, {0, false, 0xabcde}, {}}},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.Format, opts.IPHeaderFields = test.format, test.ipHeaderFields
+		opts.LocalSubnets = "192.168.0.0/16,2001:db8:1::/48"
+		output, _ := extractFixture(t, capture, opts)
+		var got []fields
+		for _, key := range []string{"192.168.1.10:50000-203.0.113.10:3478@17", "2001:db8:1::10:50002-2001:db8:2::10:3478@17"} {
+			flow, ok := output.Flows[key]
+			if !ok {
+				t.Fatalf("%s: no flow %s in %v", test.format, key, sortedFlowKeys(output.Flows))
+			}
+			for _, packet := range flow.Packets {
+				got = append(got, fields{packet.IPID, packet.DF, packet.FlowLabel})
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Fatalf("%s (ip header fields %v): got %d packets, want %d", test.format, test.ipHeaderFields, len(got), len(test.want))
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s (ip header fields %v): packet %d has %+v, want %+v", test.format, test.ipHeaderFields, i, got[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestL4PayloadSize(t *testing.T) {
+	tests := []struct {
+		name            string
+		ihl             uint8
+		length          uint16 // IPv4 total length
+		transportHeader int
+		captured        int
+		want            int
+	}{
+		{"udp", 5, 20 + 8 + 100, 8, 100, 100},
+		{"tcp without options", 5, 20 + 20 + 100, 20, 100, 100},
+		{"tcp with options", 5, 20 + 32 + 100, 32, 100, 100},
+		{"ip options", 6, 24 + 8 + 100, 8, 100, 100},
+		{"ip and tcp options", 15, 60 + 60 + 100, 60, 100, 100},
+		{"empty", 5, 20 + 20, 20, 0, 0},
+		{"cut at the snap length", 5, 20 + 8 + 1400, 8, 50, 1400},
+		{"more captured than the total length", 5, 20 + 20, 20, 6, 6},
+		{"total length below the headers", 5, 20, 8, 100, 100},
+	}
+	for _, test := range tests {
+		ip := &layers.IPv4{IHL: test.ihl, Length: test.length}
+		if got := l4PayloadSize(ip, test.transportHeader, test.captured); got != test.want {
+			t.Errorf("%s: l4PayloadSize = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// payloadSizeCapture has packets cut at the snap length, with IP and TCP
+// options, and an IPv6 packet following an IPv4 one whose header lengths
+// must not apply to it.
+func payloadSizeCapture(t testing.TB) []fixturePacket {
+	const client, game, client6, game6 = "192.168.1.10", "203.0.113.10", "2001:db8:1::10", "2001:db8:2::10"
+	cut := func(data []byte, captured int) ([]byte, int) { return data[:captured], len(data) }
+	truncated, length := cut(udpPacket(t, game, 3478, client, 50000, make([]byte, 1200)), 14+20+8+100)
+
+	ipOptions := ipLayer(client, game, layers.IPProtocolUDP).(*layers.IPv4)
+	ipOptions.Options = []layers.IPv4Option{{OptionType: 7, OptionLength: 7, OptionData: []byte{4, 0, 0, 0, 0}}, {OptionType: 0, OptionLength: 1}}
+	udp := &layers.UDP{SrcPort: 50000, DstPort: 3478}
+	udp.SetNetworkLayerForChecksum(ipOptions)
+
+	tcpOptions := &layers.TCP{SrcPort: 50100, DstPort: 443, Seq: 1, Ack: 1, ACK: true, PSH: true, Window: 65535, Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: make([]byte, 8)},
+		{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+		{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+	}}
+	tcpIP := ipLayer(client, game, layers.IPProtocolTCP)
+	tcpOptions.SetNetworkLayerForChecksum(tcpIP)
+
+	return []fixturePacket{
+		{at: 0, data: dnsResponse(t, "192.168.1.1", 53, client, "eu1.game.example.com", game)},
+		{at: time.Millisecond, data: dnsResponse(t, "192.168.1.1", 53, client, "v6.game.example.com", game6)},
+		{at: 10 * time.Millisecond, data: frame(t, ipOptions, udp, gopacket.Payload(make([]byte, 80)))},
+		{at: 11 * time.Millisecond, data: truncated, length: length},
+		{at: 12 * time.Millisecond, data: udpPacket(t, client6, 50002, game6, 3478, make([]byte, 30))},
+		{at: 13 * time.Millisecond, data: frame(t, tcpIP, tcpOptions, gopacket.Payload(make([]byte, 300)))},
+	}
+}
+
+// TestPayloadSize extracts the transport payload sizes of packets from their
+// header lengths, each packet with its own headers.
+func TestPayloadSize(t *testing.T) {
+	capture := fixture(t, "payloadsize.pcap", payloadSizeCapture)
+	opts := testOptions()
+	opts.LocalSubnets = "192.168.0.0/16,2001:db8:1::/48"
+	output, _ := extractFixture(t, capture, opts)
+	tests := []struct {
+		flow string
+		want []int
+	}{
+		{"192.168.1.10:50000-203.0.113.10:3478@17", []int{80, 1200}},
+		{"2001:db8:1::10:50002-2001:db8:2::10:3478@17", []int{30}},
+		{"192.168.1.10:50100-203.0.113.10:443@6", []int{300}},
+	}
+	for _, test := range tests {
+		flow, ok := output.Flows[test.flow]
+		if !ok {
+			t.Fatalf("no flow %s in %v", test.flow, sortedFlowKeys(output.Flows))
+		}
+		var got []int
+		for _, packet := range flow.Packets {
+			got = append(got, packet.PayloadSize)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: payload sizes %v, want %v", test.flow, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package pktstats
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// payloadFilter selects the flows whose initial payload bytes are captured,
+// by local or remote port or by DNS name suffix. An empty filter selects all flows.
+type payloadFilter struct {
+	ports    map[int]bool
+	suffixes domainSuffixes
+}
+
+// parsePayloadFilter parses a comma-separated list of ports and DNS name
+// suffixes, e.g. "3478,49005,nvidiagrid.net".
+func parsePayloadFilter(list string) (payloadFilter, error) {
+	filter := payloadFilter{ports: make(map[int]bool)}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if port, err := strconv.Atoi(item); err == nil {
+			if port < 0 || port > 65535 {
+				return filter, fmt.Errorf("invalid port %d in payload capture filter", port)
+			}
+			filter.ports[port] = true
+		} else {
+			filter.suffixes.add(item)
+		}
+	}
+	return filter, nil
+}
+
+func (filter payloadFilter) matches(flow *Flow) bool {
+	if len(filter.ports) == 0 && len(filter.suffixes) == 0 {
+		return true
+	}
+	if filter.ports[flow.LocalPort] || filter.ports[flow.RemotePort] {
+		return true
+	}
+	return filter.suffixes.matches(flow.DNSName)
+}
+
+// capturePayload keeps the first bytes of the payload sent in each direction,
+// up to the limit set when the flow was created.
+func (flow *Flow) capturePayload(upstream bool, payload []byte) {
+	captured := &flow.InitialPayloadDown
+	if upstream {
+		captured = &flow.InitialPayloadUp
+	}
+	if n := flow.captureBytes - len(*captured); n > 0 {
+		// copy, the payload is only valid until the next packet is read
+		*captured = append(*captured, payload[:min(n, len(payload))]...)
+	}
+}
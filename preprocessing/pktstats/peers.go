@@ -0,0 +1,71 @@
+package pktstats
+
+import (
+	"sort"
+	"strconv"
+)
+
+// PeerGroup lists the flows between one local and one remote endpoint IP with
+// the same protocol and service, e.g. a media flow that hopped across server
+// ports mid-session.
+type PeerGroup struct {
+	ID          int      `json:"id"`
+	LocalIP     string   `json:"localIP"`
+	RemoteIP    string   `json:"remoteIP"`
+	Protocol    int      `json:"protocol"`
+	Service     string   `json:"service,omitempty"` // ServiceFlowType of the flows
+	Flows       []string `json:"flows"`             // flow keys, in order of first packet arrival
+	RemotePorts []int    `json:"remotePorts"`       // distinct remote ports, ascending
+}
+
+// peerGroupKey identifies the group of a flow. Flows of different CGNAT
+// subscribers share the external local IP and are kept apart.
+func (flow *Flow) peerGroupKey() string {
+	return flow.LocalIP + "/" + flow.Subscriber + "-" + flow.RemoteIP + "@" + strconv.Itoa(flow.Protocol) + "#" + flow.ServiceFlowType
+}
+
+// assignPeerGroups groups flows by local IP, remote IP, protocol and service,
+// sets each flow's PeerGroupID and PeerFlowCount, and returns the groups with
+// more than one flow. IDs count from 1 in order of each group's first packet
+// arrival, ties broken by flow key, so they only depend on the flows.
+func assignPeerGroups(flowMap map[string]*Flow) []PeerGroup {
+	// groups in order of their first flow's arrival
+	groups := make(map[string][]string)
+	var groupKeys []string
+	for _, key := range sortedFlowKeys(flowMap) {
+		groupKey := flowMap[key].peerGroupKey()
+		if _, ok := groups[groupKey]; !ok {
+			groupKeys = append(groupKeys, groupKey)
+		}
+		groups[groupKey] = append(groups[groupKey], key)
+	}
+
+	var peerGroups []PeerGroup
+	for i, groupKey := range groupKeys {
+		keys := groups[groupKey]
+		first := flowMap[keys[0]]
+		ports := make(map[int]bool)
+		for _, key := range keys {
+			flowMap[key].PeerGroupID = i + 1
+			flowMap[key].PeerFlowCount = len(keys)
+			ports[flowMap[key].RemotePort] = true
+		}
+		if len(keys) < 2 {
+			continue
+		}
+		group := PeerGroup{
+			ID:       i + 1,
+			LocalIP:  first.LocalIP,
+			RemoteIP: first.RemoteIP,
+			Protocol: first.Protocol,
+			Service:  first.ServiceFlowType,
+			Flows:    keys,
+		}
+		for port := range ports {
+			group.RemotePorts = append(group.RemotePorts, port)
+		}
+		sort.Ints(group.RemotePorts)
+		peerGroups = append(peerGroups, group)
+	}
+	return peerGroups
+}
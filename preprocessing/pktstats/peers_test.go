@@ -0,0 +1,100 @@
+package pktstats
+
+import (
+	"reflect"
+	"testing"
+)
+
+// peerFlows returns the flows of a client whose game flow hopped across
+// three server ports, around flows that belong to other groups: another
+// protocol, another service, another local client at the same time, and
+// another CGNAT subscriber behind the same local IP.
+func peerFlows() map[string]*Flow {
+	flow := func(localIP, subscriber string, localPort int, remoteIP string, remotePort, protocol int, service string, first int64) *Flow {
+		return &Flow{
+			LocalIP: localIP, Subscriber: subscriber, LocalPort: localPort,
+			RemoteIP: remoteIP, RemotePort: remotePort, Protocol: protocol,
+			ServiceFlowType: service, Packets: []Packet{{Timestamp: first}},
+		}
+	}
+	return map[string]*Flow{
+		"192.168.1.10:50000-203.0.113.10:3478@17":            flow("192.168.1.10", "", 50000, "203.0.113.10", 3478, 17, "example.com", 100),
+		"192.168.1.10:50000-203.0.113.10:3480@17":            flow("192.168.1.10", "", 50000, "203.0.113.10", 3480, 17, "example.com", 300),
+		"192.168.1.10:50002-203.0.113.10:3479@17":            flow("192.168.1.10", "", 50002, "203.0.113.10", 3479, 17, "example.com", 200),
+		"192.168.1.10:50100-203.0.113.10:443@6":              flow("192.168.1.10", "", 50100, "203.0.113.10", 443, 6, "example.com", 150),
+		"192.168.1.10:50200-203.0.113.10:4000@17":            flow("192.168.1.10", "", 50200, "203.0.113.10", 4000, 17, telemetryRole, 50),
+		"192.168.1.11:50000-203.0.113.10:3478@17":            flow("192.168.1.11", "", 50000, "203.0.113.10", 3478, 17, "example.com", 100),
+		"192.168.1.10:50001-203.0.113.10:3478@17/100.64.0.2": flow("192.168.1.10", "100.64.0.2", 50001, "203.0.113.10", 3478, 17, "example.com", 400),
+	}
+}
+
+func TestAssignPeerGroups(t *testing.T) {
+	flows := peerFlows()
+	groups := assignPeerGroups(flows)
+
+	// IDs in order of first packet, the tie at 100 broken by flow key
+	want := map[string][2]int{ // PeerGroupID, PeerFlowCount
+		"192.168.1.10:50200-203.0.113.10:4000@17":            {1, 1},
+		"192.168.1.10:50000-203.0.113.10:3478@17":            {2, 3},
+		"192.168.1.11:50000-203.0.113.10:3478@17":            {3, 1},
+		"192.168.1.10:50100-203.0.113.10:443@6":              {4, 1},
+		"192.168.1.10:50002-203.0.113.10:3479@17":            {2, 3},
+		"192.168.1.10:50000-203.0.113.10:3480@17":            {2, 3},
+		"192.168.1.10:50001-203.0.113.10:3478@17/100.64.0.2": {5, 1},
+	}
+	for key, ids := range want {
+		if flow := flows[key]; flow.PeerGroupID != ids[0] || flow.PeerFlowCount != ids[1] {
+			t.Errorf("flow %s in group %d of %d flows, want group %d of %d", key, flow.PeerGroupID, flow.PeerFlowCount, ids[0], ids[1])
+		}
+	}
+
+	wantGroups := []PeerGroup{{
+		ID:       2,
+		LocalIP:  "192.168.1.10",
+		RemoteIP: "203.0.113.10",
+		Protocol: 17,
+		Service:  "example.com",
+		Flows: []string{
+			"192.168.1.10:50000-203.0.113.10:3478@17",
+			"192.168.1.10:50002-203.0.113.10:3479@17",
+			"192.168.1.10:50000-203.0.113.10:3480@17",
+		},
+		RemotePorts: []int{3478, 3479, 3480},
+	}}
+	if !reflect.DeepEqual(groups, wantGroups) {
+		t.Errorf("peer groups %+v, want %+v", groups, wantGroups)
+	}
+}
+
+// TestAssignPeerGroupsDeterministic assigns the groups of the same flows
+// repeatedly: map iteration order must not change them.
+func TestAssignPeerGroupsDeterministic(t *testing.T) {
+	first := peerFlows()
+	wantGroups := assignPeerGroups(first)
+	for i := 0; i < 50; i++ {
+		flows := peerFlows()
+		if groups := assignPeerGroups(flows); !reflect.DeepEqual(groups, wantGroups) {
+			t.Fatalf("run %d: peer groups %+v, want %+v", i, groups, wantGroups)
+		}
+		for key, flow := range flows {
+			if flow.PeerGroupID != first[key].PeerGroupID || flow.PeerFlowCount != first[key].PeerFlowCount {
+				t.Fatalf("run %d: flow %s in group %d of %d flows, want group %d of %d", i, key, flow.PeerGroupID, flow.PeerFlowCount, first[key].PeerGroupID, first[key].PeerFlowCount)
+			}
+		}
+	}
+}
+
+func TestAssignPeerGroupsSingletons(t *testing.T) {
+	flows := map[string]*Flow{
+		"192.168.1.10:50000-203.0.113.10:3478@17": {LocalIP: "192.168.1.10", RemoteIP: "203.0.113.10", RemotePort: 3478, Protocol: 17, Packets: []Packet{{Timestamp: 1}}},
+	}
+	if groups := assignPeerGroups(flows); groups != nil {
+		t.Errorf("peer groups %+v, want none for a single flow", groups)
+	}
+	if flow := flows["192.168.1.10:50000-203.0.113.10:3478@17"]; flow.PeerGroupID != 1 || flow.PeerFlowCount != 1 {
+		t.Errorf("single flow in group %d of %d flows, want group 1 of 1", flow.PeerGroupID, flow.PeerFlowCount)
+	}
+	if groups := assignPeerGroups(map[string]*Flow{}); groups != nil {
+		t.Errorf("peer groups %+v of no flows", groups)
+	}
+}
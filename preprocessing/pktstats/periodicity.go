@@ -0,0 +1,165 @@
+package pktstats
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// periodicityBins is the number of 1ms inter-arrival bins, longer gaps are only counted
+	periodicityBins = 64
+	// periodicityMinGaps is the number of inter-arrival times needed to estimate a frequency
+	periodicityMinGaps = 20
+	// inputMinRegularity is the regularity a flow needs to be tagged as input
+	inputMinRegularity = 0.5
+	// inputRole is the ServiceFlowType of flows carrying player inputs
+	inputRole = "input"
+)
+
+// periodicityState histograms the inter-arrival times of upstream packets
+// within a payload size range, and tracks the spread of their sizes. It takes
+// constant time and memory per packet so it can run on every UDP flow.
+type periodicityState struct {
+	minSize  int   // smallest payload counted, at least 1
+	maxSize  int   // largest payload counted, 0 when disabled
+	tsPerMs  int64 // timestamp units per millisecond
+	last     int64
+	gaps     int
+	counts   [periodicityBins]int
+	sums     [periodicityBins]int64 // sum of the inter-arrival times in each bin
+	hasFirst bool
+	// sizes of the packets counted
+	packets     int
+	sizeSum     float64
+	sizeSquares float64
+}
+
+func (state *periodicityState) observe(packet *Packet) {
+	if !packet.Upstream || packet.PayloadSize < max(state.minSize, 1) || packet.PayloadSize > state.maxSize {
+		return
+	}
+	size := float64(packet.PayloadSize)
+	state.packets++
+	state.sizeSum += size
+	state.sizeSquares += size * size
+	if state.hasFirst {
+		gap := packet.Timestamp - state.last
+		state.gaps++
+		if bin := gap / state.tsPerMs; bin < periodicityBins {
+			state.counts[bin]++
+			state.sums[bin] += gap
+		}
+	}
+	state.hasFirst = true
+	state.last = packet.Timestamp
+}
+
+// estimate returns the dominant frequency of the small upstream packets, from
+// the mean inter-arrival time around the most populated bin, and the share of
+// inter-arrival times close to it as regularity.
+func (state *periodicityState) estimate() (frequency, regularity float64, ok bool) {
+	if state.gaps < periodicityMinGaps {
+		return 0, 0, false
+	}
+	mode := 0
+	for bin := range state.counts {
+		if state.counts[bin] > state.counts[mode] {
+			mode = bin
+		}
+	}
+	var count int
+	var sum int64
+	for bin := max(mode-1, 0); bin <= min(mode+1, periodicityBins-1); bin++ {
+		count += state.counts[bin]
+		sum += state.sums[bin]
+	}
+	if count == 0 || sum == 0 {
+		return 0, 0, false
+	}
+	meanMs := float64(sum) / float64(count) / float64(state.tsPerMs)
+	return 1000 / meanMs, float64(count) / float64(state.gaps), true
+}
+
+// sizeVariation returns the coefficient of variation of the payload sizes
+// counted, 0 for near-constant sizes.
+func (state *periodicityState) sizeVariation() float64 {
+	if state.packets == 0 {
+		return 0
+	}
+	mean := state.sizeSum / float64(state.packets)
+	variance := max(state.sizeSquares/float64(state.packets)-mean*mean, 0)
+	return math.Sqrt(variance) / mean
+}
+
+// classifyInput stores the upstream periodicity of the flow and, when band is
+// set, tags flows whose frequency falls in it as input flows.
+func (flow *Flow) classifyInput(band *frequencyBand) {
+	frequency, regularity, ok := flow.periodicity.estimate()
+	if !ok {
+		return
+	}
+	flow.InputFrequencyHz = frequency
+	flow.InputRegularity = regularity
+	if band != nil && band.contains(frequency) && regularity >= inputMinRegularity {
+		flow.ServiceFlowType = inputRole
+		flow.LabelSource = labelInputBand
+		flow.LabelConfidence = regularity
+	}
+}
+
+// frequencyBand is a range of frequencies in Hz, e.g. "60-125".
+type frequencyBand struct {
+	low, high float64
+}
+
+// parseFrequencyBand parses a band such as "60-125", returning nil for an empty string.
+func parseFrequencyBand(band string) (*frequencyBand, error) {
+	if band == "" {
+		return nil, nil
+	}
+	low, high, found := strings.Cut(band, "-")
+	if !found {
+		return nil, fmt.Errorf("invalid frequency band %q, expected low-high", band)
+	}
+	var parsed frequencyBand
+	var err error
+	if parsed.low, err = strconv.ParseFloat(strings.TrimSpace(low), 64); err != nil {
+		return nil, fmt.Errorf("invalid frequency band %q: %w", band, err)
+	}
+	if parsed.high, err = strconv.ParseFloat(strings.TrimSpace(high), 64); err != nil {
+		return nil, fmt.Errorf("invalid frequency band %q: %w", band, err)
+	}
+	if parsed.low > parsed.high {
+		return nil, fmt.Errorf("invalid frequency band %q, low above high", band)
+	}
+	return &parsed, nil
+}
+
+func (band *frequencyBand) contains(frequency float64) bool {
+	return band.low <= frequency && frequency <= band.high
+}
+
+// parseFrequencyBands parses a comma-separated list of bands such as
+// "15-18,23-27", returning nil for an empty string.
+func parseFrequencyBands(bands string) ([]frequencyBand, error) {
+	var parsed []frequencyBand
+	for _, band := range strings.Split(bands, ",") {
+		if strings.TrimSpace(band) == "" {
+			continue
+		}
+		b, err := parseFrequencyBand(band)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, *b)
+	}
+	return parsed, nil
+}
+
+// timestampsPerMs returns the number of timestamp units in a millisecond.
+func (opts Options) timestampsPerMs() int64 {
+	return opts.duration(time.Millisecond)
+}
@@ -0,0 +1,80 @@
+package pktstats
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePorts parses a comma-separated list of ports, e.g. "53,5353".
+func parsePorts(list string) (map[int]bool, error) {
+	ports := make(map[int]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		port, err := strconv.Atoi(item)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ports[port] = true
+	}
+	return ports, nil
+}
+
+// dnsBPFFilter selects DNS responses from the given ports and ICMPv6, which
+// carries the router advertisements announcing NAT64 prefixes.
+func dnsBPFFilter(dnsPorts map[int]bool) string {
+	var sources []string
+	for port := range dnsPorts {
+		sources = append(sources, "src port "+strconv.Itoa(port))
+	}
+	if len(sources) == 0 {
+		return "icmp6"
+	}
+	return "(udp and (" + strings.Join(sources, " or ") + ")) or icmp6"
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	low, high int
+}
+
+// portRanges is a list of ports and port ranges, see parsePortRanges.
+type portRanges []portRange
+
+// parsePortRanges parses a comma-separated list of ports and inclusive port
+// ranges, e.g. "3478,49000-49100".
+func parsePortRanges(list string) (portRanges, error) {
+	var ranges portRanges
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		low, high, isRange := strings.Cut(item, "-")
+		if !isRange {
+			high = low
+		}
+		first, err := strconv.Atoi(strings.TrimSpace(low))
+		if err != nil || first < 0 || first > 65535 {
+			return nil, fmt.Errorf("invalid port range %q", item)
+		}
+		last, err := strconv.Atoi(strings.TrimSpace(high))
+		if err != nil || last < first || last > 65535 {
+			return nil, fmt.Errorf("invalid port range %q", item)
+		}
+		ranges = append(ranges, portRange{first, last})
+	}
+	return ranges, nil
+}
+
+func (ranges portRanges) contains(port int) bool {
+	for _, r := range ranges {
+		if port >= r.low && port <= r.high {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package pktstats
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// postgresSchema creates the tables of a PostgreSQL database. Rows are
+// unique per file hash, and per flow key and packet index below it.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS pktstats_files (
+	file_hash text PRIMARY KEY,
+	source text NOT NULL,
+	output text NOT NULL,
+	options_hash text NOT NULL,
+	schema_version integer NOT NULL,
+	total_packets bigint NOT NULL,
+	total_bytes bigint NOT NULL,
+	accounted_packets bigint NOT NULL,
+	accounted_bytes bigint NOT NULL,
+	flows integer NOT NULL,
+	exported_at timestamptz NOT NULL
+)`,
+	`CREATE TABLE IF NOT EXISTS pktstats_services (
+	file_hash text NOT NULL,
+	service text NOT NULL,
+	flows integer NOT NULL,
+	packets bigint NOT NULL,
+	bytes bigint NOT NULL,
+	streaming_bytes bigint NOT NULL,
+	bulk_bytes bigint NOT NULL,
+	voice_bytes bigint NOT NULL,
+	idle_connections integer NOT NULL,
+	idle_connection_bytes bigint NOT NULL,
+	exported_at timestamptz NOT NULL,
+	PRIMARY KEY (file_hash, service)
+)`,
+	`CREATE TABLE IF NOT EXISTS pktstats_flows (
+	file_hash text NOT NULL,
+	flow_key text NOT NULL,
+	local_ip text NOT NULL,
+	remote_ip text NOT NULL,
+	local_port integer NOT NULL,
+	remote_port integer NOT NULL,
+	protocol smallint NOT NULL,
+	service_flow_type text NOT NULL,
+	dns_name text NOT NULL,
+	registered_domain text NOT NULL,
+	label_source text NOT NULL,
+	transport_profile text NOT NULL,
+	traffic_class text NOT NULL,
+	outcome text NOT NULL,
+	local_client text NOT NULL,
+	session_id integer NOT NULL,
+	packets bigint NOT NULL,
+	up_bytes bigint NOT NULL,
+	down_bytes bigint NOT NULL,
+	first_timestamp bigint NOT NULL,
+	last_timestamp bigint NOT NULL,
+	exported_at timestamptz NOT NULL,
+	PRIMARY KEY (file_hash, flow_key)
+)`,
+	`CREATE TABLE IF NOT EXISTS pktstats_packets (
+	file_hash text NOT NULL,
+	flow_key text NOT NULL,
+	seq integer NOT NULL,
+	timestamp bigint NOT NULL,
+	upstream boolean NOT NULL,
+	pkt_length integer NOT NULL,
+	payload_size integer NOT NULL,
+	exported_at timestamptz NOT NULL,
+	PRIMARY KEY (file_hash, flow_key, seq)
+)`,
+}
+
+// postgresExporter exports to PostgreSQL over a single connection, one
+// file at a time.
+type postgresExporter struct {
+	mu   sync.Mutex
+	conn *pgx.Conn
+}
+
+func openPostgres(ctx context.Context, dsn string) (dbExporter, error) {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresExporter{conn: conn}, nil
+}
+
+func (db *postgresExporter) createSchema(ctx context.Context) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, statement := range postgresSchema {
+		if _, err := db.conn.Exec(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// export replaces the rows of the file in one transaction: those of an
+// earlier run are deleted, the new ones copied in.
+func (db *postgresExporter) export(ctx context.Context, rows *dbRows) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	tx, err := db.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, table := range []string{"pktstats_packets", "pktstats_flows", "pktstats_services", "pktstats_files"} {
+		if _, err := tx.Exec(ctx, "DELETE FROM "+table+" WHERE file_hash = $1", rows.file.FileHash); err != nil {
+			return err
+		}
+	}
+	if err := copyRows(ctx, tx, "pktstats_files", []dbFileRow{rows.file}); err != nil {
+		return err
+	}
+	if err := copyRows(ctx, tx, "pktstats_services", rows.services); err != nil {
+		return err
+	}
+	if err := copyRows(ctx, tx, "pktstats_flows", rows.flows); err != nil {
+		return err
+	}
+	if err := copyRows(ctx, tx, "pktstats_packets", rows.packets); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (db *postgresExporter) close() {
+	db.conn.Close(context.Background())
+}
+
+// copyRows inserts rows into table with COPY, streamed in a single command.
+func copyRows[R any](ctx context.Context, tx pgx.Tx, table string, rows []R) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	i := 0
+	source := pgx.CopyFromFunc(func() ([]any, error) {
+		if i == len(rows) {
+			return nil, nil
+		}
+		i++
+		return dbValues(rows[i-1]), nil
+	})
+	_, err := tx.CopyFrom(ctx, pgx.Identifier{table}, dbColumns(rows[0]), source)
+	return err
+}
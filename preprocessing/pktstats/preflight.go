@@ -0,0 +1,144 @@
+package pktstats
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// number of packets at the start of a capture inspected by the preflight check
+const preflightPackets = 5000
+
+// preflight collects capture quality indicators, mostly from the first
+// preflightPackets packets, to catch misconfigured captures (e.g. tcpdump with
+// snaplen 68 or the wrong link type).
+type preflight struct {
+	packets, truncated, decoded int
+	first, last                 time.Time
+	// checksum results of upstream packets, with Options.VerifyChecksums
+	upstreamChecked, upstreamBad int
+}
+
+// observeChecksum records the checksum result of a packet sent in direction.
+func (check *preflight) observeChecksum(direction Direction, result checksumResult) {
+	if direction != DirectionUpstream || result == checksumUnverified {
+		return
+	}
+	check.upstreamChecked++
+	if result != checksumGood {
+		check.upstreamBad++
+	}
+}
+
+// observe records a packet; decoded tells whether any layer past the link layer was decoded.
+func (check *preflight) observe(ci gopacket.CaptureInfo, decoded bool) {
+	if check.first.IsZero() {
+		check.first = ci.Timestamp
+	}
+	check.last = ci.Timestamp
+	if check.packets >= preflightPackets {
+		return
+	}
+	check.packets++
+	if ci.CaptureLength < ci.Length {
+		check.truncated++
+	}
+	if decoded {
+		check.decoded++
+	}
+}
+
+// warnings returns the quality warnings for the capture, given the number of DNS
+// responses found in it.
+func (check *preflight) warnings(dnsResponses int, opts Options) []string {
+	var warnings []string
+	if check.packets > 0 && check.truncated*2 > check.packets {
+		warnings = append(warnings, fmt.Sprintf("%d of the first %d packets are truncated, was the capture taken with a small snap length?", check.truncated, check.packets))
+	}
+	if check.packets > 0 && check.decoded == 0 {
+		warnings = append(warnings, fmt.Sprintf("none of the first %d packets decode past the link layer, was the capture taken with the wrong link type?", check.packets))
+	}
+	if check.upstreamChecked >= checksumOffloadMinPackets && check.upstreamBad*2 > check.upstreamChecked {
+		warnings = append(warnings, fmt.Sprintf("%d of %d upstream packets have bad or zero checksums, capture taken on endpoint with checksum offload?", check.upstreamBad, check.upstreamChecked))
+	}
+	duration := check.last.Sub(check.first)
+	if dnsResponses == 0 && duration > time.Duration(opts.DNSWarnMinutes)*time.Minute {
+		warnings = append(warnings, fmt.Sprintf("no DNS responses found in %s of capture, flows cannot be labeled", duration.Round(time.Second)))
+	}
+	return warnings
+}
+
+func printWarnings(filePath string, warnings []string) {
+	for _, warning := range warnings {
+		fmt.Printf("!!!!!!!!!! WARNING: %s: %s !!!!!!!!!!\n", filePath, warning)
+	}
+}
+
+// runPreflight runs only the quality checks on the first packets of a capture.
+// The DNS check then covers the time span of the inspected packets.
+func runPreflight(filePath string, opts Options) ([]string, error) {
+	var (
+		ethLayer layers.Ethernet
+		ip4Layer layers.IPv4
+		ip6Layer layers.IPv6
+		arpLayer layers.ARP
+		tcpLayer layers.TCP
+		udpLayer layers.UDP
+		dnsLayer layers.DNS
+	)
+	parser := gopacket.NewDecodingLayerParser(
+		layers.LayerTypeEthernet,
+		&ethLayer,
+		&ip4Layer,
+		&ip6Layer,
+		&arpLayer,
+		&tcpLayer,
+		&udpLayer,
+		&dnsLayer,
+	)
+	localNets, _ := parseLocalSubnets(opts.LocalSubnets)
+
+	handle, closeCapture, err := openCapture(filePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeCapture()
+
+	var check preflight
+	dnsResponses := 0
+	var foundLayerTypes []gopacket.LayerType
+	for check.packets < preflightPackets {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			break
+		}
+		_ = parser.DecodeLayers(data, &foundLayerTypes)
+		ipv4 := false
+		for _, layerType := range foundLayerTypes {
+			switch layerType {
+			case layers.LayerTypeIPv4:
+				ipv4 = true
+			case layers.LayerTypeDNS:
+				if dnsLayer.QR {
+					dnsResponses++
+				}
+			case layers.LayerTypeTCP, layers.LayerTypeUDP:
+				if !opts.VerifyChecksums || !ipv4 || ci.CaptureLength < ci.Length {
+					continue
+				}
+				if !localNets.contains(ip4Layer.SrcIP) || localNets.contains(ip4Layer.DstIP) {
+					continue
+				}
+				if layerType == layers.LayerTypeTCP {
+					check.observeChecksum(DirectionUpstream, verifyChecksums(&ip4Layer, tcpLayer.Contents, tcpLayer.Payload))
+				} else {
+					check.observeChecksum(DirectionUpstream, verifyChecksums(&ip4Layer, udpLayer.Contents, udpLayer.Payload))
+				}
+			}
+		}
+		check.observe(ci, len(foundLayerTypes) > 1)
+	}
+	return check.warnings(dnsResponses, opts), nil
+}
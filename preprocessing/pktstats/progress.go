@@ -0,0 +1,113 @@
+package pktstats
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progressSource tells how much of a capture has been read. fraction is the
+// share of the file read so far, ok is false when the size is unknown, e.g.
+// for streams read from stdin.
+type progressSource interface {
+	observe(captureLength int) // called for every packet read
+	fraction() (fraction float64, ok bool)
+}
+
+// offsetProgress reports exact progress from the bytes of the capture file
+// read by the pure-Go readers; for compressed captures these are compressed
+// bytes, read ahead of the packets by the buffers in between.
+type offsetProgress struct {
+	size int64
+	read atomic.Int64 // updated by the goroutine reading packets
+}
+
+func (progress *offsetProgress) observe(int) {}
+
+func (progress *offsetProgress) fraction() (float64, bool) {
+	return float64(progress.read.Load()) / float64(max(progress.size, 1)), true
+}
+
+// countingReader counts the bytes read into an offsetProgress.
+type countingReader struct {
+	io.Reader
+	progress *offsetProgress
+}
+
+func (reader countingReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	reader.progress.read.Add(int64(n))
+	return n, err
+}
+
+// estimatedProgress estimates the offset of a libpcap handle, which does not
+// expose it, from the records read: their captured bytes plus the record
+// header of the file format and, for pcapng, the padding of the packet data.
+// Blocks other than packets (e.g. name resolution) are not counted, so the
+// estimate may lag behind and is refined at the end of the file.
+type estimatedProgress struct {
+	size   int64
+	pcapng bool
+	offset int64
+}
+
+func (progress *estimatedProgress) observe(captureLength int) {
+	if progress.pcapng {
+		// enhanced packet block: 28 header and 4 trailer bytes, data padded to 32 bits
+		progress.offset += int64(32 + (captureLength+3)&^3)
+	} else {
+		progress.offset += int64(16 + captureLength)
+	}
+}
+
+func (progress *estimatedProgress) fraction() (float64, bool) {
+	return float64(progress.offset) / float64(max(progress.size, 1)), true
+}
+
+// streamProgress counts the packets of a stream of unknown size.
+type streamProgress struct{}
+
+func (streamProgress) observe(int) {}
+
+func (streamProgress) fraction() (float64, bool) {
+	return 0, false
+}
+
+// progressReporter prints the reading progress of a capture every
+// Options.ProgressInterval. The printed percentage never decreases, even
+// when an estimate is refined, and only reaches 100% once the file is read.
+type progressReporter struct {
+	source   progressSource
+	interval time.Duration
+	next     time.Time
+	shown    int
+}
+
+// observe accounts for a packet read, reporting progress when due.
+func (reporter *progressReporter) observe(filePath string, captureLength int, packets int64) {
+	if reporter.interval <= 0 {
+		return
+	}
+	reporter.source.observe(captureLength)
+	// checking the clock for every packet is wasteful at millions of packets
+	if packets%1024 != 0 {
+		return
+	}
+	now := time.Now()
+	if reporter.next.IsZero() {
+		reporter.next = now.Add(reporter.interval)
+		return
+	}
+	if now.Before(reporter.next) {
+		return
+	}
+	reporter.next = now.Add(reporter.interval)
+	fraction, ok := reporter.source.fraction()
+	if !ok {
+		fmt.Printf("%s: %d packets read\n", filePath, packets)
+		return
+	}
+	reporter.shown = max(reporter.shown, min(int(fraction*100), 99))
+	fmt.Printf("%s: %d%% read (%d packets)\n", filePath, reporter.shown, packets)
+}
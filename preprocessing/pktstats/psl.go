@@ -0,0 +1,83 @@
+package pktstats
+
+import (
+	_ "embed"
+	"net"
+	"strings"
+	"sync"
+)
+
+// publicSuffixList is the embedded copy of https://publicsuffix.org/list/public_suffix_list.dat.
+// Refreshing it only requires replacing the data file.
+//
+//go:embed public_suffix_list.dat
+var publicSuffixList string
+
+// suffixRules holds the parsed public suffix list, keyed by the rule without its
+// "*." or "!" prefix.
+type suffixRules struct {
+	normal    map[string]bool
+	wildcard  map[string]bool
+	exception map[string]bool
+}
+
+var (
+	pslOnce  sync.Once
+	pslRules suffixRules
+)
+
+func parseSuffixRules(list string) suffixRules {
+	rules := suffixRules{
+		normal:    make(map[string]bool),
+		wildcard:  make(map[string]bool),
+		exception: make(map[string]bool),
+	}
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule := strings.ToLower(fields[0])
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			rules.exception[rule[1:]] = true
+		case strings.HasPrefix(rule, "*."):
+			rules.wildcard[rule[2:]] = true
+		default:
+			rules.normal[rule] = true
+		}
+	}
+	return rules
+}
+
+// registeredDomain returns the registered domain (eTLD+1) of a DNS name using the
+// embedded public suffix list, e.g. gs1234.example-cdn.net -> example-cdn.net.
+// IP literals, names that are themselves public suffixes and names not covered by
+// any rule are returned unchanged. Internationalized rules are only matched in
+// their Unicode form.
+func registeredDomain(name string) string {
+	if name == "" || net.ParseIP(name) != nil {
+		return name
+	}
+	pslOnce.Do(func() { pslRules = parseSuffixRules(publicSuffixList) })
+
+	labels := strings.Split(canonicalDNSName(name), ".")
+	suffixLen := 0
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if pslRules.exception[candidate] {
+			suffixLen = len(labels) - i - 1
+		} else if pslRules.normal[candidate] {
+			suffixLen = len(labels) - i
+		} else if i+1 < len(labels) && pslRules.wildcard[strings.Join(labels[i+1:], ".")] {
+			suffixLen = len(labels) - i
+		} else {
+			continue
+		}
+		break
+	}
+	if suffixLen == 0 || suffixLen >= len(labels) {
+		return name
+	}
+	return strings.Join(labels[len(labels)-suffixLen-1:], ".")
+}
@@ -0,0 +1,404 @@
+package pktstats
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// quicV1InitialSalt derives the Initial keys of QUIC version 1 from the
+// destination connection ID of the client's first Initial, RFC 9001.
+var quicV1InitialSalt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+
+// quicMaxCrypto bounds the CRYPTO data reassembled from Initial packets for
+// the hellos.
+const quicMaxCrypto = 16 << 10
+
+// QUIC long header packet types of version 1
+const (
+	quicInitial = 0
+	quicRetry   = 3
+)
+
+// quicKeys protect the packets of one direction and packet number space.
+type quicKeys struct {
+	aead    cipher.AEAD
+	iv      []byte
+	hp      []byte
+	chacha  bool
+	largest int64 // largest packet number decrypted, -1 for none
+}
+
+// newQUICKeys derives the packet protection keys of a traffic secret.
+func newQUICKeys(suite tlsSuite, secret []byte) *quicKeys {
+	aead, err := suite.newAEAD(hkdfExpandLabel(suite.hash, secret, "quic key", suite.keyLen))
+	if err != nil {
+		return nil
+	}
+	return &quicKeys{
+		aead:    aead,
+		iv:      hkdfExpandLabel(suite.hash, secret, "quic iv", 12),
+		hp:      hkdfExpandLabel(suite.hash, secret, "quic hp", suite.keyLen),
+		chacha:  suite.chacha,
+		largest: -1,
+	}
+}
+
+// mask returns the header protection mask of a ciphertext sample.
+func (keys *quicKeys) mask(sample []byte) []byte {
+	mask := make([]byte, 16)
+	if keys.chacha {
+		stream, err := chacha20.NewUnauthenticatedCipher(keys.hp, sample[4:16])
+		if err != nil {
+			return nil
+		}
+		stream.SetCounter(binary.LittleEndian.Uint32(sample[:4]))
+		stream.XORKeyStream(mask[:5], mask[:5])
+		return mask
+	}
+	block, err := aes.NewCipher(keys.hp)
+	if err != nil {
+		return nil
+	}
+	block.Encrypt(mask, sample)
+	return mask
+}
+
+// open removes the header protection of a packet whose packet number
+// starts at pnOffset and decrypts its payload, returning the frames and
+// the unprotected first byte.
+func (keys *quicKeys) open(packet []byte, pnOffset int) ([]byte, byte, bool) {
+	if keys == nil || len(packet) < pnOffset+4+16 {
+		return nil, 0, false
+	}
+	mask := keys.mask(packet[pnOffset+4 : pnOffset+20])
+	if mask == nil {
+		return nil, 0, false
+	}
+	header := append([]byte(nil), packet[:pnOffset+4]...)
+	if header[0]&0x80 != 0 {
+		header[0] ^= mask[0] & 0x0f
+	} else {
+		header[0] ^= mask[0] & 0x1f
+	}
+	pnLen := int(header[0]&0x03) + 1
+	var truncated int64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | int64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+	pn := decodePacketNumber(keys.largest, truncated, pnLen*8)
+	nonce := append([]byte(nil), keys.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	frames, err := keys.aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, 0, false
+	}
+	keys.largest = max(keys.largest, pn)
+	return frames, header[0], true
+}
+
+// decodePacketNumber reconstructs a packet number from its truncated
+// encoding of bits bits, RFC 9000 appendix A.3.
+func decodePacketNumber(largest, truncated int64, bits int) int64 {
+	expected := largest + 1
+	window := int64(1) << bits
+	candidate := expected&^(window-1) | truncated
+	switch {
+	case candidate <= expected-window/2 && candidate < 1<<62-window:
+		return candidate + window
+	case candidate > expected+window/2 && candidate >= window:
+		return candidate - window
+	}
+	return candidate
+}
+
+// quicCrypto reassembles the CRYPTO data of one direction of the Initial
+// packet number space, from offset 0.
+type quicCrypto struct {
+	data      []byte
+	fragments map[uint64][]byte
+}
+
+func (stream *quicCrypto) add(offset uint64, data []byte) {
+	if offset+uint64(len(data)) > quicMaxCrypto {
+		return
+	}
+	if offset > uint64(len(stream.data)) {
+		if stream.fragments == nil {
+			stream.fragments = make(map[uint64][]byte)
+		}
+		stream.fragments[offset] = append([]byte(nil), data...)
+		return
+	}
+	for {
+		if end := offset + uint64(len(data)); end > uint64(len(stream.data)) {
+			stream.data = append(stream.data, data[uint64(len(stream.data))-offset:]...)
+		}
+		found := false
+		for fragmentOffset, fragment := range stream.fragments {
+			if fragmentOffset <= uint64(len(stream.data)) {
+				delete(stream.fragments, fragmentOffset)
+				offset, data, found = fragmentOffset, fragment, true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+// message returns the first handshake message of the data, nil until it
+// is complete.
+func (stream *quicCrypto) message() []byte {
+	if len(stream.data) < 4 {
+		return nil
+	}
+	length := int(stream.data[1])<<16 | int(stream.data[2])<<8 | int(stream.data[3])
+	if len(stream.data) < 4+length {
+		return nil
+	}
+	return stream.data[:4+length]
+}
+
+// quicSession decrypts the 1-RTT packets of a QUIC version 1 connection
+// whose client random is in the key log. The hellos are read from the
+// Initial packets, whose keys derive from the connection ID. Directions are
+// indexed by Packet.Upstream.
+type quicSession struct {
+	client  int    // direction of the client, that of the first Initial
+	dcid    []byte // destination connection ID of the client's first Initial, nil after a Retry
+	scids   [2][]byte
+	initial [2]*quicKeys
+	crypto  [2]quicCrypto
+	secrets *keyLogSecrets
+	oneRTT  [2]*quicKeys
+}
+
+func newQUICSession() *quicSession {
+	return &quicSession{client: -1}
+}
+
+// observe decrypts the packets of a UDP datagram, which may coalesce several.
+// It reports whether decryption can go on: the connection is QUIC version 1,
+// its keys are in the log and the keys were not updated.
+func (session *quicSession) observe(state *decryptState, packet *Packet, datagram []byte) bool {
+	dir := direction(packet)
+	if session.client < 0 {
+		session.client = dir
+	}
+	for len(datagram) > 0 && !state.done {
+		if datagram[0]&0x80 == 0 {
+			// a short header packet takes the rest of the datagram; its
+			// connection ID is the source connection ID of the receiver
+			keys := session.oneRTT[dir]
+			if keys == nil {
+				return true
+			}
+			frames, first, ok := keys.open(datagram, 1+len(session.scids[1-dir]))
+			if !ok {
+				// e.g. a packet of another connection ID length, or not
+				// decryptable as its predecessors were lost
+				return true
+			}
+			if first&0x04 != 0 {
+				// key updates need the next secrets, which are not logged
+				return false
+			}
+			return session.frames(state, packet, dir, frames, false)
+		}
+		r := byteReader{data: datagram}
+		first := r.uint8()
+		version := r.bytes(4)
+		if r.failed || binary.BigEndian.Uint32(version) == 0 {
+			return true // version negotiation
+		}
+		if binary.BigEndian.Uint32(version) != 1 {
+			return false
+		}
+		dcid := r.bytes(int(r.uint8()))
+		scid := r.bytes(int(r.uint8()))
+		packetType := first >> 4 & 0x03
+		if r.failed {
+			return false
+		}
+		if packetType == quicRetry {
+			// the client starts over with the connection ID of the server
+			session.dcid, session.initial, session.crypto = nil, [2]*quicKeys{}, [2]quicCrypto{}
+			return true
+		}
+		session.scids[dir] = append(session.scids[dir][:0], scid...)
+		if packetType == quicInitial {
+			r.skip(int(r.varint())) // token
+		}
+		length := int(r.varint())
+		pnOffset := len(datagram) - r.remaining()
+		if r.failed || length > r.remaining() {
+			return false
+		}
+		end := pnOffset + length
+		if packetType == quicInitial {
+			if session.dcid == nil && dir == session.client {
+				session.dcid = append([]byte(nil), dcid...)
+				session.initialKeys()
+			}
+			if frames, _, ok := session.initial[dir].open(datagram[:end], pnOffset); ok && !session.frames(state, packet, dir, frames, true) {
+				return false
+			}
+		}
+		datagram = datagram[end:]
+	}
+	return true
+}
+
+// initialKeys derives the Initial keys of both directions from the
+// connection ID.
+func (session *quicSession) initialKeys() {
+	suite := tlsSuites[0x1301]
+	secret := hkdf.Extract(sha256.New, session.dcid, quicV1InitialSalt)
+	session.initial[session.client] = newQUICKeys(suite, hkdfExpandLabel(sha256.New, secret, "client in", 32))
+	session.initial[1-session.client] = newQUICKeys(suite, hkdfExpandLabel(sha256.New, secret, "server in", 32))
+}
+
+// frames reads the frames of a decrypted packet: the CRYPTO frames of
+// Initial packets for the hellos, the STREAM and DATAGRAM frames of 1-RTT
+// packets as messages.
+func (session *quicSession) frames(state *decryptState, packet *Packet, dir int, frames []byte, initial bool) bool {
+	r := byteReader{data: frames}
+	for r.remaining() > 0 && !r.failed && !state.done {
+		frameType := r.varint()
+		switch {
+		case frameType == 0x00 || frameType == 0x01 || frameType == 0x1e: // PADDING, PING, HANDSHAKE_DONE
+		case frameType == 0x02 || frameType == 0x03: // ACK
+			r.varint()
+			r.varint()
+			ranges := r.varint()
+			r.varint()
+			for i := uint64(0); i < ranges && !r.failed; i++ {
+				r.varint()
+				r.varint()
+			}
+			if frameType == 0x03 {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case frameType == 0x04: // RESET_STREAM
+			r.varint()
+			r.varint()
+			r.varint()
+		case frameType == 0x05 || frameType == 0x11 || frameType == 0x15: // STOP_SENDING, MAX_STREAM_DATA, STREAM_DATA_BLOCKED
+			r.varint()
+			r.varint()
+		case frameType == 0x06: // CRYPTO
+			offset := r.varint()
+			data := r.bytes(int(r.varint()))
+			if initial && !r.failed {
+				session.crypto[dir].add(offset, data)
+				if !session.hello(state, dir) {
+					return false
+				}
+			}
+		case frameType == 0x07: // NEW_TOKEN
+			r.skip(int(r.varint()))
+		case frameType >= 0x08 && frameType <= 0x0f: // STREAM
+			stream := int64(r.varint())
+			if frameType&0x04 != 0 {
+				r.varint()
+			}
+			length := r.remaining()
+			if frameType&0x02 != 0 {
+				length = int(r.varint())
+			}
+			data := r.bytes(length)
+			if !r.failed && !initial {
+				state.record(packet, dir == session.client, "stream", &stream, data)
+			}
+		case frameType >= 0x10 && frameType <= 0x17 || frameType == 0x19: // MAX_DATA, MAX_STREAMS, DATA_BLOCKED, STREAMS_BLOCKED, RETIRE_CONNECTION_ID
+			r.varint()
+		case frameType == 0x18: // NEW_CONNECTION_ID
+			r.varint()
+			r.varint()
+			r.skip(int(r.uint8()))
+			r.skip(16) // stateless reset token
+		case frameType == 0x1a || frameType == 0x1b: // PATH_CHALLENGE, PATH_RESPONSE
+			r.skip(8)
+		case frameType == 0x1c || frameType == 0x1d: // CONNECTION_CLOSE
+			r.varint()
+			if frameType == 0x1c {
+				r.varint()
+			}
+			r.skip(int(r.varint()))
+		case frameType == 0x30 || frameType == 0x31: // DATAGRAM
+			length := r.remaining()
+			if frameType == 0x31 {
+				length = int(r.varint())
+			}
+			data := r.bytes(length)
+			if !r.failed && !initial {
+				state.record(packet, dir == session.client, "datagram", nil, data)
+			}
+		default:
+			// an extension frame of unknown length ends the packet
+			return true
+		}
+	}
+	return true
+}
+
+// hello reads the ClientHello or ServerHello of the Initial CRYPTO data of a
+// direction once complete, and derives the 1-RTT keys once both are read.
+func (session *quicSession) hello(state *decryptState, dir int) bool {
+	message := session.crypto[dir].message()
+	if message == nil {
+		return true
+	}
+	if dir == session.client {
+		if session.secrets != nil {
+			return true
+		}
+		if len(message) < 38 || message[0] != tlsClientHello {
+			return false
+		}
+		// flows whose keys are not in the log are left alone
+		session.secrets = state.keys.lookup(message[6:38])
+		return session.secrets != nil && session.secrets.clientTraffic != nil && session.secrets.serverTraffic != nil
+	}
+	if session.oneRTT[dir] != nil || session.secrets == nil {
+		return true
+	}
+	if message[0] != tlsServerHello {
+		return false
+	}
+	hello, _, ok := parseHello(message[4:], true)
+	suite, supported := tlsSuites[hello.cipher]
+	if !ok || !supported || hello.cipher>>8 != 0x13 {
+		return false
+	}
+	session.oneRTT[session.client] = newQUICKeys(suite, session.secrets.clientTraffic)
+	session.oneRTT[dir] = newQUICKeys(suite, session.secrets.serverTraffic)
+	// the Initial data is no longer needed
+	session.crypto = [2]quicCrypto{}
+	return session.oneRTT[session.client] != nil && session.oneRTT[dir] != nil
+}
+
+// varint reads a QUIC variable-length integer.
+func (r *byteReader) varint() uint64 {
+	first := r.bytes(1)
+	if first == nil {
+		return 0
+	}
+	value := uint64(first[0] & 0x3f)
+	for _, b := range r.bytes(1<<(first[0]>>6) - 1) {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
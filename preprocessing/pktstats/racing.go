@@ -0,0 +1,93 @@
+package pktstats
+
+import "sort"
+
+// racedLoserClass is the TrafficClass of the abandoned flow of a race pair.
+const racedLoserClass = "raced-loser"
+
+// raceTransport returns "tcp" or "quic" for the flows that may take part in
+// a connection race, empty for others.
+func (flow *Flow) raceTransport() string {
+	switch {
+	case flow.Protocol == 6:
+		return "tcp"
+	case flow.Protocol == 17 && flow.TransportProfile == profileQUIC:
+		return "quic"
+	}
+	return ""
+}
+
+// assignRacePairs finds the QUIC and TCP connections a client raced to the
+// same host, HTTP/3 alongside HTTP/2, keeping the first to answer: a TCP
+// and a QUIC flow of one local client to one DNS name, starting within
+// Options.RaceWindow of each other, where one, the loser, carries at most
+// Options.RaceLoserMaxBytes and lasts at most Options.RaceLoserMaxDuration.
+// Both get the RacePairID of the pair and the loser the TrafficClass
+// raced-loser, which the rollups do not count as a connection. Pair IDs
+// count from 1 in order of the first packet of the pair.
+// @return the number of pairs
+func assignRacePairs(flowMap map[string]*Flow, opts Options) int {
+	window := opts.duration(opts.RaceWindow)
+	if window <= 0 {
+		return 0
+	}
+	maxDuration := opts.duration(opts.RaceLoserMaxDuration)
+	// candidates of each client and host, in order of their first packet
+	hosts := make(map[string][]*Flow)
+	var hostKeys []string
+	for _, key := range sortedFlowKeys(flowMap) {
+		flow := flowMap[key]
+		if flow.DNSName == "" || flow.raceTransport() == "" || flow.TrafficClass != "" ||
+			flow.ServiceFlowType == telemetryRole || flow.ServiceFlowType == managementRole {
+			continue
+		}
+		host := flow.LocalIP + "/" + flow.Subscriber + "#" + flow.DNSName
+		if _, ok := hosts[host]; !ok {
+			hostKeys = append(hostKeys, host)
+		}
+		hosts[host] = append(hosts[host], flow)
+	}
+	isLoser := func(flow *Flow) bool {
+		_, bytes := flow.totals()
+		return bytes <= int64(opts.RaceLoserMaxBytes) && flow.download.last-flow.download.first <= maxDuration
+	}
+
+	type pair struct {
+		winner, loser *Flow
+		first         int64
+	}
+	var pairs []pair
+	for _, host := range hostKeys {
+		flows := hosts[host]
+		paired := make(map[*Flow]bool)
+		for i, a := range flows {
+			for _, b := range flows[i+1:] {
+				if b.download.first-a.download.first > window {
+					break
+				}
+				if paired[a] || paired[b] || a.raceTransport() == b.raceTransport() {
+					continue
+				}
+				_, aBytes := a.totals()
+				_, bBytes := b.totals()
+				winner, loser := a, b
+				if aBytes < bBytes {
+					winner, loser = b, a
+				}
+				if !isLoser(loser) || isLoser(winner) {
+					// no connection was abandoned, or both were
+					continue
+				}
+				paired[a], paired[b] = true, true
+				pairs = append(pairs, pair{winner, loser, a.download.first})
+				break
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].first < pairs[j].first })
+	for i, p := range pairs {
+		p.winner.RacePairID, p.loser.RacePairID = i+1, i+1
+		p.loser.TrafficClass = racedLoserClass
+	}
+	return len(pairs)
+}
@@ -0,0 +1,205 @@
+package pktstats
+
+import (
+	"testing"
+	"time"
+)
+
+// raceFlow is a flow of a synthetic race, transferring bytes from first to
+// last seconds into the capture.
+type raceFlow struct {
+	localIP     string
+	transport   string // tcp, quic, or udp for UDP flows of another profile
+	dnsName     string
+	first, last float64
+	bytes       int
+	pair        int  // RacePairID wanted
+	loser       bool // whether it is wanted as the loser
+}
+
+// flow returns the flow from localPort to the server of its DNS name.
+func (spec raceFlow) flow(localPort int) *Flow {
+	protocol := 17
+	if spec.transport == "tcp" {
+		protocol = 6
+	}
+	flow := syntheticFlow(spec.localIP, localPort, "203.0.113.10", 443, protocol, spec.first, spec.last)
+	flow.DNSName, flow.ServiceFlowType, flow.RegisteredDomain = spec.dnsName, registeredDomain(spec.dnsName), registeredDomain(spec.dnsName)
+	flow.Packets[0].PktLength = spec.bytes
+	switch spec.transport {
+	case "quic":
+		flow.TransportProfile = profileQUIC
+	case "udp":
+		flow.TransportProfile = profileUDPUnknown
+	}
+	return flow
+}
+
+func TestAssignRacePairs(t *testing.T) {
+	const client, other, host = "192.168.1.10", "192.168.1.11", "www.example.com"
+	tests := []struct {
+		name  string
+		opts  func(opts *Options)
+		flows []raceFlow
+	}{
+		{
+			name: "quic wins",
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 1, false},
+				{client, "tcp", host, 0.1, 0.3, 3000, 1, true},
+			},
+		},
+		{
+			name: "tcp wins",
+			flows: []raceFlow{
+				{client, "tcp", host, 0, 60, 5000000, 1, false},
+				{client, "quic", host, 0.05, 1, 2000, 1, true},
+			},
+		},
+		{
+			name: "outside the window",
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 0, false},
+				{client, "tcp", host, 0.6, 0.8, 3000, 0, false},
+			},
+		},
+		{
+			name: "race window flag",
+			opts: func(opts *Options) { opts.RaceWindow = time.Second },
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 1, false},
+				{client, "tcp", host, 0.6, 0.8, 3000, 1, true},
+			},
+		},
+		{
+			name: "race detection disabled",
+			opts: func(opts *Options) { opts.RaceWindow = 0 },
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 0, false},
+				{client, "tcp", host, 0.1, 0.3, 3000, 0, false},
+			},
+		},
+		{
+			name: "loser bytes flag",
+			opts: func(opts *Options) { opts.RaceLoserMaxBytes = 1000 },
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 0, false},
+				{client, "tcp", host, 0.1, 0.3, 3000, 0, false},
+			},
+		},
+		{
+			name: "loser lasting too long",
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 0, false},
+				{client, "tcp", host, 0.1, 5, 3000, 0, false},
+			},
+		},
+		{
+			name: "loser duration flag",
+			opts: func(opts *Options) { opts.RaceLoserMaxDuration = 10 * time.Second },
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 1, false},
+				{client, "tcp", host, 0.1, 5, 3000, 1, true},
+			},
+		},
+		{
+			name: "both abandoned",
+			flows: []raceFlow{
+				{client, "quic", host, 0, 0.5, 2000, 0, false},
+				{client, "tcp", host, 0.1, 0.3, 3000, 0, false},
+			},
+		},
+		{
+			name: "neither abandoned",
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 0, false},
+				{client, "tcp", host, 0.1, 60, 4000000, 0, false},
+			},
+		},
+		{
+			name: "same transport",
+			flows: []raceFlow{
+				{client, "tcp", host, 0, 60, 5000000, 0, false},
+				{client, "tcp", host, 0.1, 0.3, 3000, 0, false},
+			},
+		},
+		{
+			name: "udp without quic",
+			flows: []raceFlow{
+				{client, "udp", host, 0, 60, 5000000, 0, false},
+				{client, "tcp", host, 0.1, 0.3, 3000, 0, false},
+			},
+		},
+		{
+			name: "other client and other host",
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 0, false},
+				{other, "tcp", host, 0.1, 0.3, 3000, 0, false},
+				{client, "tcp", "api.example.com", 0.1, 0.3, 3000, 0, false},
+			},
+		},
+		{
+			name: "unresolved",
+			flows: []raceFlow{
+				{client, "quic", "", 0, 60, 5000000, 0, false},
+				{client, "tcp", "", 0.1, 0.3, 3000, 0, false},
+			},
+		},
+		{
+			name: "one pair per flow",
+			flows: []raceFlow{
+				{client, "quic", host, 0, 60, 5000000, 1, false},
+				{client, "tcp", host, 0.1, 0.3, 3000, 1, true},
+				{client, "tcp", host, 0.2, 0.4, 3000, 0, false},
+			},
+		},
+		{
+			name: "pair IDs by first packet",
+			flows: []raceFlow{
+				{client, "quic", host, 1, 60, 5000000, 2, false},
+				{client, "tcp", host, 1.1, 1.3, 3000, 2, true},
+				{other, "tcp", host, 0, 60, 5000000, 1, false},
+				{other, "quic", host, 0.2, 0.5, 1500, 1, true},
+			},
+		},
+	}
+	for _, test := range tests {
+		opts := DefaultOptions()
+		if test.opts != nil {
+			test.opts(&opts)
+		}
+		flows := make([]*Flow, len(test.flows))
+		wantPairs := make(map[int]bool)
+		for i, spec := range test.flows {
+			flows[i] = spec.flow(50000 + i)
+			if spec.pair > 0 {
+				wantPairs[spec.pair] = true
+			}
+		}
+		if pairs := assignRacePairs(keyedFlows(flows), opts); pairs != len(wantPairs) {
+			t.Errorf("%s: %d race pairs, want %d", test.name, pairs, len(wantPairs))
+		}
+		for i, spec := range test.flows {
+			flow := flows[i]
+			if flow.RacePairID != spec.pair || (flow.TrafficClass == racedLoserClass) != spec.loser {
+				t.Errorf("%s: flow %d in race pair %d with class %q, want pair %d loser %v", test.name, i, flow.RacePairID, flow.TrafficClass, spec.pair, spec.loser)
+			}
+		}
+	}
+}
+
+// TestRacedLoserRollup leaves the loser of a race out of the connections of
+// its service, not out of its bytes.
+func TestRacedLoserRollup(t *testing.T) {
+	flowMap := keyedFlows([]*Flow{
+		raceFlow{"192.168.1.10", "quic", "www.example.com", 0, 60, 5000000, 1, false}.flow(50000),
+		raceFlow{"192.168.1.10", "tcp", "www.example.com", 0.1, 0.3, 3000, 1, true}.flow(50001),
+	})
+	if pairs := assignRacePairs(flowMap, DefaultOptions()); pairs != 1 {
+		t.Fatalf("%d race pairs, want 1", pairs)
+	}
+	stats := serviceRollup(flowMap)["example.com"]
+	if stats == nil || stats.Flows != 1 || stats.RacedLosers != 1 || stats.Bytes != 5003000 {
+		t.Errorf("service rollup %+v, want 1 flow, 1 raced loser and the bytes of both", stats)
+	}
+}
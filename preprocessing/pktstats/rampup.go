@@ -0,0 +1,107 @@
+package pktstats
+
+import (
+	"sort"
+	"time"
+)
+
+// rampUpBin is the resolution of the ramp-up window, over which 1-second
+// rates are taken as sliding sums
+const rampUpBin = 100 * time.Millisecond
+
+// RampUp describes the first seconds of a media flow after its first media
+// packet (see Flow.FirstMediaTimestamp), where the bitrate ramps up. Rates
+// count downstream bytes per second. Flows ending before a steady state can
+// be measured after the window are NotApplicable, with the rates of the
+// seconds seen and the other values -1.
+type RampUp struct {
+	NotApplicable  bool    `json:"notApplicable,omitempty"` // the flow has no full second after the window
+	BytesPerSecond []int64 `json:"bytesPerSecond"`          // downstream bytes in each second of the window
+	SteadyRate     int64   `json:"steadyRate"`              // median rate of the full seconds after the window
+	PeakRate       int64   `json:"peakRate"`                // highest 1-second rate within the window, in rampUpBin steps
+	// from the first media packet until the 1-second rate first reached 90%
+	// of SteadyRate, -1 if it did not within the window
+	Time90Millis int64 `json:"time90Millis"`
+}
+
+// rampUpState bins the downstream bytes of a flow from its first media packet
+// on, per rampUpBin within the window and per second after it.
+type rampUpState struct {
+	window  int   // seconds, 0 if disabled
+	bin     int64 // rampUpBin in the output precision
+	bins    []int64
+	seconds []int64
+}
+
+// observe takes the packets after firstMedia observed them.
+func (state *rampUpState) observe(packet *Packet, firstMedia *firstMediaState) {
+	if packet.Upstream || !firstMedia.found {
+		return
+	}
+	index := int((packet.Timestamp - firstMedia.timestamp) / state.bin)
+	windowBins := state.window * int(time.Second/rampUpBin)
+	if index < windowBins {
+		for len(state.bins) <= index {
+			state.bins = append(state.bins, 0)
+		}
+		state.bins[index] += int64(packet.PktLength)
+		return
+	}
+	second := (index - windowBins) / int(time.Second/rampUpBin)
+	for len(state.seconds) <= second {
+		state.seconds = append(state.seconds, 0)
+	}
+	state.seconds[second] += int64(packet.PktLength)
+}
+
+// measureRampUp stores the RampUp of flows with a first media packet. The
+// steady state is the median over the full seconds after the window, the
+// last, partial second of the flow left out.
+func (flow *Flow) measureRampUp() {
+	state := &flow.rampUp
+	if state.window == 0 || !flow.firstMedia.found {
+		return
+	}
+	binsPerSecond := int(time.Second / rampUpBin)
+	windowBins := state.window * binsPerSecond
+	bins := make([]int64, windowBins)
+	copy(bins, state.bins)
+	ramp := &RampUp{SteadyRate: -1, PeakRate: -1, Time90Millis: -1}
+	flow.RampUp = ramp
+	// seconds of the window the flow was seen in, all of them if it lasts longer
+	seen := int((flow.download.last-flow.firstMedia.timestamp)/state.bin)/binsPerSecond + 1
+	for second := 0; second < state.window && second < seen; second++ {
+		var bytes int64
+		for _, binBytes := range bins[second*binsPerSecond : (second+1)*binsPerSecond] {
+			bytes += binBytes
+		}
+		ramp.BytesPerSecond = append(ramp.BytesPerSecond, bytes)
+	}
+	fullSeconds := seen - state.window - 1
+	if fullSeconds < 1 {
+		ramp.NotApplicable = true
+		return
+	}
+	rates := make([]int64, fullSeconds)
+	copy(rates, state.seconds)
+	sort.Slice(rates, func(i, j int) bool { return rates[i] < rates[j] })
+	ramp.SteadyRate = rates[len(rates)/2]
+	if len(rates)%2 == 0 {
+		ramp.SteadyRate = (rates[len(rates)/2-1] + rates[len(rates)/2]) / 2
+	}
+
+	// 1-second sliding sums ending at each bin, shorter in the first second
+	var rate int64
+	for end, binBytes := range bins {
+		rate += binBytes
+		if end >= binsPerSecond {
+			rate -= bins[end-binsPerSecond]
+		}
+		if end >= binsPerSecond-1 {
+			ramp.PeakRate = max(ramp.PeakRate, rate)
+		}
+		if ramp.Time90Millis < 0 && float64(rate) >= 0.9*float64(ramp.SteadyRate) {
+			ramp.Time90Millis = int64(end+1) * rampUpBin.Milliseconds()
+		}
+	}
+}
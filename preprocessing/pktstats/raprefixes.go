@@ -0,0 +1,145 @@
+package pktstats
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// icmpv6OptPrefixInfo is the Prefix Information option of Router
+// Advertisements, RFC 4861.
+const icmpv6OptPrefixInfo = 3
+
+const (
+	// raHoldWindow is how long IPv6 packets without a local endpoint are held
+	// for a router advertisement at the start of a capture
+	raHoldWindow = 10 * time.Second
+	// raHoldPackets bounds the packets held
+	raHoldPackets = 10000
+)
+
+// LearnedPrefix is an IPv6 prefix advertised by a router of the capture,
+// local to the direction of packets from its first advertisement on, see
+// Options.LearnPrefixes.
+type LearnedPrefix struct {
+	Prefix        string `json:"prefix"`
+	Router        string `json:"router"`        // source of the first advertisement
+	Timestamp     int64  `json:"timestamp"`     // of the first advertisement
+	ValidLifetime uint32 `json:"validLifetime"` // in seconds, 0xffffffff for infinity
+}
+
+// learnedPrefixes are the prefixes advertised so far in a capture.
+type learnedPrefixes struct {
+	prefixes []LearnedPrefix
+	nets     localSubnets
+}
+
+// learn adds the on-link or autonomous prefixes of a Router Advertisement,
+// other than link-local ones and those withdrawn with a zero lifetime.
+// @return whether a prefix was new
+func (learned *learnedPrefixes) learn(ra *layers.ICMPv6RouterAdvertisement, router net.IP, timestamp int64) bool {
+	added := false
+	for _, opt := range ra.Options {
+		if opt.Type != icmpv6OptPrefixInfo || len(opt.Data) != 30 {
+			continue
+		}
+		length, flags := int(opt.Data[0]), opt.Data[1]
+		lifetime := binary.BigEndian.Uint32(opt.Data[2:6])
+		prefix := net.IP(append([]byte(nil), opt.Data[14:30]...))
+		if length > 128 || flags&0xc0 == 0 || lifetime == 0 || prefix.IsLinkLocalUnicast() {
+			continue
+		}
+		mask := net.CIDRMask(length, 128)
+		advertised := &net.IPNet{IP: prefix.Mask(mask), Mask: mask}
+		known := false
+		for _, p := range learned.nets {
+			known = known || p.String() == advertised.String()
+		}
+		if known {
+			continue
+		}
+		learned.nets = append(learned.nets, advertised)
+		learned.prefixes = append(learned.prefixes, LearnedPrefix{Prefix: advertised.String(), Router: router.String(), Timestamp: timestamp, ValidLifetime: lifetime})
+		added = true
+	}
+	return added
+}
+
+// isLocal reports whether an IPv6 address is local: in the configured local
+// subnets or a learned prefix, unique local (fc00::/7) or link-local.
+func (learned *learnedPrefixes) isLocal(ip net.IP, configured localSubnets) bool {
+	return configured.contains(ip) || learned.nets.contains(ip) || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// heldPackets holds the IPv6 packets without a local endpoint read before the
+// first router advertisement of a capture, for at most raHoldWindow and
+// raHoldPackets, so that a prefix advertised early in the capture applies to
+// them too. Held packets are replayed, in order, once a prefix is learned or
+// the hold ends; packets are only held once.
+type heldPackets struct {
+	linkType layers.LinkType
+	packets  []gopacket.Packet
+	first    int64 // timestamp of the first packet held
+	window   int64
+	replayed int  // packets of a release replayed so far
+	release  bool // the held packets are being replayed
+	done     bool // no more packets are held
+}
+
+func newHeldPackets(opts Options, linkType layers.LinkType) *heldPackets {
+	return &heldPackets{linkType: linkType, window: opts.duration(raHoldWindow), done: !opts.LearnPrefixes}
+}
+
+// hold keeps a copy of a packet to replay, since the packet source may reuse
+// its data.
+// @return false if packets are no longer held
+func (held *heldPackets) hold(packet gopacket.Packet, timestamp int64) bool {
+	if held.done {
+		return false
+	}
+	if len(held.packets) == 0 {
+		held.first = timestamp
+	}
+	copied := gopacket.NewPacket(append([]byte(nil), packet.Data()...), held.linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	*copied.Metadata() = *packet.Metadata()
+	held.packets = append(held.packets, copied)
+	if len(held.packets) >= raHoldPackets {
+		held.end()
+	}
+	return true
+}
+
+// expire ends the hold once a packet comes raHoldWindow after the first one
+// held, holding that packet too to keep the order of the replay.
+// @return whether the packet was held
+func (held *heldPackets) expire(packet gopacket.Packet, timestamp int64) bool {
+	if held.done || len(held.packets) == 0 || timestamp-held.first <= held.window {
+		return false
+	}
+	held.hold(packet, timestamp)
+	held.end()
+	return true
+}
+
+// end stops holding packets and releases those held.
+func (held *heldPackets) end() {
+	held.done = true
+	held.release = len(held.packets) > 0
+}
+
+// next returns the next held packet to replay, nil if none is released.
+func (held *heldPackets) next() gopacket.Packet {
+	if !held.release {
+		return nil
+	}
+	packet := held.packets[held.replayed]
+	held.packets[held.replayed] = nil
+	held.replayed++
+	if held.replayed == len(held.packets) {
+		held.packets, held.replayed, held.release = nil, 0, false
+	}
+	return packet
+}
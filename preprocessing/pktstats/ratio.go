@@ -0,0 +1,122 @@
+package pktstats
+
+import "time"
+
+// RatioTimeline is the traffic of all the flows of a local client over time,
+// binned per Options.RatioBin: the downstream:upstream byte ratio and the
+// rate, which tell cloud gaming (strongly downstream-heavy at a high rate)
+// from local gameplay with online multiplayer (near-symmetric small flows)
+// without any classification of the flows.
+type RatioTimeline struct {
+	LocalClient string    `json:"localClient"`
+	Start       int64     `json:"start"` // start of the first bin, a multiple of the bin width
+	BinMillis   int64     `json:"binMillis"`
+	DownBytes   []int64   `json:"downBytes"`
+	UpBytes     []int64   `json:"upBytes"`
+	Ratios      []float64 `json:"ratios"` // downstream bytes per upstream byte of each bin
+	Mbps        []float64 `json:"mbps"`   // rate of both directions in each bin
+	// periods where the ratio and the rate stayed above the thresholds, see
+	// Options.StreamingMinRatio
+	StreamingLikely []StreamingInterval `json:"streamingLikely,omitempty"`
+}
+
+// StreamingInterval is a period of a RatioTimeline where cloud streaming is
+// likely.
+type StreamingInterval struct {
+	Start int64   `json:"start"`
+	End   int64   `json:"end"`   // end of its last bin
+	Ratio float64 `json:"ratio"` // over the interval
+	Mbps  float64 `json:"mbps"`
+}
+
+// ratioBins accumulates the bytes of the flows of each local client per bin.
+type ratioBins struct {
+	width   int64 // in the output precision
+	clients map[string]*clientBins
+}
+
+type clientBins struct {
+	start    int64
+	down, up []int64
+}
+
+func newRatioBins(opts Options) *ratioBins {
+	if opts.RatioBin <= 0 {
+		return nil
+	}
+	return &ratioBins{width: max(opts.duration(opts.RatioBin), 1), clients: make(map[string]*clientBins)}
+}
+
+// observe adds a packet of a flow of client, upstream or downstream.
+func (bins *ratioBins) observe(client string, packet *Packet) {
+	state, ok := bins.clients[client]
+	if !ok {
+		state = &clientBins{start: packet.Timestamp - packet.Timestamp%bins.width}
+		bins.clients[client] = state
+	}
+	i := int(max(packet.Timestamp-state.start, 0) / bins.width)
+	for len(state.down) <= i {
+		state.down, state.up = append(state.down, 0), append(state.up, 0)
+	}
+	if packet.Upstream {
+		state.up[i] += int64(packet.PktLength)
+	} else {
+		state.down[i] += int64(packet.PktLength)
+	}
+}
+
+// timelines returns the timeline of each client, in order of the clients,
+// with the intervals where cloud streaming is likely: at least
+// Options.StreamingMinDuration of consecutive bins with a ratio of at least
+// Options.StreamingMinRatio and a rate of at least Options.StreamingMinMbps.
+func (bins *ratioBins) timelines(opts Options) []RatioTimeline {
+	seconds := float64(time.Duration(opts.microseconds(bins.width))*time.Microsecond) / float64(time.Second)
+	minBins := int((opts.duration(opts.StreamingMinDuration) + bins.width - 1) / bins.width)
+	var timelines []RatioTimeline
+	for _, client := range sortedKeys(bins.clients) {
+		state := bins.clients[client]
+		timeline := RatioTimeline{
+			LocalClient: client,
+			Start:       state.start,
+			BinMillis:   opts.RatioBin.Milliseconds(),
+			DownBytes:   state.down,
+			UpBytes:     state.up,
+			Ratios:      make([]float64, len(state.down)),
+			Mbps:        make([]float64, len(state.down)),
+		}
+		runStart := -1
+		for i := 0; i <= len(state.down); i++ {
+			likely := false
+			if i < len(state.down) {
+				timeline.Ratios[i] = float64(state.down[i]) / float64(max(state.up[i], 1))
+				timeline.Mbps[i] = float64(state.down[i]+state.up[i]) * 8 / seconds / 1e6
+				likely = timeline.Ratios[i] >= opts.StreamingMinRatio && timeline.Mbps[i] >= opts.StreamingMinMbps
+			}
+			if likely && runStart < 0 {
+				runStart = i
+			} else if !likely && runStart >= 0 {
+				if i-runStart >= max(minBins, 1) {
+					timeline.StreamingLikely = append(timeline.StreamingLikely, streamingInterval(state, runStart, i, bins.width, seconds))
+				}
+				runStart = -1
+			}
+		}
+		timelines = append(timelines, timeline)
+	}
+	return timelines
+}
+
+// streamingInterval describes the bins [first, end) of a client.
+func streamingInterval(state *clientBins, first, end int, width int64, binSeconds float64) StreamingInterval {
+	var down, up int64
+	for i := first; i < end; i++ {
+		down += state.down[i]
+		up += state.up[i]
+	}
+	return StreamingInterval{
+		Start: state.start + int64(first)*width,
+		End:   state.start + int64(end)*width,
+		Ratio: float64(down) / float64(max(up, 1)),
+		Mbps:  float64(down+up) * 8 / (binSeconds * float64(end-first)) / 1e6,
+	}
+}
@@ -0,0 +1,128 @@
+package pktstats
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// rdnsResolver resolves PTR records for remote IPs that captured DNS did not
+// label. Results, including failed lookups, are cached for the whole run and
+// persisted so later runs and offline machines get the same answers.
+type rdnsResolver struct {
+	mu      sync.Mutex
+	cache   map[string]string // IP -> PTR name, "" when the lookup found nothing
+	offline bool              // only consult the cache
+	timeout time.Duration
+	workers chan struct{} // bounds concurrent lookups across all files
+}
+
+func newRDNSResolver(cachePath string, offline bool, timeout time.Duration, workers int) (*rdnsResolver, error) {
+	resolver := &rdnsResolver{
+		cache:   make(map[string]string),
+		offline: offline,
+		timeout: timeout,
+		workers: make(chan struct{}, workers),
+	}
+	cacheFile, err := os.ReadFile(cachePath)
+	if err != nil {
+		if offline || !os.IsNotExist(err) {
+			return nil, err
+		}
+		return resolver, nil
+	}
+	if err := json.Unmarshal(cacheFile, &resolver.cache); err != nil {
+		return nil, err
+	}
+	return resolver, nil
+}
+
+// resolve returns the PTR name of each IP and the source of the answer, "rdns"
+// for a live lookup or "rdns-cache". IPs without a name are left out.
+func (resolver *rdnsResolver) resolve(ips []string) map[string][2]string {
+	results := make(map[string][2]string)
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, ip := range ips {
+		resolver.mu.Lock()
+		name, cached := resolver.cache[ip]
+		resolver.mu.Unlock()
+		if cached || resolver.offline {
+			if name != "" {
+				results[ip] = [2]string{name, labelRDNSCache}
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			resolver.workers <- struct{}{}
+			defer func() { <-resolver.workers }()
+			name := resolver.lookup(ip)
+			resolver.mu.Lock()
+			resolver.cache[ip] = name
+			resolver.mu.Unlock()
+			if name != "" {
+				resultsMu.Lock()
+				results[ip] = [2]string{name, labelRDNS}
+				resultsMu.Unlock()
+			}
+		}(ip)
+	}
+	wg.Wait()
+	return results
+}
+
+func (resolver *rdnsResolver) lookup(ip string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), resolver.timeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	name, _ := normalizeDNSName(names[0])
+	return name
+}
+
+// save persists the cache, unless the resolver only reads a pre-built cache.
+func (resolver *rdnsResolver) save(cachePath string) error {
+	if resolver.offline {
+		return nil
+	}
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	jsonString, err := json.Marshal(resolver.cache)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cachePath, jsonString, 0644)
+}
+
+// rdnsConfidence is the LabelConfidence of PTR names, which often name the
+// hosting provider rather than the service.
+const rdnsConfidence = 0.5
+
+// labelByRDNS sets RDNSName on flows whose remote IP has no captured DNS name.
+func labelByRDNS(resolver *rdnsResolver, flowMap map[string]*Flow) {
+	var ips []string
+	seen := make(map[string]bool)
+	for _, flow := range flowMap {
+		if flow.DNSName == "" && !seen[flow.RemoteIP] {
+			seen[flow.RemoteIP] = true
+			ips = append(ips, flow.RemoteIP)
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+	results := resolver.resolve(ips)
+	for _, flow := range flowMap {
+		if result, ok := results[flow.RemoteIP]; ok && flow.DNSName == "" {
+			flow.RDNSName, flow.LabelSource = result[0], result[1]
+			flow.LabelConfidence = rdnsConfidence
+		}
+	}
+}
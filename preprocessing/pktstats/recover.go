@@ -0,0 +1,79 @@
+package pktstats
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// filePanic is a panic recovered from the processing of an input file, e.g.
+// a decoding edge case of gopacket.
+type filePanic struct {
+	value any
+	stack []byte
+}
+
+func (recovered *filePanic) String() string {
+	return fmt.Sprintf("%v\n%s", recovered.value, recovered.stack)
+}
+
+// recoverFile processes an input file, recovering a panic of the goroutine
+// so that it fails that file rather than the run. The outputs written for it
+// since the processing started are removed, as they may be cut short.
+// @param outPath: the output of the file, whose partial siblings are removed too
+// @return the recovered panic, nil if process returned
+func recoverFile(input, outPath string, process func()) (recovered *filePanic) {
+	started := time.Now()
+	defer func() {
+		value := recover()
+		if value == nil {
+			return
+		}
+		recovered = &filePanic{value: value, stack: debug.Stack()}
+		fmt.Printf("%s: panic: %s", input, recovered)
+		for _, path := range removePartialOutputs(outPath, started) {
+			fmt.Printf("%s: removed partial output %s\n", input, path)
+		}
+	}()
+	process()
+	return nil
+}
+
+// removePartialOutputs removes the files modified since started whose name
+// starts with that of outPath without its extension: the output itself, its
+// parts, per-client outputs, sidecars and trace file.
+// @return the removed files
+func removePartialOutputs(outPath string, started time.Time) []string {
+	if outPath == "" {
+		return nil
+	}
+	stem := strings.TrimSuffix(outPath, filepath.Ext(outPath))
+	pattern := strings.ReplaceAll(filepath.Join(filepath.Dir(stem), globEscape(filepath.Base(stem))), globEscape(clientToken), "*") + "*"
+	matches, _ := filepath.Glob(pattern)
+	var removed []string
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || info.ModTime().Before(started) {
+			continue
+		}
+		if os.Remove(path) == nil {
+			removed = append(removed, path)
+		}
+	}
+	return removed
+}
+
+// globEscape escapes the metacharacters of filepath.Match in a name.
+func globEscape(name string) string {
+	var escaped strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`*?[\`, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,89 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// panickingSource delivers the first packets of a capture, then panics as a
+// decoding edge case of a reader would.
+type panickingSource struct {
+	captureReader
+	packets int // delivered before the panic
+}
+
+func (source *panickingSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if source.packets == 0 {
+		panic("corrupt block")
+	}
+	source.packets--
+	return source.captureReader.ReadPacketData()
+}
+
+// TestRecoverFile runs over a capture whose reader panics and another one:
+// the first fails with its partial output removed, the second is extracted.
+func TestRecoverFile(t *testing.T) {
+	defer func(open func(string, Options) (*captureStream, func(), error)) { openSource = open }(openSource)
+	openSource = func(filePath string, opts Options) (*captureStream, func(), error) {
+		stream, release, err := openCapture(filePath, opts)
+		if err != nil || filepath.Base(filePath) != "broken.pcap" {
+			return stream, release, err
+		}
+		return &captureStream{captureReader: &panickingSource{captureReader: stream, packets: 10}, progress: stream.progress}, release, nil
+	}
+	content, err := os.ReadFile(fixture(t, "flows.pcap", flowsCapture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, singlePass := range []bool{true, false} {
+		dir := t.TempDir()
+		var inputs []string
+		for _, name := range []string{"broken.pcap", "good.pcap"} {
+			inputs = append(inputs, filepath.Join(dir, name))
+			if err := os.WriteFile(inputs[len(inputs)-1], content, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		opts := testOptions()
+		opts.DNSSinglePass = singlePass
+		opts.OutputDir = dir
+		opts.InputList = filepath.Join(dir, "inputs.txt")
+		if err := os.WriteFile(opts.InputList, []byte(strings.Join(inputs, "\n")), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Run(dir, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		manifestFile, err := os.ReadFile(filepath.Join(dir, "run_manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest Manifest
+		if err := json.Unmarshal(manifestFile, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		statuses := make(map[string]ManifestEntry)
+		for _, entry := range manifest.Files {
+			statuses[filepath.Base(entry.Input)] = entry
+		}
+		if broken := statuses["broken.pcap"]; broken.Status != "failed" || broken.Reason != "panic" || !strings.Contains(broken.Panic, "corrupt block") {
+			t.Errorf("single pass %v: broken capture recorded as %+v, want failed with the panic", singlePass, broken)
+		}
+		if good := statuses["good.pcap"]; good.Status != "processed" {
+			t.Errorf("single pass %v: good capture recorded as %+v, want processed", singlePass, good)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "broken_packetStats.json")); !os.IsNotExist(err) {
+			t.Errorf("single pass %v: output of the broken capture left: %v", singlePass, err)
+		}
+		if _, err := LoadFlows(filepath.Join(dir, "good_packetStats.json")); err != nil {
+			t.Errorf("single pass %v: %v", singlePass, err)
+		}
+	}
+}
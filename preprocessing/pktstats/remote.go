@@ -0,0 +1,219 @@
+package pktstats
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// remoteAttempts bounds the requests made to read one object; after a
+// failure the stream resumes where it stopped with a range request.
+const remoteAttempts = 5
+
+// remoteRetryDelay is the wait before the second request of an object, growing
+// by as much for each further one.
+var remoteRetryDelay = time.Second
+
+var (
+	s3Once   sync.Once
+	s3Client *s3.Client
+	s3Err    error
+)
+
+// isRemoteInput reports whether an input is an s3:// or http(s):// URL.
+func isRemoteInput(path string) bool {
+	return strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// remoteLocalPath returns the local path standing for a remote input: the
+// bucket or host and the object path below dir. Its outputs are written there,
+// and files of the same remote "directory" share a local directory, and with
+// it the cached dns_map.json and devices.json.
+func remoteLocalPath(dir, input string) (string, error) {
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" || u.Path == "" || strings.Contains(u.Path, "..") {
+		return "", fmt.Errorf("invalid remote input %s", input)
+	}
+	return filepath.Join(dir, u.Host, filepath.FromSlash(u.Path)), nil
+}
+
+// localDir returns the directory of the files kept next to a capture, its
+// dns_map.json and devices.json: that of its remoteLocalPath for a remote input.
+func localDir(filePath string, opts Options) string {
+	if isRemoteInput(filePath) {
+		if path, err := remoteLocalPath(opts.OutputDir, filePath); err == nil {
+			return filepath.Dir(path)
+		}
+	}
+	return filepath.Dir(filePath)
+}
+
+// remoteReader streams a remote input. A failed request or read is retried
+// with a range request from the bytes read so far, up to remoteAttempts
+// requests in all, so an interrupted stream resumes where it stopped.
+type remoteReader struct {
+	ctx      context.Context
+	input    string
+	body     io.ReadCloser
+	offset   int64 // bytes read so far
+	attempts int
+	err      error // of the last failed request or read
+}
+
+// newRemoteReader returns a reader of a remote input, requested on the first read.
+func newRemoteReader(ctx context.Context, input string) *remoteReader {
+	return &remoteReader{ctx: ctx, input: input}
+}
+
+func (reader *remoteReader) Read(p []byte) (int, error) {
+	for {
+		if reader.body == nil {
+			if err := reader.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := reader.body.Read(p)
+		reader.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		// the next request resumes after the bytes read
+		reader.body.Close()
+		reader.body, reader.err = nil, err
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// open requests the input from the bytes read so far on, retrying failed
+// requests until remoteAttempts were made.
+func (reader *remoteReader) open() error {
+	for {
+		if err := reader.ctx.Err(); err != nil {
+			return err
+		}
+		if reader.attempts == remoteAttempts {
+			return &remoteError{reader.input, reader.err}
+		}
+		if reader.attempts > 0 {
+			fmt.Printf("Download of %s failed after %d bytes, retrying: %v\n", reader.input, reader.offset, reader.err)
+			time.Sleep(time.Duration(reader.attempts) * remoteRetryDelay)
+		}
+		reader.attempts++
+		body, err := openRemote(reader.ctx, reader.input, reader.offset)
+		if err == nil {
+			reader.body = body
+			return nil
+		}
+		reader.err = err
+	}
+}
+
+// remoteError ends the stream of a remote input after remoteAttempts failed
+// requests. Unlike the end of a truncated file, it fails the capture.
+type remoteError struct {
+	input string
+	err   error
+}
+
+func (err *remoteError) Error() string {
+	return fmt.Sprintf("unable to download %s: %v", err.input, err.err)
+}
+
+func (err *remoteError) Unwrap() error {
+	return err.err
+}
+
+// Close closes the response being read, if any.
+func (reader *remoteReader) Close() error {
+	if reader.body == nil {
+		return nil
+	}
+	err := reader.body.Close()
+	reader.body = nil
+	return err
+}
+
+// openRemote returns the content of a remote input from offset on.
+func openRemote(ctx context.Context, input string, offset int64) (io.ReadCloser, error) {
+	rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+	if strings.HasPrefix(input, "s3://") {
+		client, err := newS3Client(ctx)
+		if err != nil {
+			return nil, err
+		}
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(input, "s3://"), "/")
+		object, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Range:  aws.String(rangeHeader),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return object.Body, nil
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, input, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		request.Header.Set("Range", rangeHeader)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent ||
+		offset > 0 && response.StatusCode != http.StatusPartialContent {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status %s", response.Status)
+	}
+	return response.Body, nil
+}
+
+// newS3Client creates the S3 client shared by all downloads, with credentials
+// and region from the standard AWS environment and configuration files.
+func newS3Client(ctx context.Context) (*s3.Client, error) {
+	s3Once.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			s3Err = fmt.Errorf("unable to load AWS configuration: %w", err)
+			return
+		}
+		s3Client = s3.NewFromConfig(cfg)
+	})
+	return s3Client, s3Err
+}
+
+// readInputList reads the inputs of a list file, one local path or URL per
+// line, skipping blank lines and # comments.
+func readInputList(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inputs []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			inputs = append(inputs, line)
+		}
+	}
+	return inputs, nil
+}
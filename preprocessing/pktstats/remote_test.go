@@ -0,0 +1,129 @@
+package pktstats
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer serves a capture, cutting the response of each of the first
+// drops requests halfway through, and records the Range header of requests.
+type flakyServer struct {
+	content []byte
+	drops   int
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (server *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	server.ranges = append(server.ranges, r.Header.Get("Range"))
+	drop := len(server.ranges) <= server.drops
+	server.mu.Unlock()
+	if !drop {
+		http.ServeContent(w, r, "flows.pcap", time.Time{}, bytes.NewReader(server.content))
+		return
+	}
+	// a response shorter than its Content-Length fails the client's read
+	status, offset := http.StatusOK, 0
+	if header := r.Header.Get("Range"); header != "" {
+		status = http.StatusPartialContent
+		offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(header, "bytes="), "-"))
+	}
+	rest := server.content[offset:]
+	w.Header().Set("Content-Length", strconv.Itoa(len(rest)))
+	w.WriteHeader(status)
+	w.Write(rest[:len(rest)/2])
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+// TestRemoteInputResume streams a capture over HTTP through interrupted
+// responses and extracts the same flows as from the local file.
+func TestRemoteInputResume(t *testing.T) {
+	defer func(delay time.Duration) { remoteRetryDelay = delay }(remoteRetryDelay)
+	remoteRetryDelay = 0
+	capture := fixture(t, "flows.pcap", flowsCapture)
+	content, err := os.ReadFile(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := extractFixture(t, capture, testOptions())
+
+	server := &flakyServer{content: content, drops: 2}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	input := httpServer.URL + "/captures/flows.pcap"
+
+	opts := testOptions()
+	opts.DNSSinglePass = false
+	opts.OutputDir = t.TempDir()
+	localPath, err := remoteLocalPath(opts.OutputDir, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the DNS pass streams the capture, the extraction streams it again
+	if opts.DNSMap, opts.DNSAnswerSets, err = constructDNSMap(context.Background(), input, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(localPath), "dns_map.json")); err != nil {
+		t.Errorf("dns_map.json not written next to the local path: %v", err)
+	}
+	outPath := outputPath(opts.OutTemplate, localPath, opts.Format)
+	if ExtractPacketStats(context.Background(), input, outPath, opts) == nil {
+		t.Fatalf("unable to extract %s", input)
+	}
+	got, err := LoadFlows(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Flows, want.Flows) {
+		t.Error("flows of the streamed capture differ from those of the local file")
+	}
+	if got.Meta.Source != input {
+		t.Errorf("meta block source %q, want %q", got.Meta.Source, input)
+	}
+
+	// each interrupted response resumes after the bytes read before it
+	half := len(content) / 2
+	wantRanges := []string{"", "bytes=" + strconv.Itoa(half) + "-", "bytes=" + strconv.Itoa(half+(len(content)-half)/2) + "-", ""}
+	if !reflect.DeepEqual(server.ranges, wantRanges) {
+		t.Errorf("requests with ranges %q, want %q", server.ranges, wantRanges)
+	}
+}
+
+// TestRemoteInputFailure fails a capture whose responses are all cut short
+// after remoteAttempts requests.
+func TestRemoteInputFailure(t *testing.T) {
+	defer func(delay time.Duration) { remoteRetryDelay = delay }(remoteRetryDelay)
+	remoteRetryDelay = 0
+	content, err := os.ReadFile(fixture(t, "flows.pcap", flowsCapture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &flakyServer{content: content, drops: remoteAttempts}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	opts := testOptions()
+	outPath := filepath.Join(t.TempDir(), "flows_packetStats.json")
+	if ExtractPacketStats(context.Background(), httpServer.URL+"/flows.pcap", outPath, opts) != nil {
+		t.Error("capture extracted from an incomplete stream")
+	}
+	if len(server.ranges) != remoteAttempts {
+		t.Errorf("%d requests, want %d", len(server.ranges), remoteAttempts)
+	}
+}
@@ -0,0 +1,104 @@
+package pktstats
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// remotePrefixes are the networks of the remote endpoints whose flows are
+// extracted, Options.RemotePrefixes: the servers of a provider under study.
+type remotePrefixes []*net.IPNet
+
+// parseRemotePrefixes parses a comma-separated list of CIDR prefixes and
+// addresses, or with a leading @, the file of that name with one per line.
+// An empty list allows all remote endpoints.
+func parseRemotePrefixes(list string) (remotePrefixes, error) {
+	var items []string
+	if path, ok := strings.CutPrefix(list, "@"); ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read remote prefixes: %w", err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				items = append(items, line)
+			}
+		}
+	} else {
+		items = strings.Split(list, ",")
+	}
+	var prefixes remotePrefixes
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, err := parseRemotePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if list != "" && len(prefixes) == 0 {
+		return nil, fmt.Errorf("no remote prefixes in %q", list)
+	}
+	return prefixes, nil
+}
+
+// parseRemotePrefix parses a CIDR prefix, or an address as the prefix of
+// that address alone.
+func parseRemotePrefix(item string) (*net.IPNet, error) {
+	if ip := net.ParseIP(item); ip != nil {
+		bits := 8 * len(ip)
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, prefix, err := net.ParseCIDR(item)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote prefix %q", item)
+	}
+	return prefix, nil
+}
+
+func (prefixes remotePrefixes) contains(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, prefix := range prefixes {
+		if prefix.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether a packet belongs to a flow with a remote endpoint
+// in the prefixes. Packets without a remote side, LAN and third-party ones,
+// are allowed when either endpoint is.
+func (prefixes remotePrefixes) allows(packet *Packet) bool {
+	switch packet.Direction {
+	case DirectionUpstream:
+		return prefixes.contains(packet.DstIP)
+	case DirectionDownstream:
+		return prefixes.contains(packet.SrcIP)
+	}
+	return prefixes.contains(packet.SrcIP) || prefixes.contains(packet.DstIP)
+}
+
+// bpfFilter returns the kernel filter of a capture read with libpcap: the
+// packets to or from the prefixes, and those observed before the prefixes
+// are checked, DNS responses from dnsPorts, ICMP errors and, with devices,
+// ARP and DHCP.
+func (prefixes remotePrefixes) bpfFilter(dnsPorts map[int]bool, devices bool) string {
+	nets := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		nets[i] = "net " + prefix.String()
+	}
+	filter := "(" + strings.Join(nets, " or ") + ") or " + dnsBPFFilter(dnsPorts) + " or icmp"
+	if devices {
+		filter += " or arp or udp port 67 or udp port 68"
+	}
+	return filter
+}
@@ -0,0 +1,399 @@
+package pktstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportChartWidth and reportChartHeight are the size in pixels of the
+// bitrate charts of a report.
+const (
+	reportChartWidth  = 720
+	reportChartHeight = 160
+)
+
+// report is the content of a directory report, see ReportMain.
+type report struct {
+	BasePath string
+	Source   string // outputs or the aggregate stats the services were summed from
+	Files    []reportFile
+	Services []reportService
+	Sessions []reportSession
+}
+
+type reportFile struct {
+	Number         int // referenced by the services carried in the file
+	Path           string
+	Link           string // relative to the report
+	Source         string
+	Start          string
+	Packets        int64
+	PacketCoverage float64
+	ByteCoverage   float64
+	KernelDrops    string
+	Warnings       []string // quality warnings of the capture
+}
+
+type reportService struct {
+	Name        string
+	Flows       int
+	Packets     int
+	Bytes       int64
+	Streaming   int64
+	Bulk        int64
+	Voice       int64
+	FileNumbers []int // files carrying the service
+}
+
+// reportSession is a media session of one output, with its bitrate over time.
+type reportSession struct {
+	Link      string
+	Path      string
+	SessionID int
+	Service   string
+	Client    string
+	Flows     int
+	Bytes     int64
+	Duration  string
+	PeakMbps  string
+	Points    string // of the polyline of the chart
+	binMbps   []float64
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Traffic report: {{.BasePath}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: right; }
+th:first-child, td:first-child, td.text { text-align: left; }
+tr.warn td { background: #fff3e0; }
+ul.warnings { margin: 0; padding-left: 1.2em; text-align: left; }
+svg { border: 1px solid #ccc; background: #fafafa; }
+polyline { fill: none; stroke: #1565c0; stroke-width: 1.5; }
+</style>
+</head>
+<body>
+<h1>Traffic report: {{.BasePath}}</h1>
+<p>Services summed from {{.Source}}.</p>
+
+<h2>Services</h2>
+<table>
+<tr><th>Service</th><th>Flows</th><th>Packets</th><th>Bytes</th><th>Streaming bytes</th><th>Bulk bytes</th><th>Voice bytes</th><th>Files</th></tr>
+{{- range .Services}}
+<tr><td>{{.Name}}</td><td>{{.Flows}}</td><td>{{.Packets}}</td><td>{{.Bytes}}</td><td>{{.Streaming}}</td><td>{{.Bulk}}</td><td>{{.Voice}}</td><td class="text">{{range $i, $n := .FileNumbers}}{{if $i}} {{end}}<a href="{{index $.FileLinks $n}}">{{$n}}</a>{{end}}</td></tr>
+{{- end}}
+</table>
+
+{{- if .Files}}
+<h2>Files</h2>
+<table>
+<tr><th>#</th><th>Output</th><th>Capture</th><th>Start</th><th>Packets</th><th>Packet coverage</th><th>Byte coverage</th><th>Kernel drops</th><th>Quality warnings</th></tr>
+{{- range .Files}}
+<tr{{if .Warnings}} class="warn"{{end}}><td>{{.Number}}</td><td class="text"><a href="{{.Link}}">{{.Path}}</a></td><td class="text">{{.Source}}</td><td class="text">{{.Start}}</td><td>{{.Packets}}</td><td>{{printf "%.1f%%" .PacketCoverage}}</td><td>{{printf "%.1f%%" .ByteCoverage}}</td><td>{{.KernelDrops}}</td><td>{{if .Warnings}}<ul class="warnings">{{range .Warnings}}<li>{{.}}</li>{{end}}</ul>{{end}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+
+{{- if .Sessions}}
+<h2>Top media sessions</h2>
+{{- range .Sessions}}
+<h3>{{.Service}}, {{.Client}}: session {{.SessionID}}</h3>
+<p><a href="{{.Link}}">{{.Path}}</a>: {{.Flows}} flows, {{.Bytes}} bytes over {{.Duration}}, peak {{.PeakMbps}} Mbps</p>
+<svg width="` + strconv.Itoa(reportChartWidth) + `" height="` + strconv.Itoa(reportChartHeight) + `" role="img" aria-label="bitrate of session {{.SessionID}}"><polyline points="{{.Points}}"/></svg>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
+
+// ReportMain implements the report subcommand, writing a self-contained HTML
+// summary of the outputs under a path: the traffic per service, the coverage
+// and quality warnings of each file and the bitrate of the top media
+// sessions. The report only depends on the outputs, so it is the same for
+// the same outputs.
+func ReportMain(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	basePath := fs.String("p", "../data/", "Base path to the outputs, or to the aggregate_stats.json of a run if it holds none")
+	outPath := fs.String("o", "", "Path of the HTML report (default: report.html in -p)")
+	top := fs.Int("top", 5, "Number of media sessions with the most bytes to chart, 0 for none")
+	bin := fs.Duration("bin", time.Second, "Bin width of the bitrate charts")
+	fs.Parse(args)
+	if *outPath == "" {
+		*outPath = filepath.Join(*basePath, "report.html")
+	}
+	if *bin <= 0 || *top < 0 {
+		fmt.Println("-bin must be positive and -top cannot be negative")
+		os.Exit(1)
+	}
+
+	content := &report{BasePath: *basePath}
+	services := make(map[string]*ServiceStats)
+	serviceFiles := make(map[string][]int)
+	var sessions []reportSession
+	err := findOutputs(*basePath, func(path string, meta *Meta) {
+		file := reportFile{
+			Number:         len(content.Files) + 1,
+			Path:           path,
+			Link:           reportLink(*outPath, path),
+			Source:         meta.Source,
+			Start:          captureTime(meta.CaptureStart, meta, false),
+			Packets:        meta.TotalPackets,
+			PacketCoverage: percentage(meta.AccountedPackets, meta.TotalPackets),
+			ByteCoverage:   percentage(meta.AccountedBytes, meta.TotalBytes),
+			KernelDrops:    "n/a",
+			Warnings:       meta.QualityWarnings,
+		}
+		if meta.KernelDrops != nil {
+			file.KernelDrops = strconv.FormatInt(*meta.KernelDrops, 10)
+		}
+		content.Files = append(content.Files, file)
+		// the parts of a split output share the meta block of the capture
+		if meta.Part <= 1 {
+			mergeServiceStats(services, meta.Services)
+			for service := range meta.Services {
+				serviceFiles[service] = append(serviceFiles[service], file.Number)
+			}
+		}
+		if *top > 0 {
+			sessions = append(sessions, reportSessions(path, file.Link, *bin, *top)...)
+		}
+	})
+	if err != nil {
+		fmt.Println("Error walking the path:", err)
+		os.Exit(1)
+	}
+	content.Source = fmt.Sprintf("%d outputs", len(content.Files))
+	if len(content.Files) == 0 {
+		aggregatePath := filepath.Join(*basePath, "aggregate_stats.json")
+		data, err := os.ReadFile(aggregatePath)
+		var aggregate AggregateStats
+		if err == nil {
+			err = json.Unmarshal(data, &aggregate)
+		}
+		if err != nil {
+			fmt.Printf("No outputs under %s, and no aggregate stats: %v\n", *basePath, err)
+			os.Exit(1)
+		}
+		services = aggregate.Services
+		content.Source = fmt.Sprintf("%s (%d files)", aggregatePath, aggregate.Files)
+	}
+
+	fileLinks := make(map[int]string)
+	for _, file := range content.Files {
+		fileLinks[file.Number] = file.Link
+	}
+	for _, name := range sortedKeys(services) {
+		stats := services[name]
+		content.Services = append(content.Services, reportService{
+			Name:        name,
+			Flows:       stats.Flows,
+			Packets:     stats.Packets,
+			Bytes:       stats.Bytes,
+			Streaming:   stats.StreamingBytes,
+			Bulk:        stats.BulkBytes,
+			Voice:       stats.VoiceBytes,
+			FileNumbers: serviceFiles[name],
+		})
+	}
+	sort.SliceStable(content.Services, func(i, j int) bool { return content.Services[i].Bytes > content.Services[j].Bytes })
+
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].Bytes > sessions[j].Bytes })
+	content.Sessions = sessions[:min(len(sessions), *top)]
+	for i := range content.Sessions {
+		content.Sessions[i].chart()
+	}
+
+	var page bytes.Buffer
+	if err := reportTemplate.Execute(&page, struct {
+		*report
+		FileLinks map[int]string
+	}{content, fileLinks}); err != nil {
+		fmt.Println("unable to render report:", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*outPath, page.Bytes(), 0644); err != nil {
+		fmt.Println("unable to write report:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("========== Writing report to: %s ==========\n", *outPath)
+}
+
+// reportLink returns the link from the report to an output file.
+func reportLink(reportPath, path string) string {
+	reportDir, errReport := filepath.Abs(filepath.Dir(reportPath))
+	target, errTarget := filepath.Abs(path)
+	if errReport == nil && errTarget == nil {
+		if rel, err := filepath.Rel(reportDir, target); err == nil {
+			path = rel
+		}
+	}
+	return filepath.ToSlash(path)
+}
+
+// sessionFlows are the flows of a media session of an output.
+type sessionFlows struct {
+	flows []*Flow
+	bytes int64
+}
+
+// reportSessions returns the media sessions of an output, see linkSessions,
+// with their bitrate in bins of width. With the flow index of the output,
+// only the flows of its top sessions by bytes are read, the only ones of the
+// output that may be charted; otherwise all of its flows are loaded.
+func reportSessions(path, link string, width time.Duration, top int) []reportSession {
+	byID, opts, err := indexedSessionFlows(path, top)
+	if err != nil {
+		if byID, opts, err = loadedSessionFlows(path); err != nil {
+			// index outputs and legacy outputs have no sessions to chart
+			return nil
+		}
+	}
+	binMicros := width.Microseconds()
+	ids := make([]int, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var sessions []reportSession
+	for _, id := range ids {
+		flows := byID[id].flows
+		sort.Slice(flows, func(i, j int) bool { return flows[i].Packets[0].Timestamp < flows[j].Packets[0].Timestamp })
+		start, end := opts.microseconds(flows[0].Packets[0].Timestamp), int64(0)
+		var binBytes []int64
+		for _, flow := range flows {
+			for _, packet := range flow.Packets {
+				timestamp := opts.microseconds(packet.Timestamp)
+				end = max(end, timestamp)
+				i := int((timestamp - start) / binMicros)
+				for len(binBytes) <= i {
+					binBytes = append(binBytes, 0)
+				}
+				binBytes[i] += int64(packet.PktLength)
+			}
+		}
+		session := reportSession{
+			Link:      link,
+			Path:      path,
+			SessionID: id,
+			Service:   flows[0].RegisteredDomain,
+			Client:    flows[0].LocalIP,
+			Flows:     len(flows),
+			Bytes:     byID[id].bytes,
+			Duration:  (time.Duration(end-start) * time.Microsecond).Round(time.Second).String(),
+		}
+		if flows[0].Subscriber != "" {
+			session.Client = flows[0].Subscriber
+		}
+		for _, bytes := range binBytes {
+			session.binMbps = append(session.binMbps, float64(bytes)*8/width.Seconds()/1e6)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// loadedSessionFlows loads the flows of an output by media session.
+func loadedSessionFlows(path string) (map[int]*sessionFlows, Options, error) {
+	output, err := LoadFlows(path)
+	if err == nil && output.Meta == nil {
+		err = errNoMeta
+	}
+	if err != nil {
+		return nil, Options{}, err
+	}
+	byID := make(map[int]*sessionFlows)
+	for _, flow := range output.Flows {
+		if flow.SessionID == 0 || len(flow.Packets) == 0 {
+			continue
+		}
+		session, ok := byID[flow.SessionID]
+		if !ok {
+			session = &sessionFlows{}
+			byID[flow.SessionID] = session
+		}
+		_, bytes := flow.totals()
+		session.flows = append(session.flows, flow)
+		session.bytes += bytes
+	}
+	return byID, output.Meta.Options, nil
+}
+
+// indexedSessionFlows reads the flows of the top media sessions of an output
+// by bytes, from the records located by its flow index.
+func indexedSessionFlows(path string, top int) (map[int]*sessionFlows, Options, error) {
+	index, err := readOutputIndex(path)
+	if err != nil {
+		return nil, Options{}, err
+	}
+	meta, err := readMeta(path)
+	if err != nil {
+		return nil, Options{}, err
+	}
+	byID := make(map[int]*sessionFlows)
+	keys := make(map[int][]string)
+	for _, key := range sortedKeys(index.Flows) {
+		record := index.Flows[key]
+		if record.Group != "" || record.SessionID == 0 || record.Packets == 0 {
+			continue
+		}
+		session, ok := byID[record.SessionID]
+		if !ok {
+			session = &sessionFlows{}
+			byID[record.SessionID] = session
+		}
+		session.bytes += record.Bytes
+		keys[record.SessionID] = append(keys[record.SessionID], key)
+	}
+	ids := make([]int, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	// ties keep the lower ID, as in the order of the report
+	sort.Ints(ids)
+	sort.SliceStable(ids, func(i, j int) bool { return byID[ids[i]].bytes > byID[ids[j]].bytes })
+	for _, id := range ids[min(len(ids), top):] {
+		delete(byID, id)
+	}
+	for id, session := range byID {
+		for _, key := range keys[id] {
+			flow, err := index.readFlow(path, key, meta)
+			if err != nil {
+				return nil, Options{}, err
+			}
+			session.flows = append(session.flows, flow)
+		}
+	}
+	return byID, meta.Options, nil
+}
+
+// chart sets the polyline of the bitrate of a session, scaled to its peak.
+func (session *reportSession) chart() {
+	peak := 0.0
+	for _, mbps := range session.binMbps {
+		peak = max(peak, mbps)
+	}
+	session.PeakMbps = strconv.FormatFloat(peak, 'f', 1, 64)
+	points := make([]string, len(session.binMbps))
+	step := float64(reportChartWidth) / float64(max(len(session.binMbps)-1, 1))
+	for i, mbps := range session.binMbps {
+		y := float64(reportChartHeight)
+		if peak > 0 {
+			y -= mbps / peak * (reportChartHeight - 10)
+		}
+		points[i] = strconv.FormatFloat(float64(i)*step, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+	}
+	session.Points = strings.Join(points, " ")
+}
@@ -0,0 +1,69 @@
+package pktstats
+
+import (
+	"sort"
+
+	"github.com/google/gopacket/layers"
+)
+
+// maximum number of resolved but unused addresses listed per file
+const maxResolvedButUnused = 100
+
+// UnusedResolution is an address answered in a DNS response of a file that
+// no flow was seen with, e.g. an edge PoP probed but not picked.
+type UnusedResolution struct {
+	Name          string `json:"name"`
+	IP            string `json:"ip"`
+	FirstResolved int64  `json:"firstResolved"` // timestamp of the first answer for IP
+}
+
+// resolutionLog records the first answer for each IPv4 address in the DNS
+// responses of a file and the remote addresses of its flows. AAAA answers are
+// left out, as IPv6 flows are not extracted.
+type resolutionLog struct {
+	first map[string]UnusedResolution
+	used  map[string]bool
+}
+
+func newResolutionLog() *resolutionLog {
+	return &resolutionLog{first: make(map[string]UnusedResolution), used: make(map[string]bool)}
+}
+
+func (log *resolutionLog) observe(dns *layers.DNS, timestamp int64) {
+	if !dns.QR {
+		return
+	}
+	for _, answer := range dns.Answers {
+		if answer.Type != layers.DNSTypeA {
+			continue
+		}
+		ip := answer.IP.String()
+		name, valid := normalizeDNSName(string(answer.Name))
+		if _, ok := log.first[ip]; !ok && valid {
+			log.first[ip] = UnusedResolution{Name: name, IP: ip, FirstResolved: timestamp}
+		}
+	}
+}
+
+// use records the remote address of a flow that survived filtering.
+func (log *resolutionLog) use(ip string) {
+	log.used[ip] = true
+}
+
+// unused returns the first maxResolvedButUnused addresses answered but never
+// used by a flow, in order of their first answer, and the count of all of them.
+func (log *resolutionLog) unused() ([]UnusedResolution, int) {
+	var unused []UnusedResolution
+	for ip, resolution := range log.first {
+		if !log.used[ip] {
+			unused = append(unused, resolution)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		if unused[i].FirstResolved != unused[j].FirstResolved {
+			return unused[i].FirstResolved < unused[j].FirstResolved
+		}
+		return unused[i].IP < unused[j].IP
+	})
+	return unused[:min(len(unused), maxResolvedButUnused)], len(unused)
+}
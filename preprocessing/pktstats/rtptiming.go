@@ -0,0 +1,278 @@
+package pktstats
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staticClockRates are the clock rates of the static RTP payload types, RFC 3551.
+var staticClockRates = map[int]float64{
+	0: 8000, 3: 8000, 4: 8000, 5: 8000, 6: 16000, 7: 8000, 8: 8000, 9: 8000, 10: 44100, 11: 44100,
+	12: 8000, 13: 8000, 14: 90000, 15: 8000, 16: 11025, 17: 22050, 18: 8000,
+	25: 90000, 26: 90000, 28: 90000, 31: 90000, 32: 90000, 33: 90000, 34: 90000,
+}
+
+// commonClockRates are the clock rates a fitted one is mapped to.
+var commonClockRates = []float64{8000, 16000, 22050, 24000, 32000, 44100, 48000, 90000}
+
+// sources of RTPTiming.ClockSource
+const (
+	clockConfigured = "configured" // Options.RTPClockRates
+	clockStatic     = "static"     // static payload type, see staticClockRates
+	clockFit        = "fit"        // slope of the fit, mapped to a common clock rate if near one
+)
+
+const (
+	// rtpTimingMinFrames is the number of RTP timestamps an SSRC needs for a fit
+	rtpTimingMinFrames = 50
+	// rtpTimingMaxFrames bounds the RTP timestamps kept per SSRC, later ones are left out
+	rtpTimingMaxFrames = 1 << 17
+	// rtpTimingMaxSSRCs bounds the SSRCs tracked per flow
+	rtpTimingMaxSSRCs = 16
+	// rtpClockTolerance is the largest relative difference between a fitted
+	// clock rate and a common one for it to be taken as that one
+	rtpClockTolerance = 0.05
+	// rtpTrendWindow is the window residual trends are fitted over
+	rtpTrendWindow = time.Second
+	// rtpTrendMinRise is the rise of the residuals over a window from which
+	// the window is building a queue
+	rtpTrendMinRise = 5 * time.Millisecond
+)
+
+// RTPTiming compares the RTP timestamps of an SSRC, its media clock, with the
+// arrival of its packets: the residuals of the linear fit of arrival time
+// against RTP timestamp are the variation of the one-way delay, apart from
+// the sender's pacing.
+type RTPTiming struct {
+	SSRC        uint32  `json:"ssrc"`
+	PayloadType int     `json:"payloadType"` // of the first packet
+	Upstream    bool    `json:"upstream,omitempty"`
+	Frames      int     `json:"frames"`      // distinct RTP timestamps fitted, by their first packet
+	ClockHz     float64 `json:"clockHz"`     // clock rate of the payload type
+	ClockSource string  `json:"clockSource"` // how ClockHz was found: configured, static or fit
+	FitClockHz  float64 `json:"fitClockHz"`  // clock rate implied by the slope of the fit, relative to the capture clock
+	// residuals above the smallest one, the delay added to the fastest packet
+	P50Micros    int64          `json:"p50Micros"`
+	P95Micros    int64          `json:"p95Micros"`
+	P99Micros    int64          `json:"p99Micros"`
+	QueueBuildup []QueueBuildup `json:"queueBuildup,omitempty"`
+}
+
+// QueueBuildup is a period over which the residuals of an SSRC trend upward,
+// a queue building up on the path.
+type QueueBuildup struct {
+	Start      int64 `json:"start"`
+	End        int64 `json:"end"`
+	RiseMicros int64 `json:"riseMicros"` // rise of the fitted residuals over the period
+}
+
+// rtpTimingState keeps, for each SSRC of an RTP flow, the arrival of the
+// first packet of each RTP timestamp.
+type rtpTimingState struct {
+	ssrcs map[uint32]*rtpClock
+	order []uint32 // SSRCs in order of appearance
+}
+
+type rtpClock struct {
+	payloadType int
+	upstream    bool
+	last        uint32 // last RTP timestamp
+	unwrapped   int64  // last RTP timestamp, unwrapped
+	samples     []rtpSample
+}
+
+type rtpSample struct {
+	arrival   int64
+	timestamp int64 // unwrapped RTP timestamp
+}
+
+func (state *rtpTimingState) observe(packet *Packet, payload []byte) {
+	if !isRTP(payload) {
+		return
+	}
+	ssrc := binary.BigEndian.Uint32(payload[8:12])
+	timestamp := binary.BigEndian.Uint32(payload[4:8])
+	clock, ok := state.ssrcs[ssrc]
+	if !ok {
+		if len(state.order) >= rtpTimingMaxSSRCs {
+			return
+		}
+		if state.ssrcs == nil {
+			state.ssrcs = make(map[uint32]*rtpClock)
+		}
+		clock = &rtpClock{payloadType: int(payload[1] & 0x7f), upstream: packet.Upstream, last: timestamp, unwrapped: int64(timestamp)}
+		clock.samples = append(clock.samples, rtpSample{packet.Timestamp, clock.unwrapped})
+		state.ssrcs[ssrc] = clock
+		state.order = append(state.order, ssrc)
+		return
+	}
+	// serial number arithmetic: later packets of a frame and reordered packets are left out
+	delta := timestamp - clock.last
+	if delta == 0 || delta >= 0x80000000 || len(clock.samples) >= rtpTimingMaxFrames {
+		return
+	}
+	clock.last = timestamp
+	clock.unwrapped += int64(delta)
+	clock.samples = append(clock.samples, rtpSample{packet.Timestamp, clock.unwrapped})
+}
+
+// parseClockRates parses clock rates of RTP payload types such as
+// "96=90000,111=48000".
+func parseClockRates(rates string) (map[int]float64, error) {
+	parsed := make(map[int]float64)
+	for _, rate := range strings.Split(rates, ",") {
+		if strings.TrimSpace(rate) == "" {
+			continue
+		}
+		payloadType, hz, ok := strings.Cut(rate, "=")
+		pt, err := strconv.Atoi(strings.TrimSpace(payloadType))
+		if !ok || err != nil || pt < 0 || pt > 127 {
+			return nil, fmt.Errorf("invalid RTP clock rate %q: expected <payload type>=<Hz> with a payload type from 0 to 127", rate)
+		}
+		clockHz, err := strconv.ParseFloat(strings.TrimSpace(hz), 64)
+		if err != nil || clockHz <= 0 {
+			return nil, fmt.Errorf("invalid RTP clock rate %q: the rate must be a positive number of Hz", rate)
+		}
+		parsed[pt] = clockHz
+	}
+	return parsed, nil
+}
+
+// measureRTPTiming stores the timing of the SSRCs of an RTP flow with at
+// least rtpTimingMinFrames RTP timestamps, in order of appearance.
+// @param clockRates: clock rates of payload types, from Options.RTPClockRates
+func (flow *Flow) measureRTPTiming(clockRates map[int]float64, opts Options) {
+	state := flow.rtpTiming
+	flow.rtpTiming = rtpTimingState{}
+	for _, ssrc := range state.order {
+		clock := state.ssrcs[ssrc]
+		if len(clock.samples) < rtpTimingMinFrames {
+			continue
+		}
+		if timing := clock.timing(clockRates, opts); timing != nil {
+			timing.SSRC = ssrc
+			flow.RTPTiming = append(flow.RTPTiming, *timing)
+		}
+	}
+}
+
+// timing fits the arrival times of an SSRC, in microseconds, against its RTP
+// timestamps by least squares. The fitted line absorbs the skew between the
+// sender's clock and the capture clock.
+// @return nil if the RTP timestamps do not advance
+func (clock *rtpClock) timing(clockRates map[int]float64, opts Options) *RTPTiming {
+	samples := clock.samples
+	n := float64(len(samples))
+	first := samples[0]
+	var sumX, sumY float64
+	for _, sample := range samples {
+		sumX += float64(sample.timestamp - first.timestamp)
+		sumY += float64(opts.microseconds(sample.arrival - first.arrival))
+	}
+	meanX, meanY := sumX/n, sumY/n
+	var covariance, variance float64
+	for _, sample := range samples {
+		dx := float64(sample.timestamp-first.timestamp) - meanX
+		covariance += dx * (float64(opts.microseconds(sample.arrival-first.arrival)) - meanY)
+		variance += dx * dx
+	}
+	if variance == 0 || covariance <= 0 {
+		return nil
+	}
+	slope := covariance / variance // microseconds per tick
+	residuals := make([]float64, len(samples))
+	minimum := math.Inf(1)
+	for i, sample := range samples {
+		x := float64(sample.timestamp-first.timestamp) - meanX
+		residuals[i] = float64(opts.microseconds(sample.arrival-first.arrival)) - meanY - slope*x
+		minimum = min(minimum, residuals[i])
+	}
+	for i := range residuals {
+		residuals[i] -= minimum
+	}
+
+	timing := &RTPTiming{PayloadType: clock.payloadType, Upstream: clock.upstream, Frames: len(samples), FitClockHz: math.Round(1e6/slope*10) / 10}
+	switch hz, configured := clockRates[clock.payloadType]; {
+	case configured:
+		timing.ClockHz, timing.ClockSource = hz, clockConfigured
+	case staticClockRates[clock.payloadType] > 0:
+		timing.ClockHz, timing.ClockSource = staticClockRates[clock.payloadType], clockStatic
+	default:
+		timing.ClockHz, timing.ClockSource = math.Round(1e6/slope), clockFit
+		nearest := commonClockRates[0]
+		for _, rate := range commonClockRates[1:] {
+			if math.Abs(math.Log(1e6/slope/rate)) < math.Abs(math.Log(1e6/slope/nearest)) {
+				nearest = rate
+			}
+		}
+		if math.Abs(1e6/slope-nearest) <= rtpClockTolerance*nearest {
+			timing.ClockHz = nearest
+		}
+	}
+	sorted := append([]float64(nil), residuals...)
+	sort.Float64s(sorted)
+	percentile := func(p float64) int64 {
+		return int64(math.Round(sorted[int(p*float64(len(sorted)-1))]))
+	}
+	timing.P50Micros, timing.P95Micros, timing.P99Micros = percentile(0.5), percentile(0.95), percentile(0.99)
+	timing.QueueBuildup = queueBuildups(samples, residuals, opts)
+	return timing
+}
+
+// queueBuildups fits the residuals of consecutive windows of rtpTrendWindow
+// against arrival time and merges the consecutive windows whose residuals
+// rise by at least rtpTrendMinRise into periods of queue buildup.
+func queueBuildups(samples []rtpSample, residuals []float64, opts Options) []QueueBuildup {
+	window := opts.duration(rtpTrendWindow)
+	minRise := float64(rtpTrendMinRise.Microseconds())
+	var buildups []QueueBuildup
+	rising := false
+	for start := 0; start < len(samples); {
+		end := start
+		for end < len(samples) && samples[end].arrival < samples[start].arrival+window {
+			end++
+		}
+		rise := residualRise(samples[start:end], residuals[start:end], opts)
+		if rise >= minRise {
+			if !rising {
+				buildups = append(buildups, QueueBuildup{Start: samples[start].arrival})
+			}
+			buildup := &buildups[len(buildups)-1]
+			buildup.End = samples[end-1].arrival
+			buildup.RiseMicros += int64(math.Round(rise))
+		}
+		rising = rise >= minRise
+		start = end
+	}
+	return buildups
+}
+
+// residualRise returns the rise of the residuals of a window over its
+// duration, by the slope of their least squares fit against arrival time.
+func residualRise(samples []rtpSample, residuals []float64, opts Options) float64 {
+	if len(samples) < 3 {
+		return 0
+	}
+	first := samples[0].arrival
+	n := float64(len(samples))
+	var sumX, sumY float64
+	for i, sample := range samples {
+		sumX += float64(opts.microseconds(sample.arrival - first))
+		sumY += residuals[i]
+	}
+	var covariance, variance float64
+	for i, sample := range samples {
+		dx := float64(opts.microseconds(sample.arrival-first)) - sumX/n
+		covariance += dx * (residuals[i] - sumY/n)
+		variance += dx * dx
+	}
+	if variance == 0 {
+		return 0
+	}
+	return covariance / variance * float64(opts.microseconds(samples[len(samples)-1].arrival-first))
+}
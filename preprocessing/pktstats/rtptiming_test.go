@@ -0,0 +1,116 @@
+package pktstats
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// rtpStream is a synthetic RTP stream of one SSRC: frames sent every
+// interval microseconds, advancing the RTP timestamp by ticks, each arriving
+// delay(frame) microseconds late.
+type rtpStream struct {
+	ssrc        uint32
+	payloadType byte
+	frames      int
+	ticks       uint32
+	interval    int64
+	start       uint32 // first RTP timestamp
+	packets     int    // per frame, 1 if 0
+	delay       func(frame int) int64
+}
+
+// observe feeds the packets of the stream to a flow.
+func (stream rtpStream) observe(flow *Flow) {
+	for frame := 0; frame < stream.frames; frame++ {
+		arrival := 1_000_000 + int64(frame)*stream.interval
+		if stream.delay != nil {
+			arrival += stream.delay(frame)
+		}
+		for i := 0; i < max(stream.packets, 1); i++ {
+			payload := make([]byte, 100)
+			payload[0], payload[1] = 0x80, stream.payloadType
+			binary.BigEndian.PutUint32(payload[4:8], stream.start+uint32(frame)*stream.ticks)
+			binary.BigEndian.PutUint32(payload[8:12], stream.ssrc)
+			flow.rtpTiming.observe(&Packet{Timestamp: arrival + int64(i)*100}, payload)
+		}
+	}
+}
+
+func TestMeasureRTPTiming(t *testing.T) {
+	// 25 fps video at 90 kHz
+	video := rtpStream{ssrc: 1, payloadType: 96, frames: 200, ticks: 3600, interval: 40_000}
+	jittered, bursty, wrapping, fewer := video, video, video, video
+	jittered.delay = func(frame int) int64 { return int64(frame%2) * 2000 }
+	// a queue builds over the fifth second, by 1 ms a frame, then drains
+	bursty.delay = func(frame int) int64 {
+		if frame >= 100 && frame < 125 {
+			return int64(frame-100) * 1000
+		}
+		return 0
+	}
+	wrapping.start, wrapping.packets = 0xffffffff-100*3600, 3
+	fewer.frames = rtpTimingMinFrames - 1
+	type want struct {
+		frames        int
+		clockHz       float64
+		source        string
+		fitClockHz    float64
+		p50, p95      int64
+		buildupFrames [][2]int // first and last frames of each queue buildup
+	}
+	tests := []struct {
+		name       string
+		streams    []rtpStream
+		clockRates map[int]float64
+		want       []want
+	}{
+		{"steady video", []rtpStream{video}, nil, []want{{200, 90000, clockFit, 90000, 0, 0, nil}}},
+		{"configured", []rtpStream{video}, map[int]float64{96: 48000}, []want{{200, 48000, clockConfigured, 90000, 0, 0, nil}}},
+		{"static", []rtpStream{{ssrc: 2, payloadType: 0, frames: 100, ticks: 160, interval: 20_000}}, nil, []want{{100, 8000, clockStatic, 8000, 0, 0, nil}}},
+		{"uncommon rate", []rtpStream{{ssrc: 3, payloadType: 97, frames: 100, ticks: 4000, interval: 40_000}}, nil, []want{{100, 100000, clockFit, 100000, 0, 0, nil}}},
+		{"jitter", []rtpStream{jittered}, nil, []want{{200, 90000, clockFit, 90000, 0, 2000, nil}}},
+		{"queue buildup", []rtpStream{bursty}, nil, []want{{200, 90000, clockFit, 0, 0, 0, [][2]int{{100, 124}}}}},
+		{"wrapping timestamps, packets of a frame", []rtpStream{wrapping}, nil, []want{{200, 90000, clockFit, 90000, 0, 0, nil}}},
+		{"too few frames", []rtpStream{fewer}, nil, nil},
+		{"two SSRCs", []rtpStream{{ssrc: 2, payloadType: 0, frames: 100, ticks: 160, interval: 20_000}, video}, nil,
+			[]want{{100, 8000, clockStatic, 8000, 0, 0, nil}, {200, 90000, clockFit, 90000, 0, 0, nil}}},
+	}
+	// the jitter skews the slope of the fit a little
+	near := func(got, want int64) bool { return got-want <= 50 && want-got <= 50 }
+	for _, test := range tests {
+		flow := &Flow{}
+		for _, stream := range test.streams {
+			stream.observe(flow)
+		}
+		flow.measureRTPTiming(test.clockRates, DefaultOptions())
+		if len(flow.RTPTiming) != len(test.want) {
+			t.Errorf("%s: timing of %d SSRCs, want %d", test.name, len(flow.RTPTiming), len(test.want))
+			continue
+		}
+		for i, want := range test.want {
+			got := flow.RTPTiming[i]
+			stream := test.streams[i]
+			if got.SSRC != stream.ssrc || got.Frames != want.frames || got.ClockHz != want.clockHz || got.ClockSource != want.source {
+				t.Errorf("%s: SSRC %d with %d frames at %v Hz from %s, want %d with %d at %v from %s", test.name,
+					got.SSRC, got.Frames, got.ClockHz, got.ClockSource, stream.ssrc, want.frames, want.clockHz, want.source)
+			}
+			// the fit of the queue buildup is skewed by it
+			if want.fitClockHz > 0 && (math.Abs(got.FitClockHz-want.fitClockHz) > 1 || !near(got.P50Micros, want.p50) || !near(got.P95Micros, want.p95)) {
+				t.Errorf("%s: fit at %v Hz with residuals p50 %d p95 %d µs, want %v Hz, %d and %d", test.name,
+					got.FitClockHz, got.P50Micros, got.P95Micros, want.fitClockHz, want.p50, want.p95)
+			}
+			if len(got.QueueBuildup) != len(want.buildupFrames) {
+				t.Errorf("%s: queue buildups %+v, want %d", test.name, got.QueueBuildup, len(want.buildupFrames))
+				continue
+			}
+			for j, frames := range want.buildupFrames {
+				buildup := got.QueueBuildup[j]
+				arrival := func(frame int) int64 { return 1_000_000 + int64(frame)*stream.interval + stream.delay(frame) }
+				if start, end := arrival(frames[0]), arrival(frames[1]); buildup.Start != start || buildup.End != end || buildup.RiseMicros < rtpTrendMinRise.Microseconds() {
+					t.Errorf("%s: queue buildup %+v, want from %d to %d", test.name, buildup, start, end)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ruleConfidence is the LabelConfidence of flows without a DNS name labeled
+// by a rule, a port heuristic.
+const ruleConfidence = 0.5
+
+// keepPortsRule is the name of the default rule built from Options.KeepPorts.
+const keepPortsRule = "keep-ports"
+
+// ClassifierRule is a rule of the rules file, Options.Rules: the flows it
+// matches are kept without a DNS name (Keep) and labeled (Label). All its
+// conditions must hold, empty ones hold for any flow. Protocol and ports are
+// known from the first packet, so only they decide whether packets without
+// a DNS name are kept as they are read; the DNS patterns, direction and
+// transport profile are only known once the flow is complete, and decide
+// which rule matched it, for its label and the rule's match count.
+type ClassifierRule struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"` // higher first, rules of equal priority in file order
+	// shell patterns of the DNSName, e.g. "*.xboxlive.com", any of which matches
+	DNS              []string `json:"dns,omitempty"`
+	Protocol         string   `json:"protocol,omitempty"`    // tcp or udp
+	LocalPorts       string   `json:"localPorts,omitempty"`  // ports and port ranges, e.g. "49000-49100"
+	RemotePorts      string   `json:"remotePorts,omitempty"` // ports and port ranges, e.g. "3478-3481"
+	Direction        string   `json:"direction,omitempty"`   // of the first packet of the flow: upstream or downstream
+	TransportProfile string   `json:"transportProfile,omitempty"`
+	Keep             bool     `json:"keep,omitempty"`  // keep the flows it matches without a DNS name
+	Label            string   `json:"label,omitempty"` // ServiceFlowType of the flows it matches, unless they have a role
+}
+
+// classifierRules are the rules of a run in priority order, with the
+// number of flows each matched.
+type classifierRules struct {
+	rules   []compiledRule
+	matches map[string]int
+}
+
+type compiledRule struct {
+	ClassifierRule
+	protocol    int
+	localPorts  portRanges
+	remotePorts portRanges
+}
+
+var transportProfiles = []string{profileTCPTLS, profileTCPPlain, profileQUIC, profileRTP, profileDTLSSRTP, profileUDPUnknown}
+
+// readRulesFile reads a rules file, a json array of rules.
+func readRulesFile(path string) ([]ClassifierRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []ClassifierRule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// compileRule checks a rule and parses its conditions.
+func compileRule(rule ClassifierRule) (compiledRule, error) {
+	compiled := compiledRule{ClassifierRule: rule}
+	if rule.Name == "" {
+		return compiled, fmt.Errorf("rule without a name")
+	}
+	if !rule.Keep && rule.Label == "" {
+		return compiled, fmt.Errorf("rule %s neither keeps nor labels flows", rule.Name)
+	}
+	switch strings.ToLower(rule.Protocol) {
+	case "":
+	case "tcp":
+		compiled.protocol = 6
+	case "udp":
+		compiled.protocol = 17
+	default:
+		return compiled, fmt.Errorf("rule %s: unknown protocol %q, expected tcp or udp", rule.Name, rule.Protocol)
+	}
+	var err error
+	if compiled.localPorts, err = parsePortRanges(rule.LocalPorts); err != nil {
+		return compiled, fmt.Errorf("rule %s: local ports: %w", rule.Name, err)
+	}
+	if compiled.remotePorts, err = parsePortRanges(rule.RemotePorts); err != nil {
+		return compiled, fmt.Errorf("rule %s: remote ports: %w", rule.Name, err)
+	}
+	if rule.Direction != "" && rule.Direction != string(DirectionUpstream) && rule.Direction != string(DirectionDownstream) {
+		return compiled, fmt.Errorf("rule %s: unknown direction %q, expected upstream or downstream", rule.Name, rule.Direction)
+	}
+	if rule.TransportProfile != "" && !containsString(transportProfiles, rule.TransportProfile) {
+		return compiled, fmt.Errorf("rule %s: unknown transport profile %q, expected one of %s", rule.Name, rule.TransportProfile, strings.Join(transportProfiles, ", "))
+	}
+	for _, pattern := range rule.DNS {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return compiled, fmt.Errorf("rule %s: invalid DNS pattern %q", rule.Name, pattern)
+		}
+	}
+	return compiled, nil
+}
+
+// newClassifierRules compiles the rules of the rules file at path, if any,
+// and the default rule keeping the flows with a local port of keepPorts,
+// which ranks below file rules of the same priority.
+func newClassifierRules(path, keepPorts string) (*classifierRules, error) {
+	var rules []ClassifierRule
+	if path != "" {
+		var err error
+		if rules, err = readRulesFile(path); err != nil {
+			return nil, fmt.Errorf("invalid rules file: %w", err)
+		}
+	}
+	if strings.TrimSpace(keepPorts) != "" {
+		rules = append(rules, ClassifierRule{Name: keepPortsRule, LocalPorts: keepPorts, Keep: true})
+	}
+	compiled := &classifierRules{matches: make(map[string]int)}
+	for _, rule := range rules {
+		if _, ok := compiled.matches[rule.Name]; ok {
+			return nil, fmt.Errorf("invalid rules file: rule %s is defined twice", rule.Name)
+		}
+		c, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rules file: %w", err)
+		}
+		compiled.rules = append(compiled.rules, c)
+		compiled.matches[rule.Name] = 0
+	}
+	sort.SliceStable(compiled.rules, func(i, j int) bool { return compiled.rules[i].Priority > compiled.rules[j].Priority })
+	return compiled, nil
+}
+
+// matchesPacket reports whether the protocol and port conditions of a rule
+// hold for a packet with a local endpoint.
+func (rule *compiledRule) matchesPacket(packet *Packet) bool {
+	localPort, remotePort := packet.SrcPort, packet.DstPort
+	if !packet.Upstream {
+		localPort, remotePort = remotePort, localPort
+	}
+	return (rule.protocol == 0 || rule.protocol == packet.Protocol) &&
+		(len(rule.localPorts) == 0 || rule.localPorts.contains(localPort)) &&
+		(len(rule.remotePorts) == 0 || rule.remotePorts.contains(remotePort))
+}
+
+// keeper returns the name of the first rule with Keep whose protocol and
+// port conditions hold for a packet without a DNS name, empty if none keeps
+// it.
+func (rules *classifierRules) keeper(packet *Packet) string {
+	for i := range rules.rules {
+		if rule := &rules.rules[i]; rule.Keep && rule.matchesPacket(packet) {
+			return rule.Name
+		}
+	}
+	return ""
+}
+
+// matches reports whether all conditions of a rule hold for a complete flow.
+func (rule *compiledRule) matches(flow *Flow) bool {
+	first := &flow.Packets[0]
+	if !rule.matchesPacket(first) {
+		return false
+	}
+	if rule.Direction != "" && string(first.Direction) != rule.Direction {
+		return false
+	}
+	if rule.TransportProfile != "" && flow.TransportProfile != rule.TransportProfile {
+		return false
+	}
+	if len(rule.DNS) == 0 {
+		return true
+	}
+	name := strings.ToLower(flow.DNSName)
+	for _, pattern := range rule.DNS {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// apply counts the first rule in priority order that matches a complete
+// local flow and labels the flow with it, unless the flow has a role such
+// as telemetry or input.
+func (rules *classifierRules) apply(flow *Flow) {
+	if flow.Direction == DirectionLocal || len(flow.Packets) == 0 {
+		return
+	}
+	for i := range rules.rules {
+		rule := &rules.rules[i]
+		if !rule.matches(flow) {
+			continue
+		}
+		rules.matches[rule.Name]++
+		if rule.Label != "" && (flow.ServiceFlowType == "" || flow.ServiceFlowType == flow.RegisteredDomain) {
+			flow.ServiceFlowType = rule.Label
+			flow.LabelSource = labelRule
+			if flow.DNSName == "" {
+				flow.LabelConfidence = ruleConfidence
+			}
+		}
+		return
+	}
+}
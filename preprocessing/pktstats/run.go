@@ -0,0 +1,433 @@
+package pktstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ExitOutputLimit is the exit status of a run that stopped dispatching files
+// at Options.MaxTotalOutput, so that scripts can tell it from a failure and
+// resume the run after freeing space.
+const ExitOutputLimit = 3
+
+// ErrOutputLimit is returned by Run when it stopped dispatching files at
+// Options.MaxTotalOutput, see ExitOutputLimit.
+var ErrOutputLimit = errors.New("stopped at -max-total-output")
+
+// Run processes the captures under basePath, or the inputs of Options.File
+// and Options.InputList, and writes the run files (aggregate stats, run
+// manifest, caches) to basePath. Files that fail are recorded in the run
+// manifest; the error is that of a run that could not start, or
+// ErrOutputLimit.
+func Run(basePath string, opts Options) error {
+	if opts.workers == nil {
+		opts.workers = make(chan struct{}, max(opts.Jobs, 1))
+	}
+	// the workers limit the number of concurrent goroutines, shared with serve requests
+	semaphore := opts.workers
+	var wg sync.WaitGroup
+	var aggregate AggregateStats
+	var dnsMaps dnsMapCache
+	manifest := newManifest(basePath, opts)
+	overrides := newDirectoryOverrides(basePath)
+	limits := newDiskLimits(opts)
+
+	rdnsCachePath := filepath.Join(basePath, "rdns_cache.json")
+	if opts.RDNSOffline != "" {
+		rdnsCachePath = opts.RDNSOffline
+	}
+	if opts.RDNS || opts.RDNSOffline != "" {
+		resolver, err := newRDNSResolver(rdnsCachePath, opts.RDNSOffline != "", opts.RDNSTimeout, 8)
+		if err != nil {
+			return fmt.Errorf("error reading reverse DNS cache: %w", err)
+		}
+		opts.rdns = resolver
+	}
+	if opts.GeoASNDB != "" || opts.GeoCityDB != "" {
+		geo, err := openGeoDatabases(opts.GeoASNDB, opts.GeoCityDB)
+		if err != nil {
+			return fmt.Errorf("error reading geo databases: %w", err)
+		}
+		defer geo.close()
+		opts.geo = geo
+	}
+
+	if opts.CGNATLog != "" {
+		translations, err := loadTranslationLog(opts.CGNATLog)
+		if err != nil {
+			return fmt.Errorf("error reading CGNAT translation log: %w", err)
+		}
+		opts.translations = translations
+	}
+	if opts.KeyLog != "" {
+		keys, err := readKeyLog(opts.KeyLog)
+		if err != nil {
+			return fmt.Errorf("error reading TLS key log: %w", err)
+		}
+		opts.keyLog = keys
+	}
+	if opts.MetricsAddr != "" {
+		listener, err := net.Listen("tcp", opts.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("error starting metrics endpoint: %w", err)
+		}
+		opts.metrics = newServiceMetrics(opts.MetricsServices)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", opts.metrics)
+		go http.Serve(listener, mux)
+	}
+	if opts.DB != "" {
+		db, err := openDB(context.Background(), opts.DB)
+		if err != nil {
+			return fmt.Errorf("error connecting to the database: %w", err)
+		}
+		defer db.close()
+		opts.db = db
+	}
+
+	process := func(input string) {
+		// remote inputs are streamed, their outputs written below -o
+		filePath := input
+		if isRemoteInput(input) {
+			var err error
+			if filePath, err = remoteLocalPath(opts.OutputDir, input); err == nil {
+				err = os.MkdirAll(filepath.Dir(filePath), 0755)
+			}
+			if err != nil {
+				fmt.Println(err)
+				manifest.record(input, "", "failed")
+				return
+			}
+		}
+		// the override files of the data tree, not of the local directory of remote inputs
+		fileOpts := opts
+		if !isRemoteInput(input) {
+			applied, err := overrides.find(filePath)
+			if err == nil {
+				manifest.noteOverrides(input, applied)
+				fileOpts, err = applied.apply(opts)
+			}
+			if err != nil {
+				fmt.Println("Invalid per-directory options:", err)
+				manifest.add(ManifestEntry{Input: input, Status: "failed", Reason: "invalid overrides"})
+				return
+			}
+		}
+		if opts.PreflightOnly {
+			semaphore <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-semaphore }()
+				var warnings []string
+				var err error
+				recovered := recoverFile(input, "", func() { warnings, err = runPreflight(input, fileOpts) })
+				if recovered != nil {
+					manifest.recordPanic(input, "", recovered)
+					return
+				}
+				if err != nil {
+					fmt.Println("unable to open pcap", err)
+					manifest.record(input, "", "failed")
+					return
+				}
+				printWarnings(input, warnings)
+				manifest.add(ManifestEntry{Input: input, Status: "checked", Warnings: warnings})
+			}()
+			return
+		}
+		outPath := outputPath(opts.OutTemplate, filePath, opts.Format)
+		if opts.Out != "" {
+			outPath = opts.Out
+		}
+		// Check if the output file already exists, from a run with the same options
+		if !opts.Force && outputExists(outPath) {
+			if skip, reason := skipExisting(outPath, fileOpts); skip {
+				fmt.Printf("Output file %s already exists, skipping (%s)...\n", outPath, reason)
+				manifest.record(input, outPath, "skipped")
+				return
+			}
+			fmt.Printf("Output file %s was extracted with other options, reprocessing...\n", outPath)
+		}
+
+		// Acquire a token from the semaphore before starting a new goroutine
+		semaphore <- struct{}{}
+		// once files in progress are done, the limit may have been reached meanwhile
+		if limits.limitReached() {
+			<-semaphore
+			limits.deferFile()
+			manifest.add(ManifestEntry{Input: input, Output: outPath, Status: "pending", Reason: "max total output"})
+			return
+		}
+		wg.Add(1)
+		go func(outPath string) {
+			defer wg.Done()
+			defer func() { <-semaphore }() // Release the token back to the semaphore when done
+			// a panic fails the file, the run goes on with the next ones
+			recovered := recoverFile(input, outPath, func() {
+				// the size of remote inputs is unknown, nothing is reserved for them
+				release, err := limits.reserve(filepath.Dir(outPath), inputSize(input))
+				if err != nil {
+					fmt.Printf("Not enough space for the output of %s: %v\n", input, err)
+					manifest.add(ManifestEntry{Input: input, Output: outPath, Status: "failed", Reason: "disk space"})
+					return
+				}
+				defer release()
+				ctx, cancel := opts.fileContext()
+				defer cancel()
+				if opts.Sketch {
+					// a single pass, learning DNS names as it goes
+					if meta := SketchPacketStats(ctx, input, outPath, fileOpts); meta != nil {
+						manifest.recordProcessed(input, outPath, meta)
+					} else {
+						manifest.recordFailure(ctx, input, outPath)
+					}
+					return
+				}
+				if !opts.DNSSinglePass {
+					if fileOpts.DNSMap, fileOpts.DNSAnswerSets, err = dnsMaps.get(ctx, input, opts); err != nil {
+						fmt.Println(err)
+						manifest.recordFailure(ctx, input, outPath)
+						return
+					}
+				}
+				if meta := ExtractPacketStats(ctx, input, outPath, fileOpts); meta != nil {
+					aggregate.add(meta)
+					manifest.recordProcessed(input, outPath, meta)
+				} else {
+					manifest.recordFailure(ctx, input, outPath)
+				}
+			})
+			if recovered != nil {
+				manifest.recordPanic(input, outPath, recovered)
+			}
+		}(outPath)
+	}
+
+	// processStitched extracts the files of one directory on a single worker,
+	// one output per session of consecutive files, see stitchedCapture
+	processStitched := func(files []string) {
+		semaphore <- struct{}{}
+		if limits.limitReached() {
+			<-semaphore
+			for _, input := range files {
+				limits.deferFile()
+				manifest.add(ManifestEntry{Input: input, Status: "pending", Reason: "max total output"})
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			stitched, failed := newStitchedCapture(files, opts)
+			for _, input := range failed {
+				manifest.record(input, "", "failed")
+			}
+			if len(stitched.files) == 0 {
+				return
+			}
+			applied, err := overrides.find(stitched.files[0])
+			fileOpts := opts
+			if err == nil {
+				for _, input := range stitched.files {
+					manifest.noteOverrides(input, applied)
+				}
+				fileOpts, err = applied.apply(opts)
+			}
+			if err != nil {
+				fmt.Println("Invalid per-directory options:", err)
+				for _, input := range stitched.files {
+					manifest.add(ManifestEntry{Input: input, Status: "failed", Reason: "invalid overrides"})
+				}
+				return
+			}
+			// sessions are only known while reading, a directory is done once its first output exists
+			if outPath := outputPath(opts.OutTemplate, stitched.files[0], opts.Format); !opts.Force && outputExists(outPath) {
+				if skip, reason := skipExisting(outPath, fileOpts); skip {
+					fmt.Printf("Output file %s already exists, skipping directory (%s)...\n", outPath, reason)
+					for _, input := range stitched.files {
+						manifest.record(input, outPath, "skipped")
+					}
+					return
+				}
+				fmt.Printf("Output file %s was extracted with other options, reprocessing directory...\n", outPath)
+			}
+			release, err := limits.reserve(filepath.Dir(outputPath(opts.OutTemplate, stitched.files[0], opts.Format)), inputSize(stitched.files...))
+			if err != nil {
+				fmt.Printf("Not enough space for the outputs of %s: %v\n", filepath.Dir(stitched.files[0]), err)
+				for _, input := range stitched.files {
+					manifest.add(ManifestEntry{Input: input, Status: "failed", Reason: "disk space"})
+				}
+				return
+			}
+			defer release()
+			if !opts.DNSSinglePass {
+				ctx, cancel := opts.fileContext()
+				if fileOpts.DNSMap, fileOpts.DNSAnswerSets, err = dnsMaps.get(ctx, stitched.files[0], opts); err != nil {
+					fmt.Println(err)
+					for _, input := range stitched.files {
+						manifest.recordFailure(ctx, input, "")
+					}
+					cancel()
+					return
+				}
+				cancel()
+			}
+			for len(stitched.files) > 0 {
+				outPath := outputPath(opts.OutTemplate, stitched.files[0], opts.Format)
+				remaining := stitched.files
+				ctx, cancel := opts.fileContext()
+				var meta *Meta
+				recovered := recoverFile(remaining[0], outPath, func() {
+					meta = ExtractStitchedPacketStats(ctx, stitched, outPath, fileOpts)
+				})
+				if recovered != nil {
+					// the session's read was cut short, the rest of the directory is not read
+					for _, input := range remaining {
+						manifest.recordPanic(input, outPath, recovered)
+					}
+					cancel()
+					return
+				}
+				if meta == nil && ctx.Err() != nil {
+					// the stitched capture belongs to the session's read in progress until it returns,
+					// the rest of the directory is not read
+					for _, input := range remaining {
+						manifest.recordFailure(ctx, input, outPath)
+					}
+					cancel()
+					return
+				}
+				cancel()
+				for _, input := range stitched.read {
+					if meta != nil {
+						manifest.recordProcessed(input, outPath, meta)
+					} else {
+						manifest.record(input, outPath, "failed")
+					}
+				}
+				if meta != nil {
+					aggregate.add(meta)
+				}
+				for _, input := range stitched.failed {
+					manifest.record(input, "", "failed")
+				}
+			}
+		}()
+	}
+
+	manifestPath := filepath.Join(basePath, "run_manifest.json")
+	// collect all inputs before dispatching them, in the configured order;
+	// whether an output exists is still checked when each input is dispatched
+	var inputs []string
+	if opts.Watch {
+		written := 0
+		watchInputs(basePath, opts, process, func() {
+			// keep the manifest current while watching
+			manifest.mu.Lock()
+			files := len(manifest.Files)
+			manifest.mu.Unlock()
+			if files != written {
+				written = files
+				manifest.noteDiskUsage(limits.report(basePath))
+				if err := manifest.write(manifestPath); err != nil {
+					fmt.Println("Error writing run manifest:", err)
+				}
+			}
+		})
+	} else {
+		var err error
+		if inputs, err = collectInputs(basePath, opts); err != nil {
+			return err
+		}
+		matched := inputs
+		inputs, manifest.Sampling = sampleInputs(matched, opts)
+		// preflight checks write no outputs
+		if !opts.PreflightOnly {
+			if err := checkSampleMix(matched, inputs, manifest.Sampling, opts); err != nil {
+				return err
+			}
+		}
+	}
+	manifest.Order = inputs
+	if opts.Stitch && !opts.PreflightOnly {
+		// still parallel across directories
+		for _, files := range groupByDirectory(inputs) {
+			processStitched(files)
+		}
+	} else {
+		for _, input := range inputs {
+			process(input)
+		}
+	}
+
+	// Wait for all goroutines to complete
+	wg.Wait()
+
+	// store the per-service rollups of all files processed in this run
+	if aggregate.Files > 0 {
+		aggregatePath := filepath.Join(basePath, "aggregate_stats.json")
+		fmt.Printf("========== Writing aggregate stats to: %s ==========\n", aggregatePath)
+		if err := aggregate.write(aggregatePath, opts.LegacyNames); err != nil {
+			fmt.Println("Error writing aggregate stats:", err)
+		}
+	}
+	if opts.rdns != nil {
+		if err := opts.rdns.save(rdnsCachePath); err != nil {
+			fmt.Println("Error writing reverse DNS cache:", err)
+		}
+	}
+	usage := limits.report(basePath)
+	manifest.noteDiskUsage(usage)
+	fmt.Printf("========== Writing run manifest to: %s ==========\n", manifestPath)
+	if err := manifest.write(manifestPath); err != nil {
+		fmt.Println("Error writing run manifest:", err)
+	}
+	if usage.LimitReached {
+		fmt.Printf("Stopped at -max-total-output after %d output bytes: %d files pending, run again after freeing space to process them\n", usage.OutputBytes, usage.Pending)
+		return ErrOutputLimit
+	}
+	return nil
+}
+
+// collectInputs returns the inputs of a run without -watch, in the order they
+// are dispatched: the -f input, the inputs of the -list file, or the capture
+// files under basePath.
+func collectInputs(basePath string, opts Options) ([]string, error) {
+	var inputs []string
+	if opts.File != "" {
+		inputs = []string{opts.File}
+	} else if opts.InputList != "" {
+		var err error
+		if inputs, err = readInputList(opts.InputList); err != nil {
+			return nil, fmt.Errorf("error reading input list: %w", err)
+		}
+	} else {
+		err := filepath.WalkDir(basePath, func(path string, d fs.DirEntry, err error) error {
+			// check for pcapng files and compressed captures
+			if isCaptureFile(path) {
+				if err != nil {
+					fmt.Println("Error walking the path:", err)
+					return err
+				}
+				inputs = append(inputs, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error walking the path: %w", err)
+		}
+	}
+	if opts.Order != "" || opts.PriorityGlob != "" {
+		inputs = orderInputs(inputs, opts.Order, opts.PriorityGlob)
+	}
+	return inputs, nil
+}
@@ -0,0 +1,148 @@
+package pktstats
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// sampleMarkerName is the file marking an output directory written by a
+// sampled run, see checkSampleMix.
+const sampleMarkerName = "sampled_outputs.json"
+
+// Sampling records how the inputs of a sampled run were selected, see
+// Options.Sample.
+type Sampling struct {
+	Fraction float64 `json:"fraction,omitempty"`
+	Count    int     `json:"count,omitempty"`
+	Seed     int64   `json:"seed"`
+	Matched  int     `json:"matched"`  // inputs collected before sampling
+	Selected int     `json:"selected"` // inputs kept
+}
+
+// sampleKey hashes an input path with the seed into [0, 1).
+func sampleKey(input string, seed int64) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(input))
+	binary.Write(hash, binary.BigEndian, seed)
+	return float64(hash.Sum64()>>11) / (1 << 53)
+}
+
+// sampleInputs selects the inputs of a sampled run by the hash of their path
+// and Options.Seed, so that runs with the same seed select the same inputs:
+// those hashing below Options.Sample, or the Options.SampleCount lowest. The
+// selected inputs keep their order.
+// @return the selected inputs, and nil sampling when the run is not sampled
+func sampleInputs(inputs []string, opts Options) ([]string, *Sampling) {
+	if opts.Sample == 0 && opts.SampleCount == 0 {
+		return inputs, nil
+	}
+	sampling := &Sampling{Fraction: opts.Sample, Count: opts.SampleCount, Seed: opts.Seed, Matched: len(inputs)}
+	keys := make(map[string]float64, len(inputs))
+	for _, input := range inputs {
+		keys[input] = sampleKey(input, opts.Seed)
+	}
+	threshold := opts.Sample
+	if opts.SampleCount > 0 {
+		threshold = math.Inf(1)
+		if opts.SampleCount < len(inputs) {
+			sorted := make([]float64, 0, len(keys))
+			for _, key := range keys {
+				sorted = append(sorted, key)
+			}
+			sort.Float64s(sorted)
+			threshold = sorted[opts.SampleCount]
+		}
+	}
+	var selected []string
+	for _, input := range inputs {
+		if keys[input] < threshold {
+			selected = append(selected, input)
+		}
+	}
+	sampling.Selected = len(selected)
+	fmt.Printf("Sampled %d of %d inputs with seed %d\n", len(selected), len(inputs), opts.Seed)
+	return selected, sampling
+}
+
+// checkSampleMix refuses to mix the outputs of sampled and full runs in an
+// output directory, unless Options.Force is set. A sampled run marks the
+// output directories of its inputs with sampleMarkerName, and refuses those
+// without the mark holding an output of any of the inputs collected; a full
+// run refuses marked directories, and removes the mark with Options.Force.
+// @param matched: the inputs collected, before sampling
+// @param sampling: how the inputs were sampled, nil for a full run
+func checkSampleMix(matched, selected []string, sampling *Sampling, opts Options) error {
+	dirs := make(map[string][]string) // outputs of the inputs collected, by directory
+	for _, input := range matched {
+		if outPath, ok := inputOutputPath(input, opts); ok {
+			dirs[filepath.Dir(outPath)] = append(dirs[filepath.Dir(outPath)], outPath)
+		}
+	}
+	written := make(map[string]bool) // directories the run writes to
+	for _, input := range selected {
+		if outPath, ok := inputOutputPath(input, opts); ok {
+			written[filepath.Dir(outPath)] = true
+		}
+	}
+	// check every directory before marking any
+	for _, dir := range sortedKeys(written) {
+		marker := filepath.Join(dir, sampleMarkerName)
+		_, err := os.Stat(marker)
+		switch {
+		case opts.Force:
+		case sampling == nil && err == nil:
+			return fmt.Errorf("%s holds outputs of a sampled run, see %s: use -force to process every input into it", dir, marker)
+		case sampling != nil && err != nil:
+			for _, outPath := range dirs[dir] {
+				if outputExists(outPath) {
+					return fmt.Errorf("%s holds outputs of a full run, e.g. %s: use -force to add sampled outputs to it", dir, outPath)
+				}
+			}
+		}
+	}
+	for _, dir := range sortedKeys(written) {
+		marker := filepath.Join(dir, sampleMarkerName)
+		if sampling != nil {
+			if err := writeSampleMarker(marker, sampling); err != nil {
+				return err
+			}
+		} else if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing the sample marker: %w", err)
+		}
+	}
+	return nil
+}
+
+// inputOutputPath returns the output path of an input, of its local copy
+// for remote inputs.
+func inputOutputPath(input string, opts Options) (string, bool) {
+	filePath := input
+	if isRemoteInput(input) {
+		var err error
+		if filePath, err = remoteLocalPath(opts.OutputDir, input); err != nil {
+			return "", false
+		}
+	}
+	return outputPath(opts.OutTemplate, filePath, opts.Format), true
+}
+
+// writeSampleMarker records the sampling of a run in an output directory.
+func writeSampleMarker(path string, sampling *Sampling) error {
+	jsonString, err := json.MarshalIndent(sampling, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(path, jsonString, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing the sample marker: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package pktstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// populate sets every exported field of v, recursively, to a value that is
+// not empty, so that no field is left out by omitempty. Types already being
+// populated, such as a flow's links to other flows, are left empty.
+func populate(v reflect.Value, path map[reflect.Type]bool) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.Pointer:
+		if path[v.Type().Elem()] {
+			return
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		populate(v.Elem(), path)
+	case reflect.Slice:
+		if path[v.Type().Elem()] {
+			return
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		populate(v.Index(0), path)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			populate(v.Index(i), path)
+		}
+	case reflect.Map:
+		if path[v.Type().Elem()] {
+			return
+		}
+		key, elem := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		populate(key, path)
+		populate(elem, path)
+		v.Set(reflect.MakeMap(v.Type()))
+		v.SetMapIndex(key, elem)
+	case reflect.Struct:
+		path[v.Type()] = true
+		defer delete(path, v.Type())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.IsExported() && field.Tag.Get("json") != "-" {
+				populate(v.Field(i), path)
+			}
+		}
+	}
+}
+
+// schemaOutput returns an output with every field set.
+func schemaOutput() *Output {
+	var output Output
+	populate(reflect.ValueOf(&output).Elem(), make(map[reflect.Type]bool))
+	return &output
+}
+
+// TestSchema freezes the field names of outputs: a renamed field, or one
+// whose json tag was lost, changes the golden file.
+func TestSchema(t *testing.T) {
+	content, err := json.MarshalIndent(schemaOutput(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "schema.golden.json", append(content, '\n'))
+}
+
+// TestLegacyNames writes an output with the Go field names of -legacy-names
+// and loads it back into the same output.
+func TestLegacyNames(t *testing.T) {
+	output := schemaOutput()
+	legacy, err := marshalOutput(output, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := marshalOutput(output, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, goName := range legacyFieldNames {
+		if name != goName && bytes.Contains(current, []byte(`"`+name+`":`)) && bytes.Contains(legacy, []byte(`"`+name+`":`)) {
+			t.Errorf("field %s is not renamed to %s", name, goName)
+		}
+	}
+	var loaded Output
+	if err := json.Unmarshal(legacy, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&loaded, output) {
+		t.Error("output with legacy names does not load back into the output")
+	}
+
+	// map keys such as flow keys are kept
+	keys := []byte(`{"flows":{"192.168.1.10:50000-203.0.113.10:3478@17":{"localIP":"192.168.1.10"}}}`)
+	want := `{"Flows":{"192.168.1.10:50000-203.0.113.10:3478@17":{"LocalIP":"192.168.1.10"}}}`
+	if got := string(withLegacyNames(keys)); got != want {
+		t.Errorf("withLegacyNames(%s) = %s, want %s", keys, got, want)
+	}
+}
@@ -0,0 +1,462 @@
+package pktstats
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// serveJobRetention is how long the output of a finished job can be fetched
+	serveJobRetention = time.Hour
+	// maxServeRequestOptions is the largest json request body, or options field of an upload
+	maxServeRequestOptions = 1 << 20
+)
+
+// extractRequest is the json body of a POST /extract naming a capture under
+// the base path. Uploads send the same fields as multipart form fields, the
+// capture in a "file" field.
+type extractRequest struct {
+	Path    string          `json:"path"`
+	Options json.RawMessage `json:"options"` // Options fields overriding the server's flags for this capture
+	Async   bool            `json:"async"`   // return a job at once instead of waiting up to Options.ServeTimeout
+}
+
+// serveJob is the extraction of one capture requested through the API.
+type serveJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // queued, running, done or failed
+	Source string `json:"source"`
+	Error  string `json:"error,omitempty"`
+
+	output   []byte // output envelope, once done
+	done     chan struct{}
+	finished time.Time
+}
+
+// extractServer serves the extraction of captures over HTTP, see ServeMain.
+type extractServer struct {
+	basePath string
+	opts     Options
+	mu       sync.Mutex
+	jobs     map[string]*serveJob
+	running  sync.WaitGroup
+}
+
+// ServeMain serves the HTTP API until SIGTERM, finishing the jobs started
+// before. With Options.Watch, new captures under basePath are processed
+// alongside, the workers shared with the requests.
+func ServeMain(basePath string, opts Options) {
+	if opts.workers == nil {
+		opts.workers = make(chan struct{}, max(opts.Jobs, 1))
+	}
+	if opts.CGNATLog != "" {
+		translations, err := loadTranslationLog(opts.CGNATLog)
+		if err != nil {
+			fmt.Println("Error reading CGNAT translation log:", err)
+			return
+		}
+		opts.translations = translations
+	}
+	if opts.GeoASNDB != "" || opts.GeoCityDB != "" {
+		geo, err := openGeoDatabases(opts.GeoASNDB, opts.GeoCityDB)
+		if err != nil {
+			fmt.Println("Error reading geo databases:", err)
+			return
+		}
+		defer geo.close()
+		opts.geo = geo
+	}
+	server := &extractServer{basePath: basePath, opts: opts, jobs: make(map[string]*serveJob)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", server.health)
+	mux.HandleFunc("POST /extract", server.extract)
+	mux.HandleFunc("GET /jobs/{id}", server.job)
+	httpServer := &http.Server{Addr: opts.ServeAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	var watching sync.WaitGroup
+	if opts.Watch {
+		watching.Add(1)
+		go func() {
+			defer watching.Done()
+			if err := Run(basePath, opts); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		httpServer.Shutdown(context.Background())
+	}()
+	fmt.Println("========== Serving on: " + opts.ServeAddr + " ==========")
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("Error serving:", err)
+		stop()
+	}
+	server.running.Wait()
+	watching.Wait()
+}
+
+func (server *extractServer) health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]int{"workers": cap(server.opts.workers), "busyWorkers": len(server.opts.workers)})
+}
+
+// extract starts a job for the capture of the request and responds with its
+// output envelope, or with 202 and the job when it is asynchronous or takes
+// longer than Options.ServeTimeout. The job continues after the response.
+func (server *extractServer) extract(w http.ResponseWriter, r *http.Request) {
+	request, filePath, cleanup, err := server.readRequest(w, r)
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeError(w, status, err)
+		return
+	}
+	opts, err := server.requestOptions(request.Options)
+	if err != nil {
+		cleanup()
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	job := server.start(filePath, opts, cleanup)
+	if !request.Async {
+		select {
+		case <-job.done:
+			server.respond(w, job)
+			return
+		case <-time.After(server.opts.ServeTimeout):
+		case <-r.Context().Done():
+			// the client left, the job can still be polled
+			return
+		}
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// job responds with the output envelope of a finished job, or its status.
+func (server *extractServer) job(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	job, ok := server.jobs[r.PathValue("id")]
+	server.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown job %s", r.PathValue("id")))
+		return
+	}
+	select {
+	case <-job.done:
+		server.respond(w, job)
+	default:
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// respond writes the output envelope of a finished job, or its error.
+func (server *extractServer) respond(w http.ResponseWriter, job *serveJob) {
+	if job.Status == "failed" {
+		writeJSON(w, http.StatusUnprocessableEntity, job)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(job.output)
+}
+
+// readRequest reads a json request naming a capture under the base path, or
+// a multipart upload, which is stored in a temporary directory removed by
+// cleanup. Uploads are limited to Options.ServeMaxUploadMB.
+func (server *extractServer) readRequest(w http.ResponseWriter, r *http.Request) (request extractRequest, filePath string, cleanup func(), err error) {
+	cleanup = func() {}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxServeRequestOptions))
+		if err := decoder.Decode(&request); err != nil {
+			return request, "", cleanup, fmt.Errorf("invalid request: %w", err)
+		}
+		filePath, err = server.capturePath(request.Path)
+		return request, filePath, cleanup, err
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, server.opts.ServeMaxUploadMB<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return request, "", cleanup, err
+	}
+	dir, err := os.MkdirTemp("", "upload")
+	if err != nil {
+		return request, "", cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return request, "", nil, err
+		}
+		switch part.FormName() {
+		case "file":
+			// the extension selects the decompression, see openCapture
+			filePath = filepath.Join(dir, filepath.Base(part.FileName()))
+			if part.FileName() == "" || !isCaptureFile(filePath) {
+				err = fmt.Errorf("the uploaded file %q is no capture file", part.FileName())
+				break
+			}
+			var file *os.File
+			if file, err = os.Create(filePath); err == nil {
+				_, err = io.Copy(file, part)
+				if closeErr := file.Close(); err == nil {
+					err = closeErr
+				}
+			}
+		case "options":
+			request.Options, err = io.ReadAll(io.LimitReader(part, maxServeRequestOptions))
+		case "async":
+			var value []byte
+			value, err = io.ReadAll(io.LimitReader(part, 16))
+			request.Async = strings.TrimSpace(string(value)) == "true"
+		}
+		if err != nil {
+			cleanup()
+			return request, "", nil, err
+		}
+	}
+	if filePath == "" {
+		cleanup()
+		return request, "", nil, fmt.Errorf("no file uploaded")
+	}
+	return request, filePath, cleanup, nil
+}
+
+// capturePath resolves the path of a request relative to the base path and
+// rejects captures outside of it.
+func (server *extractServer) capturePath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("no path given")
+	}
+	base, err := filepath.Abs(server.basePath)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(base, path)
+	}
+	path = filepath.Clean(path)
+	if relative, err := filepath.Rel(base, path); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the base path %s", path, base)
+	}
+	if !isCaptureFile(path) {
+		return "", fmt.Errorf("%s is no capture file", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// serveOptions are the options a serve request may set: those controlling
+// the extraction of one capture, none naming a file, so that a request
+// neither reads nor writes files of the server. Its fields are the Options
+// fields of the same name; inputs, outputs, caches and the server settings
+// stay the server's.
+type serveOptions struct {
+	NumPackets             int           `json:"numPackets"`
+	CanonicalKeys          bool          `json:"canonicalKeys"`
+	StringKeys             bool          `json:"stringKeys"`
+	ThirdParty             string        `json:"thirdParty"`
+	ZeroPayload            string        `json:"zeroPayload"`
+	PerClient              bool          `json:"perClient"`
+	CaptureBytes           int           `json:"captureBytes"`
+	CaptureFilter          string        `json:"captureFilter"`
+	LocalSubnets           string        `json:"localSubnets"`
+	KeepPorts              string        `json:"keepPorts"`
+	LabelPrecedence        string        `json:"labelPrecedence"`
+	InterfaceRoles         string        `json:"interfaceRoles"`
+	RemotePrefixes         string        `json:"remotePrefixes"` // CIDR prefixes only, not @file
+	DNSPorts               string        `json:"dnsPorts"`
+	SignaturePackets       int           `json:"signaturePackets"`
+	SignatureZeroPayload   bool          `json:"signatureZeroPayload"`
+	BulkMinRatio           float64       `json:"bulkMinRatio"`
+	BulkMinMbps            float64       `json:"bulkMinMbps"`
+	BulkMaxUpPPS           float64       `json:"bulkMaxUpPPS"`
+	InputMaxSize           int           `json:"inputMaxSize"`
+	InputBand              string        `json:"inputBand"`
+	VoiceMinSize           int           `json:"voiceMinSize"`
+	VoiceMaxSize           int           `json:"voiceMaxSize"`
+	VoiceBands             string        `json:"voiceBands"`
+	LegacyNames            bool          `json:"legacyNames"`
+	NoFingerprints         bool          `json:"noFingerprints"`
+	VerifyChecksums        bool          `json:"verifyChecksums"`
+	IPHeaderFields         bool          `json:"ipHeaderFields"`
+	MaxFlows               int           `json:"maxFlows"`
+	MaxFlowsHard           int           `json:"maxFlowsHard"`
+	BurstGapMicros         int           `json:"burstGapMicros"`
+	BurstMinPackets        int           `json:"burstMinPackets"`
+	BurstMinCount          int           `json:"burstMinCount"`
+	MediaMinPayload        int           `json:"mediaMinPayload"`
+	RampUpSeconds          int           `json:"rampUpSeconds"`
+	KeepaliveMaxPayload    int           `json:"keepaliveMaxPayload"`
+	KeepaliveMinPeriod     time.Duration `json:"keepaliveMinPeriod"`
+	ExcludeIdleConnections bool          `json:"excludeIdleConnections"`
+	TrimKeepalive          bool          `json:"trimKeepalive"`
+	OngoingIdle            time.Duration `json:"ongoingIdle"`
+	RatioBin               time.Duration `json:"ratioBin"`
+	StreamingMinRatio      float64       `json:"streamingMinRatio"`
+	StreamingMinMbps       float64       `json:"streamingMinMbps"`
+	StreamingMinDuration   time.Duration `json:"streamingMinDuration"`
+	Finalize               string        `json:"finalize"`
+	FlushLinger            time.Duration `json:"flushLinger"`
+	FlushUDPIdle           time.Duration `json:"flushUDPIdle"`
+	LateArrivals           string        `json:"lateArrivals"`
+	SessionGap             time.Duration `json:"sessionGap"`
+	SessionMinDuration     time.Duration `json:"sessionMinDuration"`
+	RaceWindow             time.Duration `json:"raceWindow"`
+	RaceLoserMaxBytes      int           `json:"raceLoserMaxBytes"`
+	RaceLoserMaxDuration   time.Duration `json:"raceLoserMaxDuration"`
+	LimitBinMillis         int           `json:"limitBinMillis"`
+	LimitWindow            int           `json:"limitWindow"`
+	AppLimitedRatio        float64       `json:"appLimitedRatio"`
+	NetworkLimitedRatio    float64       `json:"networkLimitedRatio"`
+	LearnPrefixes          bool          `json:"learnPrefixes"`
+	RTPClockRates          string        `json:"rtpClockRates"`
+	CongestionScore        string        `json:"congestionScore"`
+	CongestionWeights      string        `json:"congestionWeights"`
+	CongestionThreshold    float64       `json:"congestionThreshold"`
+	GapQuietMs             int           `json:"gapQuietMs"`
+	GapMinPPS              float64       `json:"gapMinPPS"`
+	ClockWarnSeconds       float64       `json:"clockWarnSeconds"`
+	FixClock               bool          `json:"fixClock"`
+	ExcludeMgmt            bool          `json:"excludeMgmt"`
+	MgmtEndpoints          string        `json:"mgmtEndpoints"`
+	MgmtDrop               bool          `json:"mgmtDrop"`
+	CaptureHost            string        `json:"captureHost"`
+	TimestampPrecision     string        `json:"timestampPrecision"`
+	Timezone               string        `json:"timezone"`
+}
+
+// copyServeOptions copies the fields of serveOptions from src to dst, each a
+// serveOptions or an Options.
+func copyServeOptions(dst, src reflect.Value) {
+	fields := reflect.TypeOf(serveOptions{})
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Field(i).Name
+		dst.FieldByName(name).Set(src.FieldByName(name))
+	}
+}
+
+// requestOptions applies the options of a request to the server's. Options
+// other than those of serveOptions are rejected, and the output is always
+// the json envelope.
+func (server *extractServer) requestOptions(raw json.RawMessage) (Options, error) {
+	opts := server.opts
+	if len(raw) > 0 {
+		var request serveOptions
+		copyServeOptions(reflect.ValueOf(&request).Elem(), reflect.ValueOf(opts))
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			return opts, fmt.Errorf("invalid options: %w", err)
+		}
+		// the error of a file read could hold its content
+		if request.RemotePrefixes != opts.RemotePrefixes && strings.HasPrefix(strings.TrimSpace(request.RemotePrefixes), "@") {
+			return opts, fmt.Errorf("invalid options: remotePrefixes cannot name a file")
+		}
+		copyServeOptions(reflect.ValueOf(&opts).Elem(), reflect.ValueOf(request))
+	}
+	opts.Format = "json"
+	// the hash covers flags, request options are not stored as outputs
+	opts.optionsHash = ""
+	return opts, opts.ValidateExtraction()
+}
+
+// start queues the extraction of filePath on the workers and returns its job.
+// cleanup is called once the job is finished.
+func (server *extractServer) start(filePath string, opts Options, cleanup func()) *serveJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &serveJob{ID: hex.EncodeToString(id), Status: "queued", Source: filePath, done: make(chan struct{})}
+	server.mu.Lock()
+	for id, old := range server.jobs {
+		if !old.finished.IsZero() && time.Since(old.finished) > serveJobRetention {
+			delete(server.jobs, id)
+		}
+	}
+	server.jobs[job.ID] = job
+	server.mu.Unlock()
+
+	server.running.Add(1)
+	go func() {
+		defer server.running.Done()
+		defer cleanup()
+		server.opts.workers <- struct{}{}
+		defer func() { <-server.opts.workers }()
+		server.mu.Lock()
+		job.Status = "running"
+		server.mu.Unlock()
+		output, err := extractEnvelope(filePath, opts)
+		server.mu.Lock()
+		job.Status, job.output, job.finished = "done", output, time.Now()
+		if err != nil {
+			job.Status, job.Error = "failed", err.Error()
+		}
+		server.mu.Unlock()
+		close(job.done)
+	}()
+	return job
+}
+
+// extractEnvelope extracts a capture into the json output envelope, meta
+// block and flows, as written to output files.
+func extractEnvelope(filePath string, opts Options) (envelope []byte, err error) {
+	// extraction panics on unreadable files, which must not stop the server
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("extraction failed: %v", r)
+		}
+	}()
+	output := &Output{Flows: make(map[string]*Flow)}
+	extractor := NewExtractor(opts)
+	extractor.RegisterFlowHandler(output.collect)
+	fmt.Println("========== Processing file: " + filePath + " ==========")
+	ctx, cancel := opts.fileContext()
+	defer cancel()
+	if output.Meta, err = extractor.ExtractContext(ctx, filePath); err != nil {
+		return nil, err
+	}
+	return marshalOutput(output, opts.LegacyNames)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,87 @@
+package pktstats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestServeOptionsFields checks that each field of serveOptions is the
+// Options field of the same name, type and json key.
+func TestServeOptionsFields(t *testing.T) {
+	options := reflect.TypeOf(Options{})
+	fields := reflect.TypeOf(serveOptions{})
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		option, ok := options.FieldByName(field.Name)
+		key, _, _ := strings.Cut(option.Tag.Get("json"), ",")
+		if !ok || option.Type != field.Type || key != field.Tag.Get("json") {
+			t.Errorf("serveOptions.%s %s `%s` is no Options field", field.Name, field.Type, field.Tag)
+		}
+	}
+}
+
+func TestRequestOptions(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("root:x:0:0:root:/root:/bin/bash\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.NumPackets = 7
+	server := &extractServer{opts: opts}
+
+	tests := []struct {
+		name    string
+		raw     string
+		valid   bool
+		applied func(opts Options) bool
+	}{
+		{"none", "", true, func(opts Options) bool { return opts.NumPackets == 7 }},
+		{"extraction options", `{"zeroPayload": "aggregate", "sessionGap": 1000000000}`, true, func(opts Options) bool {
+			return opts.ZeroPayload == zeroPayloadAggregate && opts.SessionGap == 1e9 && opts.NumPackets == 7
+		}},
+		{"remote prefixes", `{"remotePrefixes": "203.0.113.0/24"}`, true, func(opts Options) bool { return opts.RemotePrefixes == "203.0.113.0/24" }},
+		{"invalid value", `{"zeroPayload": "drop"}`, false, nil},
+		{"remote prefixes file", `{"remotePrefixes": "@` + secret + `"}`, false, nil},
+		{"rules", `{"rules": "` + secret + `"}`, false, nil},
+		{"key log", `{"keyLog": "` + secret + `"}`, false, nil},
+		{"telemetry list", `{"telemetryList": "` + secret + `"}`, false, nil},
+		{"devices", `{"devices": true}`, false, nil},
+		{"DNS map written", `{"dnsSinglePass": false}`, false, nil},
+		{"output template", `{"outTemplate": "/tmp/{base}.json"}`, false, nil},
+		{"server settings", `{"serveAddr": ":80"}`, false, nil},
+	}
+	for _, test := range tests {
+		got, err := server.requestOptions([]byte(test.raw))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: error %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if err != nil {
+			if strings.Contains(err.Error(), "root:") {
+				t.Errorf("%s: error %q holds the content of the file", test.name, err)
+			}
+			continue
+		}
+		if got.Format != "json" || !test.applied(got) {
+			t.Errorf("%s: options %+v not applied", test.name, got)
+		}
+	}
+}
+
+// TestExtractRefusesFiles sends a request naming a file of the server as
+// its remote prefixes.
+func TestExtractRefusesFiles(t *testing.T) {
+	capture := copyFixture(t, fixture(t, "flows.pcap", flowsCapture))
+	server := &extractServer{basePath: filepath.Dir(capture), opts: DefaultOptions(), jobs: make(map[string]*serveJob)}
+	body := `{"path": "` + filepath.Base(capture) + `", "options": {"remotePrefixes": "@/etc/passwd"}}`
+	recorder := httptest.NewRecorder()
+	server.extract(recorder, httptest.NewRequest(http.MethodPost, "/extract", strings.NewReader(body)))
+	if recorder.Code != http.StatusBadRequest || strings.Contains(recorder.Body.String(), "root:") {
+		t.Errorf("response %d %s, want 400 without the file", recorder.Code, recorder.Body)
+	}
+}
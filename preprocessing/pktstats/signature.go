@@ -0,0 +1,26 @@
+package pktstats
+
+import "strconv"
+
+// signatureState tracks the packets still to be added to a flow's signature.
+type signatureState struct {
+	remaining   int
+	zeroPayload bool // whether packets without payload are part of the signature
+}
+
+// extendSignature appends the signed payload size of a packet to the flow's signature.
+func (flow *Flow) extendSignature(packet *Packet) {
+	if packet.PayloadSize == 0 && !flow.signature.zeroPayload {
+		return
+	}
+	if flow.Signature != "" {
+		flow.Signature += " "
+	}
+	if packet.Upstream {
+		flow.Signature += "+"
+	} else {
+		flow.Signature += "-"
+	}
+	flow.Signature += strconv.Itoa(packet.PayloadSize)
+	flow.signature.remaining--
+}
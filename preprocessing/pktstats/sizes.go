@@ -0,0 +1,60 @@
+package pktstats
+
+// maxTrackedSizes is the number of distinct payload sizes counted per
+// direction of a flow; packets of further sizes only mark the count as
+// overflowing.
+const maxTrackedSizes = 512
+
+// PayloadSizes describes the payload sizes of the packets of one direction
+// of a flow that carry a payload. Constant-bitrate encrypted media uses few
+// distinct sizes, with a dominant one.
+type PayloadSizes struct {
+	Distinct   int     `json:"distinct"`           // distinct payload sizes, at most maxTrackedSizes
+	Overflow   bool    `json:"overflow,omitempty"` // more than maxTrackedSizes sizes, the mode is that of the tracked ones
+	ModalSize  int     `json:"modalSize"`          // most frequent payload size, the smallest of equally frequent ones
+	ModalShare float64 `json:"modalShare"`         // share of the payload-bearing packets with ModalSize
+}
+
+// sizeState counts the packets per payload size of one direction, updating
+// the mode as packets arrive.
+type sizeState struct {
+	counts    map[int]int
+	overflow  bool
+	packets   int
+	mode      int
+	modeCount int
+}
+
+func (state *sizeState) observe(size int) {
+	if size == 0 {
+		return
+	}
+	state.packets++
+	count, ok := state.counts[size]
+	if !ok && len(state.counts) >= maxTrackedSizes {
+		state.overflow = true
+		return
+	}
+	if state.counts == nil {
+		state.counts = make(map[int]int)
+	}
+	count++
+	state.counts[size] = count
+	if count > state.modeCount || count == state.modeCount && size < state.mode {
+		state.mode, state.modeCount = size, count
+	}
+}
+
+// payloadSizes returns the PayloadSizes of the direction, nil without
+// payload-bearing packets.
+func (state *sizeState) payloadSizes() *PayloadSizes {
+	if state.packets == 0 {
+		return nil
+	}
+	return &PayloadSizes{
+		Distinct:   len(state.counts),
+		Overflow:   state.overflow,
+		ModalSize:  state.mode,
+		ModalShare: float64(state.modeCount) / float64(state.packets),
+	}
+}
@@ -0,0 +1,318 @@
+package pktstats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// defaultSketchTemplate names the outputs of Options.Sketch when
+// Options.OutTemplate is left at its default, next to the full outputs.
+const defaultSketchTemplate = "{dir}/{base}_sketch.json"
+
+// sketchCountersPerEntry is the number of counters of a sketch per endpoint
+// reported: the more counters, the tighter the error bounds of the top ones.
+const sketchCountersPerEntry = 10
+
+// EndpointSketch is the output of Options.Sketch: the remote endpoints of a
+// capture with the most bytes, estimated in a single pass over its packets
+// without any per-flow state.
+type EndpointSketch struct {
+	Meta      *Meta         `json:"meta"`
+	Counters  int           `json:"counters"`  // counters of each sketch
+	RemoteIPs []SketchEntry `json:"remoteIPs"` // by remote IP
+	DNSNames  []SketchEntry `json:"dnsNames"`  // by the DNS name of the remote IP, for packets sent once it was answered
+}
+
+// SketchEntry is a remote endpoint of an EndpointSketch. Its actual bytes
+// are between Bytes - ErrorBytes and Bytes.
+type SketchEntry struct {
+	Key        string `json:"key"`
+	DNSName    string `json:"dnsName,omitempty"` // of remote IPs, the last name they were answered for
+	Bytes      int64  `json:"bytes"`
+	ErrorBytes int64  `json:"errorBytes"`
+	// packets counted since the endpoint took its counter, all of them when
+	// ErrorBytes is 0
+	Packets int64 `json:"packets"`
+	// the endpoint is among the actual top endpoints: at least Bytes -
+	// ErrorBytes exceeds the estimate of any endpoint not listed
+	Guaranteed bool `json:"guaranteed"`
+}
+
+// spaceSaving is a Space-Saving top-K sketch of bytes by key in a fixed
+// number of counters: a key without a counter takes that of the smallest
+// one, inheriting its bytes as the error of its estimate. The counters are a
+// min-heap on bytes.
+type spaceSaving[K comparable] struct {
+	capacity int
+	counters []sketchCounter[K]
+	index    map[K]int
+}
+
+type sketchCounter[K comparable] struct {
+	key                      K
+	bytes, errBytes, packets int64
+}
+
+func newSpaceSaving[K comparable](capacity int) *spaceSaving[K] {
+	return &spaceSaving[K]{capacity: capacity, index: make(map[K]int, capacity)}
+}
+
+// add counts a packet of a key.
+func (sketch *spaceSaving[K]) add(key K, bytes int64) {
+	if i, ok := sketch.index[key]; ok {
+		counter := &sketch.counters[i]
+		counter.bytes += bytes
+		counter.packets++
+		sketch.down(i)
+		return
+	}
+	if len(sketch.counters) < sketch.capacity {
+		sketch.counters = append(sketch.counters, sketchCounter[K]{key: key, bytes: bytes, packets: 1})
+		sketch.index[key] = len(sketch.counters) - 1
+		sketch.up(len(sketch.counters) - 1)
+		return
+	}
+	smallest := sketch.counters[0]
+	delete(sketch.index, smallest.key)
+	sketch.counters[0] = sketchCounter[K]{key: key, bytes: smallest.bytes + bytes, errBytes: smallest.bytes, packets: 1}
+	sketch.index[key] = 0
+	sketch.down(0)
+}
+
+func (sketch *spaceSaving[K]) swap(i, j int) {
+	sketch.counters[i], sketch.counters[j] = sketch.counters[j], sketch.counters[i]
+	sketch.index[sketch.counters[i].key] = i
+	sketch.index[sketch.counters[j].key] = j
+}
+
+func (sketch *spaceSaving[K]) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if sketch.counters[parent].bytes <= sketch.counters[i].bytes {
+			return
+		}
+		sketch.swap(i, parent)
+		i = parent
+	}
+}
+
+func (sketch *spaceSaving[K]) down(i int) {
+	for {
+		smallest := i
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(sketch.counters) && sketch.counters[child].bytes < sketch.counters[smallest].bytes {
+				smallest = child
+			}
+		}
+		if smallest == i {
+			return
+		}
+		sketch.swap(i, smallest)
+		i = smallest
+	}
+}
+
+// top returns the n counters with the most bytes as entries, named by name.
+func (sketch *spaceSaving[K]) top(n int, name func(K) string) []SketchEntry {
+	counters := append([]sketchCounter[K](nil), sketch.counters...)
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].bytes != counters[j].bytes {
+			return counters[i].bytes > counters[j].bytes
+		}
+		return name(counters[i].key) < name(counters[j].key)
+	})
+	// endpoints without a counter have at most the bytes of the smallest one;
+	// until all counters are taken, none was replaced and the counts are exact
+	var outside int64
+	if len(counters) > n {
+		outside = counters[n].bytes
+	} else if len(counters) == sketch.capacity {
+		outside = counters[len(counters)-1].bytes
+	}
+	entries := []SketchEntry{}
+	for _, counter := range counters[:min(n, len(counters))] {
+		entries = append(entries, SketchEntry{
+			Key:        name(counter.key),
+			Bytes:      counter.bytes,
+			ErrorBytes: counter.errBytes,
+			Packets:    counter.packets,
+			Guaranteed: counter.bytes-counter.errBytes > outside || len(counters) < sketch.capacity,
+		})
+	}
+	return entries
+}
+
+// sketchCapture reads a capture once and estimates its top remote endpoints
+// by bytes, by remote IP and by DNS name. DNS names are learned from the
+// responses as they are read, as with Options.DNSSinglePass. Packets
+// between two local or two remote endpoints are not counted, nor those of
+// decrypted-mirror interfaces.
+func sketchCapture(ctx context.Context, filePath string, opts Options) (*EndpointSketch, error) {
+	localNets, _ := parseLocalSubnets(opts.LocalSubnets)
+	dnsPorts, _ := parsePorts(opts.DNSPorts)
+	roles, _ := parseInterfaceRoles(opts.InterfaceRoles)
+	handle, release, err := openCapture(filePath, opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", filePath, err)
+	}
+	defer release()
+	var (
+		ethLayer layers.Ethernet
+		ip4Layer layers.IPv4
+		ip6Layer layers.IPv6
+		tcpLayer layers.TCP
+		udpLayer layers.UDP
+		dnsLayer layers.DNS
+	)
+	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &ethLayer, &ip4Layer, &ip6Layer, &tcpLayer, &udpLayer)
+	parser.IgnoreUnsupported = true
+	capacity := max(opts.SketchTop, 1) * sketchCountersPerEntry
+	byIP := newSpaceSaving[netip.Addr](capacity)
+	byName := newSpaceSaving[string](capacity)
+	names := make(map[netip.Addr]string)
+	var totalPackets, totalBytes, accountedPackets, accountedBytes, first, last int64
+	var decoded []gopacket.LayerType
+	for {
+		if totalPackets%4096 == 0 && ctx.Err() != nil {
+			return nil, fmt.Errorf("sketch of %s stopped: %w", filePath, ctx.Err())
+		}
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			break
+		}
+		timestamp := opts.timestamp(ci.Timestamp)
+		if totalPackets == 0 {
+			first = timestamp
+		}
+		last = max(last, timestamp)
+		totalPackets++
+		totalBytes += int64(ci.Length)
+		_ = parser.DecodeLayers(data, &decoded)
+		var src, dst netip.Addr
+		for _, layerType := range decoded {
+			switch layerType {
+			case layers.LayerTypeIPv4:
+				src, _ = netip.AddrFromSlice(ip4Layer.SrcIP)
+				dst, _ = netip.AddrFromSlice(ip4Layer.DstIP)
+			case layers.LayerTypeIPv6:
+				src, _ = netip.AddrFromSlice(ip6Layer.SrcIP)
+				dst, _ = netip.AddrFromSlice(ip6Layer.DstIP)
+			case layers.LayerTypeUDP:
+				if dnsPorts[int(udpLayer.SrcPort)] && dnsLayer.DecodeFromBytes(udpLayer.Payload, gopacket.NilDecodeFeedback) == nil && dnsLayer.QR {
+					for _, answer := range dnsLayer.Answers {
+						if answer.Type != layers.DNSTypeA && answer.Type != layers.DNSTypeAAAA {
+							continue
+						}
+						ip, ok := netip.AddrFromSlice(answer.IP)
+						if name, valid := normalizeDNSName(string(answer.Name)); ok && valid {
+							names[ip.Unmap()] = name
+						}
+					}
+				}
+			}
+		}
+		if !src.IsValid() || roles.mirrored(ci.InterfaceIndex) {
+			continue
+		}
+		srcLocal, dstLocal := localNets.contains(src.AsSlice()), localNets.contains(dst.AsSlice())
+		if srcLocal == dstLocal {
+			continue
+		}
+		remote := dst
+		if !srcLocal {
+			remote = src
+		}
+		remote = remote.Unmap()
+		accountedPackets++
+		accountedBytes += int64(ci.Length)
+		byIP.add(remote, int64(ci.Length))
+		if name, ok := names[remote]; ok {
+			byName.add(name, int64(ci.Length))
+		}
+	}
+	if err := handle.remoteFailure(); err != nil {
+		return nil, err
+	}
+	if handle.err != nil {
+		fmt.Printf("%s: capture ends early: %v\n", filePath, handle.err)
+	}
+	sketch := &EndpointSketch{
+		Meta: &Meta{
+			SchemaVersion:    schemaVersion,
+			Version:          BuildVersion(),
+			Options:          opts,
+			OptionsHash:      opts.optionsHash,
+			Source:           filePath,
+			Format:           opts.Format,
+			TotalPackets:     totalPackets,
+			TotalBytes:       totalBytes,
+			AccountedPackets: accountedPackets,
+			AccountedBytes:   accountedBytes,
+			CaptureStart:     first,
+			CaptureEnd:       last,
+			CaptureTimezone:  opts.Timezone,
+			Notes:            []string{"sketch: accounted packets are those between a local and a remote endpoint, estimated by remote endpoint without flows"},
+		},
+		Counters:  capacity,
+		RemoteIPs: byIP.top(opts.SketchTop, netip.Addr.String),
+		DNSNames:  byName.top(opts.SketchTop, func(name string) string { return name }),
+	}
+	for i := range sketch.RemoteIPs {
+		ip, _ := netip.ParseAddr(sketch.RemoteIPs[i].Key)
+		sketch.RemoteIPs[i].DNSName = names[ip]
+	}
+	return sketch, nil
+}
+
+// SketchPacketStats writes the EndpointSketch of a capture to outPath.
+// @return the meta block of the written sketch, nil if the capture could not be read
+func SketchPacketStats(ctx context.Context, filePath string, outPath string, opts Options) *Meta {
+	fmt.Println("========== Sketching file: " + filePath + " ==========")
+	start := time.Now()
+	sketch, err := sketchCapture(ctx, filePath, opts)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	meta := sketch.Meta
+	if opts.HashOutputs {
+		meta.hashes = &outputHashes{}
+	}
+	fmt.Printf("%s: %d packets sketched in %s\n", filePath, meta.TotalPackets, time.Since(start).Round(time.Millisecond))
+	fmt.Printf("========== Writing to file: %s ==========\n", outPath)
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	content, err := marshalOutput(sketch, opts.LegacyNames)
+	if err == nil {
+		err = writeOutputFile(outPath, content, meta.hashes)
+	}
+	if err != nil {
+		fmt.Println("unable to write sketch:", err)
+		return nil
+	}
+	return meta
+}
+
+// readSketch reads an EndpointSketch written with Options.Sketch.
+func readSketch(path string) (*EndpointSketch, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sketch := &EndpointSketch{}
+	if err := json.Unmarshal(content, sketch); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return sketch, nil
+}
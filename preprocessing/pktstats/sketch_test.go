@@ -0,0 +1,101 @@
+package pktstats
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// sketchPacket is a packet of bytes counted for a key of a sketch.
+type sketchPacket struct {
+	key   string
+	bytes int64
+}
+
+func TestSpaceSaving(t *testing.T) {
+	identity := func(key string) string { return key }
+	tests := []struct {
+		name     string
+		capacity int
+		top      int
+		packets  []sketchPacket
+		want     []SketchEntry
+	}{
+		{
+			name:     "exact under capacity",
+			capacity: 3,
+			top:      2,
+			packets:  []sketchPacket{{"a", 100}, {"b", 50}, {"a", 10}, {"c", 20}},
+			want:     []SketchEntry{{Key: "a", Bytes: 110, Packets: 2, Guaranteed: true}, {Key: "b", Bytes: 50, Packets: 1, Guaranteed: true}},
+		},
+		{
+			name:     "ties by key",
+			capacity: 3,
+			top:      3,
+			packets:  []sketchPacket{{"b", 50}, {"a", 50}},
+			want:     []SketchEntry{{Key: "a", Bytes: 50, Packets: 1, Guaranteed: true}, {Key: "b", Bytes: 50, Packets: 1, Guaranteed: true}},
+		},
+		{
+			// c takes the counter of b, the smallest, inheriting its 50 bytes
+			// as error: its 10 actual bytes may be fewer than those of b
+			name:     "replaced",
+			capacity: 2,
+			top:      2,
+			packets:  []sketchPacket{{"a", 100}, {"b", 50}, {"c", 10}},
+			want:     []SketchEntry{{Key: "a", Bytes: 100, Packets: 1, Guaranteed: true}, {Key: "c", Bytes: 60, ErrorBytes: 50, Packets: 1}},
+		},
+		{
+			// the heavy endpoint arriving late is listed, its estimate an
+			// upper bound of its bytes
+			name:     "heavy endpoint after light ones",
+			capacity: 3,
+			top:      1,
+			packets:  []sketchPacket{{"a", 10}, {"b", 20}, {"c", 30}, {"d", 1000}, {"d", 1000}},
+			want:     []SketchEntry{{Key: "d", Bytes: 2010, ErrorBytes: 10, Packets: 2, Guaranteed: true}},
+		},
+		{
+			name:     "empty",
+			capacity: 3,
+			top:      2,
+			want:     []SketchEntry{},
+		},
+	}
+	for _, test := range tests {
+		sketch := newSpaceSaving[string](test.capacity)
+		for _, packet := range test.packets {
+			sketch.add(packet.key, packet.bytes)
+		}
+		if got := sketch.top(test.top, identity); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: top %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestSketchCapture sketches the capture of the game and store flows, whose
+// bytes the sketch counts exactly with counters to spare. The DNS responses,
+// between local endpoints, are not counted.
+func TestSketchCapture(t *testing.T) {
+	opts := testOptions()
+	opts.Sketch, opts.SketchTop = true, 2
+	sketch, err := sketchCapture(context.Background(), fixture(t, "flows.pcap", flowsCapture), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantIPs := []SketchEntry{
+		{Key: "203.0.113.10", DNSName: "eu1.game.example.com", Bytes: 25470, Packets: 40, Guaranteed: true},
+		{Key: "198.51.100.7", DNSName: "store.example.net", Bytes: 1968, Packets: 8, Guaranteed: true},
+	}
+	if !reflect.DeepEqual(sketch.RemoteIPs, wantIPs) {
+		t.Errorf("remote IPs %+v, want %+v", sketch.RemoteIPs, wantIPs)
+	}
+	wantNames := []SketchEntry{
+		{Key: "eu1.game.example.com", Bytes: 25470, Packets: 40, Guaranteed: true},
+		{Key: "store.example.net", Bytes: 1968, Packets: 8, Guaranteed: true},
+	}
+	if !reflect.DeepEqual(sketch.DNSNames, wantNames) {
+		t.Errorf("DNS names %+v, want %+v", sketch.DNSNames, wantNames)
+	}
+	if meta := sketch.Meta; sketch.Counters != 20 || meta.TotalPackets != 50 || meta.AccountedPackets != 48 || meta.AccountedBytes != 25470+1968 {
+		t.Errorf("%d counters, %d packets of which %d of %d bytes accounted, want 20, 50 and 48 of %d", sketch.Counters, meta.TotalPackets, meta.AccountedPackets, meta.AccountedBytes, 25470+1968)
+	}
+}
@@ -0,0 +1,128 @@
+package pktstats
+
+import "net"
+
+// Label precedences, see Options.LabelPrecedence: which of the DNS name and
+// the SNI of a flow labels it when their registered domains differ.
+const (
+	precedenceDNS = "dns" // the captured DNS answer, as without an SNI
+	precedenceSNI = "sni" // the name the client asked the server for
+)
+
+var labelPrecedences = []string{precedenceDNS, precedenceSNI}
+
+// sniMaxPackets bounds the upstream payload-bearing segments of a TCP flow
+// buffered for its ClientHello.
+const sniMaxPackets = 4
+
+// sniMaxHello bounds the size of a buffered ClientHello record.
+const sniMaxHello = 16 << 10
+
+// TLS handshake record and message types, and the server_name extension
+const (
+	tlsHandshake        = 22
+	tlsClientHello      = 1
+	extensionServerName = 0
+)
+
+// SNIDisagreement records a flow whose SNI and DNS name belong to
+// different registered domains, e.g. a CDN address reused by another
+// provider or a stale DNS map, and which of them labels the flow.
+type SNIDisagreement struct {
+	DNSName   string `json:"dnsName"`
+	DNSSource string `json:"dnsSource"` // label source of the DNS name, e.g. dns or nrb
+	SNI       string `json:"sni"`
+	Chosen    string `json:"chosen"` // dns or sni
+	Reason    string `json:"reason"`
+}
+
+// sniState buffers the first upstream segments of a TCP flow until they hold
+// a whole ClientHello record.
+type sniState struct {
+	done    bool
+	packets int
+	buffer  []byte
+	name    string
+}
+
+// observe buffers an upstream payload of a TCP flow.
+func (state *sniState) observe(payload []byte) {
+	if state.done || len(payload) == 0 {
+		return
+	}
+	state.packets++
+	if len(state.buffer) == 0 && (len(payload) < 6 || payload[0] != tlsHandshake || payload[5] != tlsClientHello) {
+		// not a TLS connection, or captured after its handshake
+		state.done = true
+		return
+	}
+	state.buffer = append(state.buffer, payload...)
+	length := int(state.buffer[3])<<8 | int(state.buffer[4])
+	if len(state.buffer) >= 5+length {
+		state.name = parseClientHelloSNI(state.buffer[5 : 5+length])
+		state.done, state.buffer = true, nil
+	} else if state.packets >= sniMaxPackets || length > sniMaxHello {
+		state.done, state.buffer = true, nil
+	}
+}
+
+// parseClientHelloSNI returns the host name of the server_name extension of
+// a TLS ClientHello handshake message, empty without one.
+func parseClientHelloSNI(message []byte) string {
+	r := byteReader{data: message}
+	if r.uint8() != tlsClientHello {
+		return ""
+	}
+	r.skip(3)  // length
+	r.skip(2)  // legacy version
+	r.skip(32) // random
+	r.skip(int(r.uint8()))
+	r.skip(int(r.uint16()))
+	r.skip(int(r.uint8())) // compression methods
+	block := byteReader{data: r.bytes(int(r.uint16()))}
+	for !r.failed && !block.failed && block.remaining() > 0 {
+		extensionType := block.uint16()
+		extension := byteReader{data: block.bytes(int(block.uint16()))}
+		if extensionType != extensionServerName {
+			continue
+		}
+		list := byteReader{data: extension.bytes(int(extension.uint16()))}
+		for !extension.failed && !list.failed && list.remaining() > 0 {
+			nameType := list.uint8()
+			name := list.bytes(int(list.uint16()))
+			if nameType == 0 && !list.failed {
+				return string(name)
+			}
+		}
+	}
+	return ""
+}
+
+// resolveSNI stores the SNI of a TLS flow and, when it belongs to another
+// registered domain than its DNS name, records the disagreement and labels
+// the flow with the name that takes precedence. It reports whether they
+// disagreed.
+func (flow *Flow) resolveSNI(precedence string, telemetry domainSuffixes) bool {
+	name, ok := normalizeDNSName(flow.sni.name)
+	if !ok || net.ParseIP(name) != nil {
+		// IP literals and malformed names are not hostnames
+		return false
+	}
+	flow.SNI = name
+	if flow.DNSName == "" || registeredDomain(name) == flow.RegisteredDomain {
+		return false
+	}
+	disagreement := &SNIDisagreement{DNSName: flow.DNSName, DNSSource: flow.LabelSource, SNI: name, Chosen: precedenceDNS}
+	if precedence == precedenceSNI {
+		disagreement.Chosen = precedenceSNI
+		disagreement.Reason = "the SNI takes precedence over DNS answers"
+		labelFlow(flow, name, telemetry)
+		if flow.LabelSource == labelDNS {
+			flow.LabelSource = labelSNI
+		}
+	} else {
+		disagreement.Reason = "DNS answers take precedence over the SNI"
+	}
+	flow.LabelDisagreement = disagreement
+	return true
+}
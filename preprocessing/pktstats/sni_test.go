@@ -0,0 +1,117 @@
+package pktstats
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// tlsExtension returns an extension of a ClientHello.
+func tlsExtension(extensionType uint16, data []byte) []byte {
+	extension := binary.BigEndian.AppendUint16(nil, extensionType)
+	extension = binary.BigEndian.AppendUint16(extension, uint16(len(data)))
+	return append(extension, data...)
+}
+
+// serverName returns the server_name extension of a ClientHello with a
+// host name.
+func serverName(name string) []byte {
+	entry := append([]byte{0}, binary.BigEndian.AppendUint16(nil, uint16(len(name)))...)
+	entry = append(entry, name...)
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(entry)))
+	return tlsExtension(extensionServerName, append(list, entry...))
+}
+
+// clientHello returns the TLS record of a ClientHello with a session ID and
+// the extensions given.
+func clientHello(extensions ...[]byte) []byte {
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)    // random
+	body = append(body, 8)                      // session ID
+	body = append(body, make([]byte, 8)...)     // session ID
+	body = append(body, 0, 4, 0x13, 1, 0x13, 2) // cipher suites
+	body = append(body, 1, 0)                   // null compression
+	var block []byte
+	for _, extension := range extensions {
+		block = append(block, extension...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(block)))
+	body = append(body, block...)
+	message := []byte{tlsClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	message = append(message, body...)
+	record := []byte{tlsHandshake, 3, 1}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(message)))
+	return append(record, message...)
+}
+
+// split cuts a payload into segments of at most size bytes.
+func split(payload []byte, size int) [][]byte {
+	var segments [][]byte
+	for len(payload) > size {
+		segments = append(segments, payload[:size])
+		payload = payload[size:]
+	}
+	return append(segments, payload)
+}
+
+func TestSNIStateObserve(t *testing.T) {
+	hello := clientHello(tlsExtension(10, []byte{0, 2, 0, 29}), serverName("play.example.com"), tlsExtension(43, []byte{2, 3, 4}))
+	truncated := clientHello(serverName("play.example.com"))
+	truncated[len(truncated)-20] = 0xff // name length past the extension
+	tests := []struct {
+		name     string
+		segments [][]byte
+		sni      string
+		done     bool
+	}{
+		{"whole", [][]byte{hello}, "play.example.com", true},
+		{"split", split(hello, 60), "play.example.com", true},
+		{"empty segments skipped", [][]byte{hello[:60], nil, hello[60:]}, "play.example.com", true},
+		{"split over too many segments", split(hello, 20), "", true},
+		{"incomplete", [][]byte{hello[:60]}, "", false},
+		{"no server name", [][]byte{clientHello(tlsExtension(10, []byte{0, 2, 0, 29}))}, "", true},
+		{"malformed server name", [][]byte{truncated}, "", true},
+		{"not TLS", [][]byte{[]byte("GET / HTTP/1.1\r\nHost: play.example.com\r\n\r\n")}, "", true},
+		{"after the handshake", [][]byte{{23, 3, 3, 0, 2, 1, 2}, hello}, "", true},
+	}
+	for _, test := range tests {
+		var state sniState
+		for _, segment := range test.segments {
+			state.observe(segment)
+		}
+		if state.name != test.sni || state.done != test.done {
+			t.Errorf("%s: SNI %q done %v, want %q %v", test.name, state.name, state.done, test.sni, test.done)
+		}
+	}
+}
+
+func TestResolveSNI(t *testing.T) {
+	tests := []struct {
+		name       string
+		dnsName    string
+		sni        string
+		precedence string
+		wantName   string // DNSName after resolution
+		wantSource string
+		chosen     string // empty without a disagreement
+	}{
+		{"same domain", "eu1.game.example.com", "play.example.com", precedenceDNS, "eu1.game.example.com", labelDNS, ""},
+		{"dns precedence", "eu1.game.example.com", "cdn.example.net", precedenceDNS, "eu1.game.example.com", labelDNS, precedenceDNS},
+		{"sni precedence", "eu1.game.example.com", "cdn.example.net", precedenceSNI, "cdn.example.net", labelSNI, precedenceSNI},
+		{"case and trailing dot", "eu1.game.example.com", "Play.Example.COM.", precedenceSNI, "eu1.game.example.com", labelDNS, ""},
+		{"unresolved", "", "cdn.example.net", precedenceSNI, "", "", ""},
+		{"IP literal", "eu1.game.example.com", "203.0.113.10", precedenceSNI, "eu1.game.example.com", labelDNS, ""},
+	}
+	for _, test := range tests {
+		flow := &Flow{}
+		labelFlow(flow, test.dnsName, nil)
+		flow.sni.name = test.sni
+		disagreed := flow.resolveSNI(test.precedence, nil)
+		if disagreed != (test.chosen != "") || flow.DNSName != test.wantName || flow.LabelSource != test.wantSource {
+			t.Errorf("%s: disagreed %v, DNSName %q from %q, want %v, %q from %q", test.name, disagreed, flow.DNSName, flow.LabelSource, test.chosen != "", test.wantName, test.wantSource)
+		}
+		if disagreement := flow.LabelDisagreement; test.chosen != "" && (disagreement == nil || disagreement.Chosen != test.chosen ||
+			disagreement.DNSName != test.dnsName || disagreement.DNSSource != labelDNS || disagreement.SNI != test.sni) {
+			t.Errorf("%s: disagreement %+v, want %s chosen", test.name, disagreement, test.chosen)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package pktstats
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// stitchedCapture reads the rotated captures of a directory one after the
+// other as a single capture, in order of their first packet, so flows
+// spanning a rotation continue across files (Options.Stitch). A session ends
+// where the gap in capture time between the last packet of a file and the
+// first packet of the next exceeds maxGap, or where the link type changes;
+// the remaining files start the next session.
+type stitchedCapture struct {
+	files   []string // files not read yet, in capture time order
+	starts  map[string]time.Time
+	sizes   map[string]int64
+	maxGap  time.Duration
+	opts    Options  // of the captures, see openCapture
+	read    []string // files read in the current session
+	failed  []string // files that could not be opened
+	errs    []error  // read errors of the files of the current session
+	current *captureStream
+	release func()
+	link    layers.LinkType
+	last    time.Time // last packet read
+	// progress over the files remaining at the start of the session
+	total, done int64
+}
+
+// newStitchedCapture orders the files of a directory by their first packet,
+// sessions split at gaps above Options.StitchGap. Files that cannot be read
+// are returned separately.
+func newStitchedCapture(files []string, opts Options) (*stitchedCapture, []string) {
+	stitched := &stitchedCapture{
+		starts: make(map[string]time.Time),
+		sizes:  make(map[string]int64),
+		maxGap: opts.StitchGap,
+		opts:   opts,
+	}
+	var failed []string
+	for _, file := range files {
+		start, err := captureStart(file, opts)
+		if err != nil {
+			fmt.Println("unable to open pcap", err)
+			failed = append(failed, file)
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			stitched.sizes[file] = info.Size()
+		}
+		stitched.starts[file] = start
+		stitched.files = append(stitched.files, file)
+	}
+	sort.SliceStable(stitched.files, func(i, j int) bool {
+		return stitched.starts[stitched.files[i]].Before(stitched.starts[stitched.files[j]])
+	})
+	return stitched, failed
+}
+
+// captureStart returns the timestamp of the first packet of a capture, the
+// zero time for captures without packets.
+func captureStart(filePath string, opts Options) (time.Time, error) {
+	handle, closeCapture, err := openCapture(filePath, opts)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer closeCapture()
+	_, ci, err := handle.ReadPacketData()
+	if err != nil {
+		return time.Time{}, handle.err
+	}
+	return ci.Timestamp, nil
+}
+
+// startSession opens the first remaining file and returns the capture of the
+// session starting with it.
+func (stitched *stitchedCapture) startSession() (*captureStream, error) {
+	stitched.read, stitched.failed, stitched.errs = nil, nil, nil
+	stitched.total, stitched.done = 0, 0
+	for _, file := range stitched.files {
+		stitched.total += stitched.sizes[file]
+	}
+	if err := stitched.open(); err != nil {
+		return nil, err
+	}
+	stitched.link = stitched.current.LinkType()
+	return &captureStream{captureReader: stitched, progress: stitched}, nil
+}
+
+// close releases the file being read if a session is stopped before its end.
+func (stitched *stitchedCapture) close() {
+	if stitched.current != nil {
+		stitched.release()
+		stitched.current = nil
+	}
+}
+
+// open opens the next remaining file, which is then read or failed.
+func (stitched *stitchedCapture) open() error {
+	file := stitched.files[0]
+	stitched.files = stitched.files[1:]
+	current, release, err := openCapture(file, stitched.opts)
+	if err != nil {
+		stitched.failed = append(stitched.failed, file)
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	stitched.current, stitched.release = current, release
+	stitched.read = append(stitched.read, file)
+	return nil
+}
+
+func (stitched *stitchedCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for stitched.current != nil {
+		data, ci, err := stitched.current.ReadPacketData()
+		if err == nil {
+			stitched.last = ci.Timestamp
+			return data, ci, nil
+		}
+		// the current file ended, keeping what was read of a damaged file
+		stitched.current.rethrow()
+		stitched.current.finishHash()
+		file := stitched.read[len(stitched.read)-1]
+		if stitched.current.err != nil {
+			stitched.errs = append(stitched.errs, fmt.Errorf("%s: %w", file, stitched.current.err))
+		}
+		stitched.release()
+		stitched.current = nil
+		stitched.done += stitched.sizes[file]
+		for len(stitched.files) > 0 {
+			next := stitched.files[0]
+			// capture time, not wall clock: files may be processed long after they were written
+			if stitched.starts[next].Sub(stitched.last) > stitched.maxGap {
+				break
+			}
+			if err := stitched.open(); err != nil {
+				stitched.errs = append(stitched.errs, err)
+				continue
+			}
+			if stitched.current.LinkType() != stitched.link {
+				// another session, reopened from the start
+				stitched.release()
+				stitched.current = nil
+				stitched.read = stitched.read[:len(stitched.read)-1]
+				stitched.files = append([]string{next}, stitched.files...)
+			}
+			break
+		}
+	}
+	if err := errors.Join(stitched.errs...); err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (stitched *stitchedCapture) LinkType() layers.LinkType {
+	return stitched.link
+}
+
+func (stitched *stitchedCapture) observe(captureLength int) {
+	if stitched.current != nil {
+		stitched.current.progress.observe(captureLength)
+	}
+}
+
+func (stitched *stitchedCapture) fraction() (float64, bool) {
+	done := float64(stitched.done)
+	if stitched.current != nil {
+		if fraction, ok := stitched.current.progress.fraction(); ok {
+			done += min(fraction, 1) * float64(stitched.sizes[stitched.read[len(stitched.read)-1]])
+		}
+	}
+	return done / float64(max(stitched.total, 1)), true
+}
+
+// groupByDirectory groups inputs by directory, in order of each directory's
+// first input.
+func groupByDirectory(inputs []string) [][]string {
+	index := make(map[string]int)
+	var groups [][]string
+	for _, input := range inputs {
+		dir := filepath.Dir(input)
+		i, ok := index[dir]
+		if !ok {
+			i = len(groups)
+			index[dir] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], input)
+	}
+	return groups
+}
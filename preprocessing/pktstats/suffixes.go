@@ -0,0 +1,28 @@
+package pktstats
+
+import "strings"
+
+// domainSuffixes matches DNS names against a set of domain suffixes, e.g.
+// "nvidiagrid.net" matches itself and all its subdomains. It is the single
+// suffix matcher used by the payload capture filter and the telemetry blocklist.
+type domainSuffixes []string
+
+// add appends a suffix, ignoring case and a trailing dot.
+func (suffixes *domainSuffixes) add(suffix string) {
+	*suffixes = append(*suffixes, canonicalDNSName(suffix))
+}
+
+// matches reports whether a DNS name, normalized as the names of the DNS map,
+// is or is under one of the suffixes. Invalid names match none.
+func (suffixes domainSuffixes) matches(name string) bool {
+	name, ok := normalizeDNSName(name)
+	if !ok {
+		return false
+	}
+	for _, suffix := range suffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package pktstats
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// findOutputs walks basePath and calls fn for every output with a meta block.
+func findOutputs(basePath string, fn func(path string, meta *Meta)) error {
+	return filepath.WalkDir(basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(path)
+		if d.IsDir() || (ext != ".json" && ext != ".ndjson") || strings.HasSuffix(path, outputIndexSuffix) {
+			return nil
+		}
+		meta, err := readMeta(path)
+		if err != nil {
+			return nil
+		}
+		fn(path, meta)
+		return nil
+	})
+}
+
+// SummarizeMain implements the summarize subcommand, printing per-output
+// coverage: the share of the capture's packets and bytes accounted for by flows.
+func SummarizeMain(args []string) {
+	fs := flag.NewFlagSet("summarize", flag.ExitOnError)
+	basePath := fs.String("p", "../data/", "Base path to the outputs")
+	minCoverage := fs.Float64("min-coverage", 50, "Mark outputs whose packet coverage is below this percentage")
+	times := fs.String("times", "utc", "Time zone of the capture start times: utc, or capture for the zone recorded with -tz")
+	listFlows := fs.Bool("flows", false, "List the flows of each output with their service, duration and bytes, from the flow index of the output when present")
+	fs.Parse(args)
+	if *times != "utc" && *times != "capture" {
+		fmt.Println("-times must be utc or capture")
+		os.Exit(1)
+	}
+
+	fmt.Printf("%-60s %-24s %12s %9s %9s %12s\n", "Output", "Start", "Packets", "Pkt cov", "Byte cov", "Kernel drops")
+	err := findOutputs(*basePath, func(path string, meta *Meta) {
+		packetCoverage := percentage(meta.AccountedPackets, meta.TotalPackets)
+		byteCoverage := percentage(meta.AccountedBytes, meta.TotalBytes)
+		drops := "n/a"
+		if meta.KernelDrops != nil {
+			drops = fmt.Sprint(*meta.KernelDrops)
+		}
+		marker := ""
+		if packetCoverage < *minCoverage {
+			marker = "  <-- low coverage"
+		}
+		start := captureTime(meta.CaptureStart, meta, *times == "capture")
+		fmt.Printf("%-60s %-24s %12d %8.1f%% %8.1f%% %12s%s\n", path, start, meta.TotalPackets, packetCoverage, byteCoverage, drops, marker)
+		if *listFlows {
+			printFlows(path, meta)
+		}
+	})
+	if err != nil {
+		fmt.Println("Error walking the path:", err)
+		os.Exit(1)
+	}
+}
+
+// printFlows lists the flows of an output in order of their first packet. The
+// flow index of the output spares loading their packets, see OutputIndex.
+func printFlows(path string, meta *Meta) {
+	if meta.Options.IndexOnly {
+		return
+	}
+	records := make(map[string]FlowRecord)
+	if index, err := readOutputIndex(path); err == nil {
+		records = index.Flows
+	} else {
+		output, err := LoadFlows(path)
+		if err != nil {
+			fmt.Println("    Error loading the flows:", err)
+			return
+		}
+		for group, flows := range map[string]map[string]*Flow{"": output.Flows, groupThirdParty: output.ThirdPartyFlows, groupMirror: output.MirrorFlows} {
+			for key, flow := range flows {
+				records[key] = newFlowRecord(flow, group)
+			}
+		}
+	}
+	keys := sortedKeys(records)
+	sort.SliceStable(keys, func(i, j int) bool { return records[keys[i]].Start < records[keys[j]].Start })
+	for _, key := range keys {
+		record := records[key]
+		duration := (time.Duration(meta.Options.microseconds(record.End-record.Start)) * time.Microsecond).Round(time.Millisecond)
+		fmt.Printf("    %-56s %-24s %12s %14d\n", key, record.Service, duration, record.Bytes)
+	}
+}
+
+func percentage(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
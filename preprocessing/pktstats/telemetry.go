@@ -0,0 +1,37 @@
+package pktstats
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// telemetryRole is the ServiceFlowType of flows to telemetry and advertising domains.
+const telemetryRole = "telemetry"
+
+// defaultTelemetryList is the embedded blocklist, replaced by Options.TelemetryList.
+//
+//go:embed telemetry_domains.txt
+var defaultTelemetryList string
+
+// loadTelemetryList parses the blocklist at path, or the embedded one if path is empty.
+func loadTelemetryList(path string) (domainSuffixes, error) {
+	list := defaultTelemetryList
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read telemetry list: %w", err)
+		}
+		list = string(content)
+	}
+	var suffixes domainSuffixes
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		suffixes.add(line)
+	}
+	return suffixes, nil
+}
@@ -0,0 +1,65 @@
+package pktstats
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// defaultOutTemplate reproduces the historical <dir>/<base>_packetStats.json naming.
+const defaultOutTemplate = "{dir}/{base}_packetStats.{format}"
+
+// tokens accepted in output filename templates
+var templateTokens = []string{"dir", "base", "ext", "format", "client"}
+
+// validateOutTemplate checks that an output filename template only uses known
+// tokens and contains {base}, so that different inputs never share an output.
+func validateOutTemplate(template string) error {
+	hasBase := false
+	rest := template
+	for {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			break
+		}
+		if rest[start] == '}' {
+			return fmt.Errorf("unbalanced '}' in output template %q", template)
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return fmt.Errorf("unterminated token in output template %q", template)
+		}
+		token := rest[start+1 : start+end]
+		if !containsString(templateTokens, token) {
+			return fmt.Errorf("unknown token {%s} in output template %q, expected one of {%s}", token, template, strings.Join(templateTokens, "}, {"))
+		}
+		hasBase = hasBase || token == "base"
+		rest = rest[start+end+1:]
+	}
+	if !hasBase {
+		return fmt.Errorf("output template %q must contain {base}", template)
+	}
+	return nil
+}
+
+// outputPath expands the output filename template for an input file. The
+// {client} token is left in place until the local clients are known.
+func outputPath(template, inputPath, format string) string {
+	ext := captureExt(inputPath)
+	replacer := strings.NewReplacer(
+		"{dir}", filepath.Dir(inputPath),
+		"{base}", strings.TrimSuffix(filepath.Base(inputPath), ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+		"{format}", format,
+	)
+	return filepath.Clean(replacer.Replace(template))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
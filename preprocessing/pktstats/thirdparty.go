@@ -0,0 +1,67 @@
+package pktstats
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maximum number of distinct address pairs sampled for third-party packets
+const maxThirdPartySamples = 10
+
+// thirdParty values accepted by Options.ThirdParty
+var thirdPartyPolicies = []string{"drop", "keep"}
+
+// thirdPartyStats counts packets for which neither endpoint is local (e.g. transit
+// traffic in captures taken upstream of the NAT) and keeps a bounded sample of the
+// address pairs involved.
+type thirdPartyStats struct {
+	packets int
+	samples []AddrPair
+	seen    map[AddrPair]bool
+}
+
+// AddrPair is the source and destination address of a packet.
+type AddrPair struct {
+	SrcIP string `json:"srcIP"`
+	DstIP string `json:"dstIP"`
+}
+
+func (stats *thirdPartyStats) record(srcIP, dstIP string) {
+	stats.packets++
+	if len(stats.samples) >= maxThirdPartySamples {
+		return
+	}
+	pair := AddrPair{SrcIP: srcIP, DstIP: dstIP}
+	if stats.seen == nil {
+		stats.seen = make(map[AddrPair]bool)
+	}
+	if !stats.seen[pair] {
+		stats.seen[pair] = true
+		stats.samples = append(stats.samples, pair)
+	}
+}
+
+// report prints a one-line summary of the third-party packets of a file.
+func (stats *thirdPartyStats) report(policy string) {
+	if stats.packets == 0 {
+		return
+	}
+	action := "Dropped"
+	if policy == "keep" {
+		action = "Kept"
+	}
+	pairs := make([]string, len(stats.samples))
+	for i, pair := range stats.samples {
+		pairs[i] = pair.SrcIP + " -> " + pair.DstIP
+	}
+	fmt.Printf("%s %d packets with no local IP address, e.g. %s\n", action, stats.packets, strings.Join(pairs, ", "))
+}
+
+func isThirdPartyPolicy(policy string) bool {
+	for _, p := range thirdPartyPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
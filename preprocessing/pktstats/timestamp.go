@@ -0,0 +1,60 @@
+package pktstats
+
+import (
+	"fmt"
+	"time"
+)
+
+// timestampUnits maps the output timestamp precisions to their unit in nanoseconds.
+// Capture timestamps are read in nanoseconds, honoring the resolution of each
+// pcapng interface, and only then converted to the output precision.
+var timestampUnits = map[string]int64{
+	"us": int64(time.Microsecond),
+	"ns": int64(time.Nanosecond),
+}
+
+func isTimestampPrecision(precision string) bool {
+	_, ok := timestampUnits[precision]
+	return ok
+}
+
+// timestampUnit returns the unit of the output precision in nanoseconds,
+// microseconds when no precision is set.
+func (opts Options) timestampUnit() int64 {
+	if unit, ok := timestampUnits[opts.TimestampPrecision]; ok {
+		return unit
+	}
+	return int64(time.Microsecond)
+}
+
+// timestamp converts a capture timestamp to the output precision.
+func (opts Options) timestamp(t time.Time) int64 {
+	return t.UnixNano() / opts.timestampUnit()
+}
+
+// duration converts a duration to timestamp units of the output precision.
+func (opts Options) duration(d time.Duration) int64 {
+	return d.Nanoseconds() / opts.timestampUnit()
+}
+
+// microseconds converts a timestamp in the output precision to microseconds.
+func (opts Options) microseconds(timestamp int64) int64 {
+	return timestamp * opts.timestampUnit() / int64(time.Microsecond)
+}
+
+// captureTime formats a timestamp of an output in UTC or, with inZone set,
+// in the time zone recorded for its capture host, Meta.CaptureTimezone.
+func captureTime(timestamp int64, meta *Meta, inZone bool) string {
+	if timestamp == 0 {
+		return "n/a"
+	}
+	t := time.UnixMicro(meta.Options.microseconds(timestamp)).UTC()
+	if inZone && meta.CaptureTimezone != "" {
+		location, err := time.LoadLocation(meta.CaptureTimezone)
+		if err != nil {
+			return fmt.Sprintf("%s (unknown zone %s)", t.Format(time.DateTime), meta.CaptureTimezone)
+		}
+		t = t.In(location)
+	}
+	return t.Format("2006-01-02 15:04:05 MST")
+}
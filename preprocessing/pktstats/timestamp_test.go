@@ -0,0 +1,131 @@
+package pktstats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+	"time"
+)
+
+// ngPacket is a packet of a crafted pcapng capture, captured on interface iface.
+type ngPacket struct {
+	iface int
+	fixturePacket
+}
+
+// pcapngCapture writes a pcapng section with an Ethernet interface for each
+// of resolutions, its if_tsresol as a negative power of 10, and the packets
+// with their timestamps in the resolution of their interface. pcapgo writes
+// every interface in nanoseconds, so the blocks are written here.
+func pcapngCapture(resolutions []uint8, packets []ngPacket) []byte {
+	var buffer bytes.Buffer
+	block := func(blockType uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		length := uint32(12 + len(body))
+		buffer.Write(binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, blockType), length))
+		buffer.Write(body)
+		buffer.Write(binary.LittleEndian.AppendUint32(nil, length))
+	}
+
+	// section header: byte order magic, version 1.0, unspecified section length
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1a2b3c4d)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	block(0x0a0d0d0a, binary.LittleEndian.AppendUint64(shb, ^uint64(0)))
+	for _, resolution := range resolutions {
+		idb := binary.LittleEndian.AppendUint16(nil, 1) // LINKTYPE_ETHERNET
+		idb = binary.LittleEndian.AppendUint16(idb, 0)
+		idb = binary.LittleEndian.AppendUint32(idb, 65535)
+		// if_tsresol, padded to 4 bytes, then opt_endofopt
+		idb = append(idb, 9, 0, 1, 0, resolution, 0, 0, 0, 0, 0, 0, 0)
+		block(1, idb)
+	}
+	for _, packet := range packets {
+		ts := uint64(fixtureStart.Add(packet.at).UnixNano())
+		for i := resolutions[packet.iface]; i < 9; i++ {
+			ts /= 10
+		}
+		epb := binary.LittleEndian.AppendUint32(nil, uint32(packet.iface))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet.data)))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(max(packet.length, len(packet.data))))
+		block(6, append(epb, packet.data...))
+	}
+	return buffer.Bytes()
+}
+
+const (
+	// cadences of the upstream flows of mixedResolutionCapture
+	nsInterfaceGap = 8 * time.Millisecond  // 125 Hz
+	usInterfaceGap = 16 * time.Millisecond // 62.5 Hz
+	// offsets of their packets, below the resolution of the other interface
+	nsInterfaceOffset = 250 * time.Nanosecond
+	usInterfaceOffset = 3 * time.Microsecond
+	mixedFlowPackets  = 25
+)
+
+// mixedResolutionCapture has an interface with nanosecond timestamps and one
+// with microsecond timestamps, each capturing the input flow of a client.
+func mixedResolutionCapture(t testing.TB) []byte {
+	const client = "192.168.1.10"
+	packets := []ngPacket{
+		{0, fixturePacket{at: 0, data: dnsResponse(t, "192.168.1.1", 53, client, "eu1.game.example.com", "203.0.113.10")}},
+		{0, fixturePacket{at: 0, data: dnsResponse(t, "192.168.1.1", 53, client, "eu2.game.example.com", "203.0.113.11")}},
+	}
+	for i := 1; i <= mixedFlowPackets; i++ {
+		packets = append(packets,
+			ngPacket{0, fixturePacket{at: time.Duration(i)*nsInterfaceGap + nsInterfaceOffset, data: udpPacket(t, client, 50000, "203.0.113.10", 3478, make([]byte, 80))}},
+			ngPacket{1, fixturePacket{at: time.Duration(i)*usInterfaceGap + usInterfaceOffset, data: udpPacket(t, client, 50001, "203.0.113.11", 3479, make([]byte, 80))}},
+		)
+	}
+	slices.SortStableFunc(packets, func(a, b ngPacket) int { return int(a.at - b.at) })
+	return pcapngCapture([]uint8{9, 6}, packets)
+}
+
+// TestMixedTimestampResolutions reads the timestamps of each pcapng interface
+// in its own resolution, in both output precisions: neither the timestamps
+// nor the inter-arrival times of the flows are scaled by the other interface.
+func TestMixedTimestampResolutions(t *testing.T) {
+	capture := rawFixture(t, "tsresol.pcapng", mixedResolutionCapture)
+	flows := []struct {
+		key       string
+		gap       time.Duration
+		offset    time.Duration
+		frequency float64
+	}{
+		{"192.168.1.10:50000-203.0.113.10:3478@17", nsInterfaceGap, nsInterfaceOffset, 125},
+		{"192.168.1.10:50001-203.0.113.11:3479@17", usInterfaceGap, usInterfaceOffset, 62.5},
+	}
+	for _, precision := range []string{"us", "ns"} {
+		opts := testOptions()
+		opts.TimestampPrecision = precision
+		output, _ := extractFixture(t, capture, opts)
+		unit := timestampUnits[precision]
+		for _, want := range flows {
+			flow := output.Flows[want.key]
+			if flow == nil || len(flow.Packets) != mixedFlowPackets {
+				t.Fatalf("%s: flow %s not loaded with its %d packets", precision, want.key, mixedFlowPackets)
+			}
+			for i, packet := range flow.Packets {
+				at := time.Duration(i+1)*want.gap + want.offset
+				if timestamp := fixtureStart.Add(at).UnixNano() / unit; packet.Timestamp != timestamp {
+					t.Errorf("%s: packet %d of %s at %d, want %d", precision, i, want.key, packet.Timestamp, timestamp)
+					break
+				}
+				if i > 0 {
+					if iat := packet.Timestamp - flow.Packets[i-1].Timestamp; iat != int64(want.gap)/unit {
+						t.Errorf("%s: packet %d of %s %d after the previous one, want %d", precision, i, want.key, iat, int64(want.gap)/unit)
+						break
+					}
+				}
+			}
+			if flow.InputFrequencyHz != want.frequency || flow.InputRegularity != 1 {
+				t.Errorf("%s: flow %s input frequency %v Hz regularity %v, want %v Hz regularity 1", precision, want.key, flow.InputFrequencyHz, flow.InputRegularity, want.frequency)
+			}
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package pktstats
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// tlsMaxRecord bounds the length of a buffered TLS record: 16 KiB of
+// plaintext plus the largest expansion TLS 1.2 allows.
+const tlsMaxRecord = 16<<10 + 2048
+
+// TLS record content types, and the ServerHello handshake message type
+const (
+	tlsChangeCipherSpec = 20
+	tlsAlert            = 21
+	tlsApplicationData  = 23
+	tlsServerHello      = 2
+)
+
+// tlsContentTypes names the content types of Negotiation.ContentType.
+var tlsContentTypes = map[byte]string{
+	tlsChangeCipherSpec: "change_cipher_spec",
+	tlsAlert:            "alert",
+	tlsHandshake:        "handshake",
+	tlsApplicationData:  "application_data",
+}
+
+// tlsSuite is an AEAD cipher suite decrypted with the keys of a key log.
+type tlsSuite struct {
+	keyLen int
+	hash   func() hash.Hash
+	chacha bool // ChaCha20-Poly1305, AES-GCM otherwise
+}
+
+// tlsSuites are the supported cipher suites: those of TLS 1.3 and QUIC,
+// and the AEAD suites of TLS 1.2.
+var tlsSuites = map[uint16]tlsSuite{
+	0x1301: {16, sha256.New, false},    // TLS_AES_128_GCM_SHA256
+	0x1302: {32, sha512.New384, false}, // TLS_AES_256_GCM_SHA384
+	0x1303: {32, sha256.New, true},     // TLS_CHACHA20_POLY1305_SHA256
+	0xc02b: {16, sha256.New, false},    // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02f: {16, sha256.New, false},    // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {32, sha512.New384, false}, // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc030: {32, sha512.New384, false}, // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	0x009c: {16, sha256.New, false},    // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {32, sha512.New384, false}, // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0xcca8: {32, sha256.New, true},     // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	0xcca9: {32, sha256.New, true},     // TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+}
+
+// newAEAD returns the AEAD of a suite keyed with key.
+func (suite tlsSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	if suite.chacha {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tlsCipher decrypts the records of one direction of a TLS connection.
+type tlsCipher struct {
+	aead     cipher.AEAD
+	iv       []byte // TLS 1.3 and ChaCha20: XORed with the sequence number; TLS 1.2 AES-GCM: the implicit salt
+	seq      uint64
+	tls13    bool
+	active   bool // TLS 1.2: a ChangeCipherSpec was sent; TLS 1.3: an application data record was decrypted
+	explicit bool // TLS 1.2 AES-GCM: records start with an explicit nonce
+}
+
+// nonce returns the per-record nonce of the XOR construction.
+func (c *tlsCipher) nonce() []byte {
+	nonce := append([]byte(nil), c.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(c.seq >> (8 * i))
+	}
+	return nonce
+}
+
+// open decrypts a record, returning its content type and plaintext.
+func (c *tlsCipher) open(header, body []byte) (byte, []byte, bool) {
+	if c.tls13 {
+		plaintext, err := c.aead.Open(nil, c.nonce(), body, header)
+		if err != nil {
+			return 0, nil, false
+		}
+		// the inner content type is the last non-zero byte, followed by padding
+		end := len(plaintext)
+		for end > 0 && plaintext[end-1] == 0 {
+			end--
+		}
+		if end == 0 {
+			return 0, nil, false
+		}
+		return plaintext[end-1], plaintext[:end-1], true
+	}
+	var nonce []byte
+	if c.explicit {
+		if len(body) < 8 {
+			return 0, nil, false
+		}
+		nonce = append(append([]byte(nil), c.iv...), body[:8]...)
+		body = body[8:]
+	} else {
+		nonce = c.nonce()
+	}
+	length := len(body) - c.aead.Overhead()
+	if length < 0 {
+		return 0, nil, false
+	}
+	aad := binary.BigEndian.AppendUint64(nil, c.seq)
+	aad = append(aad, header[0], header[1], header[2], byte(length>>8), byte(length))
+	plaintext, err := c.aead.Open(nil, nonce, body, aad)
+	if err != nil {
+		return 0, nil, false
+	}
+	return header[0], plaintext, true
+}
+
+// tlsStream reassembles the records of one direction of a TCP stream, in
+// sequence order.
+type tlsStream struct {
+	started bool
+	nextSeq uint32
+	buffer  []byte
+}
+
+// tlsSession decrypts the records of a TLS connection over TCP whose client
+// random is in the key log. Directions are indexed by Packet.Upstream.
+type tlsSession struct {
+	streams [2]tlsStream
+	client  int // direction of the client, -1 until its ClientHello
+	random  []byte
+	secrets *keyLogSecrets
+	ciphers [2]*tlsCipher
+}
+
+func newTLSSession() *tlsSession {
+	return &tlsSession{client: -1}
+}
+
+// direction returns the index of the direction of a packet.
+func direction(packet *Packet) int {
+	if packet.Upstream {
+		return 1
+	}
+	return 0
+}
+
+// observe decrypts the records completed by a TCP segment. It reports
+// whether decryption can go on: the connection is TLS, its keys are in the
+// log and no segment was missed.
+func (session *tlsSession) observe(state *decryptState, packet *Packet, seq uint32, payload []byte) bool {
+	dir := direction(packet)
+	stream := &session.streams[dir]
+	if !stream.started {
+		if session.client < 0 && (len(payload) < 6 || payload[0] != tlsHandshake || payload[5] != tlsClientHello) {
+			// not a TLS connection, or captured after its handshake
+			return false
+		}
+		if !isTLSRecord(payload) {
+			return false
+		}
+		stream.started, stream.nextSeq = true, seq
+	}
+	// serial number arithmetic, as sequence numbers wrap around
+	offset := int32(stream.nextSeq - seq)
+	if offset < 0 {
+		// bytes were missed, the records are lost
+		return false
+	}
+	if int(offset) >= len(payload) {
+		return true // retransmission
+	}
+	payload = payload[offset:]
+	stream.nextSeq += uint32(len(payload))
+	stream.buffer = append(stream.buffer, payload...)
+	for len(stream.buffer) >= 5 {
+		if !isTLSRecord(stream.buffer) {
+			return false
+		}
+		length := int(stream.buffer[3])<<8 | int(stream.buffer[4])
+		if length > tlsMaxRecord {
+			return false
+		}
+		if len(stream.buffer) < 5+length {
+			break
+		}
+		header, body := stream.buffer[:5], stream.buffer[5:5+length]
+		if !session.handle(state, packet, dir, header, body) || state.done {
+			return false
+		}
+		stream.buffer = stream.buffer[5+length:]
+	}
+	if len(stream.buffer) == 0 {
+		stream.buffer = nil
+	}
+	return true
+}
+
+// handle reads the hellos of a connection and decrypts its protected
+// records once both are seen.
+func (session *tlsSession) handle(state *decryptState, packet *Packet, dir int, header, body []byte) bool {
+	if session.client < 0 {
+		if len(body) < 38 || body[0] != tlsClientHello {
+			return false
+		}
+		session.client, session.random = dir, append([]byte(nil), body[6:38]...)
+		// flows whose keys are not in the log are left alone
+		session.secrets = state.keys.lookup(session.random)
+		return session.secrets != nil
+	}
+	c := session.ciphers[dir]
+	switch {
+	case c == nil && dir != session.client && header[0] == tlsHandshake && len(body) >= 4 && body[0] == tlsServerHello:
+		length := int(body[1])<<16 | int(body[2])<<8 | int(body[3])
+		if len(body) < 4+length {
+			return false
+		}
+		return session.keys(body[4 : 4+length])
+	case c == nil:
+		return true
+	case header[0] == tlsChangeCipherSpec && !c.tls13:
+		c.active = true
+		return true
+	case header[0] == tlsChangeCipherSpec || !c.active && !c.tls13:
+		return true
+	}
+	if c.tls13 && header[0] != tlsApplicationData {
+		return true
+	}
+	contentType, plaintext, ok := c.open(header, body)
+	if !ok {
+		// TLS 1.3 handshake records are protected with handshake keys, which
+		// are not needed: the application keys open from the first
+		// application data record on
+		return c.tls13 && !c.active
+	}
+	c.seq++
+	c.active = true
+	name, ok := tlsContentTypes[contentType]
+	if !ok {
+		return false
+	}
+	state.record(packet, dir == session.client, name, nil, plaintext)
+	return true
+}
+
+// keys derives the record keys of both directions from a ServerHello body
+// and the secrets of the key log.
+func (session *tlsSession) keys(serverHello []byte) bool {
+	hello, extensions, ok := parseHello(serverHello, true)
+	if !ok || len(serverHello) < 34 {
+		return false
+	}
+	suite, ok := tlsSuites[hello.cipher]
+	if !ok {
+		return false
+	}
+	server := 1 - session.client
+	if version, found := extensions[extensionSupportedVersions]; found && len(version) == 2 && binary.BigEndian.Uint16(version) == 0x0304 {
+		if hello.cipher>>8 != 0x13 || session.secrets.clientTraffic == nil || session.secrets.serverTraffic == nil {
+			return false
+		}
+		var secrets [2][]byte
+		secrets[session.client], secrets[server] = session.secrets.clientTraffic, session.secrets.serverTraffic
+		for dir, secret := range secrets {
+			aead, err := suite.newAEAD(hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen))
+			if err != nil {
+				return false
+			}
+			session.ciphers[dir] = &tlsCipher{aead: aead, iv: hkdfExpandLabel(suite.hash, secret, "iv", 12), tls13: true}
+		}
+		return true
+	}
+	if hello.cipher>>8 == 0x13 || session.secrets.masterSecret == nil {
+		return false
+	}
+	// TLS 1.2 key block: client and server write keys, then their IVs
+	ivLen := 4
+	if suite.chacha {
+		ivLen = 12
+	}
+	seed := append(append([]byte(nil), serverHello[2:34]...), session.random...)
+	block := tls12PRF(suite.hash, session.secrets.masterSecret, "key expansion", seed, 2*suite.keyLen+2*ivLen)
+	for i, dir := range []int{session.client, server} {
+		aead, err := suite.newAEAD(block[i*suite.keyLen : (i+1)*suite.keyLen])
+		if err != nil {
+			return false
+		}
+		iv := block[2*suite.keyLen+i*ivLen : 2*suite.keyLen+(i+1)*ivLen]
+		session.ciphers[dir] = &tlsCipher{aead: aead, iv: iv, explicit: !suite.chacha}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package pktstats
+
+// tlsRecordBuckets are the upper bounds (exclusive) of the application data
+// record size buckets of TLSRecordStats.AppDataSizes; the last bucket holds
+// larger records, up to the 16 KiB record limit plus expansion.
+var tlsRecordBuckets = []int{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384}
+
+// TLSRecordStats counts the TLS records sent in one direction of a TCP flow.
+type TLSRecordStats struct {
+	Records        int   `json:"records"`                // records of any content type
+	AppDataRecords int   `json:"appDataRecords"`         // application data records
+	AppDataSizes   []int `json:"appDataSizes,omitempty"` // application data records by length, bucketed by tlsRecordBuckets
+}
+
+// tlsRecordState follows the record framing of one direction of a TCP stream
+// from the record headers, skipping record bodies by length.
+type tlsRecordState struct {
+	started   bool
+	truncated bool
+	nextSeq   uint32
+	remaining int     // bytes left of the current record body
+	header    [5]byte // partial record header spanning segments
+	headerLen int
+	stats     TLSRecordStats
+}
+
+// observeTLSRecords follows the TLS records of a TCP segment sent upstream
+// (or by the first endpoint, for canonically ordered flows) or downstream.
+func (flow *Flow) observeTLSRecords(upstream bool, seq uint32, payload []byte) {
+	state := &flow.tlsDown
+	if upstream {
+		state = &flow.tlsUp
+	}
+	state.observe(seq, payload)
+	if state.truncated {
+		flow.RecordsTruncated = true
+	}
+}
+
+func (state *tlsRecordState) observe(seq uint32, payload []byte) {
+	if state.truncated || len(payload) == 0 {
+		return
+	}
+	if !state.started {
+		// start at the first segment that begins with a record, e.g. mid-flow captures
+		if !isTLSRecord(payload) {
+			return
+		}
+		state.started = true
+		state.nextSeq = seq
+	}
+	// serial number arithmetic, as sequence numbers wrap around
+	offset := int32(state.nextSeq - seq)
+	if offset < 0 {
+		// bytes were missed, the framing is lost
+		state.truncated = true
+		return
+	}
+	if int(offset) >= len(payload) {
+		return // retransmission
+	}
+	payload = payload[offset:]
+	state.nextSeq += uint32(len(payload))
+	for len(payload) > 0 {
+		if state.remaining > 0 {
+			n := min(state.remaining, len(payload))
+			state.remaining -= n
+			payload = payload[n:]
+			continue
+		}
+		n := copy(state.header[state.headerLen:], payload)
+		state.headerLen += n
+		payload = payload[n:]
+		if state.headerLen < len(state.header) {
+			return
+		}
+		state.headerLen = 0
+		if !isTLSRecord(state.header[:]) {
+			state.truncated = true
+			return
+		}
+		length := int(state.header[3])<<8 | int(state.header[4])
+		state.remaining = length
+		state.stats.Records++
+		if state.header[0] == 23 {
+			state.stats.AppDataRecords++
+			if state.stats.AppDataSizes == nil {
+				state.stats.AppDataSizes = make([]int, len(tlsRecordBuckets)+1)
+			}
+			bucket := 0
+			for bucket < len(tlsRecordBuckets) && length >= tlsRecordBuckets[bucket] {
+				bucket++
+			}
+			state.stats.AppDataSizes[bucket]++
+		}
+	}
+}
+
+// tlsRecordStats returns the record counts of a direction, nil if no record was seen.
+func (state *tlsRecordState) tlsRecordStats() *TLSRecordStats {
+	if state.stats.Records == 0 {
+		return nil
+	}
+	stats := state.stats
+	return &stats
+}
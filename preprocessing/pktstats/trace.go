@@ -0,0 +1,221 @@
+package pktstats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// traceSuffix is appended to the output path to name the trace file of
+// Options.TraceFilter.
+const traceSuffix = ".trace.ndjson"
+
+// TraceRecord is the line of a trace file for one traced packet: the
+// filtering decisions made about it in order, and what became of it.
+type TraceRecord struct {
+	Timestamp   int64           `json:"timestamp"`
+	Packet      string          `json:"packet,omitempty"` // src:port-dst:port@protocol of IPv4 TCP and UDP packets
+	Decisions   []TraceDecision `json:"decisions"`
+	Disposition string          `json:"disposition"`
+}
+
+// TraceDecision is a filtering step taken for a traced packet.
+type TraceDecision struct {
+	Step   string `json:"step"`
+	Result string `json:"result"`
+}
+
+// decide records a filtering step.
+func (record *TraceRecord) decide(step, format string, args ...any) {
+	record.Decisions = append(record.Decisions, TraceDecision{Step: step, Result: fmt.Sprintf(format, args...)})
+}
+
+// dispose records what became of the packet, the last disposition wins.
+func (record *TraceRecord) dispose(format string, args ...any) {
+	record.Disposition = fmt.Sprintf(format, args...)
+}
+
+// traceEndpoint is an endpoint of a trace tuple, nil IP and 0 port for any.
+type traceEndpoint struct {
+	ip   net.IP
+	port int
+}
+
+func (endpoint traceEndpoint) matches(ip net.IP, port int) bool {
+	return (endpoint.ip == nil || endpoint.ip.Equal(ip)) && (endpoint.port == 0 || endpoint.port == port)
+}
+
+// traceTuple selects the IPv4 TCP and UDP packets of one or two endpoints,
+// in either direction.
+type traceTuple struct {
+	endpoints []traceEndpoint
+	protocol  int // 0 for any
+}
+
+// parseTraceTuple parses a tuple in the form of flow keys: one or two
+// endpoints "ip", "ip:port" or ":port" separated by "-", optionally
+// followed by "@" and the protocol, tcp, udp or its number.
+func parseTraceTuple(text string) (*traceTuple, error) {
+	tuple := &traceTuple{}
+	text, protocol, found := strings.Cut(text, "@")
+	if found {
+		switch strings.ToLower(protocol) {
+		case "tcp", "6":
+			tuple.protocol = 6
+		case "udp", "17":
+			tuple.protocol = 17
+		default:
+			return nil, fmt.Errorf("unknown protocol %q", protocol)
+		}
+	}
+	parts := strings.Split(text, "-")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("more than two endpoints")
+	}
+	for _, part := range parts {
+		var endpoint traceEndpoint
+		host := part
+		if strings.Contains(part, ":") {
+			var port string
+			var err error
+			if host, port, err = net.SplitHostPort(part); err != nil {
+				return nil, err
+			}
+			if endpoint.port, err = strconv.Atoi(port); err != nil || endpoint.port < 1 || endpoint.port > 65535 {
+				return nil, fmt.Errorf("invalid port %q", port)
+			}
+		}
+		if host != "" {
+			if endpoint.ip = net.ParseIP(host).To4(); endpoint.ip == nil {
+				return nil, fmt.Errorf("invalid IPv4 address %q", host)
+			}
+		}
+		tuple.endpoints = append(tuple.endpoints, endpoint)
+	}
+	return tuple, nil
+}
+
+func (tuple *traceTuple) matches(src, dst net.IP, srcPort, dstPort, protocol int) bool {
+	if tuple.protocol != 0 && tuple.protocol != protocol {
+		return false
+	}
+	first := tuple.endpoints[0]
+	if len(tuple.endpoints) == 1 {
+		return first.matches(src, srcPort) || first.matches(dst, dstPort)
+	}
+	second := tuple.endpoints[1]
+	return first.matches(src, srcPort) && second.matches(dst, dstPort) ||
+		first.matches(dst, dstPort) && second.matches(src, srcPort)
+}
+
+// parseTraceFilter parses Options.TraceFilter: a tuple, see parseTraceTuple,
+// or else a BPF expression compiled for linkType.
+func parseTraceFilter(filter string, linkType layers.LinkType) (*traceTuple, *pcap.BPF, error) {
+	tuple, tupleErr := parseTraceTuple(filter)
+	if tupleErr == nil {
+		return tuple, nil, nil
+	}
+	bpf, err := pcap.NewBPF(linkType, 65535, filter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%q is neither a tuple (%v) nor a BPF expression (%v)", filter, tupleErr, err)
+	}
+	return nil, bpf, nil
+}
+
+// filterTracer writes the TraceRecord of the packets matching
+// Options.TraceFilter, up to Options.TracePackets of them. A nil tracer
+// traces nothing.
+type filterTracer struct {
+	tuple     *traceTuple
+	bpf       *pcap.BPF
+	remaining int
+	traced    int
+	path      string
+	file      *os.File
+	writer    *bufio.Writer
+	encoder   *json.Encoder
+	current   *TraceRecord
+}
+
+// newFilterTracer returns the tracer of an extraction writing to path, nil
+// without Options.TraceFilter.
+func newFilterTracer(opts Options, linkType layers.LinkType, path string) (*filterTracer, error) {
+	if opts.TraceFilter == "" || path == "" {
+		return nil, nil
+	}
+	tuple, bpf, err := parseTraceFilter(opts.TraceFilter, linkType)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	return &filterTracer{tuple: tuple, bpf: bpf, remaining: opts.TracePackets, path: path, file: file, writer: writer, encoder: json.NewEncoder(writer)}, nil
+}
+
+// start writes the record of the previous traced packet and returns that of
+// a packet if it matches the filter, nil otherwise. Packets that are not
+// extracted keep the default disposition.
+func (tracer *filterTracer) start(ci gopacket.CaptureInfo, data []byte, decoded []gopacket.LayerType, ip4 *layers.IPv4, tcp *layers.TCP, udp *layers.UDP, timestamp int64) *TraceRecord {
+	tracer.flush()
+	if tracer.remaining <= 0 {
+		return nil
+	}
+	var src, dst net.IP
+	var srcPort, dstPort, protocol int
+	for _, layerType := range decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			src, dst, protocol = ip4.SrcIP, ip4.DstIP, int(ip4.Protocol)
+		case layers.LayerTypeTCP:
+			srcPort, dstPort = int(tcp.SrcPort), int(tcp.DstPort)
+		case layers.LayerTypeUDP:
+			srcPort, dstPort = int(udp.SrcPort), int(udp.DstPort)
+		}
+	}
+	if tracer.bpf != nil && !tracer.bpf.Matches(ci, data) || tracer.tuple != nil && (src == nil || !tracer.tuple.matches(src, dst, srcPort, dstPort, protocol)) {
+		return nil
+	}
+	tracer.remaining--
+	tracer.traced++
+	tracer.current = &TraceRecord{Timestamp: timestamp, Decisions: []TraceDecision{}, Disposition: "not extracted: not an IPv4 TCP or UDP packet"}
+	if src != nil && srcPort != 0 {
+		tracer.current.Packet = fmt.Sprintf("%s:%d-%s:%d@%d", src, srcPort, dst, dstPort, protocol)
+	}
+	return tracer.current
+}
+
+// flush writes the record of the last traced packet.
+func (tracer *filterTracer) flush() {
+	if tracer.current != nil {
+		tracer.encoder.Encode(tracer.current)
+		tracer.current = nil
+	}
+}
+
+// close writes the last record and closes the trace file.
+func (tracer *filterTracer) close(filePath string) {
+	if tracer == nil {
+		return
+	}
+	tracer.flush()
+	err := tracer.writer.Flush()
+	if closeErr := tracer.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Printf("%s: unable to write trace: %v\n", filePath, err)
+		return
+	}
+	fmt.Printf("%s: %d packets traced to %s\n", filePath, tracer.traced, tracer.path)
+}
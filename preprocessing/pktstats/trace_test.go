@@ -0,0 +1,118 @@
+package pktstats
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseTraceTuple(t *testing.T) {
+	type packet struct {
+		src, dst         string
+		srcPort, dstPort int
+		protocol         int
+	}
+	upstream := packet{"192.168.1.10", "203.0.113.10", 50000, 3478, 17}
+	downstream := packet{"203.0.113.10", "192.168.1.10", 3478, 50000, 17}
+	other := packet{"192.168.1.10", "198.51.100.7", 50100, 443, 6}
+	tests := []struct {
+		tuple   string
+		err     bool
+		matches []packet
+		misses  []packet
+	}{
+		{tuple: "192.168.1.10:50000-203.0.113.10:3478@udp", matches: []packet{upstream, downstream}, misses: []packet{other}},
+		{tuple: "203.0.113.10:3478-192.168.1.10:50000@17", matches: []packet{upstream, downstream}, misses: []packet{other}},
+		{tuple: "192.168.1.10", matches: []packet{upstream, downstream, other}},
+		{tuple: ":443", matches: []packet{other}, misses: []packet{upstream}},
+		{tuple: "192.168.1.10@TCP", matches: []packet{other}, misses: []packet{upstream}},
+		{tuple: "192.168.1.10-198.51.100.7", matches: []packet{other}, misses: []packet{upstream, downstream}},
+		{tuple: "192.168.1.10:3478-203.0.113.10", misses: []packet{upstream, downstream}},
+		{tuple: "192.168.1.10@icmp", err: true},
+		{tuple: "192.168.1.10-203.0.113.10-198.51.100.7", err: true},
+		{tuple: "192.168.1.10:65536", err: true},
+		{tuple: "2001:db8::1", err: true},
+		{tuple: "host.example.com:443", err: true},
+		{tuple: "port 443", err: true},
+	}
+	for _, test := range tests {
+		tuple, err := parseTraceTuple(test.tuple)
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v, want error %v", test.tuple, err, test.err)
+			continue
+		}
+		for _, p := range test.matches {
+			if !tuple.matches(net.ParseIP(p.src), net.ParseIP(p.dst), p.srcPort, p.dstPort, p.protocol) {
+				t.Errorf("%q: misses %+v", test.tuple, p)
+			}
+		}
+		for _, p := range test.misses {
+			if tuple.matches(net.ParseIP(p.src), net.ParseIP(p.dst), p.srcPort, p.dstPort, p.protocol) {
+				t.Errorf("%q: matches %+v", test.tuple, p)
+			}
+		}
+	}
+}
+
+// TestTraceFilter traces the packets of the flows capture selected by a
+// tuple and compares the dispositions written next to the output.
+func TestTraceFilter(t *testing.T) {
+	const store, game = "192.168.1.10:50100-198.51.100.7:443@6", "192.168.1.10:50000-203.0.113.10:3478@17"
+	capture := fixture(t, "flows.pcap", flowsCapture)
+	tests := []struct {
+		name         string
+		filter       string
+		packets      int // -trace-packets
+		numPackets   int // stored per flow
+		dispositions []string
+	}{
+		{"flow", "198.51.100.7:443@tcp", 1000, 0, []string{
+			"stored: first packet of flow " + store,
+			"stored in flow " + store, "stored in flow " + store, "stored in flow " + store,
+			"stored in flow " + store, "stored in flow " + store, "stored in flow " + store, "stored in flow " + store,
+		}},
+		{"bounded", game, 3, 0, []string{
+			"stored: first packet of flow " + game, "stored in flow " + game, "stored in flow " + game,
+		}},
+		{"flow full", game, 3, 2, []string{
+			"stored: first packet of flow " + game, "stored in flow " + game, "counted in flow " + game + ", not stored: flow already holds 2 packets",
+		}},
+		{"no match", "203.0.113.99", 1000, 0, nil},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.TraceFilter, opts.TracePackets = test.filter, test.packets
+		if test.numPackets > 0 {
+			opts.NumPackets = test.numPackets
+		}
+		_, outPath := extractFixture(t, capture, opts)
+		file, err := os.Open(outPath + traceSuffix)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var dispositions []string
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record TraceRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if len(record.Decisions) == 0 || record.Decisions[0].Step != "direction" {
+				t.Errorf("%s: decisions %+v, want the direction first", test.name, record.Decisions)
+			}
+			dispositions = append(dispositions, record.Disposition)
+		}
+		file.Close()
+		if len(dispositions) != len(test.dispositions) {
+			t.Errorf("%s: dispositions %q, want %q", test.name, dispositions, test.dispositions)
+			continue
+		}
+		for i := range dispositions {
+			if dispositions[i] != test.dispositions[i] {
+				t.Errorf("%s: packet %d %q, want %q", test.name, i, dispositions[i], test.dispositions[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package pktstats
+
+import "encoding/binary"
+
+// number of payload-bearing packets inspected before a flow's transport profile is decided
+const transportProfilePackets = 10
+
+// transport profiles assigned by classifyTransport
+const (
+	profileTCPTLS     = "tcp-tls"
+	profileTCPPlain   = "tcp-plain"
+	profileQUIC       = "quic"
+	profileRTP        = "rtp-over-udp"
+	profileDTLSSRTP   = "dtls-srtp"
+	profileUDPUnknown = "udp-unknown"
+)
+
+// transportEvidence counts payload patterns seen in the first payload-bearing
+// packets of a flow.
+type transportEvidence struct {
+	inspected     int
+	tlsHandshake  int // TLS handshake records, e.g. ClientHello
+	tlsRecord     int // any TLS record header
+	quicLong      int // QUIC long header packets
+	dtlsHandshake int // DTLS handshake records (content type 22)
+	dtlsRecord    int // any DTLS record header
+	rtp           int // RTP version 2 headers
+}
+
+func (evidence *transportEvidence) observe(protocol int, payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	evidence.inspected++
+	switch protocol {
+	case 6:
+		if isTLSRecord(payload) {
+			evidence.tlsRecord++
+			if payload[0] == 22 {
+				evidence.tlsHandshake++
+			}
+		}
+	case 17:
+		if isQUICLongHeader(payload) {
+			evidence.quicLong++
+		}
+		if isDTLSRecord(payload) {
+			evidence.dtlsRecord++
+			if payload[0] == 22 {
+				evidence.dtlsHandshake++
+			}
+		}
+		if isRTP(payload) {
+			evidence.rtp++
+		}
+	}
+}
+
+// classifyTransport decides the transport profile of a flow from the evidence
+// collected on its first packets:
+//   - tcp-tls: TCP with a TLS handshake, or mostly TLS records when the capture started mid-flow
+//   - tcp-plain: any other TCP flow
+//   - quic: UDP with QUIC long header packets (Initial/Handshake)
+//   - dtls-srtp: UDP with a DTLS handshake, the key exchange of SRTP media
+//   - rtp-over-udp: UDP where most payloads carry an RTP header
+//   - udp-unknown: any other UDP flow
+func classifyTransport(protocol int, evidence transportEvidence) string {
+	switch protocol {
+	case 6:
+		if evidence.tlsHandshake > 0 || (evidence.inspected > 0 && evidence.tlsRecord*2 > evidence.inspected) {
+			return profileTCPTLS
+		}
+		return profileTCPPlain
+	case 17:
+		switch {
+		case evidence.quicLong > 0:
+			return profileQUIC
+		case evidence.dtlsHandshake > 0:
+			return profileDTLSSRTP
+		case evidence.inspected > 0 && evidence.rtp*2 > evidence.inspected:
+			return profileRTP
+		}
+		return profileUDPUnknown
+	}
+	return ""
+}
+
+// isTLSRecord checks for a TLS record header: content type 20-23 and version 3.x.
+func isTLSRecord(payload []byte) bool {
+	return len(payload) >= 5 && payload[0] >= 20 && payload[0] <= 23 && payload[1] == 3 && payload[2] <= 4
+}
+
+// isDTLSRecord checks for a DTLS record header: content type 20-25 and version 0xfeXX.
+func isDTLSRecord(payload []byte) bool {
+	return len(payload) >= 13 && payload[0] >= 20 && payload[0] <= 25 && payload[1] == 0xfe
+}
+
+// isQUICLongHeader checks for a QUIC long header with a known version.
+func isQUICLongHeader(payload []byte) bool {
+	if len(payload) < 7 || payload[0]&0xc0 != 0xc0 {
+		return false
+	}
+	version := binary.BigEndian.Uint32(payload[1:5])
+	// v1, v2 and IETF drafts
+	return version == 0x00000001 || version == 0x6b3343cf || version&0xffffff00 == 0xff000000
+}
+
+// isQUICInitial checks for a QUIC Initial packet, the long header packet
+// type 0 in v1 and the drafts, 1 in v2.
+func isQUICInitial(payload []byte) bool {
+	if !isQUICLongHeader(payload) {
+		return false
+	}
+	packetType := payload[0] >> 4 & 0x03
+	if binary.BigEndian.Uint32(payload[1:5]) == 0x6b3343cf {
+		return packetType == 1
+	}
+	return packetType == 0
+}
+
+// isRTP checks for an RTP version 2 header, excluding the payload types that
+// collide with RTCP packet types.
+func isRTP(payload []byte) bool {
+	if len(payload) < 12 || payload[0]>>6 != 2 {
+		return false
+	}
+	payloadType := payload[1] & 0x7f
+	return payloadType < 72 || payloadType > 76
+}
@@ -0,0 +1,98 @@
+package pktstats
+
+import (
+	"bytes"
+	"testing"
+)
+
+// payloads of the first packets of flows, by the transport they carry
+var (
+	tlsClientHelloPayload = append([]byte{22, 3, 1, 0, 200, 1}, make([]byte, 200)...)
+	tlsAppDataPayload     = append([]byte{23, 3, 3, 1, 0}, make([]byte, 256)...)
+	quicInitialPayload    = append([]byte{0xc3, 0, 0, 0, 1, 8}, make([]byte, 1200)...)
+	quicV2InitialPayload  = append([]byte{0xd3, 0x6b, 0x33, 0x43, 0xcf, 8}, make([]byte, 1200)...)
+	quicDraftPayload      = append([]byte{0xc3, 0xff, 0, 0, 29, 8}, make([]byte, 1200)...)
+	quicShortPayload      = append([]byte{0x43}, make([]byte, 1000)...)
+	dtlsHelloPayload      = append([]byte{22, 0xfe, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 100}, make([]byte, 100)...)
+	dtlsAppDataPayload    = append([]byte{23, 0xfe, 0xfd, 0, 1, 0, 0, 0, 0, 0, 5, 0, 100}, make([]byte, 100)...)
+	rtpPacketPayload      = append([]byte{0x80, 96, 0, 1, 0, 0, 0, 100, 0, 0, 0, 1}, make([]byte, 1000)...)
+	rtcpPacketPayload     = append([]byte{0x80, 200, 0, 6, 0, 0, 0, 1}, make([]byte, 20)...)
+	plainPayload          = []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	opaquePayload         = bytes.Repeat([]byte{0x17}, 300)
+)
+
+// repeat returns n copies of payload.
+func repeat(payload []byte, n int) [][]byte {
+	payloads := make([][]byte, n)
+	for i := range payloads {
+		payloads[i] = payload
+	}
+	return payloads
+}
+
+func TestClassifyTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol int
+		payloads [][]byte
+		want     string
+	}{
+		{"tls handshake", 6, [][]byte{tlsClientHelloPayload, tlsAppDataPayload}, profileTCPTLS},
+		{"tls mid-flow", 6, append(repeat(tlsAppDataPayload, 3), plainPayload, plainPayload), profileTCPTLS},
+		{"tls records in half the payloads", 6, [][]byte{tlsAppDataPayload, plainPayload}, profileTCPPlain},
+		{"http", 6, repeat(plainPayload, 4), profileTCPPlain},
+		{"tcp without payload", 6, nil, profileTCPPlain},
+		{"empty payloads", 6, repeat(nil, 3), profileTCPPlain},
+		{"quic v1", 17, [][]byte{quicInitialPayload, quicShortPayload, quicShortPayload}, profileQUIC},
+		{"quic v2", 17, [][]byte{quicV2InitialPayload, quicShortPayload}, profileQUIC},
+		{"quic draft", 17, [][]byte{quicDraftPayload}, profileQUIC},
+		{"quic short headers only", 17, repeat(quicShortPayload, 5), profileUDPUnknown},
+		{"quic over rtp", 17, append(repeat(rtpPacketPayload, 5), quicInitialPayload), profileQUIC},
+		{"dtls-srtp", 17, append([][]byte{dtlsHelloPayload, dtlsHelloPayload}, repeat(rtpPacketPayload, 8)...), profileDTLSSRTP},
+		{"dtls without handshake", 17, repeat(dtlsAppDataPayload, 4), profileUDPUnknown},
+		{"rtp", 17, append(repeat(rtpPacketPayload, 9), opaquePayload), profileRTP},
+		{"rtp in half the payloads", 17, [][]byte{rtpPacketPayload, opaquePayload}, profileUDPUnknown},
+		{"rtcp", 17, repeat(rtcpPacketPayload, 5), profileUDPUnknown},
+		{"opaque udp", 17, repeat(opaquePayload, 3), profileUDPUnknown},
+		{"udp without payload", 17, nil, profileUDPUnknown},
+		{"tls on udp", 17, [][]byte{tlsClientHelloPayload}, profileUDPUnknown},
+		{"icmp", 1, [][]byte{opaquePayload}, ""},
+	}
+	for _, test := range tests {
+		var evidence transportEvidence
+		for _, payload := range test.payloads {
+			evidence.observe(test.protocol, payload)
+		}
+		if got := classifyTransport(test.protocol, evidence); got != test.want {
+			t.Errorf("%s: classifyTransport = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// TestTransportProfileStable decides the profile of a flow on its first
+// transportProfilePackets payloads, whatever comes after them, or at the end
+// of flows with fewer.
+func TestTransportProfileStable(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol int
+		payloads [][]byte
+		want     string
+	}{
+		{"rtp then opaque", 17, append(repeat(rtpPacketPayload, transportProfilePackets), repeat(opaquePayload, 50)...), profileRTP},
+		{"opaque then quic", 17, append(repeat(opaquePayload, transportProfilePackets), quicInitialPayload), profileUDPUnknown},
+		{"plain then tls", 6, append(repeat(plainPayload, transportProfilePackets), repeat(tlsClientHelloPayload, 20)...), profileTCPPlain},
+		{"empty payloads not counted", 17, append(repeat(nil, 2*transportProfilePackets), quicInitialPayload), profileQUIC},
+		{"fewer packets", 6, [][]byte{tlsClientHelloPayload}, profileTCPTLS},
+	}
+	for _, test := range tests {
+		flow := &Flow{Protocol: test.protocol}
+		for _, payload := range test.payloads {
+			flow.observe(&Packet{Protocol: test.protocol, PayloadSize: len(payload)}, payload)
+		}
+		flow.finalize()
+		if flow.TransportProfile != test.want {
+			t.Errorf("%s: transport profile %q, want %q", test.name, flow.TransportProfile, test.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package pktstats
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// VersionInfo identifies the binary that produced an output.
+type VersionInfo struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"` // VCS revision the binary was built from
+	Time      string `json:"time,omitempty"`     // VCS commit time
+	Modified  bool   `json:"modified"`           // whether the working tree had uncommitted changes
+	GoVersion string `json:"goVersion"`
+}
+
+// BuildVersion reads the version information embedded in the binary by the Go toolchain.
+func BuildVersion() VersionInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return VersionInfo{Version: "unknown"}
+	}
+	version := VersionInfo{
+		Module:    info.Main.Path,
+		Version:   info.Main.Version,
+		GoVersion: info.GoVersion,
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			version.Revision = setting.Value
+		case "vcs.time":
+			version.Time = setting.Value
+		case "vcs.modified":
+			version.Modified = setting.Value == "true"
+		}
+	}
+	return version
+}
+
+func (version VersionInfo) String() string {
+	s := version.Module + " " + version.Version
+	if version.Revision != "" {
+		s += " (" + version.Revision
+		if version.Modified {
+			s += "-dirty"
+		}
+		s += ")"
+	}
+	return fmt.Sprintf("%s %s", s, version.GoVersion)
+}
@@ -0,0 +1,87 @@
+package pktstats
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// roundTrip writes v as JSON and reads it back into a new value of its type.
+func roundTrip[T any](t *testing.T, v *T) *T {
+	t.Helper()
+	content, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := new(T)
+	if err := json.Unmarshal(content, loaded); err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+// TestMetaRoundTrip reads back the meta block of an extraction: it carries
+// the build version and the effective options, and loads back unchanged.
+func TestMetaRoundTrip(t *testing.T) {
+	opts := testOptions()
+	output, _ := extractFixture(t, fixture(t, "flows.pcap", flowsCapture), opts)
+	meta := output.Meta
+	if meta == nil {
+		t.Fatal("output without a meta block")
+	}
+	if meta.Version != BuildVersion() {
+		t.Errorf("meta version %+v, want %+v", meta.Version, BuildVersion())
+	}
+	if meta.SchemaVersion != schemaVersion {
+		t.Errorf("meta schema version %d, want %d", meta.SchemaVersion, schemaVersion)
+	}
+	if want := roundTrip(t, &opts); !reflect.DeepEqual(meta.Options, *want) {
+		t.Errorf("meta options %+v, want the effective options %+v", meta.Options, *want)
+	}
+	if loaded := roundTrip(t, meta); !reflect.DeepEqual(loaded, meta) {
+		t.Errorf("meta block loads back as %+v, want %+v", loaded, meta)
+	}
+
+	// every field, including those left out when empty
+	populated := schemaOutput().Meta
+	if loaded := roundTrip(t, populated); !reflect.DeepEqual(loaded, populated) {
+		t.Errorf("populated meta block loads back as %+v, want %+v", loaded, populated)
+	}
+}
+
+// TestManifestVersion reads back the build version and options of a run
+// from its manifest.
+func TestManifestVersion(t *testing.T) {
+	dir := t.TempDir()
+	content, err := os.ReadFile(fixture(t, "flows.pcap", flowsCapture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.File, opts.OutputDir = filepath.Join(dir, "flows.pcap"), dir
+	if err := os.WriteFile(opts.File, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	content, err = os.ReadFile(filepath.Join(dir, "run_manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Version != BuildVersion() {
+		t.Errorf("manifest version %+v, want %+v", manifest.Version, BuildVersion())
+	}
+	if manifest.Options.File != opts.File || manifest.Options.Format != opts.Format {
+		t.Errorf("manifest options %+v, want those of the run", manifest.Options)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Status != "processed" {
+		t.Errorf("manifest files %+v, want the capture processed", manifest.Files)
+	}
+}
@@ -0,0 +1,61 @@
+package pktstats
+
+const (
+	// voiceRole is the ServiceFlowType of flows carrying upstream voice chat
+	voiceRole = "voice-upstream"
+	// voiceMinGaps is the number of inter-arrival times of a sustained voice flow, 2s at 20ms pacing
+	voiceMinGaps = 100
+	// voiceMinRegularity is the share of inter-arrival times a voice flow needs at its pacing
+	voiceMinRegularity = 0.5
+	// voiceMaxSizeVariation is the largest coefficient of variation of voice payload sizes
+	voiceMaxSizeVariation = 0.3
+	// rtpDynamicPayloadTypes is the first RTP payload type of the dynamic range, used by Opus
+	rtpDynamicPayloadTypes = 96
+)
+
+// voiceState looks for the upstream packets of voice chat: near-constant
+// sizes paced at the 20, 40 or 60ms frames of codecs such as Opus.
+type voiceState struct {
+	pacing periodicityState
+	// upstream RTP packets in the size range, and those with a dynamic payload type
+	rtpPackets     int
+	dynamicPackets int
+}
+
+func (state *voiceState) observe(packet *Packet, payload []byte) {
+	state.pacing.observe(packet)
+	if !packet.Upstream || len(payload) < state.pacing.minSize || len(payload) > state.pacing.maxSize || !isRTP(payload) {
+		return
+	}
+	state.rtpPackets++
+	if payload[1]&0x7f >= rtpDynamicPayloadTypes {
+		state.dynamicPackets++
+	}
+}
+
+// classifyVoice tags UDP flows whose upstream packets in the voice size range
+// are sustained, paced at a frequency in one of the bands and near-constant in
+// size as voice flows. When most of those packets carry RTP headers, most must
+// use a dynamic payload type, as Opus does. Flows already tagged as input are
+// kept.
+func (flow *Flow) classifyVoice(bands []frequencyBand) {
+	state := &flow.voice
+	if len(bands) == 0 || flow.ServiceFlowType == inputRole || state.pacing.gaps < voiceMinGaps {
+		return
+	}
+	frequency, regularity, ok := state.pacing.estimate()
+	if !ok || regularity < voiceMinRegularity || state.pacing.sizeVariation() > voiceMaxSizeVariation {
+		return
+	}
+	if state.rtpPackets*2 > state.pacing.packets && state.dynamicPackets*2 <= state.rtpPackets {
+		return
+	}
+	for _, band := range bands {
+		if band.contains(frequency) {
+			flow.ServiceFlowType = voiceRole
+			flow.LabelSource = labelVoice
+			flow.LabelConfidence = regularity
+			return
+		}
+	}
+}
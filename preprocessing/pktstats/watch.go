@@ -0,0 +1,84 @@
+package pktstats
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// watchedFile is a capture file seen by watchInputs that was not dispatched yet.
+type watchedFile struct {
+	size        int64
+	modTime     time.Time
+	stableSince time.Time
+}
+
+// watchInputs polls basePath for pcapng files every Options.WatchInterval
+// until SIGTERM or SIGINT, and dispatches each file once, when it is complete:
+// its size did not change for Options.WatchGrace, or a newer capture file
+// appeared in its directory (the capture rotated). checkpoint is called after
+// each poll. Files dispatched before the signal are finished by the caller.
+func watchInputs(basePath string, opts Options, process func(string), checkpoint func()) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	fmt.Println("========== Watching: " + basePath + " ==========")
+	pending := make(map[string]*watchedFile)
+	dispatched := make(map[string]bool)
+	ticker := time.NewTicker(opts.WatchInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		// newest capture file of each directory, possibly still being written
+		newest := make(map[string]time.Time)
+		err := filepath.WalkDir(basePath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !isCaptureFile(path) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if dir := filepath.Dir(path); info.ModTime().After(newest[dir]) {
+				newest[dir] = info.ModTime()
+			}
+			if dispatched[path] {
+				return nil
+			}
+			file, ok := pending[path]
+			if !ok || file.size != info.Size() {
+				pending[path] = &watchedFile{size: info.Size(), modTime: info.ModTime(), stableSince: now}
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println("Error walking the path:", err)
+		}
+		paths := make([]string, 0, len(pending))
+		for path := range pending {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			file := pending[path]
+			rotated := file.modTime.Before(newest[filepath.Dir(path)])
+			if rotated || now.Sub(file.stableSince) >= opts.WatchGrace {
+				delete(pending, path)
+				dispatched[path] = true
+				process(path)
+			}
+		}
+		checkpoint()
+		select {
+		case <-ctx.Done():
+			fmt.Println("========== Stopping watch, finishing files in progress ==========")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package pktstats
+
+// Treatments of zero-payload packets (pure ACKs, SYNs, FINs), see Options.ZeroPayload.
+const (
+	zeroPayloadKeep         = "keep"          // stored and counted like other packets
+	zeroPayloadExcludeStats = "exclude-stats" // stored, left out of size and inter-arrival statistics
+	zeroPayloadAggregate    = "aggregate"     // counted per flow in Flow.ZeroPayload, not stored
+)
+
+var zeroPayloadModes = []string{zeroPayloadKeep, zeroPayloadExcludeStats, zeroPayloadAggregate}
+
+// EmptyPackets counts the zero-payload packets of a flow that are not
+// stored with the aggregate mode. The first packet of a flow is always stored,
+// as it records the start of the flow.
+type EmptyPackets struct {
+	UpPackets   int   `json:"upPackets"`
+	DownPackets int   `json:"downPackets"`
+	Bytes       int64 `json:"bytes"`
+}
+
+func (counts *EmptyPackets) add(packet *Packet) {
+	if packet.Upstream {
+		counts.UpPackets++
+	} else {
+		counts.DownPackets++
+	}
+	counts.Bytes += int64(packet.PktLength)
+}
+
+// totals returns the packets and bytes of a flow: its stored packets and the
+// zero-payload packets it aggregated.
+func (flow *Flow) totals() (packets int, bytes int64) {
+	packets = len(flow.Packets)
+	for _, packet := range flow.Packets {
+		bytes += int64(packet.PktLength)
+	}
+	if flow.ZeroPayload != nil {
+		packets += flow.ZeroPayload.UpPackets + flow.ZeroPayload.DownPackets
+		bytes += flow.ZeroPayload.Bytes
+	}
+	return packets, bytes
+}
+
+func isZeroPayloadMode(mode string) bool {
+	for _, m := range zeroPayloadModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// zeroPayloadMode returns the treatment of zero-payload packets of an output,
+// zeroPayloadKeep for outputs written before it was configurable.
+func (meta *Meta) zeroPayloadMode() string {
+	if meta.ZeroPayload == "" {
+		return zeroPayloadKeep
+	}
+	return meta.ZeroPayload
+}
@@ -0,0 +1,111 @@
+package pktstats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const (
+	// bursts of zeroPayloadCapture, each of burstSegments data segments
+	zeroPayloadBursts = 10
+	burstSegments     = 5
+	segmentSize       = 1000
+	// on the wire: Ethernet, IPv4 and TCP headers, and empty segments padded
+	// to the minimum Ethernet frame
+	dataSegmentLength  = 14 + 20 + 20 + segmentSize
+	emptySegmentLength = 60
+)
+
+// zeroPayloadCapture is a TCP connection downloading in bursts: each burst
+// of data segments ends with a window update of the server and is
+// acknowledged by a pure ACK of the client, between the handshake and the
+// close of the connection.
+func zeroPayloadCapture(t testing.TB) []fixturePacket {
+	const client, server = "192.168.1.10", "203.0.113.10"
+	up := func(at time.Duration, flags string, seq, ack uint32) fixturePacket {
+		return fixturePacket{at: at, data: tcpPacket(t, client, 50000, server, 443, flags, seq, ack, nil)}
+	}
+	down := func(at time.Duration, flags string, seq, ack uint32, payload []byte) fixturePacket {
+		return fixturePacket{at: at, data: tcpPacket(t, server, 443, client, 50000, flags, seq, ack, payload)}
+	}
+	packets := []fixturePacket{
+		{at: 0, data: dnsResponse(t, "192.168.1.1", 53, client, "eu1.game.example.com", server)},
+		up(time.Millisecond, "S", 0, 0),
+		down(2*time.Millisecond, "SA", 0, 1, nil),
+		up(3*time.Millisecond, "A", 1, 1),
+	}
+	seq := uint32(1)
+	for burst := 0; burst < zeroPayloadBursts; burst++ {
+		start := time.Duration(burst+1) * 10 * time.Millisecond
+		for segment := 0; segment < burstSegments; segment++ {
+			packets = append(packets, down(start+time.Duration(segment)*100*time.Microsecond, "PA", seq, 1, make([]byte, segmentSize)))
+			seq += segmentSize
+		}
+		packets = append(packets,
+			down(start+burstSegments*100*time.Microsecond, "A", seq, 1, nil),
+			up(start+time.Millisecond, "A", 1, seq),
+		)
+	}
+	end := time.Duration(zeroPayloadBursts+1) * 10 * time.Millisecond
+	return append(packets,
+		up(end, "FA", 1, seq),
+		down(end+time.Millisecond, "FA", seq, 2, nil),
+		up(end+2*time.Millisecond, "A", 2, seq+1),
+	)
+}
+
+func TestZeroPayloadModes(t *testing.T) {
+	capture := fixture(t, "zeropayload.pcap", zeroPayloadCapture)
+	const (
+		dataPackets = zeroPayloadBursts * burstSegments
+		// the handshake, a window update and an ACK per burst, and the close
+		emptyUp   = 2 + zeroPayloadBursts + 2
+		emptyDown = 1 + zeroPayloadBursts + 1
+		packets   = dataPackets + emptyUp + emptyDown
+		bytes     = dataPackets*dataSegmentLength + (emptyUp+emptyDown)*emptySegmentLength
+	)
+	// bottleneck rates of the bursts: the bytes after their first packet
+	// over their dispersion, with and without the window update ending them
+	withEmpty := float64((burstSegments-1)*dataSegmentLength+emptySegmentLength) * 8 / float64(burstSegments*100)
+	withoutEmpty := float64((burstSegments-1)*dataSegmentLength) * 8 / float64((burstSegments-1)*100)
+
+	tests := []struct {
+		mode       string
+		stored     int
+		aggregated *EmptyPackets
+		bottleneck float64 // Mbps
+	}{
+		{zeroPayloadKeep, packets, nil, withEmpty},
+		{zeroPayloadExcludeStats, packets, nil, withoutEmpty},
+		// the SYN opening the flow is stored
+		{zeroPayloadAggregate, dataPackets + 1, &EmptyPackets{UpPackets: emptyUp - 1, DownPackets: emptyDown, Bytes: (emptyUp + emptyDown - 1) * emptySegmentLength}, withoutEmpty},
+	}
+	for _, test := range tests {
+		opts := testOptions()
+		opts.ZeroPayload = test.mode
+		output, _ := extractFixture(t, capture, opts)
+		if output.Meta.ZeroPayload != test.mode {
+			t.Errorf("%s: meta block records mode %q", test.mode, output.Meta.ZeroPayload)
+		}
+		flow := output.Flows["192.168.1.10:50000-203.0.113.10:443@6"]
+		if flow == nil {
+			t.Fatalf("%s: TCP flow not extracted", test.mode)
+		}
+		if len(flow.Packets) != test.stored {
+			t.Errorf("%s: %d packets stored, want %d", test.mode, len(flow.Packets), test.stored)
+		}
+		if (flow.ZeroPayload == nil) != (test.aggregated == nil) || (flow.ZeroPayload != nil && *flow.ZeroPayload != *test.aggregated) {
+			t.Errorf("%s: zero-payload packets aggregated as %+v, want %+v", test.mode, flow.ZeroPayload, test.aggregated)
+		}
+		if got, gotBytes := flow.totals(); got != packets || gotBytes != bytes {
+			t.Errorf("%s: flow totals %d packets %d bytes, want %d packets %d bytes", test.mode, got, gotBytes, packets, bytes)
+		}
+		if service := output.Meta.Services["example.com"]; service == nil || service.Packets != packets || service.Bytes != bytes {
+			t.Errorf("%s: service rollup %+v, want %d packets %d bytes", test.mode, service, packets, bytes)
+		}
+		if flow.BottleneckMbps == nil || flow.BottleneckMbps.Bursts != zeroPayloadBursts || math.Abs(flow.BottleneckMbps.P50Mbps-test.bottleneck) > 0.01 {
+			t.Errorf("%s: bottleneck rates %+v, want %d bursts at %.2f Mbps", test.mode, flow.BottleneckMbps, zeroPayloadBursts, test.bottleneck)
+		}
+	}
+}